@@ -1,5 +1,10 @@
 package agent
 
+import (
+	"github.com/buildkite/agent/v3/cgroup"
+	"github.com/buildkite/agent/v3/process"
+)
+
 // AgentConfiguration is the run-time configuration for an agent that
 // has been loaded from the config file and command-line params
 type AgentConfiguration struct {
@@ -7,6 +12,7 @@ type AgentConfiguration struct {
 	BootstrapScript            string
 	BuildPath                  string
 	HooksPath                  string
+	HooksBundle                *HooksBundle
 	SocketsPath                string
 	GitMirrorsPath             string
 	GitMirrorsLockTimeout      int
@@ -17,6 +23,14 @@ type AgentConfiguration struct {
 	GitCloneMirrorFlags        string
 	GitCleanFlags              string
 	GitFetchFlags              string
+	GitCheckoutRetries         int
+	GitCheckoutRetryBackoff    string
+	GitCheckoutCleanOn         []string
+	GitRemoteFallbacks         []string
+	GitCheckoutLayout          string
+	GitSubmoduleCredentials    []string
+	GitSubmoduleConcurrency    int
+	GitLFSSkipSmudge           bool
 	GitSubmodules              bool
 	SSHKeyscan                 bool
 	CommandEval                bool
@@ -28,9 +42,27 @@ type AgentConfiguration struct {
 	HealthCheckAddr            string
 	DisconnectAfterJob         bool
 	DisconnectAfterIdleTimeout int
+	MaintenanceWindows         []MaintenanceWindow
 	CancelGracePeriod          int
+	CancelSignalTarget         process.SignalTarget
+	ReapOrphanedProcesses      bool
+	AnnotateJobResources       bool
+	JobResourceLimits          cgroup.Limits
+	JobCgroupParent            string
+	ScratchPath                string
+	ScratchTmpfsSize           uint64
+	DockerProxySocket          string
+	UsagePath                  string
+	JobStatusFile              string
+	ArtifactPostProcessors     string
+	ArtifactSigningKey         string
+	ArtifactURLRewrites        string
+	ArtifactDefaultDestination string
+	MetaDataEncryptionKeyFile  string
+	TagsEnv                    map[string]string
 	EnableJobLogTmpfile        bool
 	WriteJobLogsToStdout       bool
+	JobLogFilter               JobLogFilterConfig
 	LogFormat                  string
 	Shell                      string
 	Profile                    string
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/system"
+)
+
+// artifactUploadHeader is the header the bootstrap prints while it's
+// uploading a job's artifacts
+const artifactUploadHeader = "Uploading artifacts"
+
+// AgentStatus is what an agent worker last reported about itself. Workers
+// write it to a file in the build path each time they heartbeat, so that
+// buildkite-agent status can read it.
+type AgentStatus struct {
+	Name      string          `json:"name"`
+	PID       int             `json:"pid"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Health    api.AgentHealth `json:"health"`
+}
+
+// AgentStatusDir returns the directory that agents using buildPath write
+// their status files to.
+func AgentStatusDir(buildPath string) string {
+	return filepath.Join(buildPath, ".buildkite-agent-status")
+}
+
+// ReadAgentStatuses reads the status files of the agents using buildPath,
+// sorted by agent name. Files that can't be read are skipped.
+func ReadAgentStatuses(buildPath string) ([]AgentStatus, error) {
+	paths, err := filepath.Glob(filepath.Join(AgentStatusDir(buildPath), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []AgentStatus{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var status AgentStatus
+		if err := json.Unmarshal(b, &status); err != nil {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+// HostHealth measures the health of the host, using the filesystem that
+// buildPath is on for disk space. Anything that can't be measured is left
+// empty.
+func HostHealth(buildPath string) api.AgentHealth {
+	var health api.AgentHealth
+
+	if buildPath != "" {
+		if free, total, err := system.DiskUsage(buildPath); err == nil {
+			health.DiskFreeBytes, health.DiskTotalBytes = free, total
+		}
+	}
+
+	if loads, err := system.LoadAverage(); err == nil {
+		health.LoadAverage = loads
+	}
+
+	return health
+}
+
+// health returns the health of the host and what the worker is doing.
+func (a *AgentWorker) health() *api.AgentHealth {
+	health := HostHealth(a.agentConfiguration.BuildPath)
+
+	a.stats.Lock()
+	jr := a.stats.currentJob
+	a.stats.Unlock()
+
+	if jr != nil {
+		health.JobID = jr.JobID()
+		health.JobPhase = jr.Phase()
+		health.ArtifactTransfer = jr.ArtifactTransfer()
+	}
+
+	return &health
+}
+
+func (a *AgentWorker) statusFilePath() string {
+	if a.agentConfiguration.BuildPath == "" {
+		return ""
+	}
+
+	// Agent names can contain characters that aren't allowed in file names
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '-'
+		}
+		return r
+	}, a.registration().Name)
+
+	return filepath.Join(AgentStatusDir(a.agentConfiguration.BuildPath), name+".json")
+}
+
+// writeStatusFile records the worker's health for buildkite-agent status.
+func (a *AgentWorker) writeStatusFile(health *api.AgentHealth) error {
+	path := a.statusFilePath()
+	if path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(AgentStatus{
+		Name:      a.registration().Name,
+		PID:       os.Getpid(),
+		UpdatedAt: time.Now().UTC(),
+		Health:    *health,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return fmt.Errorf("creating status directory: %w", err)
+	}
+
+	// Write to a temporary file and rename it into place, so that readers
+	// never see a partially written file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeStatusFile removes the worker's status file when it disconnects.
+func (a *AgentWorker) removeStatusFile() {
+	if path := a.statusFilePath(); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			a.logger.Warn("Failed to remove status file: %v", err)
+		}
+	}
+}
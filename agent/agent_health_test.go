@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentStatusFile(t *testing.T) {
+	t.Parallel()
+
+	buildPath := t.TempDir()
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{Name: "llama/1"},
+		agentConfiguration: AgentConfiguration{BuildPath: buildPath},
+	}
+
+	health := worker.health()
+	assert.Empty(t, health.JobID)
+
+	health.JobID = "job-1"
+	health.JobPhase = artifactUploadHeader
+	health.ArtifactTransfer = true
+	assert.NoError(t, worker.writeStatusFile(health))
+
+	statuses, err := ReadAgentStatuses(buildPath)
+	assert.NoError(t, err)
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "llama/1", statuses[0].Name)
+		assert.Equal(t, *health, statuses[0].Health)
+	}
+
+	worker.removeStatusFile()
+
+	statuses, err = ReadAgentStatuses(buildPath)
+	assert.NoError(t, err)
+	assert.Empty(t, statuses)
+}
+
+func TestHeaderText(t *testing.T) {
+	t.Parallel()
+
+	for line, want := range map[string]string{
+		"~~~ Running commands":                   "Running commands",
+		"\x1b[90m--- Uploading artifacts\x1b[0m": "Uploading artifacts",
+		"not a header":                           "",
+	} {
+		assert.Equal(t, want, headerText(line), "headerText(%q)", line)
+	}
+}
@@ -15,8 +15,10 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/agent/v3/status"
 	"github.com/buildkite/roko"
+	"golang.org/x/time/rate"
 )
 
 type AgentWorkerConfig struct {
@@ -37,6 +39,24 @@ type AgentWorkerConfig struct {
 
 	// Stdout of the parent agent process. Used for job log stdout writing arg, for simpler containerized log collection.
 	AgentStdout io.Writer
+
+	// If set, the agent registers again with this when Buildkite stops
+	// accepting its access token, such as when the agent token it registered
+	// with is revoked, rather than disconnecting. It's given the agent's
+	// current tags, which remote control may have changed.
+	Reregister func(ctx context.Context, tags []string) (*api.AgentRegisterResponse, error)
+
+	// Limits how fast job logs are uploaded, shared by every worker. If nil,
+	// there's no limit
+	LogUploadLimiter *rate.Limiter
+
+	// The tags-env mappings, to render the job environment again when
+	// Buildkite updates the agent's tags
+	TagsEnvMappings []string
+
+	// Records the remote control actions the agent is sent. If nil, they're
+	// only logged
+	RemoteControlAuditLog *RemoteControlAuditLog
 }
 
 type agentStats struct {
@@ -47,6 +67,9 @@ type agentStats struct {
 
 	// The last error that occurred during heartbeat, or nil if it was successful
 	lastHeartbeatError error
+
+	// The job that's running, if there is one
+	currentJob jobRunner
 }
 
 type AgentWorker struct {
@@ -55,6 +78,12 @@ type AgentWorker struct {
 	// The API Client used when this agent is communicating with the API
 	apiClient APIClient
 
+	// Guards apiClient and agent, which the ping and heartbeat loops both
+	// use, and which registering again or switching endpoints replaces. The
+	// registration is replaced rather than changed in place, so a copy of
+	// the pointer is safe to read from
+	connMu sync.RWMutex
+
 	// The logger instance to use
 	logger logger.Logger
 
@@ -91,6 +120,13 @@ type AgentWorker struct {
 	// JobRunner here
 	jobRunner jobRunner
 
+	// Whether the worker is in a maintenance window, and isn't accepting jobs
+	inMaintenance bool
+
+	// See AgentWorkerConfig
+	tagsEnvMappings       []string
+	remoteControlAuditLog *RemoteControlAuditLog
+
 	// retrySleepFunc is useful for testing retry loops fast
 	// Hopefully this can be replaced with a global setting for tests in future:
 	// https://github.com/buildkite/roko/issues/2
@@ -98,6 +134,14 @@ type AgentWorker struct {
 
 	// Stdout of the parent agent process. Used for job log stdout writing arg, for simpler containerized log collection.
 	agentStdout io.Writer
+
+	// Registers the agent again when its access token is rejected, and the
+	// lock that stops the ping and heartbeat loops both doing it
+	reregisterFunc func(context.Context, []string) (*api.AgentRegisterResponse, error)
+	reregisterMu   sync.Mutex
+
+	// Limits how fast job logs are uploaded
+	logUploadLimiter *rate.Limiter
 }
 
 type errUnrecoverable struct {
@@ -124,10 +168,37 @@ func (e *errUnrecoverable) Unwrap() error {
 	return e.err
 }
 
+// client returns the API client the worker is using now
+func (a *AgentWorker) client() APIClient {
+	a.connMu.RLock()
+	defer a.connMu.RUnlock()
+	return a.apiClient
+}
+
+// registration returns the agent's registration. It mustn't be changed, use
+// updateRegistration instead
+func (a *AgentWorker) registration() *api.AgentRegisterResponse {
+	a.connMu.RLock()
+	defer a.connMu.RUnlock()
+	return a.agent
+}
+
+// updateRegistration replaces the registration with a copy that update has
+// been applied to
+func (a *AgentWorker) updateRegistration(update func(*api.AgentRegisterResponse)) {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	reg := *a.agent
+	update(&reg)
+	a.agent = &reg
+}
+
 // Creates the agent worker and initializes its API Client
 func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Collector, apiClient APIClient, c AgentWorkerConfig) *AgentWorker {
 	return &AgentWorker{
-		logger:             l,
+		// A copy of the logger, so remote control can set the level of
+		// this worker's logs without changing the other workers'
+		logger:             l.WithFields(),
 		agent:              a,
 		metricsCollector:   m,
 		apiClient:          apiClient.FromAgentRegisterResponse(a),
@@ -139,6 +210,11 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 		spawnIndex:         c.SpawnIndex,
 		retrySleepFunc:     time.Sleep, // https://github.com/buildkite/roko/issues/2
 		agentStdout:        c.AgentStdout,
+		reregisterFunc:     c.Reregister,
+		logUploadLimiter:   c.LogUploadLimiter,
+
+		tagsEnvMappings:       c.TagsEnvMappings,
+		remoteControlAuditLog: c.RemoteControlAuditLog,
 	}
 }
 
@@ -166,7 +242,7 @@ func (a *AgentWorker) statusCallback(context.Context) (any, error) {
 // Starts the agent worker
 func (a *AgentWorker) Start(ctx context.Context, idleMonitor *IdleMonitor) error {
 	a.metrics = a.metricsCollector.Scope(metrics.Tags{
-		"agent_name": a.agent.Name,
+		"agent_name": a.registration().Name,
 	})
 
 	ctx, done := status.AddItem(ctx, fmt.Sprintf("Worker %d", a.spawnIndex), workerStatusPart, a.statusCallback)
@@ -208,7 +284,7 @@ func (a *AgentWorker) Start(ctx context.Context, idleMonitor *IdleMonitor) error
 		// there's really no point in letting the idle monitor know
 		// we're busy, but it's probably a good thing to do for good
 		// measure.
-		idleMonitor.MarkBusy(a.agent.UUID)
+		idleMonitor.MarkBusy(a.registration().UUID)
 
 		return a.AcquireAndRunJob(ctx, a.agentConfiguration.AcquireJob)
 	}
@@ -221,7 +297,7 @@ func (a *AgentWorker) runHeartbeatLoop(ctx context.Context) {
 	defer done()
 	setStat("🏃 Starting...")
 
-	heartbeatInterval := time.Second * time.Duration(a.agent.HeartbeatInterval)
+	heartbeatInterval := time.Second * time.Duration(a.registration().HeartbeatInterval)
 	heartbeatTicker := time.NewTicker(heartbeatInterval)
 	defer heartbeatTicker.Stop()
 	for {
@@ -260,7 +336,7 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 	setStat("🏃 Starting...")
 
 	// Create the ticker
-	pingInterval := time.Second * time.Duration(a.agent.PingInterval)
+	pingInterval := time.Second * time.Duration(a.registration().PingInterval)
 	pingTicker := time.NewTicker(pingInterval)
 	defer pingTicker.Stop()
 
@@ -269,7 +345,9 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 
 	// Continue this loop until the closing of the stop channel signals termination
 	for {
-		if !a.stopping {
+		// Buildkite assigns jobs to agents that ping, so the agent doesn't
+		// during maintenance windows, and the status says when they end
+		if !a.stopping && !a.checkMaintenance(time.Now(), setStat) {
 			setStat("📡 Pinging Buildkite for work")
 			job, err := a.Ping(ctx)
 			if err != nil {
@@ -281,7 +359,7 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 			} else if job != nil {
 				// Let other agents know this agent is now busy and
 				// not to idle terminate
-				idleMonitor.MarkBusy(a.agent.UUID)
+				idleMonitor.MarkBusy(a.registration().UUID)
 				setStat("💼 Accepting job")
 
 				// Runs the job, only errors if something goes wrong
@@ -317,7 +395,7 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 				if time.Now().After(idleDeadline) {
 					// Let other agents know this agent is now idle and termination
 					// is possible
-					idleMonitor.MarkIdle(a.agent.UUID)
+					idleMonitor.MarkIdle(a.registration().UUID)
 
 					// But only terminate if everyone else is also idle
 					if idleMonitor.Idle() {
@@ -343,6 +421,30 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 	}
 }
 
+// checkMaintenance reports whether now is within one of the agent's
+// maintenance windows, logging when the agent enters and leaves them. The
+// agent stays connected and heartbeating during maintenance, but doesn't
+// ping for new jobs.
+func (a *AgentWorker) checkMaintenance(now time.Time, setStat func(string)) bool {
+	for _, window := range a.agentConfiguration.MaintenanceWindows {
+		if active, end := window.Active(now); active {
+			if !a.inMaintenance {
+				a.logger.Info("Entering maintenance window (%s). No new jobs will be accepted until %s",
+					window, end.Format(time.RFC3339))
+				a.inMaintenance = true
+			}
+			setStat(fmt.Sprintf("🔧 In maintenance window until %s", end.Format(time.RFC3339)))
+			return true
+		}
+	}
+
+	if a.inMaintenance {
+		a.logger.Info("Maintenance window has ended. Waiting for work...")
+		a.inMaintenance = false
+	}
+	return false
+}
+
 // Stops the agent from accepting new work and cancels any current work it's
 // running
 func (a *AgentWorker) Stop(graceful bool) {
@@ -402,26 +504,80 @@ func (a *AgentWorker) Connect(ctx context.Context) error {
 	return roko.NewRetrier(
 		roko.WithMaxAttempts(10),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
-		_, err := a.apiClient.Connect(ctx)
+	).DoWithContext(ctx, retrylog.Wrap("Connecting agent", func(r *roko.Retrier) error {
+		_, err := a.client().Connect(ctx)
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, r)
 		}
 		return err
-	})
+	}))
+}
+
+// reregister registers the agent again when Buildkite rejects the access token
+// of the failed client, and switches to the new registration. It returns
+// whether the agent has a registration that's worth trying again with, which
+// it also does when the other loop has already registered again.
+func (a *AgentWorker) reregister(ctx context.Context, failed APIClient) bool {
+	if a.reregisterFunc == nil {
+		return false
+	}
+
+	a.reregisterMu.Lock()
+	defer a.reregisterMu.Unlock()
+
+	if a.client() != failed {
+		return true
+	}
+
+	a.logger.Warn("Buildkite rejected the agent's access token. Registering again...")
+	// Register with the tags the agent has now, so any that were changed
+	// remotely aren't undone
+	tags := a.registration().Tags
+	registered, err := a.reregisterFunc(ctx, tags)
+	if err != nil {
+		a.logger.Error("Failed to register again: %v", err)
+		return false
+	}
+	if len(registered.Tags) == 0 {
+		registered.Tags = tags
+	}
+
+	a.connMu.Lock()
+	a.agent = registered
+	a.apiClient = a.apiClient.FromAgentRegisterResponse(registered)
+	a.connMu.Unlock()
+
+	if err := a.Connect(ctx); err != nil {
+		a.logger.Error("Failed to connect after registering again: %v", err)
+		return false
+	}
+
+	a.logger.Info("Registered again as %q", registered.Name)
+	return true
 }
 
 // Performs a heatbeat
 func (a *AgentWorker) Heartbeat(ctx context.Context) error {
 	var beat *api.Heartbeat
 
+	health := a.health()
+	if err := a.writeStatusFile(health); err != nil {
+		a.logger.Warn("Failed to write status file: %v", err)
+	}
+
 	// Retry the heartbeat a few times
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(10),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
-		b, resp, err := a.apiClient.Heartbeat(ctx)
+		roko.WithSleepFunc(a.retrySleepFunc),
+	).DoWithContext(ctx, retrylog.Wrap("Sending heartbeat", func(r *roko.Retrier) error {
+		client := a.client()
+		b, resp, err := client.Heartbeat(ctx, health)
 		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized && a.reregister(ctx, client) {
+				a.logger.Warn("%s (%s)", err, r)
+				return err
+			}
 			if resp != nil && !api.IsRetryableStatus(resp) {
 				a.Stop(false)
 				r.Break()
@@ -433,7 +589,7 @@ func (a *AgentWorker) Heartbeat(ctx context.Context) error {
 		}
 		beat = b
 		return nil
-	})
+	}))
 
 	a.stats.Lock()
 	defer a.stats.Unlock()
@@ -454,7 +610,8 @@ func (a *AgentWorker) Heartbeat(ctx context.Context) error {
 // Performs a ping that checks Buildkite for a job or action to take
 // Returns a job, or nil if none is found
 func (a *AgentWorker) Ping(ctx context.Context) (*api.Job, error) {
-	ping, resp, pingErr := a.apiClient.Ping(ctx)
+	client := a.client()
+	ping, resp, pingErr := client.Ping(ctx)
 	// wait a minute, where's my if err != nil block? TL;DR look for pingErr ~20 lines down
 	// the api client returns an error if the response code isn't a 2xx, but there's still information in resp and ping
 	// that we need to check out to do special handling for specific error codes or messages in the response body
@@ -474,6 +631,12 @@ func (a *AgentWorker) Ping(ctx context.Context) (*api.Job, error) {
 	}
 
 	if pingErr != nil {
+		// If Buildkite no longer accepts the agent's access token, it might
+		// be able to register again and carry on from the next ping
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized && a.reregister(ctx, client) {
+			return nil, nil
+		}
+
 		// If the ping has a non-retryable status, we have to kill the agent, there's no way of recovering
 		// The reason we do this after the disconnect check is because the backend can (and does) send disconnect actions in
 		// responses with non-retryable statuses
@@ -500,9 +663,12 @@ func (a *AgentWorker) Ping(ctx context.Context) (*api.Job, error) {
 	a.stats.lastPing = time.Now()
 	a.stats.Unlock()
 
+	// Is Buildkite controlling the agent remotely, such as pausing it?
+	a.handleRemoteControl(ping)
+
 	// Should we switch endpoints?
-	if ping.Endpoint != "" && ping.Endpoint != a.agent.Endpoint {
-		newAPIClient := a.apiClient.FromPing(ping)
+	if ping.Endpoint != "" && ping.Endpoint != a.registration().Endpoint {
+		newAPIClient := client.FromPing(ping)
 
 		// Before switching to the new one, do a ping test to make sure it's
 		// valid. If it is, switch and carry on, otherwise ignore the switch
@@ -511,9 +677,14 @@ func (a *AgentWorker) Ping(ctx context.Context) (*api.Job, error) {
 			a.logger.Warn("Failed to ping the new endpoint %s - ignoring switch for now (%s)", ping.Endpoint, err)
 		} else {
 			// Replace the APIClient and process the new ping
+			a.connMu.Lock()
 			a.apiClient = newAPIClient
-			a.agent.Endpoint = ping.Endpoint
+			a.connMu.Unlock()
+			a.updateRegistration(func(reg *api.AgentRegisterResponse) {
+				reg.Endpoint = ping.Endpoint
+			})
 			ping = newPing
+			a.handleRemoteControl(ping)
 		}
 	}
 
@@ -551,7 +722,7 @@ func (a *AgentWorker) AcquireAndRunJob(ctx context.Context, jobId string) error
 		roko.WithMaxAttempts(10),
 		roko.WithStrategy(roko.Constant(3*time.Second)),
 		roko.WithSleepFunc(a.retrySleepFunc),
-	).DoWithContext(timeoutCtx, func(r *roko.Retrier) error {
+	).DoWithContext(timeoutCtx, retrylog.Wrap("Pinging for work", func(r *roko.Retrier) error {
 		// If this agent has been asked to stop, don't even bother
 		// doing any retry checks and just bail.
 		if a.stopping {
@@ -561,7 +732,7 @@ func (a *AgentWorker) AcquireAndRunJob(ctx context.Context, jobId string) error
 		var err error
 		var response *api.Response
 
-		acquiredJob, response, err = a.apiClient.AcquireJob(
+		acquiredJob, response, err = a.client().AcquireJob(
 			timeoutCtx, jobId,
 			api.Header{Name: "X-Buildkite-Lock-Acquire-Job", Value: "1"},
 			api.Header{Name: "X-Buildkite-Backoff-Sequence", Value: fmt.Sprintf("%d", r.AttemptCount())},
@@ -591,7 +762,7 @@ func (a *AgentWorker) AcquireAndRunJob(ctx context.Context, jobId string) error
 		}
 
 		return nil
-	})
+	}))
 
 	// If `acquiredJob` is nil, then the job was never acquired
 	if acquiredJob == nil {
@@ -613,9 +784,9 @@ func (a *AgentWorker) AcceptAndRunJob(ctx context.Context, job *api.Job) error {
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(30),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Accepting job", func(r *roko.Retrier) error {
 		var err error
-		accepted, _, err = a.apiClient.AcceptJob(ctx, job)
+		accepted, _, err = a.client().AcceptJob(ctx, job)
 		if err != nil {
 			if api.IsRetryableError(err) {
 				a.logger.Warn("%s (%s)", err, r)
@@ -626,7 +797,7 @@ func (a *AgentWorker) AcceptAndRunJob(ctx context.Context, job *api.Job) error {
 		}
 
 		return err
-	})
+	}))
 
 	// If `accepted` is nil, then the job was never accepted
 	if accepted == nil {
@@ -647,20 +818,27 @@ func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error
 	})
 
 	// Now that we've got a job to do, we can start it.
-	jr, err := NewJobRunner(a.logger, jobMetricsScope, a.agent, acceptResponse, a.apiClient, JobRunnerConfig{
+	jr, err := NewJobRunner(a.logger, jobMetricsScope, a.registration(), acceptResponse, a.client(), JobRunnerConfig{
 		Debug:              a.debug,
 		DebugHTTP:          a.debugHTTP,
 		CancelSignal:       a.cancelSig,
 		AgentConfiguration: a.agentConfiguration,
 		AgentStdout:        a.agentStdout,
+		LogUploadLimiter:   a.logUploadLimiter,
 	})
 	if err != nil {
 		return fmt.Errorf("Failed to initialize job: %v", err)
 	}
 	a.jobRunner = jr
+	a.stats.Lock()
+	a.stats.currentJob = jr
+	a.stats.Unlock()
 	defer func() {
 		// No more job, no more runner.
 		a.jobRunner = nil
+		a.stats.Lock()
+		a.stats.currentJob = nil
+		a.stats.Unlock()
 	}()
 
 	// Start running the job
@@ -676,17 +854,19 @@ func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error
 // disconnect as fast as possible.
 func (a *AgentWorker) Disconnect(ctx context.Context) error {
 	a.logger.Info("Disconnecting...")
+	a.removeStatusFile()
+
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(4),
 		roko.WithStrategy(roko.Constant(1*time.Second)),
 		roko.WithSleepFunc(a.retrySleepFunc),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
-		if _, err := a.apiClient.Disconnect(ctx); err != nil {
+	).DoWithContext(ctx, retrylog.Wrap("Disconnecting agent", func(r *roko.Retrier) error {
+		if _, err := a.client().Disconnect(ctx); err != nil {
 			a.logger.Warn("%s (%s)", err, r) // e.g. POST https://...: 500 (Attempt 0/4 Retrying in ..)
 			return err
 		}
 		return nil
-	})
+	}))
 
 	if err != nil {
 		// none of the retries worked
@@ -8,6 +8,8 @@ import (
 	"net/http/httptest"
 	"regexp"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -109,6 +111,122 @@ func TestDisconnectRetry(t *testing.T) {
 	assert.Equal(t, "[info] Disconnected", l.Messages[3])
 }
 
+func TestPingRegistersAgainWhenTokenRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Token new" {
+			http.Error(rw, `{"message": "Invalid access token"}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/connect":
+			fmt.Fprint(rw, `{}`)
+		case "/ping":
+			fmt.Fprint(rw, `{"action": "idle"}`)
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "old",
+	})
+
+	reregistrations := 0
+	var reregisteredTags []string
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{Name: "agent-1", Tags: []string{"queue=gpu"}},
+		apiClient:          client,
+		agentConfiguration: AgentConfiguration{},
+		stop:               make(chan struct{}),
+		reregisterFunc: func(_ context.Context, tags []string) (*api.AgentRegisterResponse, error) {
+			reregistrations++
+			reregisteredTags = tags
+			return &api.AgentRegisterResponse{Name: "agent-2", AccessToken: "new"}, nil
+		},
+	}
+
+	job, err := worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+	assert.False(t, worker.stopping)
+	assert.Equal(t, "agent-2", worker.agent.Name)
+
+	// It registers with the tags it has now, which remote control may have
+	// changed, and keeps them
+	assert.Equal(t, []string{"queue=gpu"}, reregisteredTags)
+	assert.Equal(t, []string{"queue=gpu"}, worker.agent.Tags)
+
+	// The next ping uses the new registration
+	_, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reregistrations)
+}
+
+func TestPingAndHeartbeatRegisterAgainOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Token new" {
+			http.Error(rw, `{"message": "Invalid access token"}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/connect", "/heartbeat":
+			fmt.Fprint(rw, `{}`)
+		case "/ping":
+			fmt.Fprint(rw, `{"action": "idle"}`)
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "old",
+	})
+
+	var reregistrations int32
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{Name: "agent-1"},
+		apiClient:          client,
+		agentConfiguration: AgentConfiguration{},
+		stop:               make(chan struct{}),
+		retrySleepFunc:     func(time.Duration) {},
+		reregisterFunc: func(context.Context, []string) (*api.AgentRegisterResponse, error) {
+			atomic.AddInt32(&reregistrations, 1)
+			return &api.AgentRegisterResponse{Name: "agent-2", AccessToken: "new"}, nil
+		},
+	}
+
+	// Both loops get a 401 at about the same time, and only one of them
+	// registers again. Run with -race to check they share the registration
+	// safely
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := worker.Ping(ctx)
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, worker.Heartbeat(ctx))
+	}()
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reregistrations))
+	assert.Equal(t, "agent-2", worker.registration().Name)
+}
+
 func TestAcquireAndRunJobWaiting(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
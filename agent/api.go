@@ -23,7 +23,7 @@ type APIClient interface {
 	FromPing(*api.Ping) *api.Client
 	GetJobState(context.Context, string) (*api.JobState, *api.Response, error)
 	GetMetaData(context.Context, string, string, string) (*api.MetaData, *api.Response, error)
-	Heartbeat(context.Context) (*api.Heartbeat, *api.Response, error)
+	Heartbeat(context.Context, *api.AgentHealth) (*api.Heartbeat, *api.Response, error)
 	MetaDataKeys(context.Context, string, string) ([]string, *api.Response, error)
 	OIDCToken(context.Context, *api.OIDCTokenRequest) (*api.OIDCToken, *api.Response, error)
 	Ping(context.Context) (*api.Ping, *api.Response, error)
@@ -35,7 +35,9 @@ type APIClient interface {
 	StartJob(context.Context, *api.Job) (*api.Response, error)
 	StepExport(context.Context, string, *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error)
 	StepUpdate(context.Context, string, *api.StepUpdate) (*api.Response, error)
+	StreamChunks(context.Context, string) (*api.ChunkStream, error)
 	UpdateArtifacts(context.Context, string, map[string]string) (*api.Response, error)
 	UploadChunk(context.Context, string, *api.Chunk) (*api.Response, error)
+	UploadJobEvents(context.Context, string, *api.JobEvents) (*api.Response, error)
 	UploadPipeline(context.Context, string, *api.PipelineChange, ...api.Header) (*api.Response, error)
 }
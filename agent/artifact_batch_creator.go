@@ -6,6 +6,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 )
 
@@ -81,7 +82,7 @@ func (a *ArtifactBatchCreator) Create(ctx context.Context) ([]*api.Artifact, err
 			// Meanwhile, 8 roko.Exponential(2sec) attempts is 1,2,4,8,16,32,64 seconds delay (~2 mins)
 			roko.WithMaxAttempts(8),
 			roko.WithStrategy(roko.Exponential(2*time.Second, 0)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Creating artifacts", func(r *roko.Retrier) error {
 
 			ctxTimeout := ctx
 			if a.conf.CreateArtifactsTimeout != 0 {
@@ -99,7 +100,7 @@ func (a *ArtifactBatchCreator) Create(ctx context.Context) ([]*api.Artifact, err
 			}
 
 			return err
-		})
+		}))
 
 		// Did the batch creation eventually fail?
 		if err != nil {
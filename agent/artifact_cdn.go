@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/buildkite/agent/v3/api"
+)
+
+// How long the signed URLs and cookies for downloading through a CDN last,
+// which is the same as presigned S3 URLs
+const cdnSignatureExpiry = time.Hour
+
+// cdnSigner grants access to a URL on a CDN distribution that only serves
+// signed requests
+type cdnSigner interface {
+	signURL(rawURL string, expires time.Time) (string, error)
+	signCookies(rawURL string, expires time.Time) ([]*http.Cookie, error)
+}
+
+// artifactCDN downloads artifacts through a CDN distribution, which can be
+// much closer to the agent than the bucket behind it
+type artifactCDN struct {
+	// The upload destinations the distribution serves objects from, such as
+	// s3://. Artifacts whose URL is already on the distribution, such as
+	// after it's been rewritten, are downloaded through it too.
+	scheme string
+
+	// The URL objects in the bucket are served from
+	baseURL string
+
+	// Whether access is granted with signed cookies, rather than signed URLs
+	cookies bool
+
+	signer cdnSigner
+}
+
+// artifactCDNsFromEnv returns the CDN distributions configured in the
+// environment, like the credentials for the buckets behind them
+func artifactCDNsFromEnv() ([]*artifactCDN, error) {
+	cookies := false
+	if v := os.Getenv("BUILDKITE_ARTIFACT_CDN_SIGNED_COOKIES"); v != "" {
+		var err error
+		if cookies, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid BUILDKITE_ARTIFACT_CDN_SIGNED_COOKIES %q: %w", v, err)
+		}
+	}
+
+	var cdns []*artifactCDN
+
+	if baseURL := os.Getenv("BUILDKITE_CLOUDFRONT_URL"); baseURL != "" {
+		keyPairID := os.Getenv("BUILDKITE_CLOUDFRONT_KEY_PAIR_ID")
+		keyPath := os.Getenv("BUILDKITE_CLOUDFRONT_PRIVATE_KEY_PATH")
+		if keyPairID == "" || keyPath == "" {
+			return nil, fmt.Errorf("Downloading artifacts through CloudFront needs BUILDKITE_CLOUDFRONT_KEY_PAIR_ID and BUILDKITE_CLOUDFRONT_PRIVATE_KEY_PATH to sign requests with")
+		}
+
+		key, err := sign.LoadPEMPrivKeyFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading CloudFront private key %s: %w", keyPath, err)
+		}
+
+		cdns = append(cdns, &artifactCDN{
+			scheme:  "s3://",
+			baseURL: baseURL,
+			cookies: cookies,
+			signer: cloudFrontSigner{
+				url:     sign.NewURLSigner(keyPairID, key),
+				cookies: sign.NewCookieSigner(keyPairID, key),
+			},
+		})
+	}
+
+	if baseURL := os.Getenv("BUILDKITE_CLOUD_CDN_URL"); baseURL != "" {
+		keyName := os.Getenv("BUILDKITE_CLOUD_CDN_KEY_NAME")
+		keyPath := os.Getenv("BUILDKITE_CLOUD_CDN_KEY_PATH")
+		if keyName == "" || keyPath == "" {
+			return nil, fmt.Errorf("Downloading artifacts through Cloud CDN needs BUILDKITE_CLOUD_CDN_KEY_NAME and BUILDKITE_CLOUD_CDN_KEY_PATH to sign requests with")
+		}
+
+		key, err := loadCloudCDNKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		cdns = append(cdns, &artifactCDN{
+			scheme:  "gs://",
+			baseURL: baseURL,
+			cookies: cookies,
+			signer:  cloudCDNSigner{keyName: keyName, key: key},
+		})
+	}
+
+	return cdns, nil
+}
+
+// cdnFor returns the CDN distribution to download the artifact through, if
+// there is one
+func cdnFor(cdns []*artifactCDN, artifactURL, uploadDestination string) *artifactCDN {
+	for _, cdn := range cdns {
+		if strings.HasPrefix(uploadDestination, cdn.scheme) || cdn.serves(artifactURL) {
+			return cdn
+		}
+	}
+	return nil
+}
+
+// serves returns whether rawURL is on the distribution
+func (c *artifactCDN) serves(rawURL string) bool {
+	return rawURL != "" && strings.HasPrefix(rawURL, strings.TrimSuffix(c.baseURL, "/")+"/")
+}
+
+// objectURL returns the URL of an object in the bucket behind the
+// distribution
+func (c *artifactCDN) objectURL(key string) string {
+	return strings.TrimSuffix(c.baseURL, "/") + (&url.URL{Path: "/" + strings.TrimPrefix(key, "/")}).EscapedPath()
+}
+
+// artifactURL returns the URL of the artifact on the distribution, where
+// path is where it's downloaded to
+func (c *artifactCDN) artifactURL(artifact *api.Artifact, path string) string {
+	switch {
+	case c.serves(artifact.URL):
+		return artifact.URL
+	case c.scheme == "s3://":
+		return c.objectURL(S3Downloader{conf: S3DownloaderConfig{S3Path: artifact.UploadDestination, Path: path}}.BucketFileLocation())
+	default:
+		return c.objectURL(GSDownloader{conf: GSDownloaderConfig{Bucket: artifact.UploadDestination, Path: path}}.BucketFileLocation())
+	}
+}
+
+// sign returns the URL to download from, and the headers to download it with
+func (c *artifactCDN) sign(rawURL string) (string, map[string]string, error) {
+	expires := time.Now().Add(cdnSignatureExpiry)
+
+	if !c.cookies {
+		signed, err := c.signer.signURL(rawURL, expires)
+		return signed, nil, err
+	}
+
+	cookies, err := c.signer.signCookies(rawURL, expires)
+	if err != nil {
+		return "", nil, err
+	}
+	pairs := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	return rawURL, map[string]string{"Cookie": strings.Join(pairs, "; ")}, nil
+}
+
+// cloudFrontSigner signs requests to a CloudFront distribution with a
+// canned policy, using the key pair of one of its trusted key groups
+type cloudFrontSigner struct {
+	url     *sign.URLSigner
+	cookies *sign.CookieSigner
+}
+
+func (s cloudFrontSigner) signURL(rawURL string, expires time.Time) (string, error) {
+	return s.url.Sign(rawURL, expires)
+}
+
+func (s cloudFrontSigner) signCookies(rawURL string, expires time.Time) ([]*http.Cookie, error) {
+	return s.cookies.Sign(rawURL, expires)
+}
+
+// cloudCDNSigner signs requests to a Cloud CDN backend with one of its
+// signed request keys. See
+// https://cloud.google.com/cdn/docs/using-signed-urls and
+// https://cloud.google.com/cdn/docs/using-signed-cookies
+type cloudCDNSigner struct {
+	keyName string
+	key     []byte
+}
+
+func (s cloudCDNSigner) signature(value string) string {
+	mac := hmac.New(sha1.New, s.key)
+	mac.Write([]byte(value))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s cloudCDNSigner) signURL(rawURL string, expires time.Time) (string, error) {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	signed := fmt.Sprintf("%s%sExpires=%d&KeyName=%s", rawURL, separator, expires.Unix(), url.QueryEscape(s.keyName))
+	return signed + "&Signature=" + s.signature(signed), nil
+}
+
+func (s cloudCDNSigner) signCookies(rawURL string, expires time.Time) ([]*http.Cookie, error) {
+	// The cookie grants access to the URL and nothing else, as a prefix
+	// ending in the object's name
+	policy := fmt.Sprintf("URLPrefix=%s:Expires=%d:KeyName=%s",
+		base64.URLEncoding.EncodeToString([]byte(rawURL)), expires.Unix(), s.keyName)
+	return []*http.Cookie{{
+		Name:  "Cloud-CDN-Cookie",
+		Value: policy + ":Signature=" + s.signature(policy),
+	}}, nil
+}
+
+// loadCloudCDNKey reads a Cloud CDN signed request key, which is 16 bytes of
+// base64url, as used by gcloud compute sign-url --key-file
+func loadCloudCDNKey(keyPath string) ([]byte, error) {
+	contents, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading Cloud CDN key: %w", err)
+	}
+
+	key, err := base64.URLEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Cloud CDN key %s isn't base64url encoded: %w", keyPath, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// cdnTestServer serves a build with a single artifact uploaded to
+// destination, and serves it at /cdn/builds/1/llamas.txt to requests that
+// authorized accepts
+func cdnTestServer(t *testing.T, destination string, authorized func(*http.Request) bool) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"upload_destination": %q
+			}]`, destination)
+		case "/cdn/builds/1/llamas.txt":
+			if !authorized(req) {
+				http.Error(rw, "Forbidden", http.StatusForbidden)
+				return
+			}
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+}
+
+func downloadThroughCDN(t *testing.T, server *httptest.Server) {
+	t.Helper()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+	})
+
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "OK\n" {
+		t.Errorf("llamas.txt = %q, want %q", got, "OK\n")
+	}
+}
+
+func TestArtifactDownloaderCloudCDNSignedURL(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	keyPath := filepath.Join(t.TempDir(), "cdn.key")
+	if err := os.WriteFile(keyPath, []byte(base64.URLEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	server := cdnTestServer(t, "gs://my-bucket/builds/1", func(req *http.Request) bool {
+		query := req.URL.Query()
+		if query.Get("KeyName") != "my-key" || query.Get("Expires") == "" {
+			return false
+		}
+
+		// The signature is of the URL up to the signature
+		rawURL := "http://" + req.Host + req.URL.RequestURI()
+		signed, _, _ := strings.Cut(rawURL, "&Signature=")
+		mac := hmac.New(sha1.New, key)
+		mac.Write([]byte(signed))
+		return query.Get("Signature") == base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	})
+	defer server.Close()
+
+	t.Setenv("BUILDKITE_CLOUD_CDN_URL", server.URL+"/cdn/")
+	t.Setenv("BUILDKITE_CLOUD_CDN_KEY_NAME", "my-key")
+	t.Setenv("BUILDKITE_CLOUD_CDN_KEY_PATH", keyPath)
+
+	downloadThroughCDN(t, server)
+}
+
+func TestArtifactDownloaderCloudFrontSignedCookies(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "cloudfront.pem")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	server := cdnTestServer(t, "s3://my-bucket/builds/1", func(req *http.Request) bool {
+		cookies := map[string]string{}
+		for _, name := range []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"} {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return false
+			}
+			cookies[name] = cookie.Value
+		}
+		if cookies["CloudFront-Key-Pair-Id"] != "K2JCJMDEHXQW5F" {
+			return false
+		}
+
+		// CloudFront's base64 has its own URL safe characters
+		unescape := strings.NewReplacer("-", "+", "_", "=", "~", "/")
+		policy, err := base64.StdEncoding.DecodeString(unescape.Replace(cookies["CloudFront-Policy"]))
+		if err != nil {
+			return false
+		}
+		signature, err := base64.StdEncoding.DecodeString(unescape.Replace(cookies["CloudFront-Signature"]))
+		if err != nil {
+			return false
+		}
+		digest := sha1.Sum(policy)
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], signature) == nil
+	})
+	defer server.Close()
+
+	// No AWS credentials are needed to download through CloudFront
+	t.Setenv("BUILDKITE_CLOUDFRONT_URL", server.URL+"/cdn")
+	t.Setenv("BUILDKITE_CLOUDFRONT_KEY_PAIR_ID", "K2JCJMDEHXQW5F")
+	t.Setenv("BUILDKITE_CLOUDFRONT_PRIVATE_KEY_PATH", keyPath)
+	t.Setenv("BUILDKITE_ARTIFACT_CDN_SIGNED_COOKIES", "true")
+
+	downloadThroughCDN(t, server)
+}
+
+func TestArtifactCDNsFromEnvNeedsKeys(t *testing.T) {
+	t.Setenv("BUILDKITE_CLOUDFRONT_URL", "https://d111111abcdef8.cloudfront.net")
+
+	if _, err := artifactCDNsFromEnv(); err == nil {
+		t.Error("artifactCDNsFromEnv() error = nil, want an error about the missing key")
+	}
+}
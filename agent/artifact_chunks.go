@@ -0,0 +1,422 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/dustin/go-humanize"
+)
+
+// Artifacts uploaded with the chunk post-processor are split into chunks at
+// boundaries picked by their contents, so inserting or changing a few bytes
+// only changes the chunks around them. The artifact is replaced by an index
+// of its chunks, at its path with chunkIndexSuffix, and each distinct chunk is
+// uploaded once, named by its SHA-256 under its path with chunkDirSuffix. A
+// chunk that a base build already uploaded isn't uploaded again, and the
+// index says which build has it. Downloading it with ArtifactDownloaderConfig
+// Chunked reassembles it, only downloading the chunks that aren't in the file
+// that's already there.
+const (
+	chunkIndexSuffix = ".chunks.json"
+	chunkDirSuffix   = ".chunks/"
+
+	chunkMinSize = 512 * 1024
+	chunkMaxSize = 8 * 1024 * 1024
+
+	// A boundary is where the top 21 bits of the rolling hash are zero, so
+	// chunks are 2 MiB on average, after the minimum
+	chunkMask = ((uint64(1) << 21) - 1) << (64 - 21)
+)
+
+// chunkGear is the random value each byte adds to the rolling hash. It's the
+// same everywhere, so the same contents are always split the same way.
+var chunkGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return gear
+}()
+
+// artifactChunkIndex is what a chunked artifact is uploaded as
+type artifactChunkIndex struct {
+	Version int             `json:"version"`
+	Size    int64           `json:"size"`
+	Sha256  string          `json:"sha256"`
+	Chunks  []artifactChunk `json:"chunks"`
+}
+
+// artifactChunk is a chunk of an artifact, in order
+type artifactChunk struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+
+	// The build that uploaded the chunk, if it was an earlier one than the
+	// index's
+	Build string `json:"build,omitempty"`
+}
+
+// splitChunks reads r to the end, calling found with each chunk of it. The
+// chunk is only valid until found returns.
+func splitChunks(r io.Reader, found func([]byte) error) error {
+	buf := make([]byte, chunkMaxSize)
+	n, eof := 0, false
+	for {
+		for !eof && n < len(buf) {
+			m, err := r.Read(buf[n:])
+			n += m
+			if errors.Is(err, io.EOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+
+		cut := chunkBoundary(buf[:n])
+		if err := found(buf[:cut]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// chunkBoundary returns where the chunk at the start of data ends, which is
+// the end of data if it has no boundary
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	var h uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		h = h<<1 + chunkGear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunk replaces the artifact with an index of its chunks, and uploads the
+// chunks that the base build doesn't have alongside it
+func (p *artifactPostProcess) chunk(artifact *api.Artifact) ([]*api.Artifact, error) {
+	if p.uploader.conf.NameTemplate != "" {
+		return nil, errors.New("chunked artifacts can't be named with a template, as their chunks are found by path")
+	}
+
+	base, err := p.baseChunks(artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := artifactChunkIndex{Version: 1, Size: artifact.FileSize, Sha256: artifact.Sha256Sum}
+	uploading := map[string]bool{}
+	var chunks []*api.Artifact
+	var uploadSize int64
+
+	err = splitChunks(f, func(data []byte) error {
+		sum := sha256.Sum256(data)
+		c := artifactChunk{Sha256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		index.Chunks = append(index.Chunks, c)
+
+		switch {
+		case base[c.Sha256]:
+			index.Chunks[len(index.Chunks)-1].Build = p.uploader.conf.ChunkBaseBuild
+			return nil
+		case uploading[c.Sha256]:
+			return nil
+		}
+		uploading[c.Sha256] = true
+		uploadSize += c.Size
+
+		chunkPath := artifact.Path + chunkDirSuffix + c.Sha256
+		out, err := p.create(chunkPath)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		uploaded, err := p.uploader.build(chunkPath, out.Name(), artifact.GlobPath)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, uploaded)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	indexArtifact, err := p.sidecar(artifact, chunkIndexSuffix, append(contents, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	p.uploader.logger.Info("Split %s into %d chunks, %d of which (%s) are new", artifact.Path, len(index.Chunks), len(chunks), humanize.Bytes(uint64(uploadSize)))
+	return append([]*api.Artifact{indexArtifact}, chunks...), nil
+}
+
+// baseChunks returns the SHA-256s of the artifact's chunks that the base
+// build uploaded, if there is one
+func (p *artifactPostProcess) baseChunks(artifact *api.Artifact) (map[string]bool, error) {
+	build := p.uploader.conf.ChunkBaseBuild
+	if build == "" {
+		return nil, nil
+	}
+
+	prefix := filepath.ToSlash(artifact.Path) + chunkDirSuffix
+	searcher := NewArtifactSearcher(p.uploader.logger, p.uploader.apiClient, build)
+	found, err := searcher.Search(p.ctx, prefix+"*", "", true, true)
+	if err != nil {
+		return nil, fmt.Errorf("searching for the chunks of %s in build %s: %w", artifact.Path, build, err)
+	}
+
+	chunks := make(map[string]bool, len(found))
+	for _, a := range found {
+		if name := filepath.ToSlash(a.Path); strings.HasPrefix(name, prefix) {
+			chunks[strings.TrimPrefix(name, prefix)] = true
+		}
+	}
+	return chunks, nil
+}
+
+// downloadChunked downloads the indexes of the chunked artifacts the query
+// finds, and reassembles each of them in the destination
+func (a *ArtifactDownloader) downloadChunked(ctx context.Context) error {
+	switch {
+	case a.conf.Output != nil, a.conf.ServerSide, a.conf.Range != nil, a.conf.DryRun, a.conf.Prefetch:
+		return errors.New("Chunked artifacts can only be downloaded whole to a directory")
+	case a.conf.NameTemplate != "", a.conf.PathTemplate != "", a.conf.SignaturePublicKeyPath != "", len(a.conf.IDs) > 0:
+		return errors.New("Chunked artifacts can't be downloaded with a name or path template, signatures, or by ID")
+	}
+
+	destination, _ := filepath.Abs(a.conf.Destination)
+	if !isDir(destination) {
+		return fmt.Errorf("%s is not a directory", destination)
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-artifact-chunks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	indexes := a.chunkDownloader(dir)
+	indexes.conf.Query = a.conf.Query + chunkIndexSuffix
+	if err := indexes.Download(ctx); err != nil {
+		return err
+	}
+
+	var durable *durableDownload
+	if a.conf.Durable {
+		durable = newDurableDownload(destination)
+	}
+	var ownership *downloadOwnership
+	if a.conf.Owner != nil {
+		if ownership, err = newDownloadOwnership(a.conf.Owner, destination); err != nil {
+			return err
+		}
+	}
+	for _, result := range indexes.Results() {
+		if result.Error != "" {
+			continue
+		}
+		started := time.Now()
+		if ownership != nil {
+			ownership.expect(a.destinationPath(&api.Artifact{Path: strings.TrimSuffix(result.Path, chunkIndexSuffix)}, destination, nil))
+		}
+		reassembled, err := a.reassemble(ctx, result, destination, dir)
+		if err == nil && ownership != nil {
+			err = ownership.chown(reassembled.Destination)
+		}
+		if err == nil && durable != nil {
+			err = durable.add(reassembled.Destination)
+		}
+		if err != nil {
+			return fmt.Errorf("reassembling %s: %w", strings.TrimSuffix(result.Path, chunkIndexSuffix), err)
+		}
+		reassembled.DurationSeconds = time.Since(started).Seconds()
+		a.results = append(a.results, reassembled)
+	}
+	if durable != nil {
+		return durable.sync()
+	}
+	return nil
+}
+
+// chunkDownloader returns a downloader of chunks and their indexes to dir,
+// without any of the options for what to do with them
+func (a *ArtifactDownloader) chunkDownloader(dir string) ArtifactDownloader {
+	conf := a.conf
+	conf.Chunked = false
+	conf.Destination = dir
+	conf.Include, conf.Exclude = "", ""
+	conf.MaxArtifacts = 0
+	conf.PreserveMetadata, conf.Durable, conf.Owner = false, false, nil
+	conf.OverwritePolicy = OverwriteAlways
+	conf.Quiet, conf.ProgressInterval = true, 0
+	conf.Observer = ArtifactDownloadObserver{}
+	return NewArtifactDownloader(a.logger, a.apiClient, conf)
+}
+
+// reassemble writes the artifact whose chunk index was downloaded to the
+// destination, taking chunks from the file that's already there where it
+// can, and downloading the rest
+func (a *ArtifactDownloader) reassemble(ctx context.Context, indexResult ArtifactDownloadResult, destination, dir string) (ArtifactDownloadResult, error) {
+	artifactPath := strings.TrimSuffix(indexResult.Path, chunkIndexSuffix)
+	result := ArtifactDownloadResult{
+		ID:     indexResult.ID,
+		Path:   artifactPath,
+		JobID:  indexResult.JobID,
+		Source: indexResult.Source,
+	}
+
+	contents, err := os.ReadFile(indexResult.Destination)
+	if err != nil {
+		return result, err
+	}
+	var index artifactChunkIndex
+	if err := json.Unmarshal(contents, &index); err != nil {
+		return result, fmt.Errorf("parsing the chunk index: %w", err)
+	}
+	if index.Version != 1 {
+		return result, fmt.Errorf("unsupported chunk index version %d", index.Version)
+	}
+
+	target := a.destinationPath(&api.Artifact{Path: artifactPath}, destination, nil)
+	result.Destination, result.FileSize, result.Sha256Sum = target, index.Size, index.Sha256
+
+	// Where each chunk that's already in the file at the target is
+	local := map[string]int64{}
+	existing, err := os.Open(target)
+	if err == nil {
+		// It's replaced once the chunks have been copied out of it
+		defer existing.Close()
+		var offset int64
+		err = splitChunks(existing, func(data []byte) error {
+			sum := sha256.Sum256(data)
+			local[hex.EncodeToString(sum[:])] = offset
+			offset += int64(len(data))
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("reading %s: %w", target, err)
+		}
+	}
+
+	// Download the chunks that aren't, from the builds that have them
+	missing := map[string][]string{}
+	seen := map[string]bool{}
+	var downloadSize int64
+	for _, c := range index.Chunks {
+		if _, ok := local[c.Sha256]; ok || seen[c.Sha256] {
+			continue
+		}
+		seen[c.Sha256] = true
+		build := c.Build
+		if build == "" {
+			build = a.conf.BuildID
+		}
+		missing[build] = append(missing[build], artifactPath+chunkDirSuffix+c.Sha256)
+		downloadSize += c.Size
+	}
+	chunkDir := filepath.Join(dir, "chunks")
+	if err := os.MkdirAll(chunkDir, 0o700); err != nil {
+		return result, err
+	}
+	for build, paths := range missing {
+		chunks := a.chunkDownloader(chunkDir)
+		chunks.conf.BuildID = build
+		chunks.conf.Query = artifactPath + chunkDirSuffix + "*"
+		chunks.conf.Include = strings.Join(paths, ArtifactPathDelimiter)
+		chunks.conf.Step, chunks.conf.IDs = "", nil
+		chunks.conf.IncludeRetriedJobs, chunks.conf.KeepRetriedDuplicates = true, true
+		if err := chunks.Download(ctx); err != nil {
+			return result, fmt.Errorf("downloading chunks from build %s: %w", build, err)
+		}
+	}
+
+	// Write the chunks in order next to the target, then replace it
+	out, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	for _, c := range index.Chunks {
+		if err := copyChunk(w, c, existing, local, getTargetPath(artifactPath+chunkDirSuffix+c.Sha256, chunkDir)); err != nil {
+			return result, err
+		}
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != index.Sha256 {
+		return result, fmt.Errorf("reassembled file has a SHA-256 of %s, expected %s", sum, index.Sha256)
+	}
+	if err := out.Close(); err != nil {
+		return result, err
+	}
+	if existing != nil {
+		existing.Close()
+	}
+	if err := os.Rename(out.Name(), target); err != nil {
+		return result, err
+	}
+
+	a.logger.Info("Reassembled %s from %d chunks, downloading %s of them", artifactPath, len(index.Chunks), humanize.Bytes(uint64(downloadSize)))
+	return result, nil
+}
+
+// copyChunk writes a chunk to w, from where it is in the existing file if it's
+// there, and otherwise from the file it was downloaded to
+func copyChunk(w io.Writer, c artifactChunk, existing *os.File, local map[string]int64, downloaded string) error {
+	var r io.Reader
+	if offset, ok := local[c.Sha256]; ok {
+		r = io.NewSectionReader(existing, offset, c.Size)
+	} else {
+		f, err := os.Open(downloaded)
+		if err != nil {
+			return fmt.Errorf("chunk %s wasn't downloaded: %w", c.Sha256, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != c.Size {
+		return fmt.Errorf("chunk %s is %d bytes, expected %d", c.Sha256, n, c.Size)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	split := func(data []byte) []int {
+		var sizes []int
+		require.NoError(t, splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+			sizes = append(sizes, len(chunk))
+			return nil
+		}))
+		return sizes
+	}
+
+	sizes := split(data)
+	total := 0
+	for _, size := range sizes {
+		assert.GreaterOrEqual(t, size, chunkMinSize)
+		assert.LessOrEqual(t, size, chunkMaxSize)
+		total += size
+	}
+	assert.Equal(t, len(data), total)
+	assert.Equal(t, sizes, split(data), "the same contents are split the same way")
+
+	// Inserting bytes only changes the chunk they're inserted into
+	changed := append(append(append([]byte{}, data[:7*1024*1024]...), "llamas"...), data[7*1024*1024:]...)
+	changedSizes := split(changed)
+	same := 0
+	for _, a := range sizes {
+		for _, b := range changedSizes {
+			if a == b {
+				same++
+				break
+			}
+		}
+	}
+	assert.GreaterOrEqual(t, same, len(sizes)-2, "split(data) = %v, split(changed) = %v", sizes, changedSizes)
+}
+
+// chunkServer is an agent API and artifact storage for the artifacts of a few
+// builds
+type chunkServer struct {
+	mu        sync.Mutex
+	builds    map[string][]*api.Artifact
+	downloads []string
+}
+
+func (s *chunkServer) add(build string, artifacts []*api.Artifact) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range artifacts {
+		a.ID = fmt.Sprintf("%s-%d", build, i)
+		s.builds[build] = append(s.builds[build], a)
+	}
+}
+
+func (s *chunkServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "builds" && parts[3] == "search":
+		query := req.URL.Query().Get("query")
+		found := []api.Artifact{}
+		for _, a := range s.builds[parts[1]] {
+			if ok, _ := path.Match(query, a.Path); ok {
+				found = append(found, api.Artifact{
+					ID:        a.ID,
+					Path:      a.Path,
+					FileSize:  a.FileSize,
+					Sha256Sum: a.Sha256Sum,
+					URL:       fmt.Sprintf("http://%s/download/%s", req.Host, a.ID),
+				})
+			}
+		}
+		json.NewEncoder(rw).Encode(found)
+
+	case len(parts) == 2 && parts[0] == "download":
+		for _, artifacts := range s.builds {
+			for _, a := range artifacts {
+				if a.ID == parts[1] {
+					s.downloads = append(s.downloads, a.Path)
+					http.ServeFile(rw, req, a.AbsolutePath)
+					return
+				}
+			}
+		}
+		http.NotFound(rw, req)
+
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestChunkedArtifacts(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	server := &chunkServer{builds: map[string][]*api.Artifact{}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	ac := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamasforever"})
+
+	upload := func(build, baseBuild string, contents []byte) []*api.Artifact {
+		t.Helper()
+		src := filepath.Join(dir, build+".img")
+		require.NoError(t, os.WriteFile(src, contents, 0o600))
+
+		uploader := NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{
+			JobID:          build + "-job",
+			PostProcessors: "*.img=chunk",
+			ChunkBaseBuild: baseBuild,
+		})
+		artifact, err := uploader.build("disk.img", src, "*.img")
+		require.NoError(t, err)
+		artifacts, cleanup, err := uploader.postProcess(ctx, []*api.Artifact{artifact})
+		require.NoError(t, err)
+		t.Cleanup(cleanup)
+
+		server.add(build, artifacts)
+		return artifacts
+	}
+
+	v1 := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(1)).Read(v1)
+	first := upload("build-1", "", v1)
+	assert.Equal(t, "disk.img"+chunkIndexSuffix, first[0].Path)
+
+	// Only the chunks that changed since build-1 are uploaded by build-2
+	v2 := append(append(append([]byte{}, v1[:5*1024*1024]...), "llamas"...), v1[5*1024*1024:]...)
+	second := upload("build-2", "build-1", v2)
+	assert.Less(t, len(second), len(first))
+
+	contents, err := os.ReadFile(second[0].AbsolutePath)
+	require.NoError(t, err)
+	var index artifactChunkIndex
+	require.NoError(t, json.Unmarshal(contents, &index))
+	fromBase := 0
+	for _, c := range index.Chunks {
+		if c.Build == "build-1" {
+			fromBase++
+		}
+	}
+	assert.Equal(t, len(index.Chunks)-(len(second)-1), fromBase)
+
+	// Reassembling it over build-1's only downloads the chunks that changed
+	destination := filepath.Join(dir, "out")
+	require.NoError(t, os.MkdirAll(destination, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(destination, "disk.img"), v1, 0o644))
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		Query:       "disk.img",
+		Destination: destination,
+		BuildID:     "build-2",
+		Chunked:     true,
+	})
+	require.NoError(t, d.Download(ctx))
+
+	got, err := os.ReadFile(filepath.Join(destination, "disk.img"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(v2, got), "reassembled disk.img doesn't match what was uploaded")
+	assert.Len(t, server.downloads, len(second), "downloads = %q", server.downloads)
+
+	results := d.Results()
+	require.Len(t, results, 1)
+	assert.Equal(t, "disk.img", results[0].Path)
+	assert.Equal(t, index.Sha256, results[0].Sha256Sum)
+
+	// Without an existing file, every chunk is downloaded, from whichever
+	// build has it
+	server.downloads = nil
+	fresh := filepath.Join(dir, "fresh")
+	require.NoError(t, os.MkdirAll(fresh, 0o755))
+	d = NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		Query:       "disk.img",
+		Destination: fresh,
+		BuildID:     "build-2",
+		Chunked:     true,
+	})
+	require.NoError(t, d.Download(ctx))
+	got, err = os.ReadFile(filepath.Join(fresh, "disk.img"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(v2, got), "reassembled disk.img doesn't match what was uploaded")
+}
@@ -0,0 +1,358 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/experiments"
+	zglob "github.com/mattn/go-zglob"
+	"github.com/mattn/go-zglob/fastwalk"
+)
+
+// artifactCollector turns the upload glob patterns into artifacts.
+//
+// The directory walk runs in parallel, prunes ignored directories and, where
+// the pattern allows it, directories deeper than the pattern could match.
+// Matching files are handed straight to a pool of workers that stat and
+// checksum them, so hashing overlaps with the walk and the list of matches is
+// never held in memory on its own.
+type artifactCollector struct {
+	uploader *ArtifactUploader
+	ignore   *ignoreMatcher
+
+	// The working directory, which artifact paths are relative to
+	wd string
+
+	mu        sync.Mutex
+	seenPaths map[string]bool
+	artifacts []*api.Artifact
+	err       error
+}
+
+// collectJob is a matched file waiting to be built into an artifact
+type collectJob struct {
+	file     string
+	globPath string
+}
+
+func (c *artifactCollector) collect() ([]*api.Artifact, error) {
+	jobs := make(chan collectJob, 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if c.failed() {
+					continue
+				}
+				if err := c.process(job); err != nil {
+					c.setErr(err)
+				}
+			}
+		}()
+	}
+
+	for _, globPath := range strings.Split(c.uploader.conf.Paths, ArtifactPathDelimiter) {
+		globPath = strings.TrimSpace(globPath)
+		if globPath == "" {
+			continue
+		}
+
+		c.uploader.logger.Debug("Searching for %s", globPath)
+
+		err := c.walk(globPath, func(file string) {
+			jobs <- collectJob{file: file, globPath: globPath}
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			c.uploader.logger.Info("File not found: %s", globPath)
+			continue
+		} else if err != nil {
+			c.setErr(fmt.Errorf("resolving glob: %w", err))
+			break
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	// The workers finish in any order, so sort the artifacts to upload and
+	// list them the same way every time
+	sort.Slice(c.artifacts, func(i, j int) bool {
+		return c.artifacts[i].Path < c.artifacts[j].Path
+	})
+	return c.artifacts, nil
+}
+
+func (c *artifactCollector) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *artifactCollector) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// walk calls fn with every file matching globPath that isn't ignored. It
+// resolves patterns the same way as zglob.Glob, but can skip directories.
+func (c *artifactCollector) walk(globPath string, fn func(file string)) error {
+	matcher, err := zglob.New(globPath)
+	if err != nil {
+		return err
+	}
+
+	root, hasMeta := globRoot(globPath)
+	if !hasMeta {
+		// Not a glob, just a path to a single file (or directory)
+		if _, err := os.Stat(globPath); err != nil {
+			return os.ErrNotExist
+		}
+		fn(globPath)
+		return nil
+	}
+
+	// Without ** or braces, a pattern can only match at a fixed depth below
+	// its root, so there's no need to descend any further than that
+	maxDepth := -1
+	if !strings.Contains(globPath, "**") && !strings.Contains(globPath, "{") {
+		maxDepth = strings.Count(strings.TrimPrefix(filepath.ToSlash(globPath), root), "/")
+	}
+
+	// fastwalk gives us paths joined onto the root, so strip a leading "./"
+	// to match what zglob returns for relative patterns
+	trim := func(p string) string {
+		if root == "." && len(p) > 1 {
+			p = p[2:]
+		}
+		return filepath.ToSlash(p)
+	}
+
+	followSymlinks := c.uploader.conf.FollowSymlinks
+
+	return fastwalk.FastWalk(filepath.FromSlash(root), func(p string, mode os.FileMode) error {
+		if c.failed() {
+			return errors.New("collection aborted")
+		}
+
+		name := trim(p)
+
+		if followSymlinks && mode == os.ModeSymlink {
+			if target, err := filepath.EvalSymlinks(p); err == nil {
+				if fi, err := os.Lstat(target); err == nil && fi.IsDir() {
+					if c.ignore.Match(name, true) {
+						return filepath.SkipDir
+					}
+					return fastwalk.TraverseLink
+				}
+			}
+		}
+
+		if mode.IsDir() {
+			if name == "." || len(name) <= len(root) {
+				return nil
+			}
+			if c.ignore.Match(name, true) {
+				c.uploader.logger.Debug("Ignoring directory %s", name)
+				return filepath.SkipDir
+			}
+			if maxDepth >= 0 && strings.Count(strings.TrimPrefix(name, root), "/") >= maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !matcher.Match(name) {
+			return nil
+		}
+		if c.ignore.Match(name, false) {
+			c.uploader.logger.Debug("Ignoring %s", name)
+			return nil
+		}
+
+		fn(name)
+		return nil
+	})
+}
+
+// process turns a single matched file into an artifact
+func (c *artifactCollector) process(job collectJob) error {
+	absolutePath, err := filepath.Abs(job.file)
+	if err != nil {
+		return fmt.Errorf("resolving absolute path for file %s: %w", job.file, err)
+	}
+
+	// dedupe based on resolved absolutePath
+	c.mu.Lock()
+	seen := c.seenPaths[absolutePath]
+	c.seenPaths[absolutePath] = true
+	c.mu.Unlock()
+	if seen {
+		c.uploader.logger.Debug("Skipping duplicate path %s", job.file)
+		return nil
+	}
+
+	// Ignore directories, we only want files
+	if isDir(absolutePath) {
+		c.uploader.logger.Debug("Skipping directory %s", job.file)
+		return nil
+	}
+
+	// If a glob is absolute, we need to make it relative to the root so that
+	// it can be combined with the download destination to make a valid path.
+	// This is possibly weird and crazy, this logic dates back to
+	// https://github.com/buildkite/agent/commit/8ae46d975aa60d1ae0e2cc0bff7a43d3bf960935
+	// from 2014, so I'm replicating it here to avoid breaking things
+	wd := c.wd
+	if filepath.IsAbs(job.globPath) {
+		if runtime.GOOS == "windows" {
+			wd = filepath.VolumeName(absolutePath) + "/"
+		} else {
+			wd = "/"
+		}
+	}
+
+	path, err := filepath.Rel(wd, absolutePath)
+	if err != nil {
+		return fmt.Errorf("resolving relative path for file %s: %w", job.file, err)
+	}
+
+	if experiments.IsEnabled("normalised-upload-paths") {
+		// Convert any Windows paths to Unix/URI form
+		path = filepath.ToSlash(path)
+	}
+
+	// Build an artifact object using the paths we have.
+	artifact, err := c.uploader.build(path, absolutePath, job.globPath)
+	if err != nil {
+		return fmt.Errorf("building artifact: %w", err)
+	}
+
+	c.mu.Lock()
+	c.artifacts = append(c.artifacts, artifact)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// globEnvRegexp matches the path components that zglob replaces with the
+// value of an environment variable
+var globEnvRegexp = regexp.MustCompile(`^(\$[a-zA-Z][a-zA-Z0-9_]+|\$\([a-zA-Z][a-zA-Z0-9_]+\))$`)
+
+// globRoot returns the directory that a zglob pattern starts matching from,
+// which is everything before the first path component containing a * or {.
+// It reports false if the pattern contains no such component.
+func globRoot(pattern string) (string, bool) {
+	var static []string
+	for i, part := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if strings.ContainsAny(part, "*{") {
+			if len(static) == 0 {
+				return ".", true
+			}
+			root := path.Join(static...)
+			if static[0] == "" {
+				root = "/" + root
+			}
+			return root, true
+		}
+
+		// zglob expands ~ and environment variables in the static part
+		if i == 0 && part == "~" {
+			if runtime.GOOS == "windows" {
+				part = os.Getenv("USERPROFILE")
+			} else {
+				part = os.Getenv("HOME")
+			}
+		}
+		if globEnvRegexp.MatchString(part) {
+			part = strings.Trim(strings.Trim(os.Getenv(part[1:]), "()"), `"`)
+		}
+
+		static = append(static, part)
+	}
+	return "", false
+}
+
+// ignoreMatcher matches paths against gitignore-style patterns. A pattern
+// without a slash matches a file or directory name at any depth, a pattern
+// with a slash matches a path relative to the working directory, and a
+// trailing slash only matches directories. Ignored directories are not
+// walked at all.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	matcher  interface{ Match(string) bool }
+	dirOnly  bool
+	basename bool
+}
+
+func newIgnoreMatcher(paths string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	for _, p := range strings.Split(paths, ArtifactPathDelimiter) {
+		p = filepath.ToSlash(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+
+		ip := ignorePattern{}
+		if strings.HasSuffix(p, "/") {
+			ip.dirOnly = true
+			p = strings.TrimSuffix(p, "/")
+		}
+		p = strings.TrimPrefix(p, "./")
+		ip.basename = !strings.Contains(p, "/")
+
+		matcher, err := zglob.New(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %w", p, err)
+		}
+		ip.matcher = matcher
+
+		m.patterns = append(m.patterns, ip)
+	}
+	return m, nil
+}
+
+// Match reports whether name, a slash separated path, should be ignored.
+func (m *ignoreMatcher) Match(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	name = strings.TrimPrefix(name, "./")
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		subject := name
+		if p.basename {
+			subject = path.Base(name)
+		}
+
+		if p.matcher.Match(subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+// ArtifactDiff is how the files in a directory differ from artifacts. Paths
+// are relative to the directory, with forward slashes.
+type ArtifactDiff struct {
+	// Files in the directory that aren't artifacts
+	Added []string `json:"added"`
+
+	// Files whose checksum doesn't match the artifact's
+	Changed []string `json:"changed"`
+
+	// Artifacts that aren't in the directory
+	Missing []string `json:"missing"`
+
+	// Files that match their artifact
+	Unchanged []string `json:"unchanged"`
+}
+
+// Empty reports whether the directory matches the artifacts exactly
+func (d *ArtifactDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Missing) == 0
+}
+
+// DiffArtifacts compares the files in dir with the artifacts, using the
+// strongest checksum each artifact was uploaded with
+func DiffArtifacts(artifacts []*api.Artifact, dir string) (*ArtifactDiff, error) {
+	byPath := make(map[string]*api.Artifact, len(artifacts))
+	for _, a := range artifacts {
+		p := a.Path
+		if runtime.GOOS != "windows" {
+			p = strings.ReplaceAll(p, `\`, `/`)
+		}
+		p = filepath.ToSlash(filepath.Clean(p))
+		if _, ok := byPath[p]; !ok {
+			byPath[p] = a
+		}
+	}
+
+	diff := &ArtifactDiff{
+		Added:     []string{},
+		Changed:   []string{},
+		Missing:   []string{},
+		Unchanged: []string{},
+	}
+
+	local := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		local[rel] = true
+
+		a, ok := byPath[rel]
+		if !ok {
+			diff.Added = append(diff.Added, rel)
+			return nil
+		}
+
+		same, err := matchesArtifact(a, path)
+		if err != nil {
+			return err
+		}
+		if same {
+			diff.Unchanged = append(diff.Unchanged, rel)
+		} else {
+			diff.Changed = append(diff.Changed, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for p := range byPath {
+		if !local[p] {
+			diff.Missing = append(diff.Missing, p)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Unchanged)
+	return diff, nil
+}
+
+// matchesArtifact reports whether the file has the artifact's checksum
+func matchesArtifact(a *api.Artifact, path string) (bool, error) {
+	algorithm, want := "sha256", a.Sha256Sum
+	if want == "" {
+		algorithm, want = "sha1", a.Sha1Sum
+	}
+	if want == "" {
+		return false, fmt.Errorf("artifact %q has no checksum to compare with", a.Path)
+	}
+
+	got, err := transfer.ChecksumFile(transfer.ChecksumAlgorithms[algorithm](), path)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(got, want), nil
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffArtifacts(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(path, contents string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(contents), 0o644))
+	}
+	write("bin/app", "app")
+	write("bin/tool", "new tool")
+	write("README.md", "readme")
+	write("extra.txt", "extra")
+
+	artifacts := []*api.Artifact{
+		{Path: "bin/app", Sha256Sum: fmt.Sprintf("%x", sha256.Sum256([]byte("app")))},
+		{Path: "bin/tool", Sha256Sum: fmt.Sprintf("%x", sha256.Sum256([]byte("old tool")))},
+		{Path: "README.md", Sha1Sum: fmt.Sprintf("%x", sha1.Sum([]byte("readme")))},
+		{Path: "lib/missing.so", Sha256Sum: "abc"},
+	}
+
+	diff, err := DiffArtifacts(artifacts, dir)
+	require.NoError(t, err)
+	assert.Equal(t, &ArtifactDiff{
+		Added:     []string{"extra.txt"},
+		Changed:   []string{"bin/tool"},
+		Missing:   []string{"lib/missing.so"},
+		Unchanged: []string{"README.md", "bin/app"},
+	}, diff)
+	assert.False(t, diff.Empty())
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/dustin/go-humanize"
+)
+
+// dryRun logs where each artifact would be downloaded to, and warns about the
+// ones that would overwrite a file that's already there or another artifact,
+// without downloading anything. The plan is kept as the results, so it can be
+// printed with --format json.
+func (a *ArtifactDownloader) dryRun(artifacts []*api.Artifact, downloadDestination string, names *artifactNameTemplate) {
+	a.results = a.dryRunResults(artifacts, downloadDestination, names)
+
+	var totalBytes int64
+	downloads, conflicts := 0, 0
+	for _, result := range a.results {
+		if result.Skipped {
+			a.logger.Info("%s would be skipped, as %s already exists", result.Path, result.Destination)
+			continue
+		}
+		downloads++
+		totalBytes += result.FileSize
+		if result.Conflict != "" {
+			conflicts++
+			a.logger.Warn("%s would be downloaded to %s, which %s", result.Path, result.Destination, result.Conflict)
+			continue
+		}
+		a.logger.Info("%s (%s) would be downloaded to %s", result.Path, humanize.IBytes(uint64(result.FileSize)), result.Destination)
+	}
+
+	a.logger.Info("Dry run: %d artifacts, %s, would be downloaded to %s, and %d would overwrite something",
+		downloads, humanize.IBytes(uint64(totalBytes)), downloadDestination, conflicts)
+}
+
+// dryRunResults resolves where each artifact would be downloaded to, the same
+// way Download does
+func (a *ArtifactDownloader) dryRunResults(artifacts []*api.Artifact, downloadDestination string, names *artifactNameTemplate) []ArtifactDownloadResult {
+	results := make([]ArtifactDownloadResult, 0, len(artifacts))
+	claimed := map[string]string{}
+
+	for _, artifact := range artifacts {
+		targetPath := a.destinationPath(artifact, downloadDestination, names)
+
+		size := artifact.FileSize
+		if a.conf.Range != nil && a.conf.Range.Length < size {
+			size = a.conf.Range.Length
+		}
+
+		result := ArtifactDownloadResult{
+			ID:          artifact.ID,
+			JobID:       artifact.JobID,
+			Source:      artifactSource(artifact),
+			Path:        artifact.Path,
+			FileSize:    size,
+			Destination: targetPath,
+			Sha1Sum:     artifact.Sha1Sum,
+			Sha256Sum:   artifact.Sha256Sum,
+		}
+
+		switch info, err := os.Stat(targetPath); {
+		case a.keepExisting(artifact, targetPath) != "":
+			result.Skipped = true
+		case claimed[targetPath] != "":
+			result.Conflict = fmt.Sprintf("%s would also be downloaded to", claimed[targetPath])
+		case err == nil && info.IsDir():
+			result.Conflict = "is an existing directory"
+		case err == nil:
+			result.Conflict = fmt.Sprintf("is an existing file of %s", humanize.IBytes(uint64(info.Size())))
+		}
+		if _, ok := claimed[targetPath]; !ok {
+			claimed[targetPath] = artifact.Path
+		}
+
+		results = append(results, result)
+	}
+	return results
+}
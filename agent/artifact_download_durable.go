@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// durableDownload makes downloaded artifacts durable, for when the next step
+// is a reboot or a VM snapshot, which can otherwise lose what's still only in
+// the page cache. Each artifact is synced once it's in place, and then the
+// directories they're in, up to the destination, are synced once, after they
+// all are, so that the entries for them survive too.
+type durableDownload struct {
+	destination string
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func newDurableDownload(destination string) *durableDownload {
+	return &durableDownload{
+		destination: filepath.Clean(destination),
+		dirs:        map[string]bool{},
+	}
+}
+
+// add syncs a downloaded artifact, and remembers the directories to sync
+func (d *durableDownload) add(path string) error {
+	if err := syncPath(path); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for dir := filepath.Dir(path); !d.dirs[dir]; dir = filepath.Dir(dir) {
+		d.dirs[dir] = true
+		if dir == d.destination || !within(d.destination, dir) {
+			break
+		}
+	}
+	return nil
+}
+
+// sync syncs the directories artifacts were downloaded into, the deepest
+// first, so each directory's entry is synced after what's in it
+func (d *durableDownload) sync() error {
+	// Windows can't sync directories, and NTFS journals their entries anyway
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dirs := make([]string, 0, len(d.dirs))
+	for dir := range d.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(filepath.Separator)) > strings.Count(dirs[j], string(filepath.Separator))
+	})
+	for _, dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPath flushes a file or directory to disk
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// within reports whether path is in dir
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
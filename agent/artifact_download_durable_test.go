@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDurableDownload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, path := range []string{"a/b/llamas.txt", "a/alpacas.txt", "camels.txt"} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, []byte("llamas"), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() error = %v", err)
+		}
+	}
+
+	d := newDurableDownload(dir)
+	for _, path := range []string{"a/b/llamas.txt", "a/alpacas.txt"} {
+		if err := d.add(filepath.Join(dir, path)); err != nil {
+			t.Fatalf("d.add(%s) error = %v", path, err)
+		}
+	}
+
+	// Only the directories up to the destination are synced, not its parents
+	var got []string
+	for dir := range d.dirs {
+		got = append(got, dir)
+	}
+	sort.Strings(got)
+	want := []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "a", "b")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("directories to sync diff (-want +got):\n%s", diff)
+	}
+	if err := d.sync(); err != nil {
+		t.Errorf("d.sync() error = %v", err)
+	}
+
+	if err := d.add(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("d.add(missing.txt) error = nil, want an error")
+	}
+}
+
+func TestArtifactDownloaderDurable(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 7,
+				"path": "images/disk.img",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprint(rw, "llamas\n")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Durable:     true,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+	if !d.durable.dirs[filepath.Join(dir, "images")] {
+		t.Errorf("images directory wasn't synced, want it synced after the artifact in it")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "images", "disk.img"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "llamas\n" {
+		t.Errorf("images/disk.img = %q, want %q", got, "llamas\n")
+	}
+}
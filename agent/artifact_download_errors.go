@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// ArtifactDownloadError is why an artifact failed to download
+type ArtifactDownloadError struct {
+	ID   string
+	Path string
+	Err  error
+}
+
+func (e *ArtifactDownloadError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *ArtifactDownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ArtifactDownloadMultiError is returned by ArtifactDownloader.Download when
+// some of the artifacts fail to download
+type ArtifactDownloadMultiError struct {
+	// Why each artifact that failed did, in the order they failed
+	Errors []*ArtifactDownloadError
+
+	// How many artifacts were found to download
+	Total int
+
+	// How many artifacts weren't downloaded, as the download was stopped
+	// after the first failure
+	Canceled int
+}
+
+func (e *ArtifactDownloadMultiError) Error() string {
+	msg := fmt.Sprintf("%d of %d artifacts failed to download", len(e.Errors), e.Total)
+	if e.Canceled > 0 {
+		msg += fmt.Sprintf(", and %d weren't downloaded", e.Canceled)
+	}
+	return msg
+}
+
+// Unwrap returns the error of each artifact that failed
+func (e *ArtifactDownloadMultiError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Summary returns a table of the artifacts that failed and why, one line
+// each after a heading
+func (e *ArtifactDownloadMultiError) Summary() []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tID\tERROR")
+	for _, err := range e.Errors {
+		// Errors that span lines would break up the table
+		reason := strings.Join(strings.Fields(err.Err.Error()), " ")
+		fmt.Fprintf(w, "%s\t%s\t%s\n", err.Path, err.ID, reason)
+	}
+	w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderFailFast(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 3,
+				"path": "alpacas.txt",
+				"url": "http://%s/missing"
+			}, {
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	for _, failFast := range []bool{false, true} {
+		d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+			BuildID:     "my-build",
+			Destination: t.TempDir(),
+			Concurrency: 1,
+			Retry:       RetryConfig{MaxAttempts: 1},
+			FailFast:    failFast,
+		})
+
+		err := d.Download(context.Background())
+		var failures *ArtifactDownloadMultiError
+		if !errors.As(err, &failures) {
+			t.Fatalf("FailFast: %t, d.Download() = %v, want an *ArtifactDownloadMultiError", failFast, err)
+		}
+		if len(failures.Errors) != 1 || failures.Errors[0].Path != "alpacas.txt" {
+			t.Errorf("FailFast: %t, failures.Errors = %v, want alpacas.txt to fail", failFast, failures.Errors)
+		}
+
+		wantCanceled := 0
+		if failFast {
+			wantCanceled = 1
+		}
+		if failures.Canceled != wantCanceled || failures.Total != 2 {
+			t.Errorf("FailFast: %t, failures = %+v, want %d of 2 canceled", failFast, failures, wantCanceled)
+		}
+
+		summary := failures.Summary()
+		if len(summary) != 2 || !strings.HasPrefix(summary[1], "alpacas.txt  f7b32a13-4e92-bb83-4600-ac5c5a13f86f  ") {
+			t.Errorf("FailFast: %t, failures.Summary() = %q, want a heading and a row for alpacas.txt", failFast, summary)
+		}
+	}
+}
+
+func TestArtifactDownloaderAllowFailures(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 3,
+				"path": "alpacas.txt",
+				"url": "http://%s/missing"
+			}, {
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	for threshold, wantErr := range map[FailureThreshold]bool{
+		{}:            true,
+		{Count: 1}:    false,
+		{Percent: 25}: true,
+		{Percent: 50}: false,
+	} {
+		d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+			BuildID:       "my-build",
+			Destination:   t.TempDir(),
+			Retry:         RetryConfig{MaxAttempts: 1},
+			AllowFailures: threshold,
+		})
+		if err := d.Download(context.Background()); (err != nil) != wantErr {
+			t.Errorf("AllowFailures: %s, d.Download() = %v, want an error: %t", threshold, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"path"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactFilter picks which of the artifacts found by a search are
+// downloaded, using the same gitignore-style patterns as --ignore-paths
+type artifactFilter struct {
+	include *ignoreMatcher
+	exclude *ignoreMatcher
+}
+
+func newArtifactFilter(include, exclude string) (*artifactFilter, error) {
+	inc, err := newIgnoreMatcher(include)
+	if err != nil {
+		return nil, err
+	}
+	exc, err := newIgnoreMatcher(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactFilter{include: inc, exclude: exc}, nil
+}
+
+// Match reports whether the artifact at name should be downloaded. With no
+// include patterns, everything that isn't excluded is.
+func (f *artifactFilter) Match(name string) bool {
+	name = strings.Replace(name, `\`, `/`, -1)
+	if len(f.include.patterns) > 0 && !matchArtifactPath(f.include, name) {
+		return false
+	}
+	return !matchArtifactPath(f.exclude, name)
+}
+
+// Filter returns the artifacts that should be downloaded
+func (f *artifactFilter) Filter(artifacts []*api.Artifact) []*api.Artifact {
+	filtered := make([]*api.Artifact, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		if f.Match(artifact.Path) {
+			filtered = append(filtered, artifact)
+		}
+	}
+	return filtered
+}
+
+// matchArtifactPath reports whether the artifact at name, or a directory it
+// is in, matches m
+func matchArtifactPath(m *ignoreMatcher, name string) bool {
+	if m.Match(name, false) {
+		return true
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if m.Match(dir, true) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactFilter(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name             string
+		include, exclude string
+		want             map[string]bool
+	}{
+		{
+			name: "no patterns",
+			want: map[string]bool{"logs/build.log": true, "pkg/app.tar.gz": true},
+		},
+		{
+			name:    "include and exclude",
+			include: "logs/**",
+			exclude: "logs/**/*.tmp",
+			want: map[string]bool{
+				"logs/build.log":          true,
+				"logs/tests/junit.xml":    true,
+				"logs/tests/scratch.tmp":  false,
+				"logs/tests/a/b/deep.log": true,
+				"pkg/app.tar.gz":          false,
+			},
+		},
+		{
+			name:    "file names and directories",
+			exclude: "*.tmp;coverage/",
+			want: map[string]bool{
+				"logs/build.log":        true,
+				"logs/scratch.tmp":      false,
+				"coverage/index.html":   false,
+				"report/coverage.html":  true,
+				`windows\path\file.tmp`: false,
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := newArtifactFilter(tc.include, tc.exclude)
+			require.NoError(t, err)
+
+			for name, want := range tc.want {
+				assert.Equal(t, want, f.Match(name), "f.Match(%q)", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/version"
+)
+
+// DownloadHTTPConfig is how to make the HTTP client that artifacts are
+// downloaded with, from Buildkite, CDNs, Artifactory, and anything else that
+// isn't downloaded with a cloud provider's client
+type DownloadHTTPConfig struct {
+	// How many artifacts are downloaded at once, so a connection to each host
+	// can be kept for each of them
+	Concurrency int
+
+	// If set, only HTTP/1.1 is used
+	DisableHTTP2 bool
+
+	// How long connecting, and then the TLS handshake, can each take. If
+	// zero, they can take 30 and 10 seconds
+	ConnectTimeout time.Duration
+
+	// How long to wait for the response headers once a request has been
+	// sent. If zero, there's no limit
+	ResponseHeaderTimeout time.Duration
+
+	// The proxy to download through, and how servers' certificates are
+	// verified
+	TransportConfig
+
+	// The User-Agent header to send. If empty, it's the agent's
+	UserAgent string
+}
+
+// NewDownloadHTTPClient returns a client for downloading artifacts. Sharing it
+// keeps connections alive between artifacts, so hundreds of small ones don't
+// each pay for connecting and a TLS handshake.
+func NewDownloadHTTPClient(c DownloadHTTPConfig) (*http.Client, error) {
+	// An explicit proxy takes precedence over a SOCKS5 proxy for artifact
+	// storage, and is connected to through an SSH tunnel
+	t := storageproxy.Transport(http.DefaultTransport.(*http.Transport).Clone())
+
+	// Keep a connection to each host for every artifact downloaded at once,
+	// rather than the two that are kept by default
+	if c.Concurrency > t.MaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = c.Concurrency
+	}
+	if c.Concurrency > t.MaxIdleConns {
+		t.MaxIdleConns = c.Concurrency
+	}
+
+	if c.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if c.ConnectTimeout > 0 {
+		t.DialContext = (&net.Dialer{
+			Timeout:   c.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		t.TLSHandshakeTimeout = c.ConnectTimeout
+	}
+	t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+
+	if err := c.TransportConfig.apply(t); err != nil {
+		return nil, err
+	}
+
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = version.UserAgent()
+	}
+
+	return &http.Client{Transport: userAgentTransport{userAgent: userAgent, next: t}}, nil
+}
+
+// userAgentTransport sets the User-Agent of requests that don't have one
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
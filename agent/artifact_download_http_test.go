@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewDownloadHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	client, _ := NewDownloadHTTPClient(DownloadHTTPConfig{Concurrency: 16})
+	transport := client.Transport.(userAgentTransport).next.(*http.Transport)
+	if got := transport.MaxIdleConnsPerHost; got != 16 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 16", got)
+	}
+	if !transport.ForceAttemptHTTP2 {
+		t.Errorf("ForceAttemptHTTP2 = false, want true")
+	}
+	if transport.Proxy == nil {
+		t.Errorf("Proxy = nil, want proxies from the environment")
+	}
+
+	client, _ = NewDownloadHTTPClient(DownloadHTTPConfig{Concurrency: 1, DisableHTTP2: true})
+	transport = client.Transport.(userAgentTransport).next.(*http.Transport)
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Errorf("with HTTP/2 disabled, ForceAttemptHTTP2 = %v and TLSNextProto = %v, want false and empty", transport.ForceAttemptHTTP2, transport.TLSNextProto)
+	}
+	if transport == http.DefaultTransport {
+		t.Errorf("NewDownloadHTTPClient() shares http.DefaultTransport, want a copy")
+	}
+}
+
+func TestNewDownloadHTTPClientConfig(t *testing.T) {
+	t.Parallel()
+
+	var gotUserAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotUserAgent = req.UserAgent()
+		fmt.Fprintln(rw, "OK")
+	}))
+	defer server.Close()
+
+	// Requests to the server go through the "proxy", which is the server
+	client, err := NewDownloadHTTPClient(DownloadHTTPConfig{
+		ConnectTimeout:        5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		TransportConfig:       TransportConfig{Proxy: server.URL},
+		UserAgent:             "llama-fetcher/1.0",
+	})
+	if err != nil {
+		t.Fatalf("NewDownloadHTTPClient() error = %v", err)
+	}
+	resp, err := client.Get("http://artifacts.invalid/llamas.txt")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if gotUserAgent != "llama-fetcher/1.0" {
+		t.Errorf("User-Agent = %q, want %q", gotUserAgent, "llama-fetcher/1.0")
+	}
+
+	transport := client.Transport.(userAgentTransport).next.(*http.Transport)
+	if transport.ResponseHeaderTimeout != 5*time.Second || transport.TLSHandshakeTimeout != 5*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %s, TLSHandshakeTimeout = %s, want 5s", transport.ResponseHeaderTimeout, transport.TLSHandshakeTimeout)
+	}
+
+	for _, c := range []DownloadHTTPConfig{
+		{TransportConfig: TransportConfig{Proxy: "proxy.internal:3128"}},
+		{TransportConfig: TransportConfig{CACertFile: "/does/not/exist.pem"}},
+	} {
+		if _, err := NewDownloadHTTPClient(c); err == nil {
+			t.Errorf("NewDownloadHTTPClient(%+v) error = nil, want an error", c)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// How many of the prefixes that matched the most artifacts are suggested when
+// a search finds too many
+const tooManyArtifactsPrefixes = 5
+
+// checkArtifactLimit returns an error if there are more artifacts than max,
+// listing the prefixes that matched the most to help narrow down the query.
+// If max is zero, there's no limit.
+func checkArtifactLimit(artifacts []*api.Artifact, max int) error {
+	if max <= 0 || len(artifacts) <= max {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Found %d artifacts, which is more than the %d allowed by --max-artifacts. Narrow down the query, or raise the limit if they're all needed. The most artifacts were found in:", len(artifacts), max)
+	for _, prefix := range topArtifactPrefixes(artifacts, tooManyArtifactsPrefixes) {
+		fmt.Fprintf(&b, "\n  %s (%d)", prefix.prefix, prefix.count)
+	}
+	return fmt.Errorf("%s", b.String())
+}
+
+type artifactPrefixCount struct {
+	prefix string
+	count  int
+}
+
+// topArtifactPrefixes returns the n directories, at most two deep, that the
+// most artifacts are in
+func topArtifactPrefixes(artifacts []*api.Artifact, n int) []artifactPrefixCount {
+	counts := map[string]int{}
+	for _, artifact := range artifacts {
+		parts := strings.Split(strings.ReplaceAll(artifact.Path, `\`, `/`), "/")
+		parts = parts[:len(parts)-1]
+		if len(parts) > 2 {
+			parts = parts[:2]
+		}
+		prefix := "./"
+		if len(parts) > 0 {
+			prefix = strings.Join(parts, "/") + "/"
+		}
+		counts[prefix]++
+	}
+
+	prefixes := make([]artifactPrefixCount, 0, len(counts))
+	for prefix, count := range counts {
+		prefixes = append(prefixes, artifactPrefixCount{prefix: prefix, count: count})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].count != prefixes[j].count {
+			return prefixes[i].count > prefixes[j].count
+		}
+		return prefixes[i].prefix < prefixes[j].prefix
+	})
+	if len(prefixes) > n {
+		prefixes = prefixes[:n]
+	}
+	return prefixes
+}
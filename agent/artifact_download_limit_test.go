@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckArtifactLimit(t *testing.T) {
+	t.Parallel()
+
+	var artifacts []*api.Artifact
+	for _, path := range []string{
+		"build/logs/a.log",
+		"build/logs/deep/b.log",
+		`build\logs\c.log`,
+		"build/bin/app",
+		"coverage.xml",
+	} {
+		artifacts = append(artifacts, &api.Artifact{Path: path})
+	}
+
+	for _, max := range []int{0, 5, 10} {
+		if err := checkArtifactLimit(artifacts, max); err != nil {
+			t.Errorf("checkArtifactLimit(artifacts, %d) = %v, want nil", max, err)
+		}
+	}
+
+	err := checkArtifactLimit(artifacts, 4)
+	if err == nil {
+		t.Fatalf("checkArtifactLimit(artifacts, 4) = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), "Found 5 artifacts") || !strings.Contains(err.Error(), "build/logs/ (3)") {
+		t.Errorf("checkArtifactLimit(artifacts, 4) = %q, want it to mention the count and build/logs/", err)
+	}
+
+	want := []artifactPrefixCount{
+		{prefix: "build/logs/", count: 3},
+		{prefix: "./", count: 1},
+	}
+	if diff := cmp.Diff(want, topArtifactPrefixes(artifacts, 2), cmp.AllowUnexported(artifactPrefixCount{})); diff != "" {
+		t.Errorf("topArtifactPrefixes() diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ArtifactDownloadManifest lists the artifacts a download wrote, for later
+// steps that need to know where they came from, or to remove exactly the
+// files that were downloaded
+type ArtifactDownloadManifest struct {
+	BuildID      string                          `json:"build_id"`
+	Query        string                          `json:"query"`
+	DownloadedAt time.Time                       `json:"downloaded_at"`
+	Artifacts    []ArtifactDownloadManifestEntry `json:"artifacts"`
+}
+
+// ArtifactDownloadManifestEntry is an artifact that was downloaded, and where
+// it was written to
+type ArtifactDownloadManifestEntry struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	JobID     string `json:"job_id,omitempty"`
+	Source    string `json:"source,omitempty"`
+	LocalPath string `json:"local_path"`
+	FileSize  int64  `json:"file_size"`
+	Sha1Sum   string `json:"sha1sum,omitempty"`
+	Sha256Sum string `json:"sha256sum,omitempty"`
+}
+
+// NewArtifactDownloadManifest makes a manifest of the artifacts that were
+// downloaded from how each went. Artifacts that failed, or whose files were
+// already there and kept, aren't in it. Local paths are made absolute, so
+// the manifest can be used from any directory.
+func NewArtifactDownloadManifest(buildID, query string, results []ArtifactDownloadResult) ArtifactDownloadManifest {
+	manifest := ArtifactDownloadManifest{
+		BuildID:      buildID,
+		Query:        query,
+		DownloadedAt: time.Now().UTC(),
+		Artifacts:    []ArtifactDownloadManifestEntry{},
+	}
+	for _, result := range results {
+		if result.Error != "" || result.Skipped {
+			continue
+		}
+		localPath := result.Destination
+		if abs, err := filepath.Abs(localPath); err == nil {
+			localPath = abs
+		}
+		manifest.Artifacts = append(manifest.Artifacts, ArtifactDownloadManifestEntry{
+			ID:        result.ID,
+			Path:      result.Path,
+			JobID:     result.JobID,
+			Source:    result.Source,
+			LocalPath: localPath,
+			FileSize:  result.FileSize,
+			Sha1Sum:   result.Sha1Sum,
+			Sha256Sum: result.Sha256Sum,
+		})
+	}
+	return manifest
+}
+
+// WriteFile writes the manifest to path as JSON, through a temporary file
+// next to it, so a step reading it never sees it half written
+func (m ArtifactDownloadManifest) WriteFile(path string) (err error) {
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(append(contents, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
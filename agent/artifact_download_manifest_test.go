@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArtifactDownloadManifest(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	results := []ArtifactDownloadResult{
+		{
+			ID:          "a1",
+			Path:        "pkg/app.tar.gz",
+			JobID:       "job-1",
+			Source:      "s3://my-bucket/builds/pkg/app.tar.gz",
+			Destination: filepath.Join(dir, "pkg", "app.tar.gz"),
+			FileSize:    42,
+			Sha256Sum:   "abc123",
+		},
+		{ID: "a2", Path: "pkg/failed.tar.gz", Destination: filepath.Join(dir, "pkg", "failed.tar.gz"), Error: "boom"},
+		{ID: "a3", Path: "pkg/kept.tar.gz", Destination: filepath.Join(dir, "pkg", "kept.tar.gz"), Skipped: true},
+	}
+
+	path := filepath.Join(dir, "manifest.json")
+	if err := NewArtifactDownloadManifest("my-build", "pkg/*", results).WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", path, err)
+	}
+	var got ArtifactDownloadManifest
+	if err := json.Unmarshal(contents, &got); err != nil {
+		t.Fatalf("json.Unmarshal(manifest) error = %v", err)
+	}
+
+	if got.BuildID != "my-build" || got.Query != "pkg/*" || got.DownloadedAt.IsZero() {
+		t.Errorf("manifest = %+v, want the build, query and when it was downloaded", got)
+	}
+	want := []ArtifactDownloadManifestEntry{{
+		ID:        "a1",
+		Path:      "pkg/app.tar.gz",
+		JobID:     "job-1",
+		Source:    "s3://my-bucket/builds/pkg/app.tar.gz",
+		LocalPath: filepath.Join(dir, "pkg", "app.tar.gz"),
+		FileSize:  42,
+		Sha256Sum: "abc123",
+	}}
+	if diff := cmp.Diff(want, got.Artifacts); diff != "" {
+		t.Errorf("manifest artifacts diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestArtifactSource(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		artifact *api.Artifact
+		want     string
+	}{
+		{
+			artifact: &api.Artifact{Path: "a/b.txt", UploadDestination: "s3://bucket/prefix/"},
+			want:     "s3://bucket/prefix/a/b.txt",
+		},
+		{
+			artifact: &api.Artifact{Path: "a/b.txt", URL: "https://buildkite.com/artifacts/a1"},
+			want:     "https://buildkite.com/artifacts/a1",
+		},
+	} {
+		if got := artifactSource(tc.artifact); got != tc.want {
+			t.Errorf("artifactSource(%+v) = %q, want %q", tc.artifact, got, tc.want)
+		}
+	}
+}
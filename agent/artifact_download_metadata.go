@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// restoreMetadata gives a downloaded artifact the executable bits and
+// modification time it had when it was uploaded. The rest of its mode is
+// left as the download created it, so the umask still applies. Artifacts
+// uploaded without them recorded are left alone.
+func (a *ArtifactDownloader) restoreMetadata(artifact *api.Artifact, targetPath string) error {
+	// Part of an artifact isn't the file that was uploaded
+	if a.conf.Range != nil {
+		return nil
+	}
+
+	if exec := os.FileMode(artifact.FileMode) & 0o111; exec != 0 {
+		info, err := os.Stat(targetPath)
+		if err != nil {
+			return fmt.Errorf("restoring the mode of %s: %w", artifact.Path, err)
+		}
+		if err := os.Chmod(targetPath, info.Mode().Perm()|exec); err != nil {
+			return fmt.Errorf("restoring the mode of %s: %w", artifact.Path, err)
+		}
+	}
+
+	if artifact.FileModifiedAt != nil {
+		mtime := *artifact.FileModifiedAt
+		if err := os.Chtimes(targetPath, mtime, mtime); err != nil {
+			return fmt.Errorf("restoring the modification time of %s: %w", artifact.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderPreserveMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows files don't have executable bits")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"file_mode": 493,
+				"file_modified_at": "2023-04-01T12:00:00Z",
+				"path": "bin/llama",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:          "my-build",
+		Destination:      dir,
+		PreserveMetadata: true,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "bin", "llama"))
+	if err != nil {
+		t.Fatalf("os.Stat() = %v", err)
+	}
+	if info.Mode().Perm()&0o100 == 0 {
+		t.Errorf("mode = %v, want it executable", info.Mode())
+	}
+	if want := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Errorf("modification time = %v, want %v", info.ModTime(), want)
+	}
+}
@@ -0,0 +1,41 @@
+package agent
+
+import "github.com/buildkite/agent/v3/api"
+
+// ArtifactDownloadObserver is told how each artifact's download is going, so
+// programs that embed ArtifactDownloader can show their own progress rather
+// than reading it from the log. Any of its functions can be nil. They're
+// called from the goroutines downloading the artifacts, so several can be
+// called at once.
+type ArtifactDownloadObserver struct {
+	// Called when an artifact starts downloading to targetPath
+	Started func(artifact *api.Artifact, targetPath string)
+
+	// Called with the number of bytes of an artifact that have been
+	// downloaded since it was last called for the artifact. When a download
+	// is retried, bytes that have to be downloaded again are taken back
+	// with a negative number first, so they're only counted once.
+	Progress func(artifact *api.Artifact, bytes int64)
+
+	// Called once for each artifact with how it went, including artifacts
+	// that weren't downloaded because they failed or were skipped
+	Finished func(artifact *api.Artifact, result ArtifactDownloadResult)
+}
+
+func (o ArtifactDownloadObserver) started(artifact *api.Artifact, targetPath string) {
+	if o.Started != nil {
+		o.Started(artifact, targetPath)
+	}
+}
+
+func (o ArtifactDownloadObserver) progress(artifact *api.Artifact, bytes int64) {
+	if o.Progress != nil {
+		o.Progress(artifact, bytes)
+	}
+}
+
+func (o ArtifactDownloadObserver) finished(artifact *api.Artifact, result ArtifactDownloadResult) {
+	if o.Finished != nil {
+		o.Finished(artifact, result)
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileOwner is the user and group that downloaded files are given, such as
+// the user jobs run as when the agent runs as root. An ID of -1 leaves that
+// part of the ownership as it is.
+type FileOwner struct {
+	UID, GID int
+}
+
+// ParseFileOwner parses an owner such as "buildkite", "buildkite:staff" or
+// "1000:1000". Without a group, the user's primary group is used, if it can be
+// looked up.
+func ParseFileOwner(s string) (*FileOwner, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("the owner of downloaded files can't be set on Windows")
+	}
+
+	name, group, hasGroup := strings.Cut(s, ":")
+	if name == "" && (!hasGroup || group == "") {
+		return nil, fmt.Errorf("%q has no user or group", s)
+	}
+
+	owner := &FileOwner{UID: -1, GID: -1}
+	if name != "" {
+		u, err := lookupUser(name)
+		if err != nil {
+			// A numeric user without an entry in the user database can
+			// still own files
+			id, convErr := strconv.Atoi(name)
+			if convErr != nil {
+				return nil, err
+			}
+			owner.UID = id
+		} else {
+			if owner.UID, err = strconv.Atoi(u.Uid); err != nil {
+				return nil, fmt.Errorf("user %s has a non-numeric ID %q", name, u.Uid)
+			}
+			if !hasGroup {
+				if gid, err := strconv.Atoi(u.Gid); err == nil {
+					owner.GID = gid
+				}
+			}
+		}
+	}
+
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			owner.GID = id
+		} else {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			if owner.GID, err = strconv.Atoi(g.Gid); err != nil {
+				return nil, fmt.Errorf("group %s has a non-numeric ID %q", group, g.Gid)
+			}
+		}
+	}
+	return owner, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// downloadOwnership gives the artifacts a download writes, and the
+// directories it creates for them, to an owner. The destination belongs to
+// the user jobs run as, so nothing on the way to a file is followed if it's a
+// symlink, or a job could have the agent give it any file on the host.
+type downloadOwnership struct {
+	owner *FileOwner
+	root  string
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func newDownloadOwnership(owner *FileOwner, destination string) (*downloadOwnership, error) {
+	root, err := filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &downloadOwnership{owner: owner, root: root, dirs: map[string]bool{}}, nil
+}
+
+// expect records the directories within the destination that don't exist
+// yet above path, which this download is about to create. Call it before
+// the file at path is downloaded.
+func (o *downloadOwnership) expect(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for dir := filepath.Dir(abs); dir != o.root && within(o.root, dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		o.dirs[dir] = true
+	}
+}
+
+// chown gives a downloaded file, and the directories above it that this
+// download created, to the owner
+func (o *downloadOwnership) chown(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !within(o.root, abs) || abs == o.root {
+		return fmt.Errorf("%s isn't within the download path %s", path, o.root)
+	}
+
+	paths := []string{abs}
+	o.mu.Lock()
+	for dir := filepath.Dir(abs); o.dirs[dir]; dir = filepath.Dir(dir) {
+		paths = append(paths, dir)
+	}
+	o.mu.Unlock()
+
+	for _, p := range paths {
+		if err := chownWithin(o.root, p, o.owner.UID, o.owner.GID); err != nil {
+			return fmt.Errorf("changing the owner of %s: %w", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFileOwner(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		owner    string
+		uid, gid int
+	}{
+		{"123456:654321", 123456, 654321},
+		{":654321", -1, 654321},
+		{"123456:", 123456, -1},
+	} {
+		got, err := ParseFileOwner(tc.owner)
+		if err != nil {
+			t.Errorf("ParseFileOwner(%q) error = %v", tc.owner, err)
+			continue
+		}
+		assert.Equal(t, &FileOwner{UID: tc.uid, GID: tc.gid}, got, "ParseFileOwner(%q)", tc.owner)
+	}
+
+	for _, owner := range []string{"", ":", "no-such-user-llamas", "0:no-such-group-llamas"} {
+		if _, err := ParseFileOwner(owner); err == nil {
+			t.Errorf("ParseFileOwner(%q) error = nil, want an error", owner)
+		}
+	}
+}
+
+func TestArtifactDownloaderOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Only root can give files to another user")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "pkg/llama.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Owner:       &FileOwner{UID: 4321, GID: 8765},
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	for path, want := range map[string]uint32{
+		filepath.Join(dir, "pkg", "llama.txt"): 4321,
+		filepath.Join(dir, "pkg"):              4321,
+		// It was already there, so it's left alone
+		dir: 0,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("os.Stat(%q) = %v", path, err)
+		}
+		if uid := info.Sys().(*syscall.Stat_t).Uid; uid != want {
+			t.Errorf("owner of %s = %d, want %d", path, uid, want)
+		}
+	}
+}
+
+func TestChownWithinDoesntFollowSymlinks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Only root can give files to another user")
+	}
+
+	root, outside := t.TempDir(), t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("llamas"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "pkg")); err != nil {
+		t.Fatalf("os.Symlink() error = %v", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "llama.txt")); err != nil {
+		t.Fatalf("os.Symlink() error = %v", err)
+	}
+
+	if err := chownWithin(root, filepath.Join(root, "pkg", "secret"), 4321, 8765); err == nil {
+		t.Errorf("chownWithin() through a symlinked directory error = nil, want an error")
+	}
+	if err := chownWithin(root, filepath.Join(root, "llama.txt"), 4321, 8765); err != nil {
+		t.Errorf("chownWithin() of a symlink error = %v", err)
+	}
+
+	info, err := os.Stat(secret)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) = %v", secret, err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; uid != 0 {
+		t.Errorf("owner of %s = %d, want it left as 0", secret, uid)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// chownWithin changes the owner of path, which is within root, without
+// following any symlinks in the path from root to it, including path itself
+func chownWithin(root, path string, uid, gid int) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || !within(root, path) {
+		return fmt.Errorf("%s isn't within %s", path, root)
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", part, err)
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+
+	return unix.Fchownat(fd, parts[len(parts)-1], uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+}
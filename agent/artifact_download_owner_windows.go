@@ -0,0 +1,9 @@
+package agent
+
+import "errors"
+
+// chownWithin can't change the owner of files on Windows, which
+// ParseFileOwner doesn't allow an owner for anyway
+func chownWithin(root, path string, uid, gid int) error {
+	return errors.New("the owner of downloaded files can't be set on Windows")
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+)
+
+// artifactDownloadProgress adds up the progress of all the artifacts being
+// downloaded, and logs it every so often
+type artifactDownloadProgress struct {
+	logger   logger.Logger
+	interval time.Duration
+	now      func() time.Time
+
+	// What there is to download
+	totalFiles int
+	totalBytes int64
+
+	mu      sync.Mutex
+	started time.Time
+	bytes   int64
+	done    int
+	failed  int
+}
+
+func newArtifactDownloadProgress(l logger.Logger, interval time.Duration, files int, bytes int64) *artifactDownloadProgress {
+	return &artifactDownloadProgress{
+		logger:     l,
+		interval:   interval,
+		now:        time.Now,
+		totalFiles: files,
+		totalBytes: bytes,
+		started:    time.Now(),
+	}
+}
+
+// expect adds to what there is to download, as more artifacts are found
+func (p *artifactDownloadProgress) expect(files int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.totalFiles += files
+	p.totalBytes += bytes
+}
+
+// add records bytes that have been downloaded
+func (p *artifactDownloadProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes += n
+}
+
+// finished records an artifact that's finished downloading, or failed to
+func (p *artifactDownloadProgress) finished(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failed++
+	} else {
+		p.done++
+	}
+}
+
+// run logs the progress every interval until the context is done
+func (p *artifactDownloadProgress) run(ctx context.Context) {
+	if p.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.logger.Info("%s", p.report())
+		}
+	}
+}
+
+// report describes how far the downloads have got, and how long they'll take
+// to finish at the rate they're going
+func (p *artifactDownloadProgress) report() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := p.now().Sub(p.started)
+	msg := fmt.Sprintf("Downloaded %d/%d artifacts", p.done, p.totalFiles)
+	if p.failed > 0 {
+		msg += fmt.Sprintf(" (%d failed)", p.failed)
+	}
+
+	bytes := p.bytes
+	if p.totalBytes > 0 {
+		if bytes > p.totalBytes {
+			bytes = p.totalBytes
+		}
+		msg += fmt.Sprintf(", %s of %s (%d%%)", humanize.IBytes(uint64(bytes)), humanize.IBytes(uint64(p.totalBytes)), bytes*100/p.totalBytes)
+	} else {
+		msg += ", " + humanize.IBytes(uint64(bytes))
+	}
+
+	if elapsed < time.Second || bytes == 0 {
+		return msg
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+	msg += fmt.Sprintf(" at %s/s", humanize.IBytes(uint64(rate)))
+
+	if remaining := p.totalBytes - bytes; p.totalBytes > 0 && remaining > 0 {
+		eta := time.Duration(float64(remaining) / rate * float64(time.Second))
+		msg += fmt.Sprintf(", about %s left", eta.Round(time.Second))
+	}
+	return msg
+}
+
+// summary describes the downloads once they've finished
+func (p *artifactDownloadProgress) summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := p.now().Sub(p.started).Round(time.Millisecond)
+	msg := fmt.Sprintf("Downloaded %d artifacts, %s in %s", p.done, humanize.IBytes(uint64(p.bytes)), elapsed)
+	if p.failed > 0 {
+		msg += fmt.Sprintf(", and %d failed", p.failed)
+	}
+	return msg
+}
+
+// artifactProgress reports the progress of downloading one artifact, and
+// takes it back if the artifact has to be downloaded again
+type artifactProgress struct {
+	report func(int64)
+	bytes  int64
+}
+
+// add reports n bytes, which are negative when they're taken back
+func (p *artifactProgress) add(n int64) {
+	atomic.AddInt64(&p.bytes, n)
+	p.report(n)
+}
+
+// reset takes back everything that's been reported
+func (p *artifactProgress) reset() {
+	if n := atomic.SwapInt64(&p.bytes, 0); n != 0 {
+		p.report(-n)
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloadProgressReport(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	p := newArtifactDownloadProgress(logger.Discard, time.Second, 4, 400*1024*1024)
+	p.started = start
+	p.now = func() time.Time { return now }
+
+	if got, want := p.report(), "Downloaded 0/4 artifacts, 0 B of 400 MiB (0%)"; got != want {
+		t.Errorf("p.report() = %q, want %q", got, want)
+	}
+
+	p.add(50 * 1024 * 1024)
+	p.add(50 * 1024 * 1024)
+	p.finished(nil)
+	now = start.Add(10 * time.Second)
+
+	if got, want := p.report(), "Downloaded 1/4 artifacts, 100 MiB of 400 MiB (25%) at 10 MiB/s, about 30s left"; got != want {
+		t.Errorf("p.report() = %q, want %q", got, want)
+	}
+
+	p.add(300 * 1024 * 1024)
+	p.finished(nil)
+	p.finished(nil)
+	p.finished(errors.New("oops"))
+	now = start.Add(40 * time.Second)
+
+	if got, want := p.report(), "Downloaded 3/4 artifacts (1 failed), 400 MiB of 400 MiB (100%) at 10 MiB/s"; got != want {
+		t.Errorf("p.report() = %q, want %q", got, want)
+	}
+	if got, want := p.summary(), "Downloaded 3 artifacts, 400 MiB in 40s, and 1 failed"; got != want {
+		t.Errorf("p.summary() = %q, want %q", got, want)
+	}
+}
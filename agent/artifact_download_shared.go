@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/gofrs/flock"
+)
+
+// The shared cache directory is only for the agent's user, as whatever is in
+// it is copied into jobs
+const sharedCacheDirPermissions = 0o700
+
+// How often a job waiting for another to download an artifact into the
+// shared cache checks whether it's done
+var sharedDownloadLockRetry = 100 * time.Millisecond
+
+// downloadShared downloads an artifact through the shared cache directory, so
+// that when jobs on the same host download it at once, only one of them
+// fetches it, and the rest wait for it and copy it from the cache. Artifacts
+// are cached by ID, as what was uploaded under an ID never changes, and are
+// checked against their checksums whenever they're found in the cache, so
+// something else that put a file there can't stand in for them.
+func (a *ArtifactDownloader) downloadShared(ctx context.Context, artifact *api.Artifact, targetPath string, progress func(int64), download func() error) error {
+	if a.conf.Prefetch && artifact.ID == "" {
+		return fmt.Errorf("%s can't be prefetched, as it has no ID to cache it by", artifact.Path)
+	}
+
+	// Part of an artifact can't stand in for the whole of it
+	if a.conf.SharedCacheDir == "" || a.conf.Range != nil || artifact.ID == "" {
+		return download()
+	}
+
+	if err := os.MkdirAll(a.conf.SharedCacheDir, sharedCacheDirPermissions); err != nil {
+		a.logger.Warn("Downloading %s without the shared cache, as it couldn't be created: %s", artifact.Path, err)
+		return download()
+	}
+	cachePath := filepath.Join(a.conf.SharedCacheDir, artifact.ID)
+
+	lock := flock.New(cachePath + ".lock")
+	if _, err := lock.TryLockContext(ctx, sharedDownloadLockRetry); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		a.logger.Warn("Downloading %s without the shared cache, as it couldn't be locked: %s", artifact.Path, err)
+		return download()
+	}
+	defer lock.Unlock()
+
+	// Another job has already downloaded it
+	if _, err := os.Stat(cachePath); err == nil {
+		switch err := a.verifyCached(artifact, cachePath); {
+		case err != nil:
+			a.logger.Warn("Removing %s from the shared cache and downloading it again, as %s", artifact.Path, err)
+			if err := os.Remove(cachePath); err != nil {
+				return fmt.Errorf("removing %s from the shared cache: %w", artifact.Path, err)
+			}
+
+		case a.conf.Prefetch:
+			a.logger.Debug("%s is already in the shared cache at %s", artifact.Path, cachePath)
+			progress(artifact.FileSize)
+			return nil
+
+		default:
+			a.logger.Debug("Copying %s from the shared cache at %s", artifact.Path, cachePath)
+			if err := a.copySharedFile(cachePath, targetPath); err != nil {
+				return fmt.Errorf("copying %s from the shared cache: %w", artifact.Path, err)
+			}
+			progress(artifact.FileSize)
+			return nil
+		}
+	}
+
+	// Other agents may have it already, in which case the object store
+	// doesn't need to be asked for it again
+	fetched := false
+	if len(a.conf.Peers) > 0 {
+		switch err := a.fetchFromPeers(ctx, artifact, targetPath, progress); {
+		case err == nil:
+			fetched = true
+		case errors.Is(err, errNoPeers):
+			a.logger.Debug("Downloading %s from the object store, as no peer has it", artifact.Path)
+		default:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			a.logger.Warn("Downloading %s from the object store, as fetching it from peers failed: %s", artifact.Path, err)
+		}
+	}
+	if !fetched {
+		if err := download(); err != nil {
+			return err
+		}
+	}
+
+	// Prefetched artifacts are downloaded next to the cache, and only needed
+	// in it
+	if a.conf.Prefetch {
+		return os.Rename(targetPath, cachePath)
+	}
+
+	// The download has already succeeded, so failing to share it only means
+	// other jobs download it themselves
+	if err := copyFileAtomically(targetPath, cachePath); err != nil {
+		a.logger.Warn("Failed to add %s to the shared cache: %s", artifact.Path, err)
+	}
+	return nil
+}
+
+// verifyCached checks an artifact in the shared cache against the checksums it
+// was uploaded with. Unlike a download, one that has no checksum to check
+// can't be trusted, as anything that can write to the cache could have put
+// it there.
+func (a *ArtifactDownloader) verifyCached(artifact *api.Artifact, cachePath string) error {
+	algorithm, err := transfer.VerifyFile(cachePath, map[string]string{
+		"sha1":   artifact.Sha1Sum,
+		"sha256": artifact.Sha256Sum,
+	}, a.conf.ChecksumPreference)
+	if err != nil {
+		return err
+	}
+	if algorithm == "" {
+		return fmt.Errorf("it has no checksum from %q to verify it with", a.conf.ChecksumPreference)
+	}
+	return nil
+}
+
+// copySharedFile copies a file from the shared cache to where it's being
+// downloaded to, creating missing directories
+func (a *ArtifactDownloader) copySharedFile(cachePath, targetPath string) error {
+	if err := downloadDirs.MkdirAll(filepath.Dir(targetPath), a.conf.DirPermissions); err != nil {
+		return err
+	}
+	return copyFileAtomically(cachePath, targetPath)
+}
+
+// copyFileAtomically copies src to dst through a temporary file next to dst,
+// so dst is never seen half written. It has the same permissions as src.
+func copyFileAtomically(src, dst string) error {
+	return copyFile(src, dst, false)
+}
+
+// copyFile copies src to dst like copyFileAtomically, and if sync is set,
+// makes sure the copy is on disk before it's renamed to dst
+func copyFile(src, dst string, sync bool) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(out.Name())
+		}
+	}()
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderSharedCache(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"sha256sum": "a12b7cb43c9d9134b5bb1b35e9096b66775d9e92e7611d1cc92b02edd6782a87",
+				"path": "pkg/llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			atomic.AddInt32(&downloads, 1)
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	// Several jobs download the same artifact at once
+	cache := t.TempDir()
+	var wg sync.WaitGroup
+	dirs := make([]string, 4)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+				BuildID:        "my-build",
+				Destination:    dir,
+				SharedCacheDir: cache,
+			})
+			if err := d.Download(context.Background()); err != nil {
+				t.Errorf("d.Download() = %v", err)
+			}
+		}(dirs[i])
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&downloads); got != 1 {
+		t.Errorf("artifact was downloaded %d times, want once", got)
+	}
+	for _, dir := range dirs {
+		contents, err := os.ReadFile(filepath.Join(dir, "pkg", "llamas.txt"))
+		if err != nil || string(contents) != "OK\n" {
+			t.Errorf("os.ReadFile() = %q, %v, want %q", contents, err, "OK\n")
+		}
+	}
+}
+
+func TestArtifactDownloaderPrefetch(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"sha256sum": "a12b7cb43c9d9134b5bb1b35e9096b66775d9e92e7611d1cc92b02edd6782a87",
+				"path": "toolchain/llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			atomic.AddInt32(&downloads, 1)
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+	cache := t.TempDir()
+
+	// Prefetching again finds it's already cached
+	for i := 0; i < 2; i++ {
+		d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+			BuildID:        "my-build",
+			SharedCacheDir: cache,
+			Prefetch:       true,
+		})
+		if err := d.Download(context.Background()); err != nil {
+			t.Fatalf("d.Download() = %v", err)
+		}
+		if got, want := d.Results()[0].Destination, filepath.Join(cache, "4600ac5c-5a13-4e92-bb83-f86f218f7b32"); got != want {
+			t.Errorf("d.Results()[0].Destination = %q, want %q", got, want)
+		}
+	}
+
+	entries, err := os.ReadDir(cache)
+	if err != nil {
+		t.Fatalf("os.ReadDir(%q) = %v", cache, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("%s was left in the shared cache", entry.Name())
+		}
+	}
+
+	// The job copies it from the cache
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:        "my-build",
+		Destination:    dir,
+		SharedCacheDir: cache,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+	if got := atomic.LoadInt32(&downloads); got != 1 {
+		t.Errorf("artifact was downloaded %d times, want once", got)
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, "toolchain", "llamas.txt"))
+	if err != nil || string(contents) != "OK\n" {
+		t.Errorf("os.ReadFile() = %q, %v, want %q", contents, err, "OK\n")
+	}
+}
+
+func TestArtifactDownloaderSharedCacheReplacesUnverifiedFiles(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"sha256sum": "a12b7cb43c9d9134b5bb1b35e9096b66775d9e92e7611d1cc92b02edd6782a87",
+				"path": "pkg/llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			atomic.AddInt32(&downloads, 1)
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	// Something else has put a file in the cache under the artifact's ID
+	cache := t.TempDir()
+	cachePath := filepath.Join(cache, "4600ac5c-5a13-4e92-bb83-f86f218f7b32")
+	if err := os.WriteFile(cachePath, []byte("NO\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%q) = %v", cachePath, err)
+	}
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:        "my-build",
+		Destination:    dir,
+		SharedCacheDir: cache,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	if got := atomic.LoadInt32(&downloads); got != 1 {
+		t.Errorf("artifact was downloaded %d times, want once", got)
+	}
+	for _, path := range []string{filepath.Join(dir, "pkg", "llamas.txt"), cachePath} {
+		contents, err := os.ReadFile(path)
+		if err != nil || string(contents) != "OK\n" {
+			t.Errorf("os.ReadFile(%q) = %q, %v, want %q", path, contents, err, "OK\n")
+		}
+	}
+}
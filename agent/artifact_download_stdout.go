@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/buildkite/agent/v3/usage"
+	"github.com/buildkite/roko"
+	"github.com/dustin/go-humanize"
+)
+
+// StdoutDestination is the download destination that writes the artifact to
+// standard output, rather than to a file
+const StdoutDestination = "-"
+
+// downloadToOutput streams a single artifact to the configured Output. As
+// what's been written can't be taken back, a failed attempt carries on from
+// where it stopped, and the artifact is checked against its checksum as it's
+// written, rather than being downloaded again if it doesn't match.
+func (a *ArtifactDownloader) downloadToOutput(ctx context.Context, artifacts []*api.Artifact, cdns []*artifactCDN) error {
+	if len(artifacts) != 1 {
+		return fmt.Errorf("Found %d artifacts, but only a single artifact can be streamed", len(artifacts))
+	}
+	artifact := artifacts[0]
+
+	url, headers := artifact.URL, map[string]string{}
+	if cdn := cdnFor(cdns, artifact.URL, artifact.UploadDestination); cdn != nil {
+		var err error
+		url, headers, err = cdn.sign(cdn.artifactURL(artifact, artifactLocalPath(artifact.Path)))
+		if err != nil {
+			return fmt.Errorf("signing the CDN URL for %s: %w", artifact.Path, err)
+		}
+	}
+
+	header := http.Header{}
+	for k, v := range headers {
+		header.Add(k, v)
+	}
+	backend := &transfer.HTTPBackend{
+		Client:    a.conf.HTTPClient,
+		Header:    header,
+		DebugHTTP: a.conf.DebugHTTP,
+		Logger:    a.logger,
+	}
+
+	offset, length := int64(0), artifact.FileSize
+	if a.conf.Range != nil {
+		offset, length = a.conf.Range.Offset, a.conf.Range.Length
+	}
+
+	// Part of an artifact can't be checked against the whole artifact's
+	// checksum
+	var algorithm, expected string
+	var h hash.Hash
+	if a.conf.Range == nil {
+		algorithm, expected, h = a.outputChecksum(artifact)
+	}
+	if algorithm == "" && a.conf.Range == nil && a.conf.RequireChecksums {
+		return fmt.Errorf("verifying %s: it has no checksum from %q to verify it with", artifact.Path, a.conf.ChecksumPreference)
+	}
+
+	w := a.conf.Output
+	if h != nil {
+		w = io.MultiWriter(a.conf.Output, h)
+	}
+
+	var written int64
+	err := a.conf.Retry.retrier(DefaultDownloadRetries).DoWithContext(ctx, retrylog.Wrap("Downloading file", func(r *roko.Retrier) error {
+		err := a.conf.Retry.attempt(ctx, func(ctx context.Context) error {
+			var body io.ReadCloser
+			var err error
+			switch {
+			case written > 0:
+				body, err = backend.ReadRange(ctx, url, offset+written, length-written)
+			case a.conf.Range != nil:
+				body, err = backend.ReadRange(ctx, url, offset, length)
+			default:
+				body, err = backend.Open(ctx, url)
+			}
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+
+			n, err := io.Copy(w, transfer.NewThrottledReader(ctx, body, a.conf.MaxBandwidth))
+			written += n
+			return err
+		})
+		if errors.Is(err, transfer.ErrRangeIgnored) {
+			// The server would send what's already been written again
+			r.Break()
+		}
+		if err != nil {
+			a.logger.Warn("Error trying to download %s (%s) %s", artifact.Path, err, r)
+		}
+		return err
+	}))
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", artifact.Path, err)
+	}
+
+	if h != nil {
+		if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != expected {
+			return &transfer.ChecksumMismatchError{
+				Path:      artifact.Path,
+				Algorithm: algorithm,
+				Expected:  expected,
+				Actual:    actual,
+			}
+		}
+		a.logger.Debug("Verified %s checksum of %s", algorithm, artifact.Path)
+	}
+
+	a.logger.Info("Successfully downloaded \"%s\" %s", artifact.Path, humanize.Bytes(uint64(written)))
+	a.conf.Usage.Add(usage.ArtifactDownload, written)
+
+	return nil
+}
+
+// outputChecksum returns the strongest preferred checksum the artifact has,
+// and a hash to compute it with as it's written
+func (a *ArtifactDownloader) outputChecksum(artifact *api.Artifact) (string, string, hash.Hash) {
+	expected := map[string]string{
+		"sha1":   artifact.Sha1Sum,
+		"sha256": artifact.Sha256Sum,
+	}
+	for _, algorithm := range a.conf.ChecksumPreference {
+		newHash, ok := transfer.ChecksumAlgorithms[algorithm]
+		if !ok || expected[algorithm] == "" {
+			continue
+		}
+		return algorithm, expected[algorithm], newHash()
+	}
+	return "", "", nil
+}
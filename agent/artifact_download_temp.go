@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactStagingPrefix starts the name of the directory artifacts are
+// downloaded to before they're moved into the destination
+const artifactStagingPrefix = ".buildkite-downloading-"
+
+// stagingDir creates the directory artifacts are downloaded to before they're
+// moved into the destination. It's in TempDir if there is one, and otherwise
+// in the destination, where moving them is always a rename.
+func (a *ArtifactDownloader) stagingDir(downloadDestination string) (string, error) {
+	if a.conf.TempDir == "" {
+		return os.MkdirTemp(downloadDestination, artifactStagingPrefix)
+	}
+
+	info, err := os.Stat(a.conf.TempDir)
+	if err != nil {
+		return "", fmt.Errorf("the download temp directory: %w", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("the download temp directory %s is not a directory", a.conf.TempDir)
+	}
+	staging, err := os.MkdirTemp(a.conf.TempDir, artifactStagingPrefix)
+	if err != nil {
+		return "", fmt.Errorf("the download temp directory %s can't be written to: %w", a.conf.TempDir, err)
+	}
+	return staging, nil
+}
+
+// unstage moves a downloaded artifact from where it was staged to where it
+// belongs in the destination, and returns where that is
+func (a *ArtifactDownloader) unstage(artifact *api.Artifact, names *artifactNameTemplate, targetPath, downloadDestination string) (string, error) {
+	destination := a.destinationPath(artifact, downloadDestination, names)
+	if err := downloadDirs.MkdirAll(filepath.Dir(destination), a.conf.DirPermissions); err != nil {
+		return targetPath, err
+	}
+	if err := moveFile(targetPath, destination); err != nil {
+		return targetPath, fmt.Errorf("moving %s to %s: %w", artifact.Path, destination, err)
+	}
+	return destination, nil
+}
+
+// moveFile moves src to dst. Across filesystems, where it can't be renamed,
+// it's copied and synced next to dst, then renamed into place, so that dst is
+// never seen half written, even on a network filesystem.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	if err := copyFile(src, dst, true); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// isCrossDevice reports whether err is from renaming a file to another
+// filesystem
+func isCrossDevice(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	// Windows calls it ERROR_NOT_SAME_DEVICE
+	return errno == syscall.EXDEV || (runtime.GOOS == "windows" && errno == 17)
+}
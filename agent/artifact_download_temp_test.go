@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderTempDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 7,
+				"path": "pkg/llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprint(rw, "llamas\n")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir, tempDir := t.TempDir(), t.TempDir()
+	var started string
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		TempDir:     tempDir,
+		Observer: ArtifactDownloadObserver{
+			Started: func(_ *api.Artifact, targetPath string) { started = targetPath },
+		},
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	if !strings.HasPrefix(started, tempDir) {
+		t.Errorf("artifact started downloading to %s, want somewhere in %s", started, tempDir)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "pkg", "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "llamas\n" {
+		t.Errorf("pkg/llamas.txt = %q, want %q", got, "llamas\n")
+	}
+	if results := d.Results(); len(results) != 1 || results[0].Destination != filepath.Join(dir, "pkg", "llamas.txt") {
+		t.Errorf("d.Results() = %+v, want pkg/llamas.txt downloaded to the destination", results)
+	}
+	if left, _ := os.ReadDir(tempDir); len(left) > 0 {
+		t.Errorf("%d files left in the temp directory, want it cleaned up", len(left))
+	}
+
+	// A temp directory that doesn't exist is an error, rather than being
+	// created somewhere unexpected
+	d = NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		TempDir:     filepath.Join(tempDir, "missing"),
+	})
+	if err := d.Download(context.Background()); err == nil {
+		t.Errorf("d.Download() with a missing temp directory = nil, want an error")
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("llamas"), 0o640); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile() error = %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(src) error = %v, want it moved", err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "llamas" {
+		t.Errorf("os.ReadFile(dst) = (%q, %v), want llamas", got, err)
+	}
+
+	// Copying it, as moving it across filesystems does, keeps its
+	// permissions
+	if err := copyFile(dst, src, true); err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("os.Stat(src) error = %v", err)
+	}
+	if want := os.FileMode(0o640); info.Mode().Perm() != want && os.PathSeparator == '/' {
+		t.Errorf("copy's permissions = %v, want %v", info.Mode().Perm(), want)
+	}
+}
@@ -2,20 +2,41 @@ package agent
 
 import (
 	"context"
+	"crypto"
+	"crypto/cipher"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/destination"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/buildkite/agent/v3/usage"
+	"github.com/buildkite/roko"
 )
 
+// How many times an artifact is downloaded before giving up on one that
+// doesn't match its checksum
+const checksumMismatchAttempts = 3
+
+// DefaultDownloadConcurrency is how many artifacts are downloaded at once by
+// default. It's a few per processor available to Go, as downloads mostly wait
+// on the network, but each still needs some CPU to write and checksum.
+func DefaultDownloadConcurrency() int {
+	return runtime.GOMAXPROCS(0) * 4
+}
+
 type ArtifactDownloaderConfig struct {
 	// The ID of the Build
 	BuildID string
@@ -23,31 +44,308 @@ type ArtifactDownloaderConfig struct {
 	// The query used to find the artifacts
 	Query string
 
+	// The IDs of the artifacts to download, instead of searching for Query.
+	// Each of them has to be found, from any job of the build
+	IDs []string
+
+	// Whether the query is for artifacts uploaded with the chunk
+	// post-processor, which are reassembled from their chunks. Chunks that
+	// are already in the file at the destination aren't downloaded again
+	Chunked bool
+
 	// Which step should we look at for the jobs
 	Step string
 
 	// Whether to include artifacts from retried jobs in the search
 	IncludeRetriedJobs bool
 
+	// The most artifacts to download. If the search finds more, nothing is
+	// downloaded. If zero, there's no limit
+	MaxArtifacts int
+
+	// Whether to download every artifact from retried jobs, rather than only
+	// the one from the newest job when a path was uploaded more than once
+	KeepRetriedDuplicates bool
+
+	// Gitignore-style patterns separated by semicolons. If set, only the
+	// artifacts the search finds that match them are downloaded
+	Include string
+
+	// Gitignore-style patterns separated by semicolons for artifacts found by
+	// the search that aren't downloaded
+	Exclude string
+
 	// Where we'll be downloading artifacts to
 	Destination string
 
+	// Permissions to create missing destination directories with. If zero,
+	// DefaultDownloadDirPermissions is used, less the umask. Otherwise the umask
+	// doesn't apply
+	DirPermissions os.FileMode
+
+	// The order in which checksum algorithms are tried when verifying
+	// downloaded files. If nil, transfer.DefaultChecksumPreference is used,
+	// and if empty, downloads aren't verified
+	ChecksumPreference []string
+
+	// Whether a download fails when the artifact has none of the preferred
+	// checksums to verify it with, rather than going unverified
+	RequireChecksums bool
+
 	// Whether to show HTTP debugging
 	DebugHTTP bool
+
+	// The HTTP client to download artifacts over HTTP with, which is shared
+	// by all of them. If nil, one is made that keeps a connection alive for
+	// each artifact downloaded at once
+	HTTPClient *http.Client
+
+	// Whether the client that's made when HTTPClient is nil only uses
+	// HTTP/1.1
+	DisableHTTP2 bool
+
+	// The proxy to download through, and how servers' certificates are
+	// verified, for the S3, Google Cloud Storage and Artifactory clients. It
+	// applies to the client that's made when HTTPClient is nil too, and
+	// should be what HTTPClient was made with otherwise
+	Transport TransportConfig
+
+	// How many artifacts to download at once. If zero,
+	// DefaultDownloadConcurrency is used
+	Concurrency int
+
+	// The most bytes per second to download each artifact at. If zero,
+	// there is no limit
+	MaxBandwidth int64
+
+	// If set, a download that fails part way through starts again from the
+	// beginning, rather than carrying on from where it stopped
+	NoResume bool
+
+	// If set, only this range of the artifact is downloaded. The query must
+	// match a single artifact.
+	Range *ByteRange
+
+	// The size of the parts that large S3 artifacts are downloaded in,
+	// several at once. If zero, DefaultS3DownloadPartSize is used, and if
+	// negative, they're downloaded in one go
+	S3PartSize int64
+
+	// How many parts of each artifact are downloaded at once. If zero,
+	// DefaultDownloadPartConcurrency is used
+	PartConcurrency int
+
+	// Rules for rewriting artifact URLs and upload destinations before
+	// downloading, such as "^https://artifacts\.internal/=>https://cdn.example.com/"
+	URLRewrites string
+
+	// Rules for creating the clients of S3 buckets, such as to assume a role
+	// for a bucket in another account, like
+	// "partner-*=role-arn:arn:aws:iam::123456789012:role/reader,external-id:xyz"
+	S3BucketConfig string
+
+	// A Google Cloud credentials file to download gs:// artifacts with, such
+	// as a service account key or workload identity federation config. If
+	// empty, the credentials in the environment are used
+	GSCredentialsFile string
+
+	// The URL of a server compatible with the Cloud Storage JSON API to
+	// download gs:// artifacts from, such as fake-gcs-server. If empty,
+	// it's Google's
+	GSEndpoint string
+
+	// How to retry artifacts that fail to download. If its MaxAttempts is
+	// zero, each is tried DefaultDownloadRetries times
+	Retry RetryConfig
+
+	// A 256 bit AES key to decrypt artifacts that were encrypted when they
+	// were uploaded. If empty, encrypted artifacts are left as they are
+	EncryptionKeyPath string
+
+	// The template the artifacts were named with when they were uploaded,
+	// such as "{{.Path}}-{{.Os}}-{{.Arch}}". If set, the query is named with
+	// it, and artifacts named for this platform are downloaded to the paths
+	// they were uploaded from.
+	NameTemplate string
+
+	// A text/template that artifacts' paths in the destination are rendered
+	// with, such as "{{.JobName}}/{{.BaseName}}", so artifacts from parallel
+	// jobs with the same paths don't collide. If empty, they're downloaded to
+	// their paths
+	PathTemplate string
+
+	// How often to log how far the downloads have got, how fast they're
+	// going and how long they'll take. If zero, progress isn't logged
+	ProgressInterval time.Duration
+
+	// If set, a line isn't logged for each artifact that's downloaded, only a
+	// summary once they all are, and warnings and errors
+	Quiet bool
+
+	// If set, the artifacts are searched for and where they'd be downloaded
+	// to is logged, but nothing is downloaded
+	DryRun bool
+
+	// What to do about artifacts whose files already exist, one of
+	// OverwriteAlways, OverwriteNever or OverwriteIfChanged. If empty, they're
+	// always downloaded again
+	OverwritePolicy string
+
+	// If set, the destination is an s3:// or gs:// bucket, and the artifacts
+	// are copied to it with the storage service's copy API, rather than
+	// being downloaded. They must have been uploaded to the same service.
+	ServerSide bool
+
+	// If set, the query must find a single artifact, which is written to it
+	// rather than to a file in Destination
+	Output io.Writer
+
+	// If set, the first artifact that fails to download, once it's been
+	// retried, stops the rest, rather than them all being tried
+	FailFast bool
+
+	// How many artifacts can fail to download without the download failing.
+	// The failures are still logged. With FailFast, the rest are only
+	// stopped once more than this have failed
+	AllowFailures FailureThreshold
+
+	// A directory shared by the jobs running on this host. If set, an
+	// artifact that several of them download at once is only fetched by one,
+	// and the others wait for it and copy it from here once it's been checked
+	// against its checksums. Nothing is removed from it, apart from artifacts
+	// that don't match their checksums
+	SharedCacheDir string
+
+	// A directory to download artifacts into before they're moved into the
+	// destination, so they're never seen half downloaded there. When it's on
+	// another filesystem, they're copied and synced rather than renamed. If
+	// empty, they're downloaded straight into the destination
+	TempDir string
+
+	// Other agents serving their shared cache directories, as host:port, to
+	// fetch artifacts that aren't in SharedCacheDir from before the object
+	// store. A host with several addresses is a peer at each of them
+	Peers []string
+
+	// The token peers are fetched from with, if they need one
+	PeerToken string
+
+	// A PEM encoded public key to verify the signature of each artifact with.
+	// Signatures are artifacts with the path of the one they sign and .sig
+	// added. Artifacts are verified before they're moved into the
+	// destination, and those without a signature that matches are moved into
+	// .buildkite-quarantine in it instead, and fail with an error wrapping
+	// ErrArtifactUnverified
+	SignaturePublicKeyPath string
+
+	// If set, each artifact's executable bits and modification time are
+	// restored to what they were when it was uploaded, if they were recorded
+	PreserveMetadata bool
+
+	// If set, each artifact, and the directories created to download it
+	// into, are given to this owner once it's downloaded, so a job that runs
+	// as another user than the agent can read them
+	Owner *FileOwner
+
+	// If set, each artifact is synced to disk once it's downloaded, and then
+	// the directories they're in, so they survive a crash or reboot right
+	// after the download
+	Durable bool
+
+	// If set, the artifacts are only downloaded into SharedCacheDir, ready
+	// for jobs to copy them from, and Destination is ignored. Artifacts
+	// already in it aren't downloaded again
+	Prefetch bool
+
+	// Backends to download artifacts uploaded to destinations with these
+	// schemes, such as "s3", from, instead of the built in ones. They're
+	// given the URL of the artifact in the destination, such as
+	// s3://bucket/prefix/path/to/artifact
+	Backends map[string]transfer.Backend
+
+	// Told how each artifact's download is going
+	Observer ArtifactDownloadObserver
+
+	// Where to send transfer metrics. If nil, no metrics are sent
+	Metrics *metrics.Scope
+
+	// Where to record the data transferred. If nil, nothing is recorded
+	Usage *usage.Recorder
+}
+
+// ArtifactDownloadResult describes how downloading an artifact went, for
+// tools that read the output of artifact download --format json
+type ArtifactDownloadResult struct {
+	ID              string  `json:"id"`
+	Path            string  `json:"path"`
+	FileSize        int64   `json:"file_size"`
+	Destination     string  `json:"destination"`
+	JobID           string  `json:"job_id,omitempty"`
+	Source          string  `json:"source,omitempty"`
+	Sha1Sum         string  `json:"sha1sum,omitempty"`
+	Sha256Sum       string  `json:"sha256sum,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+
+	// In a dry run, why downloading the artifact would overwrite something
+	Conflict string `json:"conflict,omitempty"`
+
+	// Whether the artifact's file already existed, and was kept because of
+	// the overwrite policy
+	Skipped bool `json:"skipped,omitempty"`
 }
 
 type ArtifactDownloader struct {
 	// The config for downloading
 	conf ArtifactDownloaderConfig
 
+	// How downloading each artifact went, in the order they finished
+	results []ArtifactDownloadResult
+
+	// Where artifacts are downloaded to in the destination, if there's a
+	// PathTemplate
+	paths *artifactPathTemplate
+
+	// Where artifacts are downloaded to before they're moved into the
+	// destination, if they aren't downloaded straight into it
+	staging string
+
+	// The artifacts and directories to sync to disk, if it's Durable
+	durable *durableDownload
+
+	// What to give to the Owner, if there is one
+	ownership *downloadOwnership
+
+	// The client for requests to S3 and Google Cloud Storage, if there's a
+	// Transport for them
+	storageClient *http.Client
+
 	// The logger instance to use
 	logger logger.Logger
 
-	// The APIClient that will be used when uploading jobs
-	apiClient APIClient
+	// The client that will be used to search for the artifacts
+	apiClient ArtifactSearchClient
 }
 
-func NewArtifactDownloader(l logger.Logger, ac APIClient, c ArtifactDownloaderConfig) ArtifactDownloader {
+func NewArtifactDownloader(l logger.Logger, ac ArtifactSearchClient, c ArtifactDownloaderConfig) ArtifactDownloader {
+	if c.Metrics == nil {
+		c.Metrics = metrics.NewCollector(l, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = DefaultDownloadConcurrency()
+	}
+	if c.ChecksumPreference == nil {
+		c.ChecksumPreference = transfer.DefaultChecksumPreference
+	}
+	if c.HTTPClient == nil {
+		// A Transport that can't be used is reported by Download
+		c.HTTPClient, _ = NewDownloadHTTPClient(DownloadHTTPConfig{
+			Concurrency:     c.Concurrency,
+			DisableHTTP2:    c.DisableHTTP2,
+			TransportConfig: c.Transport,
+		})
+	}
+
 	return ArtifactDownloader{
 		logger:    l,
 		apiClient: ac,
@@ -56,109 +354,837 @@ func NewArtifactDownloader(l logger.Logger, ac APIClient, c ArtifactDownloaderCo
 }
 
 func (a *ArtifactDownloader) Download(ctx context.Context) error {
-	// Turn the download destination into an absolute path and confirm it exists
-	downloadDestination, _ := filepath.Abs(a.conf.Destination)
-	fileInfo, err := os.Stat(downloadDestination)
+	if a.conf.Transport != (TransportConfig{}) {
+		client, err := a.conf.Transport.client()
+		if err != nil {
+			return fmt.Errorf("invalid download transport config: %w", err)
+		}
+		a.storageClient = client
+	}
+
+	if a.conf.Chunked {
+		return a.downloadChunked(ctx)
+	}
+
+	var downloadDestination string
+	switch {
+	case a.conf.Output != nil:
+		// Nothing is written to the destination
+	case a.conf.ServerSide:
+		if _, err := parseServerSideDestination(a.conf.Destination); err != nil {
+			return err
+		}
+	case a.conf.Prefetch:
+		if a.conf.SharedCacheDir == "" {
+			return errors.New("Prefetching artifacts needs a shared cache directory")
+		}
+		if a.conf.Range != nil {
+			return errors.New("A range can't be prefetched, as whole artifacts are cached")
+		}
+		// Artifacts are downloaded next to the cache, so they can be moved
+		// into it
+		if err := os.MkdirAll(a.conf.SharedCacheDir, sharedCacheDirPermissions); err != nil {
+			return fmt.Errorf("creating the shared cache directory: %w", err)
+		}
+		staging, err := os.MkdirTemp(a.conf.SharedCacheDir, ".prefetch-")
+		if err != nil {
+			return fmt.Errorf("creating a directory to prefetch into: %w", err)
+		}
+		defer os.RemoveAll(staging)
+		downloadDestination = staging
+	default:
+		// Turn the download destination into an absolute path and confirm it exists
+		downloadDestination, _ = filepath.Abs(a.conf.Destination)
+		fileInfo, err := os.Stat(downloadDestination)
+		if err != nil {
+			return fmt.Errorf("Could not find information about destination: %s %v",
+				downloadDestination, err)
+		}
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("%s is not a directory", downloadDestination)
+		}
+	}
+
+	urlRewrites, err := parseURLRewriteRules(a.conf.URLRewrites)
 	if err != nil {
-		return fmt.Errorf("Could not find information about destination: %s %v",
-			downloadDestination, err)
+		return err
 	}
-	if !fileInfo.IsDir() {
-		return fmt.Errorf("%s is not a directory", downloadDestination)
+
+	cdns, err := artifactCDNsFromEnv()
+	if err != nil {
+		return err
 	}
 
-	artifacts, err := NewArtifactSearcher(a.logger, a.apiClient, a.conf.BuildID).
-		Search(ctx, a.conf.Query, a.conf.Step, a.conf.IncludeRetriedJobs, false)
+	s3BucketRules, err := parseS3BucketRules(a.conf.S3BucketConfig)
 	if err != nil {
 		return err
 	}
 
+	filter, err := newArtifactFilter(a.conf.Include, a.conf.Exclude)
+	if err != nil {
+		return err
+	}
+
+	var encryption cipher.AEAD
+	if a.conf.EncryptionKeyPath != "" {
+		if encryption, err = LoadEncryptionKey(a.conf.EncryptionKeyPath); err != nil {
+			return err
+		}
+	}
+
+	var signatureKey crypto.PublicKey
+	if a.conf.SignaturePublicKeyPath != "" {
+		switch {
+		case a.conf.Output != nil, a.conf.ServerSide, a.conf.Range != nil, a.conf.Prefetch:
+			return errors.New("Signatures can only be verified when whole artifacts are downloaded to a directory")
+		case len(a.conf.IDs) > 0:
+			return errors.New("Signatures can only be verified when artifacts are searched for, not downloaded by ID")
+		}
+		if signatureKey, err = loadSignaturePublicKey(a.conf.SignaturePublicKeyPath); err != nil {
+			return err
+		}
+	}
+
+	query := a.conf.Query
+	var names *artifactNameTemplate
+	if a.conf.NameTemplate != "" {
+		if names, err = newArtifactNameTemplate(a.conf.NameTemplate); err != nil {
+			return err
+		}
+	}
+	if a.conf.PathTemplate != "" {
+		if a.conf.Output != nil || a.conf.ServerSide || a.conf.Prefetch {
+			return errors.New("A path template can only be used when artifacts are downloaded to a directory")
+		}
+		if a.paths, err = newArtifactPathTemplate(a.conf.PathTemplate); err != nil {
+			return err
+		}
+	}
+	// Signed artifacts are verified before they're moved into the
+	// destination, so they're never there unverified
+	if downloadDestination != "" && !a.conf.Prefetch && !a.conf.DryRun && (a.paths != nil || a.conf.TempDir != "" || a.conf.SignaturePublicKeyPath != "") {
+		if a.staging, err = a.stagingDir(downloadDestination); err != nil {
+			return err
+		}
+		defer os.RemoveAll(a.staging)
+	}
+	if a.conf.Durable && downloadDestination != "" && !a.conf.Prefetch && !a.conf.DryRun {
+		a.durable = newDurableDownload(downloadDestination)
+	}
+	if a.conf.Owner != nil && downloadDestination != "" && !a.conf.Prefetch && !a.conf.DryRun {
+		if a.ownership, err = newDownloadOwnership(a.conf.Owner, downloadDestination); err != nil {
+			return err
+		}
+	}
+	if names != nil && len(a.conf.IDs) == 0 {
+		if query, err = names.render(query); err != nil {
+			return fmt.Errorf("naming query %q: %w", a.conf.Query, err)
+		}
+		a.logger.Debug("Searching for %q, as named by the template", query)
+	}
+
+	searcher := NewArtifactSearcher(a.logger, a.apiClient, a.conf.BuildID)
+	prepare := func(artifacts []*api.Artifact) []*api.Artifact {
+		return a.prepareArtifacts(artifacts, filter, urlRewrites)
+	}
+
+	// Artifacts are downloaded as each page of the search arrives, unless
+	// something needs to see all of them first
+	if a.streams() {
+		searchCtx, stopSearch := context.WithCancel(ctx)
+		defer stopSearch()
+		pages, searchErr := a.searchPages(searchCtx, searcher, query, prepare)
+		a.logger.Info("Downloading artifacts to %s as they're found", downloadDestination)
+		return a.downloadPages(ctx, pages, func() error {
+			stopSearch()
+			return <-searchErr
+		}, downloadDestination, names, cdns, s3BucketRules, encryption, signatureKey, query, -1)
+	}
+
+	var artifacts []*api.Artifact
+	if len(a.conf.IDs) > 0 {
+		artifacts, err = searcher.ByID(ctx, a.conf.IDs, a.conf.Step)
+	} else {
+		artifacts, err = searcher.Search(ctx, query, a.conf.Step, a.conf.IncludeRetriedJobs, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Artifacts asked for by ID are exactly the ones wanted, even if a retry
+	// uploaded the same path
+	if a.conf.IncludeRetriedJobs && !a.conf.KeepRetriedDuplicates && len(a.conf.IDs) == 0 {
+		if latest := LatestArtifacts(artifacts); len(latest) < len(artifacts) {
+			a.logger.Info("Skipping %d artifacts that were replaced by retried jobs", len(artifacts)-len(latest))
+			artifacts = latest
+		}
+	}
+
+	artifacts = prepare(artifacts)
+
 	artifactCount := len(artifacts)
 
 	if artifactCount == 0 {
-		return errors.New("No artifacts found for downloading")
+		return errNoArtifactsFound
 	}
 
-	a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
+	if err := checkArtifactLimit(artifacts, a.conf.MaxArtifacts); err != nil {
+		return err
+	}
 
-	p := pool.New(pool.MaxConcurrencyLimit)
-	errors := []error{}
-	s3Clients, err := a.generateS3Clients(artifacts)
+	// Check where every artifact was uploaded before anything's transferred
+	uploadDestinations, err := parseUploadDestinations(artifacts)
 	if err != nil {
-		return fmt.Errorf("failed to generate S3 clients for artifact upload: %w", err)
+		return err
 	}
 
-	for _, artifact := range artifacts {
-		// Create new instance of the artifact for the goroutine
-		// See: http://golang.org/doc/effective_go.html#channels
-		artifact := artifact
+	if a.conf.Output != nil {
+		return a.downloadToOutput(ctx, artifacts, cdns)
+	}
+
+	if a.conf.ServerSide {
+		return a.copyServerSide(ctx, artifacts, uploadDestinations, s3BucketRules)
+	}
+
+	if a.conf.Range != nil && artifactCount > 1 {
+		return fmt.Errorf("Found %d artifacts, but a range can only be downloaded from a single artifact", artifactCount)
+	}
+
+	if a.conf.DryRun {
+		a.dryRun(artifacts, downloadDestination, names)
+		return nil
+	}
+
+	a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
+
+	pages := make(chan []*api.Artifact, 1)
+	pages <- artifacts
+	close(pages)
+	return a.downloadPages(ctx, pages, func() error { return nil }, downloadDestination, names, cdns, s3BucketRules, encryption, signatureKey, query, artifactCount)
+}
+
+// streams reports whether artifacts can be downloaded as the pages of the
+// search arrive. Picking the newest of retried jobs' artifacts, finding
+// artifacts by ID, limiting how many there are, and everything but
+// downloading whole artifacts to a directory need all of them first.
+func (a *ArtifactDownloader) streams() bool {
+	switch {
+	case a.conf.IncludeRetriedJobs && !a.conf.KeepRetriedDuplicates,
+		len(a.conf.IDs) > 0,
+		a.conf.MaxArtifacts > 0,
+		a.conf.Output != nil,
+		a.conf.ServerSide,
+		a.conf.DryRun,
+		a.conf.Range != nil:
+		return false
+	}
+	return true
+}
+
+// prepareArtifacts leaves out the artifacts that don't match the include and
+// exclude patterns, and rewrites the URLs of the rest
+func (a *ArtifactDownloader) prepareArtifacts(artifacts []*api.Artifact, filter *artifactFilter, urlRewrites []urlRewriteRule) []*api.Artifact {
+	if filtered := filter.Filter(artifacts); len(filtered) < len(artifacts) {
+		a.logger.Info("Skipping %d artifacts that don't match the include and exclude patterns", len(artifacts)-len(filtered))
+		artifacts = filtered
+	}
 
+	if len(urlRewrites) > 0 {
+		for _, artifact := range artifacts {
+			if url := rewriteURL(urlRewrites, artifact.URL); url != artifact.URL {
+				a.logger.Debug("Rewrote the URL of %s to %s", artifact.Path, url)
+				artifact.URL = url
+			}
+			if destination := rewriteURL(urlRewrites, artifact.UploadDestination); destination != artifact.UploadDestination {
+				a.logger.Debug("Rewrote the upload destination of %s to %s", artifact.Path, destination)
+				artifact.UploadDestination = destination
+			}
+		}
+	}
+	return artifacts
+}
+
+// searchPages searches for artifacts in the background, sending each page on
+// the returned channel once it's been prepared. The channel holds one page,
+// so the search gets no more than a page ahead of the downloads. Once the
+// search has finished, the channel is closed and its error is sent.
+func (a *ArtifactDownloader) searchPages(ctx context.Context, searcher *ArtifactSearcher, query string, prepare func([]*api.Artifact) []*api.Artifact) (<-chan []*api.Artifact, <-chan error) {
+	pages := make(chan []*api.Artifact, 1)
+	searchErr := make(chan error, 1)
+	go func() {
+		defer close(pages)
+		searchErr <- searcher.SearchPages(ctx, query, a.conf.Step, a.conf.IncludeRetriedJobs, false, func(page []*api.Artifact) error {
+			select {
+			case pages <- prepare(page):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return pages, searchErr
+}
+
+// downloadPages downloads the artifacts in each page as it arrives. Once the
+// pages run out, or downloading them can't go on, searchDone is called to
+// stop the search and return its error. expected is how many artifacts there
+// are, or -1 if they're still being found.
+func (a *ArtifactDownloader) downloadPages(ctx context.Context, pages <-chan []*api.Artifact, searchDone func() error, downloadDestination string, names *artifactNameTemplate, cdns []*artifactCDN, s3BucketRules []s3BucketRule, encryption cipher.AEAD, signatureKey crypto.PublicKey, query string, expected int) error {
+	var signatures *artifactSignatures
+	if signatureKey != nil {
+		var err error
+		var cleanup func()
+		if signatures, cleanup, err = a.downloadSignatures(ctx, query); err != nil {
+			return err
+		}
+		defer cleanup()
+		a.logger.Debug("Found %d artifact signatures", len(signatures.paths))
+	}
+
+	progress := newArtifactDownloadProgress(a.logger, a.conf.ProgressInterval, 0, 0)
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.run(progressCtx)
+
+	// Each artifact's downloader only warns when it's quiet
+	fileLogger := a.logger
+	if a.conf.Quiet {
+		fileLogger = a.logger.WithFields()
+		if fileLogger.Level() < logger.WARN {
+			fileLogger.SetLevel(logger.WARN)
+		}
+	}
+
+	p := pool.New(a.conf.Concurrency)
+	s3Clients := map[string]*s3.S3{}
+
+	// With FailFast, the first artifact to fail stops the rest
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	failures := &ArtifactDownloadMultiError{}
+	if expected >= 0 {
+		failures.Total = expected
+	}
+	stopped := false
+
+	// fail records why an artifact failed. Artifacts that were stopped part
+	// way through by another failing are only counted.
+	fail := func(artifact *api.Artifact, err error) {
+		p.Lock()
+		defer p.Unlock()
+
+		if stopped && errors.Is(err, context.Canceled) {
+			failures.Canceled++
+			return
+		}
+		failures.Errors = append(failures.Errors, &ArtifactDownloadError{
+			ID:   artifact.ID,
+			Path: artifact.Path,
+			Err:  err,
+		})
+		if a.conf.FailFast && !stopped && !a.conf.AllowFailures.Allows(len(failures.Errors), failures.Total) {
+			a.logger.Error("Stopping the download, as %s failed to download", artifact.Path)
+			stopped = true
+			stop()
+		}
+	}
+
+	spawn := func(artifact *api.Artifact, s3Client *s3.S3) {
 		p.Spawn(func() {
-			// Convert windows paths to slashes, otherwise we get a literal
-			// download of "dir/dir/file" vs sub-directories on non-windows agents
-			path := artifact.Path
-			if runtime.GOOS != "windows" {
-				path = strings.Replace(path, `\`, `/`, -1)
+			path := artifactLocalPath(artifact.Path)
+
+			p.Lock()
+			canceled := stopped
+			if canceled {
+				failures.Canceled++
+			}
+			p.Unlock()
+			if canceled {
+				return
 			}
 
-			// Handle downloading from S3, GS, or RT
+			if reason := a.keepExisting(artifact, a.destinationPath(artifact, downloadDestination, names)); reason != "" {
+				a.logger.Info("Skipping %s, as %s", artifact.Path, reason)
+
+				result := ArtifactDownloadResult{
+					ID:          artifact.ID,
+					JobID:       artifact.JobID,
+					Source:      artifactSource(artifact),
+					Path:        artifact.Path,
+					FileSize:    artifact.FileSize,
+					Destination: a.destinationPath(artifact, downloadDestination, names),
+					Sha1Sum:     artifact.Sha1Sum,
+					Sha256Sum:   artifact.Sha256Sum,
+					Skipped:     true,
+				}
+				p.Lock()
+				a.results = append(a.results, result)
+				p.Unlock()
+				progress.add(artifact.FileSize)
+				progress.finished(nil)
+				a.conf.Observer.finished(artifact, result)
+				return
+			}
+
+			// The progress of every artifact is added up, and passed on to
+			// the observer
+			downloaded := &artifactProgress{report: func(n int64) {
+				progress.add(n)
+				a.conf.Observer.progress(artifact, n)
+			}}
+			addProgress := downloaded.add
+
+			// Staged artifacts are downloaded somewhere of their own first,
+			// as several can have the same path with a path template
+			artifactDestination := downloadDestination
+			if a.staging != "" {
+				artifactDestination = filepath.Join(a.staging, artifact.ID)
+			}
+
+			// Handle downloading through a CDN, or from S3, GS, RT, or Azure
 			var dler interface {
 				Start(context.Context) error
 			}
+			cdn := cdnFor(cdns, artifact.URL, artifact.UploadDestination)
+			backend := backendFor(a.conf.Backends, artifact.UploadDestination)
 			switch {
+			case backend != nil:
+				dler = NewBackendDownloader(fileLogger, backend, BackendDownloaderConfig{
+					URL:            backendURL(artifact.UploadDestination, path),
+					Path:           path,
+					Destination:    artifactDestination,
+					Retries:        DefaultDownloadRetries,
+					Retry:          a.conf.Retry,
+					DirPermissions: a.conf.DirPermissions,
+					Range:          a.conf.Range,
+					MaxBandwidth:   a.conf.MaxBandwidth,
+					Progress:       addProgress,
+				})
+			case cdn != nil:
+				url, headers, err := cdn.sign(cdn.artifactURL(artifact, path))
+				if err != nil {
+					a.logger.Error("Failed to sign the CDN URL for %s: %s", artifact.Path, err)
+
+					result := ArtifactDownloadResult{
+						ID:       artifact.ID,
+						JobID:    artifact.JobID,
+						Source:   artifactSource(artifact),
+						Path:     artifact.Path,
+						FileSize: artifact.FileSize,
+						Error:    err.Error(),
+					}
+					fail(artifact, err)
+					p.Lock()
+					a.results = append(a.results, result)
+					p.Unlock()
+					progress.finished(err)
+					a.conf.Observer.finished(artifact, result)
+					return
+				}
+
+				a.logger.Debug("Downloading %s through the CDN at %s", artifact.Path, cdn.baseURL)
+				dler = NewDownload(fileLogger, a.conf.HTTPClient, DownloadConfig{
+					URL:            url,
+					Headers:        headers,
+					Path:           path,
+					Destination:    artifactDestination,
+					Retries:        DefaultDownloadRetries,
+					Retry:          a.conf.Retry,
+					DirPermissions: a.conf.DirPermissions,
+					DebugHTTP:      a.conf.DebugHTTP,
+					Range:          a.conf.Range,
+					MaxBandwidth:   a.conf.MaxBandwidth,
+					Progress:       addProgress,
+					Size:           artifact.FileSize,
+					NoResume:       a.conf.NoResume,
+				})
 			case strings.HasPrefix(artifact.UploadDestination, "s3://"):
-				bucketName, _ := ParseS3Destination(artifact.UploadDestination)
-				dler = NewS3Downloader(a.logger, S3DownloaderConfig{
-					S3Client:    s3Clients[bucketName],
-					Path:        path,
-					S3Path:      artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
+				dler = NewS3Downloader(fileLogger, S3DownloaderConfig{
+					S3Client:        s3Client,
+					Path:            path,
+					S3Path:          artifact.UploadDestination,
+					Destination:     artifactDestination,
+					Retries:         DefaultDownloadRetries,
+					Retry:           a.conf.Retry,
+					DirPermissions:  a.conf.DirPermissions,
+					DebugHTTP:       a.conf.DebugHTTP,
+					HTTPClient:      a.conf.HTTPClient,
+					Range:           a.conf.Range,
+					MaxBandwidth:    a.conf.MaxBandwidth,
+					Progress:        addProgress,
+					Size:            artifact.FileSize,
+					NoResume:        a.conf.NoResume,
+					PartSize:        a.conf.S3PartSize,
+					PartConcurrency: a.conf.PartConcurrency,
 				})
 			case strings.HasPrefix(artifact.UploadDestination, "gs://"):
-				dler = NewGSDownloader(a.logger, GSDownloaderConfig{
-					Path:        path,
-					Bucket:      artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
+				dler = NewGSDownloader(fileLogger, GSDownloaderConfig{
+					Path:            path,
+					Bucket:          artifact.UploadDestination,
+					Destination:     artifactDestination,
+					Retries:         DefaultDownloadRetries,
+					Retry:           a.conf.Retry,
+					DirPermissions:  a.conf.DirPermissions,
+					DebugHTTP:       a.conf.DebugHTTP,
+					Range:           a.conf.Range,
+					MaxBandwidth:    a.conf.MaxBandwidth,
+					Progress:        addProgress,
+					Size:            artifact.FileSize,
+					NoResume:        a.conf.NoResume,
+					HTTPClient:      a.storageClient,
+					CredentialsFile: a.conf.GSCredentialsFile,
+					Endpoint:        a.conf.GSEndpoint,
 				})
 			case strings.HasPrefix(artifact.UploadDestination, "rt://"):
-				dler = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-					Path:        path,
-					Repository:  artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
+				dler = NewArtifactoryDownloader(fileLogger, ArtifactoryDownloaderConfig{
+					Path:           path,
+					Repository:     artifact.UploadDestination,
+					Destination:    artifactDestination,
+					Retries:        DefaultDownloadRetries,
+					Retry:          a.conf.Retry,
+					DirPermissions: a.conf.DirPermissions,
+					DebugHTTP:      a.conf.DebugHTTP,
+					HTTPClient:     a.conf.HTTPClient,
+					Transport:      a.conf.Transport,
+					Range:          a.conf.Range,
+					MaxBandwidth:   a.conf.MaxBandwidth,
+					Progress:       addProgress,
+					Size:           artifact.FileSize,
+					NoResume:       a.conf.NoResume,
+				})
+			case strings.HasPrefix(artifact.UploadDestination, "az://"):
+				dler = NewAzureBlobDownloader(fileLogger, AzureBlobDownloaderConfig{
+					Path:           path,
+					Container:      artifact.UploadDestination,
+					Destination:    artifactDestination,
+					Retries:        DefaultDownloadRetries,
+					Retry:          a.conf.Retry,
+					DirPermissions: a.conf.DirPermissions,
+					DebugHTTP:      a.conf.DebugHTTP,
+					HTTPClient:     a.conf.HTTPClient,
+					Range:          a.conf.Range,
+					MaxBandwidth:   a.conf.MaxBandwidth,
+					Progress:       addProgress,
+					Size:           artifact.FileSize,
+					NoResume:       a.conf.NoResume,
+				})
+			case isStorageHelperDestination(artifact.UploadDestination):
+				dler = NewStorageHelperDownloader(fileLogger, StorageHelperDownloaderConfig{
+					UploadDestination: artifact.UploadDestination,
+					Path:              path,
+					Destination:       artifactDestination,
+					DirPermissions:    a.conf.DirPermissions,
+					Size:              artifact.FileSize,
+					Progress:          addProgress,
 				})
 			default:
-				dler = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-					URL:         artifact.URL,
-					Path:        path,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
+				dler = NewDownload(fileLogger, a.conf.HTTPClient, DownloadConfig{
+					URL:            artifact.URL,
+					Path:           path,
+					Destination:    artifactDestination,
+					Retries:        DefaultDownloadRetries,
+					Retry:          a.conf.Retry,
+					DirPermissions: a.conf.DirPermissions,
+					DebugHTTP:      a.conf.DebugHTTP,
+					Range:          a.conf.Range,
+					MaxBandwidth:   a.conf.MaxBandwidth,
+					Progress:       addProgress,
+					Size:           artifact.FileSize,
+					NoResume:       a.conf.NoResume,
 				})
 			}
 
+			downloadMetrics := a.conf.Metrics.With(metrics.Tags{
+				"backend": artifactBackend(artifact.UploadDestination),
+			})
+			startedAt := time.Now()
+
 			// If the downloaded encountered an error, lock
 			// the pool, collect it, then unlock the pool
 			// again.
-			if err := dler.Start(ctx); err != nil {
+			targetPath := getTargetPath(path, artifactDestination)
+			if a.ownership != nil {
+				a.ownership.expect(targetPath)
+				a.ownership.expect(a.destinationPath(artifact, downloadDestination, names))
+			}
+			a.conf.Observer.started(artifact, targetPath)
+			err := a.downloadShared(ctx, artifact, targetPath, addProgress, func() error {
+				return a.downloadAndVerify(ctx, dler, artifact, targetPath, downloaded)
+			})
+			if a.conf.Prefetch {
+				// Jobs copy it from the cache, and decrypt and name it
+				// themselves
+				targetPath = filepath.Join(a.conf.SharedCacheDir, artifact.ID)
+			}
+			if err == nil && !a.conf.Prefetch {
+				err = a.decrypt(encryption, artifact, targetPath)
+			}
+			if err == nil && signatureKey != nil && !signatures.isSignature(artifact) {
+				err = a.verifySignature(signatureKey, signatures, artifact, targetPath, downloadDestination)
+			}
+			if err == nil && !a.conf.Prefetch && names != nil && a.staging == "" {
+				targetPath, err = a.restoreName(names, path, targetPath, downloadDestination)
+			}
+			if a.staging != "" {
+				if err == nil {
+					targetPath, err = a.unstage(artifact, names, targetPath, downloadDestination)
+				}
+				os.RemoveAll(artifactDestination)
+			}
+			if err == nil && !a.conf.Prefetch && a.conf.PreserveMetadata {
+				err = a.restoreMetadata(artifact, targetPath)
+			}
+			if err == nil && a.ownership != nil {
+				err = a.ownership.chown(targetPath)
+			}
+			if err == nil && a.durable != nil {
+				err = a.durable.add(targetPath)
+			}
+			duration := time.Since(startedAt)
+			downloadMetrics.Timing("artifacts.download.duration", duration)
+
+			result := ArtifactDownloadResult{
+				ID:              artifact.ID,
+				JobID:           artifact.JobID,
+				Source:          artifactSource(artifact),
+				Path:            artifact.Path,
+				FileSize:        artifact.FileSize,
+				Destination:     targetPath,
+				Sha1Sum:         artifact.Sha1Sum,
+				Sha256Sum:       artifact.Sha256Sum,
+				DurationSeconds: duration.Seconds(),
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			p.Lock()
+			a.results = append(a.results, result)
+			p.Unlock()
+			progress.finished(err)
+			a.conf.Observer.finished(artifact, result)
+
+			if err != nil {
 				a.logger.Error("Failed to download artifact: %s", err)
+				downloadMetrics.Count("artifacts.download.failed", 1)
+				fail(artifact, err)
+				return
+			}
 
-				p.Lock()
-				errors = append(errors, err)
-				p.Unlock()
+			size := artifact.FileSize
+			if a.conf.Range != nil && a.conf.Range.Length < size {
+				size = a.conf.Range.Length
 			}
+			downloadMetrics.Count("artifacts.download.success", 1)
+			downloadMetrics.Count("artifacts.download.bytes", size)
+			a.conf.Usage.Add(usage.ArtifactDownload, size)
 		})
 	}
 
+	var pageErr error
+	found := 0
+	for page := range pages {
+		// Check where every artifact in the page was uploaded before any of
+		// them are transferred
+		uploadDestinations, err := parseUploadDestinations(page)
+		if err != nil {
+			pageErr = err
+			break
+		}
+		if err := a.addS3Clients(ctx, s3Clients, page, uploadDestinations, cdns, s3BucketRules); err != nil {
+			pageErr = fmt.Errorf("failed to generate S3 clients for artifact upload: %w", err)
+			break
+		}
+
+		found += len(page)
+		var pageBytes int64
+		for _, artifact := range page {
+			pageBytes += artifact.FileSize
+		}
+		if a.conf.Range != nil {
+			pageBytes = a.conf.Range.Length
+		}
+		progress.expect(len(page), pageBytes)
+		if expected < 0 {
+			p.Lock()
+			failures.Total += len(page)
+			p.Unlock()
+		}
+
+		for _, artifact := range page {
+			spawn(artifact, s3Clients[uploadDestinations[artifact].Bucket])
+		}
+	}
+	searchErr := searchDone()
+
 	p.Wait()
+	stopProgress()
+
+	if a.durable != nil {
+		if err := a.durable.sync(); err != nil {
+			return fmt.Errorf("syncing the directories artifacts were downloaded into: %w", err)
+		}
+	}
+
+	if found == 0 && pageErr == nil && searchErr == nil {
+		return errNoArtifactsFound
+	}
+	a.logger.Info("%s", progress.summary())
+
+	// Whatever was found before the search failed has been downloaded, but
+	// not everything was
+	if pageErr != nil {
+		return pageErr
+	}
+	if searchErr != nil {
+		return searchErr
+	}
+
+	if len(failures.Errors) > 0 {
+		if failures.Canceled == 0 && a.conf.AllowFailures.Allows(len(failures.Errors), failures.Total) {
+			a.logger.Warn("%s, which is within the %s allowed to fail:", failures, a.conf.AllowFailures)
+			for _, line := range failures.Summary() {
+				a.logger.Warn("%s", line)
+			}
+			return nil
+		}
+
+		a.logger.Error("%s:", failures)
+		for _, line := range failures.Summary() {
+			a.logger.Error("%s", line)
+		}
+		return failures
+	}
+
+	return nil
+}
+
+// errNoArtifactsFound is returned when the search finds nothing to download
+var errNoArtifactsFound = errors.New("No artifacts found for downloading")
+
+// artifactLocalPath converts windows paths to slashes, otherwise we get a
+// literal download of "dir/dir/file" vs sub-directories on non-windows agents
+func artifactLocalPath(path string) string {
+	if runtime.GOOS != "windows" {
+		path = strings.Replace(path, `\`, `/`, -1)
+	}
+	return path
+}
+
+// destinationPath returns where an artifact ends up once it's downloaded,
+// which is the path it was uploaded from if it was named for this platform,
+// laid out by the path template if there is one
+func (a *ArtifactDownloader) destinationPath(artifact *api.Artifact, downloadDestination string, names *artifactNameTemplate) string {
+	path := artifactLocalPath(artifact.Path)
+	if names != nil {
+		if original, ok := names.original(path); ok {
+			path = original
+		}
+	}
+	if a.paths != nil {
+		rendered, err := a.paths.render(artifact, path)
+		if err != nil {
+			a.logger.Warn("Downloading %s to its own path, as the path template can't be rendered for it: %v", artifact.Path, err)
+			return getTargetPath(path, downloadDestination)
+		}
+		return filepath.Join(downloadDestination, rendered)
+	}
+	return getTargetPath(path, downloadDestination)
+}
+
+// artifactSource returns where an artifact was uploaded to, such as
+// s3://bucket/prefix/path/to/artifact, or the URL it's downloaded from for
+// artifacts stored by Buildkite
+func artifactSource(artifact *api.Artifact) string {
+	if strings.Contains(artifact.UploadDestination, "://") {
+		return strings.TrimSuffix(artifact.UploadDestination, "/") + "/" + artifact.Path
+	}
+	return artifact.URL
+}
+
+// Results returns how downloading each artifact went, once Download has
+// returned
+func (a *ArtifactDownloader) Results() []ArtifactDownloadResult {
+	return a.results
+}
+
+// decrypt decrypts a downloaded artifact in place if there's a key. Without a
+// key, or when only part of it was downloaded, it's left as it is. With a key,
+// an artifact that wasn't encrypted is an error, and is removed, as it can't
+// be trusted to be what was uploaded.
+func (a *ArtifactDownloader) decrypt(encryption cipher.AEAD, artifact *api.Artifact, targetPath string) error {
+	switch {
+	case a.conf.Range != nil:
+		if isEncryptedArtifact(targetPath) {
+			a.logger.Warn("%s is encrypted, and can't be decrypted when only part of it is downloaded", artifact.Path)
+		}
+		return nil
+	case encryption == nil:
+		if isEncryptedArtifact(targetPath) {
+			a.logger.Warn("%s is encrypted. Download it with an encryption key to decrypt it", artifact.Path)
+		}
+		return nil
+	}
+
+	err := decryptArtifactFile(encryption, targetPath)
+	if errors.Is(err, errArtifactNotEncrypted) {
+		os.Remove(targetPath)
+		return fmt.Errorf("%s wasn't encrypted, but an encryption key was given to decrypt it with: %w", artifact.Path, errArtifactNotEncrypted)
+	}
+	return err
+}
+
+// downloadAndVerify downloads an artifact and checks it against its
+// checksums, downloading it again if it doesn't match, as a flaky proxy can
+// corrupt a download that otherwise succeeded
+func (a *ArtifactDownloader) downloadAndVerify(ctx context.Context, dler interface{ Start(context.Context) error }, artifact *api.Artifact, targetPath string, progress *artifactProgress) error {
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(checksumMismatchAttempts),
+		roko.WithStrategy(roko.Constant(time.Second)),
+	).DoWithContext(ctx, retrylog.Wrap(fmt.Sprintf("Downloading %s", artifact.Path), func(r *roko.Retrier) error {
+		if err := dler.Start(ctx); err != nil {
+			// The download has already been retried
+			r.Break()
+			return err
+		}
+
+		// Part of a file can't be checked against the whole file's
+		// checksum
+		if a.conf.Range != nil {
+			return nil
+		}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("There were errors with downloading some of the artifacts")
+		err := a.verify(artifact, targetPath)
+		var mismatch *transfer.ChecksumMismatchError
+		if !errors.As(err, &mismatch) {
+			r.Break()
+			return err
+		}
+
+		a.logger.Warn("Downloaded %s is corrupt (%s), downloading it again %s", artifact.Path, err, r)
+		progress.reset()
+		return err
+	}))
+}
+
+// verify checks a downloaded artifact against the checksums it was uploaded
+// with, using the strongest algorithm that's both preferred and available
+func (a *ArtifactDownloader) verify(artifact *api.Artifact, targetPath string) error {
+	algorithm, err := transfer.VerifyFile(targetPath, map[string]string{
+		"sha1":   artifact.Sha1Sum,
+		"sha256": artifact.Sha256Sum,
+	}, a.conf.ChecksumPreference)
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", artifact.Path, err)
+	}
+
+	if algorithm == "" && a.conf.RequireChecksums {
+		return fmt.Errorf("verifying %s: it has no checksum from %q to verify it with", artifact.Path, a.conf.ChecksumPreference)
+	}
+
+	if algorithm == "" {
+		a.logger.Debug("Not verifying %s, no preferred checksums are available", artifact.Path)
+	} else {
+		a.logger.Debug("Verified %s checksum of %s", algorithm, artifact.Path)
 	}
 
 	return nil
@@ -166,25 +1192,61 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 
 // We want to have as few S3 clients as possible, as creating them is kind of an expensive operation
 // But it's also theoretically possible that we'll have multiple artifacts with different S3 buckets, and each
-// S3Client only applies to one bucket, so we need to store the S3 clients in a map, one for each bucket
-func (a *ArtifactDownloader) generateS3Clients(artifacts []*api.Artifact) (map[string]*s3.S3, error) {
-	s3Clients := map[string]*s3.S3{}
-
+// S3Client only applies to one bucket, so we need to store the S3 clients in a map, one for each bucket.
+// Artifacts downloaded through a CDN don't need one.
+func (a *ArtifactDownloader) addS3Clients(ctx context.Context, s3Clients map[string]*s3.S3, artifacts []*api.Artifact, uploadDestinations map[*api.Artifact]destination.Destination, cdns []*artifactCDN, bucketRules []s3BucketRule) error {
 	for _, artifact := range artifacts {
-		if !strings.HasPrefix(artifact.UploadDestination, "s3://") {
+		dest, ok := uploadDestinations[artifact]
+		if !ok || dest.Scheme != destination.S3 {
+			continue
+		}
+		if cdnFor(cdns, artifact.URL, artifact.UploadDestination) != nil || backendFor(a.conf.Backends, artifact.UploadDestination) != nil {
 			continue
 		}
 
-		bucketName, _ := ParseS3Destination(artifact.UploadDestination)
+		bucketName := dest.Bucket
 		if _, has := s3Clients[bucketName]; !has {
-			client, err := NewS3Client(a.logger, bucketName)
+			client, err := NewS3ClientWithConfig(ctx, a.logger, bucketName, a.s3BucketConfig(bucketRules, bucketName))
 			if err != nil {
-				return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+				return fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
 			}
 
 			s3Clients[bucketName] = client
 		}
 	}
 
-	return s3Clients, nil
+	return nil
+}
+
+// s3BucketConfig returns the config for the client of a bucket, which goes
+// through the downloader's Transport, if it has one
+func (a *ArtifactDownloader) s3BucketConfig(rules []s3BucketRule, bucket string) *S3BucketConfig {
+	conf := s3BucketConfigFor(rules, bucket)
+	if a.storageClient == nil {
+		return conf
+	}
+	if conf == nil {
+		conf = &S3BucketConfig{}
+	}
+	conf.HTTPClient = a.storageClient
+	return conf
+}
+
+// parseUploadDestinations parses the destinations that the artifacts were
+// uploaded to, so a bad one fails the download before anything's transferred.
+// Artifacts in Buildkite's storage, or with schemes handled by storage
+// helpers, are left out.
+func parseUploadDestinations(artifacts []*api.Artifact) (map[*api.Artifact]destination.Destination, error) {
+	destinations := map[*api.Artifact]destination.Destination{}
+	for _, artifact := range artifacts {
+		if artifact.UploadDestination == "" || !destination.HasScheme(artifact.UploadDestination, destination.Schemes...) {
+			continue
+		}
+		dest, err := destination.Parse(artifact.UploadDestination)
+		if err != nil {
+			return nil, fmt.Errorf("%s can't be downloaded: %w", artifact.Path, err)
+		}
+		destinations[artifact] = dest
+	}
+	return destinations, nil
 }
@@ -1,12 +1,19 @@
 package agent
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -48,3 +55,470 @@ func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
 		t.Errorf("d.Download() = %v", err)
 	}
 }
+
+func TestArtifactDownloaderRetriesCorruptDownloads(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"sha256sum": "%x",
+				"url": "http://%s/download"
+			}]`, sha256.Sum256([]byte("OK\n")), req.Host)
+		case "/download":
+			// The first download is corrupted on the way
+			if atomic.AddInt32(&downloads, 1) == 1 {
+				fmt.Fprintln(rw, "KO")
+				return
+			}
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	var progress int64
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Observer: ArtifactDownloadObserver{
+			Progress: func(_ *api.Artifact, bytes int64) {
+				atomic.AddInt64(&progress, bytes)
+			},
+		},
+	})
+
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+	if got := atomic.LoadInt32(&downloads); got != 2 {
+		t.Errorf("downloads = %d, want 2", got)
+	}
+
+	// The corrupt download's bytes are taken back
+	if got := atomic.LoadInt64(&progress); got != 3 {
+		t.Errorf("progress = %d, want 3", got)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "OK\n" {
+		t.Errorf("llamas.txt = %q, want %q", got, "OK\n")
+	}
+}
+
+func TestArtifactDownloaderRequireChecksums(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:          "my-build",
+		Destination:      t.TempDir(),
+		RequireChecksums: true,
+	})
+
+	if err := d.Download(context.Background()); err == nil {
+		t.Errorf("d.Download() = nil, want an error for an artifact without checksums")
+	}
+}
+
+func TestArtifactDownloaderResults(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"sha256sum": "%x",
+				"url": "http://%s/download"
+			}, {
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 3,
+				"path": "alpacas.txt",
+				"url": "http://%s/missing"
+			}]`, sha256.Sum256([]byte("OK\n")), req.Host, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+	})
+
+	if err := d.Download(context.Background()); err == nil {
+		t.Fatalf("d.Download() = nil, want an error for the missing artifact")
+	}
+
+	results := map[string]ArtifactDownloadResult{}
+	for _, result := range d.Results() {
+		results[result.Path] = result
+	}
+	if len(results) != 2 {
+		t.Fatalf("d.Results() = %v, want a result for each artifact", d.Results())
+	}
+
+	if got := results["llamas.txt"]; got.Error != "" || got.Destination != filepath.Join(dir, "llamas.txt") || got.Sha256Sum == "" {
+		t.Errorf("llamas.txt result = %+v, want it downloaded to %s", got, filepath.Join(dir, "llamas.txt"))
+	}
+	if got := results["alpacas.txt"]; got.Error == "" {
+		t.Errorf("alpacas.txt result = %+v, want an error", got)
+	}
+}
+
+func TestArtifactDownloaderDryRun(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}, {
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 3,
+				"path": "pkg/alpacas.txt",
+				"url": "http://%s/download"
+			}, {
+				"id": "bb83f86f-4e92-4600-ac5c-5a13f7b32a13",
+				"file_size": 3,
+				"path": "pkg\\alpacas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host, req.Host, req.Host)
+		default:
+			atomic.AddInt32(&downloads, 1)
+			fmt.Fprintln(rw, "OK")
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() = %v", err)
+	}
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		DryRun:      true,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	if got := atomic.LoadInt32(&downloads); got != 0 {
+		t.Errorf("artifacts downloaded = %d, want none in a dry run", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pkg")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(pkg) = %v, want nothing created in a dry run", err)
+	}
+
+	results := d.Results()
+	if len(results) != 3 {
+		t.Fatalf("d.Results() = %v, want a result for each artifact", results)
+	}
+	if got := results[0]; got.Conflict == "" {
+		t.Errorf("llamas.txt result = %+v, want a conflict with the existing file", got)
+	}
+	if got := results[1]; got.Conflict != "" || got.Destination != filepath.Join(dir, "pkg", "alpacas.txt") {
+		t.Errorf("pkg/alpacas.txt result = %+v, want no conflict", got)
+	}
+	if runtime.GOOS != "windows" {
+		if got := results[2]; got.Conflict == "" {
+			t.Errorf("pkg\\alpacas.txt result = %+v, want a conflict with pkg/alpacas.txt", got)
+		}
+	}
+}
+
+func TestArtifactDownloaderOverwritePolicy(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"sha256sum": "%x",
+				"url": "http://%s/download"
+			}]`, sha256.Sum256([]byte("OK\n")), req.Host)
+		case "/download":
+			atomic.AddInt32(&downloads, 1)
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	for _, test := range []struct {
+		policy   string
+		existing string
+		want     int32
+	}{
+		{policy: OverwriteAlways, existing: "OK\n", want: 1},
+		{policy: OverwriteNever, existing: "no\n", want: 0},
+		{policy: OverwriteIfChanged, existing: "OK\n", want: 0},
+		{policy: OverwriteIfChanged, existing: "no\n", want: 1},
+		{policy: OverwriteIfChanged, existing: "", want: 1},
+	} {
+		atomic.StoreInt32(&downloads, 0)
+
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte(test.existing), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() = %v", err)
+		}
+
+		d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+			BuildID:         "my-build",
+			Destination:     dir,
+			OverwritePolicy: test.policy,
+		})
+		if err := d.Download(context.Background()); err != nil {
+			t.Fatalf("%s: d.Download() = %v", test.policy, err)
+		}
+
+		if got := atomic.LoadInt32(&downloads); got != test.want {
+			t.Errorf("%s with %q existing: downloads = %d, want %d", test.policy, test.existing, got, test.want)
+		}
+		if got := d.Results()[0].Skipped; got != (test.want == 0) {
+			t.Errorf("%s with %q existing: Skipped = %v, want %v", test.policy, test.existing, got, test.want == 0)
+		}
+	}
+}
+
+func TestArtifactDownloaderObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}, {
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 3,
+				"path": "alpacas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	var mu sync.Mutex
+	started := map[string]string{}
+	downloaded := map[string]int64{}
+	finished := map[string]ArtifactDownloadResult{}
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Observer: ArtifactDownloadObserver{
+			Started: func(artifact *api.Artifact, targetPath string) {
+				mu.Lock()
+				defer mu.Unlock()
+				started[artifact.Path] = targetPath
+			},
+			Progress: func(artifact *api.Artifact, bytes int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				downloaded[artifact.Path] += bytes
+			},
+			Finished: func(artifact *api.Artifact, result ArtifactDownloadResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				finished[artifact.Path] = result
+			},
+		},
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	for _, path := range []string{"llamas.txt", "alpacas.txt"} {
+		if got, want := started[path], filepath.Join(dir, path); got != want {
+			t.Errorf("started[%q] = %q, want %q", path, got, want)
+		}
+		if got := downloaded[path]; got != 3 {
+			t.Errorf("downloaded[%q] = %d, want 3", path, got)
+		}
+		if got := finished[path]; got.Path != path || got.Error != "" {
+			t.Errorf("finished[%q] = %+v, want a successful result", path, got)
+		}
+	}
+}
+
+func TestArtifactDownloaderOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?query=llamas.txt&state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"sha256sum": "%x",
+				"url": "http://%s/download"
+			}]`, sha256.Sum256([]byte("OK\n")), req.Host)
+		case "/builds/my-build/artifacts/search?query=%2A&state=finished":
+			fmt.Fprintf(rw, `[
+				{"id": "1", "file_size": 3, "path": "llamas.txt", "url": "http://%s/download"},
+				{"id": "2", "file_size": 3, "path": "alpacas.txt", "url": "http://%s/download"}
+			]`, req.Host, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	var out bytes.Buffer
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Query:       "llamas.txt",
+		Destination: StdoutDestination,
+		Output:      &out,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+	if got, want := out.String(), "OK\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	d = NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Query:       "*",
+		Destination: StdoutDestination,
+		Output:      &bytes.Buffer{},
+	})
+	if err := d.Download(context.Background()); err == nil {
+		t.Errorf("d.Download() = nil, want an error for a query that finds 2 artifacts")
+	}
+}
+
+func TestArtifactDownloaderDownloadsPagesAsTheyArrive(t *testing.T) {
+	t.Parallel()
+
+	// The second page isn't found until the first page's artifact has been
+	// downloaded, so it can only finish if downloads start before the
+	// search does
+	firstDownloaded := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			rw.Header().Set("Link", fmt.Sprintf(`<http://%s/builds/my-build/artifacts/search?page=2&state=finished>; rel="next"`, req.Host))
+			fmt.Fprintf(rw, `[{"id": "a1", "file_size": 3, "path": "llamas.txt", "url": "http://%s/llamas"}]`, req.Host)
+		case "/builds/my-build/artifacts/search?page=2&state=finished":
+			select {
+			case <-firstDownloaded:
+			case <-time.After(10 * time.Second):
+				http.Error(rw, "the first page wasn't downloaded", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(rw, `[{"id": "a2", "file_size": 3, "path": "alpacas.txt", "url": "http://%s/alpacas"}]`, req.Host)
+		case "/llamas":
+			fmt.Fprintln(rw, "OK")
+			close(firstDownloaded)
+		case "/alpacas":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Concurrency: 1,
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() error = %v", err)
+	}
+
+	for _, name := range []string{"llamas.txt", "alpacas.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("os.Stat(%q) error = %v, want it downloaded", name, err)
+		}
+	}
+}
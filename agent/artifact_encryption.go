@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/buildkite/agent/v3/api"
+)
+
+// MetaDataEncryptionKeyFileEnv is the environment variable that points a
+// job's meta-data commands at the key the agent was given to encrypt and
+// decrypt values with. Keys are loaded like artifact encryption keys.
+const MetaDataEncryptionKeyFileEnv = "BUILDKITE_META_DATA_ENCRYPTION_KEY_FILE"
+
+// Encrypted artifacts start with this marker, so downloads can tell them
+// apart from artifacts that weren't encrypted. The version is the last byte.
+var encryptedArtifactMagic = []byte("BKENC\x00\x01")
+
+const (
+	// Artifacts are encrypted with AES-256-GCM in chunks of this size, so they
+	// can be streamed rather than held in memory. Each chunk's nonce has its
+	// number in it, and the last chunk is marked as last, so chunks can't be
+	// reordered, dropped or truncated without decryption failing.
+	encryptedArtifactChunkSize = 64 * 1024
+
+	encryptedArtifactKeySize = 32
+
+	// The content type of encrypted artifacts, as whatever they were is
+	// meaningless to the storage backend
+	encryptedArtifactContentType = "application/octet-stream"
+)
+
+// errArtifactNotEncrypted is returned when decrypting something that doesn't
+// start with the encrypted artifact marker
+var errArtifactNotEncrypted = errors.New("artifact isn't encrypted")
+
+// LoadEncryptionKey reads a 256 bit AES key, which is either the raw 32 bytes
+// or their base64, as written by openssl rand -base64 32. A file containing
+// kms: followed by the base64 of a key encrypted with AWS KMS, as returned by
+// aws kms generate-data-key, is decrypted with KMS, so the plain key is never
+// kept on disk.
+func LoadEncryptionKey(keyPath string) (cipher.AEAD, error) {
+	contents, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %w", err)
+	}
+
+	key := contents
+	if trimmed := strings.TrimSpace(string(contents)); strings.HasPrefix(trimmed, kmsEncryptionKeyPrefix) {
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(trimmed, kmsEncryptionKeyPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s isn't base64 after %s: %w", keyPath, kmsEncryptionKeyPrefix, err)
+		}
+		if key, err = decryptKMSKey(blob); err != nil {
+			return nil, fmt.Errorf("decrypting encryption key %s with KMS: %w", keyPath, err)
+		}
+	}
+
+	if len(key) != encryptedArtifactKeySize {
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+		if err != nil || len(key) != encryptedArtifactKeySize {
+			return nil, fmt.Errorf("encryption key %s must be %d bytes, or their base64", keyPath, encryptedArtifactKeySize)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Key files starting with this hold a key encrypted with AWS KMS
+const kmsEncryptionKeyPrefix = "kms:"
+
+// decryptKMSKey decrypts a key that was encrypted with AWS KMS, with the
+// agent's AWS credentials
+func decryptKMSKey(blob []byte) ([]byte, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	out, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// chunkNonce returns the nonce for the nth chunk, which is the random base
+// nonce with the chunk number XORed into its last 8 bytes
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^n)
+	return nonce
+}
+
+// chunkAdditionalData authenticates whether a chunk is the last one
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptArtifact writes the encrypted contents of r to w
+func encryptArtifact(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	base := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(base); err != nil {
+		return err
+	}
+	if _, err := w.Write(encryptedArtifactMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(base); err != nil {
+		return err
+	}
+
+	// Peek past each chunk, so the last chunk is known when it's sealed. An
+	// empty artifact is a single empty chunk.
+	br := bufio.NewReaderSize(r, encryptedArtifactChunkSize+1)
+	chunk := make([]byte, encryptedArtifactChunkSize)
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := br.Peek(1)
+		last := size < len(chunk) || peekErr == io.EOF
+
+		sealed := aead.Seal(nil, chunkNonce(base, n), chunk[:size], chunkAdditionalData(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptArtifact writes the decrypted contents of r to w. It returns
+// errArtifactNotEncrypted if r doesn't start with the marker.
+func decryptArtifact(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	sealedSize := encryptedArtifactChunkSize + aead.Overhead()
+	br := bufio.NewReaderSize(r, sealedSize+1)
+
+	magic := make([]byte, len(encryptedArtifactMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, encryptedArtifactMagic) {
+		return errArtifactNotEncrypted
+	}
+	base := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(br, base); err != nil {
+		return fmt.Errorf("reading nonce: %w", err)
+	}
+
+	sealed := make([]byte, sealedSize)
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(br, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = errors.New("encrypted artifact is truncated")
+			}
+			return err
+		}
+		_, peekErr := br.Peek(1)
+		last := size < len(sealed) || peekErr == io.EOF
+
+		chunk, err := aead.Open(sealed[:0], chunkNonce(base, n), sealed[:size], chunkAdditionalData(last))
+		if err != nil {
+			return fmt.Errorf("decrypting chunk %d: the key is wrong or the artifact was modified", n)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// isEncryptedArtifact returns whether the file starts with the encrypted
+// artifact marker
+func isEncryptedArtifact(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptedArtifactMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, encryptedArtifactMagic)
+}
+
+// decryptArtifactFile decrypts a downloaded artifact in place. Artifacts that
+// weren't encrypted are left as they are, and return an error wrapping
+// errArtifactNotEncrypted, as anyone who can write to where they're stored
+// could have put them there.
+func decryptArtifactFile(aead cipher.AEAD, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".decrypting")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if err := decryptArtifact(aead, out, in); err != nil {
+		return fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+
+	// Keep the permissions it was downloaded with
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(out.Name(), info.Mode().Perm())
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// encrypt replaces each artifact with an encrypted copy of it at the same
+// path, if there's an encryption key. The returned function removes the
+// copies, and must be called once the artifacts are uploaded.
+func (a *ArtifactUploader) encrypt(artifacts []*api.Artifact) ([]*api.Artifact, func(), error) {
+	noop := func() {}
+	if a.conf.EncryptionKeyPath == "" {
+		return artifacts, noop, nil
+	}
+
+	aead, err := LoadEncryptionKey(a.conf.EncryptionKeyPath)
+	if err != nil {
+		return nil, noop, err
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-encrypted-artifacts")
+	if err != nil {
+		return nil, noop, fmt.Errorf("creating directory for encrypted artifacts: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	encrypted := make([]*api.Artifact, 0, len(artifacts))
+	for i, artifact := range artifacts {
+		e, err := a.encryptOne(aead, filepath.Join(dir, strconv.Itoa(i)), artifact)
+		if err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("encrypting %s: %w", artifact.Path, err)
+		}
+		encrypted = append(encrypted, e)
+	}
+
+	a.logger.Info("Encrypted %d artifacts", len(encrypted))
+	return encrypted, cleanup, nil
+}
+
+// encryptOne writes the encrypted artifact to name. It isn't named after the
+// artifact's path, which can contain .. and escape the temporary directory.
+func (a *ArtifactUploader) encryptOne(aead cipher.AEAD, name string, artifact *api.Artifact) (*api.Artifact, error) {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	if err := encryptArtifact(aead, out, in); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	e, err := a.build(artifact.Path, name, artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	e.ContentType = encryptedArtifactContentType
+	return e, nil
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testEncryptionKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, encryptedArtifactKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "artifacts.key")
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	return keyPath
+}
+
+func TestArtifactEncryptionRoundTrip(t *testing.T) {
+	aead, err := LoadEncryptionKey(testEncryptionKey(t))
+	if err != nil {
+		t.Fatalf("LoadEncryptionKey() error = %v", err)
+	}
+
+	for _, size := range []int{0, 1, encryptedArtifactChunkSize - 1, encryptedArtifactChunkSize, encryptedArtifactChunkSize + 1, 3 * encryptedArtifactChunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		var encrypted bytes.Buffer
+		if err := encryptArtifact(aead, &encrypted, bytes.NewReader(plaintext)); err != nil {
+			t.Fatalf("size %d: encryptArtifact() error = %v", size, err)
+		}
+		if !bytes.HasPrefix(encrypted.Bytes(), encryptedArtifactMagic) {
+			t.Errorf("size %d: encrypted artifact doesn't start with the marker", size)
+		}
+
+		var decrypted bytes.Buffer
+		if err := decryptArtifact(aead, &decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+			t.Fatalf("size %d: decryptArtifact() error = %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: decrypted artifact differs from the original", size)
+		}
+
+		// Dropping the last chunk leaves a valid chunk that isn't marked last
+		if size > encryptedArtifactChunkSize {
+			truncated := encrypted.Bytes()[:len(encryptedArtifactMagic)+aead.NonceSize()+encryptedArtifactChunkSize+aead.Overhead()]
+			if err := decryptArtifact(aead, &bytes.Buffer{}, bytes.NewReader(truncated)); err == nil {
+				t.Errorf("size %d: decryptArtifact(truncated) error = nil, want an error", size)
+			}
+		}
+
+		// Flipping any bit of the ciphertext is noticed
+		tampered := append([]byte(nil), encrypted.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		if err := decryptArtifact(aead, &bytes.Buffer{}, bytes.NewReader(tampered)); err == nil {
+			t.Errorf("size %d: decryptArtifact(tampered) error = nil, want an error", size)
+		}
+	}
+}
+
+func TestDecryptArtifactFile(t *testing.T) {
+	aead, err := LoadEncryptionKey(testEncryptionKey(t))
+	if err != nil {
+		t.Fatalf("LoadEncryptionKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.txt")
+	if err := os.WriteFile(plainPath, []byte("llamas\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	var encrypted bytes.Buffer
+	if err := encryptArtifact(aead, &encrypted, bytes.NewReader([]byte("alpacas\n"))); err != nil {
+		t.Fatalf("encryptArtifact() error = %v", err)
+	}
+	encryptedPath := filepath.Join(dir, "encrypted.txt")
+	if err := os.WriteFile(encryptedPath, encrypted.Bytes(), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	// Something that wasn't encrypted could have been put there by anyone
+	// who can write to the storage backend
+	if err := decryptArtifactFile(aead, plainPath); !errors.Is(err, errArtifactNotEncrypted) {
+		t.Errorf("decryptArtifactFile(%q) error = %v, want %v", plainPath, err, errArtifactNotEncrypted)
+	}
+
+	for path, want := range map[string]string{plainPath: "llamas\n", encryptedPath: "alpacas\n"} {
+		if path == encryptedPath {
+			if err := decryptArtifactFile(aead, path); err != nil {
+				t.Fatalf("decryptArtifactFile(%q) error = %v", path, err)
+			}
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("os.ReadFile() error = %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("after decryptArtifactFile(%q), contents = %q, want %q", path, got, want)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("decryptArtifactFile left temporary files behind: %v", entries)
+	}
+}
+
+func TestLoadArtifactEncryptionKeyWrongSize(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "short.key")
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString([]byte("too short"))), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if _, err := LoadEncryptionKey(keyPath); err == nil {
+		t.Error("LoadEncryptionKey() error = nil, want an error about the key size")
+	}
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FailureThreshold is how many artifacts can fail to transfer without the
+// upload or download failing, either as a count, or a percentage of the
+// artifacts. The zero value allows none.
+type FailureThreshold struct {
+	Count   int
+	Percent float64
+}
+
+// ParseFailureThreshold parses a count of artifacts, such as 5, or a
+// percentage of them, such as 10%
+func ParseFailureThreshold(s string) (FailureThreshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return FailureThreshold{}, nil
+	}
+
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || p < 0 || p > 100 {
+			return FailureThreshold{}, fmt.Errorf("invalid percentage %q, expected 0%% to 100%%", s)
+		}
+		return FailureThreshold{Percent: p}, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return FailureThreshold{}, fmt.Errorf("invalid failure threshold %q, expected a count such as 5, or a percentage such as 10%%", s)
+	}
+	return FailureThreshold{Count: n}, nil
+}
+
+// Allows returns whether failed artifacts out of total is within the
+// threshold
+func (t FailureThreshold) Allows(failed, total int) bool {
+	if failed == 0 {
+		return true
+	}
+	if t.Percent > 0 {
+		return float64(failed)*100 <= t.Percent*float64(total)
+	}
+	return failed <= t.Count
+}
+
+func (t FailureThreshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.Itoa(t.Count)
+}
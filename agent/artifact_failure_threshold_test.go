@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestParseFailureThreshold(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		in            string
+		want          FailureThreshold
+		failed, total int
+		allows        bool
+	}{
+		{in: "", want: FailureThreshold{}, failed: 1, total: 100, allows: false},
+		{in: "", want: FailureThreshold{}, failed: 0, total: 100, allows: true},
+		{in: "3", want: FailureThreshold{Count: 3}, failed: 3, total: 4, allows: true},
+		{in: "3", want: FailureThreshold{Count: 3}, failed: 4, total: 100, allows: false},
+		{in: "10%", want: FailureThreshold{Percent: 10}, failed: 10, total: 100, allows: true},
+		{in: "10%", want: FailureThreshold{Percent: 10}, failed: 2, total: 10, allows: false},
+		{in: " 2.5 %", want: FailureThreshold{Percent: 2.5}, failed: 1, total: 40, allows: true},
+	} {
+		got, err := ParseFailureThreshold(test.in)
+		if err != nil {
+			t.Errorf("ParseFailureThreshold(%q) error = %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseFailureThreshold(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if allows := got.Allows(test.failed, test.total); allows != test.allows {
+			t.Errorf("ParseFailureThreshold(%q).Allows(%d, %d) = %t, want %t", test.in, test.failed, test.total, allows, test.allows)
+		}
+	}
+
+	for _, in := range []string{"-1", "101%", "some", "%"} {
+		if _, err := ParseFailureThreshold(in); err == nil {
+			t.Errorf("ParseFailureThreshold(%q) error = nil, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactNameData is what artifact name templates are executed with
+type artifactNameData struct {
+	// The artifact's path, and its directory, file name without extension,
+	// and extension
+	Path, Dir, Name, Ext string
+
+	// The platform of the agent, as in GOOS and GOARCH
+	Os, Arch string
+}
+
+func newArtifactNameData(artifactPath, goos, goarch string) artifactNameData {
+	artifactPath = filepath.ToSlash(artifactPath)
+	ext := path.Ext(artifactPath)
+	return artifactNameData{
+		Path: artifactPath,
+		Dir:  path.Dir(artifactPath),
+		Name: strings.TrimSuffix(path.Base(artifactPath), ext),
+		Ext:  ext,
+		Os:   goos,
+		Arch: goarch,
+	}
+}
+
+// artifactNameTemplate names artifacts after the platform they were built
+// for, such as "{{.Path}}-{{.Os}}-{{.Arch}}", so builds for several platforms
+// can upload the same paths without colliding. Downloads reverse it, so the
+// artifact for the agent's own platform is downloaded to its original path.
+type artifactNameTemplate struct {
+	tmpl         *template.Template
+	goos, goarch string
+
+	// Matches names rendered on this platform, capturing the fields of the
+	// original path
+	reverse *regexp.Regexp
+}
+
+func newArtifactNameTemplate(text string) (*artifactNameTemplate, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact name template: %w", err)
+	}
+
+	t := &artifactNameTemplate{tmpl: tmpl, goos: runtime.GOOS, goarch: runtime.GOARCH}
+
+	// Render the template with placeholders for the path's fields, then turn
+	// those into capture groups
+	placeholders := artifactNameData{
+		Path: "\x00Path\x00",
+		Dir:  "\x00Dir\x00",
+		Name: "\x00Name\x00",
+		Ext:  "\x00Ext\x00",
+		Os:   t.goos,
+		Arch: t.goarch,
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, placeholders); err != nil {
+		return nil, fmt.Errorf("invalid artifact name template: %w", err)
+	}
+
+	groups := map[string]string{
+		"Path": `(?P<Path>.+)`,
+		"Dir":  `(?P<Dir>.*)`,
+		"Name": `(?P<Name>[^/]*)`,
+		"Ext":  `(?P<Ext>\.[^./]*|)`,
+	}
+	var pattern strings.Builder
+	seen := map[string]bool{}
+	for i, part := range strings.Split(rendered.String(), "\x00") {
+		switch {
+		case i%2 == 0:
+			pattern.WriteString(regexp.QuoteMeta(part))
+		case seen[part]:
+			// Later uses of a field are checked by rendering the original
+			// again, as there are no backreferences
+			pattern.WriteString(`.*`)
+		default:
+			seen[part] = true
+			pattern.WriteString(groups[part])
+		}
+	}
+	if seen["Path"] || seen["Name"] {
+		t.reverse = regexp.MustCompile("^" + pattern.String() + "$")
+	}
+
+	return t, nil
+}
+
+// render names the artifact at artifactPath for this platform
+func (t *artifactNameTemplate) render(artifactPath string) (string, error) {
+	var out strings.Builder
+	if err := t.tmpl.Execute(&out, newArtifactNameData(artifactPath, t.goos, t.goarch)); err != nil {
+		return "", err
+	}
+	return path.Clean(out.String()), nil
+}
+
+// original returns the path an artifact with the given name was uploaded
+// from on this platform. It returns false if the name wasn't rendered on this
+// platform, or the template doesn't keep enough of the path to tell.
+func (t *artifactNameTemplate) original(name string) (string, bool) {
+	if t.reverse == nil {
+		return "", false
+	}
+
+	// Names are cleaned after they're rendered, so a template that starts
+	// with {{.Dir}} loses the "./" of artifacts in the top directory
+	name = filepath.ToSlash(name)
+	for _, candidate := range []string{name, "./" + name} {
+		match := t.reverse.FindStringSubmatch(candidate)
+		if match == nil {
+			continue
+		}
+		fields := map[string]string{}
+		for i, group := range t.reverse.SubexpNames() {
+			if group != "" {
+				fields[group] = match[i]
+			}
+		}
+
+		original := fields["Path"]
+		if original == "" {
+			original = path.Join(fields["Dir"], fields["Name"]+fields["Ext"])
+		}
+		if rendered, err := t.render(original); err == nil && rendered == path.Clean(name) {
+			return original, true
+		}
+	}
+	return "", false
+}
+
+// rename gives each artifact the name the template renders for its path
+func (t *artifactNameTemplate) rename(artifacts []*api.Artifact) error {
+	for _, artifact := range artifacts {
+		name, err := t.render(artifact.Path)
+		if err != nil {
+			return fmt.Errorf("naming %s: %w", artifact.Path, err)
+		}
+		artifact.Path = name
+	}
+	return nil
+}
+
+// restoreName moves a downloaded artifact to the path it was uploaded from,
+// if it was named for this platform, and returns where it ends up
+func (a *ArtifactDownloader) restoreName(names *artifactNameTemplate, name, targetPath, downloadDestination string) (string, error) {
+	original, ok := names.original(name)
+	if !ok {
+		a.logger.Debug("%s wasn't named for this platform, so it keeps its name", name)
+		return targetPath, nil
+	}
+
+	originalPath := getTargetPath(original, downloadDestination)
+	if originalPath == targetPath {
+		return targetPath, nil
+	}
+
+	if err := downloadDirs.MkdirAll(filepath.Dir(originalPath), a.conf.DirPermissions); err != nil {
+		return targetPath, err
+	}
+	if err := os.Rename(targetPath, originalPath); err != nil {
+		return targetPath, fmt.Errorf("renaming %s to %s: %w", name, original, err)
+	}
+	return originalPath, nil
+}
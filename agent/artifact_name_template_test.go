@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestArtifactNameTemplateRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+
+	for _, test := range []struct {
+		template, path, name string
+	}{
+		{"{{.Path}}-{{.Os}}-{{.Arch}}", "dist/app", "dist/app-" + platform},
+		{"{{.Path}}-{{.Os}}-{{.Arch}}", "app.tar.gz", "app.tar.gz-" + platform},
+		{"{{.Dir}}/{{.Name}}-{{.Os}}-{{.Arch}}{{.Ext}}", "dist/app.zip", "dist/app-" + platform + ".zip"},
+		{"{{.Dir}}/{{.Name}}-{{.Os}}-{{.Arch}}{{.Ext}}", "app.zip", "app-" + platform + ".zip"},
+		{"{{.Dir}}/{{.Name}}-{{.Os}}-{{.Arch}}{{.Ext}}", "dist/app", "dist/app-" + platform},
+		{"{{.Os}}/{{.Arch}}/{{.Path}}", "dist/app", runtime.GOOS + "/" + runtime.GOARCH + "/dist/app"},
+	} {
+		names, err := newArtifactNameTemplate(test.template)
+		if err != nil {
+			t.Fatalf("newArtifactNameTemplate(%q) error = %v", test.template, err)
+		}
+
+		name, err := names.render(test.path)
+		if err != nil {
+			t.Fatalf("render(%q) error = %v", test.path, err)
+		}
+		if name != test.name {
+			t.Errorf("%q: render(%q) = %q, want %q", test.template, test.path, name, test.name)
+		}
+
+		original, ok := names.original(name)
+		if !ok || original != test.path {
+			t.Errorf("%q: original(%q) = (%q, %t), want (%q, true)", test.template, name, original, ok, test.path)
+		}
+	}
+}
+
+func TestArtifactNameTemplateOtherPlatforms(t *testing.T) {
+	t.Parallel()
+
+	names, err := newArtifactNameTemplate("{{.Path}}-{{.Os}}-{{.Arch}}")
+	if err != nil {
+		t.Fatalf("newArtifactNameTemplate() error = %v", err)
+	}
+
+	for _, name := range []string{"dist/app-plan9-mips", "dist/app"} {
+		if original, ok := names.original(name); ok {
+			t.Errorf("original(%q) = %q, want no original for another platform", name, original)
+		}
+	}
+}
+
+func TestArtifactNameTemplateWithoutPath(t *testing.T) {
+	t.Parallel()
+
+	names, err := newArtifactNameTemplate("{{.Os}}-{{.Arch}}{{.Ext}}")
+	if err != nil {
+		t.Fatalf("newArtifactNameTemplate() error = %v", err)
+	}
+
+	if original, ok := names.original(runtime.GOOS + "-" + runtime.GOARCH + ".zip"); ok {
+		t.Errorf("original() = %q, want no original when the template drops the path", original)
+	}
+}
+
+func TestArtifactNameTemplateInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, template := range []string{"{{.Path", "{{.Platform}}"} {
+		if _, err := newArtifactNameTemplate(template); err == nil {
+			t.Errorf("newArtifactNameTemplate(%q) error = nil, want an error", template)
+		}
+	}
+}
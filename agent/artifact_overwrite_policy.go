@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+// What to do about artifacts whose files already exist
+const (
+	// Download them again, replacing the files
+	OverwriteAlways = "always"
+
+	// Keep the files, and don't download them
+	OverwriteNever = "never"
+
+	// Only download them if the files' sizes or checksums don't match the
+	// artifacts'. Without a checksum to compare, they're downloaded again.
+	OverwriteIfChanged = "if-changed"
+)
+
+// ValidateOverwritePolicy returns an error if the policy isn't one there is
+func ValidateOverwritePolicy(policy string) error {
+	switch policy {
+	case "", OverwriteAlways, OverwriteNever, OverwriteIfChanged:
+		return nil
+	default:
+		return fmt.Errorf("%q isn't an overwrite policy, expected %s, %s or %s", policy, OverwriteAlways, OverwriteNever, OverwriteIfChanged)
+	}
+}
+
+// keepExisting returns why the file an artifact would be downloaded to should
+// be kept rather than downloaded again, or an empty string if it shouldn't be
+func (a *ArtifactDownloader) keepExisting(artifact *api.Artifact, targetPath string) string {
+	policy := a.conf.OverwritePolicy
+	if policy == "" || policy == OverwriteAlways || a.conf.Range != nil {
+		return ""
+	}
+
+	info, err := os.Stat(targetPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+
+	if policy == OverwriteNever {
+		return "it already exists"
+	}
+
+	if info.Size() != artifact.FileSize {
+		return ""
+	}
+	algorithm, err := transfer.VerifyFile(targetPath, map[string]string{
+		"sha1":   artifact.Sha1Sum,
+		"sha256": artifact.Sha256Sum,
+	}, a.conf.ChecksumPreference)
+	if err != nil || algorithm == "" {
+		return ""
+	}
+	return fmt.Sprintf("it already exists with the same %s checksum", algorithm)
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// artifactPathData is what destination path templates are executed with
+type artifactPathData struct {
+	// The artifact's path, and its directory, file name, file name without
+	// extension, and extension
+	Path, Dir, BaseName, Name, Ext string
+
+	// The job that uploaded it, and the key of its step. JobName is the
+	// job's label, made safe to use as a directory name, or its ID if it
+	// wasn't recorded when the artifact was uploaded
+	JobID, JobName, StepKey string
+
+	// When it was uploaded
+	UploadedAt time.Time
+}
+
+// artifactPathFuncs are the helpers destination path templates can use
+var artifactPathFuncs = template.FuncMap{
+	// timestamp formats a time like 20230102T150405Z, which sorts in order
+	// and is safe in file names everywhere
+	"timestamp": func(t time.Time) string {
+		return t.UTC().Format("20060102T150405Z")
+	},
+}
+
+func newArtifactPathData(artifact *api.Artifact, artifactPath string) artifactPathData {
+	artifactPath = filepath.ToSlash(artifactPath)
+	base := path.Base(artifactPath)
+	ext := path.Ext(base)
+
+	jobName := pathSegment(artifact.JobName)
+	if jobName == "" {
+		jobName = artifact.JobID
+	}
+
+	return artifactPathData{
+		Path:       artifactPath,
+		Dir:        path.Dir(artifactPath),
+		BaseName:   base,
+		Name:       strings.TrimSuffix(base, ext),
+		Ext:        ext,
+		JobID:      artifact.JobID,
+		JobName:    jobName,
+		StepKey:    pathSegment(artifact.StepKey),
+		UploadedAt: artifact.CreatedAt,
+	}
+}
+
+// artifactPathTemplate lays out downloaded artifacts in the destination, such
+// as "{{.JobName}}/{{.BaseName}}", so that artifacts with the same path from
+// many parallel jobs don't collide
+type artifactPathTemplate struct {
+	tmpl *template.Template
+}
+
+func newArtifactPathTemplate(text string) (*artifactPathTemplate, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Funcs(artifactPathFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact path template: %w", err)
+	}
+
+	// Catch fields that don't exist now, rather than for every artifact
+	t := &artifactPathTemplate{tmpl: tmpl}
+	example := &api.Artifact{
+		Path:      "pkg/app.tar.gz",
+		JobID:     "018a2c5e-4f7b-4b7e-9c1d-3f6a2b1c0d9e",
+		JobName:   "Build",
+		StepKey:   "build",
+		CreatedAt: time.Now(),
+	}
+	if _, err := t.render(example, example.Path); err != nil {
+		return nil, fmt.Errorf("invalid artifact path template: %w", err)
+	}
+
+	return t, nil
+}
+
+// render returns the path in the destination to download the artifact to,
+// where artifactPath is the path it would otherwise be downloaded to
+func (t *artifactPathTemplate) render(artifact *api.Artifact, artifactPath string) (string, error) {
+	var out strings.Builder
+	if err := t.tmpl.Execute(&out, newArtifactPathData(artifact, artifactPath)); err != nil {
+		return "", err
+	}
+
+	rendered := path.Clean(strings.TrimLeft(out.String(), "/"))
+	switch {
+	case rendered == "." || strings.HasSuffix(out.String(), "/"):
+		return "", fmt.Errorf("%q is a directory, not a file", out.String())
+	case rendered == ".." || strings.HasPrefix(rendered, "../"):
+		return "", errors.New("artifacts can't be downloaded outside the destination")
+	}
+	return filepath.FromSlash(rendered), nil
+}
+
+// pathSegment makes s safe to use as a single directory or file name, such as
+// a job's label like ":rspec: Tests 1/4", which becomes rspec-Tests-1-4
+func pathSegment(s string) string {
+	var out strings.Builder
+	dash := false
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' {
+			out.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && out.Len() > 0 {
+			out.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.Trim(out.String(), "-.")
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactPathTemplate(t *testing.T) {
+	t.Parallel()
+
+	artifact := &api.Artifact{
+		Path:      "reports/junit.xml",
+		JobID:     "018a2c5e-4f7b-4b7e-9c1d-3f6a2b1c0d9e",
+		JobName:   ":rspec: Tests 1/4",
+		StepKey:   "tests",
+		CreatedAt: time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+
+	for _, test := range []struct {
+		template, want string
+	}{
+		{"{{.JobName}}/{{.BaseName}}", "rspec-Tests-1-4/junit.xml"},
+		{"{{.StepKey}}/{{.JobID}}/{{.Path}}", "tests/018a2c5e-4f7b-4b7e-9c1d-3f6a2b1c0d9e/reports/junit.xml"},
+		{"{{.Dir}}/{{.Name}}-{{timestamp .UploadedAt}}{{.Ext}}", "reports/junit-20230102T150405Z.xml"},
+		{"/{{.Path}}", "reports/junit.xml"},
+	} {
+		paths, err := newArtifactPathTemplate(test.template)
+		if err != nil {
+			t.Fatalf("newArtifactPathTemplate(%q) error = %v", test.template, err)
+		}
+		got, err := paths.render(artifact, artifact.Path)
+		if err != nil {
+			t.Fatalf("%q: render() error = %v", test.template, err)
+		}
+		if want := filepath.FromSlash(test.want); got != want {
+			t.Errorf("%q: render() = %q, want %q", test.template, got, want)
+		}
+	}
+
+	// Without a label, artifacts are laid out by job ID
+	paths, err := newArtifactPathTemplate("{{.JobName}}/{{.BaseName}}")
+	if err != nil {
+		t.Fatalf("newArtifactPathTemplate() error = %v", err)
+	}
+	got, err := paths.render(&api.Artifact{Path: "junit.xml", JobID: "job-1"}, "junit.xml")
+	if err != nil {
+		t.Fatalf("render() error = %v", err)
+	}
+	if want := filepath.Join("job-1", "junit.xml"); got != want {
+		t.Errorf("render() without a label = %q, want %q", got, want)
+	}
+
+	for _, invalid := range []string{"{{.Job}}/{{.Path}}", "{{.Path", "{{upper .Path}}"} {
+		if _, err := newArtifactPathTemplate(invalid); err == nil {
+			t.Errorf("newArtifactPathTemplate(%q) error = nil, want an error", invalid)
+		}
+	}
+	for _, escaping := range []string{"../{{.Path}}", "{{.Dir}}/"} {
+		paths, err := newArtifactPathTemplate(escaping)
+		if err != nil {
+			continue
+		}
+		if got, err := paths.render(artifact, artifact.Path); err == nil {
+			t.Errorf("%q: render() = %q, want an error", escaping, got)
+		}
+	}
+}
+
+func TestArtifactDownloaderPathTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 6,
+				"path": "junit.xml",
+				"job_id": "job-1",
+				"job_name": "Tests 1/2",
+				"url": "http://%s/download/1"
+			}, {
+				"id": "f7b32a13-4e92-bb83-4600-ac5c5a13f86f",
+				"file_size": 6,
+				"path": "junit.xml",
+				"job_id": "job-2",
+				"job_name": "Tests 2/2",
+				"url": "http://%s/download/2"
+			}]`, req.Host, req.Host)
+		case "/download/1":
+			fmt.Fprint(rw, "first\n")
+		case "/download/2":
+			fmt.Fprint(rw, "secnd\n")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		Query:        "junit.xml",
+		BuildID:      "my-build",
+		Destination:  dir,
+		PathTemplate: "{{.JobName}}/{{.BaseName}}",
+	})
+	if err := d.Download(context.Background()); err != nil {
+		t.Fatalf("d.Download() = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"Tests-1-2/junit.xml": "first\n",
+		"Tests-2-2/junit.xml": "secnd\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) error = %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(dir, artifactStagingPrefix+"*")); len(staged) > 0 {
+		t.Errorf("%s left in the destination, want it removed once the artifacts are laid out", staged)
+	}
+}
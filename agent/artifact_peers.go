@@ -0,0 +1,341 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// Agents running the artifact-peers experiment serve the artifacts in their
+// shared cache directory to each other, so when hundreds of them need the same
+// artifact at once, only the first few fetch it from the object store, and the
+// rest fetch pieces of it from those that already have it, from several at
+// once. Only whole artifacts are put in the cache, but peers serve whatever
+// is there, so what's fetched from peers is checked against the artifact's
+// SHA-256 before it's used. If it doesn't match, or no peer has it, it's
+// fetched from the object store as usual.
+const (
+	// The size of the pieces fetched from each peer
+	peerPieceSize = 4 * 1024 * 1024
+
+	// How long peers have to say whether they have an artifact
+	peerLookupTimeout = 2 * time.Second
+
+	// The header peers are authenticated with, if they share a token
+	peerTokenHeader = "X-Buildkite-Artifact-Peer-Token"
+)
+
+// peerArtifactID matches the IDs of artifacts in the shared cache, so nothing
+// else in the directory can be requested
+var peerArtifactID = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z-]*$`)
+
+// errNoPeers is returned when no peer has an artifact
+var errNoPeers = errors.New("no peer has the artifact")
+
+// ArtifactPeerServerConfig is the config for serving a shared cache directory
+// to other agents
+type ArtifactPeerServerConfig struct {
+	// The shared cache directory that artifacts are downloaded into
+	SharedCacheDir string
+
+	// If set, peers must send this token to fetch artifacts. Anyone who can
+	// reach the server can fetch them otherwise
+	Token string
+
+	// How many requests are served at once. Peers are told to try another
+	// when there are more. If zero, it's 16
+	MaxConcurrent int
+}
+
+// ArtifactPeerServer serves the artifacts in a shared cache directory to other
+// agents, by ID
+type ArtifactPeerServer struct {
+	conf   ArtifactPeerServerConfig
+	logger logger.Logger
+	slots  chan struct{}
+}
+
+func NewArtifactPeerServer(l logger.Logger, c ArtifactPeerServerConfig) *ArtifactPeerServer {
+	if c.MaxConcurrent <= 0 {
+		c.MaxConcurrent = 16
+	}
+	return &ArtifactPeerServer{
+		conf:   c,
+		logger: l,
+		slots:  make(chan struct{}, c.MaxConcurrent),
+	}
+}
+
+func (s *ArtifactPeerServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.conf.Token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get(peerTokenHeader)), []byte(s.conf.Token)) != 1 {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/artifacts/")
+	if id == req.URL.Path || !peerArtifactID.MatchString(id) {
+		http.NotFound(rw, req)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "Too many requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.conf.SharedCacheDir, id))
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(rw, req)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		s.logger.Debug("Serving %s (%s) to %s", id, req.Header.Get("Range"), req.RemoteAddr)
+	}
+	http.ServeContent(rw, req, "", info.ModTime(), f)
+}
+
+// resolvePeers returns the base URLs of the peers, which are given as
+// host:port, where a host with several addresses is a peer at each of them
+func resolvePeers(ctx context.Context, peers []string) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, peer := range peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			u := "http://" + net.JoinHostPort(addr, port)
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// fetchFromPeers fetches an artifact from the peers that have it to
+// targetPath, in pieces from several of them at once, and checks its SHA-256
+func (a *ArtifactDownloader) fetchFromPeers(ctx context.Context, artifact *api.Artifact, targetPath string, progress func(int64)) error {
+	if artifact.Sha256Sum == "" {
+		return errors.New("it has no SHA-256 to check what peers send against")
+	}
+
+	client := peerHTTPClient
+	peers := a.peersWith(ctx, client, artifact)
+	if len(peers) == 0 {
+		return errNoPeers
+	}
+
+	if err := downloadDirs.MkdirAll(filepath.Dir(targetPath), a.conf.DirPermissions); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// Each peer takes the next piece when it's done with the last, so faster
+	// peers fetch more of them. A piece a peer fails to send goes back for
+	// another peer, and that peer isn't asked for any more
+	pieces := make(chan int64, artifact.FileSize/peerPieceSize+1)
+	for offset := int64(0); offset < artifact.FileSize; offset += peerPieceSize {
+		pieces <- offset
+	}
+	remaining := len(pieces)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	if remaining == 0 {
+		close(done)
+	}
+	failed := 0
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			for {
+				var offset int64
+				select {
+				case offset = <-pieces:
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				}
+
+				size := artifact.FileSize - offset
+				if size > peerPieceSize {
+					size = peerPieceSize
+				}
+				err := a.fetchPiece(ctx, client, peer, artifact.ID, out, offset, size)
+
+				mu.Lock()
+				if err != nil {
+					a.logger.Debug("Peer %s failed to send %s from %d: %v", peer, artifact.Path, offset, err)
+					pieces <- offset
+					failed++
+					if failed == len(peers) {
+						close(done)
+					}
+					mu.Unlock()
+					return
+				}
+				progress(size)
+				remaining--
+				if remaining == 0 {
+					close(done)
+				}
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	if remaining > 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("every peer that had it failed, with %d pieces left", remaining)
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, out); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != artifact.Sha256Sum {
+		return fmt.Errorf("what peers sent has a SHA-256 of %s, expected %s", sum, artifact.Sha256Sum)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	a.logger.Debug("Fetched %s from %d peers", artifact.Path, len(peers))
+	return os.Rename(out.Name(), targetPath)
+}
+
+// peersWith returns the peers that have the whole of an artifact
+func (a *ArtifactDownloader) peersWith(ctx context.Context, client *http.Client, artifact *api.Artifact) []string {
+	ctx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+	defer cancel()
+
+	urls := resolvePeers(ctx, a.conf.Peers)
+	have := make([]bool, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			req, err := a.peerRequest(ctx, http.MethodHead, u, artifact.ID)
+			if err != nil {
+				return
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			res.Body.Close()
+			have[i] = res.StatusCode == http.StatusOK && res.ContentLength == artifact.FileSize
+		}(i, u)
+	}
+	wg.Wait()
+
+	var peers []string
+	for i, u := range urls {
+		if have[i] {
+			peers = append(peers, u)
+		}
+	}
+	return peers
+}
+
+// fetchPiece writes size bytes of an artifact, from offset, from a peer to
+// the same place in out
+func (a *ArtifactDownloader) fetchPiece(ctx context.Context, client *http.Client, peer, id string, out *os.File, offset, size int64) error {
+	req, err := a.peerRequest(ctx, http.MethodGet, peer, id)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s", res.Status)
+	}
+
+	n, err := io.Copy(&offsetWriter{w: out, off: offset}, io.LimitReader(res.Body, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("got %d bytes, expected %d", n, size)
+	}
+	return nil
+}
+
+func (a *ArtifactDownloader) peerRequest(ctx context.Context, method, peer, id string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, peer+"/artifacts/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.conf.PeerToken != "" {
+		req.Header.Set(peerTokenHeader, a.conf.PeerToken)
+	}
+	return req, nil
+}
+
+// peerHTTPClient is the client peers are fetched from with. They're on the
+// same network, so it doesn't go through the proxies artifact storage is
+// reached through
+var peerHTTPClient = func() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.MaxIdleConnsPerHost = 16
+	return &http.Client{Transport: t}
+}()
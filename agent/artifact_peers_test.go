@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderFetchesFromPeers(t *testing.T) {
+	const id = "4600ac5c-5a13-4e92-bb83-f86f218f7b32"
+
+	contents := make([]byte, 3*peerPieceSize+123)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	var storeDownloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			fmt.Fprintf(rw, `[{
+				"id": %q,
+				"file_size": %d,
+				"path": "toolchain.tar",
+				"sha256sum": "%x",
+				"url": "http://%s/download"
+			}]`, id, len(contents), sha256.Sum256(contents), req.Host)
+		case "/download":
+			atomic.AddInt32(&storeDownloads, 1)
+			rw.Write(contents)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	// startPeer serves a shared cache with the artifact in it, if it's given
+	// what the peer has
+	startPeer := func(has []byte) string {
+		t.Helper()
+		dir := t.TempDir()
+		if has != nil {
+			if err := os.WriteFile(filepath.Join(dir, id), has, 0o644); err != nil {
+				t.Fatalf("os.WriteFile() error = %v", err)
+			}
+		}
+		peer := httptest.NewServer(NewArtifactPeerServer(logger.Discard, ArtifactPeerServerConfig{
+			SharedCacheDir: dir,
+			Token:          "alpacas",
+		}))
+		t.Cleanup(peer.Close)
+		u, _ := url.Parse(peer.URL)
+		return u.Host
+	}
+
+	download := func(peers []string) []byte {
+		t.Helper()
+		dir := t.TempDir()
+		d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+			BuildID:        "my-build",
+			Destination:    filepath.Join(dir, "out"),
+			SharedCacheDir: filepath.Join(dir, "cache"),
+			Peers:          peers,
+			PeerToken:      "alpacas",
+		})
+		if err := os.MkdirAll(filepath.Join(dir, "out"), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() error = %v", err)
+		}
+		if err := d.Download(context.Background()); err != nil {
+			t.Fatalf("d.Download() = %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "out", "toolchain.tar"))
+		if err != nil {
+			t.Fatalf("os.ReadFile() error = %v", err)
+		}
+
+		// Whatever was fetched is in the cache, to be served to other peers
+		if _, err := os.Stat(filepath.Join(dir, "cache", id)); err != nil {
+			t.Errorf("os.Stat(cache) error = %v, want the artifact in the shared cache", err)
+		}
+		return got
+	}
+
+	// Peers that have it are fetched from, and one that doesn't isn't
+	peers := []string{startPeer(contents), startPeer(contents), startPeer(nil)}
+	if got := download(peers); !bytes.Equal(got, contents) {
+		t.Errorf("downloaded artifact doesn't match what was uploaded")
+	}
+	if got := atomic.LoadInt32(&storeDownloads); got != 0 {
+		t.Errorf("downloads from the object store = %d, want 0", got)
+	}
+
+	// What a peer sends that doesn't match is thrown away
+	corrupt := append([]byte{}, contents...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if got := download([]string{startPeer(corrupt)}); !bytes.Equal(got, contents) {
+		t.Errorf("downloaded artifact doesn't match what was uploaded")
+	}
+	if got := atomic.LoadInt32(&storeDownloads); got != 1 {
+		t.Errorf("downloads from the object store = %d, want 1 after a peer sent something else", got)
+	}
+}
+
+func TestArtifactPeerServer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "llamas"), []byte("llamas"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "llamas.lock"), nil, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	s := NewArtifactPeerServer(logger.Discard, ArtifactPeerServerConfig{SharedCacheDir: dir, Token: "alpacas"})
+
+	for _, test := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/artifacts/llamas", "alpacas", http.StatusOK},
+		{"/artifacts/llamas", "", http.StatusUnauthorized},
+		{"/artifacts/llamas", "camels", http.StatusUnauthorized},
+		{"/artifacts/llamas.lock", "alpacas", http.StatusNotFound},
+		{"/artifacts/../llamas", "alpacas", http.StatusNotFound},
+		{"/llamas", "alpacas", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://peer"+test.path, nil)
+		if test.token != "" {
+			req.Header.Set(peerTokenHeader, test.token)
+		}
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, req)
+		if rw.Code != test.want {
+			t.Errorf("GET %s with token %q = %d, want %d", test.path, test.token, rw.Code, test.want)
+		}
+	}
+}
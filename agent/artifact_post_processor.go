@@ -0,0 +1,348 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/version"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// artifactPostProcessors are what can be done to artifacts after they're
+// collected and before they're uploaded. Each is given the artifact as it is
+// so far, and returns the artifact to upload in its place, followed by any
+// extra artifacts to upload alongside it.
+var artifactPostProcessors = map[string]func(*artifactPostProcess, *api.Artifact) ([]*api.Artifact, error){
+	"gzip":     (*artifactPostProcess).gzip,
+	"checksum": (*artifactPostProcess).checksum,
+	"sign":     (*artifactPostProcess).sign,
+	"sbom":     (*artifactPostProcess).sbom,
+	"chunk":    (*artifactPostProcess).chunk,
+}
+
+// postProcessRule applies post-processors to the artifacts matching a pattern
+type postProcessRule struct {
+	matcher    interface{ Match(string) bool }
+	basename   bool
+	processors []string
+}
+
+// parsePostProcessRules parses rules like "*.log=gzip;dist/**/*=checksum,sign",
+// which apply the post-processors after the = to the artifacts whose path
+// matches the pattern before it. Like --ignore-paths, a pattern without a
+// slash matches the artifact's file name.
+func parsePostProcessRules(rules string) ([]postProcessRule, error) {
+	var parsed []postProcessRule
+	for _, rule := range strings.Split(rules, ArtifactPathDelimiter) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, processors, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid post-processing rule %q, expected pattern=processor,...", rule)
+		}
+		pattern = strings.TrimPrefix(filepath.ToSlash(strings.TrimSpace(pattern)), "./")
+
+		matcher, err := zglob.New(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid post-processing pattern %q: %w", pattern, err)
+		}
+		r := postProcessRule{
+			matcher:  matcher,
+			basename: !strings.Contains(pattern, "/"),
+		}
+
+		for _, name := range strings.Split(processors, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := artifactPostProcessors[name]; !ok {
+				return nil, fmt.Errorf("unknown artifact post-processor %q in %q, expected one of %q", name, rule, postProcessorNames())
+			}
+			r.processors = append(r.processors, name)
+		}
+
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func postProcessorNames() []string {
+	names := make([]string, 0, len(artifactPostProcessors))
+	for name := range artifactPostProcessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// processorsFor returns the post-processors for the artifact at path, in the
+// order they're given by the matching rules
+func processorsFor(rules []postProcessRule, artifactPath string) []string {
+	name := filepath.ToSlash(artifactPath)
+
+	var processors []string
+	seen := map[string]bool{}
+	for _, r := range rules {
+		target := name
+		if r.basename {
+			target = path.Base(name)
+		}
+		if !r.matcher.Match(target) {
+			continue
+		}
+		for _, p := range r.processors {
+			if !seen[p] {
+				seen[p] = true
+				processors = append(processors, p)
+			}
+		}
+	}
+	return processors
+}
+
+// artifactPostProcess is a run of post-processors over collected artifacts.
+// What they write is kept in a temporary directory until it's uploaded.
+type artifactPostProcess struct {
+	ctx        context.Context
+	uploader   *ArtifactUploader
+	dir        string
+	signingKey ed25519.PrivateKey
+}
+
+// postProcess applies the configured post-processors to the artifacts. The
+// returned function removes the files they wrote, and must be called once
+// the artifacts are uploaded.
+func (a *ArtifactUploader) postProcess(ctx context.Context, artifacts []*api.Artifact) ([]*api.Artifact, func(), error) {
+	noop := func() {}
+
+	rules, err := parsePostProcessRules(a.conf.PostProcessors)
+	if err != nil || len(rules) == 0 {
+		return artifacts, noop, err
+	}
+
+	p := &artifactPostProcess{ctx: ctx, uploader: a}
+	for _, r := range rules {
+		for _, name := range r.processors {
+			if name == "sign" && p.signingKey == nil {
+				if p.signingKey, err = loadArtifactSigningKey(a.conf.SigningKeyPath); err != nil {
+					return nil, noop, err
+				}
+			}
+		}
+	}
+
+	p.dir, err = os.MkdirTemp("", "buildkite-artifacts")
+	if err != nil {
+		return nil, noop, fmt.Errorf("creating directory for post-processed artifacts: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(p.dir) }
+
+	var processed []*api.Artifact
+	for _, artifact := range artifacts {
+		var extra []*api.Artifact
+		for _, name := range processorsFor(rules, artifact.Path) {
+			out, err := artifactPostProcessors[name](p, artifact)
+			if err != nil {
+				cleanup()
+				return nil, noop, fmt.Errorf("%s post-processing %s: %w", name, artifact.Path, err)
+			}
+			artifact, extra = out[0], append(extra, out[1:]...)
+		}
+		processed = append(processed, artifact)
+		processed = append(processed, extra...)
+	}
+
+	if len(processed) != len(artifacts) {
+		a.logger.Info("Post-processing added %d artifacts", len(processed)-len(artifacts))
+	}
+
+	return processed, cleanup, nil
+}
+
+// create returns a new file for the artifact at artifactPath. The file gets a
+// generated name, as artifact paths can contain .. and escape p.dir, but keeps
+// the extension so the content type is still detected from it.
+func (p *artifactPostProcess) create(artifactPath string) (*os.File, error) {
+	return os.CreateTemp(p.dir, "artifact-*"+filepath.Ext(artifactPath))
+}
+
+// sidecar uploads contents as a new artifact next to the given one
+func (p *artifactPostProcess) sidecar(artifact *api.Artifact, suffix string, contents []byte) (*api.Artifact, error) {
+	f, err := p.create(artifact.Path + suffix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return p.uploader.build(artifact.Path+suffix, f.Name(), artifact.GlobPath)
+}
+
+// gzip replaces the artifact with a gzipped copy of it, with .gz on the end
+// of its path
+func (p *artifactPostProcess) gzip(artifact *api.Artifact) ([]*api.Artifact, error) {
+	in, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := p.create(artifact.Path + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(artifact.Path)
+	if _, err := io.Copy(zw, in); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	gzipped, err := p.uploader.build(artifact.Path+".gz", out.Name(), artifact.GlobPath)
+	if err != nil {
+		return nil, err
+	}
+	return []*api.Artifact{gzipped}, nil
+}
+
+// checksum uploads the artifact's SHA-256 next to it, in the format
+// sha256sum --check reads
+func (p *artifactPostProcess) checksum(artifact *api.Artifact) ([]*api.Artifact, error) {
+	contents := fmt.Sprintf("%s  %s\n", artifact.Sha256Sum, path.Base(filepath.ToSlash(artifact.Path)))
+	sum, err := p.sidecar(artifact, ".sha256", []byte(contents))
+	if err != nil {
+		return nil, err
+	}
+	return []*api.Artifact{artifact, sum}, nil
+}
+
+// sign uploads a base64 Ed25519 signature of the artifact next to it. Ed25519
+// signs the whole file rather than a digest of it, which is what
+// verifyFileSignature checks.
+func (p *artifactPostProcess) sign(artifact *api.Artifact) ([]*api.Artifact, error) {
+	message, err := os.ReadFile(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(p.signingKey, message))
+	sig, err := p.sidecar(artifact, ".sig", []byte(signature+"\n"))
+	if err != nil {
+		return nil, err
+	}
+	return []*api.Artifact{artifact, sig}, nil
+}
+
+// spdxDocument is the part of an SPDX 2.3 software bill of materials that
+// describes a single file
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Files []spdxFile `json:"files"`
+}
+
+type spdxFile struct {
+	FileName  string         `json:"fileName"`
+	SPDXID    string         `json:"SPDXID"`
+	Checksums []spdxChecksum `json:"checksums"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// sbom uploads an SPDX document describing the artifact next to it
+func (p *artifactPostProcess) sbom(artifact *api.Artifact) ([]*api.Artifact, error) {
+	name := filepath.ToSlash(artifact.Path)
+
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://buildkite.com/spdx/%s/%s", p.uploader.conf.JobID, name),
+		Files: []spdxFile{{
+			FileName: "./" + name,
+			SPDXID:   "SPDXRef-File",
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", ChecksumValue: artifact.Sha1Sum},
+				{Algorithm: "SHA256", ChecksumValue: artifact.Sha256Sum},
+			},
+		}},
+	}
+	doc.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: buildkite-agent-" + version.Version()}
+
+	contents, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sbom, err := p.sidecar(artifact, ".spdx.json", append(contents, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return []*api.Artifact{artifact, sbom}, nil
+}
+
+// loadArtifactSigningKey reads a PEM encoded PKCS #8 Ed25519 private key, as
+// written by openssl genpkey -algorithm ed25519
+func loadArtifactSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	if keyPath == "" {
+		return nil, errors.New("the sign artifact post-processor needs an artifact signing key")
+	}
+
+	contents, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading artifact signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("artifact signing key %s isn't PEM encoded", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing artifact signing key %s: %w", keyPath, err)
+	}
+
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("artifact signing key %s is a %T, not an Ed25519 key", keyPath, key)
+	}
+	return signingKey, nil
+}
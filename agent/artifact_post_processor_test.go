@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePostProcessRules(t *testing.T) {
+	rules, err := parsePostProcessRules("*.log=gzip; dist/**/*=checksum, sign ;;")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"gzip"}, processorsFor(rules, "tmp/build.log"))
+	assert.Equal(t, []string{"checksum", "sign"}, processorsFor(rules, "dist/app.tar"))
+	assert.Equal(t, []string{"gzip", "checksum", "sign"}, processorsFor(rules, "dist/debug/build.log"))
+	assert.Empty(t, processorsFor(rules, "README.md"))
+
+	for _, invalid := range []string{"*.log", "*.log=zip", "*.log=gzip,"} {
+		_, err := parsePostProcessRules(invalid)
+		assert.Error(t, err, "parsePostProcessRules(%q)", invalid)
+	}
+}
+
+func TestArtifactPostProcess(t *testing.T) {
+	dir := t.TempDir()
+
+	contents := []byte("llamas\n")
+	logPath := filepath.Join(dir, "build.log")
+	require.NoError(t, os.WriteFile(logPath, contents, 0o600))
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "signing.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:          "my-job",
+		PostProcessors: "*.log=gzip,checksum,sign,sbom",
+		SigningKeyPath: keyPath,
+	})
+
+	artifact, err := uploader.build("logs/build.log", logPath, "logs/*.log")
+	require.NoError(t, err)
+
+	artifacts, cleanup, err := uploader.postProcess(context.Background(), []*api.Artifact{artifact})
+	require.NoError(t, err)
+	defer cleanup()
+
+	var paths []string
+	for _, a := range artifacts {
+		paths = append(paths, filepath.ToSlash(a.Path))
+	}
+	assert.Equal(t, []string{
+		"logs/build.log.gz",
+		"logs/build.log.gz.sha256",
+		"logs/build.log.gz.sig",
+		"logs/build.log.gz.spdx.json",
+	}, paths)
+
+	// The gzipped log replaces the original
+	gzipped := artifacts[0]
+	f, err := os.Open(gzipped.AbsolutePath)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, contents, got)
+
+	sum, err := os.ReadFile(artifacts[1].AbsolutePath)
+	require.NoError(t, err)
+	assert.Equal(t, gzipped.Sha256Sum+"  build.log.gz\n", string(sum))
+
+	sig, err := os.ReadFile(artifacts[2].AbsolutePath)
+	require.NoError(t, err)
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	require.NoError(t, err)
+	message, err := os.ReadFile(gzipped.AbsolutePath)
+	require.NoError(t, err)
+	assert.True(t, ed25519.Verify(pub, message, signature), "signature doesn't verify")
+
+	sbom, err := os.ReadFile(artifacts[3].AbsolutePath)
+	require.NoError(t, err)
+	var doc spdxDocument
+	require.NoError(t, json.Unmarshal(sbom, &doc))
+	assert.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	require.Len(t, doc.Files, 1)
+	assert.Contains(t, doc.Files[0].Checksums, spdxChecksum{Algorithm: "SHA256", ChecksumValue: gzipped.Sha256Sum})
+
+	// Everything post-processing wrote goes once the artifacts are uploaded
+	cleanup()
+	_, err = os.Stat(gzipped.AbsolutePath)
+	assert.True(t, os.IsNotExist(err), "os.Stat(%q) error = %v, want not exist", gzipped.AbsolutePath, err)
+}
+
+func TestArtifactPostProcessSignWithoutKey(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		PostProcessors: "*=sign",
+	})
+
+	_, _, err := uploader.postProcess(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+func TestArtifactPostProcessStaysInItsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "build.log")
+	require.NoError(t, os.WriteFile(logPath, []byte("llamas\n"), 0o600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:          "my-job",
+		PostProcessors: "**/*.log=gzip,checksum",
+	})
+
+	artifact, err := uploader.build("../../../build.log", logPath, "../../../*.log")
+	require.NoError(t, err)
+
+	artifacts, cleanup, err := uploader.postProcess(context.Background(), []*api.Artifact{artifact})
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.Len(t, artifacts, 2)
+	for _, a := range artifacts {
+		parent := filepath.Dir(filepath.Dir(a.AbsolutePath))
+		assert.True(t, within(os.TempDir(), parent), "%s was written outside the temp directory", a.AbsolutePath)
+	}
+}
+
+func TestArtifactPostProcessSignatureVerifies(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.tar")
+	require.NoError(t, os.WriteFile(path, []byte("llamas\n"), 0o600))
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "signing.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:          "my-job",
+		PostProcessors: "*.tar=sign",
+		SigningKeyPath: keyPath,
+	})
+
+	artifact, err := uploader.build("app.tar", path, "*.tar")
+	require.NoError(t, err)
+
+	artifacts, cleanup, err := uploader.postProcess(context.Background(), []*api.Artifact{artifact})
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.Len(t, artifacts, 2)
+	assert.NoError(t, verifyFileSignature(pub, artifacts[0].AbsolutePath, artifacts[1].AbsolutePath))
+
+	// A tampered artifact doesn't verify against the same signature
+	require.NoError(t, os.WriteFile(path, []byte("alpacas\n"), 0o600))
+	assert.Error(t, verifyFileSignature(pub, path, artifacts[1].AbsolutePath))
+}
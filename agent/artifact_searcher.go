@@ -2,25 +2,37 @@ package agent
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 )
 
+// ArtifactSearchClient is the part of the API client that searches for
+// artifacts, which is all ArtifactSearcher and ArtifactDownloader need
+type ArtifactSearchClient interface {
+	SearchArtifacts(context.Context, string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error)
+}
+
+// ArtifactSearcher finds the artifacts of a build. It's used by the artifact
+// commands, and can be used by other tools that need to find artifacts
+// without downloading them.
 type ArtifactSearcher struct {
 	// The logger instance to use
 	logger logger.Logger
 
-	// The APIClient that will be used when uploading jobs
-	apiClient APIClient
+	// The client that will be used to search for artifacts
+	apiClient ArtifactSearchClient
 
 	// The ID of the Build that these artifacts belong to
 	buildID string
 }
 
-func NewArtifactSearcher(l logger.Logger, ac APIClient, buildID string) *ArtifactSearcher {
+func NewArtifactSearcher(l logger.Logger, ac ArtifactSearchClient, buildID string) *ArtifactSearcher {
 	return &ArtifactSearcher{
 		logger:    l,
 		apiClient: ac,
@@ -29,29 +41,236 @@ func NewArtifactSearcher(l logger.Logger, ac APIClient, buildID string) *Artifac
 }
 
 func (a *ArtifactSearcher) Search(ctx context.Context, query, scope string, includeRetriedJobs, includeDuplicates bool) ([]*api.Artifact, error) {
-	if scope == "" {
+	var artifacts []*api.Artifact
+	err := a.SearchPages(ctx, query, scope, includeRetriedJobs, includeDuplicates, func(page []*api.Artifact) error {
+		artifacts = append(artifacts, page...)
+		return nil
+	})
+	return artifacts, err
+}
+
+// SearchPages is Search, but calls found with each page of artifacts as it
+// arrives, rather than returning them all once the last page has, so they
+// can be used before the search has finished. The search stops if found
+// returns an error. Each page is retried on its own, so a failure part way
+// through doesn't search again from the start.
+func (a *ArtifactSearcher) SearchPages(ctx context.Context, query, scope string, includeRetriedJobs, includeDuplicates bool, found func([]*api.Artifact) error) error {
+	switch {
+	case query == "":
+		// Without a query, every artifact of the build is listed
+		a.logger.Debug("Listing the build's artifacts")
+	case scope == "":
 		a.logger.Info("Searching for artifacts: \"%s\"", query)
-	} else {
+	default:
 		a.logger.Info("Searching for artifacts: \"%s\" within step: \"%s\"", query, scope)
 	}
 
-	var artifacts []*api.Artifact
+	return a.searchPages(ctx, api.ArtifactSearchOptions{
+		Query:              query,
+		Scope:              scope,
+		State:              "finished",
+		IncludeRetriedJobs: includeRetriedJobs,
+		IncludeDuplicates:  includeDuplicates,
+	}, found)
+}
+
+// ArtifactQuery is what ArtifactSearcher.Find looks for. Its zero value
+// finds every finished artifact of the build.
+type ArtifactQuery struct {
+	// A glob of the paths to find, or empty for every path
+	Path string
+
+	// The steps, by key, label or ID, whose jobs uploaded the artifacts. If
+	// empty, artifacts from any step are found
+	Steps []string
+
+	// The states the artifacts are in, such as "finished" or "error". If
+	// empty, only finished artifacts are found
+	States []string
+
+	// Only artifacts created within this window are found. A zero time
+	// leaves that end of it open
+	CreatedAfter, CreatedBefore time.Time
 
-	// Retry on transport errors, a failed search will return 0 artifacts
-	err := roko.NewRetrier(
-		roko.WithMaxAttempts(10),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(*roko.Retrier) error {
-		var searchErr error
-		artifacts, _, searchErr = a.apiClient.SearchArtifacts(ctx, a.buildID, &api.ArtifactSearchOptions{
-			Query:              query,
-			Scope:              scope,
-			State:              "finished",
-			IncludeRetriedJobs: includeRetriedJobs,
-			IncludeDuplicates:  includeDuplicates,
-		})
-		return searchErr
+	// Whether to find artifacts from jobs that were retried, and artifacts
+	// with the same path as others
+	IncludeRetriedJobs, IncludeDuplicates bool
+
+	// If set, OnPage is called with each page of results as it arrives, and
+	// Find returns none, so they can be used before the search has finished.
+	// The search stops if it returns an error
+	OnPage func([]ArtifactSearchResult) error
+}
+
+// ArtifactSearchResult is an artifact that ArtifactSearcher.Find found, with
+// which of the query's steps and states it matched
+type ArtifactSearchResult struct {
+	*api.Artifact
+
+	// The step it was found in, or empty if the query had no steps
+	Step string
+
+	// The state it's in
+	State string
+}
+
+// Find finds the artifacts that match q. Each step and state is searched in
+// the order they're given, and an artifact matched by more than one of them
+// is only found once.
+func (a *ArtifactSearcher) Find(ctx context.Context, q ArtifactQuery) ([]ArtifactSearchResult, error) {
+	steps := q.Steps
+	if len(steps) == 0 {
+		steps = []string{""}
+	}
+	states := q.States
+	if len(states) == 0 {
+		states = []string{"finished"}
+	}
+
+	var results []ArtifactSearchResult
+	seen := make(map[string]bool)
+	for _, state := range states {
+		for _, step := range steps {
+			a.logger.Debug("Finding %s artifacts matching %q in step %q", state, q.Path, step)
+
+			err := a.searchPages(ctx, api.ArtifactSearchOptions{
+				Query:              q.Path,
+				Scope:              step,
+				State:              state,
+				IncludeRetriedJobs: q.IncludeRetriedJobs,
+				IncludeDuplicates:  q.IncludeDuplicates,
+			}, func(page []*api.Artifact) error {
+				var matched []ArtifactSearchResult
+				for _, artifact := range page {
+					if seen[artifact.ID] || !q.createdWithin(artifact.CreatedAt) {
+						continue
+					}
+					seen[artifact.ID] = true
+					matched = append(matched, ArtifactSearchResult{Artifact: artifact, Step: step, State: state})
+				}
+				if q.OnPage != nil {
+					if len(matched) == 0 {
+						return nil
+					}
+					return q.OnPage(matched)
+				}
+				results = append(results, matched...)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+func (q ArtifactQuery) createdWithin(t time.Time) bool {
+	if !q.CreatedAfter.IsZero() && t.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !t.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// searchPages searches with opts a page at a time, calling found with each
+func (a *ArtifactSearcher) searchPages(ctx context.Context, opts api.ArtifactSearchOptions, found func([]*api.Artifact) error) error {
+	for page := 0; ; {
+		var artifacts []*api.Artifact
+		var resp *api.Response
+
+		// Retry on transport errors, a failed search will return 0 artifacts
+		err := roko.NewRetrier(
+			roko.WithMaxAttempts(10),
+			roko.WithStrategy(roko.Constant(5*time.Second)),
+		).DoWithContext(ctx, retrylog.Wrap("Searching for artifacts", func(*roko.Retrier) error {
+			var searchErr error
+			opts.Page = page
+			artifacts, resp, searchErr = a.apiClient.SearchArtifacts(ctx, a.buildID, &opts)
+			return searchErr
+		}))
+		if err != nil {
+			return err
+		}
+
+		if err := found(artifacts); err != nil {
+			return err
+		}
+
+		// Responses that aren't paginated have every artifact, and a page
+		// that links to itself would never finish
+		if resp == nil || resp.NextPage == 0 || resp.NextPage <= page {
+			return nil
+		}
+		a.logger.Debug("Found %d artifacts, searching page %d", len(artifacts), resp.NextPage)
+		page = resp.NextPage
+	}
+}
+
+// ByID finds the artifacts with the given IDs, in the order they're given, by
+// listing every artifact of the build rather than matching their paths, so
+// it finds exactly those artifacts whichever jobs uploaded them. It's an
+// error if any of them can't be found.
+func (a *ArtifactSearcher) ByID(ctx context.Context, ids []string, scope string) ([]*api.Artifact, error) {
+	wanted := make(map[string]*api.Artifact, len(ids))
+	for _, id := range ids {
+		wanted[id] = nil
+	}
+
+	a.logger.Info("Looking up %d artifacts by ID", len(wanted))
+	err := a.SearchPages(ctx, "", scope, true, true, func(page []*api.Artifact) error {
+		for _, artifact := range page {
+			if found, ok := wanted[artifact.ID]; ok && found == nil {
+				wanted[artifact.ID] = artifact
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return artifacts, err
+	var artifacts []*api.Artifact
+	var missing []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if wanted[id] == nil {
+			missing = append(missing, id)
+			continue
+		}
+		artifacts = append(artifacts, wanted[id])
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no finished artifacts were found with the IDs %s", strings.Join(missing, ", "))
+	}
+	return artifacts, nil
+}
+
+// LatestArtifacts resolves the artifacts found when searching retried jobs
+// too, where a job and each of its retries can upload the same path. Only
+// the most recently created artifact for each path is kept, as it's from the
+// newest job in the retry lineage. Otherwise the order is unchanged.
+func LatestArtifacts(artifacts []*api.Artifact) []*api.Artifact {
+	latest := make(map[string]int, len(artifacts))
+	var resolved []*api.Artifact
+
+	for _, artifact := range artifacts {
+		i, ok := latest[artifact.Path]
+		if !ok {
+			latest[artifact.Path] = len(resolved)
+			resolved = append(resolved, artifact)
+			continue
+		}
+		if !artifact.CreatedAt.Before(resolved[i].CreatedAt) {
+			resolved[i] = artifact
+		}
+	}
+
+	return resolved
 }
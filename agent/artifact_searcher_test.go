@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -55,3 +56,157 @@ func TestArtifactSearcherConnectsToEndpoint(t *testing.T) {
 		URL:          "http://example.com/download",
 	}}, artifacts)
 }
+
+func TestLatestArtifacts(t *testing.T) {
+	first := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	retried := first.Add(time.Hour)
+
+	artifacts := []*api.Artifact{
+		{ID: "a1", Path: "coverage.xml", JobID: "job-1", CreatedAt: first},
+		{ID: "b1", Path: "report.html", JobID: "job-1", CreatedAt: first},
+		{ID: "a2", Path: "coverage.xml", JobID: "job-2", CreatedAt: retried},
+		{ID: "c2", Path: "only-retried.txt", JobID: "job-2", CreatedAt: retried},
+	}
+
+	var ids []string
+	for _, artifact := range LatestArtifacts(artifacts) {
+		ids = append(ids, artifact.ID)
+	}
+	assert.Equal(t, []string{"a2", "b1", "c2"}, ids)
+}
+
+func TestArtifactSearcherFollowsPages(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?query=%2A.txt&state=finished":
+			rw.Header().Set("Link", fmt.Sprintf(`<http://%s/builds/my-build/artifacts/search?page=2>; rel="next", <http://%s/builds/my-build/artifacts/search?page=2>; rel="last"`, req.Host, req.Host))
+			fmt.Fprint(rw, `[{"id": "a1", "path": "llamas.txt"}]`)
+		case "/builds/my-build/artifacts/search?page=2&query=%2A.txt&state=finished":
+			fmt.Fprint(rw, `[{"id": "a2", "path": "alpacas.txt"}]`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	var pages [][]string
+	err := NewArtifactSearcher(logger.Discard, ac, "my-build").SearchPages(context.Background(), "*.txt", "", false, false, func(page []*api.Artifact) error {
+		var ids []string
+		for _, artifact := range page {
+			ids = append(ids, artifact.ID)
+		}
+		pages = append(pages, ids)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SearchPages() error = %v", err)
+	}
+	assert.Equal(t, [][]string{{"a1"}, {"a2"}}, pages)
+}
+
+func TestArtifactSearcherByID(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?include_duplicates=true&include_retried_jobs=true&state=finished":
+			fmt.Fprint(rw, `[
+				{"id": "a1", "path": "coverage.xml", "job_id": "job-1"},
+				{"id": "b1", "path": "report.html", "job_id": "job-1"},
+				{"id": "a2", "path": "coverage.xml", "job_id": "job-2"}
+			]`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+	s := NewArtifactSearcher(logger.Discard, ac, "my-build")
+
+	// The artifact from the first job is found, even though it was retried
+	artifacts, err := s.ByID(context.Background(), []string{"b1", "a1", "b1"}, "")
+	if err != nil {
+		t.Fatalf(`s.ByID([b1 a1 b1]) error = %v`, err)
+	}
+	var ids []string
+	for _, artifact := range artifacts {
+		ids = append(ids, artifact.ID)
+	}
+	assert.Equal(t, []string{"b1", "a1"}, ids)
+
+	if _, err := s.ByID(context.Background(), []string{"a1", "llamas"}, ""); err == nil {
+		t.Errorf(`s.ByID([a1 llamas]) error = nil, want an error for the missing artifact`)
+	}
+}
+
+func TestArtifactSearcherFind(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if req.URL.Path != "/builds/my-build/artifacts/search" || q.Get("query") != "*.log" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		switch q.Get("scope") + " " + q.Get("state") {
+		case "test finished":
+			fmt.Fprint(rw, `[
+				{"id": "old", "path": "old.log", "created_at": "2023-01-01T00:00:00Z"},
+				{"id": "a1", "path": "test.log", "created_at": "2023-01-02T00:00:00Z"}
+			]`)
+		case "lint finished":
+			// a1 again, as the same step can match more than one scope
+			fmt.Fprint(rw, `[
+				{"id": "a1", "path": "test.log", "created_at": "2023-01-02T00:00:00Z"},
+				{"id": "b1", "path": "lint.log", "created_at": "2023-01-02T00:00:00Z"}
+			]`)
+		case "test error", "lint error":
+			fmt.Fprint(rw, `[]`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+	s := NewArtifactSearcher(logger.Discard, ac, "my-build")
+
+	query := ArtifactQuery{
+		Path:         "*.log",
+		Steps:        []string{"test", "lint"},
+		States:       []string{"finished", "error"},
+		CreatedAfter: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	results, err := s.Find(context.Background(), query)
+	if err != nil {
+		t.Fatalf("s.Find() error = %v", err)
+	}
+
+	type found struct{ ID, Step, State string }
+	var got []found
+	for _, result := range results {
+		got = append(got, found{result.ID, result.Step, result.State})
+	}
+	assert.Equal(t, []found{{"a1", "test", "finished"}, {"b1", "lint", "finished"}}, got)
+
+	// With OnPage, the results are given a page at a time instead
+	var pages int
+	query.OnPage = func(page []ArtifactSearchResult) error {
+		pages++
+		return nil
+	}
+	results, err = s.Find(context.Background(), query)
+	if err != nil {
+		t.Fatalf("s.Find() with OnPage error = %v", err)
+	}
+	assert.Empty(t, results)
+	assert.Equal(t, 2, pages)
+}
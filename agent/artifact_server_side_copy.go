@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/destination"
+	"github.com/buildkite/agent/v3/pool"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Objects larger than this can't be copied in one request, and are copied
+// in parts of s3CopyPartSize instead
+const (
+	s3MaxCopySize  = 5 * 1024 * 1024 * 1024
+	s3CopyPartSize = 512 * 1024 * 1024
+)
+
+// serverSideCopier copies objects within a storage service, without their
+// contents passing through the agent
+type serverSideCopier interface {
+	copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, size int64) error
+}
+
+// IsServerSideDestination returns whether artifacts can be copied to a
+// download destination with ArtifactDownloaderConfig.ServerSide
+func IsServerSideDestination(dest string) bool {
+	return destination.HasScheme(dest, destination.S3, destination.GS)
+}
+
+// parseServerSideDestination parses and validates an s3:// or gs://
+// download destination
+func parseServerSideDestination(dest string) (destination.Destination, error) {
+	if !IsServerSideDestination(dest) {
+		return destination.Destination{}, fmt.Errorf("Artifacts can only be copied server-side to s3:// or gs:// destinations, not %s", dest)
+	}
+	return destination.Parse(dest)
+}
+
+// joinKey joins the parts of an object key, leaving out empty ones
+func joinKey(parts ...string) string {
+	nonEmpty := parts[:0]
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
+
+// copyServerSide copies the artifacts to the destination bucket with the
+// storage service's copy API, rather than downloading them
+func (a *ArtifactDownloader) copyServerSide(ctx context.Context, artifacts []*api.Artifact, uploadDestinations map[*api.Artifact]destination.Destination, s3BucketRules []s3BucketRule) error {
+	dst, err := parseServerSideDestination(a.conf.Destination)
+	if err != nil {
+		return err
+	}
+	scheme, dstBucket, dstPath := dst.Scheme, dst.Bucket, dst.Path
+
+	// Every artifact has to be in the same storage service as the
+	// destination, or there's no copy API to copy it with
+	for _, artifact := range artifacts {
+		if src, ok := uploadDestinations[artifact]; !ok || src.Scheme != scheme {
+			where := artifact.UploadDestination
+			if where == "" {
+				where = "Buildkite's artifact storage"
+			}
+			return fmt.Errorf("%s was uploaded to %s, so it can't be copied to %s server-side", artifact.Path, where, a.conf.Destination)
+		}
+	}
+
+	if a.conf.DryRun {
+		for _, artifact := range artifacts {
+			src := uploadDestinations[artifact]
+			a.logger.Info("%s would be copied from %s://%s/%s to %s://%s/%s", artifact.Path,
+				scheme, src.Bucket, joinKey(src.Path, artifactLocalPath(artifact.Path)),
+				scheme, dstBucket, joinKey(dstPath, artifactLocalPath(artifact.Path)))
+		}
+		return nil
+	}
+
+	var copier serverSideCopier
+	switch scheme {
+	case destination.S3:
+		client, err := NewS3ClientWithConfig(ctx, a.logger, dstBucket, a.s3BucketConfig(s3BucketRules, dstBucket))
+		if err != nil {
+			return fmt.Errorf("creating an S3 client for %s: %w", dstBucket, err)
+		}
+		copier = s3Copier{client: client}
+	case destination.GS:
+		client, err := newGoogleClient(ctx, storage.DevstorageReadWriteScope, a.conf.GSCredentialsFile, a.storageClient)
+		if err != nil {
+			return fmt.Errorf("creating a Google Cloud Storage client: %w", err)
+		}
+		service, err := storage.New(client)
+		if err != nil {
+			return err
+		}
+		if base := gcsAPIBase(a.conf.GSEndpoint); base != defaultGCSAPIBase {
+			service.BasePath = base + "/storage/v1/"
+		}
+		copier = gsCopier{service: service}
+	}
+
+	a.logger.Info("Found %d artifacts. Copying them to: %s", len(artifacts), a.conf.Destination)
+
+	p := pool.New(a.conf.Concurrency)
+	failed := 0
+	for _, artifact := range artifacts {
+		artifact := artifact
+
+		p.Spawn(func() {
+			path := artifactLocalPath(artifact.Path)
+			src := uploadDestinations[artifact]
+			srcKey, dstKey := joinKey(src.Path, path), joinKey(dstPath, path)
+			destination := fmt.Sprintf("%s://%s/%s", scheme, dstBucket, dstKey)
+
+			a.logger.Info("Copying %s to %s", artifact.Path, destination)
+			startedAt := time.Now()
+			err := copier.copy(ctx, src.Bucket, srcKey, dstBucket, dstKey, artifact.FileSize)
+
+			result := ArtifactDownloadResult{
+				ID:              artifact.ID,
+				JobID:           artifact.JobID,
+				Source:          artifactSource(artifact),
+				Path:            artifact.Path,
+				FileSize:        artifact.FileSize,
+				Destination:     destination,
+				Sha1Sum:         artifact.Sha1Sum,
+				Sha256Sum:       artifact.Sha256Sum,
+				DurationSeconds: time.Since(startedAt).Seconds(),
+			}
+			if err != nil {
+				a.logger.Error("Failed to copy %s: %s", artifact.Path, err)
+				result.Error = err.Error()
+			}
+
+			p.Lock()
+			a.results = append(a.results, result)
+			if err != nil {
+				failed++
+			}
+			p.Unlock()
+		})
+	}
+	p.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("There were errors with copying %d of the artifacts", failed)
+	}
+	return nil
+}
+
+// s3Copier copies objects with the client of the destination bucket, whose
+// credentials must be able to read the artifacts
+type s3Copier struct {
+	client *s3.S3
+}
+
+func (c s3Copier) copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, size int64) error {
+	source := (&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()
+
+	var sse *string
+	if strings.EqualFold(os.Getenv("BUILDKITE_S3_SSE_ENABLED"), "true") {
+		sse = aws.String("AES256")
+	}
+
+	if size <= s3MaxCopySize {
+		_, err := c.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:               aws.String(dstBucket),
+			Key:                  aws.String(dstKey),
+			CopySource:           aws.String(source),
+			ServerSideEncryption: sse,
+		})
+		return err
+	}
+
+	upload, err := c.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(dstBucket),
+		Key:                  aws.String(dstKey),
+		ServerSideEncryption: sse,
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for n, offset := int64(1), int64(0); offset < size; n, offset = n+1, offset+s3CopyPartSize {
+		end := offset + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+		res, err := c.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			_, abortErr := c.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dstBucket),
+				Key:      aws.String(dstKey),
+				UploadId: upload.UploadId,
+			})
+			if abortErr != nil {
+				return fmt.Errorf("copying part %d: %w, and then aborting the copy failed: %v", n, err, abortErr)
+			}
+			return fmt.Errorf("copying part %d: %w", n, err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+
+	_, err = c.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// gsCopier copies objects with the rewrite API, which copies large objects
+// in several calls
+type gsCopier struct {
+	service *storage.Service
+}
+
+func (c gsCopier) copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, size int64) error {
+	var token string
+	for {
+		call := c.service.Objects.Rewrite(srcBucket, srcKey, dstBucket, dstKey, &storage.Object{}).Context(ctx)
+		if token != "" {
+			call = call.RewriteToken(token)
+		}
+		res, err := call.Do()
+		if err != nil {
+			return err
+		}
+		if res.Done {
+			return nil
+		}
+		token = res.RewriteToken
+	}
+}
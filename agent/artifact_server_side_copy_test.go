@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerSideDestination(t *testing.T) {
+	t.Parallel()
+
+	for dest, want := range map[string][2]string{
+		"s3://builds":            {"builds", ""},
+		"s3://builds/":           {"builds", ""},
+		"gs://builds/pkg/1/":     {"builds", "pkg/1"},
+		"s3://builds/pkg/1/keep": {"builds", "pkg/1/keep"},
+	} {
+		parsed, err := parseServerSideDestination(dest)
+		assert.NoError(t, err, dest)
+		assert.Equal(t, want, [2]string{parsed.Bucket, parsed.Path}, dest)
+	}
+
+	for _, dest := range []string{"rt://builds/pkg", "s3://", "/tmp/builds"} {
+		_, err := parseServerSideDestination(dest)
+		assert.Error(t, err, dest)
+	}
+
+	assert.Equal(t, "pkg/1/app.tar.gz", joinKey("", "pkg/1/", "/app.tar.gz"))
+}
+
+// artifactSearchServer serves a search that finds artifacts uploaded to
+// uploadDestination
+func artifactSearchServer(t *testing.T, uploadDestination string, paths ...string) APIClient {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/builds/my-build/artifacts/search" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte("["))
+		for i, path := range paths {
+			if i > 0 {
+				rw.Write([]byte(","))
+			}
+			fmt.Fprintf(rw, `{"id": "artifact-%d", "path": %q, "file_size": 8, "upload_destination": %q}`, i, path, uploadDestination)
+		}
+		rw.Write([]byte("]"))
+	}))
+	t.Cleanup(server.Close)
+
+	return api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+}
+
+func TestArtifactDownloaderServerSideCopy(t *testing.T) {
+	server := testutil.NewS3Server("builds", "staging")
+	defer server.Close()
+	for k, v := range server.Env() {
+		t.Setenv(k, v)
+	}
+
+	server.PutObject("builds", "pipeline/1/pkg/app.tar.gz", []byte("alpacas\n"))
+	server.PutObject("builds", "pipeline/1/pkg/lib.tar.gz", []byte("llamas!\n"))
+
+	ac := artifactSearchServer(t, "s3://builds/pipeline/1", "pkg/app.tar.gz", "pkg/lib.tar.gz")
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: "s3://staging/release/",
+		ServerSide:  true,
+	})
+	require.NoError(t, d.Download(context.Background()))
+
+	assert.Equal(t, []string{"release/pkg/app.tar.gz", "release/pkg/lib.tar.gz"}, server.Keys("staging"))
+	obj, ok := server.Object("staging", "release/pkg/app.tar.gz")
+	if assert.True(t, ok) {
+		assert.Equal(t, "alpacas\n", string(obj.Data))
+	}
+	assert.Len(t, d.Results(), 2)
+}
+
+func TestArtifactDownloaderServerSideCopyFromAnotherService(t *testing.T) {
+	t.Parallel()
+
+	ac := artifactSearchServer(t, "gs://builds/pipeline/1", "pkg/app.tar.gz")
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: "s3://staging/release",
+		ServerSide:  true,
+	})
+
+	err := d.Download(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't be copied to s3://staging/release server-side")
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// Signatures are uploaded next to the artifacts they sign, with this added to
+// their paths, as written by cosign sign-blob --output-signature
+const artifactSignatureSuffix = ".sig"
+
+// Artifacts that fail signature verification are moved into this directory
+// of the download destination, rather than being left where they'd be used
+const artifactQuarantineDir = ".buildkite-quarantine"
+
+// ErrArtifactUnverified is wrapped by the errors of artifacts whose signature
+// couldn't be verified
+var ErrArtifactUnverified = errors.New("artifact signature couldn't be verified")
+
+// ArtifactSignatureError is why an artifact's signature couldn't be verified,
+// and where the artifact was quarantined
+type ArtifactSignatureError struct {
+	Path        string
+	Quarantined string
+	Err         error
+}
+
+func (e *ArtifactSignatureError) Error() string {
+	if e.Quarantined == "" {
+		return fmt.Sprintf("verifying the signature of %s: %s", e.Path, e.Err)
+	}
+	return fmt.Sprintf("verifying the signature of %s: %s, so it was quarantined in %s", e.Path, e.Err, e.Quarantined)
+}
+
+func (e *ArtifactSignatureError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ArtifactSignatureError) Is(target error) bool {
+	return target == ErrArtifactUnverified
+}
+
+// loadSignaturePublicKey reads a PEM encoded ECDSA, Ed25519 or RSA public
+// key, as written by cosign generate-key-pair or openssl
+func loadSignaturePublicKey(keyPath string) (crypto.PublicKey, error) {
+	contents, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading signature public key: %w", err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("signature public key %s isn't PEM encoded", keyPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signature public key %s: %w", keyPath, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("signature public key %s is a %T, not an ECDSA, Ed25519 or RSA key", keyPath, key)
+	}
+}
+
+// artifactSignatures are the signatures of the artifacts being downloaded
+type artifactSignatures struct {
+	// Where each signature was downloaded to, by the path of the artifact it
+	// signs
+	paths map[string]string
+
+	// The IDs of the signature artifacts, which aren't signed themselves
+	ids map[string]bool
+}
+
+// isSignature reports whether an artifact is one of the signatures of the
+// others, which isn't signed itself. Anything else with a path like a
+// signature's is still verified, so naming an artifact like one doesn't get
+// it past verification.
+func (s *artifactSignatures) isSignature(artifact *api.Artifact) bool {
+	return artifact.ID != "" && s.ids[artifact.ID] && strings.HasSuffix(artifact.Path, artifactSignatureSuffix)
+}
+
+// downloadSignatures downloads the signatures of the artifacts a query finds,
+// which are found with the same query with the signature suffix added, into
+// a temporary directory. It returns the signatures, and a function to remove
+// them.
+func (a *ArtifactDownloader) downloadSignatures(ctx context.Context, query string) (*artifactSignatures, func(), error) {
+	dir, err := os.MkdirTemp("", "buildkite-artifact-signatures-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// The signatures are downloaded the same way as the artifacts, but without
+	// any of the options for what to do with them
+	conf := a.conf
+	conf.Query = query + artifactSignatureSuffix
+	conf.Destination = dir
+	conf.Include, conf.Exclude, conf.NameTemplate, conf.PathTemplate = "", "", "", ""
+	conf.MaxArtifacts = 0
+	conf.Range = nil
+	conf.Output = nil
+	conf.ServerSide, conf.DryRun, conf.Prefetch, conf.PreserveMetadata = false, false, false, false
+	conf.FailFast, conf.AllowFailures = false, FailureThreshold{}
+	conf.OverwritePolicy = OverwriteAlways
+	conf.SignaturePublicKeyPath = ""
+	conf.Quiet, conf.ProgressInterval = true, 0
+	conf.Observer = ArtifactDownloadObserver{}
+
+	d := NewArtifactDownloader(a.logger, a.apiClient, conf)
+	if err := d.Download(ctx); err != nil && !errors.Is(err, errNoArtifactsFound) {
+		cleanup()
+		return nil, nil, fmt.Errorf("downloading artifact signatures: %w", err)
+	}
+
+	signatures := &artifactSignatures{paths: map[string]string{}, ids: map[string]bool{}}
+	for _, result := range d.Results() {
+		if result.Error == "" {
+			signatures.paths[strings.TrimSuffix(result.Path, artifactSignatureSuffix)] = result.Destination
+			signatures.ids[result.ID] = true
+		}
+	}
+	return signatures, cleanup, nil
+}
+
+// verifySignature checks a downloaded artifact against its signature. If it
+// doesn't match, or has no signature, it's moved into the quarantine
+// directory of the download destination, and an *ArtifactSignatureError is
+// returned.
+func (a *ArtifactDownloader) verifySignature(key crypto.PublicKey, signatures *artifactSignatures, artifact *api.Artifact, targetPath, downloadDestination string) error {
+	var err error
+	if signaturePath, ok := signatures.paths[artifact.Path]; ok {
+		err = verifyFileSignature(key, targetPath, signaturePath)
+	} else {
+		err = fmt.Errorf("no %s signature was uploaded", artifact.Path+artifactSignatureSuffix)
+	}
+	if err == nil {
+		return nil
+	}
+
+	sigErr := &ArtifactSignatureError{Path: artifact.Path, Err: err}
+	quarantined := filepath.Join(downloadDestination, artifactQuarantineDir, artifactLocalPath(artifact.Path))
+	if err := os.MkdirAll(filepath.Dir(quarantined), 0o700); err != nil {
+		os.Remove(targetPath)
+		return sigErr
+	}
+	if err := moveFile(targetPath, quarantined); err != nil {
+		os.Remove(targetPath)
+		return sigErr
+	}
+	sigErr.Quarantined = quarantined
+	return sigErr
+}
+
+// verifyFileSignature checks that a signature of a file, either raw or base64
+// encoded, was made by the private half of key. ECDSA and RSA signatures are
+// of the file's SHA-256.
+func verifyFileSignature(key crypto.PublicKey, path, signaturePath string) error {
+	signature, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Ed25519 signs the message itself, rather than a digest of it
+	if key, ok := key.(ed25519.PublicKey); ok {
+		message, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return errors.New("the signature doesn't match")
+		}
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("the signature doesn't match")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature); err != nil {
+			return errors.New("the signature doesn't match")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	return nil
+}
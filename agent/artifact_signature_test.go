@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactDownloaderVerifySignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+	digest := sha256.Sum256([]byte("OK\n"))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("ecdsa.SignASN1() error = %v", err)
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/my-build/artifacts/search":
+			switch req.URL.Query().Get("query") {
+			case "pkg/*":
+				fmt.Fprintf(rw, `[
+					{"id": "1", "file_size": 3, "path": "pkg/signed.txt", "url": "http://%[1]s/download"},
+					{"id": "2", "file_size": 3, "path": "pkg/unsigned.txt", "url": "http://%[1]s/download"},
+					{"id": "4", "file_size": 3, "path": "pkg/unsigned.sig", "url": "http://%[1]s/download"}
+				]`, req.Host)
+			case "pkg/*.sig":
+				fmt.Fprintf(rw, `[{"id": "3", "file_size": 96, "path": "pkg/signed.txt.sig", "url": "http://%s/signature"}]`, req.Host)
+			default:
+				fmt.Fprint(rw, `[]`)
+			}
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		case "/signature":
+			fmt.Fprint(rw, base64.StdEncoding.EncodeToString(signature))
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	dir := t.TempDir()
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		Query:                  "pkg/*",
+		BuildID:                "my-build",
+		Destination:            dir,
+		SignaturePublicKeyPath: keyPath,
+	})
+	err = d.Download(context.Background())
+
+	// Naming an artifact like a signature doesn't get it past verification
+	var multiErr *ArtifactDownloadMultiError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 2 {
+		t.Fatalf("d.Download() error = %v, want two artifacts to fail", err)
+	}
+	failed := map[string]bool{}
+	for _, got := range multiErr.Errors {
+		if !errors.Is(got, ErrArtifactUnverified) {
+			t.Errorf("d.Download() failed %s with %v, want it to be unverified", got.Path, got.Err)
+		}
+		failed[got.Path] = true
+	}
+	if !failed["pkg/unsigned.txt"] || !failed["pkg/unsigned.sig"] {
+		t.Errorf("d.Download() failed %v, want pkg/unsigned.txt and pkg/unsigned.sig to be unverified", failed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pkg", "unsigned.sig")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(unsigned.sig) error = %v, want it not to exist", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pkg", "signed.txt")); err != nil {
+		t.Errorf("os.Stat(signed.txt) error = %v, want it downloaded", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pkg", "unsigned.txt")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(unsigned.txt) error = %v, want it not to exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, artifactQuarantineDir, "pkg", "unsigned.txt")); err != nil {
+		t.Errorf("os.Stat(quarantined unsigned.txt) error = %v, want it quarantined", err)
+	}
+}
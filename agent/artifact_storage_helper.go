@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// Artifacts can be stored anywhere there's a helper for. An upload
+// destination with a scheme the agent doesn't know, such as myblob://, is
+// handed to a command named for the scheme, such as buildkite-artifact-myblob,
+// found in the PATH. Like git credential helpers, the command is run with
+// the operation as its argument, a storageHelperRequest as JSON on stdin, and
+// prints a storageHelperResponse as JSON. The operations are:
+//
+//   - url: return the URL an artifact will be downloadable from
+//   - upload: upload the artifact from File
+//   - download: download the artifact to File
+const storageHelperPrefix = "buildkite-artifact-"
+
+// The schemes of storage the agent has clients for, which aren't helpers
+var builtinStorageSchemes = map[string]bool{
+	"s3": true, "gs": true, "rt": true, "az": true, "http": true, "https": true,
+}
+
+var storageHelperSchemePattern = regexp.MustCompile(`^([a-z][a-z0-9+.-]*)://`)
+
+// storageHelperRequest is what a storage helper is asked to do
+type storageHelperRequest struct {
+	// The upload destination, such as myblob://bucket/prefix
+	Destination string `json:"destination"`
+
+	// The artifact's path, relative to the destination
+	Path string `json:"path"`
+
+	// The file on disk to upload from or download to
+	File string `json:"file,omitempty"`
+
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// storageHelperResponse is what a storage helper prints
+type storageHelperResponse struct {
+	// For url, where the artifact can be downloaded from
+	URL string `json:"url,omitempty"`
+}
+
+// storageHelperScheme returns the scheme of an upload destination, if it's
+// one that's handled by a helper
+func storageHelperScheme(destination string) (string, bool) {
+	match := storageHelperSchemePattern.FindStringSubmatch(destination)
+	if match == nil || builtinStorageSchemes[match[1]] {
+		return "", false
+	}
+	return match[1], true
+}
+
+func isStorageHelperDestination(destination string) bool {
+	_, ok := storageHelperScheme(destination)
+	return ok
+}
+
+// storageHelper runs the helper for a scheme
+type storageHelper struct {
+	scheme string
+	path   string
+}
+
+func newStorageHelper(scheme string) (*storageHelper, error) {
+	path, err := exec.LookPath(storageHelperPrefix + scheme)
+	if err != nil {
+		return nil, fmt.Errorf("there's no %s%s in the PATH to store %s:// artifacts with: %w", storageHelperPrefix, scheme, scheme, err)
+	}
+	return &storageHelper{scheme: scheme, path: path}, nil
+}
+
+func (h *storageHelper) run(ctx context.Context, operation string, req storageHelperRequest) (*storageHelperResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.path, operation)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("storage helper %s %s failed: %w: %s", h.path, operation, err, msg)
+		}
+		return nil, fmt.Errorf("storage helper %s %s failed: %w", h.path, operation, err)
+	}
+
+	var resp storageHelperResponse
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return nil, fmt.Errorf("parsing the output of storage helper %s %s: %w", h.path, operation, err)
+		}
+	}
+	return &resp, nil
+}
+
+// StorageHelperUploader uploads artifacts with a storage helper
+type StorageHelperUploader struct {
+	destination string
+	helper      *storageHelper
+	logger      logger.Logger
+}
+
+func NewStorageHelperUploader(l logger.Logger, destination string) (*StorageHelperUploader, error) {
+	scheme, ok := storageHelperScheme(destination)
+	if !ok {
+		return nil, fmt.Errorf("%q isn't a destination for a storage helper", destination)
+	}
+	helper, err := newStorageHelper(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageHelperUploader{destination: destination, helper: helper, logger: l}, nil
+}
+
+func (u *StorageHelperUploader) URL(artifact *api.Artifact) string {
+	resp, err := u.helper.run(context.Background(), "url", storageHelperRequest{
+		Destination: u.destination,
+		Path:        artifact.Path,
+	})
+	if err != nil {
+		u.logger.Warn("%s", err)
+		return ""
+	}
+	return resp.URL
+}
+
+func (u *StorageHelperUploader) Upload(artifact *api.Artifact) error {
+	u.logger.Debug("Uploading %s with %s", artifact.Path, u.helper.path)
+	_, err := u.helper.run(context.Background(), "upload", storageHelperRequest{
+		Destination: u.destination,
+		Path:        artifact.Path,
+		File:        artifact.AbsolutePath,
+		ContentType: artifact.ContentType,
+		Size:        artifact.FileSize,
+	})
+	return err
+}
+
+type StorageHelperDownloaderConfig struct {
+	// The upload destination the artifact was uploaded to
+	UploadDestination string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder
+	Path string
+
+	// Permissions to create missing destination directories with
+	DirPermissions os.FileMode
+
+	// The size of the file, which is reported as progress once it's
+	// downloaded
+	Size int64
+
+	// If set, it's called with the number of bytes downloaded
+	Progress func(int64)
+}
+
+// StorageHelperDownloader downloads an artifact with a storage helper
+type StorageHelperDownloader struct {
+	conf   StorageHelperDownloaderConfig
+	logger logger.Logger
+}
+
+func NewStorageHelperDownloader(l logger.Logger, c StorageHelperDownloaderConfig) StorageHelperDownloader {
+	return StorageHelperDownloader{conf: c, logger: l}
+}
+
+func (d StorageHelperDownloader) Start(ctx context.Context) error {
+	scheme, ok := storageHelperScheme(d.conf.UploadDestination)
+	if !ok {
+		return fmt.Errorf("%q isn't a destination for a storage helper", d.conf.UploadDestination)
+	}
+	helper, err := newStorageHelper(scheme)
+	if err != nil {
+		return err
+	}
+
+	targetPath := getTargetPath(d.conf.Path, d.conf.Destination)
+	if err := downloadDirs.MkdirAll(filepath.Dir(targetPath), d.conf.DirPermissions); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", targetPath, err)
+	}
+
+	d.logger.Info("Downloading %s with %s", d.conf.Path, helper.path)
+	if _, err := helper.run(ctx, "download", storageHelperRequest{
+		Destination: d.conf.UploadDestination,
+		Path:        d.conf.Path,
+		File:        targetPath,
+		Size:        d.conf.Size,
+	}); err != nil {
+		return err
+	}
+
+	if d.conf.Progress != nil {
+		d.conf.Progress(d.conf.Size)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestStorageHelperScheme(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"myblob://bucket/prefix": "myblob",
+		"s3://bucket":            "",
+		"https://example.com":    "",
+		"":                       "",
+		"not a destination":      "",
+	}
+	for destination, want := range tests {
+		got, ok := storageHelperScheme(destination)
+		if got != want || ok != (want != "") {
+			t.Errorf("storageHelperScheme(%q) = (%q, %t), want %q", destination, got, ok, want)
+		}
+	}
+}
+
+// The helper stores artifacts as files in a directory, and reads its
+// requests with sed, which is enough for the tests
+const testStorageHelper = `#!/bin/sh
+req=$(cat)
+field() { printf '%s' "$req" | sed -n "s/.*\"$1\":\"\([^\"]*\)\".*/\1/p"; }
+case "$1" in
+url) echo "{\"url\":\"https://blobs.example.com/$(field path)\"}" ;;
+upload) cp "$(field file)" "$STORE/$(field path)" ;;
+download) cp "$STORE/$(field path)" "$(field file)" ;;
+*) echo "unknown operation $1" >&2; exit 1 ;;
+esac
+`
+
+func TestStorageHelperUploadAndDownload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test helper is a shell script")
+	}
+
+	binDir, store, work := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "buildkite-artifact-myblob"), []byte(testStorageHelper), 0o755); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("STORE", store)
+
+	source := filepath.Join(work, "llamas.txt")
+	if err := os.WriteFile(source, []byte("llamas"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: source, FileSize: 6}
+
+	uploader, err := NewStorageHelperUploader(logger.Discard, "myblob://bucket")
+	if err != nil {
+		t.Fatalf("NewStorageHelperUploader() error = %v", err)
+	}
+	if got, want := uploader.URL(artifact), "https://blobs.example.com/llamas.txt"; got != want {
+		t.Errorf("uploader.URL() = %q, want %q", got, want)
+	}
+	if err := uploader.Upload(artifact); err != nil {
+		t.Fatalf("uploader.Upload() error = %v", err)
+	}
+
+	var progress int64
+	downloads := filepath.Join(work, "downloads")
+	err = NewStorageHelperDownloader(logger.Discard, StorageHelperDownloaderConfig{
+		UploadDestination: "myblob://bucket",
+		Path:              "llamas.txt",
+		Destination:       downloads,
+		Size:              6,
+		Progress:          func(n int64) { progress += n },
+	}).Start(context.Background())
+	if err != nil {
+		t.Fatalf("StorageHelperDownloader.Start() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(downloads, "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "llamas" {
+		t.Errorf("downloaded %q, want %q", got, "llamas")
+	}
+	if progress != 6 {
+		t.Errorf("progress = %d, want 6", progress)
+	}
+}
+
+func TestStorageHelperMissing(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewStorageHelperUploader(logger.Discard, "nosuchhelper://bucket"); err == nil {
+		t.Errorf("NewStorageHelperUploader() error = nil, want an error about the missing helper")
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// ArtifactTransfersDirEnv is the environment variable that points a job's
+// artifact commands at the directory they mark themselves as transferring
+// in, so the agent can report that the job is uploading or downloading
+// artifacts
+const ArtifactTransfersDirEnv = "BUILDKITE_ARTIFACT_TRANSFERS_DIR"
+
+// MarkArtifactTransfer marks the artifact command running in this process as
+// transferring, until the func it returns is called. The mark is a file that
+// the command holds a lock on, so one left behind by a command that was
+// killed isn't mistaken for a transfer. It does nothing if dir is empty.
+func MarkArtifactTransfer(dir string) (func(), error) {
+	if dir == "" {
+		return func() {}, nil
+	}
+
+	lock := flock.New(filepath.Join(dir, fmt.Sprintf("%d.lock", os.Getpid())))
+	if err := lock.Lock(); err != nil {
+		return func() {}, fmt.Errorf("marking artifact transfer: %w", err)
+	}
+	return func() {
+		lock.Unlock()
+		os.Remove(lock.Path())
+	}, nil
+}
+
+// artifactTransferring reports whether any command has marked itself as
+// transferring artifacts in dir. Marks left by commands that have exited are
+// removed.
+func artifactTransferring(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	transferring := false
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+		lock := flock.New(filepath.Join(dir, entry.Name()))
+		locked, err := lock.TryLock()
+		if err != nil {
+			continue
+		}
+		if !locked {
+			transferring = true
+			continue
+		}
+		lock.Unlock()
+		os.Remove(lock.Path())
+	}
+	return transferring
+}
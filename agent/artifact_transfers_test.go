@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactTransferring(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	assert.False(t, artifactTransferring(dir))
+
+	unmark, err := MarkArtifactTransfer(dir)
+	require.NoError(t, err)
+	assert.True(t, artifactTransferring(dir))
+
+	unmark()
+	assert.False(t, artifactTransferring(dir))
+
+	// A mark that isn't locked was left by a command that exited
+	stale := filepath.Join(dir, "12345.lock")
+	require.NoError(t, os.WriteFile(stale, nil, 0o600))
+	assert.False(t, artifactTransferring(dir))
+	assert.NoFileExists(t, stale)
+}
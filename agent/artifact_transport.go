@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/buildkite/agent/v3/storageproxy"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// TransportConfig is how artifacts are downloaded through a proxy, and how the
+// certificates of the servers they're downloaded from are verified, such as
+// for agents behind a corporate proxy that intercepts TLS. It applies to
+// downloads over HTTP, and to the S3, Google Cloud Storage and Artifactory
+// clients.
+type TransportConfig struct {
+	// A file of PEM encoded CA certificates to trust, as well as the
+	// system's, such as for an Artifactory server with an internal CA
+	CACertFile string
+
+	// If set, servers' certificates aren't verified at all. It's only for a
+	// server with a self-signed certificate that can't be given as a CA
+	InsecureSkipVerify bool
+
+	// The oldest version of TLS to connect with, such as tls.VersionTLS12. If
+	// zero, it's Go's default
+	MinTLSVersion uint16
+
+	// The URL of a proxy to download through. If empty, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used
+	Proxy string
+
+	// Hosts that aren't downloaded from through a proxy, in the same format
+	// as NO_PROXY, which it's used instead of
+	NoProxy string
+}
+
+// ParseTLSVersion parses a TLS version such as 1.2
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// apply configures t's proxy and TLS. An explicit proxy takes precedence over
+// a SOCKS5 proxy or SSH tunnel for artifact storage, which t should already
+// be routed through.
+func (c TransportConfig) apply(t *http.Transport) error {
+	if c.CACertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return fmt.Errorf("reading CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM encoded certificates were found in %s", c.CACertFile)
+		}
+		t.TLSClientConfig = tlsConfig(t)
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if c.InsecureSkipVerify {
+		t.TLSClientConfig = tlsConfig(t)
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if c.MinTLSVersion != 0 {
+		t.TLSClientConfig = tlsConfig(t)
+		t.TLSClientConfig.MinVersion = c.MinTLSVersion
+	}
+
+	switch {
+	case c.Proxy != "":
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return fmt.Errorf("parsing proxy URL: %w", err)
+		}
+		if proxy.Scheme == "" || proxy.Host == "" {
+			return errors.New("the proxy must be a URL such as http://proxy.internal:3128")
+		}
+		if c.NoProxy == "" {
+			t.Proxy = http.ProxyURL(proxy)
+			break
+		}
+		t.Proxy = proxyFunc(&httpproxy.Config{
+			HTTPProxy:  c.Proxy,
+			HTTPSProxy: c.Proxy,
+			NoProxy:    c.NoProxy,
+		})
+	case c.NoProxy != "":
+		// Storage that's routed through a SOCKS5 proxy or SSH tunnel doesn't
+		// use the environment's proxies anyway
+		if conf, err := storageproxy.Check(); err != nil || conf.Enabled() {
+			break
+		}
+		env := httpproxy.FromEnvironment()
+		env.NoProxy = c.NoProxy
+		t.Proxy = proxyFunc(env)
+	}
+	return nil
+}
+
+// client returns a client for artifact storage, such as for the S3 and Google
+// Cloud Storage clients, that's configured by c
+func (c TransportConfig) client() (*http.Client, error) {
+	t := storageproxy.Transport(http.DefaultTransport.(*http.Transport).Clone())
+	if err := c.apply(t); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// tlsConfig returns t's TLS config, making one if it doesn't have one
+func tlsConfig(t *http.Transport) *tls.Config {
+	if t.TLSClientConfig == nil {
+		return &tls.Config{}
+	}
+	return t.TLSClientConfig
+}
+
+// proxyFunc adapts an httpproxy config for an http.Transport
+func proxyFunc(c *httpproxy.Config) func(*http.Request) (*url.URL, error) {
+	proxy := c.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	for version, want := range map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		if got, err := ParseTLSVersion(version); err != nil || got != want {
+			t.Errorf("ParseTLSVersion(%q) = (%d, %v), want %d", version, got, err, want)
+		}
+	}
+	for _, version := range []string{"", "1.4", "TLS1.2"} {
+		if _, err := ParseTLSVersion(version); err == nil {
+			t.Errorf("ParseTLSVersion(%q) error = nil, want an error", version)
+		}
+	}
+}
+
+func TestTransportConfigTLS(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "OK")
+	}))
+	defer server.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCert, certPEM, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	client, err := TransportConfig{CACertFile: caCert, MinTLSVersion: tls.VersionTLS13}.client()
+	if err != nil {
+		t.Fatalf("TransportConfig.client() error = %v", err)
+	}
+	if got := client.Transport.(*http.Transport).TLSClientConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %d, want %d", got, tls.VersionTLS13)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("client.Get() error = %v, want the server's certificate trusted", err)
+	}
+	resp.Body.Close()
+
+	// Without the CA, the server's certificate isn't trusted
+	client, err = TransportConfig{}.client()
+	if err != nil {
+		t.Fatalf("TransportConfig.client() error = %v", err)
+	}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("client.Get() error = nil, want the server's certificate to be untrusted")
+	}
+}
+
+func TestTransportConfigNoProxy(t *testing.T) {
+	t.Parallel()
+
+	transport := &http.Transport{}
+	err := TransportConfig{
+		Proxy:   "http://proxy.internal:3128",
+		NoProxy: "artifacts.internal,10.0.0.0/8",
+	}.apply(transport)
+	if err != nil {
+		t.Fatalf("TransportConfig.apply() error = %v", err)
+	}
+
+	for target, want := range map[string]string{
+		"https://s3.amazonaws.com/bucket/llamas.txt":    "http://proxy.internal:3128",
+		"https://artifacts.internal/llamas.txt":         "",
+		"https://cache.artifacts.internal/llamas.txt":   "",
+		"http://10.1.2.3/llamas.txt":                    "",
+		"https://storage.googleapis.com/b/llamas.txt":   "http://proxy.internal:3128",
+		"https://artifactory.example.com/llamas.tar.gz": "http://proxy.internal:3128",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		proxy, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatalf("Proxy(%s) error = %v", target, err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != want {
+			t.Errorf("Proxy(%s) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestArtifactDownloaderInvalidTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to %s, want the download to fail first", req.URL.Path)
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: t.TempDir(),
+		Transport:   TransportConfig{CACertFile: "/does/not/exist.pem"},
+	})
+	if err := d.Download(context.Background()); err == nil {
+		t.Errorf("d.Download() with a missing CA file = nil, want an error")
+	}
+}
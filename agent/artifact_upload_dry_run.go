@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/dustin/go-humanize"
+)
+
+// ArtifactUploadPlan is what a dry run of an upload found it would upload,
+// and where to
+type ArtifactUploadPlan struct {
+	Path         string `json:"path"`
+	AbsolutePath string `json:"absolute_path"`
+	GlobPath     string `json:"glob_path"`
+	FileSize     int64  `json:"file_size"`
+	Sha1Sum      string `json:"sha1sum"`
+	Sha256Sum    string `json:"sha256sum"`
+	ContentType  string `json:"content_type"`
+
+	// The storage backend it would be uploaded to, such as s3 or buildkite
+	Backend string `json:"backend"`
+
+	// Where in the backend it would be uploaded to, or empty for Buildkite's
+	// artifact storage
+	Destination string `json:"destination,omitempty"`
+}
+
+// dryRun logs what each artifact would be uploaded as, and where to, without
+// uploading anything. The plan is kept, so it can be printed with --format
+// json.
+func (a *ArtifactUploader) dryRun(artifacts []*api.Artifact) {
+	backend := artifactBackend(a.conf.Destination)
+
+	var totalBytes int64
+	a.plan = make([]ArtifactUploadPlan, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		plan := ArtifactUploadPlan{
+			Path:         artifact.Path,
+			AbsolutePath: artifact.AbsolutePath,
+			GlobPath:     artifact.GlobPath,
+			FileSize:     artifact.FileSize,
+			Sha1Sum:      artifact.Sha1Sum,
+			Sha256Sum:    artifact.Sha256Sum,
+			ContentType:  artifact.ContentType,
+			Backend:      backend,
+		}
+		if a.conf.Destination != "" {
+			plan.Destination = strings.TrimSuffix(a.conf.Destination, "/") + "/" + artifact.Path
+		}
+		a.plan = append(a.plan, plan)
+		totalBytes += artifact.FileSize
+
+		where := plan.Destination
+		if where == "" {
+			where = "Buildkite artifact storage"
+		}
+		a.logger.Info("%s (%s, sha256 %s) would be uploaded to %s", artifact.Path, humanize.IBytes(uint64(artifact.FileSize)), artifact.Sha256Sum, where)
+	}
+
+	a.logger.Info("Dry run: %d artifacts, %s, would be uploaded to %s", len(artifacts), humanize.IBytes(uint64(totalBytes)), backend)
+}
+
+// DryRunPlan returns what a dry run found it would upload, once Upload has
+// returned
+func (a *ArtifactUploader) DryRunPlan() []ArtifactUploadPlan {
+	return a.plan
+}
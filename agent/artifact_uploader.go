@@ -4,24 +4,24 @@ import (
 	"context"
 	"crypto/sha1"
 	"crypto/sha256"
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/mime"
 	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/buildkite/agent/v3/usage"
 	"github.com/buildkite/roko"
 	"github.com/dustin/go-humanize"
-	zglob "github.com/mattn/go-zglob"
 )
 
 const (
@@ -33,12 +33,21 @@ type ArtifactUploaderConfig struct {
 	// The ID of the Job
 	JobID string
 
+	// The label and key of the job's step, which are recorded with the
+	// artifacts so downloads can lay them out by job
+	JobName, StepKey string
+
 	// The path of the uploads
 	Paths string
 
 	// Where we'll be uploading artifacts
 	Destination string
 
+	// Where artifacts go instead of Buildkite's artifact storage when there's
+	// no Destination, such as an organisation's own S3 bucket. They're put
+	// under the job's ID, so jobs don't overwrite each other's
+	DefaultDestination string
+
 	// A specific Content-Type to use for all artifacts
 	ContentType string
 
@@ -47,6 +56,54 @@ type ArtifactUploaderConfig struct {
 
 	// Whether to follow symbolic links when resolving globs
 	FollowSymlinks bool
+
+	// Gitignore-style patterns for paths that shouldn't be uploaded, even if
+	// they match Paths
+	IgnorePaths string
+
+	// Rules for post-processing artifacts before they're uploaded, such as
+	// "*.log=gzip;dist/**/*=checksum,sign"
+	PostProcessors string
+
+	// The Ed25519 private key used by the sign post-processor
+	SigningKeyPath string
+
+	// An earlier build whose chunks the chunk post-processor doesn't upload
+	// again, such as the last build of the branch
+	ChunkBaseBuild string
+
+	// A 256 bit AES key to encrypt artifacts with before they're uploaded,
+	// after they're post-processed. If empty, they aren't encrypted
+	EncryptionKeyPath string
+
+	// A text/template that artifacts are named with, such as
+	// "{{.Path}}-{{.Os}}-{{.Arch}}". If empty, they're named after their paths
+	NameTemplate string
+
+	// How many artifacts can fail to upload without the upload failing. The
+	// failures are still logged
+	AllowFailures FailureThreshold
+
+	// Backends to upload artifacts to destinations with these schemes, such
+	// as "s3", with, instead of the built in uploaders. They're given the
+	// URL of the artifact in the destination, such as
+	// s3://bucket/prefix/path/to/artifact
+	Backends map[string]transfer.Backend
+
+	// Where to send transfer metrics. If nil, no metrics are sent
+	Metrics *metrics.Scope
+
+	// Where to record the data transferred. If nil, nothing is recorded
+	Usage *usage.Recorder
+
+	// Where artifact states that couldn't be sent to the API are saved, for
+	// the job runner to try again before the job finishes. If empty, they
+	// aren't
+	PendingWritesDir string
+
+	// If set, the artifacts are collected, post-processed and checksummed,
+	// and what would be uploaded where is logged, but nothing is uploaded
+	DryRun bool
 }
 
 type ArtifactUploader struct {
@@ -58,9 +115,19 @@ type ArtifactUploader struct {
 
 	// The APIClient that will be used when uploading jobs
 	apiClient APIClient
+
+	// What a dry run would have uploaded
+	plan []ArtifactUploadPlan
 }
 
 func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig) *ArtifactUploader {
+	if c.Metrics == nil {
+		c.Metrics = metrics.NewCollector(l, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+	}
+	if c.Destination == "" && c.DefaultDestination != "" {
+		c.Destination = strings.TrimSuffix(c.DefaultDestination, "/") + "/" + c.JobID
+	}
+
 	return &ArtifactUploader{
 		logger:    l,
 		apiClient: ac,
@@ -69,6 +136,14 @@ func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig
 }
 
 func (a *ArtifactUploader) Upload(ctx context.Context) error {
+	var names *artifactNameTemplate
+	if a.conf.NameTemplate != "" {
+		var err error
+		if names, err = newArtifactNameTemplate(a.conf.NameTemplate); err != nil {
+			return err
+		}
+	}
+
 	// Create artifact structs for all the files we need to upload
 	artifacts, err := a.Collect()
 	if err != nil {
@@ -81,6 +156,30 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	}
 
 	a.logger.Info("Found %d files that match %q", len(artifacts), a.conf.Paths)
+
+	artifacts, cleanup, err := a.postProcess(ctx, artifacts)
+	if err != nil {
+		return fmt.Errorf("post-processing artifacts: %w", err)
+	}
+	defer cleanup()
+
+	artifacts, cleanupEncrypted, err := a.encrypt(artifacts)
+	if err != nil {
+		return fmt.Errorf("encrypting artifacts: %w", err)
+	}
+	defer cleanupEncrypted()
+
+	if names != nil {
+		if err := names.rename(artifacts); err != nil {
+			return fmt.Errorf("naming artifacts: %w", err)
+		}
+	}
+
+	if a.conf.DryRun {
+		a.dryRun(artifacts)
+		return nil
+	}
+
 	if err := a.upload(ctx, artifacts); err != nil {
 		return fmt.Errorf("uploading artifacts: %w", err)
 	}
@@ -88,6 +187,25 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	return nil
 }
 
+// artifactBackend returns the name of the storage backend for an upload
+// destination, for use as a metrics tag
+func artifactBackend(destination string) string {
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		return "s3"
+	case strings.HasPrefix(destination, "gs://"):
+		return "gs"
+	case strings.HasPrefix(destination, "rt://"):
+		return "artifactory"
+	case strings.HasPrefix(destination, "az://"):
+		return "azure"
+	}
+	if scheme, ok := storageHelperScheme(destination); ok {
+		return scheme
+	}
+	return "buildkite"
+}
+
 func isDir(path string) bool {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -102,86 +220,20 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 		return nil, fmt.Errorf("getting working directory: %w", err)
 	}
 
-	// file paths are deduplicated after resolving globs etc
-	seenPaths := make(map[string]bool)
-
-	for _, globPath := range strings.Split(a.conf.Paths, ArtifactPathDelimiter) {
-		globPath = strings.TrimSpace(globPath)
-		if globPath == "" {
-			continue
-		}
-
-		a.logger.Debug("Searching for %s", globPath)
-
-		// Resolve the globs (with * and ** in them), if it's a non-globbed path and doesn't exists
-		// then we will get the ErrNotExist that is handled below
-		globfunc := zglob.Glob
-		if a.conf.FollowSymlinks {
-			// Follow symbolic links for files & directories while expanding globs
-			globfunc = zglob.GlobFollowSymlinks
-		}
-		files, err := globfunc(globPath)
-		if errors.Is(err, os.ErrNotExist) {
-			a.logger.Info("File not found: %s", globPath)
-			continue
-		} else if err != nil {
-			return nil, fmt.Errorf("resolving glob: %w", err)
-		}
-
-		// Process each glob match into an api.Artifact
-		for _, file := range files {
-			absolutePath, err := filepath.Abs(file)
-			if err != nil {
-				return nil, fmt.Errorf("resolving absolute path for file %s: %w", file, err)
-			}
-
-			// dedupe based on resolved absolutePath
-			if _, ok := seenPaths[absolutePath]; ok {
-				a.logger.Debug("Skipping duplicate path %s", file)
-				continue
-			}
-			seenPaths[absolutePath] = true
-
-			// Ignore directories, we only want files
-			if isDir(absolutePath) {
-				a.logger.Debug("Skipping directory %s", file)
-				continue
-			}
-
-			// If a glob is absolute, we need to make it relative to the root so that
-			// it can be combined with the download destination to make a valid path.
-			// This is possibly weird and crazy, this logic dates back to
-			// https://github.com/buildkite/agent/commit/8ae46d975aa60d1ae0e2cc0bff7a43d3bf960935
-			// from 2014, so I'm replicating it here to avoid breaking things
-			if filepath.IsAbs(globPath) {
-				if runtime.GOOS == "windows" {
-					wd = filepath.VolumeName(absolutePath) + "/"
-				} else {
-					wd = "/"
-				}
-			}
-
-			path, err := filepath.Rel(wd, absolutePath)
-			if err != nil {
-				return nil, fmt.Errorf("resolving relative path for file %s: %w", file, err)
-			}
-
-			if experiments.IsEnabled("normalised-upload-paths") {
-				// Convert any Windows paths to Unix/URI form
-				path = filepath.ToSlash(path)
-			}
-
-			// Build an artifact object using the paths we have.
-			artifact, err := a.build(path, absolutePath, globPath)
-			if err != nil {
-				return nil, fmt.Errorf("building artifact: %w", err)
-			}
+	ignore, err := newIgnoreMatcher(a.conf.IgnorePaths)
+	if err != nil {
+		return nil, err
+	}
 
-			artifacts = append(artifacts, artifact)
-		}
+	c := &artifactCollector{
+		uploader: a,
+		ignore:   ignore,
+		wd:       wd,
+		// file paths are deduplicated after resolving globs etc
+		seenPaths: make(map[string]bool),
 	}
 
-	return artifacts, nil
+	return c.collect()
 }
 
 func (a *ArtifactUploader) build(path string, absolutePath string, globPath string) (*api.Artifact, error) {
@@ -216,15 +268,22 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		}
 	}
 
+	// Record its mode and modification time, so downloads can restore them
+	modifiedAt := fileInfo.ModTime().UTC()
+
 	// Create our new artifact data structure
 	artifact := &api.Artifact{
-		Path:         path,
-		AbsolutePath: absolutePath,
-		GlobPath:     globPath,
-		FileSize:     fileInfo.Size(),
-		Sha1Sum:      sha1sum,
-		Sha256Sum:    sha256sum,
-		ContentType:  contentType,
+		Path:           path,
+		AbsolutePath:   absolutePath,
+		GlobPath:       globPath,
+		FileSize:       fileInfo.Size(),
+		Sha1Sum:        sha1sum,
+		Sha256Sum:      sha256sum,
+		FileMode:       uint32(fileInfo.Mode().Perm()),
+		FileModifiedAt: &modifiedAt,
+		JobName:        a.conf.JobName,
+		StepKey:        a.conf.StepKey,
+		ContentType:    contentType,
 	}
 
 	return artifact, nil
@@ -236,7 +295,9 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 
 	// Determine what uploader to use
 	if a.conf.Destination != "" {
-		if strings.HasPrefix(a.conf.Destination, "s3://") {
+		if backend := backendFor(a.conf.Backends, a.conf.Destination); backend != nil {
+			uploader = NewBackendUploader(a.logger, backend, a.conf.Destination)
+		} else if strings.HasPrefix(a.conf.Destination, "s3://") {
 			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
 				Destination: a.conf.Destination,
 				DebugHTTP:   a.conf.DebugHTTP,
@@ -251,8 +312,15 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 				Destination: a.conf.Destination,
 				DebugHTTP:   a.conf.DebugHTTP,
 			})
+		} else if strings.HasPrefix(a.conf.Destination, "az://") {
+			uploader, err = NewAzureBlobUploader(a.logger, AzureBlobUploaderConfig{
+				Destination: a.conf.Destination,
+				DebugHTTP:   a.conf.DebugHTTP,
+			})
+		} else if _, ok := storageHelperScheme(a.conf.Destination); ok {
+			uploader, err = NewStorageHelperUploader(a.logger, a.conf.Destination)
 		} else {
-			return fmt.Errorf("invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload schemes are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination)
+			return fmt.Errorf("invalid upload destination: '%v'. Only s3://, gs://, rt:// or az:// upload schemes, or schemes with a %s<scheme> helper, are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination, storageHelperPrefix)
 		}
 
 		a.logger.Info("Uploading to %q, using your agent configuration", a.conf.Destination)
@@ -269,6 +337,10 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 		return fmt.Errorf("creating uploader: %v", err)
 	}
 
+	uploadMetrics := a.conf.Metrics.With(metrics.Tags{
+		"backend": artifactBackend(a.conf.Destination),
+	})
+
 	// Set the URLs of the artifacts based on the uploader
 	for _, artifact := range artifacts {
 		artifact.URL = uploader.URL(artifact)
@@ -292,6 +364,10 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	errors := []error{}
 	var errorsMutex sync.Mutex
 
+	// The artifacts that failed to upload, and why, which may be allowed
+	uploadFailures := []string{}
+	uploadErrors := []error{}
+
 	// Create a wait group so we can make sure the uploader waits for all
 	// the artifact states to upload before finishing
 	var stateUploaderWaitGroup sync.WaitGroup
@@ -334,7 +410,7 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 					// Meanwhile, 8 roko.Exponential(2sec) attempts is 1,2,4,8,16,32,64 seconds delay (~2 mins)
 					roko.WithMaxAttempts(8),
 					roko.WithStrategy(roko.Exponential(2*time.Second, 0)),
-				).DoWithContext(ctx, func(r *roko.Retrier) error {
+				).DoWithContext(ctx, retrylog.Wrap("Updating artifact states", func(r *roko.Retrier) error {
 					ctxShort, cancel := context.WithTimeout(ctx, 5*time.Second)
 					defer cancel()
 					if _, err := a.apiClient.UpdateArtifacts(ctxShort, a.conf.JobID, statesToUpload); err != nil {
@@ -342,7 +418,13 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 						return err
 					}
 					return nil
-				})
+				}))
+				if deferred, deferErr := DeferWrite(a.conf.PendingWritesDir, err, PendingWrite{JobID: a.conf.JobID, ArtifactStates: statesToUpload}); deferred {
+					a.logger.Warn("Error uploading artifact states, they will be tried again before the job finishes: %s", err)
+					err = nil
+				} else if deferErr != nil {
+					a.logger.Warn("Failed to save artifact states to try again later: %s", deferErr)
+				}
 				if err != nil {
 					a.logger.Error("Error uploading artifact states: %s", err)
 
@@ -378,16 +460,30 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 			// Upload the artifact and then set the state depending
 			// on whether or not it passed. We'll retry the upload
 			// a couple of times before giving up.
-			err := roko.NewRetrier(
+			startedAt := time.Now()
+			r := roko.NewRetrier(
 				roko.WithMaxAttempts(10),
 				roko.WithStrategy(roko.Constant(5*time.Second)),
-			).DoWithContext(ctx, func(r *roko.Retrier) error {
+			)
+			err := r.DoWithContext(ctx, retrylog.Wrap("Uploading artifact", func(r *roko.Retrier) error {
 				if err := uploader.Upload(artifact); err != nil {
 					a.logger.Warn("%s (%s)", err, r)
 					return err
 				}
 				return nil
-			})
+			}))
+
+			uploadMetrics.Timing("artifacts.upload.duration", time.Since(startedAt))
+			// AttemptCount counts failed attempts, and the last one
+			// isn't retried when the upload gives up
+			retries := r.AttemptCount()
+			if err != nil {
+				retries--
+			}
+			if retries > 0 {
+				uploadMetrics.Count("artifacts.upload.retries", int64(retries))
+			}
+
 			// Did the upload eventually fail?
 			if err != nil {
 				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
@@ -396,12 +492,17 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 				// acquire a lock since we mutate the errors
 				// slice in multiple routines.
 				errorsMutex.Lock()
-				errors = append(errors, err)
+				uploadFailures = append(uploadFailures, artifact.Path)
+				uploadErrors = append(uploadErrors, err)
 				errorsMutex.Unlock()
 
+				uploadMetrics.Count("artifacts.upload.failed", 1)
 				state = "error"
 			} else {
 				a.logger.Info("Successfully uploaded artifact \"%s\"", artifact.Path)
+				uploadMetrics.Count("artifacts.upload.success", 1)
+				uploadMetrics.Count("artifacts.upload.bytes", artifact.FileSize)
+				a.conf.Usage.Add(usage.ArtifactUpload, artifact.FileSize)
 				state = "finished"
 			}
 
@@ -424,10 +525,20 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	// Wait for the statuses to finish uploading
 	stateUploaderWaitGroup.Wait()
 
+	if !a.conf.AllowFailures.Allows(len(uploadFailures), len(artifacts)) {
+		errors = append(errors, uploadErrors...)
+	}
+
 	if len(errors) > 0 {
 		return fmt.Errorf("errors uploading artifacts: %v", errors)
 	}
 
+	if len(uploadFailures) > 0 {
+		a.logger.Warn("%d of %d artifacts failed to upload, which is within the %s allowed to fail: %s",
+			len(uploadFailures), len(artifacts), a.conf.AllowFailures, strings.Join(uploadFailures, ", "))
+		return nil
+	}
+
 	a.logger.Info("Artifact uploads completed successfully")
 
 	return nil
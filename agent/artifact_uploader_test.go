@@ -1,6 +1,9 @@
 package agent
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -308,3 +311,222 @@ func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 		paths,
 	)
 }
+
+func TestArtifactBackend(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		destination, want string
+	}{
+		{"", "buildkite"},
+		{"s3://my-bucket/path", "s3"},
+		{"gs://my-bucket/path", "gs"},
+		{"rt://my-repo/path", "artifactory"},
+	} {
+		if got := artifactBackend(tc.destination); got != tc.want {
+			t.Errorf("artifactBackend(%q) = %q, want %q", tc.destination, got, tc.want)
+		}
+	}
+}
+
+func TestArtifactUploaderDefaultDestination(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		destination, defaultDestination, want string
+	}{
+		{"", "", ""},
+		{"", "s3://my-artifacts/buildkite/", "s3://my-artifacts/buildkite/my-job"},
+		{"", "s3://my-artifacts", "s3://my-artifacts/my-job"},
+		{"gs://my-bucket/path", "s3://my-artifacts/buildkite", "gs://my-bucket/path"},
+	} {
+		uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+			JobID:              "my-job",
+			Destination:        tc.destination,
+			DefaultDestination: tc.defaultDestination,
+		})
+		if got := uploader.conf.Destination; got != tc.want {
+			t.Errorf("NewArtifactUploader(Destination: %q, DefaultDestination: %q) destination = %q, want %q", tc.destination, tc.defaultDestination, got, tc.want)
+		}
+	}
+}
+
+func TestCollectWithIgnorePaths(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	for _, file := range []string{
+		"a.log",
+		"b.tmp",
+		filepath.Join("node_modules", "dep", "c.log"),
+		filepath.Join("sub", "d.log"),
+		filepath.Join("sub", "build", "e.log"),
+		filepath.Join("other", "build", "f.log"),
+	} {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0o666); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:       filepath.Join(root, "**", "*"),
+		IgnorePaths: "node_modules/;*.tmp;" + filepath.ToSlash(filepath.Join(root, "sub", "build")) + "/",
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatalf("uploader.Collect() error = %v", err)
+	}
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.AbsolutePath)
+	}
+	// Artifacts are sorted by path
+	assert.Equal(t, []string{
+		filepath.Join(root, "a.log"),
+		filepath.Join(root, "other", "build", "f.log"),
+		filepath.Join(root, "sub", "d.log"),
+	}, paths)
+}
+
+func TestCollectWithoutRecursiveGlobSkipsDeeperFiles(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	for _, file := range []string{
+		filepath.Join("dist", "a.js"),
+		filepath.Join("dist", "nested", "b.js"),
+	} {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0o666); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths: filepath.Join(root, "dist", "*.js"),
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatalf("uploader.Collect() error = %v", err)
+	}
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.AbsolutePath)
+	}
+	assert.ElementsMatch(t, []string{filepath.Join(root, "dist", "a.js")}, paths)
+}
+
+func TestGlobRoot(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pattern     string
+		wantRoot    string
+		wantHasMeta bool
+	}{
+		{"*.jpg", ".", true},
+		{"**/*.jpg", ".", true},
+		{"test/fixtures/**/*.jpg", "test/fixtures", true},
+		{"/var/log/*.log", "/var/log", true},
+		{"build/{a,b}/out.txt", "build", true},
+		{"path/to/file.txt", "", false},
+	} {
+		root, hasMeta := globRoot(tc.pattern)
+		if root != tc.wantRoot || hasMeta != tc.wantHasMeta {
+			t.Errorf("globRoot(%q) = (%q, %t), want (%q, %t)", tc.pattern, root, hasMeta, tc.wantRoot, tc.wantHasMeta)
+		}
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	root := b.TempDir()
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 100; j++ {
+			dir := filepath.Join(root, fmt.Sprintf("dir%d", i), fmt.Sprintf("sub%d", j%10))
+			if err := os.MkdirAll(dir, 0o777); err != nil {
+				b.Fatalf("os.MkdirAll(%q) error = %v", dir, err)
+			}
+			path := filepath.Join(dir, fmt.Sprintf("file%d.txt", j))
+			if err := os.WriteFile(path, []byte(path), 0o666); err != nil {
+				b.Fatalf("os.WriteFile(%q) error = %v", path, err)
+			}
+		}
+	}
+
+	for _, bc := range []struct {
+		name        string
+		paths       string
+		ignorePaths string
+	}{
+		{name: "AllFiles", paths: filepath.Join(root, "**", "*")},
+		{name: "IgnoredSubtree", paths: filepath.Join(root, "**", "*"), ignorePaths: "{sub1,sub2,sub3,sub4,sub5,sub6,sub7,sub8,sub9}/"},
+		{name: "FixedDepth", paths: filepath.Join(root, "dir1", "*", "*.txt")},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+				Paths:       bc.paths,
+				IgnorePaths: bc.ignorePaths,
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := uploader.Collect(); err != nil {
+					b.Fatalf("uploader.Collect() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestArtifactUploaderDryRun(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	for _, file := range []string{"a.log", "b.tmp"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("llamas"), 0o666); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", file, err)
+		}
+	}
+
+	// A nil API client would panic if anything were uploaded
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		JobID:       "my-job",
+		Paths:       filepath.Join(root, "*"),
+		IgnorePaths: "*.tmp",
+		Destination: "s3://my-bucket/artifacts/",
+		ContentType: "text/plain",
+		DryRun:      true,
+	})
+	if err := uploader.Upload(context.Background()); err != nil {
+		t.Fatalf("uploader.Upload() error = %v", err)
+	}
+
+	plan := uploader.DryRunPlan()
+	if len(plan) != 1 {
+		t.Fatalf("len(uploader.DryRunPlan()) = %d, want 1", len(plan))
+	}
+	path := filepath.ToSlash(filepath.Join(root, "a.log"))
+	assert.Equal(t, ArtifactUploadPlan{
+		Path:         plan[0].Path,
+		AbsolutePath: filepath.Join(root, "a.log"),
+		GlobPath:     filepath.Join(root, "*"),
+		FileSize:     6,
+		Sha1Sum:      fmt.Sprintf("%x", sha1.Sum([]byte("llamas"))),
+		Sha256Sum:    fmt.Sprintf("%x", sha256.Sum256([]byte("llamas"))),
+		ContentType:  "text/plain",
+		Backend:      "s3",
+		Destination:  "s3://my-bucket/artifacts/" + plan[0].Path,
+	}, plan[0])
+	assert.True(t, strings.HasSuffix(path, plan[0].Path), "plan[0].Path = %q, want a suffix of %q", plan[0].Path, path)
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// urlRewriteRule replaces what a regular expression matches in an artifact's
+// URL or upload destination
+type urlRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseURLRewriteRules parses rules like
+// "^https://artifacts\.internal/=>https://cdn.example.com/", separated by
+// semicolons. The replacement can refer to groups in the pattern, like $1.
+func parseURLRewriteRules(rules string) ([]urlRewriteRule, error) {
+	var parsed []urlRewriteRule
+	for _, rule := range strings.Split(rules, ArtifactPathDelimiter) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, replacement, ok := strings.Cut(rule, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid artifact URL rewrite %q, expected pattern=>replacement", rule)
+		}
+
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact URL rewrite pattern %q: %w", pattern, err)
+		}
+
+		parsed = append(parsed, urlRewriteRule{
+			pattern:     re,
+			replacement: strings.TrimSpace(replacement),
+		})
+	}
+	return parsed, nil
+}
+
+// rewriteURL applies each of the rules to the URL in turn
+func rewriteURL(rules []urlRewriteRule, url string) string {
+	for _, r := range rules {
+		url = r.pattern.ReplaceAllString(url, r.replacement)
+	}
+	return url
+}
@@ -0,0 +1,30 @@
+package agent
+
+import "testing"
+
+func TestRewriteURL(t *testing.T) {
+	rules, err := parseURLRewriteRules(`^https://artifacts\.internal/ => https://cdn.example.com/ ; ^s3://([a-z-]+)-private/=>s3://$1-mirror/`)
+	if err != nil {
+		t.Fatalf("parseURLRewriteRules() error = %v", err)
+	}
+
+	for _, test := range []struct {
+		url, want string
+	}{
+		{url: "https://artifacts.internal/llamas.txt", want: "https://cdn.example.com/llamas.txt"},
+		{url: "s3://builds-private/job/llamas.txt", want: "s3://builds-mirror/job/llamas.txt"},
+		{url: "https://example.com/artifacts.internal/llamas.txt", want: "https://example.com/artifacts.internal/llamas.txt"},
+	} {
+		if got := rewriteURL(rules, test.url); got != test.want {
+			t.Errorf("rewriteURL(rules, %q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestParseURLRewriteRulesErrors(t *testing.T) {
+	for _, rules := range []string{"https://example.com", "(=>x"} {
+		if _, err := parseURLRewriteRules(rules); err == nil {
+			t.Errorf("parseURLRewriteRules(%q) error = nil, want an error", rules)
+		}
+	}
+}
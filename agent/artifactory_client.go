@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// artifactoryTLSEnvVar configures how the certificates of Artifactory
+// repositories are verified, for an instance with a self-signed certificate
+// or one from an internal certificate authority. It's rules like
+// "internal-*=ca-cert:/etc/ssl/certs/internal-ca.pem;scratch=skip-verify:true",
+// separated by semicolons. Patterns are matched against repository names like
+// path.Match, and the first rule that matches a repository applies to it. The
+// rules only apply to requests to Artifactory, not to other storage.
+const artifactoryTLSEnvVar = "BUILDKITE_ARTIFACTORY_TLS"
+
+// artifactoryTLSRule is how the certificates of the repositories whose names
+// match a pattern are verified
+type artifactoryTLSRule struct {
+	pattern    string
+	caCertFile string
+	skipVerify bool
+}
+
+// parseArtifactoryTLSRules parses the rules in artifactoryTLSEnvVar. The
+// settings are ca-cert, a file of PEM encoded certificates to trust, and
+// skip-verify.
+func parseArtifactoryTLSRules(rules string) ([]artifactoryTLSRule, error) {
+	var parsed []artifactoryTLSRule
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, settings, ok := strings.Cut(rule, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid %s rule %q, expected repository=setting:value,...", artifactoryTLSEnvVar, rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s repository pattern %q: %w", artifactoryTLSEnvVar, pattern, err)
+		}
+
+		r := artifactoryTLSRule{pattern: pattern}
+		for _, setting := range strings.Split(settings, ",") {
+			// Cut at the first colon, as Windows paths have them too
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			value = strings.TrimSpace(value)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid %s setting %q for %s, expected setting:value", artifactoryTLSEnvVar, setting, pattern)
+			}
+
+			switch strings.TrimSpace(name) {
+			case "ca-cert":
+				r.caCertFile = value
+			case "skip-verify":
+				skip, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s skip-verify %q for %s, expected true or false", artifactoryTLSEnvVar, value, pattern)
+				}
+				r.skipVerify = skip
+			default:
+				return nil, fmt.Errorf("unknown %s setting %q for %s, expected ca-cert or skip-verify", artifactoryTLSEnvVar, name, pattern)
+			}
+		}
+
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// The clients made for each way of verifying Artifactory's certificate, kept
+// so connections to it are reused between artifacts
+var artifactoryClients = struct {
+	sync.Mutex
+	clients map[TransportConfig]*http.Client
+}{clients: map[TransportConfig]*http.Client{}}
+
+// artifactoryHTTPClient returns the client for requests to the repository,
+// which is client unless a rule in artifactoryTLSEnvVar verifies the
+// repository's certificate differently, in which case it's one made for that,
+// with the rest of transport, which client was made with
+func artifactoryHTTPClient(client *http.Client, transport TransportConfig, repository string) (*http.Client, error) {
+	rules, err := parseArtifactoryTLSRules(os.Getenv(artifactoryTLSEnvVar))
+	if err != nil {
+		return nil, err
+	}
+
+	conf := transport
+	for _, r := range rules {
+		if ok, _ := path.Match(r.pattern, repository); !ok {
+			continue
+		}
+		if r.caCertFile != "" {
+			conf.CACertFile = r.caCertFile
+		}
+		if r.skipVerify {
+			conf.InsecureSkipVerify = true
+		}
+		break
+	}
+	if conf == transport {
+		return client, nil
+	}
+
+	artifactoryClients.Lock()
+	defer artifactoryClients.Unlock()
+
+	if c, ok := artifactoryClients.clients[conf]; ok {
+		return c, nil
+	}
+	c, err := NewDownloadHTTPClient(DownloadHTTPConfig{TransportConfig: conf})
+	if err != nil {
+		return nil, fmt.Errorf("making a client for Artifactory: %w", err)
+	}
+	artifactoryClients.clients[conf] = c
+	return c, nil
+}
@@ -10,8 +10,10 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
 )
 
 type ArtifactoryDownloaderConfig struct {
@@ -28,8 +30,36 @@ type ArtifactoryDownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with
+	DirPermissions os.FileMode
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The HTTP client to download with. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	// The proxy and TLS config HTTPClient was made with, which a client for
+	// Artifactory's own certificate settings is made with too
+	Transport TransportConfig
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// If set, it's called with the number of bytes downloaded as they are
+	Progress func(int64)
+
+	// The size of the file, if known, so a failed download can be resumed
+	Size int64
+
+	// If set, a failed download starts again from the beginning
+	NoResume bool
 }
 
 type ArtifactoryDownloader struct {
@@ -50,10 +80,16 @@ func NewArtifactoryDownloader(l logger.Logger, c ArtifactoryDownloaderConfig) *A
 func (d ArtifactoryDownloader) Start(ctx context.Context) error {
 	// Pull environment variables
 	stringURL := os.Getenv("BUILDKITE_ARTIFACTORY_URL")
-	username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
-	password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
-	if stringURL == "" || username == "" || password == "" {
-		return errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	if stringURL == "" {
+		return errArtifactoryConfig
+	}
+	authHeader, err := artifactoryAuthHeader(ctx, d.RepositoryName())
+	if err != nil {
+		return err
+	}
+	client, err := artifactoryHTTPClient(d.conf.HTTPClient, d.conf.Transport, d.RepositoryName())
+	if err != nil {
+		return err
 	}
 
 	// create full URL
@@ -64,19 +100,81 @@ func (d ArtifactoryDownloader) Start(ctx context.Context) error {
 	)
 
 	// create headers map
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Basic %s", getBasicAuthHeader(username, password)),
+	headers := map[string]string{}
+	for name := range authHeader {
+		headers[name] = authHeader.Get(name)
+	}
+
+	// Artifactory sends the checksums it calculated when the file was
+	// deployed with every download, even of part of the file
+	var (
+		checksumsMu sync.Mutex
+		checksums   map[string]string
+	)
+	checkResponse := func(res *http.Response) error {
+		if res.StatusCode/100 != 2 {
+			return &transfer.StatusError{StatusCode: res.StatusCode, Status: res.Status}
+		}
+		checksumsMu.Lock()
+		defer checksumsMu.Unlock()
+		checksums = map[string]string{
+			"sha1":   res.Header.Get("X-Checksum-Sha1"),
+			"sha256": res.Header.Get("X-Checksum-Sha256"),
+		}
+		return nil
 	}
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         fullURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		Headers:     headers,
-		DebugHTTP:   d.conf.DebugHTTP,
+	err = NewDownload(d.logger, client, DownloadConfig{
+		URL:            fullURL,
+		Path:           d.conf.Path,
+		Destination:    d.conf.Destination,
+		Retries:        d.conf.Retries,
+		Retry:          d.conf.Retry,
+		DirPermissions: d.conf.DirPermissions,
+		Headers:        headers,
+		DebugHTTP:      d.conf.DebugHTTP,
+		CheckResponse:  checkResponse,
+		Range:          d.conf.Range,
+		MaxBandwidth:   d.conf.MaxBandwidth,
+		Progress:       d.conf.Progress,
+		Size:           d.conf.Size,
+		NoResume:       d.conf.NoResume,
 	}).Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Part of a file can't be checked against the whole file's checksum
+	if d.conf.Range != nil {
+		return nil
+	}
+	checksumsMu.Lock()
+	defer checksumsMu.Unlock()
+	return d.verify(checksums)
+}
+
+// verify checks the downloaded file against the checksums Artifactory sent
+// in its X-Checksum-* headers, which it calculated when the file was
+// deployed. That catches corruption even for artifacts that were uploaded
+// without checksums. A file that doesn't match is removed.
+func (d ArtifactoryDownloader) verify(checksums map[string]string) error {
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+	algorithm, err := transfer.VerifyFile(targetFile, checksums, transfer.DefaultChecksumPreference)
+	var mismatch *transfer.ChecksumMismatchError
+	if errors.As(err, &mismatch) {
+		os.Remove(targetFile)
+	}
+	if err != nil {
+		return fmt.Errorf("verifying %s against Artifactory's checksum: %w", d.conf.Path, err)
+	}
+
+	if algorithm == "" {
+		d.logger.Debug("Not verifying %s, Artifactory sent no checksums for it", d.conf.Path)
+	} else {
+		d.logger.Debug("Verified %s against Artifactory's %s checksum", d.conf.Path, algorithm)
+	}
+	return nil
 }
 
 func (d ArtifactoryDownloader) RepositoryFileLocation() string {
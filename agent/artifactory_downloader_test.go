@@ -1,9 +1,21 @@
 package agent
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,3 +62,96 @@ func TestArtifactoryDownloaderRepositoryFileLocation(t *testing.T) {
 	})
 	assert.Equal(t, rtUploader.RepositoryFileLocation(), "rt/folder")
 }
+
+func TestArtifactoryDownloaderVerifiesChecksums(t *testing.T) {
+	contents := "artifact contents"
+	sum := sha256.Sum256([]byte(contents))
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer rt-token" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The checksums come with the download itself
+		if req.Method != http.MethodGet {
+			t.Errorf("%s %s, want only GET requests", req.Method, req.URL.Path)
+		}
+		switch req.URL.Path {
+		case "/artifactory/my-repo/builds/good.txt", "/artifactory/other-repo/builds/good.txt":
+			rw.Header().Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+		case "/artifactory/my-repo/builds/corrupt.txt":
+			rw.Header().Set("X-Checksum-Sha256", strings.Repeat("0", 64))
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		io.WriteString(rw, contents)
+	}))
+	defer server.Close()
+
+	// Trust the server's self-signed certificate
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCert, certPEM, 0o600); err != nil {
+		t.Fatalf("os.WriteFile(ca.pem) error = %v", err)
+	}
+
+	t.Setenv(credentialHelperEnvVar, "")
+	t.Setenv("BUILDKITE_ARTIFACTORY_URL", server.URL+"/artifactory")
+	t.Setenv("BUILDKITE_ARTIFACTORY_ACCESS_TOKEN", "rt-token")
+	t.Setenv(artifactoryTLSEnvVar, "my-*=ca-cert:"+caCert)
+
+	dir := t.TempDir()
+	downloadFrom := func(repository, path string) error {
+		return NewArtifactoryDownloader(logger.Discard, ArtifactoryDownloaderConfig{
+			Repository:  repository,
+			Path:        path,
+			Destination: dir,
+			Retries:     1,
+		}).Start(context.Background())
+	}
+	download := func(path string) error {
+		return downloadFrom("rt://my-repo/builds", path)
+	}
+
+	if err := download("good.txt"); err != nil {
+		t.Fatalf(`download("good.txt") error = %v`, err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "good.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(good.txt) error = %v", err)
+	}
+	assert.Equal(t, contents, string(got))
+
+	err = download("corrupt.txt")
+	var mismatch *transfer.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf(`download("corrupt.txt") error = %v, want a *transfer.ChecksumMismatchError`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "corrupt.txt")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(corrupt.txt) error = %v, want the corrupt file to be removed", err)
+	}
+
+	// The certificate is only trusted for the repositories the rule is for
+	err = downloadFrom("rt://other-repo/builds", "good.txt")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf(`downloadFrom("rt://other-repo/builds", "good.txt") error = %v, want a certificate error`, err)
+	}
+}
+
+func TestParseArtifactoryTLSRules(t *testing.T) {
+	rules, err := parseArtifactoryTLSRules("internal-*=ca-cert:C:\\certs\\ca.pem; scratch=skip-verify:true")
+	if err != nil {
+		t.Fatalf("parseArtifactoryTLSRules() error = %v", err)
+	}
+	assert.Equal(t, []artifactoryTLSRule{
+		{pattern: "internal-*", caCertFile: `C:\certs\ca.pem`},
+		{pattern: "scratch", skipVerify: true},
+	}, rules)
+
+	for _, bad := range []string{"internal-*", "[=ca-cert:ca.pem", "scratch=skip-verify:maybe", "scratch=verify:false"} {
+		if _, err := parseArtifactoryTLSRules(bad); err == nil {
+			t.Errorf("parseArtifactoryTLSRules(%q) error = nil, want an error", bad)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -17,7 +18,11 @@ import (
 	"strings"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/destination"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
+	"github.com/buildkite/agent/v3/transfer"
 )
 
 type ArtifactoryUploaderConfig struct {
@@ -48,39 +53,52 @@ type ArtifactoryUploader struct {
 	// The logger instance to use
 	logger logger.Logger
 
-	// Artifactory username
-	user string
-
-	// Artifactory password
-	password string
+	// The header that authenticates requests to Artifactory
+	authHeader http.Header
 }
 
+// errArtifactoryConfig is returned when rt:// is used without the
+// configuration it needs
+var errArtifactoryConfig = errors.New("Must set BUILDKITE_ARTIFACTORY_URL, and BUILDKITE_ARTIFACTORY_ACCESS_TOKEN, BUILDKITE_ARTIFACTORY_API_KEY, or BUILDKITE_ARTIFACTORY_USER and BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+
 func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*ArtifactoryUploader, error) {
-	repo, path := ParseArtifactoryDestination(c.Destination)
+	dest, err := destination.Parse(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	repo, path := dest.Bucket, dest.Path
 	stringURL := os.Getenv("BUILDKITE_ARTIFACTORY_URL")
-	username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
-	password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
-	// authentication is not set
-	if stringURL == "" || username == "" || password == "" {
-		return nil, errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	if stringURL == "" {
+		return nil, errArtifactoryConfig
+	}
+	authHeader, err := artifactoryAuthHeader(context.Background(), repo)
+	if err != nil {
+		return nil, err
 	}
 
 	parsedURL, err := url.Parse(stringURL)
 	if err != nil {
 		return nil, err
 	}
+	client, err := artifactoryHTTPClient(storageproxy.Client(&http.Client{}), TransportConfig{}, repo)
+	if err != nil {
+		return nil, err
+	}
 	return &ArtifactoryUploader{
 		logger:     l,
 		conf:       c,
-		client:     &http.Client{},
+		client:     storagetags.Client(client),
 		iURL:       parsedURL,
 		Path:       path,
 		Repository: repo,
-		user:       username,
-		password:   password,
+		authHeader: authHeader,
 	}, nil
 }
 
+// ParseArtifactoryDestination splits an rt://repository/path destination into
+// its repository and path.
+//
+// Deprecated: Use destination.Parse, which also reports invalid destinations.
 func ParseArtifactoryDestination(destination string) (repo string, path string) {
 	parts := strings.Split(strings.TrimPrefix(string(destination), "rt://"), "/")
 	path = strings.Join(parts[1:], "/")
@@ -105,71 +123,34 @@ func (u *ArtifactoryUploader) Upload(artifact *api.Artifact) error {
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
 	// Upload the file to Artifactory.
 	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
 
-	req, err := http.NewRequest("PUT", u.URL(artifact), f)
-	req.SetBasicAuth(u.user, u.password)
-	if err != nil {
-		return err
-	}
-
-	md5Checksum, err := checksumFile(md5.New(), artifact.AbsolutePath)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("X-Checksum-MD5", md5Checksum)
+	header := u.authHeader.Clone()
 
-	sha1Checksum, err := checksumFile(sha1.New(), artifact.AbsolutePath)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("X-Checksum-SHA1", sha1Checksum)
-
-	sha256Checksum, err := checksumFile(sha256.New(), artifact.AbsolutePath)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("X-Checksum-SHA256", sha256Checksum)
-
-	res, err := u.client.Do(req)
-	if err != nil {
-		return err
-	}
-	if err := checkResponse(res); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func checksumFile(hasher hash.Hash, path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	if _, err := io.Copy(hasher, f); err != nil {
-		return "", err
+	for name, h := range map[string]func() hash.Hash{
+		"X-Checksum-MD5":    md5.New,
+		"X-Checksum-SHA1":   sha1.New,
+		"X-Checksum-SHA256": sha256.New,
+	} {
+		checksum, err := transfer.ChecksumFile(h(), artifact.AbsolutePath)
+		if err != nil {
+			return err
+		}
+		header.Set(name, checksum)
 	}
 
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
-}
-
-func sha1File(path string) ([]byte, error) {
-	hasher := sha1.New()
-
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	if _, err := io.Copy(hasher, f); err != nil {
-		return nil, err
+	backend := &transfer.HTTPBackend{
+		Client:        u.client,
+		Header:        header,
+		CheckResponse: checkResponse,
+		DebugHTTP:     u.conf.DebugHTTP,
+		Logger:        u.logger,
 	}
 
-	return hasher.Sum(nil), nil
+	return backend.Write(context.Background(), u.URL(artifact), f, artifact.FileSize)
 }
 
 func (u *ArtifactoryUploader) artifactPath(artifact *api.Artifact) string {
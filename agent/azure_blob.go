@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// The version of the Blob service REST API that requests are made with
+	azureBlobAPIVersion = "2021-08-06"
+
+	// The resource that managed identity tokens are requested for
+	azureStorageResource = "https://storage.azure.com/"
+)
+
+// azureIMDSTokenURL is where managed identity tokens are requested from. It's
+// a variable so tests can replace it.
+var azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// ParseAzureBlobDestination splits an az://container/path destination into
+// its container and path.
+//
+// Deprecated: Use destination.Parse, which also reports invalid destinations.
+func ParseAzureBlobDestination(destination string) (container string, path string) {
+	parts := strings.Split(strings.TrimPrefix(destination, "az://"), "/")
+	container = parts[0]
+	path = strings.Join(parts[1:], "/")
+	return
+}
+
+// azureBlobURL returns the URL of a blob, without any credentials. The
+// storage account is taken from BUILDKITE_AZURE_STORAGE_ACCOUNT, unless
+// BUILDKITE_AZURE_BLOB_ENDPOINT gives the whole endpoint, such as for
+// Azurite or a sovereign cloud.
+func azureBlobURL(container, blob string) (*url.URL, error) {
+	endpoint := os.Getenv("BUILDKITE_AZURE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		account := os.Getenv("BUILDKITE_AZURE_STORAGE_ACCOUNT")
+		if account == "" {
+			return nil, errors.New("Must set BUILDKITE_AZURE_STORAGE_ACCOUNT or BUILDKITE_AZURE_BLOB_ENDPOINT when using az:// path")
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + container + "/" + blob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure Blob Storage endpoint %q: %w", endpoint, err)
+	}
+	return u, nil
+}
+
+// azureBlobAuth returns the headers and query string that authorize requests
+// to Azure Blob Storage. A SAS token in BUILDKITE_AZURE_BLOB_SAS_TOKEN is
+// used if there is one, then a token from the credential helper, and
+// otherwise a managed identity token from the instance metadata service.
+func azureBlobAuth(ctx context.Context, container string) (http.Header, url.Values, error) {
+	header := http.Header{}
+	header.Set("x-ms-version", azureBlobAPIVersion)
+
+	if sas := os.Getenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN"); sas != "" {
+		query, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing BUILDKITE_AZURE_BLOB_SAS_TOKEN: %w", err)
+		}
+		return header, query, nil
+	}
+
+	var token string
+	if hasCredentialHelper() {
+		creds, err := runCredentialHelper(ctx, storageCredentialRequest{Backend: "az", Location: container})
+		if err != nil {
+			return nil, nil, err
+		}
+		if creds.Token == "" {
+			return nil, nil, errors.New("credential helper didn't return a token")
+		}
+		token = creds.Token
+	} else {
+		var err error
+		if token, err = azureManagedIdentityToken(ctx); err != nil {
+			return nil, nil, fmt.Errorf("getting a managed identity token for Azure Blob Storage (set BUILDKITE_AZURE_BLOB_SAS_TOKEN to use a SAS token instead): %w", err)
+		}
+	}
+
+	header.Set("Authorization", "Bearer "+token)
+	return header, nil, nil
+}
+
+// azureManagedIdentityToken gets an access token for Azure Storage from the
+// instance metadata service. AZURE_CLIENT_ID chooses a user-assigned
+// identity, when there's more than one.
+func azureManagedIdentityToken(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureStorageResource)
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	// The metadata service must never be reached through a proxy
+	client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service returned %s", res.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("parsing managed identity token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("instance metadata service didn't return an access token")
+	}
+	return token.AccessToken, nil
+}
+
+// withQuery returns the URL with the query added
+func withQuery(u *url.URL, query url.Values) string {
+	if len(query) == 0 {
+		return u.String()
+	}
+	withQuery := *u
+	withQuery.RawQuery = query.Encode()
+	return withQuery.String()
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type AzureBlobDownloaderConfig struct {
+	// The az:// destination the artifact was uploaded to
+	Container string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location in the container
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with
+	DirPermissions os.FileMode
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// The HTTP client to download with. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// If set, it's called with the number of bytes downloaded as they are
+	Progress func(int64)
+
+	// The size of the file, if known, so a failed download can be resumed
+	Size int64
+
+	// If set, a failed download starts again from the beginning
+	NoResume bool
+}
+
+type AzureBlobDownloader struct {
+	// The config for the downloader
+	conf AzureBlobDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobDownloader(l logger.Logger, c AzureBlobDownloaderConfig) *AzureBlobDownloader {
+	return &AzureBlobDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d AzureBlobDownloader) Start(ctx context.Context) error {
+	container, prefix := ParseAzureBlobDestination(d.conf.Container)
+
+	blobURL, err := azureBlobURL(container, path.Join(prefix, d.conf.Path))
+	if err != nil {
+		return err
+	}
+
+	header, query, err := azureBlobAuth(ctx, container)
+	if err != nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(header))
+	for k := range header {
+		headers[k] = header.Get(k)
+	}
+
+	// We can now cheat and pass the URL onto our regular downloader
+	return NewDownload(d.logger, d.conf.HTTPClient, DownloadConfig{
+		URL:            withQuery(blobURL, query),
+		Path:           d.conf.Path,
+		Destination:    d.conf.Destination,
+		Retries:        d.conf.Retries,
+		Retry:          d.conf.Retry,
+		DirPermissions: d.conf.DirPermissions,
+		Headers:        headers,
+		DebugHTTP:      d.conf.DebugHTTP,
+		Range:          d.conf.Range,
+		MaxBandwidth:   d.conf.MaxBandwidth,
+		Progress:       d.conf.Progress,
+		Size:           d.conf.Size,
+		NoResume:       d.conf.NoResume,
+	}).Start(ctx)
+}
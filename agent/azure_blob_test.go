@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAzureBlobDestination(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		dest, container, path string
+	}{
+		{dest: "az://my-container/foo/bar", container: "my-container", path: "foo/bar"},
+		{dest: "az://my-container", container: "my-container", path: ""},
+	} {
+		container, path := ParseAzureBlobDestination(test.dest)
+		assert.Equal(t, test.container, container, test.dest)
+		assert.Equal(t, test.path, path, test.dest)
+	}
+}
+
+func TestAzureBlobUploadAndDownloadWithSAS(t *testing.T) {
+	blobs := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("sig") != "secret" || req.Header.Get("x-ms-version") == "" {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			if req.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				http.Error(rw, "missing blob type", http.StatusBadRequest)
+				return
+			}
+			blobs[req.URL.Path], _ = io.ReadAll(req.Body)
+			rw.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			data, ok := blobs[req.URL.Path]
+			if !ok {
+				http.NotFound(rw, req)
+				return
+			}
+			rw.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("BUILDKITE_AZURE_BLOB_ENDPOINT", server.URL+"/account")
+	t.Setenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN", "?sv=2021-08-06&sig=secret")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, os.WriteFile(src, []byte("llamas"), 0o644))
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{Destination: "az://artifacts/build-1"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: src, FileSize: 6, ContentType: "text/plain"}
+	assert.Equal(t, server.URL+"/account/artifacts/build-1/llamas.txt", uploader.URL(artifact))
+	require.NoError(t, uploader.Upload(artifact))
+	assert.Equal(t, []byte("llamas"), blobs["/account/artifacts/build-1/llamas.txt"])
+
+	dest := filepath.Join(dir, "download")
+	require.NoError(t, os.Mkdir(dest, 0o755))
+	require.NoError(t, NewAzureBlobDownloader(logger.Discard, AzureBlobDownloaderConfig{
+		Container:   "az://artifacts/build-1",
+		Path:        "llamas.txt",
+		Destination: dest,
+		Retries:     1,
+	}).Start(context.Background()))
+
+	data, err := os.ReadFile(filepath.Join(dest, "llamas.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
+
+func TestAzureBlobAuthWithManagedIdentity(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata") != "true" || req.URL.Query().Get("resource") != azureStorageResource {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "my-identity", req.URL.Query().Get("client_id"))
+		rw.Write([]byte(`{"access_token":"imds-token","token_type":"Bearer"}`))
+	}))
+	defer imds.Close()
+
+	oldURL := azureIMDSTokenURL
+	azureIMDSTokenURL = imds.URL
+	t.Cleanup(func() { azureIMDSTokenURL = oldURL })
+
+	t.Setenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN", "")
+	t.Setenv(credentialHelperEnvVar, "")
+	t.Setenv("AZURE_CLIENT_ID", "my-identity")
+
+	header, query, err := azureBlobAuth(context.Background(), "artifacts")
+	require.NoError(t, err)
+	assert.Empty(t, query)
+	assert.Equal(t, "Bearer imds-token", header.Get("Authorization"))
+	assert.Equal(t, azureBlobAPIVersion, header.Get("x-ms-version"))
+}
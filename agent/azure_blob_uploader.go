@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/destination"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+type AzureBlobUploaderConfig struct {
+	// The destination which includes the container name and the path.
+	// e.g az://my-container/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+type AzureBlobUploader struct {
+	// The container set from the destination
+	Container string
+
+	// The path in the container set from the destination
+	Path string
+
+	// The configuration
+	conf AzureBlobUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// Authorization for requests, as headers or a SAS token query
+	header http.Header
+	query  url.Values
+}
+
+func NewAzureBlobUploader(l logger.Logger, c AzureBlobUploaderConfig) (*AzureBlobUploader, error) {
+	dest, err := destination.Parse(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	container, path := dest.Bucket, dest.Path
+
+	// Check the destination can be turned into URLs
+	if _, err := azureBlobURL(container, path); err != nil {
+		return nil, err
+	}
+
+	header, query, err := azureBlobAuth(context.Background(), container)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobUploader{
+		Container: container,
+		Path:      path,
+		conf:      c,
+		logger:    l,
+		header:    header,
+		query:     query,
+	}, nil
+}
+
+// URL returns the URL of the artifact's blob. It doesn't include a SAS
+// token, so it's safe to show.
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	blobURL, err := azureBlobURL(u.Container, u.artifactPath(artifact))
+	if err != nil {
+		return ""
+	}
+	return blobURL.String()
+}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	blobURL, err := azureBlobURL(u.Container, u.artifactPath(artifact))
+	if err != nil {
+		return err
+	}
+
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, blobURL)
+
+	header := u.header.Clone()
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("x-ms-blob-content-type", artifact.ContentType)
+
+	backend := &transfer.HTTPBackend{
+		Header:    header,
+		DebugHTTP: u.conf.DebugHTTP,
+		Logger:    u.logger,
+	}
+
+	return backend.Write(context.Background(), withQuery(blobURL, u.query), f, artifact.FileSize)
+}
+
+func (u *AzureBlobUploader) artifactPath(artifact *api.Artifact) string {
+	return path.Join(u.Path, artifact.Path)
+}
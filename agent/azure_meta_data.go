@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The Azure Instance Metadata Service, which is only reachable from inside
+// an Azure VM
+const azureMetaDataURL = "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01"
+
+// AzureMetaData fetches meta-data about the Azure VM the agent is running on
+type AzureMetaData struct {
+	// The URL to fetch instance meta-data from. Defaults to the Azure
+	// Instance Metadata Service.
+	URL string
+}
+
+// azureCompute is the part of the instance meta-data we use
+type azureCompute struct {
+	VMID              string `json:"vmId"`
+	Name              string `json:"name"`
+	Location          string `json:"location"`
+	Zone              string `json:"zone"`
+	VMSize            string `json:"vmSize"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	SubscriptionID    string `json:"subscriptionId"`
+	VMScaleSetName    string `json:"vmScaleSetName"`
+	Priority          string `json:"priority"`
+	TagsList          []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"tagsList"`
+}
+
+func (e AzureMetaData) compute(ctx context.Context) (*azureCompute, error) {
+	url := e.URL
+	if url == "" {
+		url = azureMetaDataURL
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Azure instance meta-data returned %s", resp.Status)
+	}
+
+	var compute azureCompute
+	if err := json.NewDecoder(resp.Body).Decode(&compute); err != nil {
+		return nil, fmt.Errorf("decoding Azure instance meta-data: %w", err)
+	}
+	return &compute, nil
+}
+
+// Get returns tags describing the Azure VM
+func (e AzureMetaData) Get(ctx context.Context) (map[string]string, error) {
+	compute, err := e.compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{
+		"azure:vm-id":           compute.VMID,
+		"azure:vm-name":         compute.Name,
+		"azure:vm-size":         compute.VMSize,
+		"azure:location":        compute.Location,
+		"azure:resource-group":  compute.ResourceGroupName,
+		"azure:subscription-id": compute.SubscriptionID,
+		"azure:priority":        strings.ToLower(compute.Priority),
+	}
+	if compute.Zone != "" {
+		result["azure:zone"] = compute.Zone
+	}
+	if compute.VMScaleSetName != "" {
+		result["azure:vm-scale-set"] = compute.VMScaleSetName
+	}
+
+	return result, nil
+}
+
+// Tags returns the tags applied to the Azure VM
+func (e AzureMetaData) Tags(ctx context.Context) (map[string]string, error) {
+	compute, err := e.compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(compute.TagsList))
+	for _, tag := range compute.TagsList {
+		result[tag.Name] = tag.Value
+	}
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const azureComputeJSON = `{
+	"vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+	"name": "builder-1",
+	"location": "westus2",
+	"zone": "1",
+	"vmSize": "Standard_D2s_v3",
+	"resourceGroupName": "ci",
+	"subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+	"vmScaleSetName": "",
+	"priority": "Spot",
+	"tagsList": [{"name": "team", "value": "platform"}]
+}`
+
+func azureMetaDataServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata") != "true" {
+			http.Error(rw, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		rw.Write([]byte(azureComputeJSON))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAzureMetaDataGet(t *testing.T) {
+	server := azureMetaDataServer(t)
+
+	got, err := AzureMetaData{URL: server.URL}.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"azure:vm-id":           "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+		"azure:vm-name":         "builder-1",
+		"azure:vm-size":         "Standard_D2s_v3",
+		"azure:location":        "westus2",
+		"azure:zone":            "1",
+		"azure:resource-group":  "ci",
+		"azure:subscription-id": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+		"azure:priority":        "spot",
+	}, got)
+}
+
+func TestAzureMetaDataTags(t *testing.T) {
+	server := azureMetaDataServer(t)
+
+	got, err := AzureMetaData{URL: server.URL}.Tags(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "platform"}, got)
+}
+
+func TestK8sTagsFromDownwardAPIFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels")
+	contents := "app=\"builder\"\napp.kubernetes.io/name=\"agent \\\"1\\\"\"\n"
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := K8sTagsFromDownwardAPIFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"app":                    "builder",
+		"app.kubernetes.io/name": `agent "1"`,
+	}, got)
+
+	if err := os.WriteFile(path, []byte("nope\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = K8sTagsFromDownwardAPIFile(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/buildkite/roko"
+	"github.com/dustin/go-humanize"
+)
+
+type BackendDownloaderConfig struct {
+	// The URL of the artifact, in the form the backend expects
+	URL string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with. If zero,
+	// DefaultDownloadDirPermissions is used, less the umask. Otherwise the umask
+	// doesn't apply
+	DirPermissions os.FileMode
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// If set, it's called with the number of bytes downloaded as they are
+	Progress func(int64)
+}
+
+// BackendDownloader downloads an artifact from a transfer.Backend, such as
+// one that a program embedding the downloader provides for its own storage
+type BackendDownloader struct {
+	conf    BackendDownloaderConfig
+	logger  logger.Logger
+	backend transfer.Backend
+}
+
+func NewBackendDownloader(l logger.Logger, backend transfer.Backend, c BackendDownloaderConfig) *BackendDownloader {
+	return &BackendDownloader{conf: c, logger: l, backend: backend}
+}
+
+func (d *BackendDownloader) Start(ctx context.Context) error {
+	return d.conf.Retry.retrier(d.conf.Retries).DoWithContext(ctx, retrylog.Wrap("Downloading file", func(r *roko.Retrier) error {
+		err := d.conf.Retry.attempt(ctx, d.try)
+		if err != nil {
+			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, r)
+		}
+		return err
+	}))
+}
+
+func (d *BackendDownloader) try(ctx context.Context) error {
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+
+	if err := downloadDirs.MkdirAll(filepath.Dir(targetFile), d.conf.DirPermissions); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+
+	var body io.ReadCloser
+	var err error
+	if d.conf.Range != nil {
+		body, err = d.backend.ReadRange(ctx, d.conf.URL, d.conf.Range.Offset, d.conf.Range.Length)
+	} else {
+		body, err = d.backend.Open(ctx, d.conf.URL)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(targetFile)
+	if err != nil {
+		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = transfer.NewThrottledReader(ctx, body, d.conf.MaxBandwidth)
+	if d.conf.Progress != nil {
+		r = &progressReader{r: r, progress: d.conf.Progress}
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Failed to write file %s (%T: %v)", targetFile, err, err)
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.Bytes(uint64(n)))
+	return nil
+}
+
+// backendFor returns the backend configured for the scheme of an upload
+// destination, if there is one
+func backendFor(backends map[string]transfer.Backend, uploadDestination string) transfer.Backend {
+	scheme, _, ok := strings.Cut(uploadDestination, "://")
+	if !ok {
+		return nil
+	}
+	return backends[strings.ToLower(scheme)]
+}
+
+// backendURL returns the URL of an artifact in the destination it was
+// uploaded to
+func backendURL(uploadDestination, path string) string {
+	return strings.TrimSuffix(uploadDestination, "/") + "/" + strings.TrimPrefix(path, "/")
+}
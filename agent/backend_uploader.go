@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+// BackendUploader uploads artifacts to a transfer.Backend, such as one that a
+// program embedding the uploader provides for its own storage
+type BackendUploader struct {
+	// The destination the artifacts are uploaded to, such as
+	// s3://bucket/prefix
+	Destination string
+
+	backend transfer.Backend
+	logger  logger.Logger
+}
+
+func NewBackendUploader(l logger.Logger, backend transfer.Backend, destination string) *BackendUploader {
+	return &BackendUploader{Destination: destination, backend: backend, logger: l}
+}
+
+func (u *BackendUploader) URL(artifact *api.Artifact) string {
+	return backendURL(u.Destination, artifact.Path)
+}
+
+func (u *BackendUploader) Upload(artifact *api.Artifact) error {
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	return u.backend.Write(context.Background(), u.URL(artifact), f, artifact.FileSize)
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writtenBackend records what's written to it
+type writtenBackend struct {
+	transfer.Backend
+
+	written map[string]string
+}
+
+func (b *writtenBackend) Write(_ context.Context, path string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.written[path] = string(data)
+	return nil
+}
+
+func TestBackendUploader(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, os.WriteFile(path, []byte("OK\n"), 0o600))
+
+	backend := &writtenBackend{written: map[string]string{}}
+	uploader := NewBackendUploader(logger.Discard, backend, "s3://my-bucket/builds/1/")
+	artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: path, FileSize: 3}
+
+	assert.Equal(t, "s3://my-bucket/builds/1/pkg/llamas.txt", uploader.URL(artifact))
+	require.NoError(t, uploader.Upload(artifact))
+	assert.Equal(t, map[string]string{"s3://my-bucket/builds/1/pkg/llamas.txt": "OK\n"}, backend.written)
+}
+
+func TestBackendFor(t *testing.T) {
+	t.Parallel()
+
+	backend := &writtenBackend{}
+	backends := map[string]transfer.Backend{"s3": backend}
+
+	assert.Equal(t, transfer.Backend(backend), backendFor(backends, "S3://my-bucket/builds/1"))
+	assert.Nil(t, backendFor(backends, "gs://my-bucket/builds/1"))
+	assert.Nil(t, backendFor(backends, ""))
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// openChunkStream opens a stream to upload the job log over. If it can't be
+// opened, chunks are uploaded with a request each, as usual.
+func (r *JobRunner) openChunkStream(ctx context.Context) {
+	stream, err := r.apiClient.StreamChunks(ctx, r.job.ID)
+	if err != nil {
+		r.logger.Warn("Couldn't open a stream for the job log, uploading it in chunks instead (%s)", err)
+		return
+	}
+
+	r.chunkStreamLock.Lock()
+	r.chunkStream = stream
+	r.chunkStreamLock.Unlock()
+}
+
+// streamChunk sends the chunk over the chunk stream, if there is one, and
+// reports whether it was sent. If the stream breaks it's closed, and this and
+// later chunks are uploaded with a request each.
+func (r *JobRunner) streamChunk(chunk *api.Chunk) bool {
+	r.chunkStreamLock.Lock()
+	stream := r.chunkStream
+	r.chunkStreamLock.Unlock()
+
+	if stream == nil {
+		return false
+	}
+
+	if err := stream.Send(chunk); err != nil {
+		r.logger.Warn("Failed to stream chunk %d, uploading the rest of the job log in chunks instead (%s)", chunk.Sequence, err)
+		r.closeChunkStream()
+		return false
+	}
+	return true
+}
+
+// closeChunkStream closes the chunk stream, if there is one
+func (r *JobRunner) closeChunkStream() {
+	r.chunkStreamLock.Lock()
+	defer r.chunkStreamLock.Unlock()
+
+	if r.chunkStream == nil {
+		return
+	}
+	if err := r.chunkStream.Close(); err != nil {
+		r.logger.Debug("Failed to close the chunk stream: %v", err)
+	}
+	r.chunkStream = nil
+}
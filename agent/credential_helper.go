@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/buildkite/shellwords"
+	"golang.org/x/oauth2"
+)
+
+// credentialHelperEnvVar names a command that artifact storage clients run to
+// get credentials, rather than reading them from the environment. It's run
+// with the argument "get", and a storageCredentialRequest as JSON on stdin,
+// and should print storageCredentials as JSON.
+const credentialHelperEnvVar = "BUILDKITE_STORAGE_CREDENTIAL_HELPER"
+
+// credentialHelperTimeout is how long the credential helper has to respond
+const credentialHelperTimeout = 30 * time.Second
+
+// credentialHelperDefaultTTL is how long credentials without an expiration
+// are used before the credential helper is run again
+const credentialHelperDefaultTTL = 15 * time.Minute
+
+// storageCredentialRequest tells the credential helper what the credentials
+// are for
+type storageCredentialRequest struct {
+	// The storage backend: "s3", "gs" or "rt"
+	Backend string `json:"backend"`
+
+	// The bucket or repository, if it's known
+	Location string `json:"location,omitempty"`
+}
+
+// storageCredentials is what the credential helper returns. Which fields are
+// used depends on the backend.
+type storageCredentials struct {
+	// For s3
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+
+	// For gs, an OAuth2 access token. For rt, an access token that's used
+	// instead of a username and password.
+	Token string `json:"token,omitempty"`
+
+	// For rt
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// When the credentials expire. If zero, they're fetched again after
+	// credentialHelperDefaultTTL.
+	Expiration time.Time `json:"expiration,omitempty"`
+}
+
+// hasCredentialHelper reports whether a credential helper is configured
+func hasCredentialHelper() bool {
+	return os.Getenv(credentialHelperEnvVar) != ""
+}
+
+// runCredentialHelper gets credentials from the configured credential helper
+func runCredentialHelper(ctx context.Context, req storageCredentialRequest) (*storageCredentials, error) {
+	args, err := shellwords.Split(os.Getenv(credentialHelperEnvVar))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", credentialHelperEnvVar, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s is empty", credentialHelperEnvVar)
+	}
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], "get")...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %w: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w", args[0], err)
+	}
+
+	var creds storageCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("parsing the output of credential helper %s: %w", args[0], err)
+	}
+	return &creds, nil
+}
+
+// credentialHelperProvider provides AWS credentials from the credential helper
+type credentialHelperProvider struct {
+	credentials.Expiry
+	bucket string
+}
+
+func (p *credentialHelperProvider) Retrieve() (credentials.Value, error) {
+	creds, err := runCredentialHelper(context.Background(), storageCredentialRequest{Backend: "s3", Location: p.bucket})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return credentials.Value{}, errors.New("credential helper didn't return an access_key_id and secret_access_key")
+	}
+
+	p.SetExpiration(creds.expiration(), time.Minute)
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    "BuildkiteCredentialHelper",
+	}, nil
+}
+
+// credentialHelperTokenSource provides Google Cloud access tokens from the
+// credential helper
+type credentialHelperTokenSource struct {
+	ctx context.Context
+}
+
+func (s credentialHelperTokenSource) Token() (*oauth2.Token, error) {
+	creds, err := runCredentialHelper(s.ctx, storageCredentialRequest{Backend: "gs"})
+	if err != nil {
+		return nil, err
+	}
+	if creds.Token == "" {
+		return nil, errors.New("credential helper didn't return a token")
+	}
+	return &oauth2.Token{
+		AccessToken: creds.Token,
+		TokenType:   "Bearer",
+		Expiry:      creds.expiration(),
+	}, nil
+}
+
+// expiration returns when the credentials expire, defaulting to
+// credentialHelperDefaultTTL from now
+func (c storageCredentials) expiration() time.Time {
+	if c.Expiration.IsZero() {
+		return time.Now().Add(credentialHelperDefaultTTL)
+	}
+	return c.Expiration
+}
+
+// artifactoryAuthHeader returns the header that authenticates requests to
+// Artifactory, using the credential helper if there is one. Otherwise it's
+// an access token, an API key, or a username and password, in that order.
+func artifactoryAuthHeader(ctx context.Context, repository string) (http.Header, error) {
+	header := http.Header{}
+
+	if !hasCredentialHelper() {
+		username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
+		password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
+		switch {
+		case os.Getenv("BUILDKITE_ARTIFACTORY_ACCESS_TOKEN") != "":
+			header.Set("Authorization", "Bearer "+os.Getenv("BUILDKITE_ARTIFACTORY_ACCESS_TOKEN"))
+		case os.Getenv("BUILDKITE_ARTIFACTORY_API_KEY") != "":
+			header.Set("X-JFrog-Art-Api", os.Getenv("BUILDKITE_ARTIFACTORY_API_KEY"))
+		case username != "" && password != "":
+			header.Set("Authorization", "Basic "+getBasicAuthHeader(username, password))
+		default:
+			return nil, errArtifactoryConfig
+		}
+		return header, nil
+	}
+
+	creds, err := runCredentialHelper(ctx, storageCredentialRequest{Backend: "rt", Location: repository})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case creds.Token != "":
+		header.Set("Authorization", "Bearer "+creds.Token)
+	case creds.Username != "" && creds.Password != "":
+		header.Set("Authorization", "Basic "+getBasicAuthHeader(creds.Username, creds.Password))
+	default:
+		return nil, errors.New("credential helper didn't return a token, or a username and password")
+	}
+	return header, nil
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCredentialHelper writes a credential helper that saves its stdin next
+// to itself, and prints output
+func writeCredentialHelper(t *testing.T, output string) (helper, stdin string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helper test scripts are shell scripts")
+	}
+
+	dir := t.TempDir()
+	helper = filepath.Join(dir, "helper")
+	stdin = filepath.Join(dir, "stdin")
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = get ] || exit 1\n" +
+		"cat > '" + stdin + "'\n" +
+		"cat <<'JSON'\n" + output + "\nJSON\n"
+	require.NoError(t, os.WriteFile(helper, []byte(script), 0o755))
+	return helper, stdin
+}
+
+func TestCredentialHelperProvider(t *testing.T) {
+	helper, stdin := writeCredentialHelper(t, `{"access_key_id":"AKID","secret_access_key":"secret","session_token":"token","expiration":"2000-01-01T00:00:00Z"}`)
+	t.Setenv(credentialHelperEnvVar, helper)
+
+	p := &credentialHelperProvider{bucket: "my-bucket"}
+	creds, err := p.Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.Equal(t, "token", creds.SessionToken)
+
+	// The credentials have already expired, so they'd be fetched again
+	assert.True(t, p.IsExpired())
+
+	input, err := os.ReadFile(stdin)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"backend":"s3","location":"my-bucket"}`, string(input))
+}
+
+func TestCredentialHelperProviderDefaultExpiration(t *testing.T) {
+	helper, _ := writeCredentialHelper(t, `{"access_key_id":"AKID","secret_access_key":"secret"}`)
+	t.Setenv(credentialHelperEnvVar, helper)
+
+	p := &credentialHelperProvider{bucket: "my-bucket"}
+	_, err := p.Retrieve()
+	require.NoError(t, err)
+
+	// Credentials without an expiration are still fetched again eventually
+	assert.False(t, p.IsExpired())
+	assert.WithinDuration(t, time.Now().Add(credentialHelperDefaultTTL-time.Minute), p.ExpiresAt(), 5*time.Second)
+}
+
+func TestArtifactoryAuthorizationFromCredentialHelper(t *testing.T) {
+	helper, _ := writeCredentialHelper(t, `{"token":"rt-token"}`)
+	t.Setenv(credentialHelperEnvVar, helper)
+
+	auth, err := artifactoryAuthHeader(context.Background(), "my-repo")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer rt-token", auth.Get("Authorization"))
+
+	helper, _ = writeCredentialHelper(t, `{"username":"user","password":"pass"}`)
+	t.Setenv(credentialHelperEnvVar, helper)
+
+	auth, err = artifactoryAuthHeader(context.Background(), "my-repo")
+	require.NoError(t, err)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", auth.Get("Authorization"))
+}
+
+func TestArtifactoryAuthHeaderFromEnvironment(t *testing.T) {
+	t.Setenv(credentialHelperEnvVar, "")
+	t.Setenv("BUILDKITE_ARTIFACTORY_USER", "user")
+	t.Setenv("BUILDKITE_ARTIFACTORY_PASSWORD", "pass")
+
+	auth, err := artifactoryAuthHeader(context.Background(), "my-repo")
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, auth)
+
+	t.Setenv("BUILDKITE_ARTIFACTORY_API_KEY", "rt-api-key")
+	auth, err = artifactoryAuthHeader(context.Background(), "my-repo")
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"X-Jfrog-Art-Api": {"rt-api-key"}}, auth)
+
+	t.Setenv("BUILDKITE_ARTIFACTORY_ACCESS_TOKEN", "rt-token")
+	auth, err = artifactoryAuthHeader(context.Background(), "my-repo")
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"Authorization": {"Bearer rt-token"}}, auth)
+}
+
+func TestCredentialHelperFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses false")
+	}
+	t.Setenv(credentialHelperEnvVar, "false")
+
+	_, err := credentialHelperTokenSource{ctx: context.Background()}.Token()
+	assert.ErrorContains(t, err, "credential helper false failed")
+}
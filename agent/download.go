@@ -2,16 +2,20 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/transfer"
 	"github.com/buildkite/roko"
 	"github.com/dustin/go-humanize"
 )
@@ -32,8 +36,75 @@ type DownloadConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with. If zero,
+	// DefaultDownloadDirPermissions is used, less the umask. Otherwise the umask
+	// doesn't apply
+	DirPermissions os.FileMode
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// Used to check each response, which may be to a request for part of
+	// the file. If nil, any 2xx or 3xx response is successful
+	CheckResponse func(*http.Response) error
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// The size of the file, if known. A download that fails part way through
+	// is only resumed when the size is known.
+	Size int64
+
+	// If set, a failed download starts again from the beginning rather than
+	// carrying on from where it stopped
+	NoResume bool
+
+	// If set, files larger than this are downloaded in parts of this size,
+	// several at once
+	PartSize int64
+
+	// How many parts are downloaded at once. If zero,
+	// DefaultDownloadPartConcurrency is used
+	PartConcurrency int
+
+	// If set, it's called with the number of bytes downloaded as they are,
+	// which may be from several parts at once. Bytes that have to be
+	// downloaded again are taken back with a negative number first
+	Progress func(int64)
+}
+
+// ByteRange is a range of bytes in a file
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// ParseByteRange parses an inclusive range of bytes like 0-1023, the format
+// of an HTTP Range header without the unit
+func ParseByteRange(s string) (*ByteRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid byte range %q, expected first-last, such as 0-1023", s)
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid start of byte range %q", s)
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	if err != nil || end < start {
+		return nil, fmt.Errorf("invalid end of byte range %q", s)
+	}
+	return &ByteRange{Offset: start, Length: end - start + 1}, nil
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Length-1)
 }
 
 type Download struct {
@@ -43,29 +114,43 @@ type Download struct {
 	// The logger instance to use
 	logger logger.Logger
 
-	// The HTTP client to use for downloading
-	client *http.Client
+	// The backend to download from
+	backend transfer.Backend
 }
 
 func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Download {
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Add(k, v)
+	}
+
 	return &Download{
 		logger: l,
-		client: client,
 		conf:   c,
+		backend: &transfer.HTTPBackend{
+			Client:        client,
+			Header:        header,
+			CheckResponse: c.CheckResponse,
+			DebugHTTP:     c.DebugHTTP,
+			Logger:        l,
+		},
 	}
 }
 
 func (d Download) Start(ctx context.Context) error {
-	return roko.NewRetrier(
-		roko.WithMaxAttempts(d.conf.Retries),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
-		if err := d.try(ctx); err != nil {
+	// Kept between attempts, so each can carry on from the last
+	progress := &downloadProgress{}
+
+	return d.conf.Retry.retrier(d.conf.Retries).DoWithContext(ctx, retrylog.Wrap("Downloading file", func(r *roko.Retrier) error {
+		err := d.conf.Retry.attempt(ctx, func(ctx context.Context) error {
+			return d.try(ctx, progress)
+		})
+		if err != nil {
 			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, r)
 			return err
 		}
 		return nil
-	})
+	}))
 }
 
 func getTargetPath(path string, destination string) string {
@@ -98,70 +183,247 @@ func getTargetPath(path string, destination string) string {
 	return targetFile
 }
 
-func (d Download) try(ctx context.Context) error {
+// downloadProgress is how much of a file earlier attempts downloaded
+type downloadProgress struct {
+	// Bytes written from the start of the file
+	written int64
+
+	// Which parts have been written, when it's downloaded in parts
+	partsDone []bool
+
+	// Set once the server has ignored a range request, after which each
+	// attempt starts from the beginning
+	noResume bool
+}
+
+// How long to wait before trying a failed download again
+var downloadRetryInterval = 5 * time.Second
+
+// DefaultDownloadPartConcurrency is how many parts of a file are downloaded
+// at once, unless it's configured
+const DefaultDownloadPartConcurrency = 4
+
+func (d Download) try(ctx context.Context, progress *downloadProgress) error {
 	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
 	targetDirectory, _ := filepath.Split(targetFile)
 
 	// Show a nice message that we're starting to download the file
 	d.logger.Debug("Downloading %s to %s", d.conf.URL, targetFile)
 
-	request, err := http.NewRequestWithContext(ctx, "GET", d.conf.URL, nil)
-	if err != nil {
-		return err
-	}
-	for k, v := range d.conf.Headers {
-		request.Header.Add(k, v)
+	// Now make the folder for our file
+	if err := downloadDirs.MkdirAll(targetDirectory, d.conf.DirPermissions); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
 	}
 
-	// Start by downloading the file
-	response, err := d.client.Do(request)
-	if err != nil {
-		return fmt.Errorf("Error while downloading %s (%T: %v)", d.conf.URL, err, err)
-	}
-	defer response.Body.Close()
-
-	// Double check the status
-	if response.StatusCode/100 != 2 && response.StatusCode/100 != 3 {
-		if d.conf.DebugHTTP {
-			responseDump, err := httputil.DumpResponse(response, true)
-			if err != nil {
-				d.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
-			} else {
-				d.logger.Debug("\n%s", string(responseDump))
-			}
-		}
+	// Work out the part of the object we want
+	offset, length := int64(0), d.conf.Size
+	if d.conf.Range != nil {
+		offset, length = d.conf.Range.Offset, d.conf.Range.Length
+	}
+	resumable := !d.conf.NoResume && !progress.noResume && length > 0
 
-		return &downloadError{response.Status}
+	if resumable && d.conf.PartSize > 0 && length > d.conf.PartSize {
+		return d.tryParts(ctx, progress, targetFile, offset, length)
 	}
 
-	// Now make the folder for our file
-	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
-	if err := os.MkdirAll(targetDirectory, 0777); err != nil {
-		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	// Start by downloading the file, or the part of it we want
+	var body io.ReadCloser
+	var err error
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch {
+	case resumable && progress.written > 0 && progress.written < length:
+		d.logger.Info("Resuming download of \"%s\" after %s", d.conf.Path, humanize.Bytes(uint64(progress.written)))
+		body, err = d.backend.ReadRange(ctx, d.conf.URL, offset+progress.written, length-progress.written)
+		flags = os.O_WRONLY | os.O_CREATE
+	case d.conf.Range != nil:
+		body, err = d.backend.ReadRange(ctx, d.conf.URL, offset, length)
+	default:
+		body, err = d.backend.Open(ctx, d.conf.URL)
+	}
+	if err != nil {
+		if errors.Is(err, transfer.ErrRangeIgnored) && progress.written > 0 {
+			// Start from the beginning next time
+			progress.noResume = true
+		}
+		return err
 	}
+	defer body.Close()
 
 	// Create a file to handle the file
-	fileBuffer, err := os.Create(targetFile)
+	fileBuffer, err := os.OpenFile(targetFile, flags, 0o666)
 	if err != nil {
 		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
 	}
 	defer fileBuffer.Close()
 
+	if flags&os.O_TRUNC == 0 {
+		if _, err := fileBuffer.Seek(progress.written, io.SeekStart); err != nil {
+			return fmt.Errorf("Failed to resume writing %s (%T: %v)", targetFile, err, err)
+		}
+	} else {
+		// Anything earlier attempts downloaded is downloaded again
+		d.report(-progress.written)
+		progress.written = 0
+	}
+
 	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
+	bytes, err := io.Copy(fileBuffer, d.reader(ctx, body))
+	progress.written += bytes
 	if err != nil {
 		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
 	}
 
-	d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.Bytes(uint64(bytes)))
+	d.logger.Info("Successfully downloaded \"%s\" %s", d.conf.Path, humanize.Bytes(uint64(progress.written)))
+
+	return nil
+}
+
+// tryParts downloads length bytes of the object from offset in parts of
+// PartSize, several at once. Parts downloaded by earlier attempts are kept.
+func (d Download) tryParts(ctx context.Context, progress *downloadProgress, targetFile string, offset, length int64) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if progress.partsDone == nil {
+		progress.partsDone = make([]bool, (length+d.conf.PartSize-1)/d.conf.PartSize)
+		flags |= os.O_TRUNC
+		d.report(-progress.written)
+		progress.written = 0
+	}
+
+	fileBuffer, err := os.OpenFile(targetFile, flags, 0o666)
+	if err != nil {
+		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
+	}
+	defer fileBuffer.Close()
+
+	if err := fileBuffer.Truncate(length); err != nil {
+		return fmt.Errorf("Failed to allocate file %s (%T: %v)", targetFile, err, err)
+	}
+
+	concurrency := d.conf.PartConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadPartConcurrency
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for i, done := range progress.partsDone {
+		if done {
+			continue
+		}
+
+		start := int64(i) * d.conf.PartSize
+		size := d.conf.PartSize
+		if start+size > length {
+			size = length - start
+		}
+
+		wg.Add(1)
+		go func(i int, start, size int64) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			written, err := d.downloadPart(ctx, fileBuffer, offset+start, start, size)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				progress.partsDone[i] = true
+				progress.written += written
+				return
+			}
+
+			// The part is downloaded again from its start
+			d.report(-written)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}(i, start, size)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if errors.Is(firstErr, transfer.ErrRangeIgnored) {
+			// Download it in one go next time
+			progress.noResume = true
+			progress.partsDone = nil
+		}
+		return firstErr
+	}
+
+	if err := fileBuffer.Close(); err != nil {
+		return fmt.Errorf("Failed to write file %s (%T: %v)", targetFile, err, err)
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\" %s in %d parts", d.conf.Path, humanize.Bytes(uint64(length)), len(progress.partsDone))
 
 	return nil
 }
 
-type downloadError struct {
-	s string
+// downloadPart downloads size bytes of the object from offset, and writes
+// them to the file at at. It returns how many bytes it wrote, even if it
+// fails.
+func (d Download) downloadPart(ctx context.Context, f io.WriterAt, offset, at, size int64) (int64, error) {
+	body, err := d.backend.ReadRange(ctx, d.conf.URL, offset, size)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	written, err := io.Copy(&offsetWriter{w: f, off: at}, d.reader(ctx, body))
+	if err != nil {
+		return written, fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+	}
+	if written != size {
+		return written, fmt.Errorf("Downloaded %d bytes of %s from %d, expected %d", written, d.conf.URL, offset, size)
+	}
+	return written, nil
+}
+
+// reader limits how fast the body is read, and reports the progress of
+// reading it
+func (d Download) reader(ctx context.Context, body io.Reader) io.Reader {
+	r := transfer.NewThrottledReader(ctx, body, d.conf.MaxBandwidth)
+	if d.conf.Progress == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: d.conf.Progress}
+}
+
+// report calls Progress with n, if it's set and n isn't zero
+func (d Download) report(n int64) {
+	if d.conf.Progress != nil && n != 0 {
+		d.conf.Progress(n)
+	}
+}
+
+// progressReader calls progress with the number of bytes each read reads
+type progressReader struct {
+	r        io.Reader
+	progress func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.progress(int64(n))
+	}
+	return n, err
+}
+
+// offsetWriter writes to a file from an offset
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
 }
 
-func (e *downloadError) Error() string {
-	return e.s
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
 }
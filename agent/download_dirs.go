@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultDownloadDirPermissions are the permissions that directories created
+// for downloads are given when none are configured. Actual permissions will be
+// reduced by umask, and won't be 0777 unless the user has manually changed the
+// umask to 000.
+const DefaultDownloadDirPermissions os.FileMode = 0777
+
+// downloadDirs is shared by all downloads in the process, so that parallel
+// downloads into the same directory tree don't race each other creating it.
+var downloadDirs = newDirCreator()
+
+// dirCreator creates directories one path component at a time, holding a lock
+// for each path while it creates it, so only one goroutine tries to create a
+// directory at once. Paths share a fixed number of locks, so it doesn't grow
+// with the number of directories it's created. os.MkdirAll copes with most races itself, but on Windows
+// and some network filesystems a directory created by another goroutine can
+// briefly fail to Stat, which MkdirAll reports as an error. It doesn't
+// remember which directories it created, so it always asks the filesystem
+// what's there.
+type dirCreator struct {
+	// The locks paths are hashed to
+	locks [dirCreatorLocks]sync.Mutex
+}
+
+// How many locks a dirCreator shares between paths
+const dirCreatorLocks = 64
+
+func newDirCreator() *dirCreator {
+	return &dirCreator{}
+}
+
+// MkdirAll creates dir and any missing parents. If perm is zero, they're
+// created with DefaultDownloadDirPermissions, less the umask. Otherwise,
+// as the permissions were chosen, directories it creates are chmod-ed to perm
+// afterwards so that the umask doesn't apply.
+func (c *dirCreator) MkdirAll(dir string, perm os.FileMode) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	// Find the directories that need creating, from the top down
+	var missing []string
+	for d := dir; !c.exists(d); d = filepath.Dir(d) {
+		missing = append([]string{d}, missing...)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	for _, d := range missing {
+		if err := c.mkdir(d, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exists reports whether dir is a directory.
+func (c *dirCreator) exists(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// lock returns the lock for dir
+func (c *dirCreator) lock(dir string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(dir))
+	return &c.locks[h.Sum32()%dirCreatorLocks]
+}
+
+func (c *dirCreator) mkdir(dir string, perm os.FileMode) error {
+	lock := c.lock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another goroutine may have created it while this one waited
+	if c.exists(dir) {
+		return nil
+	}
+
+	mode := perm
+	if mode == 0 {
+		mode = DefaultDownloadDirPermissions
+	}
+	err := os.Mkdir(dir, mode)
+	switch {
+	case err == nil:
+		if perm != 0 {
+			if err := os.Chmod(dir, perm); err != nil {
+				return fmt.Errorf("setting permissions on %s: %w", dir, err)
+			}
+		}
+		return nil
+
+	case errors.Is(err, fs.ErrExist):
+		// Something outside this process got there first. Give the
+		// filesystem a moment to agree that it's a directory.
+		return waitForDir(dir)
+
+	default:
+		return err
+	}
+}
+
+func waitForDir(dir string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		var fi os.FileInfo
+		if fi, err = os.Stat(dir); err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s exists and is not a directory", dir)
+			}
+			return nil
+		}
+		time.Sleep(time.Duration(i+1) * 50 * time.Millisecond)
+	}
+	return err
+}
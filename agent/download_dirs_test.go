@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestDirCreatorConcurrentMkdirAll(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	c := newDirCreator()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dir := filepath.Join(root, "a", "b", "c", fmt.Sprintf("d%d", i%5))
+			errs <- c.MkdirAll(dir, 0)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("c.MkdirAll() error = %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		dir := filepath.Join(root, "a", "b", "c", fmt.Sprintf("d%d", i))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("os.Stat(%q) = %v, %v, want a directory", dir, fi, err)
+		}
+	}
+}
+
+func TestDirCreatorPermissions(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("directory permissions aren't supported on Windows")
+	}
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "x", "y")
+
+	if err := newDirCreator().MkdirAll(dir, 0775); err != nil {
+		t.Fatalf("MkdirAll(%q, 0775) error = %v", dir, err)
+	}
+
+	for _, d := range []string{filepath.Join(root, "x"), dir} {
+		fi, err := os.Stat(d)
+		if err != nil {
+			t.Fatalf("os.Stat(%q) error = %v", d, err)
+		}
+		if got := fi.Mode().Perm(); got != 0775 {
+			t.Errorf("os.Stat(%q).Mode().Perm() = %o, want %o", d, got, 0775)
+		}
+	}
+}
+
+func TestDirCreatorFileInTheWay(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, []byte("llamas"), 0666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", file, err)
+	}
+
+	if err := newDirCreator().MkdirAll(filepath.Join(file, "dir"), 0); err == nil {
+		t.Errorf("MkdirAll() under a file error = nil, want an error")
+	}
+}
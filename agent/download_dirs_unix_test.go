@@ -0,0 +1,40 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDirCreatorPermissionsIgnoreUmask(t *testing.T) {
+	// The umask is the process's, so this can't run in parallel
+	old := syscall.Umask(0o022)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	root := t.TempDir()
+
+	// Configured permissions are used as they are, even 0777
+	configured := filepath.Join(root, "configured")
+	if err := newDirCreator().MkdirAll(configured, 0777); err != nil {
+		t.Fatalf("MkdirAll(%q, 0777) error = %v", configured, err)
+	}
+
+	// Otherwise the umask applies
+	unset := filepath.Join(root, "unset")
+	if err := newDirCreator().MkdirAll(unset, 0); err != nil {
+		t.Fatalf("MkdirAll(%q, 0) error = %v", unset, err)
+	}
+
+	for dir, want := range map[string]os.FileMode{configured: 0777, unset: 0755} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("os.Stat(%q) error = %v", dir, err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("os.Stat(%q).Mode().Perm() = %o, want %o", dir, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/roko"
+)
+
+// DefaultDownloadRetries is how many times an artifact download is tried
+// before it fails
+const DefaultDownloadRetries = 5
+
+const (
+	// RetryStrategyConstant waits the same interval between each attempt
+	RetryStrategyConstant = "constant"
+
+	// RetryStrategyExponential waits the interval in seconds to the power of
+	// how many attempts there have been, so 2s waits 1, 2, 4, 8... seconds
+	RetryStrategyExponential = "exponential"
+)
+
+// The base of exponential backoff when no interval is given
+const defaultExponentialRetryInterval = 2 * time.Second
+
+// RetryConfig is how a download that fails is tried again
+type RetryConfig struct {
+	// How many times to try, including the first. If zero, the download's
+	// Retries is used
+	MaxAttempts int
+
+	// RetryStrategyConstant or RetryStrategyExponential. If empty, it's
+	// constant
+	Strategy string
+
+	// The interval between attempts, or the base of exponential backoff,
+	// which must be at least a second. If zero, a default is used
+	Interval time.Duration
+
+	// Whether to add up to a second of random jitter to each wait, so
+	// downloads that failed together don't all try again together
+	Jitter bool
+
+	// How long each attempt can take before it's abandoned and tried again.
+	// If zero, there is no limit
+	AttemptTimeout time.Duration
+}
+
+// ParseRetryBackoff parses a retry strategy with an optional interval, such as
+// "constant", "exponential" or "exponential:3s"
+func ParseRetryBackoff(s string) (strategy string, interval time.Duration, err error) {
+	strategy, after, hasInterval := strings.Cut(strings.TrimSpace(s), ":")
+	if strategy != RetryStrategyConstant && strategy != RetryStrategyExponential {
+		return "", 0, fmt.Errorf("invalid retry backoff %q, expected %s or %s, optionally with an interval like %s:3s", s, RetryStrategyConstant, RetryStrategyExponential, RetryStrategyExponential)
+	}
+	if !hasInterval {
+		return strategy, 0, nil
+	}
+
+	interval, err = time.ParseDuration(after)
+	if err != nil || interval <= 0 {
+		return "", 0, fmt.Errorf("invalid retry backoff interval %q", after)
+	}
+	if strategy == RetryStrategyExponential && interval < time.Second {
+		return "", 0, fmt.Errorf("invalid retry backoff interval %q, exponential backoff needs at least 1s", after)
+	}
+	return strategy, interval, nil
+}
+
+// retrier returns a retrier for the config, which tries retries times unless
+// the config has its own MaxAttempts
+func (c RetryConfig) retrier(retries int) *roko.Retrier {
+	if c.MaxAttempts > 0 {
+		retries = c.MaxAttempts
+	}
+
+	var strategy roko.Strategy
+	var strategyType string
+	switch c.Strategy {
+	case RetryStrategyExponential:
+		interval := c.Interval
+		if interval == 0 {
+			interval = defaultExponentialRetryInterval
+		}
+		if interval < time.Second {
+			interval = time.Second
+		}
+		strategy, strategyType = roko.Exponential(interval, 0)
+	default:
+		interval := c.Interval
+		if interval == 0 {
+			interval = downloadRetryInterval
+		}
+		strategy, strategyType = roko.Constant(interval)
+	}
+
+	if c.Jitter {
+		return roko.NewRetrier(
+			roko.WithMaxAttempts(retries),
+			roko.WithStrategy(strategy, strategyType),
+			roko.WithJitter(),
+		)
+	}
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(retries),
+		roko.WithStrategy(strategy, strategyType),
+	)
+}
+
+// attempt runs f with the per-attempt timeout, if there is one
+func (c RetryConfig) attempt(ctx context.Context, f func(context.Context) error) error {
+	if c.AttemptTimeout <= 0 {
+		return f(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.AttemptTimeout)
+	defer cancel()
+	if err := f(ctx); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("attempt timed out after %s: %w", c.AttemptTimeout, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		backoff  string
+		strategy string
+		interval time.Duration
+	}{
+		{"constant", RetryStrategyConstant, 0},
+		{"constant:500ms", RetryStrategyConstant, 500 * time.Millisecond},
+		{"exponential", RetryStrategyExponential, 0},
+		{"exponential:3s", RetryStrategyExponential, 3 * time.Second},
+	} {
+		strategy, interval, err := ParseRetryBackoff(test.backoff)
+		require.NoError(t, err, "ParseRetryBackoff(%q)", test.backoff)
+		assert.Equal(t, test.strategy, strategy, "ParseRetryBackoff(%q) strategy", test.backoff)
+		assert.Equal(t, test.interval, interval, "ParseRetryBackoff(%q) interval", test.backoff)
+	}
+
+	for _, backoff := range []string{"", "linear", "constant:", "constant:soon", "constant:-1s", "exponential:500ms"} {
+		_, _, err := ParseRetryBackoff(backoff)
+		assert.Error(t, err, "ParseRetryBackoff(%q)", backoff)
+	}
+}
+
+func TestDownloadAttemptTimeout(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+
+		// The first attempt hangs until it's abandoned
+		if first {
+			<-req.Context().Done()
+			return
+		}
+		fmt.Fprint(rw, "llamas")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL + "/artifact.txt",
+		Destination: dir,
+		Path:        "artifact.txt",
+		Retries:     1,
+		Retry: RetryConfig{
+			MaxAttempts:    2,
+			Interval:       time.Millisecond,
+			AttemptTimeout: 100 * time.Millisecond,
+		},
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(dir, "artifact.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(got))
+	assert.Equal(t, 2, requests)
+}
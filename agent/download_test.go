@@ -4,8 +4,20 @@
 package agent
 
 import (
-	"github.com/stretchr/testify/assert"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetTargetPath(t *testing.T) {
@@ -51,3 +63,253 @@ func TestGetTargetPath(t *testing.T) {
 	assert.Equal(t, "foo/app/logs/a.log", getTargetPath("app/logs/a.log", "foo/app"))
 	assert.Equal(t, "app/logs/a.log", getTargetPath("app/logs/a.log", "."))
 }
+
+func TestParseByteRange(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    *ByteRange
+		wantErr bool
+	}{
+		{in: "0-1023", want: &ByteRange{Offset: 0, Length: 1024}},
+		{in: "100-100", want: &ByteRange{Offset: 100, Length: 1}},
+		{in: " 5 - 9 ", want: &ByteRange{Offset: 5, Length: 5}},
+		{in: "1023", wantErr: true},
+		{in: "-10", wantErr: true},
+		{in: "10-", wantErr: true},
+		{in: "10-5", wantErr: true},
+		{in: "a-b", wantErr: true},
+	} {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := ParseByteRange(test.in)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	const contents = "0123456789abcdefghij"
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var first, last int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, contents)
+			return
+		}
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(contents)))
+		rw.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(rw, contents[first:last+1])
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL + "/artifact.txt",
+		Destination: dir,
+		Path:        "artifact.txt",
+		Retries:     1,
+		Range:       &ByteRange{Offset: 10, Length: 5},
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(dir, "artifact.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "abcde", string(got))
+}
+
+func TestDownloadResumes(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	const contents = "0123456789abcdefghij"
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Send half the file, then drop the connection
+			rw.Header().Set("Content-Length", fmt.Sprint(len(contents)))
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, contents[:10])
+			rw.(http.Flusher).Flush()
+			conn, _, _ := rw.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(rw, req, "artifact.txt", time.Time{}, strings.NewReader(contents))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL + "/artifact.txt",
+		Destination: dir,
+		Path:        "artifact.txt",
+		Retries:     2,
+		Size:        int64(len(contents)),
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"", "bytes=10-19"}, ranges)
+
+	got, err := os.ReadFile(filepath.Join(dir, "artifact.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(got))
+}
+
+func TestDownloadProgressCountsRetriedBytesOnce(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	const contents = "0123456789abcdefghij"
+
+	for _, test := range []struct {
+		name string
+		conf DownloadConfig
+		// The range of the request that drops the connection the first time
+		failRange string
+	}{
+		{
+			name:      "starting again",
+			conf:      DownloadConfig{NoResume: true},
+			failRange: "",
+		},
+		{
+			name:      "in parts",
+			conf:      DownloadConfig{PartSize: 8},
+			failRange: "bytes=8-15",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			failed := false
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				fail := !failed && req.Header.Get("Range") == test.failRange
+				failed = failed || fail
+				mu.Unlock()
+
+				if fail {
+					// Send some of it, then drop the connection
+					rw.Header().Set("Content-Length", "8")
+					rw.WriteHeader(http.StatusPartialContent)
+					fmt.Fprint(rw, contents[:4])
+					rw.(http.Flusher).Flush()
+					conn, _, _ := rw.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				http.ServeContent(rw, req, "artifact.txt", time.Time{}, strings.NewReader(contents))
+			}))
+			defer server.Close()
+
+			var progress int64
+			conf := test.conf
+			conf.URL = server.URL + "/artifact.txt"
+			conf.Destination = t.TempDir()
+			conf.Path = "artifact.txt"
+			conf.Retries = 2
+			conf.Size = int64(len(contents))
+			conf.Progress = func(n int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				progress += n
+			}
+
+			err := NewDownload(logger.Discard, http.DefaultClient, conf).Start(context.Background())
+			require.NoError(t, err)
+
+			assert.True(t, failed, "a request failed")
+			assert.Equal(t, int64(len(contents)), progress, "bytes reported")
+		})
+	}
+}
+
+func TestDownloadInParts(t *testing.T) {
+	defer func(interval time.Duration) { downloadRetryInterval = interval }(downloadRetryInterval)
+	downloadRetryInterval = time.Millisecond
+
+	const contents = "0123456789abcdefghij"
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests[req.Header.Get("Range")]++
+		failed := req.Header.Get("Range") == "bytes=8-15" && requests["bytes=8-15"] == 1
+		mu.Unlock()
+
+		// The second part fails the first time
+		if failed {
+			http.Error(rw, "Oops", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(rw, req, "artifact.txt", time.Time{}, strings.NewReader(contents))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL + "/artifact.txt",
+		Destination: dir,
+		Path:        "artifact.txt",
+		Retries:     2,
+		Size:        int64(len(contents)),
+		PartSize:    8,
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	// Only the part that failed is downloaded again
+	assert.Equal(t, map[string]int{"bytes=0-7": 1, "bytes=8-15": 2, "bytes=16-19": 1}, requests)
+
+	got, err := os.ReadFile(filepath.Join(dir, "artifact.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(got))
+}
+
+func TestDownloadInPartsLimitsConcurrency(t *testing.T) {
+	const contents = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	var mu sync.Mutex
+	var active, most int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		active++
+		if active > most {
+			most = active
+		}
+		mu.Unlock()
+
+		// Hold each part long enough for the others to start
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		http.ServeContent(rw, req, "artifact.txt", time.Time{}, strings.NewReader(contents))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:             server.URL + "/artifact.txt",
+		Destination:     dir,
+		Path:            "artifact.txt",
+		Retries:         1,
+		Size:            int64(len(contents)),
+		PartSize:        4,
+		PartConcurrency: 2,
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, most, "most parts downloaded at once")
+
+	got, err := os.ReadFile(filepath.Join(dir, "artifact.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(got))
+}
@@ -18,7 +18,10 @@ import (
 	"os"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/chaos"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
 )
 
 var ArtifactPathVariableRegex = regexp.MustCompile("\\$\\{artifact\\:path\\}")
@@ -93,7 +96,7 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	}
 
 	// Create the client
-	client := &http.Client{}
+	client := storagetags.Client(chaos.Client(chaos.Artifacts, storageproxy.Client(&http.Client{})))
 
 	// Perform the request
 	u.logger.Debug("%s %s", request.Method, request.URL)
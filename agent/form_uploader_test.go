@@ -9,6 +9,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
 
 	"github.com/buildkite/agent/v3/api"
@@ -176,3 +178,105 @@ func TestFormUploadTooBig(t *testing.T) {
 		t.Errorf("uploader.Upload(artifact) = %v, want errArtifactTooLarge", err)
 	}
 }
+
+func TestFormUploadStreamsLargeFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads several gigabytes over loopback")
+	}
+
+	// Larger than fits in an int32, but under the 5Gb form upload limit
+	const size = int64(3 << 30) // 3Gb
+
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ContentLength <= size {
+			http.Error(rw, fmt.Sprintf("Content-Length = %d, want more than %d", req.ContentLength, size), http.StatusBadRequest)
+			return
+		}
+
+		mr, err := req.MultipartReader()
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("req.MultipartReader() error = %v", err), http.StatusBadRequest)
+			return
+		}
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("mr.NextPart() error = %v", err), http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "file" {
+				continue
+			}
+
+			n, err := io.Copy(io.Discard, part)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("io.Copy() error = %v", err), http.StatusBadRequest)
+				return
+			}
+			atomic.StoreInt64(&received, n)
+		}
+	}))
+	defer server.Close()
+
+	// A sparse file takes up no disk space, but reads back as zeroes
+	abspath := filepath.Join(t.TempDir(), "llamas.bin")
+	f, err := os.Create(abspath)
+	if err != nil {
+		t.Fatalf("os.Create(%q) error = %v", abspath, err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		t.Fatalf("f.Truncate(%d) error = %v", size, err)
+	}
+	f.Close()
+
+	uploader := NewFormUploader(logger.Discard, FormUploaderConfig{})
+	artifact := &api.Artifact{
+		ID:           "xxxxx-xxxx-xxxx-xxxx-xxxxxxxxxx",
+		Path:         "llamas.bin",
+		AbsolutePath: abspath,
+		GlobPath:     "llamas.bin",
+		ContentType:  "application/octet-stream",
+		FileSize:     size,
+		UploadInstructions: &api.ArtifactUploadInstructions{
+			Data: map[string]string{
+				"path": "${artifact:path}",
+			},
+			Action: struct {
+				URL       string "json:\"url,omitempty\""
+				Method    string "json:\"method\""
+				Path      string "json:\"path\""
+				FileInput string "json:\"file_input\""
+			}{
+				URL:       server.URL,
+				Method:    "POST",
+				Path:      "buildkiteartifacts.com",
+				FileInput: "file",
+			}},
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	if err := uploader.Upload(artifact); err != nil {
+		t.Fatalf("uploader.Upload(artifact) = %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if got := atomic.LoadInt64(&received); got != size {
+		t.Errorf("server received %d bytes of file, want %d", got, size)
+	}
+
+	// If the body were buffered, allocations would be at least the size of
+	// the file. Streaming should only need a few small copy buffers.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 256<<20 {
+		t.Errorf("uploading a %d byte file allocated %d bytes, want it streamed with bounded buffering", size, allocated)
+	}
+}
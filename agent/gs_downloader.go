@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
 
 	"github.com/buildkite/agent/v3/logger"
@@ -24,8 +26,44 @@ type GSDownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with
+	DirPermissions os.FileMode
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// If set, it's called with the number of bytes downloaded as they are
+	Progress func(int64)
+
+	// The size of the file, if known, so a failed download can be resumed
+	Size int64
+
+	// If set, a failed download starts again from the beginning
+	NoResume bool
+
+	// The client that requests to Google Cloud Storage, and for its tokens,
+	// are sent with, such as one that goes through a proxy. If nil, they only
+	// go through an artifact storage proxy, if there is one
+	HTTPClient *http.Client
+
+	// A credentials file to authenticate with, which can be a service
+	// account key or workload identity federation config. If empty, the
+	// credentials in the environment are used
+	CredentialsFile string
+
+	// The URL of a server compatible with the Cloud Storage JSON API to
+	// download from, such as an emulator. If empty, it's Google's, unless
+	// BUILDKITE_GCS_ENDPOINT or STORAGE_EMULATOR_HOST say otherwise
+	Endpoint string
 }
 
 type GSDownloader struct {
@@ -44,20 +82,27 @@ func NewGSDownloader(l logger.Logger, c GSDownloaderConfig) *GSDownloader {
 }
 
 func (d GSDownloader) Start(ctx context.Context) error {
-	client, err := newGoogleClient(storage.DevstorageReadOnlyScope)
+	client, err := newGoogleClient(ctx, storage.DevstorageReadOnlyScope, d.conf.CredentialsFile, d.conf.HTTPClient)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
 
-	url := "https://www.googleapis.com/storage/v1/b/" + d.BucketName() + "/o/" + escape(d.BucketFileLocation()) + "?alt=media"
+	url := gcsAPIBase(d.conf.Endpoint) + "/storage/v1/b/" + d.BucketName() + "/o/" + escape(d.BucketFileLocation()) + "?alt=media"
 
 	// We can now cheat and pass the URL onto our regular downloader
 	return NewDownload(d.logger, client, DownloadConfig{
-		URL:         url,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+		URL:            url,
+		Path:           d.conf.Path,
+		Destination:    d.conf.Destination,
+		Retries:        d.conf.Retries,
+		Retry:          d.conf.Retry,
+		DirPermissions: d.conf.DirPermissions,
+		DebugHTTP:      d.conf.DebugHTTP,
+		Range:          d.conf.Range,
+		MaxBandwidth:   d.conf.MaxBandwidth,
+		Progress:       d.conf.Progress,
+		Size:           d.conf.Size,
+		NoResume:       d.conf.NoResume,
 	}).Start(ctx)
 }
 
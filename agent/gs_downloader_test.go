@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testutil"
+)
+
+func TestGSDownloaderCredentialsFileAndEndpoint(t *testing.T) {
+	server := testutil.NewGCSServer("my-bucket")
+	defer server.Close()
+	server.PutObject("my-bucket", "builds/1/llamas.txt", []byte("llamas\n"))
+
+	env, err := server.Env()
+	if err != nil {
+		t.Fatalf("server.Env() error = %v", err)
+	}
+	credentials := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(credentials, []byte(env["BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON"]), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	// Nothing in the environment says where to download from, or how
+	t.Setenv("BUILDKITE_GCS_ENDPOINT", "")
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+
+	downloads := t.TempDir()
+	if err := NewGSDownloader(logger.Discard, GSDownloaderConfig{
+		Bucket:          "gs://my-bucket/builds/1",
+		Destination:     downloads,
+		Path:            "llamas.txt",
+		Retries:         1,
+		CredentialsFile: credentials,
+		Endpoint:        server.URL,
+	}).Start(context.Background()); err != nil {
+		t.Fatalf("downloader.Start() error = %v", err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(downloads, "llamas.txt")); err != nil || string(got) != "llamas\n" {
+		t.Errorf("os.ReadFile() = %q, %v, want %q", got, err, "llamas\n")
+	}
+}
+
+func TestGSDownloaderEmulatorHost(t *testing.T) {
+	server := testutil.NewGCSServer("my-bucket")
+	defer server.Close()
+	server.PutObject("my-bucket", "llamas.txt", []byte("llamas\n"))
+
+	// Emulators are used without credentials
+	t.Setenv("BUILDKITE_GCS_ENDPOINT", "")
+	t.Setenv("BUILDKITE_GS_APPLICATION_CREDENTIALS", "")
+	t.Setenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON", "")
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	downloads := t.TempDir()
+	if err := NewGSDownloader(logger.Discard, GSDownloaderConfig{
+		Bucket:      "gs://my-bucket",
+		Destination: downloads,
+		Path:        "llamas.txt",
+		Retries:     1,
+	}).Start(context.Background()); err != nil {
+		t.Fatalf("downloader.Start() error = %v", err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(downloads, "llamas.txt")); err != nil || string(got) != "llamas\n" {
+		t.Errorf("os.ReadFile() = %q, %v, want %q", got, err, "llamas\n")
+	}
+}
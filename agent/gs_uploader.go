@@ -11,7 +11,11 @@ import (
 	"strings"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/chaos"
+	"github.com/buildkite/agent/v3/destination"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
@@ -45,7 +49,7 @@ type GSUploader struct {
 }
 
 func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
-	client, err := newGoogleClient(storage.DevstorageFullControlScope)
+	client, err := newGoogleClient(context.Background(), storage.DevstorageFullControlScope, "", nil)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
@@ -53,7 +57,14 @@ func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
 	if err != nil {
 		return nil, err
 	}
-	bucketName, bucketPath := ParseGSDestination(c.Destination)
+	if base := gcsAPIBase(""); base != defaultGCSAPIBase {
+		service.BasePath = base + "/storage/v1/"
+	}
+	dest, err := destination.Parse(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	bucketName, bucketPath := dest.Bucket, dest.Path
 	return &GSUploader{
 		BucketPath: bucketPath,
 		BucketName: bucketName,
@@ -63,6 +74,41 @@ func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
 	}, nil
 }
 
+// An optional URL of a server compatible with the Google Cloud Storage JSON
+// API, such as fake-gcs-server, that's used instead of Google's
+const gcsEndpointEnvVar = "BUILDKITE_GCS_ENDPOINT"
+
+const defaultGCSAPIBase = "https://www.googleapis.com"
+
+// The host and port of a Cloud Storage emulator, as used by Google's own
+// client libraries. Requests to it aren't authenticated
+const gcsEmulatorHostEnvVar = "STORAGE_EMULATOR_HOST"
+
+// gcsAPIBase returns the base URL of the Cloud Storage JSON API, which
+// objects are uploaded to and downloaded from. An endpoint given in config
+// takes precedence over the environment.
+func gcsAPIBase(endpoint string) string {
+	if endpoint == "" {
+		endpoint = os.Getenv(gcsEndpointEnvVar)
+	}
+	if endpoint == "" {
+		if host := os.Getenv(gcsEmulatorHostEnvVar); host != "" {
+			endpoint = host
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+		}
+	}
+	if endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return defaultGCSAPIBase
+}
+
+// ParseGSDestination splits a gs://bucket/path destination into its bucket
+// and path.
+//
+// Deprecated: Use destination.Parse, which also reports invalid destinations.
 func ParseGSDestination(destination string) (name string, path string) {
 	parts := strings.Split(strings.TrimPrefix(string(destination), "gs://"), "/")
 	path = strings.Join(parts[1:], "/")
@@ -70,26 +116,77 @@ func ParseGSDestination(destination string) (name string, path string) {
 	return
 }
 
-func clientFromJSON(data []byte, scope string) (*http.Client, error) {
-	conf, err := google.JWTConfigFromJSON(data, scope)
+// clientFromJSON returns a client authenticated with a credentials file,
+// which can be a service account key, or the configuration of workload
+// identity federation, which exchanges a token from another identity
+// provider, such as an OIDC token, for Google credentials
+func clientFromJSON(data []byte, scope string, base *http.Client) (*http.Client, error) {
+	ctx := googleClientContext(base)
+	creds, err := google.CredentialsFromJSON(ctx, data, scope)
 	if err != nil {
 		return nil, err
 	}
-	return conf.Client(oauth2.NoContext), nil
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
 }
 
-func newGoogleClient(scope string) (*http.Client, error) {
-	if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON") != "" {
+// googleClientContext returns a context for making Google clients with, which
+// sends their requests, and those for their tokens, with base, or if it's nil,
+// through an artifact storage proxy if there is one
+func googleClientContext(base *http.Client) context.Context {
+	if base == nil {
+		base = storageproxy.Client(&http.Client{})
+	}
+	return context.WithValue(context.Background(), oauth2.HTTPClient, base)
+}
+
+// newGoogleClient returns an HTTP client authenticated for Google Cloud
+// Storage, with the credentials file if one is given, and otherwise with the
+// credentials in the environment. Looking for default credentials can mean
+// waiting on the GCE metadata server, so it gives up after
+// BUILDKITE_STORAGE_CLIENT_TIMEOUT. Its requests are sent with base, such as
+// one that goes through a proxy, if it isn't nil.
+func newGoogleClient(ctx context.Context, scope, credentialsFile string, base *http.Client) (*http.Client, error) {
+	stage := &clientStage{stage: "finding Google Cloud credentials"}
+
+	var client *http.Client
+	err := withClientTimeout(ctx, "a Google Cloud Storage client", stage, func(context.Context) error {
+		var err error
+		client, err = googleClient(scope, credentialsFile, base, stage)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storagetags.Client(chaos.Client(chaos.Artifacts, client)), nil
+}
+
+func googleClient(scope, credentialsFile string, base *http.Client, stage *clientStage) (*http.Client, error) {
+	if credentialsFile != "" {
+		data, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		return clientFromJSON(data, scope, base)
+	} else if hasCredentialHelper() {
+		ctx := context.Background()
+		return oauth2.NewClient(googleClientContext(base), oauth2.ReuseTokenSource(nil, credentialHelperTokenSource{ctx: ctx})), nil
+	} else if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON") != "" {
 		data := []byte(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON"))
-		return clientFromJSON(data, scope)
+		return clientFromJSON(data, scope, base)
 	} else if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS") != "" {
 		data, err := os.ReadFile(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"))
 		if err != nil {
 			return nil, err
 		}
-		return clientFromJSON(data, scope)
+		return clientFromJSON(data, scope, base)
+	} else if os.Getenv(gcsEmulatorHostEnvVar) != "" {
+		if base != nil {
+			return base, nil
+		}
+		return storageproxy.Client(&http.Client{}), nil
 	}
-	return google.DefaultClient(context.Background(), scope)
+	stage.set("finding Google Cloud application default credentials, which can mean asking the GCE metadata server")
+	return google.DefaultClient(googleClientContext(base), scope)
 }
 
 func (u *GSUploader) URL(artifact *api.Artifact) string {
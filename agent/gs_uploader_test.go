@@ -1,7 +1,14 @@
 package agent
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testutil"
 )
 
 func TestParseGSDestination(t *testing.T) {
@@ -26,3 +33,58 @@ func TestParseGSDestination(t *testing.T) {
 		}
 	}
 }
+
+func TestGSUploadAndDownload(t *testing.T) {
+	server := testutil.NewGCSServer("my-bucket")
+	defer server.Close()
+	env, err := server.Env()
+	if err != nil {
+		t.Fatalf("server.Env() error = %v", err)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("llamas\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	uploader, err := NewGSUploader(logger.Discard, GSUploaderConfig{Destination: "gs://my-bucket/builds/1"})
+	if err != nil {
+		t.Fatalf("NewGSUploader() error = %v", err)
+	}
+	if err := uploader.Upload(&api.Artifact{
+		Path:         "dir/llamas.txt",
+		AbsolutePath: filepath.Join(dir, "llamas.txt"),
+		ContentType:  "text/plain",
+	}); err != nil {
+		t.Fatalf("uploader.Upload() error = %v", err)
+	}
+
+	obj, ok := server.Object("my-bucket", "builds/1/dir/llamas.txt")
+	if !ok {
+		t.Fatalf("object wasn't uploaded, bucket has %q", server.Names("my-bucket"))
+	}
+	if obj.ContentType != "text/plain" {
+		t.Errorf("obj.ContentType = %q, want %q", obj.ContentType, "text/plain")
+	}
+
+	downloads := t.TempDir()
+	if err := NewGSDownloader(logger.Discard, GSDownloaderConfig{
+		Bucket:      "gs://my-bucket/builds/1",
+		Destination: downloads,
+		Path:        "dir/llamas.txt",
+		Retries:     1,
+	}).Start(context.Background()); err != nil {
+		t.Fatalf("downloader.Start() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(downloads, "dir", "llamas.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	if string(got) != "llamas\n" {
+		t.Errorf("downloaded %q, want %q", got, "llamas\n")
+	}
+}
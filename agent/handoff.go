@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The messages agents send each other over the handoff socket
+const (
+	handoffRequest  = "handoff"
+	handoffAccepted = "ok"
+)
+
+// How long an agent waits for a newer one to say what it wants
+const handoffReadTimeout = 10 * time.Second
+
+// ErrNoHandoff is returned by RequestHandoff when there's no agent listening
+// on the handoff socket to take over from
+var ErrNoHandoff = errors.New("no agent is listening for a handoff")
+
+// RequestHandoff asks the agent listening on the handoff socket at path to
+// hand over to this one, such as when a new version of the agent is started
+// alongside the old one. Once it returns, the old agent has stopped accepting
+// jobs, will exit once the jobs it's running have finished, and has left the
+// socket for this agent to listen on. It returns the old agent's process ID.
+func RequestHandoff(ctx context.Context, path string) (int, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		// Either nothing's there, or the socket was left behind by an agent
+		// that's gone
+		return 0, ErrNoHandoff
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(conn, "%s %d\n", handoffRequest, os.Getpid()); err != nil {
+		return 0, fmt.Errorf("requesting a handoff: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("waiting for the handoff: %w", err)
+	}
+	var pid int
+	if _, err := fmt.Sscanf(reply, handoffAccepted+" %d", &pid); err != nil {
+		return 0, fmt.Errorf("unexpected reply to the handoff %q", strings.TrimSpace(reply))
+	}
+	return pid, nil
+}
+
+// HandoffListener listens on the handoff socket for a newer agent asking to
+// take over from this one
+type HandoffListener struct {
+	logger          logger.Logger
+	path            string
+	jobCgroupParent string
+	listener        net.Listener
+	close           sync.Once
+	handoff         func(pid int)
+}
+
+// ListenForHandoff listens on the handoff socket at path, replacing any left
+// behind by an agent that's gone, and calls handoff with the process ID of the
+// agent that asks to take over. handoff should stop accepting jobs, and the
+// listener is closed before it's called.
+//
+// Only the user the agent runs as can connect to the socket, which is often
+// the user its jobs run as too, so requests from the agent's jobs are
+// refused: those from its descendants, and, if jobCgroupParent is set, from
+// the cgroups of its jobs, which is where their daemonized processes are.
+// It's only supported on Linux, where the process that asked can be found.
+func ListenForHandoff(l logger.Logger, path, jobCgroupParent string, handoff func(pid int)) (*HandoffListener, error) {
+	// The socket is created in a directory only this user can reach, and is
+	// only moved to path once its permissions are set, so there's no moment
+	// when another user could connect to it
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".handoff")
+	if err != nil {
+		return nil, fmt.Errorf("creating directory for handoff socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("listening on handoff socket: %w", err)
+	}
+
+	// The socket is removed by Close, as it's no longer at the path it was
+	// created at
+	if ul, ok := listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting permissions on handoff socket: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		listener.Close()
+		return nil, fmt.Errorf("removing old handoff socket: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("moving handoff socket into place: %w", err)
+	}
+
+	h := &HandoffListener{logger: l, path: path, jobCgroupParent: jobCgroupParent, listener: listener, handoff: handoff}
+	go h.serve()
+	return h, nil
+}
+
+// Close stops listening for a handoff, and removes the socket. Once it's been
+// closed, the socket is left alone, as an agent that's taken over from this
+// one may be listening on it by then.
+func (h *HandoffListener) Close() error {
+	err := net.ErrClosed
+	h.close.Do(func() {
+		err = h.listener.Close()
+		if rmErr := os.Remove(h.path); err == nil && !errors.Is(rmErr, os.ErrNotExist) {
+			err = rmErr
+		}
+	})
+	return err
+}
+
+func (h *HandoffListener) serve() {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		if h.handle(conn) {
+			return
+		}
+	}
+}
+
+// handle handles a connection to the handoff socket, and reports whether it
+// handed off
+func (h *HandoffListener) handle(conn net.Conn) bool {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handoffReadTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		h.logger.Warn("Couldn't read a handoff request: %v", err)
+		return false
+	}
+	var pid int
+	if _, err := fmt.Sscanf(line, handoffRequest+" %d", &pid); err != nil {
+		h.logger.Warn("Ignoring an unexpected handoff request %q", strings.TrimSpace(line))
+		return false
+	}
+	if err := h.checkPeer(conn, pid); err != nil {
+		h.logger.Warn("Refusing a handoff request from process %d: %v", pid, err)
+		return false
+	}
+
+	// Free the socket before replying, so the new agent can listen on it as
+	// soon as it hears back
+	h.Close()
+	h.handoff(pid)
+
+	if _, err := fmt.Fprintf(conn, "%s %d\n", handoffAccepted, os.Getpid()); err != nil {
+		h.logger.Warn("Couldn't tell agent process %d the handoff is done: %v", pid, err)
+	}
+	return true
+}
+
+// checkPeer checks that the process connected to the socket is the one it
+// says it is, and isn't one of this agent's jobs, which could otherwise stop
+// the agent from accepting any more
+func (h *HandoffListener) checkPeer(conn net.Conn, pid int) error {
+	peer, err := handoffPeer(conn)
+	if err != nil {
+		return err
+	}
+	if peer != pid {
+		return fmt.Errorf("it was sent by process %d", peer)
+	}
+	job, err := isJobProcess(peer, h.jobCgroupParent)
+	if err != nil {
+		return fmt.Errorf("couldn't check it isn't from a job: %w", err)
+	}
+	if job {
+		return errors.New("it's from one of this agent's jobs")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cgroup"
+	"golang.org/x/sys/unix"
+)
+
+// handoffPeer returns the process ID of what's connected to the handoff
+// socket, as the kernel reports it, rather than what it claims to be
+func handoffPeer(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("%T isn't a unix socket", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Pid), nil
+}
+
+// isJobProcess reports whether a process was started by one of this agent's
+// jobs, either because it's descended from the agent, or because it's in a
+// job's cgroup, which is where the processes that a job daemonized end up.
+func isJobProcess(pid int, jobCgroupParent string) (bool, error) {
+	if jobCgroupParent != "" {
+		path, err := cgroup.Of(pid)
+		if err != nil {
+			return false, err
+		}
+		if rel, err := filepath.Rel(jobCgroupParent, path); err == nil && strings.HasPrefix(rel, jobCgroupPrefix) {
+			return true, nil
+		}
+	}
+
+	self := os.Getpid()
+	for pid > 1 {
+		ppid, err := parentPID(pid)
+		if err != nil {
+			return false, err
+		}
+		if ppid == self {
+			return true, nil
+		}
+		pid = ppid
+	}
+	return false, nil
+}
+
+// parentPID reads the parent of a process from /proc/<pid>/stat, whose
+// fourth field is the parent's process ID. The second is the command in
+// parentheses, which can itself contain spaces and parentheses.
+func parentPID(pid int) (int, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("unexpected contents of /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected contents of /proc/%d/stat", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
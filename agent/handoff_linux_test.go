@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestIsJobProcess(t *testing.T) {
+	t.Parallel()
+
+	// A process this one started, as a job would be
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("cmd.Start() error = %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	if job, err := isJobProcess(cmd.Process.Pid, ""); err != nil || !job {
+		t.Errorf("isJobProcess(child) = (%t, %v), want (true, nil)", job, err)
+	}
+	if job, err := isJobProcess(os.Getpid(), ""); err != nil || job {
+		t.Errorf("isJobProcess(self) = (%t, %v), want (false, nil)", job, err)
+	}
+}
+
+func TestParentPID(t *testing.T) {
+	t.Parallel()
+
+	ppid, err := parentPID(os.Getpid())
+	if err != nil {
+		t.Fatalf("parentPID() error = %v", err)
+	}
+	if ppid != os.Getppid() {
+		t.Errorf("parentPID() = %d, want %d", ppid, os.Getppid())
+	}
+}
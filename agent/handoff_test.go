@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestHandoff(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("handoffs are only supported on Linux")
+	}
+
+	// Socket paths have to be short, which test directories often aren't
+	dir, err := os.MkdirTemp("", "handoff")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := RequestHandoff(ctx, path); !errors.Is(err, ErrNoHandoff) {
+		t.Fatalf("RequestHandoff() with no agent error = %v, want ErrNoHandoff", err)
+	}
+
+	handedOff := make(chan int, 1)
+	old, err := ListenForHandoff(logger.Discard, path, "", func(pid int) { handedOff <- pid })
+	if err != nil {
+		t.Fatalf("ListenForHandoff() error = %v", err)
+	}
+	defer old.Close()
+
+	// Only this user can connect to the socket, and nothing else is left in
+	// its directory
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) error = %v", path, err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+		t.Errorf("handoff socket permissions = %v, want 0600", info.Mode().Perm())
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("os.ReadDir(%q) = %v, %v, want just the socket", dir, entries, err)
+	}
+
+	pid, err := RequestHandoff(ctx, path)
+	if err != nil {
+		t.Fatalf("RequestHandoff() error = %v", err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("RequestHandoff() = %d, want %d", pid, os.Getpid())
+	}
+	select {
+	case got := <-handedOff:
+		if got != os.Getpid() {
+			t.Errorf("handed off to %d, want %d", got, os.Getpid())
+		}
+	default:
+		t.Errorf("RequestHandoff() returned before the old agent handed off")
+	}
+
+	// The new agent can listen on the socket, and the old one is gone
+	replacement, err := ListenForHandoff(logger.Discard, path, "", func(int) {})
+	if err != nil {
+		t.Fatalf("ListenForHandoff() after the handoff error = %v", err)
+	}
+	defer replacement.Close()
+	if _, err := RequestHandoff(ctx, path); err != nil {
+		t.Errorf("RequestHandoff() to the new agent error = %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,8 +20,13 @@ type headerTimesStreamer struct {
 	// upload
 	uploadCallback func(context.Context, int, int, map[string]string)
 
-	// The times that have found while scanning lines
+	// If set, it's called with the text of each header as it's found
+	onHeader func(string)
+
+	// The times that have found while scanning lines, and the text of the
+	// most recent header
 	times      []string
+	lastHeader string
 	timesMutex sync.Mutex
 
 	// Every time we get a new time, we increment the wait group, and
@@ -101,16 +107,29 @@ func (h *headerTimesStreamer) Scan(line string) bool {
 		// our times slice.
 		h.timesMutex.Lock()
 		h.times = append(h.times, time.Now().UTC().Format(time.RFC3339Nano))
+		h.lastHeader = headerText(line)
 		h.timesMutex.Unlock()
 
 		// Add the time to the wait group
 		h.uploadWaitGroup.Add(1)
+
+		if h.onHeader != nil {
+			h.onHeader(headerText(line))
+		}
 		return true
 	}
 
 	return false
 }
 
+// LastHeader returns the text of the most recent header, which says what the
+// job is doing now.
+func (h *headerTimesStreamer) LastHeader() string {
+	h.timesMutex.Lock()
+	defer h.timesMutex.Unlock()
+	return h.lastHeader
+}
+
 func (h *headerTimesStreamer) Upload(ctx context.Context) {
 	// Store the current cursor value
 	c := h.cursor
@@ -180,6 +199,15 @@ func isHeader(line string) bool {
 	return len(line) < 500 && headerRegex.MatchString(line)
 }
 
+// headerText returns the text of a header line, without the marker or colors
+func headerText(line string) string {
+	line = ansiColorRegex.ReplaceAllString(line, "")
+	if m := headerRegex.FindStringSubmatch(line); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
 func isHeaderExpansion(line string) bool {
 	return len(line) < 50 && headerExpansionRegex.MatchString(line)
 }
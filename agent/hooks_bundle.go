@@ -0,0 +1,433 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The name bundles and their signatures are downloaded to, before they're
+// checked and unpacked
+const (
+	hooksBundleArchive   = "bundle.tar.gz"
+	hooksBundleSignature = "bundle.tar.gz" + artifactSignatureSuffix
+)
+
+// Signed bundles have their version, a number that's larger for each new
+// one such as the Unix time it was made at, in this file. The newest version
+// the agent has used is kept in the bundle directory, so an older bundle
+// that was signed with the same key can't be put back in its place.
+const (
+	hooksBundleVersionFile  = ".bundle-version"
+	hooksBundleNewestSigned = ".newest-signed-version"
+)
+
+type HooksBundleConfig struct {
+	// Where the bundle is, a gzipped tar of hooks, such as
+	// https://example.com/hooks.tar.gz or s3://my-bucket/hooks.tar.gz
+	URL string
+
+	// The SHA-256 of the bundle, in hex, to pin it to a version. If empty, any
+	// version is used. An http:// bundle must be pinned or signed
+	SHA256 string
+
+	// A PEM encoded public key that the bundle's signature, at its URL with
+	// .sig added, is verified with. If empty, it isn't signed. Signed bundles
+	// must have a version in .bundle-version that's no older than the last
+	// one used
+	VerificationKeyPath string
+
+	// The directory each version of the bundle is unpacked into. It must
+	// only be writable by the agent, not by jobs, as the hooks in it run for
+	// every job. It's created with permissions of 0700
+	Dir string
+
+	// The HTTP client to download http:// and https:// bundles with. If nil,
+	// http.DefaultClient is used
+	HTTPClient *http.Client
+}
+
+// HooksBundle fetches a bundle of agent hooks that an organisation manages
+// centrally, and keeps it up to date. Each version is unpacked into its own
+// directory, named after its SHA-256, so a job keeps using the version it
+// started with when a new one arrives.
+type HooksBundle struct {
+	conf   HooksBundleConfig
+	logger logger.Logger
+	key    crypto.PublicKey
+
+	mu      sync.RWMutex
+	version string
+
+	// The versions this bundle has unpacked, which are the only ones it
+	// reuses rather than unpacking again
+	unpacked map[string]bool
+
+	// How many jobs are using each version, which aren't removed until
+	// they've all finished
+	inUse map[string]int
+}
+
+func NewHooksBundle(l logger.Logger, c HooksBundleConfig) (*HooksBundle, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	switch {
+	case strings.HasPrefix(c.URL, "https://"), strings.HasPrefix(c.URL, "s3://"):
+	case strings.HasPrefix(c.URL, "http://"):
+		// Anyone in between could change a bundle fetched over plain HTTP,
+		// and it runs for every job
+		if c.SHA256 == "" && c.VerificationKeyPath == "" {
+			return nil, fmt.Errorf("hooks bundle %q is fetched over plain HTTP, so it must be pinned to a SHA-256 or signed", c.URL)
+		}
+	default:
+		return nil, fmt.Errorf("hooks bundle %q isn't an http://, https:// or s3:// URL", c.URL)
+	}
+	c.SHA256 = strings.ToLower(c.SHA256)
+
+	b := &HooksBundle{conf: c, logger: l, unpacked: map[string]bool{}, inUse: map[string]int{}}
+	if c.VerificationKeyPath != "" {
+		key, err := loadSignaturePublicKey(c.VerificationKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		b.key = key
+	}
+	return b, nil
+}
+
+// Path returns the directory the current version of the bundle's hooks are
+// in, or "" if it hasn't been fetched
+func (b *HooksBundle) Path() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.version == "" {
+		return ""
+	}
+	return filepath.Join(b.conf.Dir, b.version)
+}
+
+// Acquire returns the directory the current version of the bundle's hooks are
+// in, like Path, and keeps that version until release is called, so it isn't
+// removed while a job is using it
+func (b *HooksBundle) Acquire() (path string, release func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.version == "" {
+		return "", func() {}
+	}
+	version := b.version
+	b.inUse[version]++
+
+	var once sync.Once
+	return filepath.Join(b.conf.Dir, version), func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.inUse[version]--; b.inUse[version] <= 0 {
+				delete(b.inUse, version)
+			}
+		})
+	}
+}
+
+// Fetch downloads the bundle, checks it, and switches to it if it's a new
+// version. It returns whether it did.
+func (b *HooksBundle) Fetch(ctx context.Context) (bool, error) {
+	if err := os.MkdirAll(b.conf.Dir, 0o700); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(b.conf.Dir, 0o700); err != nil {
+		return false, err
+	}
+	tmp, err := os.MkdirTemp(b.conf.Dir, ".download-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := b.download(ctx, hooksBundleArchive, tmp); err != nil {
+		return false, fmt.Errorf("downloading hooks bundle %s: %w", b.conf.URL, err)
+	}
+	archive := filepath.Join(tmp, hooksBundleArchive)
+
+	version, err := sha256File(archive)
+	if err != nil {
+		return false, err
+	}
+	if b.conf.SHA256 != "" && version != b.conf.SHA256 {
+		return false, fmt.Errorf("hooks bundle %s has the SHA-256 %s, not %s", b.conf.URL, version, b.conf.SHA256)
+	}
+
+	b.mu.RLock()
+	current := b.version
+	b.mu.RUnlock()
+	if version == current {
+		return false, nil
+	}
+
+	if b.key != nil {
+		if err := b.download(ctx, hooksBundleSignature, tmp); err != nil {
+			return false, fmt.Errorf("downloading the signature of hooks bundle %s: %w", b.conf.URL, err)
+		}
+		if err := verifyFileSignature(b.key, archive, filepath.Join(tmp, hooksBundleSignature)); err != nil {
+			return false, fmt.Errorf("verifying the signature of hooks bundle %s: %w", b.conf.URL, err)
+		}
+	}
+
+	// A version this bundle didn't unpack itself, such as one left behind by
+	// an earlier agent, can't be trusted to still be what was verified, so
+	// it's always unpacked again
+	dir := filepath.Join(b.conf.Dir, version)
+	b.mu.RLock()
+	reuse := b.unpacked[version]
+	b.mu.RUnlock()
+	unpacked := dir
+	if !reuse {
+		unpacked = filepath.Join(tmp, "hooks")
+		if err := unpackHooksBundle(archive, unpacked); err != nil {
+			return false, fmt.Errorf("unpacking hooks bundle %s: %w", b.conf.URL, err)
+		}
+	}
+
+	// A signature only shows the key's owner made the bundle at some point,
+	// so it must also be no older than the newest one used
+	var signedVersion int64
+	if b.key != nil {
+		if signedVersion, err = b.checkSignedVersion(unpacked); err != nil {
+			return false, err
+		}
+	}
+
+	if !reuse {
+		if err := os.RemoveAll(dir); err != nil {
+			return false, err
+		}
+		if err := os.Rename(unpacked, dir); err != nil {
+			return false, err
+		}
+	}
+	if b.key != nil {
+		if err := os.WriteFile(filepath.Join(b.conf.Dir, hooksBundleNewestSigned), []byte(strconv.FormatInt(signedVersion, 10)), 0o600); err != nil {
+			return false, err
+		}
+	}
+
+	b.mu.Lock()
+	b.version = version
+	b.unpacked[version] = true
+	b.mu.Unlock()
+
+	b.logger.Info("Using version %s of hooks bundle %s", shortVersion(version), b.conf.URL)
+	b.removeOldVersions()
+	return true, nil
+}
+
+// Refresh fetches the bundle every interval until ctx is done, carrying on
+// with the version it has when it can't
+func (b *HooksBundle) Refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := b.Fetch(ctx); err != nil {
+				b.logger.Warn("Couldn't refresh the hooks bundle, so the current version is still used: %v", err)
+			}
+		}
+	}
+}
+
+func (b *HooksBundle) download(ctx context.Context, name, destination string) error {
+	location := b.conf.URL
+	if name == hooksBundleSignature {
+		location += artifactSignatureSuffix
+	}
+
+	if strings.HasPrefix(location, "s3://") {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		client, err := NewS3Client(ctx, b.logger, bucket)
+		if err != nil {
+			return err
+		}
+		dir, file := path.Split(key)
+		if err := NewS3Downloader(b.logger, S3DownloaderConfig{
+			S3Client:    client,
+			S3Path:      "s3://" + bucket + "/" + strings.TrimSuffix(dir, "/"),
+			Path:        file,
+			Destination: destination,
+			Retries:     3,
+			NoResume:    true,
+		}).Start(ctx); err != nil {
+			return err
+		}
+		return os.Rename(filepath.Join(destination, file), filepath.Join(destination, name))
+	}
+
+	return NewDownload(b.logger, b.conf.HTTPClient, DownloadConfig{
+		URL:         location,
+		Path:        name,
+		Destination: destination,
+		Retries:     3,
+		NoResume:    true,
+	}).Start(ctx)
+}
+
+// checkSignedVersion reads the version of an unpacked signed bundle, and
+// checks it's no older than the newest one used
+func (b *HooksBundle) checkSignedVersion(unpacked string) (int64, error) {
+	contents, err := os.ReadFile(filepath.Join(unpacked, hooksBundleVersionFile))
+	if err != nil {
+		return 0, fmt.Errorf("hooks bundle %s is signed, but has no version in %s: %w", b.conf.URL, hooksBundleVersionFile, err)
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("hooks bundle %s has an invalid version in %s: %w", b.conf.URL, hooksBundleVersionFile, err)
+	}
+
+	newest := int64(0)
+	switch contents, err := os.ReadFile(filepath.Join(b.conf.Dir, hooksBundleNewestSigned)); {
+	case err == nil:
+		if newest, err = strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64); err != nil {
+			return 0, fmt.Errorf("reading the newest version of hooks bundle %s used: %w", b.conf.URL, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return 0, fmt.Errorf("reading the newest version of hooks bundle %s used: %w", b.conf.URL, err)
+	}
+
+	if version < newest {
+		return 0, fmt.Errorf("hooks bundle %s has version %d, which is older than version %d that's already been used", b.conf.URL, version, newest)
+	}
+	return version, nil
+}
+
+// removeOldVersions removes the versions of the bundle other than the current
+// one that no running job is using
+func (b *HooksBundle) removeOldVersions() {
+	entries, err := os.ReadDir(b.conf.Dir)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || name == b.version || b.inUse[name] > 0 || strings.HasPrefix(name, ".") {
+			continue
+		}
+		delete(b.unpacked, name)
+		if err := os.RemoveAll(filepath.Join(b.conf.Dir, name)); err != nil {
+			b.logger.Warn("Couldn't remove an old version of the hooks bundle: %v", err)
+		}
+	}
+}
+
+// unpackHooksBundle unpacks a gzipped tar of hooks into dir. Only regular
+// files and directories are unpacked, only within dir, and none of them are
+// writable by anyone but the agent.
+func unpackHooksBundle(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%s is outside the bundle", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()&0o755)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("%s isn't a regular file or directory", hdr.Name)
+		}
+	}
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func shortVersion(version string) string {
+	if len(version) > 12 {
+		return version[:12]
+	}
+	return version
+}
@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// hooksBundleTarGz makes a gzipped tar of the files, from their names to
+// their contents
+func hooksBundleTarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tw.WriteHeader() error = %v", err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatalf("tw.Write() error = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close() error = %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+type hooksBundleServer struct {
+	mu          sync.Mutex
+	bundle, sig []byte
+}
+
+func (s *hooksBundleServer) set(bundle, sig []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bundle, s.sig = bundle, sig
+}
+
+func (s *hooksBundleServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/hooks.tar.gz":
+		rw.Write(s.bundle)
+	case "/hooks.tar.gz.sig":
+		rw.Write(s.sig)
+	default:
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}
+}
+
+func TestHooksBundle(t *testing.T) {
+	t.Parallel()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "hooks.pub")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	v1 := hooksBundleTarGz(t, map[string]string{"environment": "echo v1", "lib/common.sh": "true", ".bundle-version": "1"})
+	srv := &hooksBundleServer{}
+	srv.set(v1, ed25519.Sign(private, v1))
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	bundle, err := NewHooksBundle(logger.Discard, HooksBundleConfig{
+		URL:                 server.URL + "/hooks.tar.gz",
+		VerificationKeyPath: keyPath,
+		Dir:                 dir,
+	})
+	if err != nil {
+		t.Fatalf("NewHooksBundle() error = %v", err)
+	}
+
+	if changed, err := bundle.Fetch(ctx); err != nil || !changed {
+		t.Fatalf("bundle.Fetch() = (%t, %v), want (true, nil)", changed, err)
+	}
+	first := bundle.Path()
+	got, err := os.ReadFile(filepath.Join(first, "environment"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(environment) error = %v", err)
+	}
+	if string(got) != "echo v1" {
+		t.Errorf("environment hook = %q, want %q", got, "echo v1")
+	}
+	if info, err := os.Stat(filepath.Join(first, "environment")); err != nil || info.Mode().Perm()&0o100 == 0 {
+		t.Errorf("environment hook isn't executable: (%v, %v)", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(first, "lib", "common.sh")); err != nil {
+		t.Errorf("os.Stat(lib/common.sh) error = %v", err)
+	}
+
+	// The same version again doesn't change anything
+	if changed, err := bundle.Fetch(ctx); err != nil || changed {
+		t.Errorf("bundle.Fetch() of the same version = (%t, %v), want (false, nil)", changed, err)
+	}
+
+	// A version signed with another key isn't used
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	v2 := hooksBundleTarGz(t, map[string]string{"environment": "echo v2", ".bundle-version": "2"})
+	srv.set(v2, ed25519.Sign(otherKey, v2))
+	if _, err := bundle.Fetch(ctx); err == nil {
+		t.Errorf("bundle.Fetch() with a bad signature error = nil, want an error")
+	}
+	if bundle.Path() != first {
+		t.Errorf("bundle.Path() = %q after a bad signature, want it still %q", bundle.Path(), first)
+	}
+
+	// A new version takes the place of the old one, which no job is using
+	srv.set(v2, ed25519.Sign(private, v2))
+	if changed, err := bundle.Fetch(ctx); err != nil || !changed {
+		t.Fatalf("bundle.Fetch() of a new version = (%t, %v), want (true, nil)", changed, err)
+	}
+	sum := sha256.Sum256(v2)
+	if want := filepath.Join(dir, hex.EncodeToString(sum[:])); bundle.Path() != want {
+		t.Errorf("bundle.Path() = %q, want %q", bundle.Path(), want)
+	}
+	if _, err := os.Stat(first); err == nil {
+		t.Errorf("the previous version was kept, want it removed as no job is using it")
+	}
+
+	// An older version that was signed with the same key isn't used again
+	srv.set(v1, ed25519.Sign(private, v1))
+	if _, err := bundle.Fetch(ctx); err == nil {
+		t.Errorf("bundle.Fetch() of an older version error = nil, want an error")
+	}
+
+	// Nor is a signed version without a version
+	unversioned := hooksBundleTarGz(t, map[string]string{"environment": "echo unversioned"})
+	srv.set(unversioned, ed25519.Sign(private, unversioned))
+	if _, err := bundle.Fetch(ctx); err == nil {
+		t.Errorf("bundle.Fetch() of a bundle without a version error = nil, want an error")
+	}
+	if want := filepath.Join(dir, hex.EncodeToString(sum[:])); bundle.Path() != want {
+		t.Errorf("bundle.Path() = %q, want it still %q", bundle.Path(), want)
+	}
+
+	// An agent starting afresh with the same directory doesn't go back either
+	restarted, err := NewHooksBundle(logger.Discard, HooksBundleConfig{
+		URL:                 server.URL + "/hooks.tar.gz",
+		VerificationKeyPath: keyPath,
+		Dir:                 dir,
+	})
+	if err != nil {
+		t.Fatalf("NewHooksBundle() error = %v", err)
+	}
+	srv.set(v1, ed25519.Sign(private, v1))
+	if _, err := restarted.Fetch(ctx); err == nil {
+		t.Errorf("restarted.Fetch() of an older version error = nil, want an error")
+	}
+}
+
+func TestHooksBundleKeepsVersionsInUse(t *testing.T) {
+	t.Parallel()
+
+	srv := &hooksBundleServer{}
+	server := httptest.NewTLSServer(srv)
+	defer server.Close()
+
+	ctx := context.Background()
+	bundle, err := NewHooksBundle(logger.Discard, HooksBundleConfig{
+		URL:        server.URL + "/hooks.tar.gz",
+		Dir:        t.TempDir(),
+		HTTPClient: server.Client(),
+	})
+	if err != nil {
+		t.Fatalf("NewHooksBundle() error = %v", err)
+	}
+
+	fetch := func(version string) {
+		t.Helper()
+		srv.set(hooksBundleTarGz(t, map[string]string{"environment": "echo " + version}), nil)
+		if _, err := bundle.Fetch(ctx); err != nil {
+			t.Fatalf("bundle.Fetch() error = %v", err)
+		}
+	}
+
+	// A long running job is still using the first version after several
+	// new ones arrive
+	fetch("v1")
+	path, release := bundle.Acquire()
+	fetch("v2")
+	fetch("v3")
+	if _, err := os.Stat(filepath.Join(path, "environment")); err != nil {
+		t.Errorf("a version still in use was removed: %v", err)
+	}
+
+	// Once it's finished, it's removed with the next new one
+	release()
+	release()
+	fetch("v4")
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("%s was kept, want it removed once no job was using it", path)
+	}
+}
+
+func TestHooksBundlePinnedSHA256(t *testing.T) {
+	t.Parallel()
+
+	v1 := hooksBundleTarGz(t, map[string]string{"environment": "echo v1"})
+	srv := &hooksBundleServer{}
+	srv.set(v1, nil)
+	server := httptest.NewServer(srv)
+	defer server.Close()
+
+	bundle, err := NewHooksBundle(logger.Discard, HooksBundleConfig{
+		URL:    server.URL + "/hooks.tar.gz",
+		SHA256: strings.Repeat("ab", 32),
+		Dir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewHooksBundle() error = %v", err)
+	}
+	if _, err := bundle.Fetch(context.Background()); err == nil {
+		t.Errorf("bundle.Fetch() with the wrong SHA-256 error = nil, want an error")
+	}
+	if bundle.Path() != "" {
+		t.Errorf("bundle.Path() = %q, want it empty", bundle.Path())
+	}
+}
+
+func TestUnpackHooksBundleOutside(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "bundle.tar.gz")
+	if err := os.WriteFile(archive, hooksBundleTarGz(t, map[string]string{"../escape": "oops"}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if err := unpackHooksBundle(archive, filepath.Join(dir, "hooks")); err == nil {
+		t.Errorf("unpackHooksBundle() error = nil, want an error for a file outside the bundle")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Errorf("../escape was unpacked outside the bundle")
+	}
+}
+
+func TestNewHooksBundleInvalidURL(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewHooksBundle(logger.Discard, HooksBundleConfig{URL: "ftp://example.com/hooks.tar.gz"}); err == nil {
+		t.Errorf("NewHooksBundle(ftp://...) error = nil, want an error")
+	}
+
+	// Plain HTTP is only allowed for bundles that are pinned or signed
+	if _, err := NewHooksBundle(logger.Discard, HooksBundleConfig{URL: "http://example.com/hooks.tar.gz"}); err == nil {
+		t.Errorf("NewHooksBundle(http://...) error = nil, want an error")
+	}
+	if _, err := NewHooksBundle(logger.Discard, HooksBundleConfig{URL: "http://example.com/hooks.tar.gz", SHA256: strings.Repeat("ab", 32)}); err != nil {
+		t.Errorf("NewHooksBundle(http://...) with a SHA-256 error = %v", err)
+	}
+	if _, err := NewHooksBundle(logger.Discard, HooksBundleConfig{URL: "https://example.com/hooks.tar.gz"}); err != nil {
+		t.Errorf("NewHooksBundle(https://...) error = %v", err)
+	}
+}
+
+func TestHooksBundleReplacesVersionsItDidntUnpack(t *testing.T) {
+	t.Parallel()
+
+	v1 := hooksBundleTarGz(t, map[string]string{"environment": "echo v1"})
+	srv := &hooksBundleServer{}
+	srv.set(v1, nil)
+	server := httptest.NewTLSServer(srv)
+	defer server.Close()
+
+	// A version directory planted before the agent started, such as by a job
+	dir := filepath.Join(t.TempDir(), "hooks-bundle")
+	sum := sha256.Sum256(v1)
+	planted := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(planted, 0o777); err != nil {
+		t.Fatalf("os.MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(planted, "environment"), []byte("echo planted"), 0o777); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	bundle, err := NewHooksBundle(logger.Discard, HooksBundleConfig{URL: server.URL + "/hooks.tar.gz", Dir: dir, HTTPClient: server.Client()})
+	if err != nil {
+		t.Fatalf("NewHooksBundle() error = %v", err)
+	}
+	if _, err := bundle.Fetch(context.Background()); err != nil {
+		t.Fatalf("bundle.Fetch() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(bundle.Path(), "environment"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(environment) error = %v", err)
+	}
+	if string(got) != "echo v1" {
+		t.Errorf("environment hook = %q, want %q", got, "echo v1")
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("os.Stat(%s) = (%v, %v), want permissions of 0700", dir, info, err)
+	}
+}
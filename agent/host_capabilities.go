@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/system"
+)
+
+// How long to wait for a command that detects a capability, e.g. when the
+// docker daemon isn't responding
+const capabilityCommandTimeout = 10 * time.Second
+
+// Memory classes, by the largest amount of memory in each class
+var memoryClasses = []struct {
+	name string
+	max  uint64
+}{
+	{"small", 8 << 30},
+	{"medium", 32 << 30},
+	{"large", 128 << 30},
+}
+
+var xcodeVersionRegexp = regexp.MustCompile(`<key>CFBundleShortVersionString</key>\s*<string>([^<]+)</string>`)
+
+// hostCapabilities detects what the host is capable of running. Each
+// detection is a func so it can be replaced in tests.
+type hostCapabilities struct {
+	// output runs a command and returns its trimmed stdout
+	output func(ctx context.Context, name string, args ...string) (string, error)
+
+	// xcodeVersions returns the versions of Xcode that are installed
+	xcodeVersions func() ([]string, error)
+
+	// totalMemory returns the host's total memory in bytes
+	totalMemory func() (uint64, error)
+}
+
+// HostCapabilities returns tags describing the host's capabilities: whether
+// docker is available and its version, the number of NVIDIA GPUs, an xcode
+// tag for each version of Xcode installed, and the class of the host's
+// memory. Capabilities that aren't present are left out.
+func HostCapabilities(ctx context.Context) []string {
+	return hostCapabilities{
+		output:        commandOutput,
+		xcodeVersions: installedXcodeVersions,
+		totalMemory:   system.TotalMemory,
+	}.detect(ctx)
+}
+
+func (h hostCapabilities) detect(ctx context.Context) []string {
+	var tags []string
+
+	// docker version exits non-zero when the daemon isn't reachable, in which
+	// case docker isn't usable for builds either
+	if version, err := h.output(ctx, "docker", "version", "--format", "{{.Server.Version}}"); err == nil && version != "" {
+		tags = append(tags, "docker=true", "docker-version="+version)
+	}
+
+	if gpus, err := h.output(ctx, "nvidia-smi", "--query-gpu=name", "--format=csv,noheader"); err == nil && gpus != "" {
+		tags = append(tags, fmt.Sprintf("gpu-count=%d", len(strings.Split(gpus, "\n"))))
+	}
+
+	// Agents are targeted at one version of Xcode with a tag like xcode=15.0,
+	// so there's one for each version
+	if versions, err := h.xcodeVersions(); err == nil {
+		sort.Slice(versions, func(i, j int) bool {
+			return compareVersions(versions[i], versions[j]) < 0
+		})
+		for _, version := range versions {
+			tags = append(tags, "xcode="+version)
+		}
+	}
+
+	if total, err := h.totalMemory(); err == nil && total > 0 {
+		tags = append(tags, "memory-class="+memoryClass(total))
+	}
+
+	return tags
+}
+
+// compareVersions compares dotted version numbers like 14.3.1 part by part,
+// numerically where both parts are numbers, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var ap, bp string
+		if i < len(as) {
+			ap = as[i]
+		}
+		if i < len(bs) {
+			bp = bs[i]
+		}
+		an, aErr := strconv.Atoi(ap)
+		bn, bErr := strconv.Atoi(bp)
+		switch {
+		case aErr == nil && bErr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && ap != bp:
+			if ap < bp {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// memoryClass buckets an amount of memory in bytes into small, medium, large
+// or xlarge
+func memoryClass(total uint64) string {
+	for _, class := range memoryClasses {
+		if total <= class.max {
+			return class.name
+		}
+	}
+	return "xlarge"
+}
+
+func commandOutput(ctx context.Context, name string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, capabilityCommandTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// installedXcodeVersions returns the versions of the Xcode apps in
+// /Applications. It returns nothing on platforms other than macOS.
+func installedXcodeVersions() ([]string, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, nil
+	}
+
+	apps, err := filepath.Glob("/Applications/Xcode*.app")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var versions []string
+	for _, app := range apps {
+		plist, err := os.ReadFile(filepath.Join(app, "Contents", "version.plist"))
+		if err != nil {
+			continue
+		}
+		version := xcodeVersionFromPlist(string(plist))
+		if version != "" && !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+
+	return versions, nil
+}
+
+// xcodeVersionFromPlist returns the version in an Xcode version.plist
+func xcodeVersionFromPlist(plist string) string {
+	if m := xcodeVersionRegexp.FindStringSubmatch(plist); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
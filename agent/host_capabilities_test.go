@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostCapabilitiesDetect(t *testing.T) {
+	t.Parallel()
+
+	h := hostCapabilities{
+		output: func(_ context.Context, name string, args ...string) (string, error) {
+			switch name {
+			case "docker":
+				return "24.0.5", nil
+			case "nvidia-smi":
+				return "NVIDIA A100-SXM4-40GB\nNVIDIA A100-SXM4-40GB", nil
+			}
+			return "", errors.New("unexpected command " + name + " " + strings.Join(args, " "))
+		},
+		xcodeVersions: func() ([]string, error) { return []string{"15.0", "9.4.1", "14.3.1"}, nil },
+		totalMemory:   func() (uint64, error) { return 16 << 30, nil },
+	}
+
+	assert.Equal(t, []string{
+		"docker=true",
+		"docker-version=24.0.5",
+		"gpu-count=2",
+		"xcode=9.4.1",
+		"xcode=14.3.1",
+		"xcode=15.0",
+		"memory-class=medium",
+	}, h.detect(context.Background()))
+}
+
+func TestHostCapabilitiesDetectNothing(t *testing.T) {
+	t.Parallel()
+
+	h := hostCapabilities{
+		output: func(context.Context, string, ...string) (string, error) {
+			return "", errors.New("executable file not found in $PATH")
+		},
+		xcodeVersions: func() ([]string, error) { return nil, nil },
+		totalMemory:   func() (uint64, error) { return 0, errors.New("not supported") },
+	}
+
+	assert.Empty(t, h.detect(context.Background()))
+}
+
+func TestMemoryClass(t *testing.T) {
+	t.Parallel()
+
+	for total, want := range map[uint64]string{
+		4 << 30:       "small",
+		8 << 30:       "small",
+		(8 << 30) + 1: "medium",
+		64 << 30:      "large",
+		256 << 30:     "xlarge",
+	} {
+		assert.Equal(t, want, memoryClass(total), "memoryClass(%d)", total)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"9.4", "14.3", -1},
+		{"14.3", "14.3.1", -1},
+		{"15.0", "14.3.1", 1},
+		{"15.0", "15.0", 0},
+		{"15.0-beta", "15.0", 1},
+	} {
+		assert.Equal(t, tc.want, compareVersions(tc.a, tc.b), "compareVersions(%q, %q)", tc.a, tc.b)
+	}
+}
+
+func TestXcodeVersionFromPlist(t *testing.T) {
+	t.Parallel()
+
+	plist := `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>CFBundleShortVersionString</key>
+	<string>15.0</string>
+</dict>
+</plist>`
+
+	assert.Equal(t, "15.0", xcodeVersionFromPlist(plist))
+	assert.Equal(t, "", xcodeVersionFromPlist("<plist></plist>"))
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/cgroup"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+)
+
+// Each job's cgroup is named this, followed by the job's ID
+const jobCgroupPrefix = "job-"
+
+// jobResourceLimits returns the agent's resource limits for jobs, with any
+// that the pipeline sets in the job's environment. Pipelines can lower the
+// agent's limits, but not raise them. Invalid limits are ignored with a
+// warning.
+func jobResourceLimits(l logger.Logger, agentLimits cgroup.Limits, env map[string]string) cgroup.Limits {
+	var limits cgroup.Limits
+
+	if v, ok := env["BUILDKITE_JOB_CPU_LIMIT"]; ok {
+		if cpus, err := cgroup.ParseCPUs(v); err != nil {
+			l.Warn("Ignoring BUILDKITE_JOB_CPU_LIMIT from the job: %v", err)
+		} else {
+			limits.CPUs = cpus
+		}
+	}
+
+	if v, ok := env["BUILDKITE_JOB_CPU_WEIGHT"]; ok {
+		if weight, err := cgroup.ParseCPUWeight(v); err != nil {
+			l.Warn("Ignoring BUILDKITE_JOB_CPU_WEIGHT from the job: %v", err)
+		} else {
+			limits.CPUWeight = weight
+		}
+	}
+	if limits.CPUWeight == 0 {
+		limits.CPUWeight = agentLimits.CPUWeight
+	}
+
+	if v, ok := env["BUILDKITE_JOB_MEMORY_LIMIT"]; ok {
+		if memory, err := cgroup.ParseMemory(v); err != nil {
+			l.Warn("Ignoring BUILDKITE_JOB_MEMORY_LIMIT from the job: %v", err)
+		} else {
+			limits.Memory = memory
+		}
+	}
+
+	return limits.Within(agentLimits)
+}
+
+// createJobCgroup creates a cgroup with the job's resource limits, and has
+// the job's process start in it. It returns nil if the cgroup couldn't be
+// created, in which case the job runs without limits.
+func (r *JobRunner) createJobCgroup() *cgroup.Group {
+	proc, ok := r.process.(interface{ StartInCgroup(path string) })
+	if !ok {
+		r.logger.Warn("Resource limits aren't supported for this kind of job, so job %s will run without them", r.job.ID)
+		return nil
+	}
+
+	limits := jobResourceLimits(r.logger, r.conf.AgentConfiguration.JobResourceLimits, r.job.Env)
+	group, err := cgroup.New(r.conf.AgentConfiguration.JobCgroupParent, jobCgroupPrefix+r.job.ID, limits)
+	if err != nil {
+		r.logger.Error("Failed to create a cgroup for job %s, so it will run without resource limits: %v", r.job.ID, err)
+		return nil
+	}
+	r.logger.Info("Running job %s with %s", r.job.ID, limits)
+
+	proc.StartInCgroup(group.Path)
+	return group
+}
+
+// removeJobCgroup reports if the job ran out of memory, then kills anything
+// left running in its cgroup and removes it
+func (r *JobRunner) removeJobCgroup(group *cgroup.Group) {
+	if kills, err := group.OOMKills(); err == nil && kills > 0 {
+		memory := jobResourceLimits(r.logger, r.conf.AgentConfiguration.JobResourceLimits, r.job.Env).Memory
+		r.logStreamer.Process([]byte(fmt.Sprintf(
+			"+++ :warning: %d processes were killed for using more than the job's memory limit of %s\n",
+			kills, humanize.IBytes(memory))))
+	}
+
+	if err := group.Remove(); err != nil {
+		r.logger.Warn("Failed to remove the cgroup for job %s: %v", r.job.ID, err)
+	}
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/cgroup"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobResourceLimits(t *testing.T) {
+	agentLimits := cgroup.Limits{CPUs: 4, CPUWeight: 100, Memory: 8 << 30}
+
+	t.Run("agent limits", func(t *testing.T) {
+		limits := jobResourceLimits(logger.Discard, agentLimits, map[string]string{})
+		assert.Equal(t, agentLimits, limits)
+	})
+
+	t.Run("pipelines can lower limits", func(t *testing.T) {
+		limits := jobResourceLimits(logger.Discard, agentLimits, map[string]string{
+			"BUILDKITE_JOB_CPU_LIMIT":    "0.5",
+			"BUILDKITE_JOB_CPU_WEIGHT":   "10",
+			"BUILDKITE_JOB_MEMORY_LIMIT": "1GiB",
+		})
+		assert.Equal(t, cgroup.Limits{CPUs: 0.5, CPUWeight: 10, Memory: 1 << 30}, limits)
+	})
+
+	t.Run("pipelines can't raise limits", func(t *testing.T) {
+		limits := jobResourceLimits(logger.Discard, agentLimits, map[string]string{
+			"BUILDKITE_JOB_CPU_LIMIT":    "64",
+			"BUILDKITE_JOB_CPU_WEIGHT":   "1000",
+			"BUILDKITE_JOB_MEMORY_LIMIT": "1TiB",
+		})
+		assert.Equal(t, agentLimits, limits)
+	})
+
+	t.Run("invalid limits are ignored", func(t *testing.T) {
+		l := logger.NewBuffer()
+		limits := jobResourceLimits(l, agentLimits, map[string]string{
+			"BUILDKITE_JOB_CPU_LIMIT":    "lots",
+			"BUILDKITE_JOB_CPU_WEIGHT":   "0",
+			"BUILDKITE_JOB_MEMORY_LIMIT": "heaps",
+		})
+		assert.Equal(t, agentLimits, limits)
+		assert.Len(t, l.Messages, 3)
+	})
+}
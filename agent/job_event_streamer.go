@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/status"
+)
+
+// jobEventStreamer recognises events in job output, like groups starting and
+// tests finishing, and uploads them in batches as the job runs
+type jobEventStreamer struct {
+	logger logger.Logger
+
+	// Uploads a batch of events. It returns false if events shouldn't be
+	// uploaded any more.
+	upload func(context.Context, []*api.JobEvent) bool
+
+	// The events found while scanning lines that haven't been uploaded yet
+	mu       sync.Mutex
+	pending  []*api.JobEvent
+	sequence int
+	disabled bool
+
+	// Every scan is added to the wait group, so stopping can wait for them
+	scanWaitGroup sync.WaitGroup
+
+	// Closed to stop the streamer, which then closes done once the last
+	// events are uploaded
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	now func() time.Time
+}
+
+func newJobEventStreamer(l logger.Logger, upload func(context.Context, []*api.JobEvent) bool) *jobEventStreamer {
+	return &jobEventStreamer{
+		logger: l,
+		upload: upload,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		now:    time.Now,
+	}
+}
+
+// Run uploads events every second until the streamer is stopped
+func (s *jobEventStreamer) Run(ctx context.Context) {
+	ctx, setStatus, done := status.AddSimpleItem(ctx, "Job Event Streamer")
+	defer done()
+	defer close(s.done)
+
+	for {
+		setStatus("📡 Uploading any pending job events")
+		s.Upload(ctx)
+
+		setStatus("😴 Sleeping for a bit")
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			s.Upload(ctx)
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// Scan takes a line of job output and records an event if it's one
+func (s *jobEventStreamer) Scan(line string) {
+	s.scanWaitGroup.Add(1)
+	defer s.scanWaitGroup.Done()
+
+	event := parseJobEvent(line)
+	if event == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		return
+	}
+	event.Sequence = s.sequence
+	event.Time = s.now().UTC().Format(time.RFC3339Nano)
+	s.sequence++
+	s.pending = append(s.pending, event)
+}
+
+// Upload uploads the events that are waiting
+func (s *jobEventStreamer) Upload(ctx context.Context) {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	s.logger.Debug("[JobEventStreamer] Uploading job events %d..%d", events[0].Sequence, events[len(events)-1].Sequence)
+	if !s.upload(ctx, events) {
+		s.logger.Debug("[JobEventStreamer] Job events won't be uploaded any more")
+		s.mu.Lock()
+		s.disabled = true
+		s.mu.Unlock()
+	}
+}
+
+// Stop waits for the lines being scanned, and for the last events to be
+// uploaded
+func (s *jobEventStreamer) Stop() {
+	s.scanWaitGroup.Wait()
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+var (
+	// The timestamps the ansi-timestamps experiment adds, and colors
+	ansiTimestampRegex = regexp.MustCompile(`\x1b_bk;t=\d+\x07`)
+
+	tapResultRegex = regexp.MustCompile(`^\s*(not )?ok(?:\s+(\d+))?(\s+-)?(?:\s+([^#]*?))?\s*(?:#\s*(?i:(skip|todo))\b.*)?$`)
+	tapPlanRegex   = regexp.MustCompile(`^\s*1\.\.(\d+)\b`)
+	tapBailRegex   = regexp.MustCompile(`^\s*Bail out!\s*(.*)$`)
+)
+
+// parseJobEvent returns the event a line of output is, or nil if it isn't one
+func parseJobEvent(line string) *api.JobEvent {
+	line = strings.TrimRight(line, "\r\n")
+	line = ansiTimestampRegex.ReplaceAllString(line, "")
+	line = ansiColorRegex.ReplaceAllString(line, "")
+
+	switch {
+	case isHeader(line):
+		// --- is collapsed, +++ is expanded and ~~~ isn't collapsible
+		status := map[string]string{"---": "collapsed", "+++": "expanded", "~~~": "open"}[line[:3]]
+		return &api.JobEvent{Type: "group", Name: headerText(line), Status: status}
+
+	case isHeaderExpansion(line):
+		return &api.JobEvent{Type: "group", Status: "expanded"}
+
+	case strings.HasPrefix(strings.TrimSpace(line), "{"):
+		return parseJSONTestEvent(strings.TrimSpace(line))
+	}
+
+	// Results have a number or a dash before their description, which tells
+	// them apart from other lines starting with ok, like go test's
+	if m := tapResultRegex.FindStringSubmatch(line); m != nil && (m[2] != "" || m[3] != "" || m[4] == "") {
+		event := &api.JobEvent{Type: "test", Name: m[4], Status: "passed"}
+		if m[1] != "" {
+			event.Status = "failed"
+		}
+		switch strings.ToLower(m[5]) {
+		case "skip":
+			event.Status = "skipped"
+		case "todo":
+			event.Status = "todo"
+		}
+		event.Number, _ = strconv.Atoi(m[2])
+		return event
+	}
+	if m := tapPlanRegex.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return &api.JobEvent{Type: "test_plan", Number: n}
+	}
+	if m := tapBailRegex.FindStringSubmatch(line); m != nil {
+		return &api.JobEvent{Type: "test_bail_out", Name: m[1]}
+	}
+	return nil
+}
+
+// parseJSONTestEvent recognises the results in go test -json output, and in
+// Rust's libtest JSON output
+func parseJSONTestEvent(line string) *api.JobEvent {
+	var record struct {
+		// go test -json
+		Action  string
+		Package string
+		Test    string
+		Elapsed float64
+
+		// libtest
+		Type  string  `json:"type"`
+		Event string  `json:"event"`
+		Name  string  `json:"name"`
+		Time  float64 `json:"exec_time"`
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil
+	}
+
+	if record.Test != "" {
+		status, ok := map[string]string{"pass": "passed", "fail": "failed", "skip": "skipped"}[record.Action]
+		if !ok {
+			return nil
+		}
+		return &api.JobEvent{Type: "test", Name: record.Test, Suite: record.Package, Status: status, Duration: record.Elapsed}
+	}
+
+	if record.Type == "test" && record.Name != "" {
+		status, ok := map[string]string{"ok": "passed", "failed": "failed", "ignored": "skipped"}[record.Event]
+		if !ok {
+			return nil
+		}
+		return &api.JobEvent{Type: "test", Name: record.Name, Status: status, Duration: record.Time}
+	}
+
+	return nil
+}
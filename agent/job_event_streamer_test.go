@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseJobEvent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		line string
+		want *api.JobEvent
+	}{
+		{"--- :go: Build", &api.JobEvent{Type: "group", Name: ":go: Build", Status: "collapsed"}},
+		{"\x1b_bk;t=1700000000000\x07\x1b[32m+++ Tests\x1b[0m", &api.JobEvent{Type: "group", Name: "Tests", Status: "expanded"}},
+		{"^^^ +++", &api.JobEvent{Type: "group", Status: "expanded"}},
+		{"ok 1 - adds numbers", &api.JobEvent{Type: "test", Name: "adds numbers", Status: "passed", Number: 1}},
+		{"not ok 2 subtracts numbers", &api.JobEvent{Type: "test", Name: "subtracts numbers", Status: "failed", Number: 2}},
+		{"not ok 3 - divides by zero # TODO not yet", &api.JobEvent{Type: "test", Name: "divides by zero", Status: "todo", Number: 3}},
+		{"ok - windows only # SKIP not windows", &api.JobEvent{Type: "test", Name: "windows only", Status: "skipped"}},
+		{"1..3", &api.JobEvent{Type: "test_plan", Number: 3}},
+		{"Bail out! database is down", &api.JobEvent{Type: "test_bail_out", Name: "database is down"}},
+		{`{"Time":"2023-01-01T00:00:00Z","Action":"fail","Package":"example.com/calc","Test":"TestAdd","Elapsed":0.25}`, &api.JobEvent{Type: "test", Name: "TestAdd", Suite: "example.com/calc", Status: "failed", Duration: 0.25}},
+		{`{"type":"test","event":"ok","name":"calc::adds","exec_time":0.5}`, &api.JobEvent{Type: "test", Name: "calc::adds", Status: "passed", Duration: 0.5}},
+		{`{"Action":"output","Test":"TestAdd","Output":"hello\n"}`, nil},
+		{`{"type":"test","event":"started","name":"calc::adds"}`, nil},
+		{"ok  \texample.com/calc\t0.012s", nil},
+		{"okay then", nil},
+		{"building...", nil},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, parseJobEvent(test.line)); diff != "" {
+			t.Errorf("parseJobEvent(%q) diff (-want +got):\n%s", test.line, diff)
+		}
+	}
+}
+
+func TestJobEventStreamerStopsUploadingWhenRejected(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var batches [][]string
+	s := newJobEventStreamer(logger.Discard, func(_ context.Context, events []*api.JobEvent) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		var names []string
+		for _, e := range events {
+			names = append(names, e.Name)
+		}
+		batches = append(batches, names)
+		return false
+	})
+	s.now = func() time.Time { return time.Unix(0, 0) }
+
+	s.Scan("--- one")
+	s.Scan("not an event")
+	s.Scan("--- two")
+	s.Upload(context.Background())
+
+	// Rejected, so these are dropped
+	s.Scan("--- three")
+	s.Upload(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([][]string{{"one", "two"}}, batches); diff != "" {
+		t.Errorf("uploaded batches diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// JobLogANSIKeep leaves escape sequences in job logs as they are
+	JobLogANSIKeep = "keep"
+
+	// JobLogANSIStrip removes every escape sequence from job logs
+	JobLogANSIStrip = "strip"
+
+	// JobLogANSINormalize keeps colors and styles, and removes the escape
+	// sequences that move the cursor, erase lines or set window titles, which
+	// mean nothing in a log
+	JobLogANSINormalize = "normalize"
+)
+
+var (
+	// Control sequences like colors and cursor movement, operating system
+	// commands like window titles and hyperlinks, and other escapes
+	ansiEscapeRegex = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|[\]_P^X][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+	// Colors and styles
+	ansiSGRRegex = regexp.MustCompile(`^\x1b\[[0-9;]*m$`)
+)
+
+// JobLogFilterConfig is how job output is shrunk before it's uploaded
+type JobLogFilterConfig struct {
+	// JobLogANSIKeep, JobLogANSIStrip or JobLogANSINormalize. If empty,
+	// escape sequences are kept
+	ANSI string
+
+	// If set, lines that are redrawn with carriage returns, like progress
+	// bars, are written at most this often, each as a line of its own, rather
+	// than every redraw being uploaded
+	ProgressSampleInterval time.Duration
+
+	// If set, lines longer than this many bytes are cut short
+	MaxLineLength int
+}
+
+// IsZero returns whether the config leaves output as it is
+func (c JobLogFilterConfig) IsZero() bool {
+	return (c.ANSI == "" || c.ANSI == JobLogANSIKeep) && c.ProgressSampleInterval == 0 && c.MaxLineLength == 0
+}
+
+// Validate returns an error if the config can't be used
+func (c JobLogFilterConfig) Validate() error {
+	switch c.ANSI {
+	case "", JobLogANSIKeep, JobLogANSIStrip, JobLogANSINormalize:
+	default:
+		return fmt.Errorf("invalid job log ANSI handling %q, expected %s, %s or %s", c.ANSI, JobLogANSIKeep, JobLogANSIStrip, JobLogANSINormalize)
+	}
+	if c.ProgressSampleInterval < 0 {
+		return fmt.Errorf("invalid job log progress sample interval %s", c.ProgressSampleInterval)
+	}
+	if c.MaxLineLength < 0 {
+		return fmt.Errorf("invalid job log max line length %d", c.MaxLineLength)
+	}
+	return nil
+}
+
+// How much of a line is held while waiting for its end, when there's no
+// maximum line length. Longer lines are written in pieces.
+const jobLogFilterMaxPending = 64 * 1024
+
+// jobLogFilter shrinks job output on its way to the log. It works a line at a
+// time, so it holds on to the end of the output until the line is finished,
+// or it's flushed.
+type jobLogFilter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	conf JobLogFilterConfig
+	now  func() time.Time
+
+	// The line, or the part of it since the last carriage return, so far
+	line []byte
+
+	// How many bytes were cut from the line
+	cut int
+
+	// Whether the last write ended with a carriage return, which might be
+	// the start of a \r\n line ending
+	pendingCR bool
+
+	// When a redrawn line was last written
+	lastSample time.Time
+}
+
+func newJobLogFilter(w io.Writer, conf JobLogFilterConfig) *jobLogFilter {
+	return &jobLogFilter{w: w, conf: conf, now: time.Now}
+}
+
+func (f *jobLogFilter) Write(data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(data)
+
+	if f.pendingCR {
+		f.pendingCR = false
+		if len(data) > 0 && data[0] == '\n' {
+			if err := f.write("\r\n"); err != nil {
+				return 0, err
+			}
+			data = data[1:]
+		} else if err := f.redraw(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			if err := f.add(data); err != nil {
+				return 0, err
+			}
+			break
+		}
+		if err := f.add(data[:i]); err != nil {
+			return 0, err
+		}
+
+		switch {
+		case data[i] == '\n':
+			if err := f.write("\n"); err != nil {
+				return 0, err
+			}
+		case i+1 == len(data):
+			// Wait for the next write to see if it's a line ending
+			f.pendingCR = true
+		case data[i+1] == '\n':
+			if err := f.write("\r\n"); err != nil {
+				return 0, err
+			}
+			i++
+		default:
+			if err := f.redraw(); err != nil {
+				return 0, err
+			}
+		}
+		data = data[i+1:]
+	}
+
+	return n, nil
+}
+
+// Flush writes the end of the output, which isn't a whole line
+func (f *jobLogFilter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ending := ""
+	if f.pendingCR {
+		f.pendingCR = false
+		ending = "\r"
+	}
+	if len(f.line) == 0 && f.cut == 0 && ending == "" {
+		return nil
+	}
+	return f.write(ending)
+}
+
+// add adds part of a line, cutting it at the maximum line length
+func (f *jobLogFilter) add(data []byte) error {
+	if max := f.conf.MaxLineLength; max > 0 {
+		if room := max - len(f.line); len(data) > room {
+			if room > 0 {
+				f.line = append(f.line, data[:room]...)
+				data = data[room:]
+			}
+			f.cut += len(data)
+			return nil
+		}
+	}
+
+	f.line = append(f.line, data...)
+
+	// Don't hold on to too much of a very long line
+	if f.conf.MaxLineLength == 0 && len(f.line) > jobLogFilterMaxPending {
+		return f.write("")
+	}
+	return nil
+}
+
+// redraw handles a carriage return in the middle of a line, which redraws it
+func (f *jobLogFilter) redraw() error {
+	if f.conf.ProgressSampleInterval == 0 {
+		return f.write("\r")
+	}
+
+	// Only write a redraw once in a while, as a line of its own. Redraws that
+	// are only escape sequences, like clearing the line, aren't worth one.
+	now := f.now()
+	if now.Sub(f.lastSample) < f.conf.ProgressSampleInterval || len(f.filter(f.line)) == 0 {
+		f.reset()
+		return nil
+	}
+	f.lastSample = now
+	return f.write("\n")
+}
+
+// write writes the line so far, with the ending, and starts another
+func (f *jobLogFilter) write(ending string) error {
+	defer f.reset()
+
+	line := f.filter(f.line)
+
+	var out bytes.Buffer
+	out.Grow(len(line) + len(ending) + 32)
+	out.Write(line)
+	if f.cut > 0 {
+		fmt.Fprintf(&out, "… [%d bytes cut]", f.cut)
+	}
+	out.WriteString(ending)
+
+	_, err := f.w.Write(out.Bytes())
+	return err
+}
+
+// filter handles the escape sequences in a line
+func (f *jobLogFilter) filter(line []byte) []byte {
+	switch f.conf.ANSI {
+	case JobLogANSIStrip:
+		return ansiEscapeRegex.ReplaceAll(line, nil)
+	case JobLogANSINormalize:
+		return ansiEscapeRegex.ReplaceAllFunc(line, func(seq []byte) []byte {
+			if ansiSGRRegex.Match(seq) {
+				return seq
+			}
+			return nil
+		})
+	}
+	return line
+}
+
+func (f *jobLogFilter) reset() {
+	f.line = f.line[:0]
+	f.cut = 0
+}
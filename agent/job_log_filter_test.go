@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJobLogFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		conf   JobLogFilterConfig
+		writes []string
+		want   string
+	}{
+		{
+			name:   "strip",
+			conf:   JobLogFilterConfig{ANSI: JobLogANSIStrip},
+			writes: []string{"\x1b[31mred\x1b[0m \x1b]0;title\x07text\x1b[2K\n", "tail"},
+			want:   "red text\ntail",
+		},
+		{
+			name:   "normalize",
+			conf:   JobLogFilterConfig{ANSI: JobLogANSINormalize},
+			writes: []string{"\x1b[1;32mgreen\x1b[0m\x1b[1A\x1b[2K\n"},
+			want:   "\x1b[1;32mgreen\x1b[0m\n",
+		},
+		{
+			name:   "escape split across writes",
+			conf:   JobLogFilterConfig{ANSI: JobLogANSIStrip},
+			writes: []string{"a\x1b[3", "1mb\n"},
+			want:   "ab\n",
+		},
+		{
+			name:   "max line length",
+			conf:   JobLogFilterConfig{MaxLineLength: 5},
+			writes: []string{"short\n", "much too", " long\r\n", "ok\n"},
+			want:   "short\nmuch … [8 bytes cut]\r\nok\n",
+		},
+		{
+			name:   "carriage returns pass through without sampling",
+			conf:   JobLogFilterConfig{ANSI: JobLogANSIStrip},
+			writes: []string{"10%\r", "50%\r100%\n"},
+			want:   "10%\r50%\r100%\n",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out bytes.Buffer
+			f := newJobLogFilter(&out, test.conf)
+			for _, w := range test.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatalf("f.Write(%q) error = %v", w, err)
+				}
+			}
+			if err := f.Flush(); err != nil {
+				t.Fatalf("f.Flush() error = %v", err)
+			}
+			if diff := cmp.Diff(test.want, out.String()); diff != "" {
+				t.Errorf("filtered output diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJobLogFilterSamplesProgressBars(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	f := newJobLogFilter(&out, JobLogFilterConfig{ProgressSampleInterval: 10 * time.Second})
+
+	now := time.Unix(1000, 0)
+	f.now = func() time.Time { return now }
+
+	for i, redraw := range []string{"0%\r", "\x1b[2K\r", "1%\r", "2%\r", "3%\r", "4%\r", "100%\r\n"} {
+		now = now.Add(3 * time.Second)
+		if i == 0 {
+			f.Write([]byte("downloading\n"))
+		}
+		if _, err := f.Write([]byte(redraw)); err != nil {
+			t.Fatalf("f.Write(%q) error = %v", redraw, err)
+		}
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatalf("f.Flush() error = %v", err)
+	}
+
+	want := "downloading\n0%\n3%\n100%\r\n"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Errorf("filtered output diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestJobLogFilterConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	if err := (JobLogFilterConfig{ANSI: "rainbow"}).Validate(); err == nil {
+		t.Errorf("JobLogFilterConfig{ANSI: rainbow}.Validate() = nil, want an error")
+	}
+	if err := (JobLogFilterConfig{ANSI: JobLogANSINormalize, MaxLineLength: 100}).Validate(); err != nil {
+		t.Errorf("JobLogFilterConfig{ANSI: normalize}.Validate() = %v", err)
+	}
+}
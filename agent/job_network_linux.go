@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// networkCounters returns the bytes received and sent by the network
+// interfaces in the agent's network namespace, other than loopback
+func networkCounters() (received, sent int64, ok bool) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	received, sent, err = parseNetDev(f)
+	return received, sent, err == nil
+}
+
+// parseNetDev totals the bytes received and sent in /proc/net/dev, which
+// has two lines of headers, then a line per interface like
+// "  eth0: <8 received counters> <8 sent counters>"
+func parseNetDev(r io.Reader) (received, sent int64, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			return 0, 0, fmt.Errorf("invalid line %q", scanner.Text())
+		}
+		if strings.TrimSpace(name) == "lo" {
+			continue
+		}
+
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return 0, 0, fmt.Errorf("invalid counters for %s: %q", name, counters)
+		}
+		rx, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		tx, err := strconv.ParseInt(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		received += rx
+		sent += tx
+	}
+	return received, sent, scanner.Err()
+}
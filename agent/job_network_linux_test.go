@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	const netDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 5000000    4000    0    0    0     0          0         0  5000000    4000    0    0    0     0       0          0
+  eth0: 1200000    9000    0    0    0     0          0         0   340000    3000    0    0    0     0       0          0
+  eth1:   34000     100    0    0    0     0          0         0     5600      80    0    0    0     0       0          0
+`
+
+	received, sent, err := parseNetDev(strings.NewReader(netDev))
+	if err != nil {
+		t.Fatalf("parseNetDev() error = %v", err)
+	}
+	if received != 1234000 || sent != 345600 {
+		t.Errorf("parseNetDev() = (%d, %d), want (1234000, 345600)", received, sent)
+	}
+
+	if _, _, err := parseNetDev(strings.NewReader("header\nheader\n  eth0 1 2 3\n")); err == nil {
+		t.Error("parseNetDev(invalid) error = nil, want an error")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// networkCounters isn't supported beyond Linux
+func networkCounters() (received, sent int64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/dustin/go-humanize"
+)
+
+// jobResources is what a job's process tree used while it ran
+type jobResources struct {
+	process.ResourceUsage
+
+	// Bytes received and sent over the network while the job ran, where
+	// they're known
+	network         bool
+	networkReceived int64
+	networkSent     int64
+}
+
+func (j jobResources) String() string {
+	parts := []string{fmt.Sprintf("%v of CPU time", j.CPUTime().Round(time.Millisecond))}
+	if j.MaxRSS > 0 {
+		parts = append(parts, humanize.Bytes(uint64(j.MaxRSS))+" peak memory")
+	}
+	if j.BytesRead > 0 || j.BytesWritten > 0 {
+		parts = append(parts, fmt.Sprintf("%s read and %s written to disk",
+			humanize.Bytes(uint64(j.BytesRead)), humanize.Bytes(uint64(j.BytesWritten))))
+	}
+	if j.network {
+		parts = append(parts, fmt.Sprintf("%s received and %s sent over the network",
+			humanize.Bytes(uint64(j.networkReceived)), humanize.Bytes(uint64(j.networkSent))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// jobNetworkStart is the network counters when the job started
+type jobNetworkStart struct {
+	ok             bool
+	received, sent int64
+}
+
+func startJobNetworkAccounting() jobNetworkStart {
+	received, sent, ok := networkCounters()
+	return jobNetworkStart{ok: ok, received: received, sent: sent}
+}
+
+// jobResources returns what the finished job used. The network counters
+// are for the agent's whole network namespace, so include anything else
+// running in it, such as other agents on the host.
+func (r *JobRunner) jobResources(netStart jobNetworkStart) *jobResources {
+	res := &jobResources{}
+	if proc, ok := r.process.(interface{ Usage() process.ResourceUsage }); ok {
+		res.ResourceUsage = proc.Usage()
+	}
+
+	if received, sent, ok := networkCounters(); ok && netStart.ok {
+		res.network = true
+		res.networkReceived = received - netStart.received
+		res.networkSent = sent - netStart.sent
+	}
+
+	return res
+}
+
+// reportJobResources records what the job used as metrics, and annotates
+// the build with it if the agent has been asked to
+func (r *JobRunner) reportJobResources(ctx context.Context, jobMetrics *metrics.Scope, res jobResources) {
+	r.logger.Info("Job %s used %s", r.job.ID, res)
+
+	jobMetrics.Timing("jobs.resources.cpu_time", res.CPUTime())
+	jobMetrics.Count("jobs.resources.max_rss_bytes", res.MaxRSS)
+	jobMetrics.Count("jobs.resources.disk_read_bytes", res.BytesRead)
+	jobMetrics.Count("jobs.resources.disk_written_bytes", res.BytesWritten)
+	if res.network {
+		jobMetrics.Count("jobs.resources.network_received_bytes", res.networkReceived)
+		jobMetrics.Count("jobs.resources.network_sent_bytes", res.networkSent)
+	}
+
+	if !r.conf.AgentConfiguration.AnnotateJobResources {
+		return
+	}
+
+	label := r.job.Env["BUILDKITE_LABEL"]
+	if label == "" {
+		label = r.job.ID
+	}
+
+	// Every job in the build adds a line to the same annotation
+	_, err := r.apiClient.Annotate(ctx, r.job.ID, &api.Annotation{
+		Context: "buildkite-agent-job-resources",
+		Style:   "info",
+		Append:  true,
+		Body:    fmt.Sprintf("- **%s** used %s\n", label, res),
+	})
+	if err != nil {
+		r.logger.Warn("Failed to annotate the build with the resources job %s used: %v", r.job.ID, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,15 +14,19 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/cgroup"
+	"github.com/buildkite/agent/v3/dockerproxy"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/kubernetes"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/agent/v3/status"
 	"github.com/buildkite/roko"
 	"github.com/buildkite/shellwords"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -69,6 +74,18 @@ var ProtectedEnv = map[string]struct{}{
 	"BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT": {},
 	"BUILDKITE_GIT_CLEAN_FLAGS":          {},
 	"BUILDKITE_SHELL":                    {},
+	"BUILDKITE_SCRATCH_DIR":              {},
+
+	// How the checkout is retried, and where from
+	"BUILDKITE_GIT_CHECKOUT_RETRIES":       {},
+	"BUILDKITE_GIT_CHECKOUT_RETRY_BACKOFF": {},
+	"BUILDKITE_GIT_CHECKOUT_CLEAN_ON":      {},
+	"BUILDKITE_GIT_REMOTE_FALLBACKS":       {},
+	"BUILDKITE_GIT_CHECKOUT_LAYOUT":        {},
+
+	// How submodules are authenticated to and updated
+	"BUILDKITE_GIT_SUBMODULE_CREDENTIALS": {},
+	"BUILDKITE_GIT_SUBMODULE_CONCURRENCY": {},
 }
 
 type JobRunnerConfig struct {
@@ -86,11 +103,26 @@ type JobRunnerConfig struct {
 
 	// Stdout of the parent agent process. Used for job log stdout writing arg, for simpler containerized log collection.
 	AgentStdout io.Writer
+
+	// Limits how fast the job's log is uploaded, shared with the other jobs
+	// the agent runs. If nil, there's no limit
+	LogUploadLimiter *rate.Limiter
 }
 
 type jobRunner interface {
 	Run(ctx context.Context) error
 	CancelAndStop() error
+
+	// JobID returns the ID of the job being run
+	JobID() string
+
+	// Phase returns the most recent header in the job's log, which says
+	// what the job is doing
+	Phase() string
+
+	// ArtifactTransfer reports whether the job is uploading or downloading
+	// artifacts
+	ArtifactTransfer() bool
 }
 
 type JobRunner struct {
@@ -118,12 +150,27 @@ type JobRunner struct {
 	// The internal buffer of the process output
 	output *process.Buffer
 
+	// Shrinks the output before it's buffered, if the agent is configured to
+	logFilter *jobLogFilter
+
 	// The internal header time streamer
 	headerTimesStreamer *headerTimesStreamer
 
+	// Writes the job's status to a file, if the agent is configured to
+	statusFile *jobStatusFile
+
 	// The internal log streamer
 	logStreamer *LogStreamer
 
+	// Uploads events recognised in the output, if the job-events experiment
+	// is enabled
+	jobEventStreamer *jobEventStreamer
+
+	// A stream to upload log chunks over, if the streaming-logs experiment
+	// is enabled and the stream hasn't broken
+	chunkStream     *api.ChunkStream
+	chunkStreamLock sync.Mutex
+
 	// If the job is being cancelled
 	cancelled bool
 
@@ -133,8 +180,26 @@ type JobRunner struct {
 	// A lock to protect concurrent calls to cancel
 	cancelLock sync.Mutex
 
+	// How the job is cancelled
+	cancel cancelSettings
+
 	// File containing a copy of the job env
 	envFile *os.File
+
+	// Directory for the job's temporary files, if the agent provides one
+	scratchDir *scratchDir
+
+	// Directory the job's commands save the writes the API didn't take to,
+	// to retry before the job finishes
+	pendingWritesDir string
+
+	// Directory the job's artifact commands mark themselves as transferring
+	// in
+	artifactTransfersDir string
+
+	// Lets the version of the hooks bundle the job uses be removed once it's
+	// finished
+	releaseHooksBundle func()
 }
 
 type jobAPI interface {
@@ -149,16 +214,33 @@ type jobAPI interface {
 var _ jobRunner = (*JobRunner)(nil)
 
 // Initializes the job runner
-func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterResponse, job *api.Job, apiClient APIClient, conf JobRunnerConfig) (jobRunner, error) {
+func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterResponse, job *api.Job, apiClient APIClient, conf JobRunnerConfig) (_ jobRunner, err error) {
 	runner := &JobRunner{
-		agent:     ag,
-		job:       job,
-		logger:    l,
-		conf:      conf,
-		metrics:   scope,
-		apiClient: apiClient,
+		agent:              ag,
+		job:                job,
+		logger:             l,
+		conf:               conf,
+		metrics:            scope,
+		apiClient:          apiClient,
+		cancel:             jobCancelSettings(l, conf, job.Env),
+		releaseHooksBundle: func() {},
+	}
+
+	// The job uses the version of the hooks bundle that's current as it
+	// starts, even if a new one arrives while it's running
+	if bundle := conf.AgentConfiguration.HooksBundle; bundle != nil {
+		runner.conf.AgentConfiguration.HooksPath, runner.releaseHooksBundle = bundle.Acquire()
 	}
 
+	// A job that can't be created won't be run, so nothing else will clean
+	// up after it
+	defer func() {
+		if err != nil {
+			runner.releaseHooksBundle()
+			runner.removeScratchDir()
+		}
+	}()
+
 	// If the accept response has a token attached, we should use that instead of the Agent Access Token that
 	// our current apiClient is using
 	if job.Token != "" {
@@ -170,11 +252,22 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	// Create our header times struct
 	runner.headerTimesStreamer = newHeaderTimesStreamer(l, runner.onUploadHeaderTime)
 
+	// Each header starts a new phase of the job in its status file
+	if path := conf.AgentConfiguration.JobStatusFile; path != "" {
+		runner.statusFile = newJobStatusFile(l, path, ag.Name, conf.AgentConfiguration.UsagePath, job.ID)
+		runner.headerTimesStreamer.onHeader = runner.statusFile.phase
+	}
+
+	if experiments.IsEnabled(experiments.JobEvents) {
+		runner.jobEventStreamer = newJobEventStreamer(l, runner.onUploadJobEvents)
+	}
+
 	// The log streamer that will take the output chunks, and send them to
 	// the Buildkite Agent API
 	runner.logStreamer = NewLogStreamer(l, runner.onUploadChunk, LogStreamerConfig{
 		Concurrency:       3,
 		MaxChunkSizeBytes: job.ChunksMaxSizeBytes,
+		RateLimiter:       conf.LogUploadLimiter,
 	})
 
 	// TempDir is not guaranteed to exist
@@ -194,6 +287,30 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		runner.envFile = file
 	}
 
+	// Prepare a directory for writes to retry at the end of the job
+	pendingWritesDir, err := os.MkdirTemp(tempDir, fmt.Sprintf("job-pending-writes-%s", job.ID))
+	if err != nil {
+		return runner, err
+	}
+	runner.pendingWritesDir = pendingWritesDir
+
+	// Prepare a directory for artifact commands to mark their transfers in
+	artifactTransfersDir, err := os.MkdirTemp(tempDir, fmt.Sprintf("job-artifact-transfers-%s", job.ID))
+	if err != nil {
+		return runner, err
+	}
+	runner.artifactTransfersDir = artifactTransfersDir
+
+	// Prepare a directory for the job's temporary files
+	if conf.AgentConfiguration.ScratchPath != "" {
+		dir, err := createScratchDir(conf.AgentConfiguration.ScratchPath, job.ID, conf.AgentConfiguration.ScratchTmpfsSize)
+		if err != nil {
+			return runner, fmt.Errorf("Failed to create scratch directory: %w", err)
+		}
+		l.Debug("[JobRunner] Created scratch directory: %s", dir.path)
+		runner.scratchDir = dir
+	}
+
 	env, err := runner.createEnvironment()
 	if err != nil {
 		return nil, err
@@ -213,6 +330,15 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	allWriters := []io.Writer{}
 
+	// filtered puts the log filter in front of w, if there is one
+	filtered := func(w io.Writer) io.Writer {
+		if conf.AgentConfiguration.JobLogFilter.IsZero() {
+			return w
+		}
+		runner.logFilter = newJobLogFilter(w, conf.AgentConfiguration.JobLogFilter)
+		return runner.logFilter
+	}
+
 	switch {
 	case experiments.IsEnabled(experiments.ANSITimestamps):
 		// If we have ansi-timestamps, we can skip line timestamps AND header times
@@ -221,18 +347,31 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 			return fmt.Sprintf("\x1b_bk;t=%d\x07",
 				time.Now().UnixNano()/int64(time.Millisecond))
 		})
-		allWriters = append(allWriters, prefixer)
+		allWriters = append(allWriters, filtered(prefixer))
+
+		// Header times aren't needed, but job events still are
+		if runner.jobEventStreamer != nil {
+			allWriters = append(allWriters, pw)
+
+			go func() {
+				err := process.NewScanner(l).ScanLines(pr, runner.jobEventStreamer.Scan)
+				if err != nil {
+					l.Error("[JobRunner] Encountered error %v", err)
+				}
+			}()
+		}
 
 	case conf.AgentConfiguration.TimestampLines:
 		// If we have timestamp lines on, we have to buffer lines before we flush them
 		// because we need to know if the line is a header or not. It's a bummer.
-		allWriters = append(allWriters, pw)
+		allWriters = append(allWriters, filtered(pw))
 
 		go func() {
 			// Use a scanner to process output line by line
 			err := process.NewScanner(l).ScanLines(pr, func(line string) {
 				// Send to our header streamer and determine if it's a header
 				isHeader := runner.headerTimesStreamer.Scan(line)
+				runner.scanJobEvent(line)
 
 				// Prefix non-header log lines with timestamps
 				if !(isHeaderExpansion(line) || isHeader) {
@@ -249,12 +388,13 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	default:
 		// Write output directly to the line buffer so we
-		allWriters = append(allWriters, pw, runner.output)
+		allWriters = append(allWriters, pw, filtered(runner.output))
 
 		// Use a scanner to process output for headers only
 		go func() {
 			err := process.NewScanner(l).ScanLines(pr, func(line string) {
 				runner.headerTimesStreamer.Scan(line)
+				runner.scanJobEvent(line)
 			})
 			if err != nil {
 				l.Error("[JobRunner] Encountered error %v", err)
@@ -319,13 +459,15 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 			PTY:             conf.AgentConfiguration.RunInPty,
 			Stdout:          processWriter,
 			Stderr:          processWriter,
-			InterruptSignal: conf.CancelSignal,
+			InterruptSignal: runner.cancel.signal,
+			SignalTarget:    runner.cancel.target,
 		})
 	}
 
 	// Close the writer end of the pipe when the process finishes
 	go func() {
 		<-runner.process.Done()
+		runner.flushLogFilter()
 		if err := pw.Close(); err != nil {
 			l.Error("%v", err)
 		}
@@ -339,6 +481,18 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	return runner, nil
 }
 
+// removeScratchDir removes the job's scratch directory, if it has one
+func (r *JobRunner) removeScratchDir() {
+	if r.scratchDir == nil {
+		return
+	}
+	if err := r.scratchDir.remove(); err != nil {
+		r.logger.Warn("[JobRunner] Error cleaning up scratch directory: %s", err)
+		return
+	}
+	r.logger.Debug("[JobRunner] Deleted scratch directory: %s", r.scratchDir.path)
+}
+
 // Runs the job
 func (r *JobRunner) Run(ctx context.Context) error {
 	r.logger.Info("Starting job %s", r.job.ID)
@@ -346,6 +500,9 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	ctx, done := status.AddItem(ctx, "Job Runner", "", nil)
 	defer done()
 
+	defer r.releaseHooksBundle()
+	defer r.removeScratchDir()
+
 	startedAt := time.Now()
 
 	// Start the build in the Buildkite Agent API. This is the first thing
@@ -355,6 +512,10 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		return err
 	}
 
+	if r.statusFile != nil {
+		r.statusFile.started(startedAt)
+	}
+
 	// If this agent successfully grabs the job from the API, publish metric for
 	// how long this job was in the queue for, if we can calculate that
 	if r.job.RunnableAt != "" {
@@ -369,6 +530,16 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	// Start the header time streamer
 	go r.headerTimesStreamer.Run(ctx)
 
+	// Start the job event streamer
+	if r.jobEventStreamer != nil {
+		go r.jobEventStreamer.Run(ctx)
+	}
+
+	// Upload the log over a stream, rather than a request per chunk
+	if experiments.IsEnabled(experiments.StreamingLogs) {
+		r.openChunkStream(ctx)
+	}
+
 	// Start the log streamer. Launches multiple goroutines.
 	if err := r.logStreamer.Start(ctx); err != nil {
 		return err
@@ -404,10 +575,16 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	// Used to wait on various routines that we spin up
 	var wg sync.WaitGroup
 
+	// What the job used, if it ran
+	var resources *jobResources
+
 	// Set up a child context for helper goroutines related to running the job.
 	cctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// The cgroup the job runs in, if any
+	var group *cgroup.Group
+
 	if environmentCommandOkay {
 		// Kick off log streaming and job status checking when the process
 		// starts.
@@ -415,8 +592,18 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		go r.jobLogStreamer(cctx, &wg)
 		go r.jobCancellationChecker(cctx, &wg)
 
+		// Limit the resources the job can use, and keep track of what it
+		// starts
+		if r.conf.AgentConfiguration.JobCgroupParent != "" {
+			group = r.createJobCgroup()
+		}
+
 		// Run the process. This will block until it finishes.
-		if err := r.process.Run(cctx); err != nil {
+		netStart := startJobNetworkAccounting()
+		err := r.process.Run(cctx)
+		resources = r.jobResources(netStart)
+
+		if err != nil {
 			// Send the error as output
 			r.logStreamer.Process([]byte(err.Error()))
 
@@ -437,6 +624,7 @@ func (r *JobRunner) Run(ctx context.Context) error {
 			}
 
 			// Add the final output to the streamer
+			r.flushLogFilter()
 			r.logStreamer.Process(r.output.ReadAndTruncate())
 
 			// Collect the finished process' exit status
@@ -455,6 +643,15 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		}
 	}
 
+	// Clean up anything the job left running, so it can't interfere with
+	// later jobs
+	if r.conf.AgentConfiguration.ReapOrphanedProcesses && environmentCommandOkay {
+		r.reapOrphanedProcesses(group)
+	}
+	if group != nil {
+		r.removeJobCgroup(group)
+	}
+
 	// Store the finished at time
 	finishedAt := time.Now()
 
@@ -462,9 +659,15 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	// have been uploaded
 	r.headerTimesStreamer.Stop()
 
+	// Stop the job event streamer, once the last events are uploaded
+	if r.jobEventStreamer != nil {
+		r.jobEventStreamer.Stop()
+	}
+
 	// Stop the log streamer. This will block until all the chunks have
 	// been uploaded
 	r.logStreamer.Stop()
+	r.closeChunkStream()
 
 	// Warn about failed chunks
 	if count := r.logStreamer.FailedChunks(); count > 0 {
@@ -478,6 +681,26 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	r.logger.Debug("[JobRunner] Waiting for all other routines to finish")
 	wg.Wait()
 
+	// Retry the annotations, meta-data and artifact states the job couldn't
+	// write, before the job is finished and they'd be lost
+	if r.pendingWritesDir != "" {
+		flushCtx, cancelFlush := context.WithTimeout(ctx, pendingWritesFlushTimeout)
+		written, failed := FlushPendingWrites(flushCtx, r.logger, r.apiClient, r.pendingWritesDir)
+		cancelFlush()
+		if written > 0 || failed > 0 {
+			r.logger.Info("Retried the job's pending writes: %d written, %d failed", written, failed)
+		}
+		if err := os.RemoveAll(r.pendingWritesDir); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up pending writes directory: %s", err)
+		}
+	}
+
+	if r.artifactTransfersDir != "" {
+		if err := os.RemoveAll(r.artifactTransfersDir); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up artifact transfers directory: %s", err)
+		}
+	}
+
 	// Remove the env file, if any
 	if r.envFile != nil {
 		if err := os.Remove(r.envFile.Name()); err != nil {
@@ -497,6 +720,13 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		jobMetrics.Timing("jobs.duration.error", finishedAt.Sub(startedAt))
 		jobMetrics.Count("jobs.failed", 1)
 	}
+	if resources != nil {
+		r.reportJobResources(ctx, jobMetrics, *resources)
+	}
+
+	if r.statusFile != nil {
+		r.statusFile.finished(finishedAt, exitStatus, signal, signalReason)
+	}
 
 	// Finish the build in the Buildkite Agent API
 	//
@@ -509,6 +739,21 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	return nil
 }
 
+func (r *JobRunner) JobID() string {
+	return r.job.ID
+}
+
+func (r *JobRunner) Phase() string {
+	return r.headerTimesStreamer.LastHeader()
+}
+
+func (r *JobRunner) ArtifactTransfer() bool {
+	if r.Phase() == artifactUploadHeader {
+		return true
+	}
+	return r.artifactTransfersDir != "" && artifactTransferring(r.artifactTransfersDir)
+}
+
 func (r *JobRunner) CancelAndStop() error {
 	r.cancelLock.Lock()
 	r.stopped = true
@@ -533,8 +778,8 @@ func (r *JobRunner) Cancel() error {
 	if r.stopped {
 		reason = " (agent stopping)"
 	}
-	r.logger.Info("Canceling job %s with a grace period of %ds%s",
-		r.job.ID, r.conf.AgentConfiguration.CancelGracePeriod, reason)
+	r.logger.Info("Canceling job %s with a grace period of %s%s",
+		r.job.ID, r.cancel.gracePeriod, reason)
 
 	r.cancelled = true
 
@@ -545,7 +790,7 @@ func (r *JobRunner) Cancel() error {
 
 	select {
 	// Grace period for cancelling
-	case <-time.After(time.Second * time.Duration(r.conf.AgentConfiguration.CancelGracePeriod)):
+	case <-time.After(r.cancel.gracePeriod):
 		r.logger.Info("Job %s hasn't stopped in time, terminating", r.job.ID)
 
 		// Terminate the process as we've exceeded our context
@@ -557,6 +802,55 @@ func (r *JobRunner) Cancel() error {
 	}
 }
 
+// cancelSettings are how a job is cancelled: the signal it's interrupted with,
+// which processes are signalled, and how long they have to exit before
+// they're killed
+type cancelSettings struct {
+	signal      process.Signal
+	target      process.SignalTarget
+	gracePeriod time.Duration
+}
+
+// jobCancelSettings returns the agent's cancel settings, with any that the
+// pipeline overrides in the job's environment, e.g. to give a database under
+// test longer to shut down. Invalid overrides are ignored with a warning.
+func jobCancelSettings(l logger.Logger, conf JobRunnerConfig, env map[string]string) cancelSettings {
+	s := cancelSettings{
+		signal:      conf.CancelSignal,
+		target:      conf.AgentConfiguration.CancelSignalTarget,
+		gracePeriod: time.Duration(conf.AgentConfiguration.CancelGracePeriod) * time.Second,
+	}
+	if s.target == "" {
+		s.target = process.SignalProcessGroup
+	}
+
+	if v, ok := env["BUILDKITE_CANCEL_SIGNAL"]; ok {
+		if sig, err := process.ParseSignal(v); err != nil {
+			l.Warn("Ignoring BUILDKITE_CANCEL_SIGNAL from the job: %v", err)
+		} else {
+			s.signal = sig
+		}
+	}
+
+	if v, ok := env["BUILDKITE_CANCEL_SIGNAL_TARGET"]; ok {
+		if target, err := process.ParseSignalTarget(v); err != nil {
+			l.Warn("Ignoring BUILDKITE_CANCEL_SIGNAL_TARGET from the job: %v", err)
+		} else {
+			s.target = target
+		}
+	}
+
+	if v, ok := env["BUILDKITE_CANCEL_GRACE_PERIOD"]; ok {
+		if seconds, err := strconv.Atoi(v); err != nil || seconds < 0 {
+			l.Warn("Ignoring BUILDKITE_CANCEL_GRACE_PERIOD from the job: %q isn't a number of seconds", v)
+		} else {
+			s.gracePeriod = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return s
+}
+
 // Creates the environment variables that will be used in the process and writes a flat environment file
 func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Create a clone of our jobs environment. We'll then set the
@@ -568,8 +862,9 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		env[key] = value
 	}
 
-	// The agent registration token should never make it into the job environment
+	// The agent registration tokens should never make it into the job environment
 	delete(env, "BUILDKITE_AGENT_TOKEN")
+	delete(env, "BUILDKITE_AGENT_SECONDARY_TOKEN")
 
 	// Write out the job environment to a file, in k="v" format, with newlines escaped
 	// We present only the clean environment - i.e only variables configured
@@ -600,6 +895,75 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		env["BUILDKITE_IGNORED_ENV"] = strings.Join(ignoredEnv, ",")
 	}
 
+	// Point the job at its scratch directory, and have temporary files go
+	// there instead of the system temp directory
+	if r.scratchDir != nil {
+		env["BUILDKITE_SCRATCH_DIR"] = r.scratchDir.path
+		if runtime.GOOS == "windows" {
+			env["TEMP"] = r.scratchDir.path
+			env["TMP"] = r.scratchDir.path
+		} else {
+			env["TMPDIR"] = r.scratchDir.path
+		}
+	}
+
+	// Have Docker go through the agent's proxy, which limits what it can do
+	if r.conf.AgentConfiguration.DockerProxySocket != "" {
+		env["DOCKER_HOST"] = dockerproxy.DockerHost(r.conf.AgentConfiguration.DockerProxySocket)
+	}
+
+	// Have API writes that fail be retried before the job finishes
+	if r.pendingWritesDir != "" {
+		env[PendingWritesDirEnv] = r.pendingWritesDir
+	}
+
+	// Have artifact commands say when they're transferring
+	if r.artifactTransfersDir != "" {
+		env[ArtifactTransfersDirEnv] = r.artifactTransfersDir
+	}
+
+	// Have artifact commands record what they transfer
+	if r.conf.AgentConfiguration.UsagePath != "" {
+		env["BUILDKITE_USAGE_PATH"] = r.conf.AgentConfiguration.UsagePath
+	}
+
+	// Have artifact uploads apply the agent's post-processing rules
+	if r.conf.AgentConfiguration.ArtifactPostProcessors != "" {
+		env["BUILDKITE_ARTIFACT_POST_PROCESSORS"] = r.conf.AgentConfiguration.ArtifactPostProcessors
+	}
+	if r.conf.AgentConfiguration.ArtifactSigningKey != "" {
+		env["BUILDKITE_ARTIFACT_SIGNING_KEY"] = r.conf.AgentConfiguration.ArtifactSigningKey
+	}
+
+	// Have artifact uploads without a destination go to the agent's, rather
+	// than Buildkite's artifact storage
+	if r.conf.AgentConfiguration.ArtifactDefaultDestination != "" {
+		env["BUILDKITE_ARTIFACT_UPLOAD_DEFAULT_DESTINATION"] = r.conf.AgentConfiguration.ArtifactDefaultDestination
+	}
+
+	// Have meta-data commands encrypt and decrypt values with the agent's key
+	if r.conf.AgentConfiguration.MetaDataEncryptionKeyFile != "" {
+		env[MetaDataEncryptionKeyFileEnv] = r.conf.AgentConfiguration.MetaDataEncryptionKeyFile
+	}
+
+	// Have artifact downloads apply the agent's URL rewrites
+	if r.conf.AgentConfiguration.ArtifactURLRewrites != "" {
+		env["BUILDKITE_ARTIFACT_URL_REWRITES"] = r.conf.AgentConfiguration.ArtifactURLRewrites
+	}
+
+	// Leave LFS files as pointers, unless the job says otherwise
+	if _, exists := r.job.Env["BUILDKITE_GIT_LFS_SKIP_SMUDGE"]; !exists && r.conf.AgentConfiguration.GitLFSSkipSmudge {
+		env["BUILDKITE_GIT_LFS_SKIP_SMUDGE"] = "true"
+	}
+
+	// Have jobs see the agent's tags as environment variables, unless the
+	// job sets them itself
+	for name, value := range r.conf.AgentConfiguration.TagsEnv {
+		if _, exists := r.job.Env[name]; !exists {
+			env[name] = value
+		}
+	}
+
 	// Add the API configuration
 	apiConfig := r.apiClient.Config()
 	env["BUILDKITE_AGENT_ENDPOINT"] = apiConfig.Endpoint
@@ -640,15 +1004,25 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_GIT_FETCH_FLAGS"] = r.conf.AgentConfiguration.GitFetchFlags
 	env["BUILDKITE_GIT_CLONE_MIRROR_FLAGS"] = r.conf.AgentConfiguration.GitCloneMirrorFlags
 	env["BUILDKITE_GIT_CLEAN_FLAGS"] = r.conf.AgentConfiguration.GitCleanFlags
+	env["BUILDKITE_GIT_CHECKOUT_RETRIES"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitCheckoutRetries)
+	env["BUILDKITE_GIT_CHECKOUT_RETRY_BACKOFF"] = r.conf.AgentConfiguration.GitCheckoutRetryBackoff
+	env["BUILDKITE_GIT_CHECKOUT_CLEAN_ON"] = strings.Join(r.conf.AgentConfiguration.GitCheckoutCleanOn, ",")
+	env["BUILDKITE_GIT_REMOTE_FALLBACKS"] = strings.Join(r.conf.AgentConfiguration.GitRemoteFallbacks, ",")
+	env["BUILDKITE_GIT_CHECKOUT_LAYOUT"] = r.conf.AgentConfiguration.GitCheckoutLayout
+	env["BUILDKITE_GIT_SUBMODULE_CREDENTIALS"] = strings.Join(r.conf.AgentConfiguration.GitSubmoduleCredentials, ",")
+	env["BUILDKITE_GIT_SUBMODULE_CONCURRENCY"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitSubmoduleConcurrency)
 	env["BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitMirrorsLockTimeout)
 	env["BUILDKITE_SHELL"] = r.conf.AgentConfiguration.Shell
-	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
+	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.EnabledFor(r.job.Env["BUILDKITE_BUILD_ID"]), ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
 
-	// propagate CancelSignal to bootstrap, unless it's the default SIGTERM
-	if r.conf.CancelSignal != process.SIGTERM {
-		env["BUILDKITE_CANCEL_SIGNAL"] = r.conf.CancelSignal.String()
+	// propagate the cancel signal to bootstrap, unless it's the default
+	// SIGTERM. This replaces any the pipeline set, as it may not be valid.
+	delete(env, "BUILDKITE_CANCEL_SIGNAL")
+	if r.cancel.signal != process.SIGTERM {
+		env["BUILDKITE_CANCEL_SIGNAL"] = r.cancel.signal.String()
 	}
+	env["BUILDKITE_CANCEL_SIGNAL_TARGET"] = string(r.cancel.target)
 
 	// Whether to enable profiling in the bootstrap
 	if r.conf.AgentConfiguration.Profile != "" {
@@ -756,7 +1130,7 @@ func (r *JobRunner) startJob(ctx context.Context, startedAt time.Time) error {
 	return roko.NewRetrier(
 		roko.WithMaxAttempts(7),
 		roko.WithStrategy(roko.Exponential(2*time.Second, 0)),
-	).DoWithContext(ctx, func(rtr *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Starting job", func(rtr *roko.Retrier) error {
 		response, err := r.apiClient.StartJob(ctx, r.job)
 
 		if err != nil {
@@ -771,7 +1145,7 @@ func (r *JobRunner) startJob(ctx context.Context, startedAt time.Time) error {
 		}
 
 		return err
-	})
+	}))
 }
 
 // finishJob finishes the job in the Buildkite Agent API. If the FinishJob call
@@ -793,7 +1167,7 @@ func (r *JobRunner) finishJob(ctx context.Context, finishedAt time.Time, exitSta
 		roko.TryForever(),
 		roko.WithJitter(),
 		roko.WithStrategy(roko.Constant(1*time.Second)),
-	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Finishing job", func(retrier *roko.Retrier) error {
 		response, err := r.apiClient.FinishJob(ctx, r.job)
 		if err != nil {
 			// If the API returns with a 422, that means that we
@@ -814,7 +1188,18 @@ func (r *JobRunner) finishJob(ctx context.Context, finishedAt time.Time, exitSta
 		}
 
 		return err
-	})
+	}))
+}
+
+// flushLogFilter writes the end of the output held by the log filter, once
+// the process has finished
+func (r *JobRunner) flushLogFilter() {
+	if r.logFilter == nil {
+		return
+	}
+	if err := r.logFilter.Flush(); err != nil {
+		r.logger.Error("[JobRunner] Failed to flush job log filter: %v", err)
+	}
 }
 
 // jobLogStreamer waits for the process to start, then grabs the job output
@@ -910,7 +1295,7 @@ func (r *JobRunner) onUploadHeaderTime(ctx context.Context, cursor, total int, t
 	roko.NewRetrier(
 		roko.WithMaxAttempts(10),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Saving header times", func(retrier *roko.Retrier) error {
 		response, err := r.apiClient.SaveHeaderTimes(ctx, r.job.ID, &api.HeaderTimes{Times: times})
 		if err != nil {
 			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
@@ -922,7 +1307,39 @@ func (r *JobRunner) onUploadHeaderTime(ctx context.Context, cursor, total int, t
 		}
 
 		return err
-	})
+	}))
+}
+
+// scanJobEvent passes a line of output to the job event streamer, if there is
+// one
+func (r *JobRunner) scanJobEvent(line string) {
+	if r.jobEventStreamer != nil {
+		r.jobEventStreamer.Scan(line)
+	}
+}
+
+// onUploadJobEvents uploads a batch of job events. It returns false if
+// Buildkite rejected them, so no more are sent.
+func (r *JobRunner) onUploadJobEvents(ctx context.Context, events []*api.JobEvent) bool {
+	rejected := false
+	roko.NewRetrier(
+		roko.WithMaxAttempts(10),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+	).DoWithContext(ctx, retrylog.Wrap("Uploading job events", func(retrier *roko.Retrier) error {
+		response, err := r.apiClient.UploadJobEvents(ctx, r.job.ID, &api.JobEvents{Events: events})
+		if err != nil {
+			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
+				r.logger.Warn("Buildkite rejected the job events (%s)", err)
+				rejected = true
+				retrier.Break()
+			} else {
+				r.logger.Warn("%s (%s)", err, retrier)
+			}
+		}
+
+		return err
+	}))
+	return !rejected
 }
 
 // onUploadChunk uploads a log streamer chunk. If a valid chunk cannot be
@@ -936,6 +1353,16 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 	// This code will retry for a long time until we get back a successful
 	// response from Buildkite that it's considered the chunk (a 4xx will be
 	// returned if the chunk is invalid, and we shouldn't retry on that)
+	apiChunk := &api.Chunk{
+		Data:     chunk.Data,
+		Sequence: chunk.Order,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+	}
+	if r.streamChunk(apiChunk) {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 48*time.Hour)
 	defer cancel()
 
@@ -943,13 +1370,8 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 		roko.TryForever(),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
 		roko.WithJitter(),
-	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.UploadChunk(ctx, r.job.ID, &api.Chunk{
-			Data:     chunk.Data,
-			Sequence: chunk.Order,
-			Offset:   chunk.Offset,
-			Size:     chunk.Size,
-		})
+	).DoWithContext(ctx, retrylog.Wrap("Uploading log chunk", func(retrier *roko.Retrier) error {
+		response, err := r.apiClient.UploadChunk(ctx, r.job.ID, apiChunk)
 		if err != nil {
 			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
 				r.logger.Warn("Buildkite rejected the chunk upload (%s)", err)
@@ -960,7 +1382,7 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 		}
 
 		return err
-	})
+	}))
 }
 
 // jobLogger is just a simple wrapper around a JSON Logger that satisfies the
@@ -2,10 +2,15 @@ package agent
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/process"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -18,3 +23,62 @@ func TestTruncateEnv(t *testing.T) {
 	assert.Equal(t, "aaaaaaaaaaaaaaaaaaaaaaaaaa[value truncated 100 -> 59 bytes]", env["FOO"])
 	assert.Equal(t, 64, len(fmt.Sprintf("FOO=%s\000", env["FOO"])))
 }
+
+func TestJobCancelSettings(t *testing.T) {
+	conf := JobRunnerConfig{
+		AgentConfiguration: AgentConfiguration{CancelGracePeriod: 10},
+		CancelSignal:       process.SIGTERM,
+	}
+
+	t.Run("agent settings", func(t *testing.T) {
+		s := jobCancelSettings(logger.Discard, conf, map[string]string{})
+		assert.Equal(t, cancelSettings{
+			signal:      process.SIGTERM,
+			target:      process.SignalProcessGroup,
+			gracePeriod: 10 * time.Second,
+		}, s)
+	})
+
+	t.Run("pipeline overrides", func(t *testing.T) {
+		s := jobCancelSettings(logger.Discard, conf, map[string]string{
+			"BUILDKITE_CANCEL_SIGNAL":        "SIGINT",
+			"BUILDKITE_CANCEL_SIGNAL_TARGET": "session",
+			"BUILDKITE_CANCEL_GRACE_PERIOD":  "120",
+		})
+		assert.Equal(t, cancelSettings{
+			signal:      process.SIGINT,
+			target:      process.SignalSession,
+			gracePeriod: 2 * time.Minute,
+		}, s)
+	})
+
+	t.Run("invalid overrides are ignored", func(t *testing.T) {
+		l := logger.NewBuffer()
+		s := jobCancelSettings(l, conf, map[string]string{
+			"BUILDKITE_CANCEL_SIGNAL":        "SIGNOPE",
+			"BUILDKITE_CANCEL_SIGNAL_TARGET": "everything",
+			"BUILDKITE_CANCEL_GRACE_PERIOD":  "-1",
+		})
+		assert.Equal(t, cancelSettings{
+			signal:      process.SIGTERM,
+			target:      process.SignalProcessGroup,
+			gracePeriod: 10 * time.Second,
+		}, s)
+		assert.Len(t, l.Messages, 3)
+	})
+}
+
+func TestNewJobRunnerRemovesScratchDirOnError(t *testing.T) {
+	scratch := t.TempDir()
+	scope := metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+
+	_, err := NewJobRunner(logger.Discard, scope, &api.AgentRegisterResponse{}, &api.Job{ID: "1234"}, api.NewClient(logger.Discard, api.Config{}), JobRunnerConfig{
+		AgentConfiguration: AgentConfiguration{
+			ScratchPath: scratch,
+			// Can't be split into words
+			BootstrapScript: `buildkite-agent "bootstrap`,
+		},
+	})
+	require.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(scratch, "job-1234"))
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/system"
+)
+
+// scratchDir is a directory for a job's temporary files, which is removed
+// when the job finishes
+type scratchDir struct {
+	path string
+
+	// Whether a tmpfs is mounted at path
+	tmpfs bool
+}
+
+// createScratchDir creates a scratch directory for the job in parent. If
+// tmpfsSize isn't zero, it's a tmpfs of that many bytes, which also limits
+// how much the job can put in it.
+func createScratchDir(parent, jobID string, tmpfsSize uint64) (*scratchDir, error) {
+	d := &scratchDir{path: filepath.Join(parent, "job-"+jobID)}
+	if err := os.MkdirAll(d.path, 0o700); err != nil {
+		return nil, err
+	}
+
+	if tmpfsSize > 0 {
+		if err := system.MountTmpfs(d.path, tmpfsSize); err != nil {
+			_ = os.RemoveAll(d.path)
+			return nil, fmt.Errorf("mounting a tmpfs at %s: %w", d.path, err)
+		}
+		d.tmpfs = true
+	}
+
+	return d, nil
+}
+
+// remove removes the scratch directory and everything in it
+func (d *scratchDir) remove() error {
+	if d.tmpfs {
+		if err := system.UnmountTmpfs(d.path); err != nil {
+			return fmt.Errorf("unmounting the tmpfs at %s: %w", d.path, err)
+		}
+	}
+	return os.RemoveAll(d.path)
+}
@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchDir(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "scratch")
+
+	d, err := createScratchDir(parent, "1234", 0)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(parent, "job-1234"), d.path)
+	assert.DirExists(t, d.path)
+
+	// Jobs can leave anything behind in it
+	require.NoError(t, os.MkdirAll(filepath.Join(d.path, "cache", "deep"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(d.path, "cache", "deep", "file"), []byte("hello"), 0o600))
+
+	require.NoError(t, d.remove())
+	assert.NoDirExists(t, d.path)
+	assert.DirExists(t, parent)
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/usage"
+)
+
+// The states a job is in in its status file
+const (
+	jobStatusRunning  = "running"
+	jobStatusFinished = "finished"
+)
+
+// JobStatus is what the job status file says about the job an agent is
+// running. It's rewritten each time the job moves to a new phase, so
+// supervisors and sidecars on the host can follow the job without the API.
+type JobStatus struct {
+	JobID      string     `json:"job_id"`
+	State      string     `json:"state"`
+	Phase      string     `json:"phase"`
+	StartedAt  time.Time  `json:"started_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Set once the job has finished
+	ExitStatus   string `json:"exit_status,omitempty"`
+	Signal       string `json:"signal,omitempty"`
+	SignalReason string `json:"signal_reason,omitempty"`
+
+	// The phases the job has been through, in order
+	Phases []JobPhase `json:"phases"`
+
+	// Only known when the agent records usage with --usage-path
+	Artifacts *JobArtifactCounts `json:"artifacts,omitempty"`
+}
+
+// JobPhase is the time spent in one phase of a job, which starts with a
+// header in its log
+type JobPhase struct {
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+
+	// Set once the next phase starts, or the job finishes
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+}
+
+// JobArtifactCounts are the artifacts the job has transferred so far
+type JobArtifactCounts struct {
+	Uploaded        int64 `json:"uploaded"`
+	UploadedBytes   int64 `json:"uploaded_bytes"`
+	Downloaded      int64 `json:"downloaded"`
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+}
+
+// jobStatusFile keeps the job status file of a job up to date
+type jobStatusFile struct {
+	path      string
+	usagePath string
+	logger    logger.Logger
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// newJobStatusFile returns a jobStatusFile writing to path, where %agent is
+// replaced with the agent's name so spawned agents don't share a file
+func newJobStatusFile(l logger.Logger, path, agentName, usagePath, jobID string) *jobStatusFile {
+	return &jobStatusFile{
+		path:      strings.ReplaceAll(path, "%agent", agentName),
+		usagePath: usagePath,
+		logger:    l,
+		status:    JobStatus{JobID: jobID, Phases: []JobPhase{}},
+	}
+}
+
+// started records that the job has started
+func (f *jobStatusFile) started(at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.status.State = jobStatusRunning
+	f.status.StartedAt = at.UTC()
+	f.update(at)
+}
+
+// phase records that the job has moved to the phase named by a header
+func (f *jobStatusFile) phase(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.endPhase(now)
+	f.status.Phase = name
+	f.status.Phases = append(f.status.Phases, JobPhase{Name: name, StartedAt: now.UTC()})
+	f.update(now)
+}
+
+// finished records how the job finished
+func (f *jobStatusFile) finished(at time.Time, exitStatus, signal, signalReason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.endPhase(at)
+	finishedAt := at.UTC()
+	f.status.State = jobStatusFinished
+	f.status.FinishedAt = &finishedAt
+	f.status.ExitStatus = exitStatus
+	f.status.Signal = signal
+	f.status.SignalReason = signalReason
+	f.update(at)
+}
+
+// endPhase sets the duration of the current phase, if there is one
+func (f *jobStatusFile) endPhase(at time.Time) {
+	if n := len(f.status.Phases); n > 0 && f.status.Phases[n-1].DurationSeconds == nil {
+		d := at.Sub(f.status.Phases[n-1].StartedAt).Seconds()
+		f.status.Phases[n-1].DurationSeconds = &d
+	}
+}
+
+// update writes the status as of now. The job carries on if it can't be
+// written, as the file is only informational.
+func (f *jobStatusFile) update(now time.Time) {
+	f.status.UpdatedAt = now.UTC()
+	f.status.Artifacts = f.artifactCounts()
+
+	if err := f.write(); err != nil {
+		f.logger.Warn("Failed to write job status file %s: %v", f.path, err)
+	}
+}
+
+// artifactCounts totals the usage records of the job, if usage is recorded
+func (f *jobStatusFile) artifactCounts() *JobArtifactCounts {
+	if f.usagePath == "" {
+		return nil
+	}
+
+	records, err := usage.Read(f.usagePath, f.status.StartedAt)
+	if err != nil {
+		f.logger.Warn("Failed to read usage records for the job status file: %v", err)
+		return nil
+	}
+
+	counts := &JobArtifactCounts{}
+	for _, rec := range records {
+		if rec.JobID != f.status.JobID {
+			continue
+		}
+		switch rec.Kind {
+		case usage.ArtifactUpload:
+			counts.Uploaded += rec.Files
+			counts.UploadedBytes += rec.Bytes
+		case usage.ArtifactDownload:
+			counts.Downloaded += rec.Files
+			counts.DownloadedBytes += rec.Bytes
+		}
+	}
+	return counts
+}
+
+func (f *jobStatusFile) write() error {
+	b, err := json.Marshal(f.status)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o750); err != nil {
+		return fmt.Errorf("creating job status directory: %w", err)
+	}
+
+	// Write to a temporary file and rename it into place, so that readers
+	// never see a partially written file
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
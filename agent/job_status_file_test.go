@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/usage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readJobStatus(t *testing.T, path string) JobStatus {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var status JobStatus
+	require.NoError(t, json.Unmarshal(b, &status))
+	return status
+}
+
+func TestJobStatusFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	usagePath := filepath.Join(dir, "usage.jsonl")
+	f := newJobStatusFile(logger.Discard, filepath.Join(dir, "status", "%agent.json"), "llama-1", usagePath, "job-1")
+	path := filepath.Join(dir, "status", "llama-1.json")
+
+	startedAt := time.Now().Add(-time.Second)
+	f.started(startedAt)
+
+	status := readJobStatus(t, path)
+	assert.Equal(t, "job-1", status.JobID)
+	assert.Equal(t, jobStatusRunning, status.State)
+	assert.Empty(t, status.Phases)
+	assert.Equal(t, &JobArtifactCounts{}, status.Artifacts)
+
+	f.phase("Running commands")
+	f.phase("Uploading artifacts")
+
+	// Only this job's records are counted
+	for _, jobID := range []string{"job-1", "job-2"} {
+		r := usage.NewRecorder(usagePath, usage.Record{JobID: jobID})
+		r.Add(usage.ArtifactUpload, 100)
+		r.Add(usage.ArtifactUpload, 200)
+		require.NoError(t, r.Flush())
+	}
+
+	finishedAt := time.Now()
+	f.finished(finishedAt, "1", "", "")
+
+	status = readJobStatus(t, path)
+	assert.Equal(t, jobStatusFinished, status.State)
+	assert.Equal(t, "Uploading artifacts", status.Phase)
+	assert.Equal(t, "1", status.ExitStatus)
+	if assert.NotNil(t, status.FinishedAt) {
+		assert.True(t, status.FinishedAt.Equal(finishedAt.UTC()))
+	}
+	if assert.Len(t, status.Phases, 2) {
+		assert.Equal(t, "Running commands", status.Phases[0].Name)
+		for _, phase := range status.Phases {
+			assert.NotNil(t, phase.DurationSeconds, phase.Name)
+		}
+	}
+	assert.Equal(t, &JobArtifactCounts{Uploaded: 2, UploadedBytes: 300}, status.Artifacts)
+}
+
+func TestJobStatusFileWithoutUsage(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status.json")
+	f := newJobStatusFile(logger.Discard, path, "llama-1", "", "job-1")
+	f.started(time.Now())
+
+	assert.Nil(t, readJobStatus(t, path).Artifacts)
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// K8sTagsFromDownwardAPIFile reads pod labels (or annotations) from a file
+// projected by the Kubernetes downward API, e.g.
+//
+//	volumes:
+//	  - name: podinfo
+//	    downwardAPI:
+//	      items:
+//	        - path: labels
+//	          fieldRef:
+//	            fieldPath: metadata.labels
+//
+// Each line of the file is key="value", with the value quoted as a Go string.
+func K8sTagsFromDownwardAPIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		key, quoted, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: line %q is not key=\"value\"", path, line)
+		}
+
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("%s: unquoting value of %s: %w", path, key, err)
+		}
+
+		result[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
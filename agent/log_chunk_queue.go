@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"bytes"
+	"container/heap"
+	"sync"
+)
+
+// logChunkQueue holds the chunks of a job's log that are waiting to be
+// uploaded. Chunks with section headers in them come out first, so a job's
+// sections show up promptly even while it's producing more output than can be
+// uploaded, and the rest come out in order.
+type logChunkQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks logChunkHeap
+	closed bool
+
+	// The newest chunk, while it's still waiting. Output that arrives before
+	// it's uploaded is added to it rather than made into another chunk.
+	newest *LogStreamerChunk
+}
+
+func newLogChunkQueue() *logChunkQueue {
+	q := &logChunkQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a chunk to the queue
+func (q *logChunkQueue) push(chunk *LogStreamerChunk) {
+	chunk.header = hasHeader(chunk.Data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	heap.Push(&q.chunks, chunk)
+	q.newest = chunk
+	q.cond.Signal()
+}
+
+// appendToNewest adds data to the end of the newest chunk, if it's still
+// waiting and there's room in it for maxSize bytes. It returns whether it did,
+// and otherwise data needs a chunk of its own.
+func (q *logChunkQueue) appendToNewest(data []byte, maxSize int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.newest == nil || q.newest.Size+len(data) > maxSize {
+		return false
+	}
+
+	// The chunk's data shares its array with the output it was cut from, so
+	// copy it rather than append over the output that follows it
+	chunk := q.newest
+	chunk.Data = append(chunk.Data[:len(chunk.Data):len(chunk.Data)], data...)
+	chunk.Size += len(data)
+	if !chunk.header && hasHeader(data) {
+		chunk.header = true
+		heap.Fix(&q.chunks, chunk.index)
+	}
+	return true
+}
+
+// pop waits for the next chunk to upload. It returns nil once the queue is
+// closed and empty.
+func (q *logChunkQueue) pop() *LogStreamerChunk {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.chunks) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.chunks) == 0 {
+		return nil
+	}
+
+	chunk := heap.Pop(&q.chunks).(*LogStreamerChunk)
+	if chunk == q.newest {
+		q.newest = nil
+	}
+	return chunk
+}
+
+// close wakes everything waiting in pop once the queue is empty
+func (q *logChunkQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// hasHeader returns whether any line of the output is a section header
+func hasHeader(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		// Most lines can't be headers, so only check the ones that might be
+		if !bytes.Contains(line, []byte("---")) && !bytes.Contains(line, []byte("+++")) && !bytes.Contains(line, []byte("~~~")) {
+			continue
+		}
+		if isHeader(string(bytes.TrimSuffix(line, []byte("\r")))) {
+			return true
+		}
+	}
+	return false
+}
+
+// logChunkHeap orders chunks with headers first, then by their order
+type logChunkHeap []*LogStreamerChunk
+
+func (h logChunkHeap) Len() int { return len(h) }
+
+func (h logChunkHeap) Less(i, j int) bool {
+	if h[i].header != h[j].header {
+		return h[i].header
+	}
+	return h[i].Order < h[j].Order
+}
+
+func (h logChunkHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *logChunkHeap) Push(x any) {
+	chunk := x.(*LogStreamerChunk)
+	chunk.index = len(*h)
+	*h = append(*h, chunk)
+}
+
+func (h *logChunkHeap) Pop() any {
+	old := *h
+	chunk := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return chunk
+}
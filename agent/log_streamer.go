@@ -9,6 +9,7 @@ import (
 
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/status"
+	"golang.org/x/time/rate"
 )
 
 type LogStreamerConfig struct {
@@ -17,6 +18,11 @@ type LogStreamerConfig struct {
 
 	// The maximum size of chunks
 	MaxChunkSizeBytes int
+
+	// Limits how fast chunks are uploaded, in bytes per second. It's shared
+	// by every job the agent runs, so one chatty job can't hold up the logs of
+	// the others. If nil, there's no limit
+	RateLimiter *rate.Limiter
 }
 
 type LogStreamer struct {
@@ -33,7 +39,7 @@ type LogStreamer struct {
 	callback func(context.Context, *LogStreamerChunk) error
 
 	// The queue of chunks that are needing to be uploaded
-	queue chan *LogStreamerChunk
+	queue *logChunkQueue
 
 	// Total size in bytes of the log
 	bytes int
@@ -62,6 +68,11 @@ type LogStreamerChunk struct {
 
 	// The byte size of this chunk
 	Size int
+
+	// Whether the chunk has a section header in it, and where it is in the
+	// queue
+	header bool
+	index  int
 }
 
 // Creates a new instance of the log streamer
@@ -70,7 +81,7 @@ func NewLogStreamer(l logger.Logger, cb func(context.Context, *LogStreamerChunk)
 		logger:   l,
 		conf:     c,
 		callback: cb,
-		queue:    make(chan *LogStreamerChunk, 1024),
+		queue:    newLogChunkQueue(),
 	}
 }
 
@@ -97,6 +108,13 @@ func (ls *LogStreamer) Process(output []byte) error {
 	ls.processMutex.Lock()
 	defer ls.processMutex.Unlock()
 
+	// If the last chunk hasn't been uploaded yet, such as when uploads are
+	// falling behind, add to it rather than making more small chunks
+	if len(output) > 0 && len(output) <= ls.conf.MaxChunkSizeBytes && ls.queue.appendToNewest(output, ls.conf.MaxChunkSizeBytes) {
+		ls.bytes += len(output)
+		return nil
+	}
+
 	for len(output) > 0 {
 		// Add another chunk...
 		ls.chunkWaitGroup.Add(1)
@@ -115,12 +133,12 @@ func (ls *LogStreamer) Process(output []byte) error {
 		ls.order++
 
 		// Create the chunk and append it to our list
-		ls.queue <- &LogStreamerChunk{
+		ls.queue.push(&LogStreamerChunk{
 			Data:   chunk,
 			Order:  ls.order,
 			Offset: ls.bytes,
 			Size:   size,
-		}
+		})
 
 		// Save the new amount of bytes
 		ls.bytes += size
@@ -137,9 +155,7 @@ func (ls *LogStreamer) Stop() error {
 
 	ls.logger.Debug("[LogStreamer] Shutting down all workers")
 
-	for n := 0; n < ls.conf.Concurrency; n++ {
-		ls.queue <- nil
-	}
+	ls.queue.close()
 
 	return nil
 }
@@ -157,13 +173,18 @@ func (ls *LogStreamer) worker(ctx context.Context, id int) {
 
 		// Get the next chunk (pointer) from the queue. This will block
 		// until something is returned.
-		chunk := <-ls.queue
+		chunk := ls.queue.pop()
 
 		// If the next chunk is nil, then there is no more work to do
 		if chunk == nil {
 			break
 		}
 
+		if ls.conf.RateLimiter != nil {
+			setStat("🚦 Waiting for the upload rate limit")
+			waitForLogUpload(ctx, ls.conf.RateLimiter, chunk.Size)
+		}
+
 		setStat("📨 Passing chunk to callback")
 
 		// Upload the chunk
@@ -180,3 +201,19 @@ func (ls *LogStreamer) worker(ctx context.Context, id int) {
 
 	ls.logger.Debug("[LogStreamer/Worker#%d] Worker has shutdown", id)
 }
+
+// waitForLogUpload waits until the limiter allows size bytes to be uploaded,
+// in bursts no bigger than it allows at once. Chunks are uploaded regardless
+// once the context is done, as the logs are still wanted.
+func waitForLogUpload(ctx context.Context, limiter *rate.Limiter, size int) {
+	for size > 0 {
+		n := size
+		if burst := limiter.Burst(); n > burst {
+			n = burst
+		}
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return
+		}
+		size -= n
+	}
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogStreamerUploadsHeadersFirstAndFillsWaitingChunks(t *testing.T) {
+	t.Parallel()
+
+	type upload struct {
+		Data          string
+		Order, Offset int
+	}
+	var mu sync.Mutex
+	var uploads []upload
+
+	ls := NewLogStreamer(logger.Discard, func(_ context.Context, chunk *LogStreamerChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		uploads = append(uploads, upload{string(chunk.Data), chunk.Order, chunk.Offset})
+		return nil
+	}, LogStreamerConfig{Concurrency: 1, MaxChunkSizeBytes: 10})
+
+	// Nothing is uploaded until it starts, so these all wait in the queue
+	for _, output := range []string{"line 1\n", "--- hdr\n", "x\n", "too long for the last chunk\n"} {
+		if err := ls.Process([]byte(output)); err != nil {
+			t.Fatalf("ls.Process(%q) error = %v", output, err)
+		}
+	}
+
+	if err := ls.Start(context.Background()); err != nil {
+		t.Fatalf("ls.Start() error = %v", err)
+	}
+	if err := ls.Stop(); err != nil {
+		t.Fatalf("ls.Stop() error = %v", err)
+	}
+
+	want := []upload{
+		{Data: "--- hdr\nx\n", Order: 2, Offset: 7},
+		{Data: "line 1\n", Order: 1, Offset: 0},
+		{Data: "too long f", Order: 3, Offset: 17},
+		{Data: "or the las", Order: 4, Offset: 27},
+		{Data: "t chunk\n", Order: 5, Offset: 37},
+	}
+	if diff := cmp.Diff(want, uploads); diff != "" {
+		t.Errorf("uploads diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHasHeader(t *testing.T) {
+	t.Parallel()
+
+	for data, want := range map[string]bool{
+		"building\n--- :go: Build\nok\n": true,
+		"\x1b[32m+++ Tests\x1b[0m\r\n":   true,
+		"~~~ Setup":                      true,
+		"diff\n--- a/file\n":             true,
+		"no headers ---\nhere\n":         false,
+		"":                               false,
+	} {
+		if got := hasHeader([]byte(data)); got != want {
+			t.Errorf("hasHeader(%q) = %t, want %t", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a recurring period of time during which an agent
+// keeps pinging Buildkite, but asks not to be given new jobs. It's written as a cron expression for when the
+// window starts, in the host's local time, followed by how long it lasts,
+// e.g. "0 2 * * SAT 4h" for 2am to 6am every Saturday.
+type MaintenanceWindow struct {
+	Expression string
+	Duration   time.Duration
+
+	minute, hour, dom, month, dow cronField
+}
+
+// cronField is the set of values a cron expression field matches
+type cronField struct {
+	values map[int]bool
+
+	// Whether the field starts with "*", such as "*" or "*/2", which matters
+	// for the day fields. Like cron, these count as unrestricted.
+	any bool
+}
+
+func (f cronField) matches(v int) bool {
+	return f.values[v]
+}
+
+var (
+	monthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	dayNames   = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+// ParseMaintenanceWindows parses maintenance windows separated by
+// semicolons, e.g. "0 2 * * SAT 4h; 30 1 1 * * 1h"
+func ParseMaintenanceWindows(s string) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		w, err := ParseMaintenanceWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// ParseMaintenanceWindow parses a maintenance window, which is the five
+// fields of a cron expression (minute, hour, day of month, month and day of
+// week) followed by a duration.
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 6 {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %q should be a cron expression and a duration, e.g. \"0 2 * * SAT 4h\"", strings.TrimSpace(s))
+	}
+
+	w := MaintenanceWindow{Expression: strings.Join(fields[:5], " ")}
+
+	duration, err := time.ParseDuration(fields[5])
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %q: %w", w.Expression, err)
+	}
+	if duration <= 0 {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %q: duration must be positive", w.Expression)
+	}
+	w.Duration = duration
+
+	specs := []struct {
+		field    *cronField
+		name     string
+		min, max int
+		names    []string
+	}{
+		{&w.minute, "minute", 0, 59, nil},
+		{&w.hour, "hour", 0, 23, nil},
+		{&w.dom, "day of month", 1, 31, nil},
+		{&w.month, "month", 1, 12, monthNames},
+		{&w.dow, "day of week", 0, 7, dayNames},
+	}
+	for i, spec := range specs {
+		f, err := parseCronField(fields[i], spec.min, spec.max, spec.names)
+		if err != nil {
+			return MaintenanceWindow{}, fmt.Errorf("maintenance window %q: %s: %w", w.Expression, spec.name, err)
+		}
+		*spec.field = f
+	}
+
+	// Both 0 and 7 are Sunday
+	if w.dow.values[7] {
+		w.dow.values[0] = true
+	}
+
+	return w, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges (a-b)
+// and steps (*/n or a-b/n). Names are matched case-insensitively, and the
+// first name is min.
+func parseCronField(s string, min, max int, names []string) (cronField, error) {
+	f := cronField{values: map[int]bool{}, any: strings.HasPrefix(s, "*")}
+
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", s)
+		}
+		if v < min || v > max {
+			return 0, fmt.Errorf("%d is out of range %d-%d", v, min, max)
+		}
+		return v, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if r, st, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(st)
+			if err != nil || n <= 0 {
+				return cronField{}, fmt.Errorf("%q is not a valid step", st)
+			}
+			rng, step = r, n
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = min, max
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(a); err != nil {
+				return cronField{}, err
+			}
+			if hi, err = value(b); err != nil {
+				return cronField{}, err
+			}
+			if lo > hi {
+				return cronField{}, fmt.Errorf("range %q is backwards", rng)
+			}
+		default:
+			v, err := value(rng)
+			if err != nil {
+				return cronField{}, err
+			}
+			lo, hi = v, v
+		}
+
+		for v := lo; v <= hi; v += step {
+			f.values[v] = true
+		}
+	}
+
+	return f, nil
+}
+
+// starts reports whether the window starts at t, to the minute
+func (w MaintenanceWindow) starts(t time.Time) bool {
+	if !w.minute.matches(t.Minute()) || !w.hour.matches(t.Hour()) || !w.month.matches(int(t.Month())) {
+		return false
+	}
+
+	// Like cron, when both day fields are restricted, a day matching
+	// either of them will do
+	dom, dow := w.dom.matches(t.Day()), w.dow.matches(int(t.Weekday()))
+	switch {
+	case w.dom.any && w.dow.any:
+		return true
+	case w.dom.any:
+		return dow
+	case w.dow.any:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Active reports whether t is within the window, and if so, when the window
+// ends.
+func (w MaintenanceWindow) Active(t time.Time) (bool, time.Time) {
+	// Look back through every minute the window could have started at
+	start := t.Truncate(time.Minute)
+	for s := start; t.Sub(s) < w.Duration; s = s.Add(-time.Minute) {
+		if w.starts(s) {
+			return true, s.Add(w.Duration)
+		}
+	}
+	return false, time.Time{}
+}
+
+func (w MaintenanceWindow) String() string {
+	return fmt.Sprintf("%s %s", w.Expression, w.Duration)
+}
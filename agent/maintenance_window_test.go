@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceWindowsErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"0 2 * * SAT",
+		"0 2 * * SAT nope",
+		"0 2 * * SAT -1h",
+		"60 2 * * * 1h",
+		"0 2 * * FUNDAY 1h",
+		"0 5-2 * * * 1h",
+		"*/0 * * * * 1h",
+	} {
+		_, err := ParseMaintenanceWindows(s)
+		assert.Error(t, err, "ParseMaintenanceWindows(%q)", s)
+	}
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	t.Parallel()
+
+	windows, err := ParseMaintenanceWindows("0 2 * * sat 4h; 30 1 1,15 * * 30m")
+	assert.NoError(t, err)
+	assert.Len(t, windows, 2)
+
+	saturday, monthly := windows[0], windows[1]
+
+	// 2023-09-02 was a Saturday
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, test := range []struct {
+		window MaintenanceWindow
+		now    string
+		active bool
+		end    string
+	}{
+		{saturday, "2023-09-02 01:59", false, ""},
+		{saturday, "2023-09-02 02:00", true, "2023-09-02 06:00"},
+		{saturday, "2023-09-02 05:59", true, "2023-09-02 06:00"},
+		{saturday, "2023-09-02 06:00", false, ""},
+		{saturday, "2023-09-03 03:00", false, ""},
+		{monthly, "2023-09-15 01:45", true, "2023-09-15 02:00"},
+		{monthly, "2023-09-16 01:45", false, ""},
+	} {
+		active, end := test.window.Active(at(test.now))
+		assert.Equal(t, test.active, active, "%s at %s", test.window, test.now)
+		if test.active {
+			assert.Equal(t, at(test.end), end, "%s at %s", test.window, test.now)
+		}
+	}
+}
+
+func TestMaintenanceWindowDayFields(t *testing.T) {
+	t.Parallel()
+
+	// When both day fields are restricted, either matches, like cron. 7 is
+	// also Sunday.
+	w, err := ParseMaintenanceWindow("0 0 1 * 7 1h")
+	assert.NoError(t, err)
+
+	assert.True(t, w.starts(time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)), "1st of the month")
+	assert.True(t, w.starts(time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)), "a Sunday")
+	assert.False(t, w.starts(time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)), "a Monday")
+}
+
+func TestMaintenanceWindowDayFieldSteps(t *testing.T) {
+	t.Parallel()
+
+	// A day field starting with * is unrestricted even with a step, like
+	// cron, so only the other day field has to match
+	w, err := ParseMaintenanceWindow("0 0 */2 * MON 1h")
+	assert.NoError(t, err)
+
+	assert.True(t, w.starts(time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)), "a Monday on an even day")
+	assert.True(t, w.starts(time.Date(2023, 9, 11, 0, 0, 0, 0, time.UTC)), "a Monday on an odd day")
+	assert.False(t, w.starts(time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)), "a Sunday on an odd day")
+	assert.False(t, w.starts(time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)), "a Tuesday on an odd day")
+
+	w, err = ParseMaintenanceWindow("0 0 1 * */2 1h")
+	assert.NoError(t, err)
+
+	assert.True(t, w.starts(time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)), "the 1st of the month, a Friday")
+	assert.False(t, w.starts(time.Date(2023, 9, 2, 0, 0, 0, 0, time.UTC)), "a Saturday, not the 1st")
+}
+
+func TestAgentWorkerCheckMaintenance(t *testing.T) {
+	t.Parallel()
+
+	windows, err := ParseMaintenanceWindows("0 2 * * * 1h")
+	assert.NoError(t, err)
+
+	l := logger.NewBuffer()
+	worker := &AgentWorker{
+		logger:             l,
+		agentConfiguration: AgentConfiguration{MaintenanceWindows: windows},
+	}
+	setStat := func(string) {}
+
+	day := time.Date(2023, 9, 2, 0, 0, 0, 0, time.Local)
+	assert.False(t, worker.checkMaintenance(day.Add(time.Hour), setStat))
+	assert.True(t, worker.checkMaintenance(day.Add(2*time.Hour), setStat))
+	assert.True(t, worker.checkMaintenance(day.Add(150*time.Minute), setStat))
+	assert.False(t, worker.checkMaintenance(day.Add(3*time.Hour), setStat))
+
+	assert.Len(t, l.Messages, 2)
+}
+
+func TestAgentWorkerDoesntTakeJobsDuringMaintenance(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(rw, `{"job": {"id": "llamas"}}`)
+	}))
+	defer server.Close()
+
+	// A window that's always open
+	windows, err := ParseMaintenanceWindows("* * * * * 1h")
+	require.NoError(t, err)
+
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{UUID: "agent-1", PingInterval: 1},
+		apiClient:          api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"}),
+		agentConfiguration: AgentConfiguration{MaintenanceWindows: windows},
+		stop:               make(chan struct{}),
+	}
+
+	done := make(chan error)
+	go func() { done <- worker.runPingLoop(context.Background(), NewIdleMonitor(1)) }()
+
+	// Let the loop go round a couple of times
+	time.Sleep(1500 * time.Millisecond)
+	close(worker.stop)
+	require.NoError(t, <-done)
+
+	// It neither pinged for the job nor accepted it
+	assert.Zero(t, atomic.LoadInt32(&requests))
+	assert.True(t, worker.inMaintenance)
+}
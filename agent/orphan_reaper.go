@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/cgroup"
+	"github.com/buildkite/agent/v3/process"
+)
+
+// How often reapOrphans checks whether the processes it asked to exit have
+var orphanPollInterval = 100 * time.Millisecond
+
+// orphanGroup is what a job's processes run in, which they can't leave by
+// daemonizing or starting their own process group or session
+type orphanGroup interface {
+	// pids returns the processes still running in the group
+	pids() ([]int, error)
+
+	// terminate asks the processes in the group to exit
+	terminate() error
+
+	// kill kills the processes in the group
+	kill() error
+}
+
+// cgroupOrphans are the processes left in a job's cgroup on Linux
+type cgroupOrphans struct {
+	group *cgroup.Group
+}
+
+func (o cgroupOrphans) pids() ([]int, error) { return o.group.PIDs() }
+func (o cgroupOrphans) terminate() error     { return o.group.Signal(syscall.SIGTERM) }
+func (o cgroupOrphans) kill() error          { return o.group.Kill() }
+
+// jobObjectOrphans are the processes left in a job's job object on Windows,
+// which can't be asked to exit, only killed
+type jobObjectOrphans struct {
+	proc interface {
+		Orphans() ([]int, error)
+		KillOrphans() error
+	}
+}
+
+func (o jobObjectOrphans) pids() ([]int, error) { return o.proc.Orphans() }
+func (o jobObjectOrphans) terminate() error     { return nil }
+func (o jobObjectOrphans) kill() error          { return o.proc.KillOrphans() }
+
+// reapOrphanedProcesses kills the processes the job left running after it
+// finished, such as test servers started in the background, and lists them
+// in the job log. They're the processes left in the job's cgroup on Linux,
+// which are sent SIGTERM, then killed if they're still running after the
+// cancel grace period, and those left in its job object on Windows, which
+// are killed straight away.
+func (r *JobRunner) reapOrphanedProcesses(group *cgroup.Group) {
+	var orphans orphanGroup
+	gracePeriod := r.cancel.gracePeriod
+	if group != nil {
+		orphans = cgroupOrphans{group: group}
+	} else if proc, ok := r.process.(interface {
+		Orphans() ([]int, error)
+		KillOrphans() error
+	}); ok {
+		orphans = jobObjectOrphans{proc: proc}
+		gracePeriod = 0
+	} else {
+		r.logger.Debug("[JobRunner] Not reaping orphaned processes, as job %s has no cgroup or job object", r.job.ID)
+		return
+	}
+
+	reaped, err := reapOrphans(orphans, gracePeriod)
+	if errors.Is(err, process.ErrFindNotSupported) {
+		r.logger.Debug("[JobRunner] Not reaping orphaned processes: %v", err)
+		return
+	}
+	if err != nil {
+		r.logger.Warn("Failed to reap processes left running by job %s: %v", r.job.ID, err)
+	}
+	if len(reaped) == 0 {
+		return
+	}
+
+	r.logger.Warn("Killed %d processes left running by job %s", len(reaped), r.job.ID)
+	r.metrics.Count("jobs.orphaned_processes", int64(len(reaped)))
+	r.logStreamer.Process([]byte(orphansReport(reaped)))
+}
+
+// reapOrphans asks the processes left in the group to exit, and kills them if
+// they haven't after the grace period. It returns the processes that were
+// left.
+func reapOrphans(g orphanGroup, gracePeriod time.Duration) ([]process.Info, error) {
+	pids, err := g.pids()
+	if err != nil || len(pids) == 0 {
+		return nil, err
+	}
+
+	// Find out what they are while they're still running
+	reaped := make([]process.Info, 0, len(pids))
+	for _, pid := range pids {
+		info, err := process.Lookup(pid)
+		if err != nil {
+			info = process.Info{PID: pid}
+		}
+		reaped = append(reaped, info)
+	}
+
+	if gracePeriod > 0 && g.terminate() == nil {
+		for deadline := time.Now().Add(gracePeriod); time.Now().Before(deadline); time.Sleep(orphanPollInterval) {
+			if left, err := g.pids(); err == nil && len(left) == 0 {
+				return reaped, nil
+			}
+		}
+	}
+
+	if err := g.kill(); err != nil {
+		return reaped, fmt.Errorf("couldn't kill every process: %w", err)
+	}
+	return reaped, nil
+}
+
+// orphansReport is the job log section listing the processes that were reaped
+func orphansReport(reaped []process.Info) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "~~~ :broom: Killed %d processes the job left running\n", len(reaped))
+	for _, p := range reaped {
+		// Only the executable, as the arguments can contain secrets
+		if p.Executable == "" {
+			fmt.Fprintf(&sb, "pid %d\n", p.PID)
+			continue
+		}
+		fmt.Fprintf(&sb, "pid %d: %s\n", p.PID, p.Executable)
+	}
+	return sb.String()
+}
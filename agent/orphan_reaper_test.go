@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOrphans is an orphanGroup whose processes exit when they're asked to,
+// unless they're stubborn
+type fakeOrphans struct {
+	running    []int
+	stubborn   bool
+	terminated bool
+	killErr    error
+	killed     bool
+}
+
+func (f *fakeOrphans) pids() ([]int, error) { return f.running, nil }
+
+func (f *fakeOrphans) terminate() error {
+	f.terminated = true
+	if !f.stubborn {
+		f.running = nil
+	}
+	return nil
+}
+
+func (f *fakeOrphans) kill() error {
+	f.killed = true
+	if f.killErr != nil {
+		return f.killErr
+	}
+	f.running = nil
+	return nil
+}
+
+func TestReapOrphans(t *testing.T) {
+	orphanPollInterval = time.Millisecond
+
+	t.Run("nothing left running", func(t *testing.T) {
+		g := &fakeOrphans{}
+		reaped, err := reapOrphans(g, time.Second)
+		assert.NoError(t, err)
+		assert.Empty(t, reaped)
+		assert.False(t, g.terminated)
+		assert.False(t, g.killed)
+	})
+
+	t.Run("exits when asked", func(t *testing.T) {
+		g := &fakeOrphans{running: []int{100}}
+		reaped, err := reapOrphans(g, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{100}, reapedPIDs(reaped))
+		assert.True(t, g.terminated)
+		assert.False(t, g.killed)
+	})
+
+	t.Run("killed after the grace period", func(t *testing.T) {
+		g := &fakeOrphans{running: []int{100, 101}, stubborn: true}
+		reaped, err := reapOrphans(g, 10*time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{100, 101}, reapedPIDs(reaped))
+		assert.True(t, g.terminated)
+		assert.True(t, g.killed)
+	})
+
+	t.Run("killed straight away without a grace period", func(t *testing.T) {
+		g := &fakeOrphans{running: []int{100}, killErr: errors.New("access denied")}
+		reaped, err := reapOrphans(g, 0)
+		assert.EqualError(t, err, "couldn't kill every process: access denied")
+		assert.Equal(t, []int{100}, reapedPIDs(reaped))
+		assert.False(t, g.terminated)
+	})
+}
+
+func reapedPIDs(reaped []process.Info) []int {
+	var pids []int
+	for _, p := range reaped {
+		pids = append(pids, p.PID)
+	}
+	return pids
+}
+
+func TestOrphansReport(t *testing.T) {
+	report := orphansReport([]process.Info{
+		{PID: 100, Executable: "redis-server", Command: "redis-server *:6379"},
+		{PID: 200, Executable: "/usr/bin/mysql", Command: "/usr/bin/mysql --password=hunter2"},
+		{PID: 300},
+	})
+	assert.Equal(t, "~~~ :broom: Killed 3 processes the job left running\npid 100: redis-server\npid 200: /usr/bin/mysql\npid 300\n", report)
+}
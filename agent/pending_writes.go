@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/roko"
+)
+
+// PendingWritesDirEnv is the environment variable that points a job's
+// commands at the directory they save the writes that the API didn't take to,
+// so the job runner can retry them before it finishes the job
+const PendingWritesDirEnv = "BUILDKITE_PENDING_WRITES_DIR"
+
+// How long the job runner retries a job's pending writes for before it
+// finishes the job anyway
+const pendingWritesFlushTimeout = 30 * time.Second
+
+// PendingWrite is an annotation, meta-data, or artifact states that couldn't
+// be written to the API during a job, to try again at the end of it
+type PendingWrite struct {
+	JobID          string            `json:"job_id"`
+	Annotation     *api.Annotation   `json:"annotation,omitempty"`
+	MetaData       []*api.MetaData   `json:"meta_data,omitempty"`
+	ArtifactStates map[string]string `json:"artifact_states,omitempty"`
+}
+
+var pendingWriteSeq uint64
+
+// DeferWrite saves a write that failed with err to dir, if it could succeed
+// later, such as when there was no response or the API was unavailable. It
+// reports whether it did.
+func DeferWrite(dir string, err error, w PendingWrite) (bool, error) {
+	if dir == "" || !writeRetryable(err) {
+		return false, nil
+	}
+
+	b, err := json.Marshal(w)
+	if err != nil {
+		return false, err
+	}
+
+	// Named so they sort in the order they were written, and written to a
+	// temporary file first, so a flush never sees half a write
+	name := fmt.Sprintf("%020d-%d-%d.json", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&pendingWriteSeq, 1))
+	tmp := filepath.Join(dir, "."+name)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return false, fmt.Errorf("saving pending write: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return false, fmt.Errorf("saving pending write: %w", err)
+	}
+	return true, nil
+}
+
+// FlushPendingWrites retries the writes saved in dir, in the order they were
+// made, until they succeed, the API rejects them, or ctx is done. It returns
+// how many were written, and how many weren't.
+func FlushPendingWrites(ctx context.Context, l logger.Logger, client APIClient, dir string) (written, failed int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			l.Error("Couldn't read pending write %s: %v", name, err)
+			failed++
+			continue
+		}
+		var w PendingWrite
+		if err := json.Unmarshal(b, &w); err != nil {
+			l.Error("Couldn't parse pending write %s: %v", name, err)
+			failed++
+			continue
+		}
+
+		if err := flushPendingWrite(ctx, l, client, w); err != nil {
+			l.Error("Gave up on a pending write for job %s: %v", w.JobID, err)
+			failed++
+			continue
+		}
+		os.Remove(path)
+		written++
+	}
+	return written, failed
+}
+
+func flushPendingWrite(ctx context.Context, l logger.Logger, client APIClient, w PendingWrite) error {
+	return roko.NewRetrier(
+		roko.TryForever(),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+		roko.WithJitter(),
+	).DoWithContext(ctx, retrylog.Wrap("Flushing pending write", func(r *roko.Retrier) error {
+		err := writePending(ctx, client, w)
+		if err != nil && !writeRetryable(err) {
+			r.Break()
+		} else if err != nil {
+			l.Warn("Retrying a pending write for job %s: %v (%s)", w.JobID, err, r)
+		}
+		return err
+	}))
+}
+
+func writePending(ctx context.Context, client APIClient, w PendingWrite) error {
+	if w.Annotation != nil {
+		if _, err := client.Annotate(ctx, w.JobID, w.Annotation); err != nil {
+			return fmt.Errorf("annotating build: %w", err)
+		}
+	}
+	for _, metaData := range w.MetaData {
+		if _, err := client.SetMetaData(ctx, w.JobID, metaData); err != nil {
+			return fmt.Errorf("setting meta-data %q: %w", metaData.Key, err)
+		}
+	}
+	if len(w.ArtifactStates) > 0 {
+		if _, err := client.UpdateArtifacts(ctx, w.JobID, w.ArtifactStates); err != nil {
+			return fmt.Errorf("updating artifact states: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeRetryable reports whether a write that failed with err could succeed
+// if it's tried again, which it can unless the API rejected it
+func writeRetryable(err error) bool {
+	var errResp *api.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil {
+		return true
+	}
+	code := errResp.Response.StatusCode
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferWrite(t *testing.T) {
+	t.Parallel()
+
+	w := PendingWrite{JobID: "llamas", Annotation: &api.Annotation{Body: "hello"}}
+	rejected := &api.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity}}
+	unavailable := &api.ErrorResponse{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}
+
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no response", errors.New("connection refused"), true},
+		{"unavailable", unavailable, true},
+		{"rate limited", &api.ErrorResponse{Response: &http.Response{StatusCode: http.StatusTooManyRequests}}, true},
+		{"rejected", rejected, false},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			deferred, err := DeferWrite(dir, test.err, w)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, deferred)
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			if test.want {
+				assert.Len(t, entries, 1)
+			} else {
+				assert.Empty(t, entries)
+			}
+		})
+	}
+
+	// Without a directory, nothing is saved
+	deferred, err := DeferWrite("", errors.New("connection refused"), w)
+	require.NoError(t, err)
+	assert.False(t, deferred)
+}
+
+func TestFlushPendingWrites(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch req.URL.Path {
+		case "/jobs/llamas/annotations", "/jobs/llamas/data/set", "/jobs/llamas/artifacts":
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte("{}"))
+		default:
+			http.Error(rw, `{"message":"Not found"}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	dir := t.TempDir()
+	unavailable := errors.New("connection refused")
+	for _, w := range []PendingWrite{
+		{JobID: "llamas", Annotation: &api.Annotation{Body: "hello"}},
+		{JobID: "llamas", MetaData: []*api.MetaData{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}},
+		{JobID: "alpacas", Annotation: &api.Annotation{Body: "wrong job"}},
+		{JobID: "llamas", ArtifactStates: map[string]string{"artifact-1": "finished"}},
+	} {
+		deferred, err := DeferWrite(dir, unavailable, w)
+		require.NoError(t, err)
+		require.True(t, deferred)
+	}
+
+	written, failed := FlushPendingWrites(context.Background(), logger.Discard, client, dir)
+	assert.Equal(t, 3, written)
+	assert.Equal(t, 1, failed)
+
+	// They're sent in the order they were saved, and the job that doesn't
+	// exist isn't retried
+	assert.Equal(t, []string{
+		"POST /jobs/llamas/annotations",
+		"POST /jobs/llamas/data/set",
+		"POST /jobs/llamas/data/set",
+		"POST /jobs/alpacas/annotations",
+		"PUT /jobs/llamas/artifacts",
+	}, requests)
+
+	// Only the write that was rejected is left
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
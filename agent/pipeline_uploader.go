@@ -12,6 +12,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 )
 
@@ -117,7 +118,7 @@ func (u *PipelineUploader) pipelineUploadAsyncWithRetry(
 		roko.WithMaxAttempts(defaultAttempts),
 		roko.WithStrategy(roko.Constant(defaultSleepDuration)),
 		roko.WithSleepFunc(u.RetrySleepFunc),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Uploading pipeline", func(r *roko.Retrier) error {
 		resp, err := u.Client.UploadPipeline(
 			ctx,
 			u.JobID,
@@ -167,7 +168,7 @@ func (u *PipelineUploader) pipelineUploadAsyncWithRetry(
 		}
 
 		return nil
-	}); err != nil {
+	})); err != nil {
 		return nil, err
 	}
 
@@ -179,7 +180,7 @@ func (u *PipelineUploader) pollForPiplineUploadStatus(ctx context.Context, l log
 		roko.WithMaxAttempts(defaultAttempts),
 		roko.WithStrategy(roko.Constant(defaultSleepDuration)),
 		roko.WithSleepFunc(u.RetrySleepFunc),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Checking pipeline upload status", func(r *roko.Retrier) error {
 		uploadStatus, resp, err := u.Client.PipelineUploadStatus(
 			ctx,
 			u.JobID,
@@ -220,7 +221,7 @@ func (u *PipelineUploader) pollForPiplineUploadStatus(ctx context.Context, l log
 			r.Break()
 			return fmt.Errorf("Unexpected pipeline upload state from API: %s", uploadStatus.State)
 		}
-	})
+	}))
 }
 
 type errLocationParse struct {
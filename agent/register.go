@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/agent/v3/system"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/roko"
@@ -40,12 +42,11 @@ func Register(ctx context.Context, l logger.Logger, ac APIClient, req api.AgentR
 	req.OS = osVersionDump
 
 	var registered *api.AgentRegisterResponse
-	var resp *api.Response
 
 	register := func(r *roko.Retrier) error {
-		reg, rsp, err := ac.Register(ctx, &req)
+		reg, resp, err := ac.Register(ctx, &req)
 		if err != nil {
-			if resp != nil && resp.StatusCode == 401 {
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
 				l.Warn("Buildkite rejected the registration (%s)", err)
 				r.Break()
 			} else {
@@ -53,7 +54,7 @@ func Register(ctx context.Context, l logger.Logger, ac APIClient, req api.AgentR
 			}
 			return err
 		}
-		registered, resp = reg, rsp
+		registered = reg
 		return nil
 	}
 
@@ -61,7 +62,7 @@ func Register(ctx context.Context, l logger.Logger, ac APIClient, req api.AgentR
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(30),
 		roko.WithStrategy(roko.Constant(10*time.Second)),
-	).DoWithContext(ctx, register)
+	).DoWithContext(ctx, retrylog.Wrap("Registering agent", register))
 	if err != nil {
 		return registered, err
 	}
@@ -80,6 +81,20 @@ func Register(ctx context.Context, l logger.Logger, ac APIClient, req api.AgentR
 	return registered, nil
 }
 
+// RegisterWithSecondary registers like Register, but if Buildkite rejects the
+// token of the primary client, such as when it has been revoked or has
+// expired, it registers with the token of the secondary client instead. The
+// secondary client can be nil.
+func RegisterWithSecondary(ctx context.Context, l logger.Logger, primary, secondary APIClient, req api.AgentRegisterRequest) (*api.AgentRegisterResponse, error) {
+	registered, err := Register(ctx, l, primary, req)
+	if err == nil || secondary == nil || !api.IsErrHavingStatus(err, http.StatusUnauthorized) {
+		return registered, err
+	}
+
+	l.Warn("Buildkite rejected the agent token, so registering with the secondary agent token instead")
+	return Register(ctx, l, secondary, req)
+}
+
 func cacheRegisterSystemInfo(l logger.Logger) {
 	var err error
 
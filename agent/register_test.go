@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterWithSecondary(t *testing.T) {
+	registrations := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get("Authorization")
+		registrations[token]++
+		if token != "Token secondary" {
+			http.Error(rw, `{"message": "Invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(rw, `{"name": "agent-1", "access_token": "access"}`)
+	}))
+	defer server.Close()
+
+	client := func(token string) APIClient {
+		return api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: token})
+	}
+
+	registered, err := RegisterWithSecondary(context.Background(), logger.Discard, client("primary"), client("secondary"), api.AgentRegisterRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "access", registered.AccessToken)
+
+	// A rejected token isn't retried
+	assert.Equal(t, map[string]int{"Token primary": 1, "Token secondary": 1}, registrations)
+
+	_, err = RegisterWithSecondary(context.Background(), logger.Discard, client("primary"), nil, api.AgentRegisterRequest{})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusUnauthorized), "RegisterWithSecondary() error = %v, want a 401", err)
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The actions Buildkite can send in a ping to control an agent remotely,
+// besides disconnect.
+//
+// There's no pause or resume. An agent that pings is assigned jobs, and one
+// that doesn't can't be told to resume, so pausing needs Buildkite to stop
+// assigning jobs to the agent itself. Until it can, pause and resume are
+// recorded as not applied, and drain stops an agent taking jobs.
+const (
+	remoteActionPause       = "pause"
+	remoteActionResume      = "resume"
+	remoteActionDrain       = "drain"
+	remoteActionUpdateTags  = "update-tags"
+	remoteActionSetLogLevel = "set-log-level"
+)
+
+// RemoteControlAuditEntry records a remote control action an agent was sent,
+// and whether it was applied
+type RemoteControlAuditEntry struct {
+	Time        time.Time `json:"time"`
+	Agent       string    `json:"agent"`
+	Action      string    `json:"action"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	LogLevel    string    `json:"log_level,omitempty"`
+	Applied     bool      `json:"applied"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// RemoteControlAuditLog appends the remote control actions agents are sent to
+// a file, one JSON object per line, so there's a record on the host of who
+// changed what. It's safe to share between workers.
+type RemoteControlAuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenRemoteControlAuditLog opens the audit log at path, creating it if it
+// doesn't exist
+func OpenRemoteControlAuditLog(path string) (*RemoteControlAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening remote control audit log: %w", err)
+	}
+	return &RemoteControlAuditLog{f: f}, nil
+}
+
+// Write appends an entry to the audit log
+func (l *RemoteControlAuditLog) Write(entry RemoteControlAuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the audit log
+func (l *RemoteControlAuditLog) Close() error {
+	return l.f.Close()
+}
+
+// handleRemoteControl applies the remote control action from a ping, if it
+// has one
+func (a *AgentWorker) handleRemoteControl(ping *api.Ping) {
+	entry := RemoteControlAuditEntry{
+		Time:        time.Now(),
+		Agent:       a.registration().Name,
+		Action:      ping.Action,
+		RequestedBy: ping.RequestedBy,
+	}
+	by := ""
+	if ping.RequestedBy != "" {
+		by = fmt.Sprintf(" (requested by %s)", ping.RequestedBy)
+	}
+
+	var err error
+	switch ping.Action {
+	case remoteActionPause, remoteActionResume:
+		err = errors.New("pausing isn't supported, as Buildkite still assigns jobs to agents that ping. Drain the agent instead")
+
+	case remoteActionDrain:
+		a.logger.Info("Draining%s", by)
+		a.Stop(true)
+
+	case remoteActionUpdateTags:
+		entry.Tags = ping.Tags
+		err = a.updateTags(ping.Tags)
+		if err == nil {
+			a.logger.Info("Updated tags to %s%s", strings.Join(ping.Tags, ", "), by)
+		}
+
+	case remoteActionSetLogLevel:
+		entry.LogLevel = ping.LogLevel
+		var level logger.Level
+		level, err = logger.LevelFromString(ping.LogLevel)
+		if err == nil {
+			// Only this worker's logger, and those of the jobs it runs
+			// from then on, log at the new level
+			a.logger.Info("Setting the log level to %s%s", strings.ToLower(ping.LogLevel), by)
+			a.logger.SetLevel(level)
+		}
+
+	default:
+		return
+	}
+
+	entry.Applied = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+		a.logger.Error("Couldn't %s%s: %v", ping.Action, by, err)
+	}
+
+	if a.remoteControlAuditLog != nil {
+		if err := a.remoteControlAuditLog.Write(entry); err != nil {
+			a.logger.Warn("Couldn't write to the remote control audit log: %v", err)
+		}
+	}
+}
+
+// updateTags replaces the agent's tags, and the job environment variables
+// rendered from them
+func (a *AgentWorker) updateTags(tags []string) error {
+	if len(tags) == 0 {
+		return errors.New("no tags were given")
+	}
+
+	tagsEnv, err := TagsEnv(tags, a.tagsEnvMappings)
+	if err != nil {
+		return err
+	}
+
+	a.updateRegistration(func(reg *api.AgentRegisterResponse) {
+		reg.Tags = tags
+	})
+	a.agentConfiguration.TagsEnv = tagsEnv
+	return nil
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPingRemoteControl(t *testing.T) {
+	pings := []string{
+		`{"action": "pause", "requested_by": "ops@example.com"}`,
+		`{"job": {"id": "llamas"}}`,
+		`{"action": "update-tags", "tags": ["queue=gpu", "region=us-east-1"]}`,
+		`{"action": "set-log-level", "log_level": "loud"}`,
+		`{"action": "set-log-level", "log_level": "debug"}`,
+		`{"action": "drain"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ping":
+			fmt.Fprint(rw, pings[0])
+			pings = pings[1:]
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := OpenRemoteControlAuditLog(auditPath)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	l := logger.NewConsoleLogger(logger.NewTextPrinter(io.Discard), func(int) {})
+	l.SetLevel(logger.INFO)
+	worker := &AgentWorker{
+		logger:                l,
+		agent:                 &api.AgentRegisterResponse{Name: "agent-1", Tags: []string{"queue=default"}},
+		apiClient:             client,
+		agentConfiguration:    AgentConfiguration{},
+		stop:                  make(chan struct{}),
+		tagsEnvMappings:       []string{"AWS_REGION={{.region}}"},
+		remoteControlAuditLog: auditLog,
+	}
+
+	// Pausing isn't supported, so the agent still takes jobs
+	job, err := worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	job, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", job.ID)
+
+	_, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"queue=gpu", "region=us-east-1"}, worker.agent.Tags)
+	assert.Equal(t, map[string]string{"AWS_REGION": "us-east-1"}, worker.agentConfiguration.TagsEnv)
+
+	// An unknown log level leaves it as it is
+	_, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, logger.INFO, l.Level())
+	_, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, logger.DEBUG, l.Level())
+
+	assert.False(t, worker.stopping)
+	_, err = worker.Ping(ctx)
+	require.NoError(t, err)
+	assert.True(t, worker.stopping)
+
+	f, err := os.Open(auditPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []RemoteControlAuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry RemoteControlAuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, entries, 5)
+	for i, want := range []struct {
+		action  string
+		applied bool
+	}{
+		{"pause", false},
+		{"update-tags", true},
+		{"set-log-level", false},
+		{"set-log-level", true},
+		{"drain", true},
+	} {
+		assert.Equal(t, want.action, entries[i].Action, "entries[%d].Action", i)
+		assert.Equal(t, want.applied, entries[i].Applied, "entries[%d].Applied", i)
+		assert.Equal(t, "agent-1", entries[i].Agent, "entries[%d].Agent", i)
+	}
+	assert.Equal(t, "ops@example.com", entries[0].RequestedBy)
+	assert.NotEmpty(t, entries[0].Error)
+	assert.Equal(t, []string{"queue=gpu", "region=us-east-1"}, entries[1].Tags)
+	assert.NotEmpty(t, entries[2].Error)
+}
+
+func TestPingRemoteControlSwitchesEndpoint(t *testing.T) {
+	newServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer newServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, `{"action": "update-tags", "tags": ["queue=gpu"], "endpoint": %q}`, newServer.URL)
+	}))
+	defer server.Close()
+
+	worker := &AgentWorker{
+		logger:    logger.Discard,
+		agent:     &api.AgentRegisterResponse{Name: "agent-1", Endpoint: server.URL},
+		apiClient: api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"}),
+		stop:      make(chan struct{}),
+	}
+
+	_, err := worker.Ping(context.Background())
+	require.NoError(t, err)
+
+	// The action is applied, and so is the endpoint that came with it
+	assert.Equal(t, []string{"queue=gpu"}, worker.agent.Tags)
+	assert.Equal(t, newServer.URL, worker.agent.Endpoint)
+}
@@ -1,8 +1,10 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 
@@ -14,7 +16,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/buildkite/agent/v3/chaos"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
 )
 
 const (
@@ -59,7 +64,7 @@ func (e *buildkiteEnvProvider) IsExpired() bool {
 	return !e.retrieved
 }
 
-func awsS3Session(region string, l logger.Logger) (*session.Session, error) {
+func awsS3Session(region, bucket string, conf *S3BucketConfig, l logger.Logger, stage *clientStage) (*session.Session, error) {
 	// Chicken and egg... but this is kinda how they do it in the sdk
 	sess, err := session.NewSession()
 	if err != nil {
@@ -67,22 +72,50 @@ func awsS3Session(region string, l logger.Logger) (*session.Session, error) {
 	}
 
 	sess.Config.Region = aws.String(region)
+	sess.Config.HTTPClient = storagetags.Client(chaos.Client(chaos.Artifacts, sess.Config.HTTPClient))
 
 	sess.Config.Credentials = credentials.NewChainCredentials(
 		[]credentials.Provider{
-			&buildkiteEnvProvider{},
-			&credentials.EnvProvider{},
-			webIdentityRoleProvider(sess),
+			stagedProvider{&buildkiteEnvProvider{}, "BUILDKITE_S3_ACCESS_KEY_ID and BUILDKITE_S3_SECRET_ACCESS_KEY", stage},
+			stagedProvider{&credentials.EnvProvider{}, "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", stage},
+			stagedProvider{webIdentityRoleProvider(sess), "the web identity token in AWS_WEB_IDENTITY_TOKEN_FILE", stage},
 			// EC2 and ECS meta-data providers
-			defaults.RemoteCredProvider(*sess.Config, sess.Handlers),
+			stagedProvider{defaults.RemoteCredProvider(*sess.Config, sess.Handlers), "the EC2 or ECS instance metadata service", stage},
 		},
 	)
 
+	// A credential helper takes the place of all the other providers
+	if hasCredentialHelper() {
+		l.Debug("S3 session credentials from %s", credentialHelperEnvVar)
+		sess.Config.Credentials = credentials.NewCredentials(stagedProvider{&credentialHelperProvider{bucket: bucket}, "the " + credentialHelperEnvVar + " credential helper", stage})
+	}
+
+	// Assume a role with whichever credentials were found, such as to read a
+	// bucket in another account. STS is asked before the endpoint is
+	// overridden, as that's only for S3.
+	if conf != nil && conf.RoleARN != "" {
+		l.Debug("S3 session assuming role %q for bucket %q", conf.RoleARN, bucket)
+		provider := &stscreds.AssumeRoleProvider{
+			Client:          sts.New(sess.Copy()),
+			RoleARN:         conf.RoleARN,
+			RoleSessionName: "buildkite-agent",
+			Duration:        stscreds.DefaultDuration,
+		}
+		if conf.ExternalID != "" {
+			provider.ExternalID = aws.String(conf.ExternalID)
+		}
+		sess.Config.Credentials = credentials.NewCredentials(stagedProvider{provider, "assuming role " + conf.RoleARN, stage})
+	}
+
 	// An optional endpoint URL (hostname only or fully qualified URI)
 	// that overrides the default generated endpoint for a client.
 	// This is useful for S3-compatible servers like MinIO.
-	if endpoint := os.Getenv(s3EndpointEnvVar); endpoint != "" {
-		l.Debug("S3 session Endpoint from %s: %q", s3EndpointEnvVar, endpoint)
+	endpoint, endpointFrom := os.Getenv(s3EndpointEnvVar), s3EndpointEnvVar
+	if conf != nil && conf.Endpoint != "" {
+		endpoint, endpointFrom = conf.Endpoint, "the config for bucket "+bucket
+	}
+	if endpoint != "" {
+		l.Debug("S3 session Endpoint from %s: %q", endpointFrom, endpoint)
 		sess.Config.Endpoint = aws.String(endpoint)
 
 		// Configure the S3 client to use path-style addressing instead of the
@@ -111,14 +144,55 @@ func webIdentityRoleProvider(sess *session.Session) *stscreds.WebIdentityRolePro
 	)
 }
 
-func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
+// NewS3Client returns a client for the bucket, after checking it can be
+// accessed. It gives up after BUILDKITE_STORAGE_CLIENT_TIMEOUT, with an error
+// that says what it was waiting on.
+func NewS3Client(ctx context.Context, l logger.Logger, bucket string) (*s3.S3, error) {
+	return NewS3ClientWithConfig(ctx, l, bucket, nil)
+}
+
+// NewS3ClientWithConfig is NewS3Client with the bucket's config, which can be
+// nil
+func NewS3ClientWithConfig(ctx context.Context, l logger.Logger, bucket string, conf *S3BucketConfig) (*s3.S3, error) {
+	stage := &clientStage{stage: "starting"}
+
+	var client *s3.S3
+	err := withClientTimeout(ctx, fmt.Sprintf("an S3 client for bucket %q", bucket), stage, func(ctx context.Context) error {
+		var err error
+		client, err = newS3Client(ctx, l, bucket, conf, stage)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// s3BucketConfig is the config for clients of a bucket. Only their requests
+// go through an artifact storage proxy, or the bucket's client, not the
+// session's requests for credentials, which can be to the EC2 instance
+// metadata service.
+func s3BucketConfig(conf *S3BucketConfig) *aws.Config {
+	client := storageproxy.Client(&http.Client{})
+	if conf != nil && conf.HTTPClient != nil {
+		client = conf.HTTPClient
+	}
+	return aws.NewConfig().WithHTTPClient(
+		storagetags.Client(chaos.Client(chaos.Artifacts, client)),
+	)
+}
+
+func newS3Client(ctx context.Context, l logger.Logger, bucket string, conf *S3BucketConfig, stage *clientStage) (*s3.S3, error) {
 	var sess *session.Session
 
-	regionHint := os.Getenv(regionHintEnvVar)
+	regionHint, regionFrom := os.Getenv(regionHintEnvVar), "environment variable "+regionHintEnvVar
+	if conf != nil && conf.Region != "" {
+		regionHint, regionFrom = conf.Region, "the config for the bucket"
+	}
 	if regionHint != "" {
-		l.Debug("Using bucket region %q from environment variable %q", regionHint, regionHintEnvVar)
+		l.Debug("Using bucket region %q from %s", regionHint, regionFrom)
 		// If there is a region hint provided, we use it unconditionally
-		session, err := awsS3Session(regionHint, l)
+		session, err := awsS3Session(regionHint, bucket, conf, l, stage)
 		if err != nil {
 			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
 		}
@@ -127,6 +201,7 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 	} else {
 		// Otherwise, use the current region (or a guess) to dynamically find
 		// where the bucket lives.
+		stage.set("discovering the current AWS region from the EC2 instance metadata service")
 		region, err := awsRegion()
 		if err != nil {
 			region = "us-east-1"
@@ -136,12 +211,13 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 
 		// Using the guess region, construct a session and ask that region where the
 		// bucket lives
-		session, err := awsS3Session(region, l)
+		session, err := awsS3Session(region, bucket, conf, l, stage)
 		if err != nil {
 			return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
 		}
 
-		bucketRegion, bucketRegionErr := s3manager.GetBucketRegion(aws.BackgroundContext(), session, bucket, region)
+		stage.set(fmt.Sprintf("finding the region of bucket %q", bucket))
+		bucketRegion, bucketRegionErr := s3manager.GetBucketRegionWithClient(ctx, s3.New(session, s3BucketConfig(conf).WithRegion(region)), bucket)
 		if bucketRegionErr == nil && bucketRegion != "" {
 			l.Debug("Discovered %q bucket region as %q", bucket, bucketRegion)
 			session.Config.Region = &bucketRegion
@@ -154,10 +230,11 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 
 	l.Debug("Testing AWS S3 credentials for bucket %q in region %q...", bucket, *sess.Config.Region)
 
-	s3client := s3.New(sess)
+	s3client := s3.New(sess, s3BucketConfig(conf))
 
 	// Test the authentication by trying to list the first 0 objects in the bucket.
-	_, err := s3client.ListObjects(&s3.ListObjectsInput{
+	stage.set(fmt.Sprintf("checking access to bucket %q", bucket))
+	_, err := s3client.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
 		Bucket:  aws.String(bucket),
 		MaxKeys: aws.Int64(0),
 	})
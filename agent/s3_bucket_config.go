@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// S3BucketConfig overrides how the client for an S3 bucket is created, for
+// buckets in another AWS account or on an S3-compatible server
+type S3BucketConfig struct {
+	// An IAM role to assume with the credentials the agent finds, and the
+	// external ID the role's trust policy requires, if any
+	RoleARN    string
+	ExternalID string
+
+	// The bucket's region, which is used instead of BUILDKITE_S3_DEFAULT_REGION
+	// or looking it up
+	Region string
+
+	// The S3 endpoint, which is used instead of BUILDKITE_S3_ENDPOINT
+	Endpoint string
+
+	// The client for requests to the bucket, such as one that goes through a
+	// proxy. If nil, one that only goes through an artifact storage proxy, if
+	// there is one, is used
+	HTTPClient *http.Client
+}
+
+// s3BucketRule is the config for the buckets whose names match a pattern
+type s3BucketRule struct {
+	pattern string
+	config  S3BucketConfig
+}
+
+// parseS3BucketRules parses rules like
+// "partner-*=role-arn:arn:aws:iam::123456789012:role/reader,external-id:xyz",
+// separated by semicolons. The settings are role-arn, external-id, region and
+// endpoint. Patterns are matched against bucket names like path.Match, and the
+// first rule that matches a bucket applies to it.
+func parseS3BucketRules(rules string) ([]s3BucketRule, error) {
+	var parsed []s3BucketRule
+	for _, rule := range strings.Split(rules, ArtifactPathDelimiter) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, settings, ok := strings.Cut(rule, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid S3 bucket config %q, expected bucket=setting:value,...", rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid S3 bucket pattern %q: %w", pattern, err)
+		}
+
+		r := s3BucketRule{pattern: pattern}
+		for _, setting := range strings.Split(settings, ",") {
+			// Cut at the first colon, as ARNs and endpoints have them too
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			value = strings.TrimSpace(value)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid S3 bucket setting %q for %s, expected setting:value", setting, pattern)
+			}
+
+			switch strings.TrimSpace(name) {
+			case "role-arn":
+				r.config.RoleARN = value
+			case "external-id":
+				r.config.ExternalID = value
+			case "region":
+				r.config.Region = value
+			case "endpoint":
+				r.config.Endpoint = value
+			default:
+				return nil, fmt.Errorf("unknown S3 bucket setting %q for %s, expected role-arn, external-id, region or endpoint", name, pattern)
+			}
+		}
+		if r.config.ExternalID != "" && r.config.RoleARN == "" {
+			return nil, fmt.Errorf("S3 bucket config for %s has an external-id but no role-arn", pattern)
+		}
+
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// s3BucketConfigFor returns the config of the first rule that matches the
+// bucket, or nil if none do
+func s3BucketConfigFor(rules []s3BucketRule, bucket string) *S3BucketConfig {
+	for _, r := range rules {
+		if ok, _ := path.Match(r.pattern, bucket); ok {
+			config := r.config
+			return &config
+		}
+	}
+	return nil
+}
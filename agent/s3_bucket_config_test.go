@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3BucketRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := parseS3BucketRules("partner-* = role-arn:arn:aws:iam::123456789012:role/reader, external-id:xyz ; builds=endpoint:https://minio.internal:9000,region:us-east-1")
+	require.NoError(t, err)
+
+	require.Equal(t, &S3BucketConfig{
+		RoleARN:    "arn:aws:iam::123456789012:role/reader",
+		ExternalID: "xyz",
+	}, s3BucketConfigFor(rules, "partner-artifacts"))
+	require.Equal(t, &S3BucketConfig{
+		Region:   "us-east-1",
+		Endpoint: "https://minio.internal:9000",
+	}, s3BucketConfigFor(rules, "builds"))
+	require.Nil(t, s3BucketConfigFor(rules, "other"))
+}
+
+func TestParseS3BucketRulesInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, rules := range []string{
+		"builds",
+		"=region:us-east-1",
+		"[=region:us-east-1",
+		"builds=region",
+		"builds=colour:blue",
+		"builds=external-id:xyz",
+	} {
+		_, err := parseS3BucketRules(rules)
+		require.Error(t, err, "parseS3BucketRules(%q)", rules)
+	}
+}
+
+func TestNewS3ClientWithBucketEndpoint(t *testing.T) {
+	server := testutil.NewS3Server("builds")
+	defer server.Close()
+	for k, v := range server.Env() {
+		t.Setenv(k, v)
+	}
+
+	// The bucket's endpoint takes the place of the environment's
+	t.Setenv(s3EndpointEnvVar, "http://127.0.0.1:1")
+	t.Setenv(regionHintEnvVar, "")
+
+	rules, err := parseS3BucketRules("builds=endpoint:" + server.URL + ",region:us-east-1")
+	require.NoError(t, err)
+
+	_, err = NewS3ClientWithConfig(context.Background(), logger.Discard, "builds", s3BucketConfigFor(rules, "builds"))
+	require.NoError(t, err)
+}
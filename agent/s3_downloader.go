@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -29,10 +30,47 @@ type S3DownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How to wait between attempts, and how long each can take
+	Retry RetryConfig
+
+	// Permissions to create missing destination directories with
+	DirPermissions os.FileMode
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The HTTP client to download with. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	// If set, only this range of the file is downloaded
+	Range *ByteRange
+
+	// The most bytes per second to download at. If zero, there is no limit
+	MaxBandwidth int64
+
+	// If set, it's called with the number of bytes downloaded as they are
+	Progress func(int64)
+
+	// The size of the file, if known, so a failed download can be resumed
+	Size int64
+
+	// If set, a failed download starts again from the beginning
+	NoResume bool
+
+	// Objects larger than this are downloaded in parts of this size, several
+	// at once, if their size is known. If zero, DefaultS3DownloadPartSize is
+	// used, and if negative, objects are downloaded in one go
+	PartSize int64
+
+	// How many parts of an object are downloaded at once. If zero,
+	// DefaultDownloadPartConcurrency is used
+	PartConcurrency int
 }
 
+// DefaultS3DownloadPartSize is the size of the parts large objects are
+// downloaded from S3 in, unless it's configured
+const DefaultS3DownloadPartSize = 64 * 1024 * 1024
+
 type S3Downloader struct {
 	// The download config
 	conf S3DownloaderConfig
@@ -63,13 +101,30 @@ func (d S3Downloader) Start(ctx context.Context) error {
 		return fmt.Errorf("error pre-signing request: %v", err)
 	}
 
+	partSize := d.conf.PartSize
+	switch {
+	case partSize == 0:
+		partSize = DefaultS3DownloadPartSize
+	case partSize < 0:
+		partSize = 0
+	}
+
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         signedURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+	return NewDownload(d.logger, d.conf.HTTPClient, DownloadConfig{
+		URL:             signedURL,
+		Path:            d.conf.Path,
+		Destination:     d.conf.Destination,
+		Retries:         d.conf.Retries,
+		Retry:           d.conf.Retry,
+		DirPermissions:  d.conf.DirPermissions,
+		DebugHTTP:       d.conf.DebugHTTP,
+		Range:           d.conf.Range,
+		MaxBandwidth:    d.conf.MaxBandwidth,
+		Progress:        d.conf.Progress,
+		Size:            d.conf.Size,
+		NoResume:        d.conf.NoResume,
+		PartSize:        partSize,
+		PartConcurrency: d.conf.PartConcurrency,
 	}).Start(ctx)
 }
 
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/destination"
 	"github.com/buildkite/agent/v3/logger"
 )
 
@@ -40,10 +42,14 @@ type S3Uploader struct {
 }
 
 func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
-	bucketName, bucketPath := ParseS3Destination(c.Destination)
+	dest, err := destination.Parse(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	bucketName, bucketPath := dest.Bucket, dest.Path
 
 	// Initialize the s3 client, and authenticate it
-	s3Client, err := NewS3Client(l, bucketName)
+	s3Client, err := NewS3Client(context.Background(), l, bucketName)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +63,10 @@ func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
 	}, nil
 }
 
+// ParseS3Destination splits an s3://bucket/path destination into its bucket
+// and path.
+//
+// Deprecated: Use destination.Parse, which also reports invalid destinations.
 func ParseS3Destination(destination string) (string, string) {
 	destinationWithNoTrailingSlash := strings.TrimSuffix(destination, "/")
 	destinationWithNoProtocol := strings.TrimPrefix(destinationWithNoTrailingSlash, "s3://")
@@ -1,9 +1,15 @@
 package agent
 
 import (
+	"bytes"
+	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,3 +94,47 @@ func TestResolvePermission(t *testing.T) {
 		os.Unsetenv("BUILDKITE_S3_ACL")
 	}
 }
+
+func TestS3UploadAndDownload(t *testing.T) {
+	server := testutil.NewS3Server("my-bucket")
+	defer server.Close()
+	for k, v := range server.Env() {
+		t.Setenv(k, v)
+	}
+
+	// Large enough to be uploaded in parts
+	large := bytes.Repeat([]byte("llamas\n"), 1024*1024)
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"small.txt": []byte("alpacas\n"), "large.txt": large} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{Destination: "s3://my-bucket/builds/1"})
+	require.NoError(t, err)
+
+	for _, name := range []string{"small.txt", "large.txt"} {
+		require.NoError(t, uploader.Upload(&api.Artifact{
+			Path:         name,
+			AbsolutePath: filepath.Join(dir, name),
+			ContentType:  "text/plain",
+		}))
+	}
+	require.Equal(t, []string{"builds/1/large.txt", "builds/1/small.txt"}, server.Keys("my-bucket"))
+
+	client, err := NewS3Client(context.Background(), logger.Discard, "my-bucket")
+	require.NoError(t, err)
+
+	downloads := t.TempDir()
+	require.NoError(t, NewS3Downloader(logger.Discard, S3DownloaderConfig{
+		S3Client:    client,
+		S3Path:      "s3://my-bucket/builds/1",
+		Destination: downloads,
+		Path:        "large.txt",
+		Retries:     1,
+	}).Start(context.Background()))
+
+	got, err := os.ReadFile(filepath.Join(downloads, "large.txt"))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(large, got), "downloaded large.txt differs from what was uploaded")
+}
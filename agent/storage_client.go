@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	storageClientTimeoutEnvVar  = "BUILDKITE_STORAGE_CLIENT_TIMEOUT"
+	defaultStorageClientTimeout = time.Minute
+)
+
+// storageClientTimeout is how long creating an S3 or Google Cloud Storage
+// client can take, which can otherwise hang for minutes when a metadata
+// service can't be reached
+func storageClientTimeout() time.Duration {
+	if v := os.Getenv(storageClientTimeoutEnvVar); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultStorageClientTimeout
+}
+
+// clientStage describes what creating a storage client is waiting on, for
+// the error if it times out
+type clientStage struct {
+	mu    sync.Mutex
+	stage string
+}
+
+func (s *clientStage) set(stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stage = stage
+}
+
+func (s *clientStage) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stage
+}
+
+// withClientTimeout runs newClient, and gives up on it if it doesn't return
+// within the storage client timeout or before ctx is done. newClient is left
+// to finish in the background, as the SDKs can't all be interrupted.
+func withClientTimeout(ctx context.Context, what string, stage *clientStage, newClient func(context.Context) error) error {
+	timeout := storageClientTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- newClient(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Timed out after %v creating %s while %s. If it needs longer, set %s", timeout, what, stage, storageClientTimeoutEnvVar)
+		}
+		return fmt.Errorf("Cancelled creating %s while %s: %w", what, stage, ctx.Err())
+	}
+}
+
+// stagedProvider records when credentials are being retrieved from the
+// provider, so a timeout can say which one was being tried
+type stagedProvider struct {
+	credentials.Provider
+	name  string
+	stage *clientStage
+}
+
+func (p stagedProvider) Retrieve() (credentials.Value, error) {
+	p.stage.set("getting AWS credentials from " + p.name)
+	return p.Provider.Retrieve()
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestWithClientTimeout(t *testing.T) {
+	t.Setenv(storageClientTimeoutEnvVar, "50ms")
+
+	stage := &clientStage{stage: "starting"}
+	provider := stagedProvider{credentials.ErrorProvider{Err: errors.New("no credentials")}, "the metadata service", stage}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	err := withClientTimeout(context.Background(), "a test client", stage, func(context.Context) error {
+		provider.Retrieve()
+		<-release
+		return nil
+	})
+	if err == nil {
+		t.Fatal("withClientTimeout() = nil, want a timeout")
+	}
+	for _, want := range []string{"Timed out after 50ms", "a test client", "getting AWS credentials from the metadata service", storageClientTimeoutEnvVar} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("withClientTimeout() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestWithClientTimeoutReturnsError(t *testing.T) {
+	want := errors.New("no bucket")
+	err := withClientTimeout(context.Background(), "a test client", &clientStage{}, func(context.Context) error {
+		return want
+	})
+	if err != want {
+		t.Errorf("withClientTimeout() = %v, want %v", err, want)
+	}
+}
+
+func TestStorageClientTimeout(t *testing.T) {
+	for _, test := range []struct {
+		env  string
+		want time.Duration
+	}{
+		{env: "", want: defaultStorageClientTimeout},
+		{env: "5s", want: 5 * time.Second},
+		{env: "soon", want: defaultStorageClientTimeout},
+		{env: "-1s", want: defaultStorageClientTimeout},
+	} {
+		t.Setenv(storageClientTimeoutEnvVar, test.env)
+		if got := storageClientTimeout(); got != test.want {
+			t.Errorf("storageClientTimeout() with %s=%q = %v, want %v", storageClientTimeoutEnvVar, test.env, got, test.want)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 	"github.com/denisbrodbeck/machineid"
 )
@@ -26,7 +27,12 @@ type FetchTagsConfig struct {
 	TagsFromGCPMetaData       bool
 	TagsFromGCPMetaDataPaths  []string
 	TagsFromGCPLabels         bool
+	TagsFromAzureMetaData     bool
+	TagsFromAzureTags         bool
+	TagsFromK8sDownwardAPI    string
 	TagsFromHost              bool
+	TagsFromHostCapabilities  bool
+	TagsMapping               []string
 	WaitForEC2TagsTimeout     time.Duration
 	WaitForEC2MetaDataTimeout time.Duration
 	WaitForECSMetaDataTimeout time.Duration
@@ -60,6 +66,16 @@ func FetchTags(ctx context.Context, l logger.Logger, conf FetchTagsConfig) []str
 		gcpLabels: func() (map[string]string, error) {
 			return GCPLabels{}.Get(ctx)
 		},
+		azureMetaData: func() (map[string]string, error) {
+			return AzureMetaData{}.Get(ctx)
+		},
+		azureTags: func() (map[string]string, error) {
+			return AzureMetaData{}.Tags(ctx)
+		},
+		k8sDownwardAPI: K8sTagsFromDownwardAPIFile,
+		hostCapabilities: func() []string {
+			return HostCapabilities(ctx)
+		},
 	}
 	return f.Fetch(ctx, l, conf)
 }
@@ -73,10 +89,16 @@ type tagFetcher struct {
 	gcpMetaDataDefault func() (map[string]string, error)
 	gcpMetaDataPaths   func(map[string]string) (map[string]string, error)
 	gcpLabels          func() (map[string]string, error)
+	azureMetaData      func() (map[string]string, error)
+	azureTags          func() (map[string]string, error)
+	k8sDownwardAPI     func(path string) (map[string]string, error)
+	hostCapabilities   func() []string
 }
 
 func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsConfig) []string {
-	tags := conf.Tags
+	// Tags fetched from the host and cloud providers, which the tag mapping
+	// applies to
+	var tags []string
 
 	if experiments.IsEnabled(experiments.KubernetesExec) {
 		k8sTags, err := t.k8s()
@@ -107,6 +129,12 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 		}
 	}
 
+	// Detect what the host is capable of running
+	if conf.TagsFromHostCapabilities {
+		l.Info("Detecting host capabilities...")
+		tags = append(tags, t.hostCapabilities()...)
+	}
+
 	// Attempt to add the default EC2 meta-data tags
 	if conf.TagsFromEC2MetaData {
 		l.Info("Fetching EC2 meta-data...")
@@ -115,7 +143,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(conf.WaitForEC2MetaDataTimeout/5)),
 			roko.WithJitter(),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Fetching EC2 meta-data", func(r *roko.Retrier) error {
 			ec2Tags, err := t.ec2MetaDataDefault()
 			if err != nil {
 				l.Warn("%s (%s)", err, r)
@@ -128,7 +156,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			}
 
 			return err
-		})
+		}))
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -162,7 +190,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(conf.WaitForEC2TagsTimeout/5)),
 			roko.WithJitter(),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Fetching EC2 tags", func(r *roko.Retrier) error {
 			ec2Tags, err := t.ec2Tags()
 			// EC2 tags are apparently "eventually consistent" and sometimes take several seconds
 			// to be applied to instances. This error will cause retries.
@@ -179,7 +207,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 				r.Break()
 			}
 			return err
-		})
+		}))
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -195,7 +223,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(conf.WaitForECSMetaDataTimeout/5)),
 			roko.WithJitter(),
-		).Do(func(r *roko.Retrier) error {
+		).Do(retrylog.Wrap("Fetching ECS meta-data", func(r *roko.Retrier) error {
 			ecsTags, err := t.ecsMetaDataDefault()
 			if err != nil {
 				l.Warn("%s (%s)", err, r)
@@ -208,7 +236,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			}
 
 			return err
-		})
+		}))
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -224,7 +252,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(1*time.Second)),
 			roko.WithJitter(),
-		).DoWithContext(ctx, func(_ *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Fetching GCP meta-data", func(_ *roko.Retrier) error {
 			gcpTags, err := t.gcpMetaDataDefault()
 			if err != nil {
 				// Don't blow up if we can't find them, just show a nasty error.
@@ -237,7 +265,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			}
 
 			return nil
-		})
+		}))
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -270,7 +298,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(conf.WaitForGCPLabelsTimeout/5)),
 			roko.WithJitter(),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Fetching GCP labels", func(r *roko.Retrier) error {
 			labels, err := t.gcpLabels()
 			if err == nil && len(labels) == 0 {
 				err = errors.New("GCP instance labels are empty")
@@ -285,7 +313,7 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 				r.Break()
 			}
 			return err
-		})
+		}))
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -293,7 +321,108 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 		}
 	}
 
-	return tags
+	// Attempt to add the Azure instance meta-data and tags
+	if conf.TagsFromAzureMetaData || conf.TagsFromAzureTags {
+		sources := []struct {
+			name  string
+			fetch func() (map[string]string, error)
+			when  bool
+		}{
+			{"Azure meta-data", t.azureMetaData, conf.TagsFromAzureMetaData},
+			{"Azure tags", t.azureTags, conf.TagsFromAzureTags},
+		}
+		for _, source := range sources {
+			if !source.when {
+				continue
+			}
+
+			l.Info("Fetching %s...", source.name)
+			err := roko.NewRetrier(
+				roko.WithMaxAttempts(5),
+				roko.WithStrategy(roko.Constant(1*time.Second)),
+				roko.WithJitter(),
+			).DoWithContext(ctx, retrylog.Wrap("Fetching "+source.name, func(r *roko.Retrier) error {
+				azureTags, err := source.fetch()
+				if err != nil {
+					l.Warn("%s (%s)", err, r)
+					return err
+				}
+
+				l.Info("Successfully fetched %s", source.name)
+				for tag, value := range azureTags {
+					tags = append(tags, fmt.Sprintf("%s=%s", tag, value))
+				}
+				return nil
+			}))
+
+			// Don't blow up if we can't find them, just show a nasty error.
+			if err != nil {
+				l.Error("Failed to fetch %s: %s", source.name, err)
+			}
+		}
+	}
+
+	// Attempt to add the pod labels projected by the Kubernetes downward API
+	if conf.TagsFromK8sDownwardAPI != "" {
+		k8sTags, err := t.k8sDownwardAPI(conf.TagsFromK8sDownwardAPI)
+		if err != nil {
+			// Don't blow up if we can't find them, just show a nasty error.
+			l.Error("Failed to read Kubernetes downward API labels: %s", err)
+		} else {
+			for tag, value := range k8sTags {
+				tags = append(tags, fmt.Sprintf("%s=%s", tag, value))
+			}
+		}
+	}
+
+	if len(conf.TagsMapping) > 0 {
+		mapping, err := parseTagsMapping(conf.TagsMapping)
+		if err != nil {
+			l.Error("Error parsing tags mapping: %s", err)
+		}
+		tags = applyTagsMapping(tags, mapping)
+	}
+
+	return append(append([]string{}, conf.Tags...), tags...)
+}
+
+// parseTagsMapping parses tag renames of the form `from=to`. A mapping with
+// an empty `to` drops the tag. Valid pairs are returned even if others are
+// invalid.
+func parseTagsMapping(pairs []string) (map[string]string, error) {
+	mapping := make(map[string]string, len(pairs))
+	var invalid []string
+
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" {
+			invalid = append(invalid, pair)
+			continue
+		}
+		mapping[from] = to
+	}
+
+	if len(invalid) > 0 {
+		return mapping, fmt.Errorf("%q cannot be parsed, format should be `from=to`", invalid)
+	}
+	return mapping, nil
+}
+
+// applyTagsMapping renames or drops tags according to mapping
+func applyTagsMapping(tags []string, mapping map[string]string) []string {
+	mapped := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		key, value, _ := strings.Cut(tag, "=")
+		to, ok := mapping[key]
+		switch {
+		case !ok:
+			mapped = append(mapped, tag)
+		case to != "":
+			mapped = append(mapped, to+"="+value)
+		}
+	}
+	return mapped
 }
 
 func parseTagValuePathPairs(paths []string) (map[string]string, error) {
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// validEnvName matches the names of environment variables that shells can
+// read
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// TagsEnv renders job environment variables from the agent's tags. Each
+// mapping is NAME=template, where the template is a text/template that's
+// given the tags by name, such as "AWS_REGION={{.region}}" or
+// "GPU={{tag \"gpu-model\"}} ({{tag \"gpu-count\"}}x)". Tags that aren't set
+// are empty. The agent's own BUILDKITE_ variables can't be set this way.
+func TagsEnv(tags []string, mappings []string) (map[string]string, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, _ := strings.Cut(tag, "=")
+		if _, ok := values[key]; !ok {
+			values[key] = value
+		}
+	}
+	funcs := template.FuncMap{
+		// tag looks up a tag whose name isn't a valid template field, such
+		// as one with a hyphen or colon in it
+		"tag": func(name string) string { return values[name] },
+	}
+
+	env := make(map[string]string, len(mappings))
+	var problems []string
+	for _, mapping := range mappings {
+		name, text, ok := strings.Cut(mapping, "=")
+		name = strings.TrimSpace(name)
+		switch {
+		case !ok || !validEnvName.MatchString(name):
+			problems = append(problems, fmt.Sprintf("%q isn't NAME=template", mapping))
+			continue
+		case strings.HasPrefix(name, "BUILDKITE_"):
+			problems = append(problems, fmt.Sprintf("%s can't be set from tags, as it's set by the agent", name))
+			continue
+		}
+
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, values); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		env[name] = out.String()
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return env, fmt.Errorf("invalid tags environment: %s", strings.Join(problems, ", "))
+	}
+	return env, nil
+}
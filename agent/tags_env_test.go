@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTagsEnv(t *testing.T) {
+	t.Parallel()
+
+	tags := []string{"queue=gpu", "region=us-east-1", "aws:instance-type=g5.xlarge", "gpu-model=A10G", "gpu-model=ignored"}
+
+	got, err := TagsEnv(tags, []string{
+		"AWS_REGION={{.region}}",
+		`INSTANCE={{tag "aws:instance-type"}} in {{.region}}`,
+		`GPU={{tag "gpu-model"}}`,
+		"MISSING={{.nope}}",
+		"STATIC=llamas",
+	})
+	if err != nil {
+		t.Fatalf("TagsEnv() error = %v", err)
+	}
+
+	want := map[string]string{
+		"AWS_REGION": "us-east-1",
+		"INSTANCE":   "g5.xlarge in us-east-1",
+		"GPU":        "A10G",
+		"MISSING":    "",
+		"STATIC":     "llamas",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TagsEnv() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTagsEnvInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, mapping := range []string{
+		"no template",
+		"1BAD={{.region}}",
+		"BUILDKITE_AGENT_NAME={{.region}}",
+		"UNCLOSED={{.region",
+	} {
+		if _, err := TagsEnv([]string{"region=us-east-1"}, []string{mapping}); err == nil {
+			t.Errorf("TagsEnv(%q) error = nil, want an error", mapping)
+		}
+	}
+}
@@ -196,3 +196,58 @@ func TestFetchingTagsFromAllSources(t *testing.T) {
 	assert.Contains(t, tags, "hostname="+hostname)
 	assert.Contains(t, tags, "os="+runtime.GOOS)
 }
+
+func TestFetchingTagsFromAzureAndK8sDownwardAPI(t *testing.T) {
+	fetcher := &tagFetcher{
+		azureMetaData: func() (map[string]string, error) {
+			return map[string]string{"azure:vm-size": "Standard_D2s_v3"}, nil
+		},
+		azureTags: func() (map[string]string, error) {
+			return map[string]string{"team": "platform"}, nil
+		},
+		k8sDownwardAPI: func(path string) (map[string]string, error) {
+			assert.Equal(t, "/etc/podinfo/labels", path)
+			return map[string]string{"app": "builder"}, nil
+		},
+	}
+
+	tags := fetcher.Fetch(context.Background(), logger.Discard, FetchTagsConfig{
+		Tags:                   []string{"llamas"},
+		TagsFromAzureMetaData:  true,
+		TagsFromAzureTags:      true,
+		TagsFromK8sDownwardAPI: "/etc/podinfo/labels",
+	})
+
+	assert.ElementsMatch(t, []string{
+		"llamas",
+		"azure:vm-size=Standard_D2s_v3",
+		"team=platform",
+		"app=builder",
+	}, tags)
+}
+
+func TestFetchingTagsWithMapping(t *testing.T) {
+	fetcher := &tagFetcher{
+		ec2MetaDataDefault: func() (map[string]string, error) {
+			return map[string]string{
+				"aws:instance-id":   "i-123",
+				"aws:instance-type": "t3.large",
+			}, nil
+		},
+	}
+
+	tags := fetcher.Fetch(context.Background(), logger.Discard, FetchTagsConfig{
+		Tags:                []string{"aws:instance-id=kept"},
+		TagsFromEC2MetaData: true,
+		TagsMapping:         []string{"aws:instance-type=instance-type", "aws:instance-id="},
+	})
+
+	// Tags set directly are never mapped
+	assert.ElementsMatch(t, []string{"aws:instance-id=kept", "instance-type=t3.large"}, tags)
+}
+
+func TestParseTagsMapping(t *testing.T) {
+	mapping, err := parseTagsMapping([]string{"a=b", " c = ", "nope", "=d"})
+	assert.Error(t, err)
+	assert.Equal(t, map[string]string{"a": "b", "c": ""}, mapping)
+}
@@ -30,9 +30,20 @@ type Artifact struct {
 	// A SHA-2 256-bit hash of the uploaded file, possibly empty
 	Sha256Sum string `json:"sha256sum"`
 
+	// The permission bits of the file when it was uploaded, such as 0755.
+	// Zero if they weren't recorded
+	FileMode uint32 `json:"file_mode,omitempty"`
+
+	// When the file was last modified before it was uploaded, if recorded
+	FileModifiedAt *time.Time `json:"file_modified_at,omitempty"`
+
 	// ID of the job that created this artifact (from API)
 	JobID string `json:"job_id"`
 
+	// The label and key of the step of the job that uploaded it, if recorded
+	JobName string `json:"job_name,omitempty"`
+	StepKey string `json:"step_key,omitempty"`
+
 	// UTC timestamp this artifact was considered created
 	CreatedAt time.Time `json:"created_at"`
 
@@ -80,6 +91,10 @@ type ArtifactSearchOptions struct {
 	State              string `url:"state,omitempty"`
 	IncludeRetriedJobs bool   `url:"include_retried_jobs,omitempty"`
 	IncludeDuplicates  bool   `url:"include_duplicates,omitempty"`
+
+	// The page of results to return, from Response.NextPage. Zero is the
+	// first page
+	Page int `url:"page,omitempty"`
 }
 
 type ArtifactBatchUpdateArtifact struct {
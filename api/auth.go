@@ -15,12 +15,19 @@ type authenticatedTransport struct {
 	// organizations registration token, or the agents access token.
 	Token string
 
+	// If true, requests are sent without a token
+	Anonymous bool
+
 	// Delegate is the underlying HTTP transport
 	Delegate http.RoundTripper
 }
 
 // RoundTrip invoked each time a request is made
 func (t authenticatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Anonymous {
+		return t.Delegate.RoundTrip(req)
+	}
+
 	if t.Token == "" {
 		return nil, fmt.Errorf("Invalid token, empty string supplied")
 	}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// chunkStreamTimeout is how long to wait for the connection, and for each
+// chunk to be acknowledged
+const chunkStreamTimeout = 30 * time.Second
+
+// ChunkStream sends a job's log chunks over a single WebSocket connection,
+// rather than a request per chunk
+type ChunkStream struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// chunkMessage is what's sent over the stream for each chunk. Data is the
+// gzipped chunk.
+type chunkMessage struct {
+	Sequence int    `json:"sequence"`
+	Offset   int    `json:"offset"`
+	Size     int    `json:"size"`
+	Data     []byte `json:"data"`
+}
+
+// chunkAck is the reply to each chunkMessage
+type chunkAck struct {
+	Sequence int    `json:"sequence"`
+	Error    string `json:"error,omitempty"`
+}
+
+// StreamChunks opens a stream to upload the job's log chunks over. It returns
+// an error if the endpoint doesn't support streaming, in which case chunks
+// should be uploaded with UploadChunk.
+func (c *Client) StreamChunks(ctx context.Context, jobId string) (*ChunkStream, error) {
+	u, err := url.Parse(joinURLPath(c.conf.Endpoint, fmt.Sprintf("jobs/%s/chunks/stream", jobId)))
+	if err != nil {
+		return nil, err
+	}
+
+	origin := *u
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("can't stream chunks to a %s endpoint", u.Scheme)
+	}
+
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", fmt.Sprintf("Token %s", c.conf.Token))
+	config.Header.Set("User-Agent", c.conf.UserAgent)
+	config.Dialer = &net.Dialer{
+		Timeout:   chunkStreamTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dialer.Deadline = deadline
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChunkStream{conn: conn}, nil
+}
+
+// Send sends the chunk and waits for it to be acknowledged
+func (s *ChunkStream) Send(chunk *Chunk) error {
+	body := &bytes.Buffer{}
+	gzipper := gzip.NewWriter(body)
+	gzipper.Write(chunk.Data)
+	if err := gzipper.Close(); err != nil {
+		return err
+	}
+
+	// Chunks are sent one at a time, so each acknowledgement is for the
+	// chunk that was just sent
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.conn.SetDeadline(time.Now().Add(chunkStreamTimeout)); err != nil {
+		return err
+	}
+
+	if err := websocket.JSON.Send(s.conn, chunkMessage{
+		Sequence: chunk.Sequence,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+		Data:     body.Bytes(),
+	}); err != nil {
+		return err
+	}
+
+	var ack chunkAck
+	if err := websocket.JSON.Receive(s.conn, &ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return errors.New(ack.Error)
+	}
+	if ack.Sequence != chunk.Sequence {
+		return fmt.Errorf("chunk %d was acknowledged as chunk %d", chunk.Sequence, ack.Sequence)
+	}
+	return nil
+}
+
+// Close closes the stream
+func (s *ChunkStream) Close() error {
+	return s.conn.Close()
+}
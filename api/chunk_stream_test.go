@@ -0,0 +1,79 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamChunks(t *testing.T) {
+	t.Parallel()
+
+	type message struct {
+		Sequence int    `json:"sequence"`
+		Offset   int    `json:"offset"`
+		Size     int    `json:"size"`
+		Data     []byte `json:"data"`
+	}
+
+	received := make(chan string, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs/abc/chunks/stream", func(rw http.ResponseWriter, req *http.Request) {
+		if got, want := req.Header.Get("Authorization"), "Token llamas"; got != want {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		websocket.Server{Handler: func(conn *websocket.Conn) {
+			for {
+				var msg message
+				if err := websocket.JSON.Receive(conn, &msg); err != nil {
+					return
+				}
+				r, err := gzip.NewReader(bytes.NewReader(msg.Data))
+				if err != nil {
+					t.Errorf("gzip.NewReader() error = %v", err)
+					return
+				}
+				data, _ := io.ReadAll(r)
+				received <- string(data)
+
+				ack := map[string]any{"sequence": msg.Sequence}
+				if msg.Sequence == 2 {
+					ack["error"] = "chunk 2 is invalid"
+				}
+				websocket.JSON.Send(conn, ack)
+			}
+		}}.ServeHTTP(rw, req)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	stream, err := client.StreamChunks(context.Background(), "abc")
+	require.NoError(t, err)
+	defer stream.Close()
+
+	assert.NoError(t, stream.Send(&api.Chunk{Data: []byte("hello"), Sequence: 1, Size: 5}))
+	assert.Equal(t, "hello", <-received)
+
+	assert.EqualError(t, stream.Send(&api.Chunk{Data: []byte("world"), Sequence: 2, Offset: 5, Size: 5}), "chunk 2 is invalid")
+	assert.Equal(t, "world", <-received)
+
+	// Endpoints that don't support streaming fail to connect
+	_, err = client.StreamChunks(context.Background(), "unknown")
+	assert.Error(t, err)
+}
@@ -15,9 +15,11 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/buildkite/agent/v3/chaos"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/google/go-querystring/query"
 )
@@ -36,6 +38,10 @@ type Config struct {
 	// The authentication token to use, either a registration or access token
 	Token string
 
+	// If true, requests are sent without a token, which only works for the
+	// public data of public pipelines, such as the artifacts of their builds
+	Anonymous bool
+
 	// User agent used when communicating with the Buildkite Agent API.
 	UserAgent string
 
@@ -45,6 +51,10 @@ type Config struct {
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If set, requests and responses are dumped into files in this
+	// directory, with credentials redacted, rather than to the logger
+	DebugHTTPDump string
+
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
 }
@@ -90,11 +100,14 @@ func NewClient(l logger.Logger, conf Config) *Client {
 			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 		}
 
+		delegate := chaos.Wrap(chaos.API, t)
+
 		httpClient = &http.Client{
 			Timeout: 60 * time.Second,
 			Transport: &authenticatedTransport{
-				Token:    conf.Token,
-				Delegate: t,
+				Token:     conf.Token,
+				Anonymous: conf.Anonymous,
+				Delegate:  delegate,
 			},
 		}
 	}
@@ -206,14 +219,38 @@ func (c *Client) newFormRequest(ctx context.Context, method, urlStr string, body
 // http.Response.
 type Response struct {
 	*http.Response
+
+	// The page to ask for next, from the response's Link header, or 0 if
+	// it's the last page, or the response isn't paginated
+	NextPage int
 }
 
 // newResponse creates a new Response for the provided http.Response.
 func newResponse(r *http.Response) *Response {
 	response := &Response{Response: r}
+	response.NextPage = nextPage(r.Header.Get("Link"))
 	return response
 }
 
+// nextPage returns the page number of the rel="next" link in a Link header,
+// such as <https://agent.buildkite.com/v3/builds/1/artifacts/search?page=2>; rel="next"
+func nextPage(link string) int {
+	for _, l := range strings.Split(link, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(l), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			continue
+		}
+		if page, err := strconv.Atoi(u.Query().Get("page")); err == nil && page > 0 {
+			return page
+		}
+	}
+	return 0
+}
+
 // Do sends an API request and returns the API response. The API response is
 // JSON decoded and stored in the value pointed to by v, or returned as an
 // error if an API error has occurred.  If v implements the io.Writer
@@ -222,7 +259,12 @@ func newResponse(r *http.Response) *Response {
 func (c *Client) doRequest(req *http.Request, v any) (*Response, error) {
 	var err error
 
-	if c.conf.DebugHTTP {
+	var dumpName string
+	if c.conf.DebugHTTPDump != "" {
+		dumpName = httpDumpName(req)
+	}
+
+	if c.conf.DebugHTTP || dumpName != "" {
 		// If the request is a multi-part form, then it's probably a
 		// file upload, in which case we don't want to spewing out the
 		// file contents into the debug log (especially if it's been
@@ -236,6 +278,8 @@ func (c *Client) doRequest(req *http.Request, v any) (*Response, error) {
 
 		if err != nil {
 			c.logger.Debug("ERR: %s\n%s", err, string(requestDump))
+		} else if dumpName != "" {
+			c.dumpHTTP(dumpName, "request", requestDump)
 		} else {
 			c.logger.Debug("%s", string(requestDump))
 		}
@@ -261,10 +305,12 @@ func (c *Client) doRequest(req *http.Request, v any) (*Response, error) {
 
 	response := newResponse(resp)
 
-	if c.conf.DebugHTTP {
+	if c.conf.DebugHTTP || dumpName != "" {
 		responseDump, err := httputil.DumpResponse(resp, true)
 		if err != nil {
 			c.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
+		} else if dumpName != "" {
+			c.dumpHTTP(dumpName, "response", responseDump)
 		} else {
 			c.logger.Debug("\n%s", string(responseDump))
 		}
@@ -292,6 +338,17 @@ func (c *Client) doRequest(req *http.Request, v any) (*Response, error) {
 	return response, err
 }
 
+// dumpHTTP writes a request or response dump into the DebugHTTPDump
+// directory
+func (c *Client) dumpHTTP(name, kind string, dump []byte) {
+	path, err := writeHTTPDump(c.conf.DebugHTTPDump, name, kind, dump)
+	if err != nil {
+		c.logger.Warn("Failed to dump HTTP %s: %v", kind, err)
+		return
+	}
+	c.logger.Debug("Dumped HTTP %s to %s", kind, path)
+}
+
 // ErrorResponse provides a message.
 type ErrorResponse struct {
 	Response *http.Response // HTTP response that caused this error
@@ -71,3 +71,23 @@ func TestRegisteringAndConnectingClient(t *testing.T) {
 func authToken(req *http.Request) string {
 	return strings.TrimPrefix(req.Header.Get("Authorization"), "Token ")
 }
+
+func TestAnonymousClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if auth := req.Header.Get("Authorization"); auth != "" {
+			http.Error(rw, fmt.Sprintf("Authorization = %q, want none", auth), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(rw, `[]`)
+	}))
+	defer server.Close()
+
+	c := api.NewClient(logger.Discard, api.Config{
+		Endpoint:  server.URL,
+		Anonymous: true,
+	})
+
+	if _, _, err := c.SearchArtifacts(context.Background(), "my-build", &api.ArtifactSearchOptions{}); err != nil {
+		t.Errorf("c.SearchArtifacts() error = %v", err)
+	}
+}
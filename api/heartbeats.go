@@ -7,15 +7,28 @@ import (
 
 // Heartbeat represents a Buildkite Agent API Heartbeat
 type Heartbeat struct {
-	SentAt     string `json:"sent_at"`
-	ReceivedAt string `json:"received_at,omitempty"`
+	SentAt     string       `json:"sent_at"`
+	ReceivedAt string       `json:"received_at,omitempty"`
+	Health     *AgentHealth `json:"health,omitempty"`
 }
 
-// Heartbeat notifies Buildkite that an agent is still connected
-func (c *Client) Heartbeat(ctx context.Context) (*Heartbeat, *Response, error) {
+// AgentHealth describes the host an agent is running on, and what the agent
+// is doing. Any of it may be missing if it couldn't be measured.
+type AgentHealth struct {
+	DiskFreeBytes    uint64    `json:"disk_free_bytes,omitempty"`
+	DiskTotalBytes   uint64    `json:"disk_total_bytes,omitempty"`
+	LoadAverage      []float64 `json:"load_average,omitempty"`
+	JobID            string    `json:"job_id,omitempty"`
+	JobPhase         string    `json:"job_phase,omitempty"`
+	ArtifactTransfer bool      `json:"artifact_transfer,omitempty"`
+}
+
+// Heartbeat notifies Buildkite that an agent is still connected, and how
+// healthy it is. health may be nil.
+func (c *Client) Heartbeat(ctx context.Context, health *AgentHealth) (*Heartbeat, *Response, error) {
 	// Include the current time in the heartbeat, and include the operating
 	// systems timezone.
-	heartbeat := &Heartbeat{SentAt: time.Now().Format(time.RFC3339Nano)}
+	heartbeat := &Heartbeat{SentAt: time.Now().Format(time.RFC3339Nano), Health: health}
 
 	req, err := c.newRequest(ctx, "POST", "heartbeat", &heartbeat)
 	if err != nil {
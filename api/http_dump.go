@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+)
+
+// httpDumpSeq numbers the requests dumped by this process, so their files
+// sort in the order they were made
+var httpDumpSeq uint64
+
+var (
+	// Headers with credentials in them
+	httpDumpSecretHeaders = regexp.MustCompile(`(?im)^((?:Proxy-)?Authorization|Cookie|Set-Cookie|X-Amz-Security-Token):[^\r\n]*`)
+
+	// JSON fields with credentials in them, such as the access_token in the
+	// response to registering, or the environment variables in a job that
+	// match the agent's default redacted-vars, such as AWS_SECRET_ACCESS_KEY
+	httpDumpSecretFields = regexp.MustCompile(`(?i)"([a-z0-9_]*(?:token|password|secret|private_key|access_key|connection_string)[a-z0-9_]*)"(\s*):(\s*)"(?:[^"\\]|\\.)*"`)
+
+	// Anything that doesn't belong in a file name
+	httpDumpUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// redactHTTPDump removes credentials from a dumped request or response
+func redactHTTPDump(dump []byte) []byte {
+	dump = httpDumpSecretHeaders.ReplaceAll(dump, []byte("$1: [REDACTED]"))
+	return httpDumpSecretFields.ReplaceAll(dump, []byte(`"$1"$2:$3"[REDACTED]"`))
+}
+
+// httpDumpName returns the name the files for a request are written with
+// in the dump directory, which is unique to the request
+func httpDumpName(req *http.Request) string {
+	path := httpDumpUnsafe.ReplaceAllString(req.URL.Path, "_")
+	if len(path) > 100 {
+		path = path[:100]
+	}
+	seq := atomic.AddUint64(&httpDumpSeq, 1)
+	return fmt.Sprintf("%d-%04d-%s%s", os.Getpid(), seq, req.Method, path)
+}
+
+// writeHTTPDump writes a redacted request or response dump into dir, and
+// returns the path of the file it was written to
+func writeHTTPDump(dir, name, kind string, dump []byte) (string, error) {
+	// Dumps can still have secrets in them that weren't recognised
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name+"."+kind+".http")
+	return path, os.WriteFile(path, redactHTTPDump(dump), 0o600)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestRedactHTTPDump(t *testing.T) {
+	dump := "HTTP/1.1 200 OK\r\n" +
+		"Authorization: Token llamas\r\n" +
+		"Content-Type: application/json\r\n" +
+		"\r\n" +
+		`{"name":"agent-1", "access_token" : "alpacas", "password":"es\"caped", "job_id":"123"}`
+
+	want := "HTTP/1.1 200 OK\r\n" +
+		"Authorization: [REDACTED]\r\n" +
+		"Content-Type: application/json\r\n" +
+		"\r\n" +
+		`{"name":"agent-1", "access_token" : "[REDACTED]", "password":"[REDACTED]", "job_id":"123"}`
+
+	if got := string(redactHTTPDump([]byte(dump))); got != want {
+		t.Errorf("redactHTTPDump(dump) = %q, want %q", got, want)
+	}
+}
+
+func TestRedactHTTPDumpJobEnv(t *testing.T) {
+	dump := `{"id":"123","env":{"BUILDKITE_BRANCH":"main","DEPLOY_PRIVATE_KEY":"-----BEGIN","S3_ACCESS_KEY":"AKIA",` +
+		`"AWS_SECRET_ACCESS_KEY":"llamas","DATABASE_CONNECTION_STRING":"postgres://u:p@db","GITHUB_TOKEN":"ghp_"}}`
+
+	want := `{"id":"123","env":{"BUILDKITE_BRANCH":"main","DEPLOY_PRIVATE_KEY":"[REDACTED]","S3_ACCESS_KEY":"[REDACTED]",` +
+		`"AWS_SECRET_ACCESS_KEY":"[REDACTED]","DATABASE_CONNECTION_STRING":"[REDACTED]","GITHUB_TOKEN":"[REDACTED]"}}`
+
+	if got := string(redactHTTPDump([]byte(dump))); got != want {
+		t.Errorf("redactHTTPDump(dump) = %q, want %q", got, want)
+	}
+}
+
+func TestClientDebugHTTPDump(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), "http-dump")
+	c := NewClient(logger.Discard, Config{
+		Endpoint:      server.URL,
+		Token:         "llamas",
+		DebugHTTPDump: dir,
+	})
+
+	if _, _, err := c.Register(context.Background(), &AgentRegisterRequest{Name: "agent-1"}); err != nil {
+		t.Fatalf("c.Register() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("os.ReadDir(%q) error = %v", dir, err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("len(entries) = %d, want a request and a response", len(entries))
+	}
+
+	for _, entry := range entries {
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) error = %v", entry.Name(), err)
+		}
+
+		switch {
+		case strings.HasSuffix(entry.Name(), "POST_register.request.http"):
+			if !strings.Contains(string(contents), `"name":"agent-1"`) {
+				t.Errorf("request dump = %q, want it to contain the request body", contents)
+			}
+		case strings.HasSuffix(entry.Name(), "POST_register.response.http"):
+			if strings.Contains(string(contents), "alpacas") {
+				t.Errorf("response dump = %q, want the access token redacted", contents)
+			}
+		default:
+			t.Errorf("unexpected dump file %q", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// JobEvent is something that happened in a job, recognised from its output,
+// such as a group starting or a test passing
+type JobEvent struct {
+	// The event's position amongst the job's events, from 0
+	Sequence int `json:"sequence"`
+
+	// What kind of event it is, such as "group" or "test"
+	Type string `json:"type"`
+
+	// When the event's output was seen, in RFC3339
+	Time string `json:"time"`
+
+	// The name of the group or test
+	Name string `json:"name,omitempty"`
+
+	// How a test finished, such as "passed" or "failed", or how a group is
+	// displayed
+	Status string `json:"status,omitempty"`
+
+	// The test's number, or how many tests are planned
+	Number int `json:"number,omitempty"`
+
+	// The package or suite the test is in
+	Suite string `json:"suite,omitempty"`
+
+	// How many seconds the test took, if the framework says
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// JobEvents is a batch of a job's events
+type JobEvents struct {
+	Events []*JobEvent `json:"events"`
+}
+
+// UploadJobEvents uploads a batch of events to the job
+func (c *Client) UploadJobEvents(ctx context.Context, jobId string, events *JobEvents) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/events", jobId)
+
+	req, err := c.newRequest(ctx, "POST", u, events)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(req, nil)
+}
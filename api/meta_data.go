@@ -30,6 +30,25 @@ func (c *Client) SetMetaData(ctx context.Context, jobId string, metaData *MetaDa
 	return c.doRequest(req, nil)
 }
 
+// MetaDataBatch represents a Buildkite Agent API request to set many meta
+// data keys at once
+type MetaDataBatch struct {
+	Items []*MetaData `json:"items"`
+}
+
+// Sets many meta data values in a single request. Agent API servers that
+// can't set them in a batch respond with 404 Not Found.
+func (c *Client) SetMetaDataBatch(ctx context.Context, jobId string, batch *MetaDataBatch) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/batch_set", jobId)
+
+	req, err := c.newRequest(ctx, "POST", u, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(req, nil)
+}
+
 // Gets the meta data value
 func (c *Client) GetMetaData(ctx context.Context, scope, id, key string) (*MetaData, *Response, error) {
 	if scope != "job" && scope != "build" {
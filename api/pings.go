@@ -8,6 +8,12 @@ type Ping struct {
 	Message  string `json:"message,omitempty"`
 	Job      *Job   `json:"job,omitempty"`
 	Endpoint string `json:"endpoint,omitempty"`
+
+	// Parameters of remote control actions, such as the tags to switch to
+	// for update-tags, and who asked for it
+	Tags        []string `json:"tags,omitempty"`
+	LogLevel    string   `json:"log_level,omitempty"`
+	RequestedBy string   `json:"requested_by,omitempty"`
 }
 
 // Pings the API and returns any work the client needs to perform
@@ -0,0 +1,110 @@
+// Package artifactdownload downloads the artifacts of a Buildkite build, for
+// programs that want to do what buildkite-agent artifact download does
+// without running it.
+//
+// Unlike most of the agent's packages, this one is a supported entry point:
+// Download and its options are kept compatible between minor releases.
+//
+//	results, err := artifactdownload.Download(ctx, client, buildID, "pkg/*.tar.gz", "./dist",
+//		artifactdownload.WithStep("build"),
+//		artifactdownload.WithConcurrency(8),
+//	)
+//
+// The client can be an *api.Client, or anything else that can search for
+// artifacts. The storage services artifacts are downloaded from can be
+// replaced with WithBackend, such as to fetch them from a mirror.
+package artifactdownload
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+// Client searches for the artifacts of a build. *api.Client is one.
+type Client = agent.ArtifactSearchClient
+
+// Result is how downloading an artifact went
+type Result = agent.ArtifactDownloadResult
+
+// Observer is told how each artifact's download is going
+type Observer = agent.ArtifactDownloadObserver
+
+// Option configures Download
+type Option func(*options)
+
+type options struct {
+	logger logger.Logger
+	conf   agent.ArtifactDownloaderConfig
+}
+
+// WithLogger logs what Download is doing to l. By default nothing is logged.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithHTTPClient downloads artifacts over HTTP with c, rather than a client
+// made for the download
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) { o.conf.HTTPClient = c }
+}
+
+// WithStep only downloads artifacts uploaded by the jobs of a step, given by
+// its key, label or a job ID
+func WithStep(step string) Option {
+	return func(o *options) { o.conf.Step = step }
+}
+
+// WithRetriedJobs also searches the artifacts of jobs that were retried,
+// downloading the newest of each path
+func WithRetriedJobs() Option {
+	return func(o *options) { o.conf.IncludeRetriedJobs = true }
+}
+
+// WithConcurrency downloads n artifacts at once
+func WithConcurrency(n int) Option {
+	return func(o *options) { o.conf.Concurrency = n }
+}
+
+// WithObserver tells obs how each artifact's download is going
+func WithObserver(obs Observer) Option {
+	return func(o *options) { o.conf.Observer = obs }
+}
+
+// WithBackend downloads artifacts uploaded to destinations with scheme, such
+// as "s3", from b, rather than the storage service itself. b is given the
+// URL of each artifact, such as s3://bucket/prefix/path/to/artifact.
+func WithBackend(scheme string, b transfer.Backend) Option {
+	return func(o *options) {
+		if o.conf.Backends == nil {
+			o.conf.Backends = map[string]transfer.Backend{}
+		}
+		o.conf.Backends[scheme] = b
+	}
+}
+
+// WithConfig changes the rest of the downloader's configuration, for the
+// settings that don't have an option of their own
+func WithConfig(f func(*agent.ArtifactDownloaderConfig)) Option {
+	return func(o *options) { f(&o.conf) }
+}
+
+// Download downloads the artifacts of a build that match query to the
+// destination directory, and returns how each went. If any fail, the error
+// is an *agent.ArtifactDownloadMultiError, and the results say which.
+func Download(ctx context.Context, client Client, buildID, query, destination string, opts ...Option) ([]Result, error) {
+	o := options{logger: logger.Discard}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.conf.BuildID = buildID
+	o.conf.Query = query
+	o.conf.Destination = destination
+
+	d := agent.NewArtifactDownloader(o.logger, client, o.conf)
+	err := d.Download(ctx)
+	return d.Results(), err
+}
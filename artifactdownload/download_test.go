@@ -0,0 +1,82 @@
+package artifactdownload_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/artifactdownload"
+	"github.com/buildkite/agent/v3/transfer"
+)
+
+// fakeClient finds the same artifacts for every search
+type fakeClient struct {
+	artifacts []*api.Artifact
+}
+
+func (f fakeClient) SearchArtifacts(context.Context, string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error) {
+	return f.artifacts, nil, nil
+}
+
+// memoryBackend serves objects from memory, recording what was read
+type memoryBackend struct {
+	transfer.Backend
+
+	mu      sync.Mutex
+	objects map[string]string
+	opened  []string
+}
+
+func (m *memoryBackend) Open(_ context.Context, path string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opened = append(m.opened, path)
+	return io.NopCloser(strings.NewReader(m.objects[path])), nil
+}
+
+func TestDownloadWithBackend(t *testing.T) {
+	t.Parallel()
+
+	client := fakeClient{artifacts: []*api.Artifact{{
+		ID:                "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+		Path:              "pkg/llamas.txt",
+		FileSize:          3,
+		UploadDestination: "s3://my-bucket/builds/1/",
+	}}}
+	backend := &memoryBackend{objects: map[string]string{
+		"s3://my-bucket/builds/1/pkg/llamas.txt": "OK\n",
+	}}
+
+	dir := t.TempDir()
+	var finished []string
+	results, err := artifactdownload.Download(context.Background(), client, "my-build", "pkg/*", dir,
+		artifactdownload.WithBackend("s3", backend),
+		artifactdownload.WithConcurrency(1),
+		artifactdownload.WithObserver(artifactdownload.Observer{
+			Finished: func(artifact *api.Artifact, _ artifactdownload.Result) {
+				finished = append(finished, artifact.Path)
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	if len(results) != 1 || results[0].Destination != filepath.Join(dir, "pkg", "llamas.txt") {
+		t.Errorf("Download() results = %+v, want pkg/llamas.txt downloaded to %s", results, dir)
+	}
+	if contents, err := os.ReadFile(filepath.Join(dir, "pkg", "llamas.txt")); err != nil || string(contents) != "OK\n" {
+		t.Errorf("os.ReadFile() = %q, %v, want %q", contents, err, "OK\n")
+	}
+	if len(backend.opened) != 1 {
+		t.Errorf("backend.opened = %q, want the artifact opened once", backend.opened)
+	}
+	if len(finished) != 1 {
+		t.Errorf("observer finished %q, want pkg/llamas.txt", finished)
+	}
+}
@@ -1,8 +1,11 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/jobapi"
 )
@@ -34,6 +37,14 @@ func (b *Bootstrap) startJobAPI() (cleanup func(), err error) {
 		return cleanup, fmt.Errorf("creating job API server: %v", err)
 	}
 
+	srv.AddRedactions = b.addRedactedValues
+	srv.Cancelled = b.cancelled
+	srv.PhaseTimings = b.phaseTimings.get
+	srv.UploadArtifacts = b.uploadArtifactsFromJobAPI
+	b.redactionMtx.Lock()
+	b.alwaysRedacting = true
+	b.redactionMtx.Unlock()
+
 	b.shell.Env.Set("BUILDKITE_AGENT_JOB_API_SOCKET", socketPath)
 	b.shell.Env.Set("BUILDKITE_AGENT_JOB_API_TOKEN", token)
 
@@ -48,3 +59,20 @@ func (b *Bootstrap) startJobAPI() (cleanup func(), err error) {
 		}
 	}, nil
 }
+
+// uploadArtifactsFromJobAPI uploads artifacts that the job's own tools ask
+// for, one request at a time. They arrive while the job's command is running,
+// so they're always uploaded by a subprocess, as the in-process uploader
+// changes the working directory and environment of the whole process. The
+// subprocess runs in a copy of the shell, so the command the shell is
+// running can still be interrupted.
+func (b *Bootstrap) uploadArtifactsFromJobAPI(ctx context.Context, paths []string, destination string) error {
+	b.jobAPIArtifactsMtx.Lock()
+	defer b.jobAPIArtifactsMtx.Unlock()
+
+	if destination == "" {
+		destination = b.ArtifactUploadDestination
+	}
+	uploader := &shellArtifactUploader{shell: b.shell.WithStdin(nil)}
+	return uploader.UploadArtifacts(ctx, strings.Join(paths, agent.ArtifactPathDelimiter), destination)
+}
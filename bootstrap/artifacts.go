@@ -0,0 +1,148 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/version"
+)
+
+// ArtifactUploader uploads the artifacts matching paths at the end of a job.
+// An empty destination means the artifacts are stored by Buildkite.
+type ArtifactUploader interface {
+	UploadArtifacts(ctx context.Context, paths, destination string) error
+}
+
+// shellArtifactUploader uploads artifacts by running buildkite-agent artifact
+// upload in the job's shell. It's the default.
+type shellArtifactUploader struct {
+	shell *shell.Shell
+}
+
+func (u *shellArtifactUploader) UploadArtifacts(ctx context.Context, paths, destination string) error {
+	args := []string{"artifact", "upload", paths}
+
+	// If blank, the upload destination is buildkite
+	if destination != "" {
+		args = append(args, destination)
+	}
+
+	return u.shell.Run(ctx, "buildkite-agent", args...)
+}
+
+// inProcessArtifactUploader uploads artifacts using an agent.ArtifactUploader
+// inside the bootstrap, rather than in a subprocess. It's used when the
+// inprocess-artifact-upload experiment is enabled.
+type inProcessArtifactUploader struct {
+	shell *shell.Shell
+	jobID string
+}
+
+func (u *inProcessArtifactUploader) UploadArtifacts(ctx context.Context, paths, destination string) error {
+	l := logger.NewConsoleLogger(logger.NewTextPrinter(u.shell.Writer), func(int) {})
+
+	endpoint, _ := u.shell.Env.Get("BUILDKITE_AGENT_ENDPOINT")
+	token, _ := u.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN")
+
+	client := api.NewClient(l, api.Config{
+		Endpoint:  endpoint,
+		Token:     token,
+		UserAgent: version.UserAgent(),
+		DebugHTTP: u.shell.Env.GetBool("BUILDKITE_AGENT_DEBUG_HTTP", false),
+	})
+
+	cfg, err := u.config(paths, destination)
+	if err != nil {
+		return err
+	}
+
+	uploader := agent.NewArtifactUploader(l, client, cfg)
+
+	return withJobEnvironment(u.shell, func() error {
+		return uploader.Upload(ctx)
+	})
+}
+
+// config builds the uploader's config from the job's environment, the same way
+// buildkite-agent artifact upload would from its flags.
+func (u *inProcessArtifactUploader) config(paths, destination string) (agent.ArtifactUploaderConfig, error) {
+	env := u.shell.Env
+	contentType, _ := env.Get("BUILDKITE_ARTIFACT_CONTENT_TYPE")
+	ignorePaths, _ := env.Get("BUILDKITE_ARTIFACT_IGNORE_PATHS")
+	jobName, _ := env.Get("BUILDKITE_LABEL")
+	stepKey, _ := env.Get("BUILDKITE_STEP_KEY")
+	defaultDestination, _ := env.Get("BUILDKITE_ARTIFACT_UPLOAD_DEFAULT_DESTINATION")
+	pendingWritesDir, _ := env.Get(agent.PendingWritesDirEnv)
+	postProcessors, _ := env.Get("BUILDKITE_ARTIFACT_POST_PROCESSORS")
+	signingKey, _ := env.Get("BUILDKITE_ARTIFACT_SIGNING_KEY")
+	encryptionKeyFile, _ := env.Get("BUILDKITE_ARTIFACT_ENCRYPTION_KEY_FILE")
+	nameTemplate, _ := env.Get("BUILDKITE_ARTIFACT_NAME_TEMPLATE")
+	allowFailuresValue, _ := env.Get("BUILDKITE_ARTIFACT_ALLOW_FAILURES")
+
+	allowFailures, err := agent.ParseFailureThreshold(allowFailuresValue)
+	if err != nil {
+		return agent.ArtifactUploaderConfig{}, fmt.Errorf("parsing BUILDKITE_ARTIFACT_ALLOW_FAILURES: %w", err)
+	}
+
+	return agent.ArtifactUploaderConfig{
+		JobID:          u.jobID,
+		JobName:        jobName,
+		StepKey:        stepKey,
+		Paths:          paths,
+		Destination:    destination,
+		ContentType:    contentType,
+		DebugHTTP:      env.GetBool("BUILDKITE_AGENT_DEBUG_HTTP", false),
+		FollowSymlinks: env.GetBool("BUILDKITE_AGENT_ARTIFACT_SYMLINKS", false),
+		IgnorePaths:    ignorePaths,
+
+		DefaultDestination: defaultDestination,
+		PendingWritesDir:   pendingWritesDir,
+		PostProcessors:     postProcessors,
+		SigningKeyPath:     signingKey,
+		EncryptionKeyPath:  encryptionKeyFile,
+		NameTemplate:       nameTemplate,
+		AllowFailures:      allowFailures,
+	}, nil
+}
+
+// withJobEnvironment runs fn with the process in the shell's working directory
+// and environment, which is what a subprocess started by the shell would see.
+// The uploaders resolve globs against the process working directory, and the
+// storage backends read their credentials from the process environment, which
+// hooks may have changed in the shell.
+func withJobEnvironment(sh *shell.Shell, fn func() error) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getting working directory: %w", err)
+	}
+	if err := os.Chdir(sh.Getwd()); err != nil {
+		return fmt.Errorf("changing to the job's working directory: %w", err)
+	}
+	defer os.Chdir(wd)
+
+	previous := map[string]*string{}
+	for name, value := range sh.Env.Dump() {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,98 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeArtifactUploader struct {
+	paths, destination string
+}
+
+func (u *fakeArtifactUploader) UploadArtifacts(ctx context.Context, paths, destination string) error {
+	u.paths, u.destination = paths, destination
+	return nil
+}
+
+func TestUploadArtifactsUsesArtifactUploader(t *testing.T) {
+	t.Parallel()
+
+	uploader := &fakeArtifactUploader{}
+	b := &Bootstrap{
+		Config: Config{
+			AutomaticArtifactUploadPaths: "llamas/*.txt",
+			ArtifactUploadDestination:    "s3://bucket/path",
+		},
+		shell:            shell.NewTestShell(t),
+		artifactUploader: uploader,
+	}
+
+	err := b.uploadArtifacts(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas/*.txt", uploader.paths)
+	assert.Equal(t, "s3://bucket/path", uploader.destination)
+}
+
+// Not parallel, as it changes the working directory and environment of the
+// test process
+func TestWithJobEnvironment(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+
+	sh := shell.NewTestShell(t)
+	assert.NoError(t, sh.Chdir(dir))
+	sh.Env.Set("BUILDKITE_TEST_WITH_JOB_ENVIRONMENT", "llamas")
+
+	err = withJobEnvironment(sh, func() error {
+		got, err := os.Getwd()
+		assert.NoError(t, err)
+		assert.Equal(t, dir, got)
+		assert.Equal(t, "llamas", os.Getenv("BUILDKITE_TEST_WITH_JOB_ENVIRONMENT"))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	got, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.Equal(t, wd, got)
+
+	_, ok := os.LookupEnv("BUILDKITE_TEST_WITH_JOB_ENVIRONMENT")
+	assert.False(t, ok)
+}
+
+func TestInProcessArtifactUploaderConfig(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("BUILDKITE_ARTIFACT_POST_PROCESSORS", "*.log=gzip;dist/**/*=sign")
+	sh.Env.Set("BUILDKITE_ARTIFACT_SIGNING_KEY", "/etc/buildkite/signing.key")
+	sh.Env.Set("BUILDKITE_ARTIFACT_ENCRYPTION_KEY_FILE", "/etc/buildkite/artifacts.key")
+	sh.Env.Set("BUILDKITE_ARTIFACT_NAME_TEMPLATE", "{{.Path}}-{{.Os}}-{{.Arch}}")
+	sh.Env.Set("BUILDKITE_ARTIFACT_ALLOW_FAILURES", "10%")
+
+	u := &inProcessArtifactUploader{shell: sh, jobID: "llamas"}
+	cfg, err := u.config("llamas/*.txt", "s3://bucket/path")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "llamas", cfg.JobID)
+	assert.Equal(t, "llamas/*.txt", cfg.Paths)
+	assert.Equal(t, "s3://bucket/path", cfg.Destination)
+	assert.Equal(t, "*.log=gzip;dist/**/*=sign", cfg.PostProcessors)
+	assert.Equal(t, "/etc/buildkite/signing.key", cfg.SigningKeyPath)
+	assert.Equal(t, "/etc/buildkite/artifacts.key", cfg.EncryptionKeyPath)
+	assert.Equal(t, "{{.Path}}-{{.Os}}-{{.Arch}}", cfg.NameTemplate)
+	assert.Equal(t, agent.FailureThreshold{Percent: 10}, cfg.AllowFailures)
+
+	sh.Env.Set("BUILDKITE_ARTIFACT_ALLOW_FAILURES", "lots")
+	_, err = u.config("llamas/*.txt", "")
+	assert.Error(t, err)
+}
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/agent/plugin"
@@ -44,6 +45,9 @@ type Bootstrap struct {
 	// Shell is the shell environment for the bootstrap
 	shell *shell.Shell
 
+	// How artifacts are uploaded at the end of the job
+	artifactUploader ArtifactUploader
+
 	// Plugins to use
 	plugins []*plugin.Plugin
 
@@ -55,13 +59,31 @@ type Bootstrap struct {
 
 	// A channel to track cancellation
 	cancelCh chan struct{}
+
+	// Closed once the job has been cancelled, for the job API
+	cancelled chan struct{}
+
+	// Values to redact that were added through the job API, and the
+	// redactors currently wrapping the job's output
+	redactionMtx    sync.Mutex
+	redactedValues  []string
+	redactors       redaction.RedactorMux
+	alwaysRedacting bool
+
+	// Uploads of artifacts requested through the job API happen one at a
+	// time
+	jobAPIArtifactsMtx sync.Mutex
+
+	// When each phase of the job started and finished
+	phaseTimings phaseTimings
 }
 
 // New returns a new Bootstrap instance
 func New(conf Config) *Bootstrap {
 	return &Bootstrap{
-		Config:   conf,
-		cancelCh: make(chan struct{}),
+		Config:    conf,
+		cancelCh:  make(chan struct{}),
+		cancelled: make(chan struct{}),
 	}
 }
 
@@ -79,6 +101,16 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		b.shell.PTY = b.Config.RunInPty
 		b.shell.Debug = b.Config.Debug
 		b.shell.InterruptSignal = b.Config.CancelSignal
+		b.shell.SignalTarget = b.Config.CancelSignalTarget
+	}
+
+	// Check if not nil to allow for tests to overwrite the artifact uploader
+	if b.artifactUploader == nil {
+		if experiments.IsEnabled(experiments.InProcessArtifactUpload) {
+			b.artifactUploader = &inProcessArtifactUploader{shell: b.shell, jobID: b.JobID}
+		} else {
+			b.artifactUploader = &shellArtifactUploader{shell: b.shell}
+		}
 	}
 	if experiments.IsEnabled(experiments.KubernetesExec) {
 		kubernetesClient := &kubernetes.Client{}
@@ -115,6 +147,7 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 
 		case <-b.cancelCh:
 			b.shell.Commentf("Received cancellation signal, interrupting")
+			close(b.cancelled)
 			b.shell.Interrupt()
 			cancel()
 		}
@@ -142,8 +175,15 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}()
 
+	// Summarise where the job spent its time once it's done, before the
+	// pre-exit hooks
+	defer b.annotatePhaseTimings(ctx)
+
 	// Initialize the environment, a failure here will still call the tearDown
-	if err = b.setUp(ctx); err != nil {
+	endPhase := b.phaseTimings.start("environment")
+	err = b.setUp(ctx)
+	endPhase()
+	if err != nil {
 		b.shell.Errorf("Error setting up bootstrap: %v", err)
 		return shell.GetExitCode(err)
 	}
@@ -164,15 +204,19 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	var phaseErr error
 
 	if includePhase("plugin") {
+		endPhase := b.phaseTimings.start("plugin")
 		phaseErr = b.preparePlugins()
 
 		if phaseErr == nil {
 			phaseErr = b.PluginPhase(ctx)
 		}
+		endPhase()
 	}
 
 	if phaseErr == nil && includePhase("checkout") {
+		endPhase := b.phaseTimings.start("checkout")
 		phaseErr = b.CheckoutPhase(cancelCtx)
+		endPhase()
 	} else {
 		checkoutDir, exists := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 		if exists {
@@ -181,12 +225,19 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	}
 
 	if phaseErr == nil && includePhase("plugin") {
+		endPhase := func() {}
+		if b.hasVendoredPlugins() {
+			endPhase = b.phaseTimings.start("vendored-plugin")
+		}
 		phaseErr = b.VendoredPluginPhase(ctx)
+		endPhase()
 	}
 
 	if phaseErr == nil && includePhase("command") {
 		var commandErr error
+		endPhase := b.phaseTimings.start("command")
 		phaseErr, commandErr = b.CommandPhase(ctx)
+		endPhase()
 		/*
 			Five possible states at this point:
 
@@ -212,7 +263,10 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 
 		// Only upload artifacts as part of the command phase
-		if err = b.artifactPhase(ctx); err != nil {
+		endPhase = b.phaseTimings.start("artifact")
+		err = b.artifactPhase(ctx)
+		endPhase()
+		if err != nil {
 			b.shell.Errorf("%v", err)
 
 			if commandErr != nil {
@@ -391,8 +445,10 @@ func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, reda
 	b.shell.Env.Apply(changes.Diff)
 
 	// reset output redactors based on new environment variable values
+	b.redactionMtx.Lock()
 	redactors.Flush()
-	redactors.Reset(redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, b.shell.Env.Dump()))
+	redactors.Reset(b.valuesToRedact())
+	b.redactionMtx.Unlock()
 
 	// First, let see any of the environment variables are supposed
 	// to change the bootstrap configuration at run time.
@@ -623,6 +679,15 @@ func (b *Bootstrap) hasPlugins() bool {
 	return b.Config.Plugins != ""
 }
 
+func (b *Bootstrap) hasVendoredPlugins() bool {
+	for _, p := range b.plugins {
+		if p.Vendored {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Bootstrap) preparePlugins() error {
 	if !b.hasPlugins() {
 		return nil
@@ -1063,11 +1128,19 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		}
 	default:
 		if b.Config.Repository != "" {
-			err := roko.NewRetrier(
-				roko.WithMaxAttempts(3),
-				roko.WithStrategy(roko.Constant(2*time.Second)),
-			).DoWithContext(ctx, func(r *roko.Retrier) error {
-				err := b.defaultCheckoutPhase(ctx)
+			remotes := b.checkoutRemotes()
+			retrier, err := b.checkoutRetrier(len(remotes))
+			if err != nil {
+				return err
+			}
+			cleanOn, err := b.checkoutCleanOn()
+			if err != nil {
+				return err
+			}
+
+			remote := 0
+			err = retrier.DoWithContext(ctx, func(r *roko.Retrier) error {
+				err := b.defaultCheckoutPhase(ctx, remotes[remote])
 				if err == nil {
 					return nil
 				}
@@ -1088,18 +1161,15 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 				default:
 					b.shell.Warningf("Checkout failed! %s (%s)", err, r)
 
+					// Try the next remote if this one couldn't be reached
+					if isGitRemoteError(err) && len(remotes) > 1 {
+						remote = (remote + 1) % len(remotes)
+						b.shell.Commentf("Trying %s next", remotes[remote])
+					}
+
 					// Specifically handle git errors
-					if ge, ok := err.(*gitError); ok {
-						switch ge.Type {
-						// These types can fail because of corrupted checkouts
-						case gitErrorClone:
-						case gitErrorClean:
-						case gitErrorCleanSubmodules:
-							// do nothing, this will fall through to destroy the checkout
-
-						default:
-							return err
-						}
+					if ge, ok := err.(*gitError); ok && !cleanOn[ge.Type] {
+						return err
 					}
 
 					// Checkout can fail because of corrupted files in the checkout
@@ -1297,8 +1367,9 @@ func (b *Bootstrap) getOrUpdateMirrorDir(ctx context.Context, repository string)
 }
 
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
-// hook exists. It performs the default checkout on the Repository provided in the config
-func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
+// hook exists. It performs the default checkout on the Repository provided in the config,
+// cloning and fetching from remote, which is the Repository unless it's being fallen back from
+func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context, remote string) error {
 	span, _ := tracetools.StartSpanFromContext(ctx, "repo-checkout", b.Config.TracingBackend)
 	span.AddAttributes(map[string]string{
 		"checkout.repo_name": b.Repository,
@@ -1309,13 +1380,21 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	defer func() { span.FinishWithError(err) }()
 
 	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(ctx, b.shell, b.Repository)
+		addRepositoryHostToSSHKnownHosts(ctx, b.shell, remote)
+	}
+
+	// Leave LFS files as pointers, so only the ones the job asks for are
+	// downloaded
+	if b.GitLFSSkipSmudge && !b.shell.Env.Exists("GIT_LFS_SKIP_SMUDGE") {
+		b.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", "1")
+		defer b.shell.Env.Remove("GIT_LFS_SKIP_SMUDGE")
 	}
 
 	var mirrorDir string
 
-	// If we can, get a mirror of the git repository to use for reference later
-	if experiments.IsEnabled(`git-mirrors`) && b.Config.GitMirrorsPath != "" && b.Config.Repository != "" {
+	// If we can, get a mirror of the git repository to use for reference later.
+	// Fallback remotes are used directly, as the mirror is of the repository.
+	if experiments.IsEnabled(`git-mirrors`) && b.Config.GitMirrorsPath != "" && b.Config.Repository != "" && remote == b.Repository {
 		b.shell.Commentf("Using git-mirrors experiment 🧪")
 		span.AddAttributes(map[string]string{"checkout.is_using_git_mirrors": "true"})
 		mirrorDir, err = b.getOrUpdateMirrorDir(ctx, b.Repository)
@@ -1336,19 +1415,34 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
 	}
 
+	// Share a repository with the pipeline's other checkouts on this host,
+	// which stays locked until the commit's been fetched into it
+	var repositoryLock shell.LockFile
+	if b.useWorktree(remote) {
+		repositoryLock, err = b.setUpWorktree(ctx)
+		if err != nil {
+			return err
+		}
+		defer repositoryLock.Unlock()
+	}
+
 	// Does the git directory exist?
 	existingGitDir := filepath.Join(b.shell.Getwd(), ".git")
 	if utils.FileExists(existingGitDir) {
 		// Update the origin of the repository so we can gracefully handle repository renames
-		if err := b.shell.Run(ctx, "git", "remote", "set-url", "origin", b.Repository); err != nil {
+		if err := b.shell.Run(ctx, "git", "remote", "set-url", "origin", remote); err != nil {
 			return err
 		}
 	} else {
-		if err := gitClone(ctx, b.shell, gitCloneFlags, b.Repository, "."); err != nil {
+		if err := gitClone(ctx, b.shell, gitCloneFlags, remote, "."); err != nil {
 			return err
 		}
 	}
 
+	if remote != b.Repository {
+		b.shell.Commentf("Checking out from %s, as %s couldn't be used", remote, b.Repository)
+	}
+
 	// Git clean prior to checkout, we do this even if submodules have been
 	// disabled to ensure previous submodules are cleaned up
 	if hasGitSubmodules(b.shell) {
@@ -1410,6 +1504,10 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if repositoryLock != nil {
+		repositoryLock.Unlock()
+	}
+
 	gitCheckoutFlags := b.GitCheckoutFlags
 
 	if b.Commit == "HEAD" {
@@ -1422,6 +1520,13 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if len(b.GitLFSInclude) > 0 {
+		b.shell.Commentf("Downloading LFS files matching %s", strings.Join(b.GitLFSInclude, ", "))
+		if err := gitLFSPull(ctx, b.shell, b.GitLFSInclude); err != nil {
+			return err
+		}
+	}
+
 	var gitSubmodules bool
 	if !b.GitSubmodules && hasGitSubmodules(b.shell) {
 		b.shell.Warningf("This repository has submodules, but submodules are disabled at an agent level")
@@ -1444,6 +1549,13 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		for _, config := range b.GitSubmoduleCloneConfig {
 			args = append(args, "-c", config)
 		}
+
+		restoreEnv, err := b.withSubmoduleCredentials()
+		if err != nil {
+			return err
+		}
+		defer restoreEnv()
+
 		// Checking for submodule repositories
 		submoduleRepos, err := gitEnumerateSubmoduleURLs(ctx, b.shell)
 		if err != nil {
@@ -1473,10 +1585,10 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 						repositoryPath = repository
 					}
 					if mirrorDir != "" {
-						submoduleArgs = append(submoduleArgs, "submodule", "update", "--init", "--recursive", "--force", "--reference", repositoryPath)
+						submoduleArgs = append(submoduleArgs, b.submoduleUpdateArgs("--reference", repositoryPath)...)
 					} else {
 						// Fall back to a clean update, rather than failing the checkout and therefore the build
-						submoduleArgs = append(submoduleArgs, "submodule", "update", "--init", "--recursive", "--force")
+						submoduleArgs = append(submoduleArgs, b.submoduleUpdateArgs()...)
 					}
 					if err := b.shell.Run(ctx, "git", submoduleArgs...); err != nil {
 						return err
@@ -1485,7 +1597,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 			}
 
 			if !mirrorSubmodules {
-				args = append(args, "submodule", "update", "--init", "--recursive", "--force")
+				args = append(args, b.submoduleUpdateArgs()...)
 				if err := b.shell.Run(ctx, "git", args...); err != nil {
 					return err
 				}
@@ -1511,6 +1623,14 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	// Point origin back at the repository after checking out from a fallback,
+	// so the job doesn't push to it
+	if remote != b.Repository {
+		if err := b.shell.Run(ctx, "git", "remote", "set-url", "origin", b.Repository); err != nil {
+			return err
+		}
+	}
+
 	if _, hasToken := b.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN"); !hasToken {
 		b.shell.Warningf("Skipping sending Git information to Buildkite as $BUILDKITE_AGENT_ACCESS_TOKEN is missing")
 		return nil
@@ -1636,6 +1756,12 @@ func (b *Bootstrap) CommandPhase(ctx context.Context) (error, error) {
 	span, ctx := tracetools.StartSpanFromContext(ctx, "command", b.Config.TracingBackend)
 	var err error
 	defer func() { span.FinishWithError(err) }()
+
+	// Set up the toolchain the step asks for
+	if err := b.provisionEnvironment(ctx); err != nil {
+		return err, nil
+	}
+
 	// Run pre-command hooks
 	if err := b.runPreCommandHooks(ctx); err != nil {
 		return err, nil
@@ -1796,6 +1922,18 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 		return err
 	}
 
+	// Run the command in a container, if the step asks for one
+	if c, ok := newContainerStep(b.shell.Env, b.shell.Getwd()); ok {
+		if experiments.IsEnabled(experiments.ContainerSteps) {
+			redactors := b.setupRedactors()
+			defer redactors.Flush()
+
+			err = runContainerCommand(ctx, b.shell, c, cmdToExec)
+			return err
+		}
+		b.shell.Warningf("BUILDKITE_CONTAINER_IMAGE is set, but the %s experiment isn't enabled, so the command will run on the agent instead of in %s", experiments.ContainerSteps, c.image)
+	}
+
 	// If we aren't running a script, try and detect if we are using a posix shell
 	// and if so add a trap so that the intermediate shell doesn't swallow signals
 	// from cancellation
@@ -1937,14 +2075,8 @@ func (b *Bootstrap) uploadArtifacts(ctx context.Context) error {
 	defer func() { span.FinishWithError(err) }()
 
 	b.shell.Headerf("Uploading artifacts")
-	args := []string{"artifact", "upload", b.AutomaticArtifactUploadPaths}
 
-	// If blank, the upload destination is buildkite
-	if b.ArtifactUploadDestination != "" {
-		args = append(args, b.ArtifactUploadDestination)
-	}
-
-	if err = b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
+	if err = b.artifactUploader.UploadArtifacts(ctx, b.AutomaticArtifactUploadPaths, b.ArtifactUploadDestination); err != nil {
 		return err
 	}
 
@@ -1992,8 +2124,15 @@ func (b *Bootstrap) ignoredEnv() []string {
 // matching environment vars.
 // redaction.RedactorMux (possibly empty) is returned so the caller can `defer redactor.Flush()`
 func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
-	valuesToRedact := redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, b.shell.Env.Dump())
-	if len(valuesToRedact) == 0 {
+	b.redactionMtx.Lock()
+	defer b.redactionMtx.Unlock()
+
+	valuesToRedact := b.valuesToRedact()
+
+	// When values can be added through the job API while a hook or command
+	// is running, the output has to be wrapped in redactors from the start,
+	// even if there's nothing to redact yet
+	if len(valuesToRedact) == 0 && !b.alwaysRedacting {
 		return nil
 	}
 
@@ -2007,8 +2146,6 @@ func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
 	if redactor, ok := b.shell.Writer.(*redaction.Redactor); ok {
 		redactor.Reset(valuesToRedact)
 		mux = append(mux, redactor)
-	} else if len(valuesToRedact) == 0 {
-		// skip
 	} else {
 		redactor := redaction.NewRedactor(b.shell.Writer, "[REDACTED]", valuesToRedact)
 		b.shell.Writer = redactor
@@ -2029,17 +2166,38 @@ func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
 	if redactor := shellLoggerRedactor; redactor != nil {
 		redactor.Reset(valuesToRedact)
 		mux = append(mux, redactor)
-	} else if len(valuesToRedact) == 0 {
-		// skip
 	} else if shellWriterLogger != nil {
 		redactor := redaction.NewRedactor(b.shell.Writer, "[REDACTED]", valuesToRedact)
 		shellWriterLogger.Writer = redactor
 		mux = append(mux, redactor)
 	}
 
+	b.redactors = mux
 	return mux
 }
 
+// valuesToRedact returns the values of environment variables matching
+// RedactedVars, and any values added through the job API. It must be called
+// with redactionMtx held.
+func (b *Bootstrap) valuesToRedact() []string {
+	values := redaction.GetValuesToRedact(b.shell, b.Config.RedactedVars, b.shell.Env.Dump())
+	return append(values, b.redactedValues...)
+}
+
+// addRedactedValues redacts values from the job log from now on, including
+// the output of the hook or command that's running.
+func (b *Bootstrap) addRedactedValues(values []string) {
+	b.redactionMtx.Lock()
+	defer b.redactionMtx.Unlock()
+
+	b.redactedValues = append(b.redactedValues, values...)
+
+	// Anything held back by the redactors in case it was the start of a
+	// secret is written out before the new values apply
+	_ = b.redactors.Flush()
+	b.redactors.Reset(b.valuesToRedact())
+}
+
 type pluginCheckout struct {
 	*plugin.Plugin
 	*plugin.Definition
@@ -0,0 +1,111 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/roko"
+)
+
+const (
+	// How many times the checkout is tried, if it isn't configured
+	defaultCheckoutAttempts = 3
+
+	// How long to wait between checkout attempts, if it isn't configured
+	defaultCheckoutRetryInterval = 2 * time.Second
+)
+
+// The failed git commands that remove the checkout before it's tried again,
+// if it isn't configured, as they can fail because the checkout is corrupt
+var defaultCheckoutCleanOn = []string{"clone", "clean", "clean-submodules"}
+
+// gitErrorNames are the names the failed git commands are configured with
+var gitErrorNames = map[string]int{
+	"checkout":         gitErrorCheckout,
+	"clone":            gitErrorClone,
+	"fetch":            gitErrorFetch,
+	"clean":            gitErrorClean,
+	"clean-submodules": gitErrorCleanSubmodules,
+}
+
+// checkoutRetrier returns a retrier for the default checkout, which tries
+// each of the remotes at least once
+func (b *Bootstrap) checkoutRetrier(remotes int) (*roko.Retrier, error) {
+	attempts := b.GitCheckoutRetries
+	if attempts <= 0 {
+		attempts = defaultCheckoutAttempts
+	}
+	if attempts < remotes {
+		attempts = remotes
+	}
+
+	strategy, interval := agent.RetryStrategyConstant, time.Duration(0)
+	if b.GitCheckoutRetryBackoff != "" {
+		var err error
+		strategy, interval, err = agent.ParseRetryBackoff(b.GitCheckoutRetryBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkout retry backoff: %w", err)
+		}
+	}
+	if interval == 0 {
+		interval = defaultCheckoutRetryInterval
+	}
+
+	if strategy == agent.RetryStrategyExponential {
+		return roko.NewRetrier(
+			roko.WithMaxAttempts(attempts),
+			roko.WithStrategy(roko.Exponential(interval, 0)),
+		), nil
+	}
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(attempts),
+		roko.WithStrategy(roko.Constant(interval)),
+	), nil
+}
+
+// checkoutCleanOn returns the failed git commands that remove the checkout
+// before it's tried again
+func (b *Bootstrap) checkoutCleanOn() (map[int]bool, error) {
+	names := b.GitCheckoutCleanOn
+	if len(names) == 0 {
+		names = defaultCheckoutCleanOn
+	}
+
+	cleanOn := map[int]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "none" {
+			continue
+		}
+		errType, ok := gitErrorNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid git command %q to clean the checkout on, expected checkout, clone, fetch, clean, clean-submodules or none", name)
+		}
+		cleanOn[errType] = true
+		if errType == gitErrorCheckout {
+			cleanOn[gitErrorCheckoutReferenceIsNotATree] = true
+		}
+	}
+	return cleanOn, nil
+}
+
+// checkoutRemotes returns the repository, followed by the remotes to fall
+// back to if it can't be cloned or fetched from
+func (b *Bootstrap) checkoutRemotes() []string {
+	remotes := []string{b.Repository}
+	for _, remote := range b.GitRemoteFallbacks {
+		if remote = strings.TrimSpace(remote); remote != "" && remote != b.Repository {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+// isGitRemoteError returns whether the checkout failed talking to the remote,
+// so another remote might work
+func isGitRemoteError(err error) bool {
+	ge, ok := err.(*gitError)
+	return ok && (ge.Type == gitErrorClone || ge.Type == gitErrorFetch)
+}
@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/buildkite/roko"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckoutCleanOn(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		cleanOn []string
+		want    map[int]bool
+		wantErr bool
+	}{
+		{
+			cleanOn: nil,
+			want:    map[int]bool{gitErrorClone: true, gitErrorClean: true, gitErrorCleanSubmodules: true},
+		},
+		{
+			cleanOn: []string{"fetch", " checkout"},
+			want:    map[int]bool{gitErrorFetch: true, gitErrorCheckout: true, gitErrorCheckoutReferenceIsNotATree: true},
+		},
+		{
+			cleanOn: []string{"none"},
+			want:    map[int]bool{},
+		},
+		{
+			cleanOn: []string{"push"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		b := New(Config{GitCheckoutCleanOn: test.cleanOn})
+		got, err := b.checkoutCleanOn()
+		if (err != nil) != test.wantErr {
+			t.Errorf("checkoutCleanOn() with %q error = %v, want error %t", test.cleanOn, err, test.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); !test.wantErr && diff != "" {
+			t.Errorf("checkoutCleanOn() with %q diff (-want +got):\n%s", test.cleanOn, diff)
+		}
+	}
+}
+
+func TestCheckoutRemotes(t *testing.T) {
+	t.Parallel()
+
+	b := New(Config{
+		Repository:         "git@github.com:buildkite/agent.git",
+		GitRemoteFallbacks: []string{"https://mirror.example.com/agent.git", "", "git@github.com:buildkite/agent.git"},
+	})
+
+	want := []string{"git@github.com:buildkite/agent.git", "https://mirror.example.com/agent.git"}
+	if diff := cmp.Diff(want, b.checkoutRemotes()); diff != "" {
+		t.Errorf("checkoutRemotes() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckoutRetrier(t *testing.T) {
+	t.Parallel()
+
+	// Every remote gets tried, even if that's more than the retries
+	b := New(Config{GitCheckoutRetries: 2, GitCheckoutRetryBackoff: "exponential:1s"})
+	r, err := b.checkoutRetrier(3)
+	if err != nil {
+		t.Fatalf("checkoutRetrier(3) error = %v", err)
+	}
+	attempts := 0
+	_ = r.Do(func(r *roko.Retrier) error {
+		attempts++
+		r.SetNextInterval(0)
+		return errors.New("checkout failed")
+	})
+	if got, want := attempts, 3; got != want {
+		t.Errorf("checkoutRetrier(3) made %d attempts, want %d", got, want)
+	}
+
+	b = New(Config{GitCheckoutRetryBackoff: "linear"})
+	if _, err := b.checkoutRetrier(1); err == nil {
+		t.Errorf("checkoutRetrier(1) with linear backoff error = nil, want an error")
+	}
+}
+
+func TestIsGitRemoteError(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&gitError{error: errors.New("clone failed"), Type: gitErrorClone}, true},
+		{&gitError{error: errors.New("fetch failed"), Type: gitErrorFetch}, true},
+		{&gitError{error: errors.New("clean failed"), Type: gitErrorClean}, false},
+		{errors.New("something else"), false},
+	} {
+		if got := isGitRemoteError(test.err); got != test.want {
+			t.Errorf("isGitRemoteError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// Checkout layouts
+const (
+	// Each agent clones the repository into its own checkout
+	checkoutLayoutClone = "clone"
+
+	// The agents on a host share a bare repository for each pipeline, and
+	// each agent's checkout is a worktree of it
+	checkoutLayoutWorktree = "worktree"
+)
+
+// ValidateCheckoutLayout returns an error if the layout isn't one there is
+func ValidateCheckoutLayout(layout string) error {
+	switch layout {
+	case "", checkoutLayoutClone, checkoutLayoutWorktree:
+		return nil
+	default:
+		return fmt.Errorf("%q isn't a checkout layout, expected %s or %s", layout, checkoutLayoutClone, checkoutLayoutWorktree)
+	}
+}
+
+// worktreeRepositoryDir is where the bare repository of the pipeline is kept,
+// which is shared by the agents on the host
+func (b *Bootstrap) worktreeRepositoryDir() string {
+	return filepath.Join(b.BuildPath, "repositories", b.OrganizationSlug, b.PipelineSlug+".git")
+}
+
+// useWorktree returns whether to check out remote as a worktree
+func (b *Bootstrap) useWorktree(remote string) bool {
+	if b.GitCheckoutLayout != checkoutLayoutWorktree {
+		return false
+	}
+	if b.BuildPath == "" {
+		b.shell.Warningf("The worktree checkout layout needs a build path, so the repository will be cloned")
+		return false
+	}
+	// Fallback remotes are cloned, as the shared repository is of the
+	// repository
+	return remote == b.Repository
+}
+
+// setUpWorktree makes sure the pipeline's bare repository exists, and that
+// the checkout directory is a worktree of it. It returns with the repository
+// locked, so jobs on other agents don't fetch into it at the same time, and
+// the lock must be released once the job has fetched.
+func (b *Bootstrap) setUpWorktree(ctx context.Context) (shell.LockFile, error) {
+	repoDir := b.worktreeRepositoryDir()
+	if err := os.MkdirAll(filepath.Dir(repoDir), 0777); err != nil {
+		return nil, err
+	}
+
+	if b.Debug {
+		b.shell.Commentf("Acquiring shared repository lock")
+	}
+	lock, err := b.shell.LockFile(ctx, repoDir+".lock", time.Second*time.Duration(b.GitMirrorsLockTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.addWorktree(ctx, repoDir); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (b *Bootstrap) addWorktree(ctx context.Context, repoDir string) error {
+	if !utils.FileExists(repoDir) {
+		b.shell.Commentf("Cloning a bare repository shared by this pipeline's checkouts to %q", repoDir)
+		if err := gitClone(ctx, b.shell, "--bare "+b.GitCloneMirrorFlags, b.Repository, repoDir); err != nil {
+			if err := os.RemoveAll(repoDir); err != nil {
+				b.shell.Errorf("Failed to remove \"%s\" (%s)", repoDir, err)
+			}
+			return err
+		}
+
+		// Bare clones don't fetch branches unless they're told to
+		if err := b.shell.Run(ctx, "git", "--git-dir", repoDir, "config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return err
+		}
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	if utils.FileExists(filepath.Join(checkoutPath, ".git")) {
+		return nil
+	}
+
+	// Forget worktrees whose checkouts have been removed, so a new one can be
+	// added in their place
+	if err := b.shell.Run(ctx, "git", "--git-dir", repoDir, "worktree", "prune"); err != nil {
+		return err
+	}
+
+	b.shell.Commentf("Adding a worktree of %q at %q", repoDir, checkoutPath)
+	return b.shell.Run(ctx, "git", "--git-dir", repoDir, "worktree", "add", "--detach", "--force", checkoutPath)
+}
@@ -86,6 +86,41 @@ type Config struct {
 	// Flags to pass to "git clean" command
 	GitCleanFlags string `env:"BUILDKITE_GIT_CLEAN_FLAGS"`
 
+	// How many times to try the checkout, which is at least once for each
+	// remote
+	GitCheckoutRetries int
+
+	// How long to wait between checkout attempts, such as "constant:2s" or
+	// "exponential:2s"
+	GitCheckoutRetryBackoff string
+
+	// Which failed git commands remove the checkout before it's tried again,
+	// such as "clone" or "fetch"
+	GitCheckoutCleanOn []string
+
+	// Remotes to clone and fetch from, in order, when the repository can't be
+	GitRemoteFallbacks []string
+
+	// How checkouts are laid out: "clone" for a clone of the repository in
+	// each, or "worktree" for worktrees of a bare repository shared by the
+	// pipeline's checkouts on the host
+	GitCheckoutLayout string
+
+	// How to authenticate to the submodules on each host, such as
+	// "github.com=https-token-env:GITHUB_TOKEN" or "example.com=ssh-key:PATH"
+	GitSubmoduleCredentials []string
+
+	// How many submodules to update at once
+	GitSubmoduleConcurrency int
+
+	// Whether to leave LFS files as pointers when checking out, rather than
+	// downloading them
+	GitLFSSkipSmudge bool
+
+	// Patterns of LFS files to download after checking out, such as
+	// "assets/*.png"
+	GitLFSInclude []string
+
 	// Config key=value pairs to pass to "git" when submodule init commands are invoked
 	GitSubmoduleCloneConfig []string `env:"BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG" normalize:"list"`
 
@@ -137,6 +172,9 @@ type Config struct {
 	// A custom destination to upload artifacts to (for example, s3://...)
 	ArtifactUploadDestination string `env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 
+	// Whether to annotate the build with how long each phase of the job took
+	PhaseTimingsAnnotation bool `env:"BUILDKITE_PHASE_TIMINGS_ANNOTATION"`
+
 	// Whether ssh-keyscan is run on ssh hosts before checkout
 	SSHKeyscan bool
 
@@ -149,6 +187,9 @@ type Config struct {
 	// What signal to use for command cancellation
 	CancelSignal process.Signal
 
+	// Which processes to signal for command cancellation
+	CancelSignalTarget process.SignalTarget
+
 	// List of environment variable globs to redact from job output
 	RedactedVars []string
 
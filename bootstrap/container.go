@@ -0,0 +1,128 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+)
+
+// containerWorkdir is where the checkout is mounted in step containers
+const containerWorkdir = "/workdir"
+
+// containerEnvDenylist is environment that isn't passed into step containers,
+// either because it's specific to the host or it's a secret the container
+// doesn't need
+var containerEnvDenylist = map[string]struct{}{
+	"BUILDKITE_AGENT_ACCESS_TOKEN": {},
+	"BUILDKITE_BIN_PATH":           {},
+	"BUILDKITE_BUILD_PATH":         {},
+	"BUILDKITE_CONFIG_PATH":        {},
+	"BUILDKITE_ENV_FILE":           {},
+	"BUILDKITE_GIT_MIRRORS_PATH":   {},
+	"BUILDKITE_HOOKS_PATH":         {},
+	"BUILDKITE_PLUGINS_PATH":       {},
+	"BUILDKITE_SOCKETS_PATH":       {},
+}
+
+// containerStep is a step whose command runs in a container
+type containerStep struct {
+	// The image to run the command in, from BUILDKITE_CONTAINER_IMAGE
+	image string
+
+	// The shell to run the command with, from BUILDKITE_CONTAINER_SHELL
+	shell []string
+
+	// Extra environment variables to pass into the container, from
+	// BUILDKITE_CONTAINER_ENV
+	env []string
+
+	// Whether to pull the image first, unless BUILDKITE_CONTAINER_PULL is
+	// false
+	pull bool
+
+	name     string
+	checkout string
+}
+
+// newContainerStep returns the container step the environment describes, or
+// false if the step doesn't run in a container
+func newContainerStep(environ *env.Environment, checkout string) (containerStep, bool) {
+	image, _ := environ.Get("BUILDKITE_CONTAINER_IMAGE")
+	if image == "" {
+		return containerStep{}, false
+	}
+
+	jobID, _ := environ.Get("BUILDKITE_JOB_ID")
+	c := containerStep{
+		image:    image,
+		shell:    []string{"/bin/sh", "-e", "-c"},
+		pull:     environ.GetBool("BUILDKITE_CONTAINER_PULL", true),
+		name:     fmt.Sprintf("buildkite_%s_step", jobID),
+		checkout: checkout,
+	}
+
+	if sh, _ := environ.Get("BUILDKITE_CONTAINER_SHELL"); sh != "" {
+		c.shell = strings.Fields(sh)
+	}
+
+	if names, _ := environ.Get("BUILDKITE_CONTAINER_ENV"); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.env = append(c.env, name)
+			}
+		}
+	}
+
+	return c, true
+}
+
+// runArgs returns the arguments to docker to run the command in the
+// container. Environment variables are passed by name, so their values are
+// taken from the environment docker runs with rather than being shown in the
+// job log.
+func (c containerStep) runArgs(environ *env.Environment, command string) []string {
+	args := []string{
+		"run", "--rm", "--init",
+		"--name", c.name,
+		"--volume", c.checkout + ":" + containerWorkdir,
+		"--workdir", containerWorkdir,
+	}
+
+	var names []string
+	for name := range environ.Dump() {
+		if _, denied := containerEnvDenylist[name]; denied {
+			continue
+		}
+		if name == "CI" || strings.HasPrefix(name, "BUILDKITE") {
+			names = append(names, name)
+		}
+	}
+	names = append(names, c.env...)
+	sort.Strings(names)
+
+	for _, name := range names {
+		args = append(args, "--env", name)
+	}
+
+	args = append(args, c.image)
+	args = append(args, c.shell...)
+	return append(args, command)
+}
+
+// runContainerCommand pulls the step's image, then runs the command in a
+// container with the checkout mounted as its working directory
+func runContainerCommand(ctx context.Context, sh *shell.Shell, c containerStep, command string) error {
+	if c.pull {
+		sh.Headerf(":docker: Pulling %s", c.image)
+		if err := sh.Run(ctx, "docker", "pull", c.image); err != nil {
+			return fmt.Errorf("Failed to pull %s: %w", c.image, err)
+		}
+	}
+
+	sh.Headerf(":docker: Running command in %s", c.image)
+	return sh.Run(ctx, "docker", c.runArgs(sh.Env, command)...)
+}
@@ -0,0 +1,63 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewContainerStep(t *testing.T) {
+	_, ok := newContainerStep(env.FromMap(map[string]string{"BUILDKITE_JOB_ID": "1234"}), "/builds/checkout")
+	assert.False(t, ok, "steps without an image don't run in a container")
+
+	c, ok := newContainerStep(env.FromMap(map[string]string{
+		"BUILDKITE_JOB_ID":          "1234",
+		"BUILDKITE_CONTAINER_IMAGE": "golang:1.20",
+		"BUILDKITE_CONTAINER_SHELL": "/bin/bash -e -c",
+		"BUILDKITE_CONTAINER_ENV":   "GOFLAGS, GOPROXY",
+		"BUILDKITE_CONTAINER_PULL":  "false",
+	}), "/builds/checkout")
+	assert.True(t, ok)
+	assert.Equal(t, containerStep{
+		image:    "golang:1.20",
+		shell:    []string{"/bin/bash", "-e", "-c"},
+		env:      []string{"GOFLAGS", "GOPROXY"},
+		pull:     false,
+		name:     "buildkite_1234_step",
+		checkout: "/builds/checkout",
+	}, c)
+}
+
+func TestContainerStepRunArgs(t *testing.T) {
+	environ := env.FromMap(map[string]string{
+		"BUILDKITE_JOB_ID":             "1234",
+		"BUILDKITE_BRANCH":             "main",
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "secret",
+		"BUILDKITE_BUILD_PATH":         "/var/lib/buildkite-agent/builds",
+		"CI":                           "true",
+		"PATH":                         "/usr/local/bin:/usr/bin",
+		"GOFLAGS":                      "-mod=mod",
+	})
+
+	c := containerStep{
+		image:    "golang:1.20",
+		shell:    []string{"/bin/sh", "-e", "-c"},
+		env:      []string{"GOFLAGS"},
+		name:     "buildkite_1234_step",
+		checkout: "/builds/checkout",
+	}
+
+	assert.Equal(t, []string{
+		"run", "--rm", "--init",
+		"--name", "buildkite_1234_step",
+		"--volume", "/builds/checkout:/workdir",
+		"--workdir", "/workdir",
+		"--env", "BUILDKITE_BRANCH",
+		"--env", "BUILDKITE_JOB_ID",
+		"--env", "CI",
+		"--env", "GOFLAGS",
+		"golang:1.20",
+		"/bin/sh", "-e", "-c", "go test ./...",
+	}, c.runArgs(environ, "go test ./..."))
+}
@@ -133,6 +133,12 @@ func gitFetch(ctx context.Context, sh shellRunner, gitFetchFlags, repository str
 	return nil
 }
 
+// gitLFSPull downloads the LFS objects of the files matching the patterns,
+// and puts them in the working tree
+func gitLFSPull(ctx context.Context, sh shellRunner, include []string) error {
+	return sh.Run(ctx, "git", "lfs", "pull", "--include", strings.Join(include, ","))
+}
+
 func gitEnumerateSubmoduleURLs(ctx context.Context, sh *shell.Shell) ([]string, error) {
 	urls := []string{}
 
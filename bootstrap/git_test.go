@@ -217,6 +217,13 @@ func TestGitFetch(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestGitLFSPull(t *testing.T) {
+	sh := new(mockShellRunner).Expect("git", "lfs", "pull", "--include", "assets/*.png,docs/**")
+	defer sh.Check(t)
+	err := gitLFSPull(context.Background(), sh, []string{"assets/*.png", "docs/**"})
+	require.NoError(t, err)
+}
+
 // mockShellRunner implements shellRunner for testing expected calls.
 type mockShellRunner struct {
 	got, want [][]string
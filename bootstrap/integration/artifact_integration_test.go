@@ -3,6 +3,7 @@ package integration
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -104,3 +105,31 @@ func TestArtifactsUploadAfterCommandHookFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestPhaseTimingsAnnotation(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	agent := tester.MockAgent(t)
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+	agent.
+		Expect("annotate", "--context", bintest.MatchAny(), "--style", "info", bintest.MatchAny()).
+		AndCallFunc(func(c *bintest.Call) {
+			body := c.Args[len(c.Args)-1]
+			for _, phase := range []string{"environment", "checkout", "command", "artifact"} {
+				if !strings.Contains(body, "| "+phase+" |") {
+					t.Errorf("annotation body = %q, want it to include the %s phase", body, phase)
+				}
+			}
+			c.Exit(0)
+		})
+
+	tester.RunAndCheck(t, "BUILDKITE_PHASE_TIMINGS_ANNOTATION=true")
+}
@@ -629,6 +629,101 @@ func TestCheckoutRetriesOnCloneFailure(t *testing.T) {
 	tester.RunAndCheck(t)
 }
 
+func TestCheckoutFallsBackToAnotherRemote(t *testing.T) {
+	t.Parallel()
+
+	if experiments.IsEnabled(experiments.GitMirrors) {
+		t.Skip("fallback remotes don't use git mirrors")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	missing := filepath.Join(tester.BuildDir, "missing-repo")
+
+	env := []string{
+		"BUILDKITE_REPO=" + missing,
+		"BUILDKITE_GIT_REMOTE_FALLBACKS=" + tester.Repo.Path,
+		"BUILDKITE_GIT_CHECKOUT_RETRY_BACKOFF=constant:100ms",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// The repository can't be cloned, so the fallback is, and origin is
+	// pointed back at the repository afterwards
+	git.ExpectAll([][]any{
+		{"clone", "-v", "--", missing, "."},
+		{"clone", "-v", "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"remote", "set-url", "origin", missing},
+		{"--no-pager", "show", "HEAD", "--no-patch", "--no-color", gitShowFormatArg},
+	})
+
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckoutWithWorktreeLayout(t *testing.T) {
+	t.Parallel()
+
+	if experiments.IsEnabled(experiments.GitMirrors) {
+		t.Skip("the worktree layout doesn't use git mirrors")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CHECKOUT_LAYOUT=worktree",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	repoDir := filepath.Join(tester.BuildDir, "repositories", "test", "test-project.git")
+
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// The checkout is a worktree of a bare clone of the repository
+	git.ExpectAll([][]any{
+		{"clone", "--bare", "-v", "--", tester.Repo.Path, repoDir},
+		{"--git-dir", repoDir, "config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"},
+		{"--git-dir", repoDir, "worktree", "prune"},
+		{"--git-dir", repoDir, "worktree", "add", "--detach", "--force", tester.CheckoutDir()},
+		{"remote", "set-url", "origin", tester.Repo.Path},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "--no-patch", "--no-color", gitShowFormatArg},
+	})
+
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
 func TestCheckoutDoesNotRetryOnHookFailure(t *testing.T) {
 	tester, err := NewBootstrapTester()
 	if err != nil {
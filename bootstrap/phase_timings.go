@@ -0,0 +1,112 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/jobapi"
+)
+
+// phaseTimingsAnnotationContext is the context of the annotation that
+// summarises how long each phase of the job took, so each job has one
+const phaseTimingsAnnotationContext = "buildkite-phase-timings"
+
+// phaseTimings records when each phase of the job started and finished, for
+// the job API and the phase timings annotation
+type phaseTimings struct {
+	mu     sync.Mutex
+	phases []jobapi.PhaseTiming
+
+	// now returns the time. If nil, it's time.Now
+	now func() time.Time
+}
+
+// start records that a phase has started, and returns a func to call when it
+// finishes
+func (p *phaseTimings) start(name string) (finish func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.phases = append(p.phases, jobapi.PhaseTiming{Name: name, StartedAt: p.time()})
+	i := len(p.phases) - 1
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		finished := p.time()
+		p.phases[i].FinishedAt = &finished
+		p.phases[i].DurationSeconds = finished.Sub(p.phases[i].StartedAt).Seconds()
+	}
+}
+
+// get returns the phases that have started so far, with how long those that
+// are still running have taken so far
+func (p *phaseTimings) get() []jobapi.PhaseTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.time()
+	phases := make([]jobapi.PhaseTiming, len(p.phases))
+	copy(phases, p.phases)
+	for i, phase := range phases {
+		if phase.FinishedAt == nil {
+			phases[i].DurationSeconds = now.Sub(phase.StartedAt).Seconds()
+		}
+	}
+	return phases
+}
+
+func (p *phaseTimings) time() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+// markdown summarises how long each phase took as a table, with how much of
+// the job's time each was
+func (p *phaseTimings) markdown() string {
+	phases := p.get()
+
+	var total float64
+	for _, phase := range phases {
+		total += phase.DurationSeconds
+	}
+
+	var b strings.Builder
+	b.WriteString("| Phase | Duration | Share |\n")
+	b.WriteString("| --- | ---: | ---: |\n")
+	for _, phase := range phases {
+		share := 0.0
+		if total > 0 {
+			share = phase.DurationSeconds / total * 100
+		}
+		duration := time.Duration(phase.DurationSeconds * float64(time.Second)).Round(100 * time.Millisecond)
+		fmt.Fprintf(&b, "| %s | %s | %.0f%% |\n", phase.Name, duration, share)
+	}
+	fmt.Fprintf(&b, "| **Total** | **%s** | |\n", time.Duration(total*float64(time.Second)).Round(100*time.Millisecond))
+	return b.String()
+}
+
+// annotatePhaseTimings summarises how long each phase of the job took in an
+// annotation, if it's been asked for
+func (b *Bootstrap) annotatePhaseTimings(ctx context.Context) {
+	if !b.PhaseTimingsAnnotation || len(b.phaseTimings.get()) == 0 {
+		return
+	}
+
+	label, _ := b.shell.Env.Get("BUILDKITE_LABEL")
+	if label == "" {
+		label = b.JobID
+	}
+	body := fmt.Sprintf("#### Where %s spent its time\n\n%s", label, b.phaseTimings.markdown())
+	annotationContext := phaseTimingsAnnotationContext + "-" + b.JobID
+
+	b.shell.Commentf("Annotating the build with how long each phase of the job took")
+	if err := b.shell.RunWithoutPrompt(ctx, "buildkite-agent", "annotate", "--context", annotationContext, "--style", "info", body); err != nil {
+		b.shell.Warningf("Couldn't annotate the build with the job's phase timings: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	p := &phaseTimings{now: func() time.Time { return now }}
+
+	endCheckout := p.start("checkout")
+	now = now.Add(30 * time.Second)
+	endCheckout()
+	p.start("command")
+	now = now.Add(90 * time.Second)
+
+	phases := p.get()
+	if len(phases) != 2 {
+		t.Fatalf("len(p.get()) = %d, want 2", len(phases))
+	}
+	if phases[0].Name != "checkout" || phases[0].DurationSeconds != 30 || phases[0].FinishedAt == nil {
+		t.Errorf("p.get()[0] = %+v, want checkout finished after 30s", phases[0])
+	}
+	if phases[1].Name != "command" || phases[1].DurationSeconds != 90 || phases[1].FinishedAt != nil {
+		t.Errorf("p.get()[1] = %+v, want command running for 90s so far", phases[1])
+	}
+
+	want := `| Phase | Duration | Share |
+| --- | ---: | ---: |
+| checkout | 30s | 25% |
+| command | 1m30s | 75% |
+| **Total** | **2m0s** | |
+`
+	if diff := cmp.Diff(want, p.markdown()); diff != "" {
+		t.Errorf("p.markdown() diff (-want +got):\n%s", diff)
+	}
+}
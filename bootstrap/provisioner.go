@@ -0,0 +1,109 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+// provisioner sets up a step's toolchain before the command phase, from a
+// description of it in the repository
+type provisioner interface {
+	// Name is how the provisioner is chosen, with
+	// BUILDKITE_ENVIRONMENT_PROVISIONER
+	Name() string
+
+	// Files returns the files in the checkout that describe the
+	// environment, which key its cache. It returns none if the checkout
+	// doesn't describe an environment this provisioner sets up.
+	Files(checkout string) []string
+
+	// Provision sets up the environment in the shell. cacheDir is a
+	// directory that's kept between jobs with the same files, for
+	// provisioners that can skip work they've already done.
+	Provision(ctx context.Context, sh *shell.Shell, checkout, cacheDir string) error
+}
+
+var provisioners = map[string]provisioner{
+	"nix":          nixProvisioner{},
+	"devcontainer": devcontainerProvisioner{},
+}
+
+// provisionEnvironment runs the provisioner chosen with
+// BUILDKITE_ENVIRONMENT_PROVISIONER, if any
+func (b *Bootstrap) provisionEnvironment(ctx context.Context) error {
+	name, _ := b.shell.Env.Get("BUILDKITE_ENVIRONMENT_PROVISIONER")
+	if name == "" {
+		return nil
+	}
+
+	p, ok := provisioners[name]
+	if !ok {
+		names := make([]string, 0, len(provisioners))
+		for n := range provisioners {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown environment provisioner %q, expected one of %q", name, names)
+	}
+
+	checkout := b.shell.Getwd()
+	files := p.Files(checkout)
+	if len(files) == 0 {
+		return fmt.Errorf("BUILDKITE_ENVIRONMENT_PROVISIONER is %q, but the checkout doesn't have the files it needs", name)
+	}
+
+	b.shell.Headerf(":package: Provisioning the %s environment", name)
+
+	key, err := provisionerCacheKey(name, checkout, files)
+	if err != nil {
+		return err
+	}
+	cacheDir := filepath.Join(b.BuildPath, ".environment-cache", key)
+	if err := os.MkdirAll(cacheDir, 0o777); err != nil {
+		return fmt.Errorf("Failed to create environment cache directory: %w", err)
+	}
+
+	// Only one agent on the host provisions an environment at a time, so
+	// the others can use what it cached
+	lock, err := b.shell.LockFile(ctx, cacheDir+".lock", 30*time.Minute)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return p.Provision(ctx, b.shell, checkout, cacheDir)
+}
+
+// provisionerCacheKey hashes the files that describe an environment
+func provisionerCacheKey(name, checkout string, files []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", name)
+	for _, f := range files {
+		contents, err := os.ReadFile(filepath.Join(checkout, f))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(contents))
+		h.Write(contents)
+	}
+	return name + "-" + hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// existingFiles returns the paths that exist in dir
+func existingFiles(dir string, paths ...string) []string {
+	var found []string
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			found = append(found, p)
+		}
+	}
+	return found
+}
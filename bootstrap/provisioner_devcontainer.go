@@ -0,0 +1,213 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/experiments"
+)
+
+// devcontainerProvisioner runs the command in the container a
+// devcontainer.json describes, using the container-steps experiment
+type devcontainerProvisioner struct{}
+
+func (devcontainerProvisioner) Name() string {
+	return "devcontainer"
+}
+
+func (devcontainerProvisioner) Files(checkout string) []string {
+	files := existingFiles(checkout, filepath.Join(".devcontainer", "devcontainer.json"), ".devcontainer.json")
+	if len(files) == 0 {
+		return nil
+	}
+
+	// The image's Dockerfile is part of the environment too
+	config, err := readDevcontainer(filepath.Join(checkout, files[0]))
+	if err == nil && config.Build.Dockerfile != "" {
+		dockerfile := filepath.Join(filepath.Dir(files[0]), config.Build.Dockerfile)
+		files = append(files, existingFiles(checkout, dockerfile)...)
+	}
+	return files
+}
+
+// devcontainer is the part of devcontainer.json that's supported
+type devcontainer struct {
+	Image string `json:"image"`
+	Build struct {
+		Dockerfile string            `json:"dockerfile"`
+		Context    string            `json:"context"`
+		Args       map[string]string `json:"args"`
+	} `json:"build"`
+	ContainerEnv map[string]string `json:"containerEnv"`
+	RemoteEnv    map[string]string `json:"remoteEnv"`
+}
+
+func (p devcontainerProvisioner) Provision(ctx context.Context, sh *shell.Shell, checkout, cacheDir string) error {
+	if !experiments.IsEnabled(experiments.ContainerSteps) {
+		return fmt.Errorf("The devcontainer environment provisioner needs the %s experiment to be enabled", experiments.ContainerSteps)
+	}
+
+	files := p.Files(checkout)
+	path := filepath.Join(checkout, files[0])
+	config, err := readDevcontainer(path)
+	if err != nil {
+		return err
+	}
+
+	image := config.Image
+	if config.Build.Dockerfile != "" {
+		// The image is tagged with the cache key, so it's only built when
+		// the devcontainer.json or Dockerfile changes
+		image = "buildkite-devcontainer:" + filepath.Base(cacheDir)
+
+		if _, err := sh.RunAndCapture(ctx, "docker", "image", "inspect", image); err == nil {
+			sh.Commentf("Using the image %s, which was already built", image)
+		} else {
+			dir := filepath.Dir(path)
+			args := []string{"build", "--tag", image, "--file", filepath.Join(dir, config.Build.Dockerfile)}
+			for _, name := range sortedKeys(config.Build.Args) {
+				args = append(args, "--build-arg", name+"="+config.Build.Args[name])
+			}
+			args = append(args, filepath.Join(dir, config.Build.Context))
+
+			if err := sh.Run(ctx, "docker", args...); err != nil {
+				return fmt.Errorf("Failed to build the devcontainer image: %w", err)
+			}
+		}
+	}
+	if image == "" {
+		return fmt.Errorf("%s needs an image, or a build with a dockerfile", files[0])
+	}
+
+	sh.Env.Set("BUILDKITE_CONTAINER_IMAGE", image)
+	sh.Commentf("The command will run in %s", image)
+
+	// Pass the devcontainer's environment into the container, along with
+	// anything already being passed in
+	env := map[string]string{}
+	for name, value := range config.ContainerEnv {
+		env[name] = value
+	}
+	for name, value := range config.RemoteEnv {
+		env[name] = value
+	}
+
+	names, _ := sh.Env.Get("BUILDKITE_CONTAINER_ENV")
+	for _, name := range sortedKeys(env) {
+		sh.Env.Set(name, env[name])
+		if names != "" {
+			names += ","
+		}
+		names += name
+	}
+	if names != "" {
+		sh.Env.Set("BUILDKITE_CONTAINER_ENV", names)
+	}
+
+	return nil
+}
+
+func readDevcontainer(path string) (devcontainer, error) {
+	var config devcontainer
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal([]byte(stripJSONC(string(contents))), &config); err != nil {
+		return config, fmt.Errorf("Failed to parse %s: %w", path, err)
+	}
+	if config.Build.Context == "" {
+		config.Build.Context = "."
+	}
+	return config, nil
+}
+
+// stripJSONC turns JSON with comments and trailing commas, which
+// devcontainer.json files are written in, into JSON
+func stripJSONC(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			end := jsonStringEnd(s, i)
+			b.WriteString(s[i:end])
+			i = end - 1
+
+		case strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			if i < len(s) {
+				b.WriteByte('\n')
+			}
+
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+
+		case c == ',' && trailingComma(s[i+1:]):
+			// Leave it out
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// jsonStringEnd returns the index just after the JSON string starting at i
+func jsonStringEnd(s string, i int) int {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// trailingComma reports whether what follows a comma is only whitespace and
+// comments before a closing bracket
+func trailingComma(rest string) bool {
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case rest[i] == ' ' || rest[i] == '\t' || rest[i] == '\n' || rest[i] == '\r':
+		case strings.HasPrefix(rest[i:], "//"):
+			for i < len(rest) && rest[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(rest[i:], "/*"):
+			end := strings.Index(rest[i+2:], "*/")
+			if end < 0 {
+				return false
+			}
+			i += end + 3
+		default:
+			return rest[i] == '}' || rest[i] == ']'
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,151 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+// nixEnvIgnored is environment from a Nix development shell that's specific
+// to building a derivation, and would break the job if it were kept
+var nixEnvIgnored = map[string]struct{}{
+	"HOME":            {},
+	"USER":            {},
+	"LOGNAME":         {},
+	"SHELL":           {},
+	"TERM":            {},
+	"PWD":             {},
+	"OLDPWD":          {},
+	"SHLVL":           {},
+	"TMP":             {},
+	"TMPDIR":          {},
+	"TEMP":            {},
+	"TEMPDIR":         {},
+	"NIX_BUILD_TOP":   {},
+	"NIX_BUILD_CORES": {},
+	"NIX_LOG_FD":      {},
+	"NIX_STORE":       {},
+	"builder":         {},
+	"out":             {},
+	"outputs":         {},
+	"shell":           {},
+	"stdenv":          {},
+	"system":          {},
+}
+
+// nixProvisioner sets up the development shell of a flake, or a shell.nix
+type nixProvisioner struct{}
+
+func (nixProvisioner) Name() string {
+	return "nix"
+}
+
+func (nixProvisioner) Files(checkout string) []string {
+	if files := existingFiles(checkout, "flake.nix"); len(files) > 0 {
+		return append(files, existingFiles(checkout, "flake.lock")...)
+	}
+	return existingFiles(checkout, "shell.nix")
+}
+
+// nixDevEnv is the output of nix print-dev-env --json
+type nixDevEnv struct {
+	Variables map[string]struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	} `json:"variables"`
+}
+
+func (p nixProvisioner) Provision(ctx context.Context, sh *shell.Shell, checkout, cacheDir string) error {
+	cached := filepath.Join(cacheDir, "dev-env.json")
+
+	out, err := os.ReadFile(cached)
+	if err == nil {
+		sh.Commentf("Using the development environment cached in %s", cached)
+	} else {
+		args := []string{"--extra-experimental-features", "nix-command flakes", "print-dev-env", "--json"}
+		if files := existingFiles(checkout, "flake.nix"); len(files) == 0 {
+			args = append(args, "--file", "shell.nix")
+		}
+
+		sh.Promptf("nix %s", strings.Join(args, " "))
+		captured, err := sh.RunAndCapture(ctx, "nix", args...)
+		if err != nil {
+			return fmt.Errorf("Failed to get the Nix development environment: %w", err)
+		}
+		out = []byte(captured)
+
+		if err := writeFileAtomic(cached, out); err != nil {
+			sh.Warningf("Failed to cache the Nix development environment: %v", err)
+		}
+	}
+
+	env, err := nixEnvironment(out)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		if name == "PATH" {
+			if existing, ok := sh.Env.Get("PATH"); ok && existing != "" {
+				value += string(os.PathListSeparator) + existing
+			}
+		}
+		sh.Env.Set(name, value)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sh.Commentf("Set %d variables from the Nix development environment: %s", len(names), strings.Join(names, ", "))
+
+	return nil
+}
+
+// nixEnvironment returns the exported variables from the output of
+// nix print-dev-env --json, apart from those in nixEnvIgnored
+func nixEnvironment(out []byte) (map[string]string, error) {
+	var devEnv nixDevEnv
+	if err := json.Unmarshal(out, &devEnv); err != nil {
+		return nil, fmt.Errorf("Failed to parse the Nix development environment: %w", err)
+	}
+
+	env := make(map[string]string)
+	for name, v := range devEnv.Variables {
+		if v.Type != "exported" {
+			continue
+		}
+		if _, ignored := nixEnvIgnored[name]; ignored {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(v.Value, &value); err != nil {
+			// Arrays and associative arrays can't be exported
+			continue
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// writeFileAtomic writes the file so that readers never see part of it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripJSONC(t *testing.T) {
+	t.Parallel()
+
+	input := `{
+	// The image to use
+	"image": "golang:1.20", /* trailing comment */
+	"containerEnv": {
+		"URL": "https://example.com//path",
+		"GLOB": "src/*.go",
+	},
+	"args": ["a", "b",],
+}`
+
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(stripJSONC(input)), &got))
+
+	assert.Equal(t, map[string]interface{}{
+		"image": "golang:1.20",
+		"containerEnv": map[string]interface{}{
+			"URL":  "https://example.com//path",
+			"GLOB": "src/*.go",
+		},
+		"args": []interface{}{"a", "b"},
+	}, got)
+}
+
+func TestNixEnvironment(t *testing.T) {
+	t.Parallel()
+
+	out := []byte(`{
+		"variables": {
+			"PATH": {"type": "exported", "value": "/nix/store/abc-go/bin"},
+			"GOROOT": {"type": "exported", "value": "/nix/store/abc-go/share/go"},
+			"HOME": {"type": "exported", "value": "/homeless-shelter"},
+			"buildPhase": {"type": "var", "value": "make"},
+			"outputs": {"type": "exported", "value": "out"},
+			"FLAGS": {"type": "array", "value": ["-a", "-b"]}
+		}
+	}`)
+
+	env, err := nixEnvironment(out)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"PATH":   "/nix/store/abc-go/bin",
+		"GOROOT": "/nix/store/abc-go/share/go",
+	}, env)
+}
+
+func TestProvisionerFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	assert.Empty(t, nixProvisioner{}.Files(dir))
+	assert.Empty(t, devcontainerProvisioner{}.Files(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "shell.nix"), []byte("{}"), 0o644))
+	assert.Equal(t, []string{"shell.nix"}, nixProvisioner{}.Files(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("{}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "flake.lock"), []byte("{}"), 0o644))
+	assert.Equal(t, []string{"flake.nix", "flake.lock"}, nixProvisioner{}.Files(dir))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".devcontainer"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "devcontainer.json"), []byte(`{
+		// Built from the Dockerfile next to this
+		"build": {"dockerfile": "Dockerfile"},
+	}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".devcontainer", "Dockerfile"), []byte("FROM alpine"), 0o644))
+	assert.Equal(t, []string{
+		filepath.Join(".devcontainer", "devcontainer.json"),
+		filepath.Join(".devcontainer", "Dockerfile"),
+	}, devcontainerProvisioner{}.Files(dir))
+}
+
+func TestProvisionerCacheKey(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shell.nix")
+	require.NoError(t, os.WriteFile(path, []byte("{ go }"), 0o644))
+
+	first, err := provisionerCacheKey("nix", dir, []string{"shell.nix"})
+	require.NoError(t, err)
+
+	again, err := provisionerCacheKey("nix", dir, []string{"shell.nix"})
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	require.NoError(t, os.WriteFile(path, []byte("{ go, nodejs }"), 0o644))
+	changed, err := provisionerCacheKey("nix", dir, []string{"shell.nix"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, changed)
+}
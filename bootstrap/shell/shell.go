@@ -71,6 +71,9 @@ type Shell struct {
 
 	// The signal to use to interrupt the command
 	InterruptSignal process.Signal
+
+	// Which processes are signalled when interrupting the command
+	SignalTarget process.SignalTarget
 }
 
 // New returns a new Shell
@@ -103,6 +106,7 @@ func (s *Shell) WithStdin(r io.Reader) *Shell {
 		Writer:          s.Writer,
 		wd:              s.wd,
 		InterruptSignal: s.InterruptSignal,
+		SignalTarget:    s.SignalTarget,
 	}
 }
 
@@ -448,6 +452,7 @@ func (s *Shell) buildCommand(name string, arg ...string) (*command, error) {
 		Stdin:           s.stdin,
 		Dir:             s.wd,
 		InterruptSignal: s.InterruptSignal,
+		SignalTarget:    s.SignalTarget,
 	}
 
 	// Add env that commands expect a shell to set
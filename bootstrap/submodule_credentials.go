@@ -0,0 +1,152 @@
+package bootstrap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// submoduleCredential is how to authenticate to the submodules on a host
+type submoduleCredential struct {
+	host string
+
+	// The environment variable holding a token for https remotes
+	tokenEnv string
+
+	// The private key for ssh remotes
+	sshKey string
+}
+
+// parseSubmoduleCredentials parses entries such as
+// "github.com=https-token-env:GITHUB_TOKEN" or
+// "gitlab.example.com=ssh-key:/etc/buildkite-agent/gitlab_key"
+func parseSubmoduleCredentials(entries []string) ([]submoduleCredential, error) {
+	creds := make([]submoduleCredential, 0, len(entries))
+	for _, entry := range entries {
+		host, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		kind, arg, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 || host == "" || arg == "" {
+			return nil, fmt.Errorf("invalid submodule credential %q, expected host=https-token-env:NAME or host=ssh-key:PATH", entry)
+		}
+
+		cred := submoduleCredential{host: host}
+		switch kind {
+		case "https-token-env":
+			cred.tokenEnv = arg
+		case "ssh-key":
+			cred.sshKey = arg
+		default:
+			return nil, fmt.Errorf("invalid submodule credential %q, %q isn't https-token-env or ssh-key", entry, kind)
+		}
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+// withSubmoduleCredentials sets up the environment so git authenticates to
+// each submodule host with its credentials. The returned function puts the
+// environment back, and must be called once the submodules are updated.
+//
+// Tokens are passed in GIT_CONFIG_* rather than as arguments, so they don't
+// end up in the job log.
+func (b *Bootstrap) withSubmoduleCredentials() (func(), error) {
+	creds, err := parseSubmoduleCredentials(b.GitSubmoduleCredentials)
+	if err != nil || len(creds) == 0 {
+		return func() {}, err
+	}
+
+	// Remember what's changed, to put it back afterwards
+	previous := map[string]*string{}
+	set := func(key, value string) {
+		if _, ok := previous[key]; !ok {
+			var prev *string
+			if v, exists := b.shell.Env.Get(key); exists {
+				prev = &v
+			}
+			previous[key] = prev
+		}
+		b.shell.Env.Set(key, value)
+	}
+	var sshConfig string
+	restore := func() {
+		for key, prev := range previous {
+			if prev == nil {
+				b.shell.Env.Remove(key)
+			} else {
+				b.shell.Env.Set(key, *prev)
+			}
+		}
+		if sshConfig != "" {
+			os.Remove(sshConfig)
+		}
+	}
+
+	// Add to any config that's already in the environment
+	count := 0
+	if v, ok := b.shell.Env.Get("GIT_CONFIG_COUNT"); ok {
+		count, _ = strconv.Atoi(v)
+	}
+
+	var sshHosts strings.Builder
+	for _, cred := range creds {
+		switch {
+		case cred.tokenEnv != "":
+			token, ok := b.shell.Env.Get(cred.tokenEnv)
+			if !ok || token == "" {
+				b.shell.Warningf("No token in $%s for submodules on %s", cred.tokenEnv, cred.host)
+				continue
+			}
+			auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+			set(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), fmt.Sprintf("http.https://%s/.extraHeader", cred.host))
+			set(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), "Authorization: Basic "+auth)
+			count++
+
+		case cred.sshKey != "":
+			fmt.Fprintf(&sshHosts, "Host %s\n  IdentityFile %s\n  IdentitiesOnly yes\n", cred.host, cred.sshKey)
+		}
+	}
+	if count > 0 {
+		set("GIT_CONFIG_COUNT", strconv.Itoa(count))
+	}
+
+	if sshHosts.Len() > 0 {
+		// ssh only reads the config it's given, so include the user's
+		// own after the keys for each host
+		sshHosts.WriteString("Match all\n  Include ~/.ssh/config\n")
+
+		f, err := os.CreateTemp("", "buildkite-submodule-ssh-config")
+		if err != nil {
+			restore()
+			return func() {}, err
+		}
+		sshConfig = f.Name()
+		_, err = f.WriteString(sshHosts.String())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			restore()
+			return func() {}, err
+		}
+
+		sshCommand, ok := b.shell.Env.Get("GIT_SSH_COMMAND")
+		if !ok || sshCommand == "" {
+			sshCommand = "ssh"
+		}
+		set("GIT_SSH_COMMAND", fmt.Sprintf("%s -F %q", sshCommand, sshConfig))
+	}
+
+	return restore, nil
+}
+
+// submoduleUpdateArgs are the arguments to git submodule update, which
+// updates several submodules at once when there's a concurrency
+func (b *Bootstrap) submoduleUpdateArgs(extra ...string) []string {
+	args := []string{"submodule", "update", "--init", "--recursive", "--force"}
+	if b.GitSubmoduleConcurrency > 1 {
+		args = append(args, "--jobs", strconv.Itoa(b.GitSubmoduleConcurrency))
+	}
+	return append(args, extra...)
+}
@@ -0,0 +1,315 @@
+// Package cgroup runs jobs in their own Linux control group (cgroup v2), so
+// the CPU and memory they use can be limited.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Root is where the cgroup v2 hierarchy is mounted
+const Root = "/sys/fs/cgroup"
+
+// agentLeaf is the cgroup processes already in the parent cgroup are moved
+// to, as cgroup v2 only allows controllers to be enabled for a cgroup's
+// children when it has no processes of its own
+const agentLeaf = "buildkite-agent"
+
+// DefaultCPUWeight is the kernel's CPU weight for a cgroup
+const DefaultCPUWeight = 100
+
+// Limits are the resources a job can use. The zero value means no limit.
+type Limits struct {
+	// CPUs is how many CPUs' worth of time the job can use, e.g. 1.5
+	CPUs float64
+
+	// CPUWeight is the job's share of CPU time relative to other jobs when
+	// the CPUs are busy, from 1 to 10000. The kernel default is 100.
+	CPUWeight int
+
+	// Memory is the most memory the job can use, in bytes. Jobs that use
+	// more are killed by the kernel.
+	Memory uint64
+}
+
+// IsZero reports whether there are no limits
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Within returns l, lowered to any limits in max that are lower. A CPU weight
+// is lowered to the one in max, or to DefaultCPUWeight if max has none, so a
+// job can't take a bigger share of CPU time than it was given.
+func (l Limits) Within(max Limits) Limits {
+	maxWeight := max.CPUWeight
+	if maxWeight == 0 {
+		maxWeight = DefaultCPUWeight
+	}
+	if l.CPUWeight > maxWeight {
+		l.CPUWeight = maxWeight
+	}
+	if max.CPUs > 0 && (l.CPUs == 0 || l.CPUs > max.CPUs) {
+		l.CPUs = max.CPUs
+	}
+	if max.Memory > 0 && (l.Memory == 0 || l.Memory > max.Memory) {
+		l.Memory = max.Memory
+	}
+	return l
+}
+
+func (l Limits) String() string {
+	var parts []string
+	if l.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("%g CPUs", l.CPUs))
+	}
+	if l.CPUWeight > 0 {
+		parts = append(parts, fmt.Sprintf("CPU weight %d", l.CPUWeight))
+	}
+	if l.Memory > 0 {
+		parts = append(parts, humanize.IBytes(l.Memory)+" memory")
+	}
+	if len(parts) == 0 {
+		return "no limits"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ParseCPUs parses a number of CPUs, e.g. "1.5". An empty string is no limit.
+func ParseCPUs(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	cpus, err := strconv.ParseFloat(s, 64)
+	if err != nil || cpus <= 0 {
+		return 0, fmt.Errorf("%q isn't a positive number of CPUs", s)
+	}
+	return cpus, nil
+}
+
+// ParseCPUWeight parses a CPU weight from 1 to 10000. An empty string is the
+// default weight.
+func ParseCPUWeight(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	weight, err := strconv.Atoi(s)
+	if err != nil || weight < 1 || weight > 10000 {
+		return 0, fmt.Errorf("%q isn't a CPU weight from 1 to 10000", s)
+	}
+	return weight, nil
+}
+
+// ParseMemory parses an amount of memory, e.g. "512MiB" or "4G". An empty
+// string is no limit.
+func ParseMemory(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	memory, err := humanize.ParseBytes(s)
+	if err != nil || memory == 0 {
+		return 0, fmt.Errorf("%q isn't an amount of memory, e.g. 4GiB", s)
+	}
+	return memory, nil
+}
+
+// Own returns the path of the cgroup this process is in
+func Own() (string, error) {
+	return of("self")
+}
+
+// Of returns the path of the cgroup a process is in
+func Of(pid int) (string, error) {
+	return of(strconv.Itoa(pid))
+}
+
+func of(pid string) (string, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	return parseProcCgroup(string(b))
+}
+
+// parseProcCgroup returns the cgroup v2 path from the contents of
+// /proc/<pid>/cgroup, which is the line starting "0::"
+func parseProcCgroup(s string) (string, error) {
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(Root, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+// Prepare gets the parent cgroup ready to have job cgroups created in it, by
+// moving any processes in it to a child cgroup of their own and enabling
+// the cpu and memory controllers for its children. Processes in the root
+// cgroup are left where they are, as it's allowed to have both.
+func Prepare(parent string) error {
+	return prepare(parent, filepath.Clean(parent) == Root)
+}
+
+func prepare(parent string, isRoot bool) error {
+	procs, err := readPIDs(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("reading the processes in %s: %w", parent, err)
+	}
+
+	if len(procs) > 0 && !isRoot {
+		leaf := filepath.Join(parent, agentLeaf)
+		if err := os.MkdirAll(leaf, 0o755); err != nil {
+			return err
+		}
+		for _, pid := range procs {
+			// Processes may exit before they're moved
+			if err := addPID(leaf, pid); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return fmt.Errorf("moving process %d to %s: %w", pid, leaf, err)
+			}
+		}
+	}
+
+	if err := writeFile(filepath.Join(parent, "cgroup.subtree_control"), "+cpu +memory"); err != nil {
+		return fmt.Errorf("enabling the cpu and memory controllers in %s: %w", parent, err)
+	}
+	return nil
+}
+
+// Group is a cgroup for a job
+type Group struct {
+	Path string
+}
+
+// New creates a cgroup called name in parent, with the limits applied
+func New(parent, name string, limits Limits) (*Group, error) {
+	g := &Group{Path: filepath.Join(parent, name)}
+	if err := os.Mkdir(g.Path, 0o755); err != nil {
+		return nil, err
+	}
+
+	var settings [][2]string
+	if limits.CPUs > 0 {
+		// The quota is in microseconds per period of 100ms
+		const period = 100000
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*period), period)})
+	}
+	if limits.CPUWeight > 0 {
+		settings = append(settings, [2]string{"cpu.weight", strconv.Itoa(limits.CPUWeight)})
+	}
+	if limits.Memory > 0 {
+		settings = append(settings, [2]string{"memory.max", strconv.FormatUint(limits.Memory, 10)})
+	}
+
+	for _, s := range settings {
+		if err := writeFile(filepath.Join(g.Path, s[0]), s[1]); err != nil {
+			_ = os.Remove(g.Path)
+			return nil, fmt.Errorf("setting %s: %w", s[0], err)
+		}
+	}
+	return g, nil
+}
+
+// Add moves the process into the group. Processes it starts afterwards are
+// in the group too.
+func (g *Group) Add(pid int) error {
+	return addPID(g.Path, pid)
+}
+
+// OOMKills returns how many times a process in the group has been killed for
+// using more memory than the limit
+func (g *Group) OOMKills() (int, error) {
+	b, err := os.ReadFile(filepath.Join(g.Path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "oom_kill ") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "oom_kill ")))
+		}
+	}
+	return 0, nil
+}
+
+// PIDs returns the processes in the group. Processes can't leave it, so
+// these are all those started in it that are still running.
+func (g *Group) PIDs() ([]int, error) {
+	return readPIDs(filepath.Join(g.Path, "cgroup.procs"))
+}
+
+// Signal sends sig to every process in the group
+func (g *Group) Signal(sig os.Signal) error {
+	pids, err := g.PIDs()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		// Processes may exit before they're signalled
+		if err := p.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("signalling process %d: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+// Kill kills every process in the group
+func (g *Group) Kill() error {
+	// cgroup.kill is only on Linux 5.14 and later
+	if err := writeFile(filepath.Join(g.Path, "cgroup.kill"), "1"); err == nil {
+		return nil
+	}
+	return g.Signal(os.Kill)
+}
+
+// Remove kills any processes left in the group, then removes it
+func (g *Group) Remove() error {
+	_ = g.Kill()
+
+	// Killed processes take a moment to leave the group, and it can't be
+	// removed until they have
+	var err error
+	for delay := 10 * time.Millisecond; delay < 2*time.Second; delay *= 2 {
+		if err = os.Remove(g.Path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(delay)
+	}
+	return err
+}
+
+func addPID(path string, pid int) error {
+	return writeFile(filepath.Join(path, "cgroup.procs"), strconv.Itoa(pid))
+}
+
+func readPIDs(path string) ([]int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// writeFile writes to a cgroup interface file. The kernel creates them, and
+// doesn't allow other files to be created, so writing one that doesn't
+// exist fails.
+func writeFile(path, value string) error {
+	return os.WriteFile(path, []byte(value), 0o644)
+}
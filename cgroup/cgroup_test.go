@@ -0,0 +1,124 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimits(t *testing.T) {
+	cpus, err := ParseCPUs("1.5")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, cpus)
+
+	weight, err := ParseCPUWeight("200")
+	require.NoError(t, err)
+	assert.Equal(t, 200, weight)
+
+	memory, err := ParseMemory("4GiB")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4<<30), memory)
+
+	cpus, err = ParseCPUs("")
+	assert.NoError(t, err)
+	assert.Zero(t, cpus)
+
+	_, err = ParseCPUs("-1")
+	assert.Error(t, err)
+	_, err = ParseCPUWeight("10001")
+	assert.Error(t, err)
+	_, err = ParseMemory("lots")
+	assert.Error(t, err)
+}
+
+func TestLimitsWithin(t *testing.T) {
+	max := Limits{CPUs: 2, CPUWeight: 100, Memory: 4 << 30}
+
+	assert.Equal(t, Limits{CPUs: 2, Memory: 4 << 30}, Limits{}.Within(max))
+	assert.Equal(t, Limits{CPUs: 1, CPUWeight: 50, Memory: 1 << 30}, Limits{CPUs: 1, CPUWeight: 50, Memory: 1 << 30}.Within(max))
+	assert.Equal(t, Limits{CPUs: 1, CPUWeight: 100, Memory: 4 << 30}, Limits{CPUs: 1, CPUWeight: 500}.Within(max))
+	assert.Equal(t, Limits{CPUs: 2, Memory: 4 << 30}, Limits{CPUs: 8, Memory: 16 << 30}.Within(max))
+	assert.Equal(t, Limits{CPUs: 8}, Limits{CPUs: 8}.Within(Limits{}))
+	assert.Equal(t, Limits{CPUWeight: DefaultCPUWeight}, Limits{CPUWeight: 1000}.Within(Limits{}))
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	path, err := parseProcCgroup("0::/system.slice/buildkite-agent.service\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup/system.slice/buildkite-agent.service", path)
+
+	_, err = parseProcCgroup("4:memory:/docker/abc\n1:cpu:/\n")
+	assert.Error(t, err)
+}
+
+func TestPrepareMovesProcessesToLeaf(t *testing.T) {
+	parent := t.TempDir()
+	writeTestFile(t, filepath.Join(parent, "cgroup.procs"), "123\n456\n")
+
+	require.NoError(t, prepare(parent, false))
+
+	assert.Equal(t, "+cpu +memory", readTestFile(t, filepath.Join(parent, "cgroup.subtree_control")))
+	// Real cgroup.procs files take one pid per write and list every process
+	assert.Equal(t, "456", readTestFile(t, filepath.Join(parent, agentLeaf, "cgroup.procs")))
+}
+
+func TestPrepareLeavesRootProcesses(t *testing.T) {
+	parent := t.TempDir()
+	writeTestFile(t, filepath.Join(parent, "cgroup.procs"), "1\n")
+
+	require.NoError(t, prepare(parent, true))
+
+	assert.NoDirExists(t, filepath.Join(parent, agentLeaf))
+	assert.Equal(t, "+cpu +memory", readTestFile(t, filepath.Join(parent, "cgroup.subtree_control")))
+}
+
+func TestNewWritesLimits(t *testing.T) {
+	parent := t.TempDir()
+
+	g, err := New(parent, "job-1", Limits{CPUs: 1.5, CPUWeight: 50, Memory: 512 << 20})
+	require.NoError(t, err)
+
+	assert.Equal(t, "150000 100000", readTestFile(t, filepath.Join(g.Path, "cpu.max")))
+	assert.Equal(t, "50", readTestFile(t, filepath.Join(g.Path, "cpu.weight")))
+	assert.Equal(t, "536870912", readTestFile(t, filepath.Join(g.Path, "memory.max")))
+
+	require.NoError(t, g.Add(789))
+	assert.Equal(t, "789", readTestFile(t, filepath.Join(g.Path, "cgroup.procs")))
+}
+
+func TestOOMKills(t *testing.T) {
+	g := &Group{Path: t.TempDir()}
+	writeTestFile(t, filepath.Join(g.Path, "memory.events"), "low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\n")
+
+	kills, err := g.OOMKills()
+	require.NoError(t, err)
+	assert.Equal(t, 2, kills)
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestKill(t *testing.T) {
+	g := &Group{Path: t.TempDir()}
+	writeTestFile(t, filepath.Join(g.Path, "cgroup.kill"), "")
+	writeTestFile(t, filepath.Join(g.Path, "cgroup.procs"), "123\n456\n")
+
+	pids, err := g.PIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []int{123, 456}, pids)
+
+	require.NoError(t, g.Kill())
+	assert.Equal(t, "1", readTestFile(t, filepath.Join(g.Path, "cgroup.kill")))
+}
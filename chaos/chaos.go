@@ -0,0 +1,242 @@
+// Package chaos injects failures and latency into HTTP requests, so that
+// retries can be tested against an unreliable network, and reports of flaky
+// network behaviour can be reproduced. It does nothing unless BUILDKITE_CHAOS
+// is set, and isn't meant to be used outside of testing.
+//
+// BUILDKITE_CHAOS is a comma separated list of settings, such as
+// "failure-rate=0.2,status=503,latency=200ms,jitter=100ms,seed=42,scope=api":
+//
+//   - failure-rate: the fraction of requests that fail, from 0 to 1
+//   - status: the status failed requests respond with. By default, they fail
+//     as if the connection was reset
+//   - latency: how long to wait before each request is made
+//   - jitter: up to how much longer to wait, chosen at random
+//   - seed: seeds the choice of which requests fail, so a run can be repeated
+//   - scope: api or artifacts, to only affect requests to the Buildkite API
+//     or to artifact storage. By default both are affected
+//
+// It is intended for internal use by buildkite-agent only.
+package chaos
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvVar is the environment variable chaos is configured with
+const EnvVar = "BUILDKITE_CHAOS"
+
+// The scopes of requests chaos can be injected into
+const (
+	API       = "api"
+	Artifacts = "artifacts"
+)
+
+// Config is how much chaos to inject
+type Config struct {
+	FailureRate float64
+	Status      int
+	Latency     time.Duration
+	Jitter      time.Duration
+	Seed        int64
+
+	// The scopes to inject chaos into. If empty, it's injected into all of
+	// them
+	Scopes []string
+}
+
+// Parse parses the settings in BUILDKITE_CHAOS
+func Parse(value string) (Config, error) {
+	conf := Config{Seed: time.Now().UnixNano()}
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		key, v, ok := strings.Cut(setting, "=")
+		if !ok {
+			return Config{}, fmt.Errorf("invalid setting %q, expected key=value", setting)
+		}
+
+		var err error
+		switch key {
+		case "failure-rate":
+			conf.FailureRate, err = strconv.ParseFloat(v, 64)
+			if err == nil && (conf.FailureRate < 0 || conf.FailureRate > 1) {
+				err = fmt.Errorf("%v isn't between 0 and 1", conf.FailureRate)
+			}
+		case "status":
+			conf.Status, err = strconv.Atoi(v)
+			if err == nil && (conf.Status < 100 || conf.Status > 599) {
+				err = fmt.Errorf("%d isn't an HTTP status", conf.Status)
+			}
+		case "latency":
+			conf.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			conf.Jitter, err = time.ParseDuration(v)
+		case "seed":
+			conf.Seed, err = strconv.ParseInt(v, 10, 64)
+		case "scope":
+			if v != API && v != Artifacts {
+				err = fmt.Errorf("%q isn't %s or %s", v, API, Artifacts)
+			}
+			conf.Scopes = append(conf.Scopes, v)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s setting %q: %w", EnvVar, setting, err)
+		}
+	}
+	return conf, nil
+}
+
+func (c Config) inScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	fromEnvOnce sync.Once
+	fromEnv     *chaos
+)
+
+// load reads BUILDKITE_CHAOS once, and returns nil if it isn't set
+func load() *chaos {
+	fromEnvOnce.Do(func() {
+		value := os.Getenv(EnvVar)
+		if value == "" {
+			return
+		}
+		conf, err := Parse(value)
+		fromEnv = newChaos(conf, err)
+	})
+	return fromEnv
+}
+
+// chaos decides what happens to each request. Requests share one source of
+// randomness, so the same seed makes the same choices for the same sequence
+// of requests.
+type chaos struct {
+	conf Config
+
+	// If the config couldn't be parsed, every request fails with it, rather
+	// than carrying on without the chaos that was asked for
+	err error
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaos(conf Config, err error) *chaos {
+	return &chaos{conf: conf, err: err, rand: rand.New(rand.NewSource(conf.Seed))}
+}
+
+// roll returns how long to delay a request, and whether it fails
+func (c *chaos) roll() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delay := c.conf.Latency
+	if c.conf.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.conf.Jitter)))
+	}
+	return delay, c.rand.Float64() < c.conf.FailureRate
+}
+
+// Transport injects chaos into the requests of the transport it wraps
+type Transport struct {
+	Delegate http.RoundTripper
+
+	chaos *chaos
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.chaos.err != nil {
+		closeBody(req)
+		return nil, t.chaos.err
+	}
+
+	delay, fail := t.chaos.roll()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+
+	if !fail {
+		return t.Delegate.RoundTrip(req)
+	}
+
+	closeBody(req)
+	if t.chaos.conf.Status == 0 {
+		return nil, fmt.Errorf("chaos: injected failure of %s %s: connection reset by peer", req.Method, req.URL.Redacted())
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.chaos.conf.Status, http.StatusText(t.chaos.conf.Status)),
+		StatusCode:    t.chaos.conf.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader("chaos: injected failure\n")),
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// A RoundTripper must close the request body, even when it fails
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// Wrap returns rt with chaos injected into its requests, if BUILDKITE_CHAOS
+// is set for the scope, and otherwise returns rt as it is
+func Wrap(scope string, rt http.RoundTripper) http.RoundTripper {
+	c := load()
+	if c == nil || (c.err == nil && !c.conf.inScope(scope)) {
+		return rt
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{Delegate: rt, chaos: c}
+}
+
+// Client returns a copy of client with chaos injected into its requests, if
+// BUILDKITE_CHAOS is set for the scope, and otherwise returns client as it is.
+// A nil client is treated as http.DefaultClient.
+func Client(scope string, client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rt := Wrap(scope, client.Transport)
+	if rt == client.Transport {
+		return client
+	}
+	wrapped := *client
+	wrapped.Transport = rt
+	return &wrapped
+}
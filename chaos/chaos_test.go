@@ -0,0 +1,101 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	got, err := Parse("failure-rate=0.25, status=503,latency=100ms,jitter=50ms,seed=42,scope=api")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := Config{
+		FailureRate: 0.25,
+		Status:      503,
+		Latency:     100 * time.Millisecond,
+		Jitter:      50 * time.Millisecond,
+		Seed:        42,
+		Scopes:      []string{API},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Parse() diff (-want +got):\n%s", diff)
+	}
+
+	for _, value := range []string{
+		"failure-rate=2",
+		"status=999",
+		"latency=soon",
+		"scope=everything",
+		"llamas=1",
+		"failure-rate",
+	} {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q) error = nil, want an error", value)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// The same seed fails the same requests
+	statuses := func(conf Config) []int {
+		client := &http.Client{Transport: &Transport{Delegate: http.DefaultTransport, chaos: newChaos(conf, nil)}}
+		var got []int
+		for i := 0; i < 20; i++ {
+			res, err := client.Get(server.URL)
+			if err != nil {
+				got = append(got, 0)
+				continue
+			}
+			res.Body.Close()
+			got = append(got, res.StatusCode)
+		}
+		return got
+	}
+
+	conf := Config{FailureRate: 0.5, Status: http.StatusServiceUnavailable, Seed: 42}
+	first, second := statuses(conf), statuses(conf)
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("statuses with the same seed differ (-first +second):\n%s", diff)
+	}
+
+	counts := map[int]int{}
+	for _, status := range first {
+		counts[status]++
+	}
+	if counts[http.StatusOK] == 0 || counts[http.StatusServiceUnavailable] == 0 || len(counts) != 2 {
+		t.Errorf("statuses = %v, want a mix of 200 and 503", first)
+	}
+
+	// Without a status, failures are errors
+	for _, status := range statuses(Config{FailureRate: 1}) {
+		if status != 0 {
+			t.Errorf("status = %d, want an error", status)
+		}
+	}
+}
+
+func TestConfigInScope(t *testing.T) {
+	t.Parallel()
+
+	if !(Config{}).inScope(Artifacts) {
+		t.Errorf("Config{}.inScope(%q) = false, want true", Artifacts)
+	}
+	conf := Config{Scopes: []string{API}}
+	if !conf.inScope(API) || conf.inScope(Artifacts) {
+		t.Errorf("%+v.inScope() should only be true for %q", conf, API)
+	}
+}
@@ -3,6 +3,7 @@ package clicommand
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -18,8 +19,12 @@ import (
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/cgroup"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/destination"
+	"github.com/buildkite/agent/v3/dockerproxy"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/logger"
@@ -30,9 +35,11 @@ import (
 	"github.com/buildkite/agent/v3/utils"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/shellwords"
+	"github.com/dustin/go-humanize"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli"
 	"golang.org/x/exp/maps"
+	"golang.org/x/time/rate"
 )
 
 const startDescription = `Usage:
@@ -65,12 +72,42 @@ type AgentStartConfig struct {
 	AcquireJob                  string   `cli:"acquire-job"`
 	DisconnectAfterJob          bool     `cli:"disconnect-after-job"`
 	DisconnectAfterIdleTimeout  int      `cli:"disconnect-after-idle-timeout"`
+	MaintenanceWindows          string   `cli:"maintenance-windows"`
+	RemoteControlAuditLog       string   `cli:"remote-control-audit-log" normalize:"filepath"`
 	BootstrapScript             string   `cli:"bootstrap-script" normalize:"commandpath"`
 	CancelGracePeriod           int      `cli:"cancel-grace-period"`
+	ReapOrphanedProcesses       bool     `cli:"reap-orphaned-processes"`
+	AnnotateJobResources        bool     `cli:"annotate-job-resources"`
+	JobCPULimit                 string   `cli:"job-cpu-limit"`
+	JobCPUWeight                string   `cli:"job-cpu-weight"`
+	JobMemoryLimit              string   `cli:"job-memory-limit"`
+	JobCgroupParent             string   `cli:"job-cgroup-parent" normalize:"filepath"`
+	ScratchPath                 string   `cli:"scratch-path" normalize:"filepath"`
+	ScratchTmpfsSize            string   `cli:"scratch-tmpfs-size"`
+	DockerProxySocket           string   `cli:"docker-proxy-socket" normalize:"filepath"`
+	DockerProxyUpstream         string   `cli:"docker-proxy-upstream" normalize:"filepath"`
+	DockerProxyAllowPrivileged  bool     `cli:"docker-proxy-allow-privileged"`
+	DockerProxyAllowedMounts    []string `cli:"docker-proxy-allowed-mounts" normalize:"list"`
+	UsagePath                   string   `cli:"usage-path" normalize:"filepath"`
+	JobStatusFile               string   `cli:"job-status-file" normalize:"filepath"`
+	ArtifactPostProcessors      string   `cli:"artifact-post-processors"`
+	ArtifactSigningKey          string   `cli:"artifact-signing-key" normalize:"filepath"`
+	ArtifactURLRewrites         string   `cli:"artifact-url-rewrites"`
+	ArtifactDefaultDestination  string   `cli:"artifact-upload-default-destination"`
+	MetaDataEncryptionKeyFile   string   `cli:"meta-data-encryption-key-file" normalize:"filepath"`
 	EnableJobLogTmpfile         bool     `cli:"enable-job-log-tmpfile"`
 	WriteJobLogsToStdout        bool     `cli:"write-job-logs-to-stdout"`
+	LogUploadRateLimit          string   `cli:"log-upload-rate-limit"`
+	JobLogANSI                  string   `cli:"job-log-ansi"`
+	JobLogProgressSample        string   `cli:"job-log-progress-sample-interval"`
+	JobLogMaxLineLength         int      `cli:"job-log-max-line-length"`
 	BuildPath                   string   `cli:"build-path" normalize:"filepath" validate:"required"`
 	HooksPath                   string   `cli:"hooks-path" normalize:"filepath"`
+	HooksBundleURL              string   `cli:"hooks-bundle-url"`
+	HooksBundleSHA256           string   `cli:"hooks-bundle-sha256"`
+	HooksBundleVerificationKey  string   `cli:"hooks-bundle-verification-key" normalize:"filepath"`
+	HooksBundleRefreshInterval  string   `cli:"hooks-bundle-refresh-interval"`
+	HooksBundlePath             string   `cli:"hooks-bundle-path" normalize:"filepath"`
 	SocketsPath                 string   `cli:"sockets-path" normalize:"filepath"`
 	PluginsPath                 string   `cli:"plugins-path" normalize:"filepath"`
 	Shell                       string   `cli:"shell"`
@@ -82,7 +119,13 @@ type AgentStartConfig struct {
 	TagsFromGCPMetaData         bool     `cli:"tags-from-gcp-meta-data"`
 	TagsFromGCPMetaDataPaths    []string `cli:"tags-from-gcp-meta-data-paths" normalize:"list"`
 	TagsFromGCPLabels           bool     `cli:"tags-from-gcp-labels"`
+	TagsFromAzureMetaData       bool     `cli:"tags-from-azure-meta-data"`
+	TagsFromAzureTags           bool     `cli:"tags-from-azure-tags"`
+	TagsFromK8sDownwardAPI      string   `cli:"tags-from-k8s-downward-api" normalize:"filepath"`
+	TagsMapping                 []string `cli:"tags-mapping" normalize:"list"`
+	TagsEnv                     []string `cli:"tags-env" normalize:"list"`
 	TagsFromHost                bool     `cli:"tags-from-host"`
+	TagsFromHostCapabilities    bool     `cli:"tags-from-host-capabilities"`
 	WaitForEC2TagsTimeout       string   `cli:"wait-for-ec2-tags-timeout"`
 	WaitForEC2MetaDataTimeout   string   `cli:"wait-for-ec2-meta-data-timeout"`
 	WaitForECSMetaDataTimeout   string   `cli:"wait-for-ecs-meta-data-timeout"`
@@ -92,6 +135,14 @@ type AgentStartConfig struct {
 	GitCloneMirrorFlags         string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags               string   `cli:"git-clean-flags"`
 	GitFetchFlags               string   `cli:"git-fetch-flags"`
+	GitCheckoutRetries          int      `cli:"git-checkout-retries"`
+	GitCheckoutRetryBackoff     string   `cli:"git-checkout-retry-backoff"`
+	GitCheckoutCleanOn          []string `cli:"git-checkout-clean-on" normalize:"list"`
+	GitRemoteFallbacks          []string `cli:"git-remote-fallbacks" normalize:"list"`
+	GitCheckoutLayout           string   `cli:"git-checkout-layout"`
+	GitSubmoduleCredentials     []string `cli:"git-submodule-credentials" normalize:"list"`
+	GitSubmoduleConcurrency     int      `cli:"git-submodule-concurrency"`
+	GitLFSSkipSmudge            bool     `cli:"git-lfs-skip-smudge"`
 	GitMirrorsPath              string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout       int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate        bool     `cli:"git-mirrors-skip-update"`
@@ -105,6 +156,7 @@ type AgentStartConfig struct {
 	NoFeatureReporting          bool     `cli:"no-feature-reporting"`
 	TimestampLines              bool     `cli:"timestamp-lines"`
 	HealthCheckAddr             string   `cli:"health-check-addr"`
+	HandoffSocket               string   `cli:"handoff-socket" normalize:"filepath"`
 	MetricsDatadog              bool     `cli:"metrics-datadog"`
 	MetricsDatadogHost          string   `cli:"metrics-datadog-host"`
 	MetricsDatadogDistributions bool     `cli:"metrics-datadog-distributions"`
@@ -114,20 +166,24 @@ type AgentStartConfig struct {
 	SpawnWithPriority           bool     `cli:"spawn-with-priority"`
 	LogFormat                   string   `cli:"log-format"`
 	CancelSignal                string   `cli:"cancel-signal"`
+	CancelSignalTarget          string   `cli:"cancel-signal-target"`
 	RedactedVars                []string `cli:"redacted-vars" normalize:"list"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
-	DebugHTTP bool   `cli:"debug-http"`
-	Token     string `cli:"token" validate:"required"`
-	Endpoint  string `cli:"endpoint" validate:"required"`
-	NoHTTP2   bool   `cli:"no-http2"`
+	DebugHTTP      bool   `cli:"debug-http"`
+	DebugHTTPDump  string `cli:"debug-http-dump" normalize:"filepath"`
+	Token          string `cli:"token" validate:"required"`
+	SecondaryToken string `cli:"secondary-token"`
+	Endpoint       string `cli:"endpoint" validate:"required"`
+	NoHTTP2        bool   `cli:"no-http2"`
 
 	// Deprecated
 	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
@@ -171,6 +227,14 @@ func (asc AgentStartConfig) Features() []string {
 		features = append(features, "disconnect-after-idle")
 	}
 
+	if asc.ReapOrphanedProcesses {
+		features = append(features, "reap-orphaned-processes")
+	}
+
+	if asc.JobCPULimit != "" || asc.JobCPUWeight != "" || asc.JobMemoryLimit != "" {
+		features = append(features, "job-resource-limits")
+	}
+
 	if asc.NoPlugins {
 		features = append(features, "no-plugins")
 	}
@@ -183,9 +247,30 @@ func (asc AgentStartConfig) Features() []string {
 		features = append(features, fmt.Sprintf("experiment-%s", exp))
 	}
 
+	for exp, percent := range experiments.Rollouts() {
+		features = append(features, fmt.Sprintf("experiment-%s-%d-percent", exp, percent))
+	}
+
 	return features
 }
 
+// parseJobResourceLimits parses the resource limits for jobs
+func parseJobResourceLimits(cfg AgentStartConfig) (cgroup.Limits, error) {
+	var limits cgroup.Limits
+	var err error
+
+	if limits.CPUs, err = cgroup.ParseCPUs(cfg.JobCPULimit); err != nil {
+		return limits, fmt.Errorf("Failed to parse job-cpu-limit: %w", err)
+	}
+	if limits.CPUWeight, err = cgroup.ParseCPUWeight(cfg.JobCPUWeight); err != nil {
+		return limits, fmt.Errorf("Failed to parse job-cpu-weight: %w", err)
+	}
+	if limits.Memory, err = cgroup.ParseMemory(cfg.JobMemoryLimit); err != nil {
+		return limits, fmt.Errorf("Failed to parse job-memory-limit: %w", err)
+	}
+	return limits, nil
+}
+
 func DefaultShell() string {
 	// https://github.com/golang/go/blob/master/src/go/build/syslist.go#L7
 	switch runtime.GOOS {
@@ -275,12 +360,105 @@ var AgentStartCommand = cli.Command{
 			Usage:  "The maximum idle time in seconds to wait for a job before disconnecting. The default of 0 means no timeout",
 			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_IDLE_TIMEOUT",
 		},
+		cli.StringFlag{
+			Name:   "maintenance-windows",
+			Value:  "",
+			Usage:  "Times when the agent stays connected but doesn't accept new jobs, as a cron expression in local time followed by a duration, e.g. \"0 2 * * SAT 4h\". Separate multiple windows with semicolons",
+			EnvVar: "BUILDKITE_AGENT_MAINTENANCE_WINDOWS",
+		},
+		cli.StringFlag{
+			Name:   "remote-control-audit-log",
+			Value:  "",
+			Usage:  "A file to append the remote control actions Buildkite sends the agent to, such as draining it or changing its tags, one JSON object per line",
+			EnvVar: "BUILDKITE_AGENT_REMOTE_CONTROL_AUDIT_LOG",
+		},
 		cli.IntFlag{
 			Name:   "cancel-grace-period",
 			Value:  10,
-			Usage:  "The number of seconds a canceled or timed out job is given to gracefully terminate and upload its artifacts",
+			Usage:  "The number of seconds a canceled or timed out job is given to gracefully terminate and upload its artifacts. Pipelines can override it with BUILDKITE_CANCEL_GRACE_PERIOD",
 			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
 		},
+		cli.BoolFlag{
+			Name:   "reap-orphaned-processes",
+			Usage:  "Kill any processes a job leaves running once it finishes, such as background test servers, and list them in the job log. On Linux, jobs run in a cgroup of their own (see --job-cgroup-parent), and what's left in it is sent SIGTERM, then killed after the cancel grace period. On Windows, what's left in the job's job object is killed. Not supported on other platforms",
+			EnvVar: "BUILDKITE_REAP_ORPHANED_PROCESSES",
+		},
+		cli.BoolFlag{
+			Name:   "annotate-job-resources",
+			Usage:  "Annotate the build with the CPU time, peak memory, and disk and network IO each job used, which are always sent as metrics",
+			EnvVar: "BUILDKITE_ANNOTATE_JOB_RESOURCES",
+		},
+		cli.StringFlag{
+			Name:   "job-cpu-limit",
+			Value:  "",
+			Usage:  "How many CPUs each job can use, e.g. 1.5. Pipelines can lower it with BUILDKITE_JOB_CPU_LIMIT. Resource limits use cgroup v2, so are only supported on Linux",
+			EnvVar: "BUILDKITE_JOB_CPU_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "job-cpu-weight",
+			Value:  "",
+			Usage:  "Each job's share of CPU time when the CPUs are busy, from 1 to 10000. Pipelines can lower it with BUILDKITE_JOB_CPU_WEIGHT",
+			EnvVar: "BUILDKITE_JOB_CPU_WEIGHT",
+		},
+		cli.StringFlag{
+			Name:   "job-memory-limit",
+			Value:  "",
+			Usage:  "How much memory each job can use, e.g. 4GiB. Processes that use more are killed. Pipelines can lower it with BUILDKITE_JOB_MEMORY_LIMIT",
+			EnvVar: "BUILDKITE_JOB_MEMORY_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "job-cgroup-parent",
+			Value:  "",
+			Usage:  "The cgroup to create job cgroups in, when resource limits are set or orphaned processes are reaped. Defaults to the agent's own cgroup, which needs to be delegated to the agent, e.g. with systemd's Delegate=yes",
+			EnvVar: "BUILDKITE_JOB_CGROUP_PARENT",
+		},
+		cli.StringFlag{
+			Name:   "scratch-path",
+			Value:  "",
+			Usage:  "Where to create a scratch directory for each job, which is removed when the job finishes. Jobs get its path as BUILDKITE_SCRATCH_DIR, and TMPDIR is set to it",
+			EnvVar: "BUILDKITE_SCRATCH_PATH",
+		},
+		cli.StringFlag{
+			Name:   "scratch-tmpfs-size",
+			Value:  "",
+			Usage:  "Mount a tmpfs of this size, e.g. 2GiB, as each job's scratch directory, which limits how much the job can put in it. Only supported on Linux, when the agent runs as root",
+			EnvVar: "BUILDKITE_SCRATCH_TMPFS_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "docker-proxy-socket",
+			Value:  "",
+			Usage:  "Listen on this socket with a proxy to Docker that only allows what the docker-proxy flags allow, and point jobs at it with DOCKER_HOST. This only helps if jobs can't also reach the Docker daemon's own socket, e.g. /var/run/docker.sock",
+			EnvVar: "BUILDKITE_DOCKER_PROXY_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "docker-proxy-upstream",
+			Value:  "/var/run/docker.sock",
+			Usage:  "The socket of the Docker daemon to proxy to",
+			EnvVar: "BUILDKITE_DOCKER_PROXY_UPSTREAM",
+		},
+		cli.BoolFlag{
+			Name:   "docker-proxy-allow-privileged",
+			Usage:  "Allow privileged containers and execs, added capabilities and devices through the Docker proxy",
+			EnvVar: "BUILDKITE_DOCKER_PROXY_ALLOW_PRIVILEGED",
+		},
+		cli.StringSliceFlag{
+			Name:   "docker-proxy-allowed-mounts",
+			Value:  &cli.StringSlice{},
+			Usage:  "Host paths that containers can bind mount through the Docker proxy, along with anything in them. The build path is always allowed",
+			EnvVar: "BUILDKITE_DOCKER_PROXY_ALLOWED_MOUNTS",
+		},
+		UsagePathFlag,
+		cli.StringFlag{
+			Name:   "job-status-file",
+			Value:  "",
+			Usage:  "A file to write the status of the running job to as JSON each time it moves to a new phase, for supervisors and sidecars on the host. %agent is replaced with the agent's name",
+			EnvVar: "BUILDKITE_JOB_STATUS_FILE",
+		},
+		ArtifactPostProcessorsFlag,
+		ArtifactSigningKeyFlag,
+		ArtifactURLRewritesFlag,
+		ArtifactUploadDefaultDestinationFlag,
+		MetaDataEncryptionKeyFileFlag,
 		cli.BoolFlag{
 			Name:   "enable-job-log-tmpfile",
 			Usage:  "Store the job logs in a temporary file ′BUILDKITE_JOB_LOG_TMPFILE′ that is accessible during the job and removed at the end of the job",
@@ -291,6 +469,30 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Writes job logs to the agent process' stdout. This simplifies log collection if running agents in Docker.",
 			EnvVar: "BUILDKITE_WRITE_JOB_LOGS_TO_STDOUT",
 		},
+		cli.StringFlag{
+			Name:   "log-upload-rate-limit",
+			Value:  "",
+			Usage:  "The most job log data per second, such as 1MB, that the agent uploads, shared fairly between the jobs it's running. Defaults to no limit",
+			EnvVar: "BUILDKITE_LOG_UPLOAD_RATE_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "job-log-ansi",
+			Value:  "keep",
+			Usage:  "What to do with ANSI escape sequences in job logs: keep them, strip them, or normalize them, which keeps colors and removes the rest",
+			EnvVar: "BUILDKITE_JOB_LOG_ANSI",
+		},
+		cli.StringFlag{
+			Name:   "job-log-progress-sample-interval",
+			Value:  "",
+			Usage:  "If set, progress bars and other lines redrawn with carriage returns are logged at most this often, such as 5s, rather than on every redraw",
+			EnvVar: "BUILDKITE_JOB_LOG_PROGRESS_SAMPLE_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "job-log-max-line-length",
+			Value:  0,
+			Usage:  "If set, job log lines longer than this many bytes are cut short. Defaults to no limit",
+			EnvVar: "BUILDKITE_JOB_LOG_MAX_LINE_LENGTH",
+		},
 		cli.StringFlag{
 			Name:   "shell",
 			Value:  DefaultShell(),
@@ -308,6 +510,11 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Include tags from the host (hostname, machine-id, os)",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_HOST",
 		},
+		cli.BoolFlag{
+			Name:   "tags-from-host-capabilities",
+			Usage:  "Include tags describing what the host can run (docker, docker-version, gpu-count, an xcode tag for each version of Xcode, memory-class)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_HOST_CAPABILITIES",
+		},
 		cli.StringSliceFlag{
 			Name:   "tags-from-ec2-meta-data",
 			Value:  &cli.StringSlice{},
@@ -347,6 +554,34 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Include the host's Google Cloud instance labels as tags",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP_LABELS",
 		},
+		cli.BoolFlag{
+			Name:   "tags-from-azure-meta-data",
+			Usage:  "Include the default set of Azure instance meta-data as tags (vm-id, vm-name, vm-size, location, zone, resource-group, subscription-id, priority and vm-scale-set)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_AZURE_META_DATA",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-azure-tags",
+			Usage:  "Include the host's Azure VM tags as tags",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_AZURE_TAGS",
+		},
+		cli.StringFlag{
+			Name:   "tags-from-k8s-downward-api",
+			Value:  "",
+			Usage:  "Include the pod labels in this file, projected by the Kubernetes downward API, as tags",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_K8S_DOWNWARD_API",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-mapping",
+			Value:  &cli.StringSlice{},
+			Usage:  "Rename tags fetched from the host or a cloud provider using from & to pairs, e.g \"aws:instance-type=instance-type\". An empty name drops the tag, e.g. \"gcp:instance-id=\"",
+			EnvVar: "BUILDKITE_AGENT_TAGS_MAPPING",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "Set job environment variables from the agent's tags, using NAME=template pairs, e.g. \"AWS_REGION={{.region}}\" or \"GPU={{tag `gpu-model`}}\". Variables the job sets itself aren't overwritten",
+			EnvVar: "BUILDKITE_AGENT_TAGS_ENV",
+		},
 		cli.DurationFlag{
 			Name:   "wait-for-ec2-tags-timeout",
 			Usage:  "The amount of time to wait for tags from EC2 before proceeding",
@@ -399,6 +634,53 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.IntFlag{
+			Name:   "git-checkout-retries",
+			Value:  3,
+			Usage:  "How many times to try the checkout, which is at least once for each remote",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-retry-backoff",
+			Value:  "constant:2s",
+			Usage:  "How long to wait between checkout attempts: constant or exponential, optionally with an interval like exponential:2s",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_RETRY_BACKOFF",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-checkout-clean-on",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated git commands that remove the checkout before it's tried again when they fail: checkout, clone, fetch, clean, clean-submodules, or none. Defaults to clone, clean and clean-submodules",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_CLEAN_ON",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-remote-fallbacks",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated git remotes, such as mirrors of the repository, to clone and fetch from in order when the repository can't be",
+			EnvVar: "BUILDKITE_GIT_REMOTE_FALLBACKS",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-layout",
+			Value:  "clone",
+			Usage:  "How checkouts are laid out: clone for a clone of the repository in each, or worktree for worktrees of a bare repository shared by each pipeline's checkouts on the host, which saves disk space and time when agents run many jobs of the same pipeline",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_LAYOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-credentials",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated credentials for the submodules on each host, either a token in an environment variable for https remotes, such as github.com=https-token-env:GITHUB_TOKEN, or a private key for ssh remotes, such as gitlab.example.com=ssh-key:/path/to/key",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_CREDENTIALS",
+		},
+		cli.IntFlag{
+			Name:   "git-submodule-concurrency",
+			Value:  1,
+			Usage:  "How many submodules to fetch and update at once",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_CONCURRENCY",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs-skip-smudge",
+			Usage:  "Leave Git LFS files as pointers when checking out, rather than downloading them. Jobs can download the ones they need with buildkite-agent lfs pull",
+			EnvVar: "BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-mirror-flags",
 			Value:  "-v",
@@ -440,6 +722,36 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "hooks-bundle-url",
+			Value:  "",
+			Usage:  "An https:// or s3:// URL of a gzipped tar of hooks to fetch at startup and use instead of those in hooks-path, so hooks can be managed centrally. An http:// URL can only be used with hooks-bundle-sha256 or hooks-bundle-verification-key",
+			EnvVar: "BUILDKITE_HOOKS_BUNDLE_URL",
+		},
+		cli.StringFlag{
+			Name:   "hooks-bundle-sha256",
+			Value:  "",
+			Usage:  "The SHA-256 the hooks bundle must have, to pin it to a version",
+			EnvVar: "BUILDKITE_HOOKS_BUNDLE_SHA256",
+		},
+		cli.StringFlag{
+			Name:   "hooks-bundle-verification-key",
+			Value:  "",
+			Usage:  "Path to a PEM encoded public key that the hooks bundle's signature, at its URL with .sig added, must be verified with. Signed bundles must have a .bundle-version file with a number, such as the Unix time they were made at, that's no lower than the last one used",
+			EnvVar: "BUILDKITE_HOOKS_BUNDLE_VERIFICATION_KEY",
+		},
+		cli.StringFlag{
+			Name:   "hooks-bundle-path",
+			Value:  defaultHooksBundlePath(),
+			Usage:  "Directory the hooks bundle is unpacked into, which must be outside the build path so jobs can't change the hooks",
+			EnvVar: "BUILDKITE_HOOKS_BUNDLE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hooks-bundle-refresh-interval",
+			Value:  "",
+			Usage:  "How often to fetch the hooks bundle again, such as 15m, so new versions are used by the jobs that start after them. By default it's only fetched at startup",
+			EnvVar: "BUILDKITE_HOOKS_BUNDLE_REFRESH_INTERVAL",
+		},
 		cli.StringFlag{
 			Name:   "sockets-path",
 			Value:  defaultSocketsPath(),
@@ -462,6 +774,11 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, disabled by default",
 			EnvVar: "BUILDKITE_AGENT_HEALTH_CHECK_ADDR",
 		},
+		cli.StringFlag{
+			Name:   "handoff-socket",
+			Usage:  "A socket for agents on this host to hand over to each other on, for upgrades without draining. A new agent started with the same socket takes over, and the agent it replaces stops accepting jobs and exits once its current jobs have finished. Requests from the agent's own jobs are refused. Only supported on Linux",
+			EnvVar: "BUILDKITE_AGENT_HANDOFF_SOCKET",
+		},
 		cli.BoolFlag{
 			Name:   "no-pty",
 			Usage:  "Do not run jobs within a pseudo terminal",
@@ -497,27 +814,14 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't automatically checkout git submodules",
 			EnvVar: "BUILDKITE_NO_GIT_SUBMODULES,BUILDKITE_DISABLE_GIT_SUBMODULES",
 		},
-		cli.BoolFlag{
-			Name:   "metrics-datadog",
-			Usage:  "Send metrics to DogStatsD for Datadog",
-			EnvVar: "BUILDKITE_METRICS_DATADOG",
-		},
+		MetricsDatadogFlag,
 		cli.BoolFlag{
 			Name:   "no-feature-reporting",
 			Usage:  "Disables sending a list of enabled features back to the Buildkite mothership. We use this information to measure feature usage, but if you're not comfortable sharing that information then that's totally okay :)",
 			EnvVar: "BUILDKITE_AGENT_NO_FEATURE_REPORTING",
 		},
-		cli.StringFlag{
-			Name:   "metrics-datadog-host",
-			Usage:  "The dogstatsd instance to send metrics to using udp",
-			EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
-			Value:  "127.0.0.1:8125",
-		},
-		cli.BoolFlag{
-			Name:   "metrics-datadog-distributions",
-			Usage:  "Use Datadog Distributions for Timing metrics",
-			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
-		},
+		MetricsDatadogHostFlag,
+		MetricsDatadogDistributionsFlag,
 		cli.StringFlag{
 			Name:   "log-format",
 			Usage:  "The format to use for the logger output",
@@ -537,10 +841,16 @@ var AgentStartCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "cancel-signal",
-			Usage:  "The signal to use for cancellation",
+			Usage:  "The signal to use for cancellation. Pipelines can override it with BUILDKITE_CANCEL_SIGNAL",
 			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
 			Value:  "SIGTERM",
 		},
+		cli.StringFlag{
+			Name:   "cancel-signal-target",
+			Usage:  "Which processes to signal for cancellation, \"process-group\" or \"session\". Use \"session\" to also signal processes that start their own process group. Pipelines can override it with BUILDKITE_CANCEL_SIGNAL_TARGET",
+			EnvVar: "BUILDKITE_CANCEL_SIGNAL_TARGET",
+			Value:  "process-group",
+		},
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  `Enable tracing for build jobs by specifying a backend, "datadog" or "opentelemetry"`,
@@ -556,9 +866,11 @@ var AgentStartCommand = cli.Command{
 
 		// API Flags
 		AgentRegisterTokenFlag,
+		AgentSecondaryTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -566,6 +878,7 @@ var AgentStartCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 		RedactedVars,
 
 		// Deprecated flags which will be removed in v4
@@ -630,7 +943,7 @@ var AgentStartCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(cfg)
@@ -652,7 +965,7 @@ var AgentStartCommand = cli.Command{
 		err = UnsetConfigFromEnvironment(c)
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		// Check if git-mirrors are enabled
@@ -714,6 +1027,122 @@ var AgentStartCommand = cli.Command{
 			cfg.DisconnectAfterIdleTimeout = cfg.DisconnectAfterJobTimeout
 		}
 
+		maintenanceWindows, err := agent.ParseMaintenanceWindows(cfg.MaintenanceWindows)
+		if err != nil {
+			l.Fatal("Failed to parse maintenance-windows: %v", err)
+		}
+
+		cancelSignalTarget, err := process.ParseSignalTarget(cfg.CancelSignalTarget)
+		if err != nil {
+			l.Fatal("Failed to parse cancel-signal-target: %v", err)
+		}
+
+		jobLimits, err := parseJobResourceLimits(cfg)
+		if err != nil {
+			l.Fatal("%v", err)
+		}
+
+		var scratchTmpfsSize uint64
+		if cfg.ScratchTmpfsSize != "" {
+			if cfg.ScratchPath == "" {
+				l.Fatal("scratch-tmpfs-size needs scratch-path to be set")
+			}
+			if runtime.GOOS != "linux" {
+				l.Fatal("scratch-tmpfs-size is only supported on Linux")
+			}
+			if scratchTmpfsSize, err = humanize.ParseBytes(cfg.ScratchTmpfsSize); err != nil || scratchTmpfsSize == 0 {
+				l.Fatal("Failed to parse scratch-tmpfs-size: %q isn't a size, e.g. 2GiB", cfg.ScratchTmpfsSize)
+			}
+		}
+
+		var logUploadLimiter *rate.Limiter
+		if cfg.LogUploadRateLimit != "" {
+			bytesPerSecond, err := humanize.ParseBytes(cfg.LogUploadRateLimit)
+			if err != nil || bytesPerSecond == 0 {
+				l.Fatal("Failed to parse log-upload-rate-limit: %q isn't a size, e.g. 1MB", cfg.LogUploadRateLimit)
+			}
+			// Allow a second's worth at once, and at least a whole chunk
+			burst := int(bytesPerSecond)
+			if burst < 1024*1024 {
+				burst = 1024 * 1024
+			}
+			logUploadLimiter = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+		}
+
+		if cfg.ArtifactDefaultDestination != "" {
+			if _, err := destination.Parse(cfg.ArtifactDefaultDestination); err != nil {
+				l.Fatal("Invalid artifact-upload-default-destination: %s", err)
+			}
+		}
+
+		var hooksBundle *agent.HooksBundle
+		var hooksBundleRefreshInterval time.Duration
+		if cfg.HooksBundleURL != "" {
+			if t := cfg.HooksBundleRefreshInterval; t != "" {
+				hooksBundleRefreshInterval, err = time.ParseDuration(t)
+				if err != nil || hooksBundleRefreshInterval <= 0 {
+					l.Fatal("Failed to parse hooks-bundle-refresh-interval: %q isn't a duration, e.g. 15m", t)
+				}
+			}
+
+			// Jobs can write anywhere in the build path, so hooks there could
+			// be changed by one job to run in every later one
+			if rel, err := filepath.Rel(cfg.BuildPath, cfg.HooksBundlePath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				l.Fatal("hooks-bundle-path %s can't be within the build path %s, where jobs could change the hooks", cfg.HooksBundlePath, cfg.BuildPath)
+			}
+
+			hooksBundle, err = agent.NewHooksBundle(l, agent.HooksBundleConfig{
+				URL:                 cfg.HooksBundleURL,
+				SHA256:              cfg.HooksBundleSHA256,
+				VerificationKeyPath: cfg.HooksBundleVerificationKey,
+				Dir:                 cfg.HooksBundlePath,
+			})
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			if _, err := hooksBundle.Fetch(ctx); err != nil {
+				l.Fatal("%s", err)
+			}
+			// The agent's own hooks, such as agent-shutdown, come from the
+			// version it started with, so it's kept for as long as it runs
+			cfg.HooksPath, _ = hooksBundle.Acquire()
+		}
+
+		var remoteControlAuditLog *agent.RemoteControlAuditLog
+		if cfg.RemoteControlAuditLog != "" {
+			remoteControlAuditLog, err = agent.OpenRemoteControlAuditLog(cfg.RemoteControlAuditLog)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			defer remoteControlAuditLog.Close()
+		}
+
+		if cfg.ReapOrphanedProcesses && runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+			l.Fatal("reap-orphaned-processes is only supported on Linux and Windows")
+		}
+
+		// Jobs on Linux run in a cgroup of their own to limit their
+		// resources, and to find the processes they leave running
+		var jobCgroupParent string
+		if !jobLimits.IsZero() || (cfg.ReapOrphanedProcesses && runtime.GOOS == "linux") {
+			if runtime.GOOS != "linux" {
+				l.Fatal("Job resource limits are only supported on Linux")
+			}
+
+			jobCgroupParent = cfg.JobCgroupParent
+			if jobCgroupParent == "" {
+				if jobCgroupParent, err = cgroup.Own(); err != nil {
+					l.Fatal("Failed to find the agent's cgroup to create job cgroups in: %v", err)
+				}
+			}
+			if err := cgroup.Prepare(jobCgroupParent); err != nil {
+				l.Fatal("Failed to set up %s for job cgroups: %v", jobCgroupParent, err)
+			}
+			if !jobLimits.IsZero() {
+				l.Info("Jobs will be limited to %s", jobLimits)
+			}
+		}
+
 		var ec2TagTimeout time.Duration
 		if t := cfg.WaitForEC2TagsTimeout; t != "" {
 			var err error
@@ -750,6 +1179,31 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		if _, _, err := agent.ParseRetryBackoff(cfg.GitCheckoutRetryBackoff); err != nil {
+			l.Fatal("Invalid --git-checkout-retry-backoff: %s", err)
+		}
+		if err := bootstrap.ValidateCheckoutLayout(cfg.GitCheckoutLayout); err != nil {
+			l.Fatal("Invalid --git-checkout-layout: %s", err)
+		}
+		if cfg.GitSubmoduleConcurrency < 1 {
+			l.Fatal("Invalid --git-submodule-concurrency %d, it must be at least 1", cfg.GitSubmoduleConcurrency)
+		}
+
+		jobLogFilter := agent.JobLogFilterConfig{
+			ANSI:          cfg.JobLogANSI,
+			MaxLineLength: cfg.JobLogMaxLineLength,
+		}
+		if t := cfg.JobLogProgressSample; t != "" {
+			var err error
+			jobLogFilter.ProgressSampleInterval, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse job log progress sample interval: %v", err)
+			}
+		}
+		if err := jobLogFilter.Validate(); err != nil {
+			l.Fatal("%v", err)
+		}
+
 		mc := metrics.NewCollector(l, metrics.CollectorConfig{
 			Datadog:              cfg.MetricsDatadog,
 			DatadogHost:          cfg.MetricsDatadogHost,
@@ -770,12 +1224,21 @@ var AgentStartCommand = cli.Command{
 			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
 			GitMirrorsSkipUpdate:       cfg.GitMirrorsSkipUpdate,
 			HooksPath:                  cfg.HooksPath,
+			HooksBundle:                hooksBundle,
 			PluginsPath:                cfg.PluginsPath,
 			GitCheckoutFlags:           cfg.GitCheckoutFlags,
 			GitCloneFlags:              cfg.GitCloneFlags,
 			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
 			GitCleanFlags:              cfg.GitCleanFlags,
 			GitFetchFlags:              cfg.GitFetchFlags,
+			GitCheckoutRetries:         cfg.GitCheckoutRetries,
+			GitCheckoutRetryBackoff:    cfg.GitCheckoutRetryBackoff,
+			GitCheckoutCleanOn:         cfg.GitCheckoutCleanOn,
+			GitRemoteFallbacks:         cfg.GitRemoteFallbacks,
+			GitCheckoutLayout:          cfg.GitCheckoutLayout,
+			GitSubmoduleCredentials:    cfg.GitSubmoduleCredentials,
+			GitSubmoduleConcurrency:    cfg.GitSubmoduleConcurrency,
+			GitLFSSkipSmudge:           cfg.GitLFSSkipSmudge,
 			GitSubmodules:              !cfg.NoGitSubmodules,
 			SSHKeyscan:                 !cfg.NoSSHKeyscan,
 			CommandEval:                !cfg.NoCommandEval,
@@ -786,9 +1249,26 @@ var AgentStartCommand = cli.Command{
 			TimestampLines:             cfg.TimestampLines,
 			DisconnectAfterJob:         cfg.DisconnectAfterJob,
 			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
+			MaintenanceWindows:         maintenanceWindows,
 			CancelGracePeriod:          cfg.CancelGracePeriod,
+			CancelSignalTarget:         cancelSignalTarget,
+			ReapOrphanedProcesses:      cfg.ReapOrphanedProcesses,
+			AnnotateJobResources:       cfg.AnnotateJobResources,
+			JobResourceLimits:          jobLimits,
+			JobCgroupParent:            jobCgroupParent,
+			ScratchPath:                cfg.ScratchPath,
+			ScratchTmpfsSize:           scratchTmpfsSize,
+			DockerProxySocket:          cfg.DockerProxySocket,
+			UsagePath:                  cfg.UsagePath,
+			JobStatusFile:              cfg.JobStatusFile,
+			ArtifactPostProcessors:     cfg.ArtifactPostProcessors,
+			ArtifactSigningKey:         cfg.ArtifactSigningKey,
+			ArtifactURLRewrites:        cfg.ArtifactURLRewrites,
+			ArtifactDefaultDestination: cfg.ArtifactDefaultDestination,
+			MetaDataEncryptionKeyFile:  cfg.MetaDataEncryptionKeyFile,
 			EnableJobLogTmpfile:        cfg.EnableJobLogTmpfile,
 			WriteJobLogsToStdout:       cfg.WriteJobLogsToStdout,
+			JobLogFilter:               jobLogFilter,
 			LogFormat:                  cfg.LogFormat,
 			Shell:                      cfg.Shell,
 			RedactedVars:               cfg.RedactedVars,
@@ -860,6 +1340,10 @@ var AgentStartCommand = cli.Command{
 			l.Info("Agents will disconnect after %d seconds of inactivity", agentConf.DisconnectAfterIdleTimeout)
 		}
 
+		for _, window := range agentConf.MaintenanceWindows {
+			l.Info("Agents won't accept new jobs during the maintenance window %q", window)
+		}
+
 		cancelSig, err := process.ParseSignal(cfg.CancelSignal)
 		if err != nil {
 			l.Fatal("Failed to parse cancel-signal: %v", err)
@@ -878,6 +1362,13 @@ var AgentStartCommand = cli.Command{
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "Token"))
 
+		// And one for the secondary token, to switch to when the primary is
+		// revoked during a rotation
+		var secondaryClient agent.APIClient
+		if cfg.SecondaryToken != "" {
+			secondaryClient = api.NewClient(l, loadAPIClientConfig(cfg, "SecondaryToken"))
+		}
+
 		// The registration request for all agents
 		registerReq := api.AgentRegisterRequest{
 			Name:              cfg.Name,
@@ -892,7 +1383,12 @@ var AgentStartCommand = cli.Command{
 				TagsFromGCPMetaData:       (cfg.TagsFromGCPMetaData || cfg.TagsFromGCP),
 				TagsFromGCPMetaDataPaths:  cfg.TagsFromGCPMetaDataPaths,
 				TagsFromGCPLabels:         cfg.TagsFromGCPLabels,
+				TagsFromAzureMetaData:     cfg.TagsFromAzureMetaData,
+				TagsFromAzureTags:         cfg.TagsFromAzureTags,
+				TagsFromK8sDownwardAPI:    cfg.TagsFromK8sDownwardAPI,
 				TagsFromHost:              cfg.TagsFromHost,
+				TagsFromHostCapabilities:  cfg.TagsFromHostCapabilities,
+				TagsMapping:               cfg.TagsMapping,
 				WaitForEC2TagsTimeout:     ec2TagTimeout,
 				WaitForEC2MetaDataTimeout: ec2MetaDataTimeout,
 				WaitForECSMetaDataTimeout: ecsMetaDataTimeout,
@@ -905,6 +1401,14 @@ var AgentStartCommand = cli.Command{
 			Features:           cfg.Features(),
 		}
 
+		// Now the tags are known, work out the environment variables jobs
+		// get from them
+		tagsEnv, err := agent.TagsEnv(registerReq.Tags, cfg.TagsEnv)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		agentConf.TagsEnv = tagsEnv
+
 		// Spawning multiple agents doesn't work if the agent is being
 		// booted in acquisition mode
 		if cfg.Spawn > 1 && cfg.AcquireJob != "" {
@@ -935,11 +1439,23 @@ var AgentStartCommand = cli.Command{
 			}
 
 			// Register the agent with the buildkite API
-			ag, err := agent.Register(ctx, l, client, registerReq)
+			ag, err := agent.RegisterWithSecondary(ctx, l, client, secondaryClient, registerReq)
 			if err != nil {
 				l.Fatal("%s", err)
 			}
 
+			// With a secondary token, agents whose access tokens are revoked
+			// register again rather than disconnecting
+			var reregister func(context.Context, []string) (*api.AgentRegisterResponse, error)
+			if secondaryClient != nil {
+				req := registerReq
+				reregister = func(ctx context.Context, tags []string) (*api.AgentRegisterResponse, error) {
+					req := req
+					req.Tags = tags
+					return agent.RegisterWithSecondary(ctx, l, client, secondaryClient, req)
+				}
+			}
+
 			// Create an agent worker to run the agent
 			workers = append(workers,
 				agent.NewAgentWorker(
@@ -950,6 +1466,11 @@ var AgentStartCommand = cli.Command{
 						DebugHTTP:          cfg.DebugHTTP,
 						SpawnIndex:         i,
 						AgentStdout:        os.Stdout,
+						Reregister:         reregister,
+						LogUploadLimiter:   logUploadLimiter,
+						TagsEnvMappings:    cfg.TagsEnv,
+
+						RemoteControlAuditLog: remoteControlAuditLog,
 					}))
 		}
 
@@ -964,6 +1485,20 @@ var AgentStartCommand = cli.Command{
 			l.Fatal("%s", err)
 		}
 
+		// Take over from the agent that's listening on the handoff socket,
+		// if there is one, before listening on anything it is
+		if cfg.HandoffSocket != "" {
+			handoffCtx, cancelHandoff := context.WithTimeout(ctx, 30*time.Second)
+			pid, err := agent.RequestHandoff(handoffCtx, cfg.HandoffSocket)
+			cancelHandoff()
+			switch {
+			case err == nil:
+				l.Info("Took over from agent process %d, which will exit once its current jobs have finished", pid)
+			case !errors.Is(err, agent.ErrNoHandoff):
+				l.Fatal("Failed to take over from the running agent: %s", err)
+			}
+		}
+
 		// Handle process signals
 		signals := handlePoolSignals(ctx, l, pool)
 		defer close(signals)
@@ -972,6 +1507,7 @@ var AgentStartCommand = cli.Command{
 		l.Info("You can press Ctrl-C to stop the agents")
 
 		// Determine the health check listening address and port for this agent
+		var healthCheckServer *http.Server
 		if cfg.HealthCheckAddr != "" {
 			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 				l.Info("%s %s", r.Method, r.URL.Path)
@@ -986,19 +1522,68 @@ var AgentStartCommand = cli.Command{
 				http.HandleFunc("/status", status.Handle)
 			}
 
+			healthCheckServer = &http.Server{Addr: cfg.HealthCheckAddr}
 			go func() {
 				_, setStatus, done := status.AddSimpleItem(ctx, "Health check server")
 				defer done()
 				setStatus("👂 Listening")
 
 				l.Notice("Starting HTTP health check server on %v", cfg.HealthCheckAddr)
-				err := http.ListenAndServe(cfg.HealthCheckAddr, nil)
-				if err != nil {
+				err := healthCheckServer.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
 					l.Error("Could not start health check server: %v", err)
 				}
 			}()
 		}
 
+		if cfg.DockerProxySocket != "" {
+			policy := dockerproxy.Policy{
+				AllowPrivileged: cfg.DockerProxyAllowPrivileged,
+				AllowedMounts:   append([]string{cfg.BuildPath}, cfg.DockerProxyAllowedMounts...),
+			}
+			if cfg.ScratchPath != "" {
+				policy.AllowedMounts = append(policy.AllowedMounts, cfg.ScratchPath)
+			}
+
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Docker proxy")
+				defer done()
+				setStatus("👂 Listening")
+
+				l.Notice("Starting Docker proxy on %s, allowing mounts of %s", cfg.DockerProxySocket, strings.Join(policy.AllowedMounts, ", "))
+				proxy := dockerproxy.New(l, cfg.DockerProxyUpstream, policy)
+				if err := proxy.ListenAndServe(ctx, cfg.DockerProxySocket); err != nil {
+					l.Error("Could not start Docker proxy: %v", err)
+				}
+			}()
+		}
+
+		// Hand over to a newer agent that asks to, freeing what it needs to
+		// listen on, and finishing the current jobs without accepting more
+		if cfg.HandoffSocket != "" {
+			handoff, err := agent.ListenForHandoff(l, cfg.HandoffSocket, jobCgroupParent, func(pid int) {
+				l.Info("Handing over to agent process %d. Waiting for the current jobs to finish before exiting", pid)
+				if healthCheckServer != nil {
+					healthCheckServer.Close()
+				}
+				pool.Stop(true)
+			})
+			if err != nil {
+				l.Fatal("Failed to listen for a handoff: %s", err)
+			}
+			defer handoff.Close()
+		}
+
+		if hooksBundle != nil && hooksBundleRefreshInterval > 0 {
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Hooks bundle")
+				defer done()
+				setStatus(fmt.Sprintf("🔄 Refreshing every %s", hooksBundleRefreshInterval))
+
+				hooksBundle.Refresh(ctx, hooksBundleRefreshInterval)
+			}()
+		}
+
 		// Start the agent pool
 		if err := pool.Start(ctx); err != nil {
 			l.Fatal("%s", err)
@@ -1102,6 +1687,15 @@ func agentLifecycleHook(hookName string, log logger.Logger, cfg AgentStartConfig
 	return nil
 }
 
+func defaultHooksBundlePath() string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "buildkite-hooks-bundle")
+	}
+
+	return filepath.Join(home, ".buildkite-agent", "hooks-bundle")
+}
+
 func defaultSocketsPath() string {
 	home, err := homedir.Dir()
 	if err != nil {
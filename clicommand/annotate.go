@@ -2,14 +2,17 @@ package clicommand
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"time"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/agent/v3/stdin"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
@@ -37,8 +40,13 @@ Description:
    Annotations are written in CommonMark-compliant Markdown, with "GitHub
    Flavored Markdown" extensions.
 
-   The annotation body can be supplied as a command line argument, or by piping
-   content into the command. The maximum size of each annotation body is 1MiB.
+   The annotation body can be supplied as a command line argument, read from a
+   file with --file, or piped into the command. The maximum size of each
+   annotation body is 1MiB.
+
+   With --validate, the body and style are checked before the annotation is
+   sent, and any HTML that Buildkite would remove, unclosed code blocks, or
+   invalid UTF-8 are reported with their line numbers.
 
    You can update an existing annotation's body by running the annotate command
    again and provide the same context as the one you want to update. Or if you
@@ -52,27 +60,33 @@ Example:
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
+   $ buildkite-agent annotate --file report.md --validate
    $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
 
 type AnnotateConfig struct {
-	Body    string `cli:"arg:0" label:"annotation body"`
-	Style   string `cli:"style"`
-	Context string `cli:"context"`
-	Append  bool   `cli:"append"`
-	Job     string `cli:"job" validate:"required"`
+	Body     string `cli:"arg:0" label:"annotation body"`
+	Style    string `cli:"style"`
+	Context  string `cli:"context"`
+	Append   bool   `cli:"append"`
+	File     string `cli:"file"`
+	Validate bool   `cli:"validate"`
+	Job      string `cli:"job" validate:"required"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -95,6 +109,16 @@ var AnnotateCommand = cli.Command{
 			Usage:  "Append to the body of an existing annotation",
 			EnvVar: "BUILDKITE_ANNOTATION_APPEND",
 		},
+		cli.StringFlag{
+			Name:   "file",
+			Usage:  "Read the body of the annotation from a file",
+			EnvVar: "BUILDKITE_ANNOTATION_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "validate",
+			Usage:  "Check the annotation for problems before sending it, and fail if there are any",
+			EnvVar: "BUILDKITE_ANNOTATION_VALIDATE",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -107,6 +131,8 @@ var AnnotateCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -114,6 +140,7 @@ var AnnotateCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -125,7 +152,7 @@ var AnnotateCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -139,6 +166,10 @@ var AnnotateCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
 		if err := annotate(ctx, cfg, l); err != nil {
 			l.Fatal(err.Error())
 		}
@@ -148,8 +179,21 @@ var AnnotateCommand = cli.Command{
 func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 	var body string
 
+	if cfg.Body != "" && cfg.File != "" {
+		return errors.New("An annotation body can't be given as an argument and with --file")
+	}
+
 	if cfg.Body != "" {
 		body = cfg.Body
+	} else if cfg.File != "" {
+		l.Info("Reading annotation body from %s", cfg.File)
+
+		b, err := readAnnotationFile(cfg.File)
+		if err != nil {
+			return fmt.Errorf("Failed to read annotation file: %w", err)
+		}
+
+		body = string(b)
 	} else if stdin.IsReadable() {
 		l.Info("Reading annotation body from STDIN")
 
@@ -162,7 +206,13 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 		body = string(stdin[:])
 	}
 
-	if bodySize := len(cfg.Body); bodySize > maxBodySize {
+	if cfg.Validate {
+		if err := validateAnnotation(body, cfg.Style); err != nil {
+			return err
+		}
+	}
+
+	if bodySize := len(body); bodySize > maxBodySize {
 		return fmt.Errorf("Annotation body size (%dB) exceeds maximum (%dB)", bodySize, maxBodySize)
 	}
 
@@ -182,7 +232,7 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 		roko.WithMaxAttempts(5),
 		roko.WithStrategy(roko.Constant(1*time.Second)),
 		roko.WithJitter(),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
+	).DoWithContext(ctx, retrylog.Wrap("Annotating build", func(r *roko.Retrier) error {
 		// Attempt to create the annotation
 		resp, err := client.Annotate(ctx, cfg.Job, annotation)
 
@@ -198,10 +248,19 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 			return err
 		}
 		return nil
-	})
+	}))
 
-	// Show a fatal error if we gave up trying to create the annotation
+	// Save the annotation for the job runner to try again before the job
+	// finishes if the API couldn't be reached, otherwise give up
 	if err != nil {
+		deferred, deferErr := agent.DeferWrite(os.Getenv(agent.PendingWritesDirEnv), err, agent.PendingWrite{JobID: cfg.Job, Annotation: annotation})
+		if deferErr != nil {
+			l.Warn("Couldn't save the annotation to try again later: %v", deferErr)
+		}
+		if deferred {
+			l.Warn("Couldn't annotate build, it will be tried again before the job finishes: %v", err)
+			return nil
+		}
 		return fmt.Errorf("Failed to annotate build: %w", err)
 	}
 
@@ -209,3 +268,16 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 
 	return nil
 }
+
+// readAnnotationFile reads an annotation body from a file. It stops reading
+// just past the maximum body size, so that a huge file is reported as too big
+// without being read into memory in its entirety.
+func readAnnotationFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, maxBodySize+1))
+}
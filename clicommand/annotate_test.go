@@ -5,6 +5,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -51,3 +53,41 @@ func TestAnnotateMaxBodySize(t *testing.T) {
 	err := annotate(ctx, cfg, l)
 	assert.Error(t, err, "Annotation body size (1048577) exceeds maximum (1048576)")
 }
+
+func TestAnnotateFromFile(t *testing.T) {
+	server := newAnnotateTestServer(t)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "report.md")
+	err := os.WriteFile(path, []byte("# Report\n\nAll good :rocket:\n"), 0o666)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	cfg := AnnotateConfig{
+		File:             path,
+		Validate:         true,
+		Job:              "jobid",
+		AgentAccessToken: "agentaccesstoken",
+		Endpoint:         server.URL,
+	}
+	l := logger.NewBuffer()
+
+	err = annotate(ctx, cfg, l)
+	assert.NoError(t, err)
+	assert.Contains(t, l.Messages, "[debug] Successfully annotated build")
+}
+
+func TestAnnotateFileMaxBodySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.md")
+	err := os.WriteFile(path, []byte(strings.Repeat("a", 2*1048576)), 0o666)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	cfg := AnnotateConfig{
+		File: path,
+	}
+	l := logger.NewBuffer()
+
+	err = annotate(ctx, cfg, l)
+	assert.ErrorContains(t, err, "exceeds maximum")
+}
@@ -0,0 +1,86 @@
+package clicommand
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// annotationStyles are the styles that Buildkite accepts for an annotation
+var annotationStyles = []string{"success", "info", "warning", "error"}
+
+// annotationUnsupportedHTML matches HTML that Buildkite strips from
+// annotations when it sanitises them, so it never shows up in the build
+var annotationUnsupportedHTML = regexp.MustCompile(`(?i)<\s*(script|style|iframe|frame|object|embed|form|input|button|textarea|select|link|meta|base)\b|\bjavascript:|<[^>]*\son[a-z]+\s*=`)
+
+// annotationValidationError lists the problems found with an annotation
+type annotationValidationError struct {
+	problems []string
+}
+
+func (e *annotationValidationError) Error() string {
+	return fmt.Sprintf("Annotation is invalid:\n  - %s", strings.Join(e.problems, "\n  - "))
+}
+
+// validateAnnotation checks an annotation body and style before it's sent to
+// Buildkite, so that problems can be reported in more detail than the API
+// gives.
+func validateAnnotation(body, style string) error {
+	var problems []string
+
+	if len(body) > maxBodySize {
+		problems = append(problems, fmt.Sprintf("body size (%dB) exceeds maximum (%dB)", len(body), maxBodySize))
+	}
+
+	if !utf8.ValidString(body) {
+		problems = append(problems, "body is not valid UTF-8")
+	}
+
+	if style != "" && !contains(annotationStyles, style) {
+		problems = append(problems, fmt.Sprintf("style %q is not one of %s", style, strings.Join(annotationStyles, ", ")))
+	}
+
+	fence := ""
+	fenceLine := 0
+	for i, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Track fenced code blocks, as HTML inside them is shown as-is
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			marker := trimmed[:3]
+			switch {
+			case fence == "":
+				fence, fenceLine = marker, i+1
+			case marker == fence:
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		if match := annotationUnsupportedHTML.FindString(line); match != "" {
+			problems = append(problems, fmt.Sprintf("line %d: %q is not supported in annotations and will be removed", i+1, strings.TrimSpace(match)))
+		}
+	}
+
+	if fence != "" {
+		problems = append(problems, fmt.Sprintf("line %d: code block is never closed", fenceLine))
+	}
+
+	if len(problems) > 0 {
+		return &annotationValidationError{problems: problems}
+	}
+	return nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
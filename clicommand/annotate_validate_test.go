@@ -0,0 +1,72 @@
+package clicommand
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAnnotation(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		body         string
+		style        string
+		wantProblems []string
+	}{
+		{
+			name:  "valid",
+			body:  "# Tests\n\n<details><summary>Results</summary>\n\nAll passed\n</details>\n",
+			style: "success",
+		},
+		{
+			name:         "unknown style",
+			body:         "llamas",
+			style:        "llama",
+			wantProblems: []string{`style "llama" is not one of success, info, warning, error`},
+		},
+		{
+			name:         "script tag",
+			body:         "ok\n<script>alert(1)</script>\n",
+			wantProblems: []string{`line 2: "<script" is not supported in annotations and will be removed`},
+		},
+		{
+			name: "html in a code block",
+			body: "```html\n<script>alert(1)</script>\n```\n",
+		},
+		{
+			name:         "unclosed code block",
+			body:         "text\n~~~\ncode\n",
+			wantProblems: []string{"line 2: code block is never closed"},
+		},
+		{
+			name:         "invalid utf-8",
+			body:         "\xff",
+			wantProblems: []string{"body is not valid UTF-8"},
+		},
+		{
+			name:         "too big",
+			body:         strings.Repeat("a", maxBodySize+1),
+			wantProblems: []string{"body size (1048577B) exceeds maximum (1048576B)"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateAnnotation(tc.body, tc.style)
+			if tc.wantProblems == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			var verr *annotationValidationError
+			if assert.True(t, errors.As(err, &verr), "validateAnnotation() error = %v", err) {
+				assert.Equal(t, tc.wantProblems, verr.problems)
+			}
+		})
+	}
+}
@@ -3,11 +3,11 @@ package clicommand
 import (
 	"context"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
@@ -33,17 +33,20 @@ type AnnotationRemoveConfig struct {
 	Job     string `cli:"job" validate:"required"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var AnnotationRemoveCommand = cli.Command{
@@ -69,6 +72,8 @@ var AnnotationRemoveCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -76,6 +81,7 @@ var AnnotationRemoveCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -87,7 +93,7 @@ var AnnotationRemoveCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -101,6 +107,10 @@ var AnnotationRemoveCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -109,7 +119,7 @@ var AnnotationRemoveCommand = cli.Command{
 			roko.WithMaxAttempts(5),
 			roko.WithStrategy(roko.Constant(1*time.Second)),
 			roko.WithJitter(),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Removing annotation", func(r *roko.Retrier) error {
 			// Attempt to remove the annotation
 			resp, err := client.AnnotationRemove(ctx, cfg.Job, cfg.Context)
 
@@ -125,7 +135,7 @@ var AnnotationRemoveCommand = cli.Command{
 				return err
 			}
 			return nil
-		})
+		}))
 
 		// Show a fatal error if we gave up trying to create the annotation
 		if err != nil {
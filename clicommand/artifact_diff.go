@@ -0,0 +1,182 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const diffHelpDescription = `Usage:
+
+   buildkite-agent artifact diff [options...] <query> <local-dir>
+
+Description:
+
+   Compares the files in a local directory with the artifacts matching a
+   search query, using the checksums generated when the artifacts were
+   uploaded. Files that aren't artifacts are shown as added, files whose
+   checksum doesn't match as changed, and artifacts that aren't in the
+   directory as missing.
+
+   The command exits with status 1 if there are any differences, so it can be
+   used to check that a deploy bundle matches what was built.
+
+   Note: You need to ensure that your search query is surrounded by quotes if
+   using a wild card as the built-in shell path globbing will provide files,
+   which will break the search.
+
+Example:
+
+   $ buildkite-agent artifact diff "dist/*" deploy --step "build" --build xxx
+
+   Artifacts are compared with where 'artifact download' would put them in the
+   directory, so this compares the artifact "dist/app.js" with
+   deploy/dist/app.js.
+
+   $ buildkite-agent artifact diff "dist/*" deploy --json`
+
+type ArtifactDiffConfig struct {
+	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
+	Directory          string `cli:"arg:1" label:"local directory" validate:"required"`
+	Step               string `cli:"step"`
+	Build              string `cli:"build" validate:"required"`
+	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	JSON               bool   `cli:"json"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+}
+
+var ArtifactDiffCommand = cli.Command{
+	Name:        "diff",
+	Usage:       "Compares a local directory with artifacts matching a search query",
+	Description: diffHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "Scope the search to a particular step by its name or job ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			EnvVar: "BUILDKITE_BUILD_ID",
+			Usage:  "The build that the artifacts were uploaded to",
+		},
+		cli.BoolFlag{
+			Name:   "include-retried-jobs",
+			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
+			Usage:  "Include artifacts from retried jobs in the search",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the differences as JSON",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ArtifactDiffConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+		artifacts, err := agent.NewArtifactSearcher(l, client, cfg.Build).
+			Search(ctx, cfg.Query, cfg.Step, cfg.IncludeRetriedJobs, false)
+		if err != nil {
+			l.Fatal("Error searching for artifacts: %s", err)
+		}
+
+		diff, err := agent.DiffArtifacts(artifacts, cfg.Directory)
+		if err != nil {
+			l.Fatal("Failed to compare artifacts with %s: %s", cfg.Directory, err)
+		}
+
+		if cfg.JSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(diff); err != nil {
+				l.Fatal("Failed to encode differences: %s", err)
+			}
+		} else {
+			printArtifactDiff(os.Stdout, diff)
+		}
+
+		if !diff.Empty() {
+			exit(1)
+		}
+	},
+}
+
+func printArtifactDiff(w io.Writer, diff *agent.ArtifactDiff) {
+	for _, p := range diff.Added {
+		fmt.Fprintf(w, "added    %s\n", p)
+	}
+	for _, p := range diff.Changed {
+		fmt.Fprintf(w, "changed  %s\n", p)
+	}
+	for _, p := range diff.Missing {
+		fmt.Fprintf(w, "missing  %s\n", p)
+	}
+	fmt.Fprintf(w, "%d added, %d changed, %d missing, %d unchanged\n",
+		len(diff.Added), len(diff.Changed), len(diff.Missing), len(diff.Unchanged))
+}
@@ -0,0 +1,27 @@
+package clicommand
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintArtifactDiff(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	printArtifactDiff(&buf, &agent.ArtifactDiff{
+		Added:     []string{"extra.txt"},
+		Changed:   []string{"bin/tool"},
+		Missing:   []string{"lib/missing.so"},
+		Unchanged: []string{"bin/app", "README.md"},
+	})
+
+	assert.Equal(t, `added    extra.txt
+changed  bin/tool
+missing  lib/missing.so
+1 added, 1 changed, 1 missing, 2 unchanged
+`, buf.String())
+}
@@ -2,18 +2,27 @@ package clicommand
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/destination"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/transfer"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 )
 
 const downloadHelpDescription = `Usage:
 
    buildkite-agent artifact download [options] <query> <destination>
+   buildkite-agent artifact download [options] --id <id> <destination>
 
 Description:
 
@@ -46,27 +55,295 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   Tools that have already found the exact artifacts they want, such as with
+   the REST API, can download them by ID instead of searching. Each of them
+   has to be found, whichever job of the build uploaded it:
+
+   $ buildkite-agent artifact download --id 0185d67a-4a1c-4f3b-9d45-1f3d6c5e8b21 --id 0185d67a-5b2d-4e6f-8a01-2b4c7d9e0f32 . --build xxx
+
+   The artifacts the search finds can be narrowed down further with
+   gitignore-style patterns, such as to download logs but not temporary files:
+
+   $ buildkite-agent artifact download "logs/**" . --exclude "*.tmp" --build xxx
+
+   Artifacts recorded with an internal hostname can be fetched from somewhere
+   else, such as a CDN or VPC endpoint, by rewriting their URLs. This is usually
+   set for every job in the agent's configuration:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --artifact-url-rewrites "^https://artifacts\.internal/=>https://cdn.example.com/"
+
+   Artifacts uploaded to your own S3 or Google Cloud Storage bucket can be
+   downloaded through a CloudFront or Cloud CDN distribution in front of it,
+   which the agent signs requests to. Downloads are signed with URLs, or with
+   cookies if BUILDKITE_ARTIFACT_CDN_SIGNED_COOKIES is true:
+
+   $ export BUILDKITE_CLOUDFRONT_URL=https://d111111abcdef8.cloudfront.net
+   $ export BUILDKITE_CLOUDFRONT_KEY_PAIR_ID=K2JCJMDEHXQW5F
+   $ export BUILDKITE_CLOUDFRONT_PRIVATE_KEY_PATH=/etc/buildkite-agent/cloudfront.pem
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --build xxx
+
+   For Cloud CDN, set BUILDKITE_CLOUD_CDN_URL, BUILDKITE_CLOUD_CDN_KEY_NAME and
+   BUILDKITE_CLOUD_CDN_KEY_PATH instead. Artifact URLs rewritten to be on a
+   distribution are signed too.
+
+   Artifacts in S3 buckets that the agent's own credentials can't read, such as
+   in another AWS account or on an S3-compatible server, can be downloaded with
+   config for those buckets. It can assume a role (with an external ID), and
+   set the bucket's region and endpoint:
+
+   $ export BUILDKITE_S3_BUCKET_CONFIG="partner-*=role-arn:arn:aws:iam::123456789012:role/reader,external-id:xyz;builds=endpoint:https://minio.internal:9000,region:us-east-1"
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --build xxx
+
+   Artifacts in Google Cloud Storage are downloaded with the application
+   default credentials. Outside of Google Cloud, such as on AWS or in a CI
+   provider with OIDC tokens, give a workload identity federation config
+   instead, or a service account key:
+
+   $ buildkite-agent artifact download "pkg/*" . --gs-credentials-file /etc/buildkite-agent/gcp-wif.json
+
+   Tests can download them from an emulator such as fake-gcs-server with
+   --gs-endpoint, or by setting STORAGE_EMULATOR_HOST, which doesn't need
+   credentials.
+
+   Artifacts that were encrypted when they were uploaded are decrypted with the
+   key they were encrypted with. Without it, they're downloaded still encrypted:
+
+   $ buildkite-agent artifact download "secrets/*" . --encryption-key-file artifacts.key
+
+   Artifacts that were named after their platform when they were uploaded can be
+   downloaded with the same template, which finds the ones for this agent's
+   platform and saves them to the paths they were uploaded from:
+
+   $ buildkite-agent artifact download "dist/app" . --name-template "{{.Path}}-{{.Os}}-{{.Arch}}"
+
+   Artifacts with the same path from many parallel jobs, such as test reports,
+   can be laid out in the download path with a template, so they don't
+   overwrite each other. Templates are given the artifact's .Path, .Dir,
+   .BaseName, .Name and .Ext, the .JobID, .JobName and .StepKey of the job that
+   uploaded it, and .UploadedAt, which the timestamp helper formats:
+
+   $ buildkite-agent artifact download "junit/*.xml" reports --step "tests" --path-template "{{.JobName}}/{{.BaseName}}"
+   $ buildkite-agent artifact download "pkg/*" . --path-template "{{.StepKey}}/{{timestamp .UploadedAt}}/{{.Path}}"
+
+   Each artifact is tried 5 times, 5 seconds apart, before its download fails.
+   Over a flaky link, back off exponentially instead, and give up on attempts
+   that stall:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --download-retries 8 --download-retry-backoff exponential --download-attempt-timeout 10m
+
+   To download only part of a large artifact, such as the start of a log, give the
+   inclusive range of bytes to fetch. The query must match a single artifact:
+
+   $ buildkite-agent artifact download "logs/build.log" . --step "tests" --range 0-1048575
+
+   For tools that need to know what was downloaded, --format json prints a
+   summary of each artifact, including any that failed to download:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --format json | jq -r '.[].destination'
+
+   To keep a record of what was downloaded for later steps, such as for
+   provenance or to remove exactly those files, write a manifest:
+
+   $ buildkite-agent artifact download "pkg/*" . --write-manifest downloaded.json
+   $ jq -r '.artifacts[].local_path' downloaded.json | xargs rm
+
+   When a step is retried, the artifacts it already downloaded can be kept
+   rather than downloaded again, as long as they haven't changed:
+
+   $ buildkite-agent artifact download "pkg/*" . --overwrite-policy if-changed
+
+   To check what a query and --step find before downloading them, --dry-run
+   prints where each artifact would be downloaded to, and warns about any that
+   would overwrite an existing file or another artifact, without downloading
+   anything:
+
+   $ buildkite-agent artifact download "pkg/*" . --step "build" --dry-run
+
+   Artifacts uploaded to S3 or Google Cloud Storage can be copied to another
+   bucket in the same service with --server-side, which uses the service's copy
+   API rather than downloading them through the agent:
+
+   $ buildkite-agent artifact download "pkg/*" s3://release-staging/$BUILDKITE_BUILD_NUMBER --server-side
+
+   When some artifacts fail to download, the rest are still downloaded, and a
+   table of the ones that failed and why is logged at the end. To give up as
+   soon as one fails instead:
+
+   $ buildkite-agent artifact download "pkg/*" . --fail-fast
+
+   Or, to let a few optional artifacts fail without failing the command, give
+   how many can, or what percentage of them. They're still in the table:
+
+   $ buildkite-agent artifact download "screenshots/*" . --allow-failures 10%
+
+   When an agent runs several jobs at once that download the same artifacts,
+   such as the jobs of a fan-out step, they can share a cache directory, so
+   each artifact is only fetched once. Set it for every job in the agent's
+   environment, and clean it up between builds:
+
+   $ export BUILDKITE_ARTIFACT_DOWNLOAD_SHARED_CACHE_DIR=/var/cache/buildkite-artifacts
+
+   Artifacts that many jobs need can be put in the cache before they start,
+   such as from an agent hook, with buildkite-agent artifact prefetch.
+
+   With the artifact-peers experiment, agents on other hosts that serve their
+   shared cache with buildkite-agent artifact serve can be fetched from before
+   the object store, so that a fleet only fetches a hot artifact from it a few
+   times:
+
+   $ buildkite-agent artifact download "toolchain/**" . --experiment artifact-peers --peers artifact-peers.internal:3901
+
+   Artifacts can be checked against detached signatures uploaded alongside
+   them, such as with cosign sign-blob --key cosign.key --output-signature
+   app.tar.gz.sig app.tar.gz. Any that don't match, or weren't signed, are
+   moved into .buildkite-quarantine in the download path, and fail the
+   download:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --verify-signature --signature-public-key cosign.pub
+
+   Downloaded artifacts are created with default permissions and the time
+   they were downloaded. To restore the executable bits and modification
+   times they had when they were uploaded, such as for tools or build caches
+   that go by modification time:
+
+   $ buildkite-agent artifact download "bin/*" . --preserve-metadata
+
+   When the agent runs as root but jobs run as another user, downloaded
+   artifacts, and the directories created for them, can be given to that
+   user, as a name or ID and optionally a group:
+
+   $ buildkite-agent artifact download "pkg/*" . --owner buildkite:buildkite
+
+   Artifacts can still be in memory, rather than on disk, once they've
+   downloaded. When the next step reboots the host or snapshots its disk,
+   make sure they're on disk first with:
+
+   $ buildkite-agent artifact download "images/*" . --durable
+
+   Artifacts behind a proxy, with certificates from an internal CA, can be
+   downloaded with the following. It applies to artifacts in S3, Google Cloud
+   Storage and Artifactory, as well as those downloaded over plain HTTP:
+
+   $ buildkite-agent artifact download "pkg/*" . --download-ca-cert /etc/ssl/internal-ca.pem --download-proxy http://proxy.internal:3128
+
+   Hosts that are reached directly, rather than through the proxy, can be
+   given like NO_PROXY, and older versions of TLS refused:
+
+   $ buildkite-agent artifact download "pkg/*" . --download-no-proxy ".internal,10.0.0.0/8" --download-tls-min-version 1.2
+
+   Artifacts are written straight into the download path as they download. To
+   only have them appear there once they're complete, such as when other
+   processes watch it, download them into a temp directory first. One on local
+   disk also helps when the download path is network mounted, as artifacts are
+   copied and synced onto it in one go:
+
+   $ buildkite-agent artifact download "pkg/*" /mnt/shared/pkg --temp-dir /var/tmp
+
+   Artifacts uploaded with the chunk post-processor are reassembled with
+   --chunked, which only downloads the chunks that aren't already in the file
+   being replaced:
+
+   $ buildkite-agent artifact download "disk.img" . --chunked
+
+   Outside of a job, the artifacts of a public pipeline's builds can be
+   downloaded without an agent access token, or with a token that can only
+   read them:
+
+   $ buildkite-agent artifact download "pkg/*" . --build xxx
+
+   A single artifact can be streamed to standard output with a download path of
+   '-', such as to unpack it without writing it to disk first. The query must
+   match exactly one artifact:
+
+   $ buildkite-agent artifact download "build.tar.gz" - --step "build" | tar xz`
 
 type ArtifactDownloadConfig struct {
-	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
-	Destination        string `cli:"arg:1" label:"artifact download path" validate:"required"`
-	Step               string `cli:"step"`
-	Build              string `cli:"build" validate:"required"`
-	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	Query                  string `cli:"arg:0" label:"artifact search query"`
+	Destination            string `cli:"arg:1" label:"artifact download path"`
+	Step                   string `cli:"step"`
+	Build                  string `cli:"build" validate:"required"`
+	IncludeRetriedJobs     bool   `cli:"include-retried-jobs"`
+	KeepRetriedDuplicates  bool   `cli:"keep-retried-duplicates"`
+	MaxArtifacts           int    `cli:"max-artifacts"`
+	Include                string `cli:"include"`
+	Exclude                string `cli:"exclude"`
+	DirPermissions         string `cli:"dir-permissions"`
+	ChecksumPreference     string `cli:"checksum-preference"`
+	VerifyChecksums        bool   `cli:"verify-checksums"`
+	Range                  string `cli:"range"`
+	DownloadConcurrency    int    `cli:"download-concurrency"`
+	MaxBandwidth           string `cli:"max-bandwidth"`
+	DownloadRetries        int    `cli:"download-retries"`
+	DownloadRetryBackoff   string `cli:"download-retry-backoff"`
+	DownloadRetryJitter    bool   `cli:"download-retry-jitter"`
+	DownloadAttemptTimeout string `cli:"download-attempt-timeout"`
+	NoResume               bool   `cli:"no-resume"`
+	ConnectTimeout         string `cli:"download-connect-timeout"`
+	ResponseHeaderTimeout  string `cli:"download-response-timeout"`
+	CACertFile             string `cli:"download-ca-cert" normalize:"filepath"`
+	Proxy                  string `cli:"download-proxy"`
+	NoProxy                string `cli:"download-no-proxy"`
+	TLSMinVersion          string `cli:"download-tls-min-version"`
+	InsecureSkipVerify     bool   `cli:"download-insecure-skip-verify"`
+	S3PartSize             string `cli:"s3-part-size"`
+	PartConcurrency        int    `cli:"part-concurrency"`
+	Progress               string `cli:"progress"`
+	Quiet                  bool   `cli:"quiet"`
+	DryRun                 bool   `cli:"dry-run"`
+	OverwritePolicy        string `cli:"overwrite-policy"`
+	ServerSide             bool   `cli:"server-side"`
+	FailFast               bool   `cli:"fail-fast"`
+	AllowFailures          string `cli:"allow-failures"`
+	SharedCacheDir         string `cli:"shared-cache-dir" normalize:"filepath"`
+	TempDir                string `cli:"temp-dir" normalize:"filepath"`
+	PreserveMetadata       bool   `cli:"preserve-metadata"`
+	Owner                  string `cli:"owner"`
+	Durable                bool   `cli:"durable"`
+	VerifySignature        bool   `cli:"verify-signature"`
+	SignaturePublicKey     string `cli:"signature-public-key" normalize:"filepath"`
+	ArtifactURLRewrites    string `cli:"artifact-url-rewrites"`
+	S3BucketConfig         string `cli:"s3-bucket-config"`
+	GSCredentialsFile      string `cli:"gs-credentials-file" normalize:"filepath"`
+	GSEndpoint             string `cli:"gs-endpoint"`
+	EncryptionKeyFile      string `cli:"encryption-key-file" normalize:"filepath"`
+	NameTemplate           string `cli:"name-template"`
+	PathTemplate           string `cli:"path-template"`
+	Format                 string `cli:"format"`
+	WriteManifest          string `cli:"write-manifest" normalize:"filepath"`
+
+	// Downloaded instead of searching for Query
+	IDs []string `cli:"id" normalize:"list"`
+
+	// Reassembled from their chunks
+	Chunked bool `cli:"chunked"`
+
+	// Fetched from before the object store
+	Peers     []string `cli:"peers" normalize:"list"`
+	PeerToken string   `cli:"peer-token"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+
+	// Metrics config
+	MetricsDatadog              bool   `cli:"metrics-datadog"`
+	MetricsDatadogHost          string `cli:"metrics-datadog-host"`
+	MetricsDatadogDistributions bool   `cli:"metrics-datadog-distributions"`
+	UsagePath                   string `cli:"usage-path" normalize:"filepath"`
 }
 
 var ArtifactDownloadCommand = cli.Command{
@@ -74,6 +351,17 @@ var ArtifactDownloadCommand = cli.Command{
 	Usage:       "Downloads artifacts from Buildkite to the local machine",
 	Description: downloadHelpDescription,
 	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:   "id",
+			Value:  &cli.StringSlice{},
+			Usage:  "Download the artifact with this ID, instead of searching for a query. Can be given more than once",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_IDS",
+		},
+		cli.BoolFlag{
+			Name:   "chunked",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CHUNKED",
+			Usage:  "Reassemble artifacts uploaded with the chunk post-processor, only downloading the chunks that aren't in the files already in the download path",
+		},
 		cli.StringFlag{
 			Name:  "step",
 			Value: "",
@@ -90,12 +378,269 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.BoolFlag{
+			Name:   "keep-retried-duplicates",
+			EnvVar: "BUILDKITE_ARTIFACT_KEEP_RETRIED_DUPLICATES",
+			Usage:  "With --include-retried-jobs, download every artifact with a matching path, rather than only the one from the newest job",
+		},
+		cli.IntFlag{
+			Name:   "max-artifacts",
+			Value:  0,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_MAX_ARTIFACTS",
+			Usage:  "Fail without downloading anything if the query finds more than this many artifacts, such as to catch a \"**/*\" that matches far more than expected. Defaults to no limit",
+		},
+		cli.StringFlag{
+			Name:  "include",
+			Value: "",
+			Usage: "Semicolon separated gitignore-style patterns. If set, only artifacts found by the search that match them are downloaded",
+		},
+		cli.StringFlag{
+			Name:  "exclude",
+			Value: "",
+			Usage: "Semicolon separated gitignore-style patterns for artifacts found by the search that shouldn't be downloaded",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "Set to json to print a JSON summary of each artifact downloaded, with its destination, checksums, how long it took, and any error",
+		},
+		cli.StringFlag{
+			Name:   "write-manifest",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_MANIFEST",
+			Usage:  "Write a JSON manifest of the artifacts that were downloaded to this path, with where each came from, its absolute local path, size, checksums and the job that uploaded it",
+		},
+		cli.StringFlag{
+			Name:   "checksum-preference",
+			Value:  strings.Join(transfer.DefaultChecksumPreference, ","),
+			EnvVar: "BUILDKITE_ARTIFACT_CHECKSUM_PREFERENCE",
+			Usage:  "A comma separated list of checksum algorithms to verify downloads with, in order of preference, or \"none\" to skip verification",
+		},
+		cli.BoolFlag{
+			Name:   "verify-checksums",
+			EnvVar: "BUILDKITE_ARTIFACT_VERIFY_CHECKSUMS",
+			Usage:  "Fail the download of any artifact that has no checksum from --checksum-preference to verify it with. Artifacts that don't match their checksum are always downloaded again, then fail",
+		},
+		cli.StringFlag{
+			Name:  "range",
+			Value: "",
+			Usage: "Only download this inclusive range of bytes, such as 0-1023, from the artifact. The query must match a single artifact",
+		},
+		cli.IntFlag{
+			Name:   "download-concurrency",
+			Value:  0,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CONCURRENCY",
+			Usage:  "How many artifacts to download at once. Defaults to 4 per CPU available",
+		},
+		cli.StringFlag{
+			Name:   "max-bandwidth",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_MAX_BANDWIDTH",
+			Usage:  "The most data per second to download each artifact at, such as 10MB. Defaults to no limit",
+		},
+		cli.IntFlag{
+			Name:   "download-retries",
+			Value:  agent.DefaultDownloadRetries,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RETRIES",
+			Usage:  "How many times to try downloading each artifact before giving up",
+		},
+		cli.StringFlag{
+			Name:   "download-retry-backoff",
+			Value:  "constant",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RETRY_BACKOFF",
+			Usage:  "How to wait between attempts to download an artifact: constant (every 5s), or exponential (1s, 2s, 4s...), optionally with the interval or base, such as exponential:3s",
+		},
+		cli.BoolFlag{
+			Name:   "download-retry-jitter",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RETRY_JITTER",
+			Usage:  "Add up to a second of random jitter to each wait between attempts, so downloads that failed together don't try again together",
+		},
+		cli.StringFlag{
+			Name:   "download-attempt-timeout",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_ATTEMPT_TIMEOUT",
+			Usage:  "How long each attempt to download an artifact can take before it's abandoned and tried again, such as 10m. Defaults to no limit",
+		},
+		cli.BoolFlag{
+			Name:   "no-resume",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_NO_RESUME",
+			Usage:  "Start failed downloads again from the beginning, rather than resuming them from where they stopped",
+		},
+		cli.StringFlag{
+			Name:   "download-connect-timeout",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CONNECT_TIMEOUT",
+			Usage:  "How long connecting to download an artifact over HTTP, and then the TLS handshake, can each take, such as 5s. Defaults to 30s and 10s",
+		},
+		cli.StringFlag{
+			Name:   "download-response-timeout",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RESPONSE_TIMEOUT",
+			Usage:  "How long to wait for a server to start responding to a request for an artifact, such as 30s. Defaults to no limit",
+		},
+		cli.StringFlag{
+			Name:   "download-ca-cert",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CA_CERT",
+			Usage:  "A file of PEM encoded CA certificates to trust when downloading artifacts over HTTPS, as well as the system's, such as for an Artifactory server with an internal CA",
+		},
+		cli.StringFlag{
+			Name:   "download-proxy",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PROXY",
+			Usage:  "The URL of a proxy to download artifacts through, rather than the one in HTTPS_PROXY or HTTP_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "download-no-proxy",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_NO_PROXY",
+			Usage:  "Hosts, domains and CIDR ranges to download artifacts from directly rather than through a proxy, separated by commas, rather than the ones in NO_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "download-tls-min-version",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_TLS_MIN_VERSION",
+			Usage:  "The oldest version of TLS to download artifacts with, one of 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2",
+		},
+		cli.BoolFlag{
+			Name:   "download-insecure-skip-verify",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_INSECURE_SKIP_VERIFY",
+			Usage:  "Don't verify the certificates of servers artifacts are downloaded from at all. Only use it for a server with a self-signed certificate that can't be given with --download-ca-cert",
+		},
+		cli.StringFlag{
+			Name:   "s3-part-size",
+			Value:  "64MiB",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_S3_PART_SIZE",
+			Usage:  "S3 artifacts larger than this are downloaded in parts of this size, several at once, into a file allocated up front. 0 downloads them in one go",
+		},
+		cli.IntFlag{
+			Name:   "part-concurrency",
+			Value:  agent.DefaultDownloadPartConcurrency,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PART_CONCURRENCY",
+			Usage:  "How many parts of each artifact to download at once",
+		},
+		cli.StringFlag{
+			Name:   "progress",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PROGRESS",
+			Usage:  "How often to log how many artifacts and bytes have been downloaded, how fast, and about how long is left, such as 10s. Defaults to not logging progress",
+		},
+		cli.BoolFlag{
+			Name:   "quiet",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_QUIET",
+			Usage:  "Don't log each artifact that's downloaded, only the progress, a summary at the end, and any warnings and errors",
+		},
+		cli.StringFlag{
+			Name:   "overwrite-policy",
+			Value:  agent.OverwriteAlways,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_OVERWRITE_POLICY",
+			Usage:  "What to do about artifacts whose files already exist: always download them again, never download them, or download them if-changed, when their size or checksum doesn't match",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_DRY_RUN",
+			Usage:  "Search for the artifacts and print where they'd be downloaded to, including any that would overwrite existing files, without downloading them",
+		},
+		cli.BoolFlag{
+			Name:   "server-side",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_SERVER_SIDE",
+			Usage:  "Copy the artifacts to an s3:// or gs:// download path with the storage service's copy API, rather than downloading them. They must have been uploaded to the same service",
+		},
+		cli.BoolFlag{
+			Name:   "fail-fast",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_FAIL_FAST",
+			Usage:  "Stop downloading as soon as any artifact fails to download after its retries, rather than trying the rest",
+		},
+		cli.StringFlag{
+			Name:   "shared-cache-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_SHARED_CACHE_DIR",
+			Usage:  "A directory shared by the jobs on this host, so that an artifact several of them download at once is only fetched once, and copied from here by the others once it matches its checksum. It's created so only the agent's user can use it",
+		},
+		cli.StringFlag{
+			Name:   "temp-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_TEMP_DIR",
+			Usage:  "An existing directory to download artifacts into before they're moved into the download path, so they're never seen there half downloaded. On another filesystem, such as with a network mounted download path, they're copied and synced rather than renamed",
+		},
+		cli.BoolFlag{
+			Name:   "preserve-metadata",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PRESERVE_METADATA",
+			Usage:  "Restore the executable bits and modification time each artifact had when it was uploaded, for artifacts uploaded by agents that record them",
+		},
+		cli.StringFlag{
+			Name:   "owner",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_OWNER",
+			Usage:  "The user, and optionally group, to give downloaded artifacts and the directories created for them to, such as buildkite or 1000:1000",
+		},
+		cli.BoolFlag{
+			Name:   "durable",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_DURABLE",
+			Usage:  "Sync each artifact to disk once it's downloaded, and then the directories they're in, so they survive a crash, reboot or VM snapshot straight after the download",
+		},
+		cli.BoolFlag{
+			Name:   "verify-signature",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_VERIFY_SIGNATURE",
+			Usage:  "Verify each artifact against a signature uploaded next to it with .sig added to its path, such as by cosign sign-blob, with --signature-public-key. Artifacts that fail are quarantined",
+		},
+		cli.StringFlag{
+			Name:   "signature-public-key",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_SIGNATURE_PUBLIC_KEY",
+			Usage:  "Path to the PEM encoded ECDSA, Ed25519 or RSA public key to verify artifact signatures with",
+		},
+		cli.StringFlag{
+			Name:   "dir-permissions",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_DIR_PERMISSIONS",
+			Usage:  "Octal permissions, such as 0755, to create missing destination directories with. When set, the umask is not applied",
+		},
+
+		ArtifactURLRewritesFlag,
+		cli.StringFlag{
+			Name:   "s3-bucket-config",
+			Value:  "",
+			EnvVar: "BUILDKITE_S3_BUCKET_CONFIG",
+			Usage:  "Rules separated by semicolons for creating the clients of S3 buckets that match a pattern, with a role-arn to assume and its external-id, and the region and endpoint, such as \"partner-*=role-arn:arn:aws:iam::123456789012:role/reader,external-id:xyz\"",
+		},
+		cli.StringFlag{
+			Name:   "gs-credentials-file",
+			Value:  "",
+			EnvVar: "BUILDKITE_GS_APPLICATION_CREDENTIALS",
+			Usage:  "A Google Cloud credentials file to download gs:// artifacts with, either a service account key, or a workload identity federation config, such as from gcloud iam workload-identity-pools create-cred-config. Defaults to the application default credentials",
+		},
+		cli.StringFlag{
+			Name:   "gs-endpoint",
+			Value:  "",
+			EnvVar: "BUILDKITE_GCS_ENDPOINT",
+			Usage:  "The URL of a server compatible with the Google Cloud Storage JSON API to download gs:// artifacts from, such as fake-gcs-server, instead of Google's",
+		},
+		ArtifactPeersFlag,
+		ArtifactPeerTokenFlag,
+		cli.StringFlag{
+			Name:   "path-template",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PATH_TEMPLATE",
+			Usage:  "A template for where each artifact is downloaded to in the download path, such as \"{{.JobName}}/{{.BaseName}}\", so artifacts with the same path from parallel jobs don't collide",
+		},
+		EncryptionKeyFileFlag,
+		ArtifactNameTemplateFlag,
+		AllowFailuresFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Metrics flags
+		MetricsDatadogFlag,
+		MetricsDatadogHostFlag,
+		MetricsDatadogDistributionsFlag,
+		UsagePathFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -103,6 +648,7 @@ var ArtifactDownloadCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -114,7 +660,7 @@ var ArtifactDownloadCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -128,21 +674,331 @@ var ArtifactDownloadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
-		// Create the API client
-		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+		// Artifacts downloaded by ID aren't searched for, so the only
+		// argument is where to download them to
+		if len(cfg.IDs) > 0 {
+			if cfg.Destination != "" {
+				l.Fatal("A search query can't be given with --id, only a download path")
+			}
+			cfg.Query, cfg.Destination = "", cfg.Query
+		} else if cfg.Query == "" {
+			l.Fatal("Missing artifact search query.")
+		}
+		if cfg.Destination == "" {
+			l.Fatal("Missing artifact download path.")
+		}
+
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		// Create the API client. Without a token, only the artifacts of
+		// public builds can be found
+		apiConfig := loadAPIClientConfig(cfg, "AgentAccessToken")
+		if cfg.AgentAccessToken == "" {
+			l.Info("No agent access token was given, so only the artifacts of public builds can be downloaded")
+			apiConfig.Anonymous = true
+		}
+		client := api.NewClient(l, apiConfig)
+
+		// Start the metrics collector, which is a no-op unless a metrics
+		// backend has been configured
+		mc := metrics.NewCollector(l, loadMetricsCollectorConfig(cfg))
+		if err := mc.Start(); err != nil {
+			l.Fatal("Failed to start metrics collection: %s", err)
+		}
+
+		var dirPermissions os.FileMode
+		if cfg.DirPermissions != "" {
+			perm, err := strconv.ParseUint(cfg.DirPermissions, 8, 32)
+			if err != nil || perm == 0 || perm > 0777 {
+				l.Fatal("Invalid --dir-permissions %q, expected octal permissions such as 0755", cfg.DirPermissions)
+			}
+			dirPermissions = os.FileMode(perm)
+		}
+
+		checksumPreference := []string{}
+		if cfg.ChecksumPreference != "none" {
+			for _, algorithm := range strings.Split(cfg.ChecksumPreference, ",") {
+				algorithm = strings.TrimSpace(strings.ToLower(algorithm))
+				if algorithm == "" {
+					continue
+				}
+				if _, ok := transfer.ChecksumAlgorithms[algorithm]; !ok {
+					l.Fatal("Unknown checksum algorithm %q in --checksum-preference", algorithm)
+				}
+				checksumPreference = append(checksumPreference, algorithm)
+			}
+		}
+
+		if cfg.VerifyChecksums && len(checksumPreference) == 0 {
+			l.Fatal("--verify-checksums can't be used with a --checksum-preference of none")
+		}
+
+		var byteRange *agent.ByteRange
+		if cfg.Range != "" {
+			byteRange, err = agent.ParseByteRange(cfg.Range)
+			if err != nil {
+				l.Fatal("Invalid --range: %s", err)
+			}
+		}
+
+		if cfg.ServerSide {
+			if !agent.IsServerSideDestination(cfg.Destination) {
+				l.Fatal("--server-side needs an s3:// or gs:// download path, not %q", cfg.Destination)
+			}
+			if _, err := destination.Parse(cfg.Destination); err != nil {
+				l.Fatal("Invalid download path: %s", err)
+			}
+			if byteRange != nil {
+				l.Fatal("--range can't be used with --server-side, as whole artifacts are copied")
+			}
+		}
+
+		var maxBandwidth uint64
+		if cfg.MaxBandwidth != "" {
+			maxBandwidth, err = humanize.ParseBytes(cfg.MaxBandwidth)
+			if err != nil {
+				l.Fatal("Invalid --max-bandwidth: %s", err)
+			}
+		}
+
+		partSize, err := humanize.ParseBytes(cfg.S3PartSize)
+		if err != nil {
+			l.Fatal("Invalid --s3-part-size: %s", err)
+		}
+
+		// 0 turns parts off, which the downloader takes as negative
+		s3PartSize := int64(partSize)
+		if s3PartSize == 0 {
+			s3PartSize = -1
+		}
+		if cfg.PartConcurrency < 1 {
+			l.Fatal("Invalid --part-concurrency %d, it must be at least 1", cfg.PartConcurrency)
+		}
+
+		if cfg.MaxArtifacts < 0 {
+			l.Fatal("Invalid --max-artifacts %d, it can't be negative", cfg.MaxArtifacts)
+		}
+
+		if err := agent.ValidateOverwritePolicy(cfg.OverwritePolicy); err != nil {
+			l.Fatal("Invalid --overwrite-policy: %s", err)
+		}
+
+		allowFailures, err := agent.ParseFailureThreshold(cfg.AllowFailures)
+		if err != nil {
+			l.Fatal("Invalid --allow-failures: %s", err)
+		}
+
+		if cfg.DownloadRetries < 1 {
+			l.Fatal("Invalid --download-retries %d, it must be at least 1", cfg.DownloadRetries)
+		}
+		retry := agent.RetryConfig{
+			MaxAttempts: cfg.DownloadRetries,
+			Jitter:      cfg.DownloadRetryJitter,
+		}
+		retry.Strategy, retry.Interval, err = agent.ParseRetryBackoff(cfg.DownloadRetryBackoff)
+		if err != nil {
+			l.Fatal("Invalid --download-retry-backoff: %s", err)
+		}
+		if cfg.DownloadAttemptTimeout != "" {
+			retry.AttemptTimeout, err = time.ParseDuration(cfg.DownloadAttemptTimeout)
+			if err != nil || retry.AttemptTimeout <= 0 {
+				l.Fatal("Invalid --download-attempt-timeout %q, expected a duration such as 10m", cfg.DownloadAttemptTimeout)
+			}
+		}
+
+		var progressInterval time.Duration
+		if cfg.Progress != "" {
+			progressInterval, err = time.ParseDuration(cfg.Progress)
+			if err != nil || progressInterval <= 0 {
+				l.Fatal("Invalid --progress %q, expected a duration such as 10s", cfg.Progress)
+			}
+		}
+
+		var signaturePublicKey string
+		if cfg.VerifySignature {
+			if cfg.SignaturePublicKey == "" {
+				l.Fatal("--verify-signature needs a --signature-public-key to verify signatures with")
+			}
+			signaturePublicKey = cfg.SignaturePublicKey
+		}
+
+		if cfg.Format != "" && cfg.Format != "json" {
+			l.Fatal("Invalid --format %q, the only format is json", cfg.Format)
+		}
+
+		toStdout := cfg.Destination == agent.StdoutDestination
+		if toStdout {
+			switch {
+			case cfg.DryRun:
+				l.Fatal("--dry-run can't be used with a download path of -")
+			case cfg.Format == "json":
+				l.Fatal("--format json can't be used with a download path of -, as the artifact is written to standard output")
+			case cfg.WriteManifest != "":
+				l.Fatal("--write-manifest can't be used with a download path of -, as nothing is written to disk")
+			}
+		}
+		if cfg.DryRun && cfg.WriteManifest != "" {
+			l.Fatal("--write-manifest can't be used with --dry-run, as nothing is downloaded")
+		}
+
+		var owner *agent.FileOwner
+		if cfg.Owner != "" {
+			if toStdout || cfg.ServerSide {
+				l.Fatal("--owner can only be used when artifacts are downloaded to disk")
+			}
+			if owner, err = agent.ParseFileOwner(cfg.Owner); err != nil {
+				l.Fatal("Invalid --owner: %s", err)
+			}
+		}
+
+		// The S3, Google Cloud Storage and Artifactory clients go through the
+		// same proxy and verify certificates the same way
+		transport := agent.TransportConfig{
+			CACertFile:         cfg.CACertFile,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			Proxy:              cfg.Proxy,
+			NoProxy:            cfg.NoProxy,
+		}
+		if cfg.TLSMinVersion != "" {
+			transport.MinTLSVersion, err = agent.ParseTLSVersion(cfg.TLSMinVersion)
+			if err != nil {
+				l.Fatal("Invalid --download-tls-min-version: %s", err)
+			}
+		}
+		if cfg.InsecureSkipVerify {
+			l.Warn("Not verifying the certificates of servers artifacts are downloaded from, as --download-insecure-skip-verify is set")
+		}
+
+		// Artifacts that aren't downloaded with a cloud provider's client are
+		// downloaded with this
+		httpConfig := agent.DownloadHTTPConfig{
+			Concurrency:     cfg.DownloadConcurrency,
+			DisableHTTP2:    cfg.NoHTTP2,
+			TransportConfig: transport,
+		}
+		if cfg.ConnectTimeout != "" {
+			httpConfig.ConnectTimeout, err = time.ParseDuration(cfg.ConnectTimeout)
+			if err != nil || httpConfig.ConnectTimeout <= 0 {
+				l.Fatal("Invalid --download-connect-timeout %q, expected a duration such as 5s", cfg.ConnectTimeout)
+			}
+		}
+		if cfg.ResponseHeaderTimeout != "" {
+			httpConfig.ResponseHeaderTimeout, err = time.ParseDuration(cfg.ResponseHeaderTimeout)
+			if err != nil || httpConfig.ResponseHeaderTimeout <= 0 {
+				l.Fatal("Invalid --download-response-timeout %q, expected a duration such as 30s", cfg.ResponseHeaderTimeout)
+			}
+		}
+		httpClient, err := agent.NewDownloadHTTPClient(httpConfig)
+		if err != nil {
+			l.Fatal("Invalid download HTTP config: %s", err)
+		}
+
+		// Record what was transferred, if --usage-path is set
+		usageRecorder := jobUsageRecorder(cfg.UsagePath)
 
 		// Setup the downloader
-		downloader := agent.NewArtifactDownloader(l, client, agent.ArtifactDownloaderConfig{
-			Query:              cfg.Query,
-			Destination:        cfg.Destination,
-			BuildID:            cfg.Build,
-			Step:               cfg.Step,
-			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
-			DebugHTTP:          cfg.DebugHTTP,
-		})
+		downloaderConfig := agent.ArtifactDownloaderConfig{
+			Query:                  cfg.Query,
+			IDs:                    cfg.IDs,
+			Chunked:                cfg.Chunked,
+			Destination:            cfg.Destination,
+			BuildID:                cfg.Build,
+			Step:                   cfg.Step,
+			IncludeRetriedJobs:     cfg.IncludeRetriedJobs,
+			KeepRetriedDuplicates:  cfg.KeepRetriedDuplicates,
+			MaxArtifacts:           cfg.MaxArtifacts,
+			Include:                cfg.Include,
+			Exclude:                cfg.Exclude,
+			DirPermissions:         dirPermissions,
+			ChecksumPreference:     checksumPreference,
+			RequireChecksums:       cfg.VerifyChecksums,
+			DebugHTTP:              cfg.DebugHTTP,
+			HTTPClient:             httpClient,
+			Transport:              transport,
+			Metrics:                mc.Scope(jobMetricsTags()),
+			Usage:                  usageRecorder,
+			Range:                  byteRange,
+			Concurrency:            cfg.DownloadConcurrency,
+			MaxBandwidth:           int64(maxBandwidth),
+			NoResume:               cfg.NoResume,
+			S3PartSize:             s3PartSize,
+			PartConcurrency:        cfg.PartConcurrency,
+			ProgressInterval:       progressInterval,
+			Quiet:                  cfg.Quiet,
+			DryRun:                 cfg.DryRun,
+			OverwritePolicy:        cfg.OverwritePolicy,
+			ServerSide:             cfg.ServerSide,
+			FailFast:               cfg.FailFast,
+			AllowFailures:          allowFailures,
+			SharedCacheDir:         cfg.SharedCacheDir,
+			TempDir:                cfg.TempDir,
+			Peers:                  artifactPeers(l, cfg.Peers, cfg.SharedCacheDir),
+			PeerToken:              cfg.PeerToken,
+			PreserveMetadata:       cfg.PreserveMetadata,
+			Owner:                  owner,
+			Durable:                cfg.Durable,
+			SignaturePublicKeyPath: signaturePublicKey,
+			URLRewrites:            cfg.ArtifactURLRewrites,
+			S3BucketConfig:         cfg.S3BucketConfig,
+			GSCredentialsFile:      cfg.GSCredentialsFile,
+			GSEndpoint:             cfg.GSEndpoint,
+			Retry:                  retry,
+			EncryptionKeyPath:      cfg.EncryptionKeyFile,
+			NameTemplate:           cfg.NameTemplate,
+			PathTemplate:           cfg.PathTemplate,
+		}
+		if toStdout {
+			downloaderConfig.Output = os.Stdout
+		}
+		downloader := agent.NewArtifactDownloader(l, client, downloaderConfig)
+
+		// Let the agent know the job is transferring artifacts
+		unmark, err := agent.MarkArtifactTransfer(os.Getenv(agent.ArtifactTransfersDirEnv))
+		if err != nil {
+			l.Warn("%s", err)
+		}
+		defer unmark()
 
 		// Download the artifacts
-		if err := downloader.Download(ctx); err != nil {
+		err = downloader.Download(ctx)
+
+		// Summarise the downloads, including any that failed
+		if cfg.Format == "json" {
+			results := downloader.Results()
+			if results == nil {
+				results = []agent.ArtifactDownloadResult{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				l.Error("Failed to encode the download summary: %s", err)
+			}
+		}
+
+		// List what was downloaded, even if some of it failed, so it can
+		// still be cleaned up
+		if cfg.WriteManifest != "" {
+			manifest := agent.NewArtifactDownloadManifest(cfg.Build, cfg.Query, downloader.Results())
+			if err := manifest.WriteFile(cfg.WriteManifest); err != nil {
+				l.Error("Failed to write the download manifest: %s", err)
+			} else {
+				l.Info("Wrote a manifest of %d downloaded artifacts to %s", len(manifest.Artifacts), cfg.WriteManifest)
+			}
+		}
+
+		// Record what was transferred, even if some of it failed
+		if err := usageRecorder.Flush(); err != nil {
+			l.Warn("Failed to record usage: %s", err)
+		}
+
+		// Flush any buffered metrics before we potentially exit
+		if err := mc.Stop(); err != nil {
+			l.Warn("Failed to stop metrics collection: %s", err)
+		}
+
+		if err != nil {
 			l.Fatal("Failed to download artifacts: %s", err)
 		}
 	},
@@ -0,0 +1,189 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const prefetchHelpDescription = `Usage:
+
+   buildkite-agent artifact prefetch [options] --build <build> --query <query>
+
+Description:
+
+   Downloads artifacts matching <query> into a shared cache directory, so
+   that jobs on this host that download them later with the same
+   --shared-cache-dir copy them from there rather than fetching them.
+
+   It's intended for large artifacts that many jobs need and that don't
+   change, such as toolchains, and can be run from an agent hook before the
+   job that downloads them starts. Artifacts already in the cache aren't
+   downloaded again.
+
+Example:
+
+   $ export BUILDKITE_ARTIFACT_DOWNLOAD_SHARED_CACHE_DIR=/var/cache/buildkite-artifacts
+   $ buildkite-agent artifact prefetch --build xxx --query "toolchain/**"
+
+   The job then downloads them as usual, copying them from the cache:
+
+   $ buildkite-agent artifact download "toolchain/**" .`
+
+type ArtifactPrefetchConfig struct {
+	Query               string `cli:"query" validate:"required"`
+	Step                string `cli:"step"`
+	Build               string `cli:"build" validate:"required"`
+	IncludeRetriedJobs  bool   `cli:"include-retried-jobs"`
+	SharedCacheDir      string `cli:"shared-cache-dir" normalize:"filepath" validate:"required"`
+	DownloadConcurrency int    `cli:"download-concurrency"`
+	DownloadRetries     int    `cli:"download-retries"`
+
+	// Fetched from before the object store
+	Peers     []string `cli:"peers" normalize:"list"`
+	PeerToken string   `cli:"peer-token"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+}
+
+var ArtifactPrefetchCommand = cli.Command{
+	Name:        "prefetch",
+	Usage:       "Downloads artifacts into a shared cache before jobs need them",
+	Description: prefetchHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "query",
+			Value: "",
+			Usage: "The artifact search query, such as \"toolchain/**\"",
+		},
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "Scope the search to a particular step by using either its name or job ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			EnvVar: "BUILDKITE_BUILD_ID",
+			Usage:  "The build that the artifacts were uploaded to",
+		},
+		cli.BoolFlag{
+			Name:   "include-retried-jobs",
+			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
+			Usage:  "Include artifacts from retried jobs in the search",
+		},
+		cli.StringFlag{
+			Name:   "shared-cache-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_SHARED_CACHE_DIR",
+			Usage:  "The directory shared by the jobs on this host to download the artifacts into",
+		},
+		cli.IntFlag{
+			Name:   "download-concurrency",
+			Value:  0,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CONCURRENCY",
+			Usage:  "How many artifacts to download at once. Defaults to 4 per CPU available",
+		},
+		cli.IntFlag{
+			Name:   "download-retries",
+			Value:  agent.DefaultDownloadRetries,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RETRIES",
+			Usage:  "How many times to try downloading each artifact before giving up",
+		},
+		ArtifactPeersFlag,
+		ArtifactPeerTokenFlag,
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ArtifactPrefetchConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		// Create the API client. Without a token, only the artifacts of
+		// public builds can be found
+		apiConfig := loadAPIClientConfig(cfg, "AgentAccessToken")
+		if cfg.AgentAccessToken == "" {
+			l.Info("No agent access token was given, so only the artifacts of public builds can be prefetched")
+			apiConfig.Anonymous = true
+		}
+		client := api.NewClient(l, apiConfig)
+
+		if cfg.DownloadRetries < 1 {
+			l.Fatal("Invalid --download-retries %d, it must be at least 1", cfg.DownloadRetries)
+		}
+
+		downloader := agent.NewArtifactDownloader(l, client, agent.ArtifactDownloaderConfig{
+			Query:              cfg.Query,
+			BuildID:            cfg.Build,
+			Step:               cfg.Step,
+			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			DebugHTTP:          cfg.DebugHTTP,
+			DisableHTTP2:       cfg.NoHTTP2,
+			Concurrency:        cfg.DownloadConcurrency,
+			Retry:              agent.RetryConfig{MaxAttempts: cfg.DownloadRetries},
+			SharedCacheDir:     cfg.SharedCacheDir,
+			Peers:              artifactPeers(l, cfg.Peers, cfg.SharedCacheDir),
+			PeerToken:          cfg.PeerToken,
+			Prefetch:           true,
+		})
+		if err := downloader.Download(ctx); err != nil {
+			l.Fatal("Failed to prefetch artifacts: %s", err)
+		}
+	},
+}
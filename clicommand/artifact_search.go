@@ -2,7 +2,9 @@ package clicommand
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -44,7 +46,12 @@ Example:
 
    $ buildkite-agent artifact search "*" -format "%p\n"
 
-   The above will return a list of filenames separated by newline.`
+   The above will return a list of filenames separated by newline.
+
+   For tools that read the results, a --format of json prints them as a JSON
+   array instead:
+
+   $ buildkite-agent artifact search "*" --format json`
 
 type ArtifactSearchConfig struct {
 	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
@@ -55,17 +62,20 @@ type ArtifactSearchConfig struct {
 	PrintFormat        string `cli:"format"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var ArtifactSearchCommand = cli.Command{
@@ -119,7 +129,7 @@ Format specifiers:
 		cli.StringFlag{
 			Name:  "format",
 			Value: "%j %p %c\n",
-			Usage: "Output formatting of results. See below for listing of available format specifiers.",
+			Usage: "Output formatting of results, or json to print them as JSON. See below for listing of available format specifiers.",
 		},
 
 		// API Flags
@@ -127,6 +137,8 @@ Format specifiers:
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -134,6 +146,7 @@ Format specifiers:
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
@@ -145,7 +158,7 @@ Format specifiers:
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -159,6 +172,10 @@ Format specifiers:
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -177,6 +194,10 @@ Format specifiers:
 			}
 		}
 
+		if cfg.PrintFormat == "json" {
+			return printArtifactSearchJSON(os.Stdout, artifacts)
+		}
+
 		for _, artifact := range artifacts {
 			r := strings.NewReplacer(
 				"%p", artifact.Path,
@@ -193,3 +214,36 @@ Format specifiers:
 		return nil
 	},
 }
+
+// artifactSearchResult is an artifact found by a search, as it's printed
+// with --format json
+type artifactSearchResult struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	JobID     string    `json:"job_id"`
+	FileSize  int64     `json:"file_size"`
+	Sha1Sum   string    `json:"sha1sum"`
+	Sha256Sum string    `json:"sha256sum,omitempty"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func printArtifactSearchJSON(w io.Writer, artifacts []*api.Artifact) error {
+	results := make([]artifactSearchResult, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		results = append(results, artifactSearchResult{
+			ID:        artifact.ID,
+			Path:      artifact.Path,
+			JobID:     artifact.JobID,
+			FileSize:  artifact.FileSize,
+			Sha1Sum:   artifact.Sha1Sum,
+			Sha256Sum: artifact.Sha256Sum,
+			URL:       artifact.URL,
+			CreatedAt: artifact.CreatedAt,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
@@ -0,0 +1,48 @@
+package clicommand
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintArtifactSearchJSON(t *testing.T) {
+	t.Parallel()
+
+	createdAt := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	artifacts := []*api.Artifact{{
+		ID:           "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+		Path:         "pkg/app.tar.gz",
+		AbsolutePath: "/tmp/pkg/app.tar.gz",
+		JobID:        "my-job",
+		FileSize:     1024,
+		Sha1Sum:      "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		URL:          "https://example.com/app.tar.gz",
+		CreatedAt:    createdAt,
+	}}
+
+	var buf bytes.Buffer
+	require.NoError(t, printArtifactSearchJSON(&buf, artifacts))
+
+	var got []map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, []map[string]any{{
+		"id":         "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+		"path":       "pkg/app.tar.gz",
+		"job_id":     "my-job",
+		"file_size":  float64(1024),
+		"sha1sum":    "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		"url":        "https://example.com/app.tar.gz",
+		"created_at": "2023-04-01T12:00:00Z",
+	}}, got)
+
+	// No results are an empty array, rather than null
+	buf.Reset()
+	require.NoError(t, printArtifactSearchJSON(&buf, nil))
+	assert.Equal(t, "[]\n", buf.String())
+}
@@ -0,0 +1,199 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+const serveHelpDescription = `Usage:
+
+   buildkite-agent artifact serve [options]
+
+Description:
+
+   Serves the artifacts in a shared cache directory to agents on other hosts,
+   so that when many of them download the same artifact at once, they fetch it
+   from each other rather than all of them fetching it from the object store.
+
+   It's part of the artifact-peers experiment, and runs until it's stopped,
+   alongside the agent on each host. Jobs fetch artifacts from it by
+   downloading them with --peers and the same --shared-cache-dir. Set
+   BUILDKITE_ARTIFACT_PEER_TOKEN to the same secret for the servers and jobs
+   so that only they can fetch the artifacts. It won't start without one
+   unless --insecure-no-token is given.
+
+   It only listens on 127.0.0.1 by default. Use --listen with the address of
+   a private network interface to serve artifacts to other hosts. Artifacts
+   are served over plain HTTP, so the peer token and the artifacts can be
+   read by anything on the network between the hosts. Only serve them on a
+   network you trust.
+
+Example:
+
+   $ export BUILDKITE_ARTIFACT_PEER_TOKEN=xxx
+   $ buildkite-agent artifact serve --experiment artifact-peers --shared-cache-dir /var/cache/buildkite-artifacts --listen 10.0.1.5:3901
+
+   Jobs on every host then download with:
+
+   $ export BUILDKITE_ARTIFACT_PEERS=artifact-peers.internal:3901
+   $ buildkite-agent artifact download --experiment artifact-peers "toolchain/**" .`
+
+type ArtifactServeConfig struct {
+	SharedCacheDir  string `cli:"shared-cache-dir" normalize:"filepath" validate:"required"`
+	Listen          string `cli:"listen" validate:"required"`
+	PeerToken       string `cli:"peer-token"`
+	InsecureNoToken bool   `cli:"insecure-no-token"`
+	MaxConcurrent   int    `cli:"max-concurrent"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+}
+
+var ArtifactServeCommand = cli.Command{
+	Name:        "serve",
+	Usage:       "Serves the artifacts in a shared cache to other agents (experimental)",
+	Description: serveHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "shared-cache-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_SHARED_CACHE_DIR",
+			Usage:  "The shared cache directory that jobs on this host download artifacts into",
+		},
+		cli.StringFlag{
+			Name:   "listen",
+			Value:  "127.0.0.1:3901",
+			EnvVar: "BUILDKITE_ARTIFACT_SERVE_LISTEN",
+			Usage:  "The address to serve the artifacts on. The default is loopback, so only this host can reach it. Artifacts and the --peer-token are sent over plain HTTP, so only set it to an address on a trusted private network",
+		},
+		ArtifactPeerTokenFlag,
+		cli.BoolFlag{
+			Name:   "insecure-no-token",
+			EnvVar: "BUILDKITE_ARTIFACT_SERVE_INSECURE_NO_TOKEN",
+			Usage:  "Serve the artifacts without a --peer-token, to anyone who can reach --listen",
+		},
+		cli.IntFlag{
+			Name:   "max-concurrent",
+			Value:  16,
+			EnvVar: "BUILDKITE_ARTIFACT_SERVE_MAX_CONCURRENT",
+			Usage:  "How many requests to serve at once. Peers fetch from others when there are more",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ArtifactServeConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if !experiments.IsEnabled(experiments.ArtifactPeers) {
+			l.Fatal("artifact serve is part of the %s experiment, which isn't enabled", experiments.ArtifactPeers)
+		}
+		if cfg.PeerToken == "" {
+			if !cfg.InsecureNoToken {
+				l.Fatal("A --peer-token is needed so that only other agents can fetch the artifacts in %s. Use --insecure-no-token to serve them to anyone who can reach %s", cfg.SharedCacheDir, cfg.Listen)
+			}
+			l.Warn("No --peer-token was given, so anyone who can reach %s can fetch the artifacts in %s", cfg.Listen, cfg.SharedCacheDir)
+		}
+
+		if !isLoopback(cfg.Listen) {
+			l.Warn("Serving artifacts over plain HTTP on %s, so the peer token and artifacts can be read by anything on the network between the hosts", cfg.Listen)
+		}
+
+		server := &http.Server{
+			Addr: cfg.Listen,
+			Handler: agent.NewArtifactPeerServer(l, agent.ArtifactPeerServerConfig{
+				SharedCacheDir: cfg.SharedCacheDir,
+				Token:          cfg.PeerToken,
+				MaxConcurrent:  cfg.MaxConcurrent,
+			}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		l.Info("Serving the artifacts in %s to peers on %s", cfg.SharedCacheDir, cfg.Listen)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fatal("Failed to serve artifacts: %s", err)
+		}
+	},
+}
+
+// artifactPeers returns the peers to fetch artifacts from, which are only
+// used with the artifact-peers experiment and a shared cache directory, which
+// is what peers serve
+func artifactPeers(l logger.Logger, peers []string, sharedCacheDir string) []string {
+	switch {
+	case len(peers) == 0:
+		return nil
+	case !experiments.IsEnabled(experiments.ArtifactPeers):
+		l.Warn("Ignoring --peers, as it's part of the %s experiment, which isn't enabled", experiments.ArtifactPeers)
+		return nil
+	case sharedCacheDir == "":
+		l.Warn("Ignoring --peers, as artifacts are only fetched from peers with a --shared-cache-dir to serve them from")
+		return nil
+	}
+	return peers
+}
+
+// isLoopback returns whether a listen address can only be reached from this
+// host
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
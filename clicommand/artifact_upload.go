@@ -2,12 +2,15 @@ package clicommand
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/destination"
+	"github.com/buildkite/agent/v3/metrics"
 	"github.com/urfave/cli"
 )
 
@@ -23,16 +26,36 @@ Description:
    built-in shell path globbing will provide the files, which is currently not
    supported.
 
-   You can specify an alternate destination on Amazon S3, Google Cloud Storage
-   or Artifactory as per the examples below. This may be specified in the
+   You can specify an alternate destination on Amazon S3, Google Cloud Storage,
+   Artifactory or Azure Blob Storage as per the examples below. This may be specified in the
    'destination' argument, or in the 'BUILDKITE_ARTIFACT_UPLOAD_DESTINATION'
    environment variable.  Otherwise, artifacts are uploaded to a
    Buildkite-managed Amazon S3 bucket, where they’re retained for six months.
 
+   Agents can keep every artifact in your own account instead, by setting
+   --artifact-upload-default-destination on the agent (or
+   'BUILDKITE_ARTIFACT_UPLOAD_DEFAULT_DESTINATION'). Uploads without a
+   destination then go there, under the job's ID, and are still registered
+   with Buildkite as usual:
+
+   $ buildkite-agent start --artifact-upload-default-destination s3://my-artifacts/buildkite
+
 Example:
 
    $ buildkite-agent artifact upload "log/**/*.log"
 
+   Files and directories matching --ignore-paths are skipped, and ignored
+   directories aren't searched at all:
+
+   $ buildkite-agent artifact upload "**/*.log" --ignore-paths "node_modules/;*.tmp.log"
+
+   To check what a pattern and --ignore-paths match before uploading them,
+   --dry-run prints each file that would be uploaded, with its size and
+   checksum, and where it would go, without uploading anything. With
+   --format json, the plan is printed as JSON:
+
+   $ buildkite-agent artifact upload "**/*.log" --ignore-paths "node_modules/" --dry-run --format json
+
    You can also upload directly to Amazon S3 if you'd like to host your own artifacts:
 
    $ export BUILDKITE_S3_ACCESS_KEY_ID=xxx
@@ -55,7 +78,104 @@ Example:
    $ export BUILDKITE_ARTIFACTORY_URL=http://my-artifactory-instance.com/artifactory
    $ export BUILDKITE_ARTIFACTORY_USER=carol-danvers
    $ export BUILDKITE_ARTIFACTORY_PASSWORD=xxx
-   $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID`
+   $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID
+
+   Instead of a username and password, Artifactory can be authenticated with
+   BUILDKITE_ARTIFACTORY_ACCESS_TOKEN or BUILDKITE_ARTIFACTORY_API_KEY.
+   Repositories behind an internal certificate authority can be trusted with
+   BUILDKITE_ARTIFACTORY_TLS rules, which give a file of PEM encoded
+   certificates with ca-cert, or skip verifying a self-signed certificate with
+   skip-verify:true, for the repositories matching each pattern. Artifact
+   download checks what it downloads from Artifactory against the checksums
+   Artifactory keeps:
+
+   $ export BUILDKITE_ARTIFACTORY_ACCESS_TOKEN=xxx
+   $ export BUILDKITE_ARTIFACTORY_TLS="internal-*=ca-cert:/etc/ssl/certs/internal-ca.pem"
+
+   Or upload directly to Azure Blob Storage, with a SAS token or otherwise the
+   managed identity of the host:
+
+   $ export BUILDKITE_AZURE_STORAGE_ACCOUNT=myaccount
+   $ export BUILDKITE_AZURE_BLOB_SAS_TOKEN="sv=2021-08-06&sig=xxx"
+   $ buildkite-agent artifact upload "log/**/*.log" az://name-of-your-container/$BUILDKITE_JOB_ID
+
+   Other storage can be uploaded to with a helper command. A destination with
+   a scheme the agent doesn't know, such as myblob://, is handed to
+   buildkite-artifact-myblob in the PATH, which is run with url, upload or
+   download as its argument and the request as JSON on stdin, like a git
+   credential helper. Artifact download uses the same helper:
+
+   $ buildkite-agent artifact upload "log/**/*.log" myblob://name-of-your-bucket/$BUILDKITE_JOB_ID
+
+   Creating an Amazon S3 or Google Cloud Storage client gives up after a minute
+   if it's stuck, such as waiting on an unreachable instance metadata service
+   for credentials. Set BUILDKITE_STORAGE_CLIENT_TIMEOUT, such as 5m, to wait
+   longer.
+
+   So that storage access logs and cost tools can tell whose artifacts are
+   being transferred, requests to storage can be tagged. The tags are added to
+   the User-Agent, and pipeline, queue, organization and step on their own
+   take their values from the job. Artifact download tags its requests too:
+
+   $ export BUILDKITE_ARTIFACT_REQUEST_TAGS="pipeline,queue,team=payments"
+   $ export BUILDKITE_ARTIFACT_REQUEST_HEADERS="X-Team=payments"
+
+   If storage can only be reached through a bastion, requests to it can be
+   sent through a SOCKS5 proxy, or an SSH tunnel, which logs in with
+   BUILDKITE_ARTIFACT_SSH_TUNNEL_KEY or the SSH agent, and checks the host's
+   key against ~/.ssh/known_hosts, or BUILDKITE_ARTIFACT_SSH_TUNNEL_KNOWN_HOSTS.
+   Artifact download uses them too:
+
+   $ export BUILDKITE_ARTIFACT_SOCKS5_PROXY="socks5://bastion.internal:1080"
+   $ export BUILDKITE_ARTIFACT_SSH_TUNNEL="deploy@bastion.internal"
+
+   Artifacts can be processed before they're uploaded, with rules that are
+   usually set for every job in the agent's configuration. Each rule gives a
+   pattern, and the post-processors to apply to artifacts that match it: gzip
+   to upload a gzipped copy instead, or checksum, sign or sbom to also upload
+   the artifact's SHA-256 checksum, Ed25519 signature (with the key from
+   --artifact-signing-key) or SPDX bill of materials alongside it:
+
+   $ buildkite-agent artifact upload "**/*.log;dist/*" --artifact-post-processors "*.log=gzip;dist/*=checksum,sign"
+
+   Large artifacts that change a little between builds, such as disk images,
+   can be uploaded in chunks with the chunk post-processor. Only the chunks
+   that aren't in --chunk-base-build, such as the last build of the branch,
+   are uploaded, and artifact download --chunked only downloads the chunks
+   that aren't in the file it's replacing:
+
+   $ buildkite-agent artifact upload "disk.img" --artifact-post-processors "*.img=chunk" --chunk-base-build "$LAST_BUILD_ID"
+
+   Artifacts can be encrypted with AES-256-GCM before they leave the agent, so
+   that whoever can read the bucket can't read them. They're encrypted after
+   any post-processing, and artifact download decrypts them when it's given
+   the same key:
+
+   $ openssl rand -base64 32 > artifacts.key
+   $ buildkite-agent artifact upload "secrets/*" s3://shared-bucket/$BUILDKITE_JOB_ID --encryption-key-file artifacts.key
+
+   When the jobs of a matrix build each produce the same paths for a different
+   platform, name the artifacts after the platform so they don't collide. The
+   template can use the artifact's .Path, .Dir, .Name and .Ext, and the agent's
+   .Os and .Arch:
+
+   $ buildkite-agent artifact upload "dist/app" --name-template "{{.Path}}-{{.Os}}-{{.Arch}}"
+
+   Jobs that upload many optional artifacts, such as screenshots, can carry on
+   when a few of them fail to upload. The failures are still logged:
+
+   $ buildkite-agent artifact upload "screenshots/**/*.png" --allow-failures 5%
+
+   Instead of setting credentials in the environment, you can have a helper
+   command provide short-lived ones. It's run with the argument "get" and
+   {"backend":"s3","location":"bucket"} on stdin (with a backend of s3, gs, rt
+   or az), and prints JSON with access_key_id, secret_access_key and
+   session_token for S3, a token for Google Cloud Storage or Azure, or a token
+   or username and password for Artifactory, and optionally an RFC 3339
+   expiration:
+
+   $ export BUILDKITE_STORAGE_CREDENTIAL_HELPER=/usr/local/bin/my-credential-broker
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID`
 
 var FollowSymlinksFlag = cli.BoolFlag{
 	Name:   "follow-symlinks",
@@ -68,22 +188,43 @@ type ArtifactUploadConfig struct {
 	Destination string `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 	Job         string `cli:"job" validate:"required"`
 	ContentType string `cli:"content-type"`
+	DryRun      bool   `cli:"dry-run"`
+	Format      string `cli:"format"`
+
+	// Where chunked artifacts' unchanged chunks are
+	ChunkBaseBuild string `cli:"chunk-base-build"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+
+	// Metrics config
+	MetricsDatadog              bool   `cli:"metrics-datadog"`
+	MetricsDatadogHost          string `cli:"metrics-datadog-host"`
+	MetricsDatadogDistributions bool   `cli:"metrics-datadog-distributions"`
+	UsagePath                   string `cli:"usage-path" normalize:"filepath"`
 
 	// Uploader flags
-	FollowSymlinks bool `cli:"follow-symlinks"`
+	FollowSymlinks         bool   `cli:"follow-symlinks"`
+	IgnorePaths            string `cli:"ignore-paths"`
+	ArtifactPostProcessors string `cli:"artifact-post-processors"`
+	ArtifactSigningKey     string `cli:"artifact-signing-key" normalize:"filepath"`
+	EncryptionKeyFile      string `cli:"encryption-key-file" normalize:"filepath"`
+	NameTemplate           string `cli:"name-template"`
+	AllowFailures          string `cli:"allow-failures"`
+	DefaultDestination     string `cli:"artifact-upload-default-destination"`
 }
 
 var ArtifactUploadCommand = cli.Command{
@@ -97,18 +238,48 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "Which job should the artifacts be uploaded to",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:   "ignore-paths",
+			Value:  "",
+			Usage:  "Semicolon separated gitignore-style patterns for files and directories to leave out of the upload",
+			EnvVar: "BUILDKITE_ARTIFACT_IGNORE_PATHS",
+		},
 		cli.StringFlag{
 			Name:   "content-type",
 			Value:  "",
 			Usage:  "A specific Content-Type to set for the artifacts (otherwise detected)",
 			EnvVar: "BUILDKITE_ARTIFACT_CONTENT_TYPE",
 		},
+		cli.StringFlag{
+			Name:   "chunk-base-build",
+			Value:  "",
+			Usage:  "The UUID of an earlier build whose chunks of artifacts uploaded with the chunk post-processor don't need uploading again",
+			EnvVar: "BUILDKITE_ARTIFACT_CHUNK_BASE_BUILD",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DRY_RUN",
+			Usage:  "Find the files that match and print what would be uploaded, with their sizes and checksums, and where to, without uploading them",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "Set to json to print what a --dry-run would upload as JSON",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Metrics flags
+		MetricsDatadogFlag,
+		MetricsDatadogHostFlag,
+		MetricsDatadogDistributionsFlag,
+		UsagePathFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -116,7 +287,14 @@ var ArtifactUploadCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 		FollowSymlinksFlag,
+		ArtifactPostProcessorsFlag,
+		ArtifactSigningKeyFlag,
+		EncryptionKeyFileFlag,
+		ArtifactNameTemplateFlag,
+		AllowFailuresFlag,
+		ArtifactUploadDefaultDestinationFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -128,7 +306,7 @@ var ArtifactUploadCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -142,22 +320,105 @@ var ArtifactUploadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
+		// Start the metrics collector, which is a no-op unless a metrics
+		// backend has been configured
+		mc := metrics.NewCollector(l, loadMetricsCollectorConfig(cfg))
+		if err := mc.Start(); err != nil {
+			l.Fatal("Failed to start metrics collection: %s", err)
+		}
+
+		// Check the destination before anything's uploaded to it
+		if destination.HasScheme(cfg.Destination, destination.Schemes...) {
+			if _, err := destination.Parse(cfg.Destination); err != nil {
+				l.Fatal("Invalid destination: %s", err)
+			}
+		}
+		if cfg.Destination == "" && cfg.DefaultDestination != "" {
+			if _, err := destination.Parse(cfg.DefaultDestination); err != nil {
+				l.Fatal("Invalid artifact-upload-default-destination: %s", err)
+			}
+		}
+
+		if cfg.Format != "" && cfg.Format != "json" {
+			l.Fatal("Invalid --format %q, the only format is json", cfg.Format)
+		}
+		if cfg.Format == "json" && !cfg.DryRun {
+			l.Fatal("--format json can only be used with --dry-run")
+		}
+
+		allowFailures, err := agent.ParseFailureThreshold(cfg.AllowFailures)
+		if err != nil {
+			l.Fatal("Invalid --allow-failures: %s", err)
+		}
+
+		// Record what was transferred, if --usage-path is set
+		usageRecorder := jobUsageRecorder(cfg.UsagePath)
+
 		// Setup the uploader
 		uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
-			JobID:          cfg.Job,
-			Paths:          cfg.UploadPaths,
-			Destination:    cfg.Destination,
-			ContentType:    cfg.ContentType,
-			DebugHTTP:      cfg.DebugHTTP,
-			FollowSymlinks: cfg.FollowSymlinks,
+			JobID:              cfg.Job,
+			JobName:            os.Getenv("BUILDKITE_LABEL"),
+			StepKey:            os.Getenv("BUILDKITE_STEP_KEY"),
+			Paths:              cfg.UploadPaths,
+			Destination:        cfg.Destination,
+			ContentType:        cfg.ContentType,
+			DefaultDestination: cfg.DefaultDestination,
+			PendingWritesDir:   os.Getenv(agent.PendingWritesDirEnv),
+			DebugHTTP:          cfg.DebugHTTP,
+			FollowSymlinks:     cfg.FollowSymlinks,
+			IgnorePaths:        cfg.IgnorePaths,
+			PostProcessors:     cfg.ArtifactPostProcessors,
+			SigningKeyPath:     cfg.ArtifactSigningKey,
+			ChunkBaseBuild:     cfg.ChunkBaseBuild,
+			EncryptionKeyPath:  cfg.EncryptionKeyFile,
+			NameTemplate:       cfg.NameTemplate,
+			AllowFailures:      allowFailures,
+			Metrics:            mc.Scope(jobMetricsTags()),
+			Usage:              usageRecorder,
+			DryRun:             cfg.DryRun,
 		})
 
+		// Let the agent know the job is transferring artifacts
+		unmark, err := agent.MarkArtifactTransfer(os.Getenv(agent.ArtifactTransfersDirEnv))
+		if err != nil {
+			l.Warn("%s", err)
+		}
+		defer unmark()
+
 		// Upload the artifacts
-		if err := uploader.Upload(ctx); err != nil {
+		err = uploader.Upload(ctx)
+
+		// Record what was transferred, even if some of it failed
+		if err := usageRecorder.Flush(); err != nil {
+			l.Warn("Failed to record usage: %s", err)
+		}
+
+		// Flush any buffered metrics before we potentially exit
+		if err := mc.Stop(); err != nil {
+			l.Warn("Failed to stop metrics collection: %s", err)
+		}
+
+		if err != nil {
 			l.Fatal("Failed to upload artifacts: %s", err)
 		}
+
+		if cfg.Format == "json" {
+			plan := uploader.DryRunPlan()
+			if plan == nil {
+				plan = []agent.ArtifactUploadPlan{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(plan); err != nil {
+				l.Error("Failed to encode the upload plan: %s", err)
+			}
+		}
 	},
 }
@@ -61,6 +61,7 @@ type BootstrapConfig struct {
 	PipelineProvider             string   `cli:"pipeline-provider" validate:"required"`
 	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
 	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
+	PhaseTimingsAnnotation       bool     `cli:"phase-timings-annotation"`
 	CleanCheckout                bool     `cli:"clean-checkout"`
 	GitCheckoutFlags             string   `cli:"git-checkout-flags"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
@@ -71,6 +72,15 @@ type BootstrapConfig struct {
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
 	GitSubmoduleCloneConfig      []string `cli:"git-submodule-clone-config"`
+	GitCheckoutRetries           int      `cli:"git-checkout-retries"`
+	GitCheckoutRetryBackoff      string   `cli:"git-checkout-retry-backoff"`
+	GitCheckoutCleanOn           []string `cli:"git-checkout-clean-on" normalize:"list"`
+	GitRemoteFallbacks           []string `cli:"git-remote-fallbacks" normalize:"list"`
+	GitCheckoutLayout            string   `cli:"git-checkout-layout"`
+	GitSubmoduleCredentials      []string `cli:"git-submodule-credentials" normalize:"list"`
+	GitSubmoduleConcurrency      int      `cli:"git-submodule-concurrency"`
+	GitLFSSkipSmudge             bool     `cli:"git-lfs-skip-smudge"`
+	GitLFSInclude                []string `cli:"git-lfs-include" normalize:"list"`
 	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
@@ -88,7 +98,9 @@ type BootstrapConfig struct {
 	Experiments                  []string `cli:"experiment" normalize:"list"`
 	Phases                       []string `cli:"phases" normalize:"list"`
 	Profile                      string   `cli:"profile"`
+	RetryVerbose                 bool     `cli:"retry-verbose"`
 	CancelSignal                 string   `cli:"cancel-signal"`
+	CancelSignalTarget           string   `cli:"cancel-signal-target"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
 	TracingBackend               string   `cli:"tracing-backend"`
 	TracingServiceName           string   `cli:"tracing-service-name"`
@@ -195,6 +207,11 @@ var BootstrapCommand = cli.Command{
 			Usage:  "A custom location to upload artifact paths to (for example, s3://my-custom-bucket/and/prefix)",
 			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
 		},
+		cli.BoolFlag{
+			Name:   "phase-timings-annotation",
+			Usage:  "Annotate the build with how long each phase of the job took, such as its checkout, plugins and command",
+			EnvVar: "BUILDKITE_PHASE_TIMINGS_ANNOTATION",
+		},
 		cli.BoolFlag{
 			Name:   "clean-checkout",
 			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
@@ -236,6 +253,59 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Comma separated key=value git config pairs applied before git submodule clone commands. For example, ′update --init′. If the config is needed to be applied to all git commands, supply it in a global git config file for the system that the agent runs in instead.",
 			EnvVar: "BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG",
 		},
+		cli.IntFlag{
+			Name:   "git-checkout-retries",
+			Value:  3,
+			Usage:  "How many times to try the checkout, which is at least once for each remote",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-retry-backoff",
+			Value:  "constant:2s",
+			Usage:  "How long to wait between checkout attempts: constant or exponential, optionally with an interval like exponential:2s",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_RETRY_BACKOFF",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-checkout-clean-on",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated git commands that remove the checkout before it's tried again when they fail: checkout, clone, fetch, clean, clean-submodules, or none. Defaults to clone, clean and clean-submodules",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_CLEAN_ON",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-remote-fallbacks",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated git remotes, such as mirrors of the repository, to clone and fetch from in order when the repository can't be",
+			EnvVar: "BUILDKITE_GIT_REMOTE_FALLBACKS",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-layout",
+			Value:  "clone",
+			Usage:  "How checkouts are laid out: clone for a clone of the repository in each, or worktree for worktrees of a bare repository shared by each pipeline's checkouts on the host, which saves disk space and time when agents run many jobs of the same pipeline",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_LAYOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-credentials",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated credentials for the submodules on each host, either a token in an environment variable for https remotes, such as github.com=https-token-env:GITHUB_TOKEN, or a private key for ssh remotes, such as gitlab.example.com=ssh-key:/path/to/key",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_CREDENTIALS",
+		},
+		cli.IntFlag{
+			Name:   "git-submodule-concurrency",
+			Value:  1,
+			Usage:  "How many submodules to fetch and update at once",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_CONCURRENCY",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs-skip-smudge",
+			Usage:  "Leave Git LFS files as pointers when checking out, rather than downloading them. Jobs can download the ones they need with buildkite-agent lfs pull",
+			EnvVar: "BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-lfs-include",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated patterns of Git LFS files to download after checking out, such as \"assets/*.png\"",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
 		cli.StringFlag{
 			Name:   "git-mirrors-path",
 			Value:  "",
@@ -340,6 +410,12 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
 			Value:  "SIGTERM",
 		},
+		cli.StringFlag{
+			Name:   "cancel-signal-target",
+			Usage:  "Which processes to signal for cancellation, \"process-group\" or \"session\"",
+			EnvVar: "BUILDKITE_CANCEL_SIGNAL_TARGET",
+			Value:  "process-group",
+		},
 		cli.StringSliceFlag{
 			Name:   "redacted-vars",
 			Usage:  "Pattern of environment variable names containing sensitive values",
@@ -361,6 +437,7 @@ var BootstrapCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		// The configuration will be loaded into this struct
@@ -370,7 +447,7 @@ var BootstrapCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -381,13 +458,24 @@ var BootstrapCommand = cli.Command{
 		}
 
 		// Enable experiments
-		for _, name := range cfg.Experiments {
-			known := experiments.Enable(name)
+		for _, experiment := range cfg.Experiments {
+			name, percent, err := experiments.Parse(experiment)
+			if err != nil {
+				l.Warn("%s", err)
+				continue
+			}
+			known := experiments.EnableRollout(name, percent)
 			if !known {
 				l.Warn("Unknown experiment enabled: %q", name)
 			}
 		}
 
+		// The agent decides which experiments being rolled out are
+		// enabled for the job, but in case it's run some other way
+		for _, name := range experiments.EnabledFor(os.Getenv("BUILDKITE_BUILD_ID")) {
+			experiments.Enable(name)
+		}
+
 		// Handle profiling flag
 		done := HandleProfileFlag(l, cfg)
 		defer done()
@@ -413,6 +501,11 @@ var BootstrapCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		cancelSignalTarget, err := process.ParseSignalTarget(cfg.CancelSignalTarget)
+		if err != nil {
+			l.Fatal("Failed to parse cancel-signal-target: %v", err)
+		}
+
 		// Configure the bootstraper
 		bootstrap := bootstrap.New(bootstrap.Config{
 			AgentName:                    cfg.AgentName,
@@ -423,6 +516,7 @@ var BootstrapCommand = cli.Command{
 			BuildPath:                    cfg.BuildPath,
 			SocketsPath:                  cfg.SocketsPath,
 			CancelSignal:                 cancelSig,
+			CancelSignalTarget:           cancelSignalTarget,
 			CleanCheckout:                cfg.CleanCheckout,
 			Command:                      cfg.Command,
 			CommandEval:                  cfg.CommandEval,
@@ -438,11 +532,21 @@ var BootstrapCommand = cli.Command{
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
 			GitSubmodules:                cfg.GitSubmodules,
 			GitSubmoduleCloneConfig:      cfg.GitSubmoduleCloneConfig,
+			GitCheckoutRetries:           cfg.GitCheckoutRetries,
+			GitCheckoutRetryBackoff:      cfg.GitCheckoutRetryBackoff,
+			GitCheckoutCleanOn:           cfg.GitCheckoutCleanOn,
+			GitRemoteFallbacks:           cfg.GitRemoteFallbacks,
+			GitCheckoutLayout:            cfg.GitCheckoutLayout,
+			GitSubmoduleCredentials:      cfg.GitSubmoduleCredentials,
+			GitSubmoduleConcurrency:      cfg.GitSubmoduleConcurrency,
+			GitLFSSkipSmudge:             cfg.GitLFSSkipSmudge,
+			GitLFSInclude:                cfg.GitLFSInclude,
 			HooksPath:                    cfg.HooksPath,
 			JobID:                        cfg.JobID,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			OrganizationSlug:             cfg.OrganizationSlug,
 			Phases:                       cfg.Phases,
+			PhaseTimingsAnnotation:       cfg.PhaseTimingsAnnotation,
 			PipelineProvider:             cfg.PipelineProvider,
 			PipelineSlug:                 cfg.PipelineSlug,
 			PluginValidation:             cfg.PluginValidation,
@@ -518,6 +622,6 @@ var BootstrapCommand = cli.Command{
 			}
 		}
 
-		os.Exit(exitCode)
+		exit(exitCode)
 	},
 }
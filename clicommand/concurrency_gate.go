@@ -0,0 +1,561 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/roko"
+	"github.com/urfave/cli"
+)
+
+const concurrencyGateHelpDescription = `Usage:
+
+   buildkite-agent concurrency gate <group> --limit <n> [options...]
+
+Description:
+
+   Waits until fewer than --limit jobs in the build hold the named group,
+   then holds it until "buildkite-agent concurrency release <group>" is run.
+   Unlike the concurrency attribute of a step, the group can be used by
+   commands in any step of the build, running on any host.
+
+   Slots in the group are kept in the build's meta-data. Meta-data has no
+   atomic compare-and-set, so the limit is best-effort: a slot is claimed by
+   setting it, then checking a few times, --settle-time apart, that no other
+   job has set it since. A job that loses a slot this way waits a random
+   time before looking for another. Jobs that claim the same slot at almost
+   the same moment can still both end up holding it, and nothing checks the
+   slot once the gate has returned, so don't rely on the limit for
+   correctness, only to reduce load.
+
+   Make sure to release the group even when the command fails (e.g. in a
+   trap or a pre-exit hook), otherwise its slot stays held until the build
+   finishes.
+
+   A step that's slow because it waited for a group doesn't look any
+   different from one that's slow for other reasons. With --annotate-waits,
+   each wait is added to a build annotation, with the group and how long the
+   job was blocked for.
+
+Example:
+
+   $ buildkite-agent concurrency gate "deploy-production" --limit 2
+   $ trap 'buildkite-agent concurrency release "deploy-production"' EXIT
+   $ ./deploy.sh`
+
+const concurrencyReleaseHelpDescription = `Usage:
+
+   buildkite-agent concurrency release <group> [options...]
+
+Description:
+
+   Releases the slot in the named group held by this job, so that another
+   job waiting at "buildkite-agent concurrency gate" can take it. Releasing a
+   group that the job doesn't hold does nothing.
+
+Example:
+
+   $ buildkite-agent concurrency release "deploy-production"`
+
+// concurrencySlotFree is the value of a slot once it's been released, since
+// meta-data can't be deleted
+const concurrencySlotFree = "free"
+
+// How many times a job checks that it still holds a slot it's claimed,
+// --settle-time apart, before it counts as acquired
+const concurrencySettleChecks = 3
+
+type ConcurrencyGateConfig struct {
+	Group         string `cli:"arg:0" label:"group" validate:"required"`
+	Limit         int    `cli:"limit" validate:"required"`
+	Timeout       string `cli:"timeout"`
+	PollInterval  string `cli:"poll-interval"`
+	SettleTime    string `cli:"settle-time"`
+	AnnotateWaits bool   `cli:"annotate-waits"`
+	Job           string `cli:"job" validate:"required"`
+	Label         string `cli:"label"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+}
+
+type ConcurrencyReleaseConfig struct {
+	Group string `cli:"arg:0" label:"group" validate:"required"`
+	Limit int    `cli:"limit"`
+	Job   string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+}
+
+var concurrencyJobFlag = cli.StringFlag{
+	Name:   "job",
+	Value:  "",
+	Usage:  "Which job should hold the slot in the group",
+	EnvVar: "BUILDKITE_JOB_ID",
+}
+
+var ConcurrencyGateCommand = cli.Command{
+	Name:        "gate",
+	Usage:       "Wait for a slot in a build-wide concurrency group",
+	Description: concurrencyGateHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "limit",
+			Usage:  "The most jobs that can hold the group at once",
+			EnvVar: "BUILDKITE_CONCURRENCY_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "timeout",
+			Value:  "0",
+			Usage:  "How long to wait for a slot, e.g. 30m. The default of 0 waits forever",
+			EnvVar: "BUILDKITE_CONCURRENCY_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "poll-interval",
+			Value:  "10s",
+			Usage:  "How often to check for a free slot while waiting",
+			EnvVar: "BUILDKITE_CONCURRENCY_POLL_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "settle-time",
+			Value:  "3s",
+			Usage:  "How long to wait between the checks, after claiming a slot, that no other job claimed it too. The limit is best-effort, as meta-data has no compare-and-set",
+			EnvVar: "BUILDKITE_CONCURRENCY_SETTLE_TIME",
+		},
+		cli.BoolFlag{
+			Name:   "annotate-waits",
+			Usage:  "If the job has to wait for a slot, add the group and how long it waited to the build's \"concurrency-waits\" annotation",
+			EnvVar: "BUILDKITE_CONCURRENCY_ANNOTATE_WAITS",
+		},
+		cli.StringFlag{
+			Name:   "label",
+			Value:  "",
+			Usage:  "The label of the job, for the annotation",
+			EnvVar: "BUILDKITE_LABEL",
+		},
+		concurrencyJobFlag,
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ConcurrencyGateConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Limit < 1 {
+			l.Fatal("--limit must be at least 1")
+		}
+
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			l.Fatal("Failed to parse timeout: %v", err)
+		}
+		pollInterval, err := time.ParseDuration(cfg.PollInterval)
+		if err != nil {
+			l.Fatal("Failed to parse poll-interval: %v", err)
+		}
+		settleTime, err := time.ParseDuration(cfg.SettleTime)
+		if err != nil {
+			l.Fatal("Failed to parse settle-time: %v", err)
+		}
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+		gate := &concurrencyGate{
+			client:     client,
+			logger:     l,
+			job:        cfg.Job,
+			group:      cfg.Group,
+			limit:      cfg.Limit,
+			settleTime: settleTime,
+		}
+
+		slot, err := gate.Acquire(ctx, pollInterval)
+		if err != nil {
+			l.Fatal("Failed to acquire concurrency group %q: %v", cfg.Group, err)
+		}
+
+		l.Info("Acquired slot %d of %d in concurrency group %q", slot+1, cfg.Limit, cfg.Group)
+
+		// The slot is held either way, so failing to annotate only warns.
+		// It's done with a context of its own, as the timeout was for the wait
+		if cfg.AnnotateWaits && gate.waited > 0 {
+			if err := annotateConcurrencyWait(context.Background(), l, client, cfg.Job, cfg.Label, cfg.Group, gate.waited); err != nil {
+				l.Warn("Failed to annotate the wait for concurrency group %q: %v", cfg.Group, err)
+			}
+		}
+	},
+}
+
+var ConcurrencyReleaseCommand = cli.Command{
+	Name:        "release",
+	Usage:       "Release this job's slot in a build-wide concurrency group",
+	Description: concurrencyReleaseHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "limit",
+			Value:  100,
+			Usage:  "The most slots to check for the one held by this job",
+			EnvVar: "BUILDKITE_CONCURRENCY_LIMIT",
+		},
+		concurrencyJobFlag,
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ConcurrencyReleaseConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		gate := &concurrencyGate{
+			client: api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken")),
+			logger: l,
+			job:    cfg.Job,
+			group:  cfg.Group,
+			limit:  cfg.Limit,
+		}
+
+		released, err := gate.Release(ctx)
+		if err != nil {
+			l.Fatal("Failed to release concurrency group %q: %v", cfg.Group, err)
+		}
+
+		if released {
+			l.Info("Released concurrency group %q", cfg.Group)
+		} else {
+			l.Info("This job doesn't hold concurrency group %q", cfg.Group)
+		}
+	},
+}
+
+// metaDataClient is the part of the API client the concurrency gate uses
+type metaDataClient interface {
+	GetMetaData(ctx context.Context, scope, id, key string) (*api.MetaData, *api.Response, error)
+	SetMetaData(ctx context.Context, jobId string, metaData *api.MetaData) (*api.Response, error)
+}
+
+// concurrencyGate limits how many jobs in a build hold a group at once. Each
+// of the limit slots is a meta-data key holding the ID of the job that
+// holds it.
+type concurrencyGate struct {
+	client     metaDataClient
+	logger     logger.Logger
+	job        string
+	group      string
+	limit      int
+	settleTime time.Duration
+
+	// How long Acquire waited for a slot to be free
+	waited time.Duration
+}
+
+func (g *concurrencyGate) slotKey(slot int) string {
+	return fmt.Sprintf("buildkite:concurrency-gate:%s:%d", g.group, slot)
+}
+
+// holder returns the ID of the job holding slot, or "" if it's free, and
+// whether the slot has ever been claimed
+func (g *concurrencyGate) holder(ctx context.Context, slot int) (holder string, claimed bool, err error) {
+	err = roko.NewRetrier(
+		roko.WithMaxAttempts(5),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+	).DoWithContext(ctx, retrylog.Wrap("Fetching concurrency slot", func(r *roko.Retrier) error {
+		md, resp, err := g.client.GetMetaData(ctx, "job", g.job, g.slotKey(slot))
+		if resp != nil && resp.StatusCode == 404 {
+			// The slot has never been claimed
+			holder, claimed = "", false
+			r.Break()
+			return nil
+		}
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 400) {
+			r.Break()
+		}
+		if err != nil {
+			g.logger.Warn("%s (%s)", err, r)
+			return err
+		}
+		holder, claimed = md.Value, true
+		return nil
+	}))
+
+	if holder == concurrencySlotFree {
+		holder = ""
+	}
+	return holder, claimed, err
+}
+
+func (g *concurrencyGate) set(ctx context.Context, slot int, value string) error {
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(5),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+	).DoWithContext(ctx, retrylog.Wrap("Setting concurrency slot", func(r *roko.Retrier) error {
+		resp, err := g.client.SetMetaData(ctx, g.job, &api.MetaData{Key: g.slotKey(slot), Value: value})
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			r.Break()
+		}
+		if err != nil {
+			g.logger.Warn("%s (%s)", err, r)
+		}
+		return err
+	}))
+}
+
+// tryAcquire makes one pass over the slots, claiming the first free one. It
+// returns -1 if every slot is held by another job.
+func (g *concurrencyGate) tryAcquire(ctx context.Context) (int, error) {
+	for slot := 0; slot < g.limit; slot++ {
+		holder, _, err := g.holder(ctx, slot)
+		if err != nil {
+			return -1, err
+		}
+
+		switch holder {
+		case g.job:
+			// Already held, e.g. the gate is being retried
+			return slot, nil
+		case "":
+			if err := g.set(ctx, slot, g.job); err != nil {
+				return -1, err
+			}
+
+			held, err := g.verifyClaim(ctx, slot)
+			if err != nil {
+				return -1, err
+			}
+			if held {
+				return slot, nil
+			}
+
+			// Jobs that collided on this slot would probably collide on
+			// the next one too, unless they wait different amounts of time
+			if g.settleTime > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(g.settleTime)))):
+				case <-ctx.Done():
+					return -1, ctx.Err()
+				}
+			}
+		default:
+			g.logger.Debug("Slot %d is held by job %s", slot, holder)
+		}
+	}
+
+	return -1, nil
+}
+
+// verifyClaim checks that the job still holds a slot it's claimed, after
+// each of concurrencySettleChecks settle times. Any other job that saw the
+// slot as free at the same time may have claimed it too, in which case the
+// last one to claim it wins, and the others carry on looking. It reports
+// whether the job held the slot at every check.
+func (g *concurrencyGate) verifyClaim(ctx context.Context, slot int) (bool, error) {
+	for i := 0; i < concurrencySettleChecks; i++ {
+		select {
+		case <-time.After(g.settleTime):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+
+		holder, _, err := g.holder(ctx, slot)
+		if err != nil {
+			return false, err
+		}
+		if holder != g.job {
+			g.logger.Debug("Slot %d was claimed by job %s at the same time", slot, holder)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Acquire waits until the job holds a slot, checking every pollInterval.
+func (g *concurrencyGate) Acquire(ctx context.Context, pollInterval time.Duration) (int, error) {
+	for {
+		slot, err := g.tryAcquire(ctx)
+		if err != nil {
+			return -1, err
+		}
+		if slot >= 0 {
+			return slot, nil
+		}
+
+		g.logger.Info("All %d slots in concurrency group %q are held, waiting...", g.limit, g.group)
+
+		waitStart := time.Now()
+		select {
+		case <-time.After(pollInterval):
+			g.waited += time.Since(waitStart)
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return -1, errors.New("timed out waiting for a free slot")
+			}
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// Release frees the slot held by the job. It reports whether the job held
+// one.
+func (g *concurrencyGate) Release(ctx context.Context) (bool, error) {
+	for slot := 0; slot < g.limit; slot++ {
+		holder, claimed, err := g.holder(ctx, slot)
+		if err != nil {
+			return false, err
+		}
+		if !claimed {
+			// Slots are claimed in order, so no later slot has been
+			// claimed either
+			return false, nil
+		}
+		if holder == g.job {
+			return true, g.set(ctx, slot, concurrencySlotFree)
+		}
+	}
+	return false, nil
+}
+
+// The context of the annotation that concurrency waits are added to
+const concurrencyWaitsAnnotationContext = "concurrency-waits"
+
+// annotator is the part of the API client that annotates builds
+type annotator interface {
+	Annotate(ctx context.Context, jobId string, annotation *api.Annotation) (*api.Response, error)
+}
+
+// annotateConcurrencyWait adds a line saying how long a job waited for a
+// group to the build's concurrency waits annotation
+func annotateConcurrencyWait(ctx context.Context, l logger.Logger, client annotator, job, label, group string, waited time.Duration) error {
+	if label == "" {
+		label = job
+	}
+	annotation := &api.Annotation{
+		Body:    fmt.Sprintf("- %s waited **%s** for concurrency group `%s`\n", label, waited.Round(time.Second), group),
+		Context: concurrencyWaitsAnnotationContext,
+		Style:   "info",
+		Append:  true,
+	}
+
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(5),
+		roko.WithStrategy(roko.Constant(1*time.Second)),
+		roko.WithJitter(),
+	).DoWithContext(ctx, retrylog.Wrap("Annotating build", func(r *roko.Retrier) error {
+		resp, err := client.Annotate(ctx, job, annotation)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			r.Break()
+			return err
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, r)
+			return err
+		}
+		return nil
+	}))
+}
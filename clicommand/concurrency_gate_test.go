@@ -0,0 +1,167 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMetaData is build meta-data shared by every job in the build
+type fakeMetaData struct {
+	sync.Mutex
+	data map[string]string
+}
+
+func (f *fakeMetaData) GetMetaData(_ context.Context, scope, id, key string) (*api.MetaData, *api.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	value, ok := f.data[key]
+	if !ok {
+		return nil, &api.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}, errors.New("not found")
+	}
+	return &api.MetaData{Key: key, Value: value}, &api.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+}
+
+func (f *fakeMetaData) SetMetaData(_ context.Context, jobID string, md *api.MetaData) (*api.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.data[md.Key] = md.Value
+	return &api.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+}
+
+func TestConcurrencyGate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	md := &fakeMetaData{data: map[string]string{}}
+
+	gate := func(job string) *concurrencyGate {
+		return &concurrencyGate{client: md, logger: logger.Discard, job: job, group: "deploy", limit: 2}
+	}
+
+	slot, err := gate("job-1").Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, slot)
+
+	slot, err = gate("job-2").Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slot)
+
+	// Acquiring again is a no-op
+	slot, err = gate("job-1").Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, slot)
+
+	// Both slots are held, so job-3 has to wait
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = gate("job-3").Acquire(timeoutCtx, time.Millisecond)
+	assert.EqualError(t, err, "timed out waiting for a free slot")
+
+	released, err := gate("job-1").Release(ctx)
+	assert.NoError(t, err)
+	assert.True(t, released)
+	assert.Equal(t, concurrencySlotFree, md.data["buildkite:concurrency-gate:deploy:0"])
+
+	slot, err = gate("job-3").Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, slot)
+
+	released, err = gate("job-4").Release(ctx)
+	assert.NoError(t, err)
+	assert.False(t, released)
+}
+
+// racingMetaData is meta-data where another job claims a slot once the job
+// under test has checked it holds it a given number of times
+type racingMetaData struct {
+	*fakeMetaData
+	key    string
+	checks int
+	rival  string
+}
+
+func (r *racingMetaData) GetMetaData(ctx context.Context, scope, id, key string) (*api.MetaData, *api.Response, error) {
+	md, resp, err := r.fakeMetaData.GetMetaData(ctx, scope, id, key)
+	if key == r.key && err == nil && md.Value == id {
+		if r.checks--; r.checks == 0 {
+			r.fakeMetaData.SetMetaData(ctx, r.rival, &api.MetaData{Key: key, Value: r.rival})
+		}
+	}
+	return md, resp, err
+}
+
+func TestConcurrencyGateReverifiesClaims(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	md := &racingMetaData{
+		fakeMetaData: &fakeMetaData{data: map[string]string{}},
+		key:          "buildkite:concurrency-gate:deploy:0",
+		checks:       2,
+		rival:        "job-2",
+	}
+
+	// job-2 takes slot 0 after job-1's first two checks, so job-1 moves on
+	gate := &concurrencyGate{client: md, logger: logger.Discard, job: "job-1", group: "deploy", limit: 2, settleTime: time.Millisecond}
+	slot, err := gate.Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slot)
+	assert.Equal(t, "job-2", md.data["buildkite:concurrency-gate:deploy:0"])
+	assert.Equal(t, "job-1", md.data["buildkite:concurrency-gate:deploy:1"])
+}
+
+// fakeAnnotator records the annotations made
+type fakeAnnotator struct {
+	annotations []*api.Annotation
+}
+
+func (f *fakeAnnotator) Annotate(_ context.Context, _ string, annotation *api.Annotation) (*api.Response, error) {
+	f.annotations = append(f.annotations, annotation)
+	return &api.Response{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func TestConcurrencyGateWaited(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	md := &fakeMetaData{data: map[string]string{}}
+
+	holder := &concurrencyGate{client: md, logger: logger.Discard, job: "job-1", group: "deploy", limit: 1}
+	_, err := holder.Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Zero(t, holder.waited)
+
+	waiter := &concurrencyGate{client: md, logger: logger.Discard, job: "job-2", group: "deploy", limit: 1}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		holder.Release(ctx)
+	}()
+	_, err = waiter.Acquire(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, waiter.waited, 10*time.Millisecond)
+}
+
+func TestAnnotateConcurrencyWait(t *testing.T) {
+	t.Parallel()
+
+	client := &fakeAnnotator{}
+	err := annotateConcurrencyWait(context.Background(), logger.Discard, client, "job-1", ":rocket: Deploy", "deploy-production", 125*time.Second)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*api.Annotation{{
+		Body:    "- :rocket: Deploy waited **2m5s** for concurrency group `deploy-production`\n",
+		Context: "concurrency-waits",
+		Style:   "info",
+		Append:  true,
+	}}, client.annotations)
+}
@@ -54,7 +54,7 @@ var EnvDumpCommand = cli.Command{
 
 		if err := enc.Encode(envMap); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Error marshalling JSON: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		return nil
 	},
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/jobapi"
@@ -83,13 +82,13 @@ func envGetAction(c *cli.Context) error {
 	client, err := jobapi.NewDefaultClient()
 	if err != nil {
 		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	envMap, err := client.EnvGet(context.Background())
 	if err != nil {
 		fmt.Fprintf(c.App.ErrWriter, "Couldn't fetch the job executor environment variables: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	notFound := false
@@ -131,7 +130,7 @@ func envGetAction(c *cli.Context) error {
 		}
 		if err := enc.Encode(envMap); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Error marshalling JSON: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 	default:
@@ -139,7 +138,7 @@ func envGetAction(c *cli.Context) error {
 	}
 
 	if notFound {
-		os.Exit(1)
+		exit(1)
 	}
 	return nil
 }
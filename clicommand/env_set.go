@@ -66,7 +66,7 @@ func envSetAction(c *cli.Context) error {
 	client, err := jobapi.NewDefaultClient()
 	if err != nil {
 		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	req := &jobapi.EnvUpdateRequest{
@@ -105,20 +105,20 @@ func envSetAction(c *cli.Context) error {
 			for sc.Scan() {
 				if err := parse(sc.Text()); err != nil {
 					fmt.Fprintf(c.App.ErrWriter, "Couldn't parse input line %d: %v\n", line, err)
-					os.Exit(1)
+					exit(1)
 				}
 				line++
 			}
 			if err := sc.Err(); err != nil {
 				fmt.Fprintf(c.App.ErrWriter, "Couldn't scan the input buffer: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
 			continue
 		}
 		// Parse args directly
 		if err := parse(arg); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Couldn't parse the command-line argument %q: %v\n", arg, err)
-			os.Exit(1)
+			exit(1)
 		}
 	}
 
@@ -155,7 +155,7 @@ func envSetAction(c *cli.Context) error {
 		}
 		if err := enc.Encode(resp); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Error marshalling JSON: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 	default:
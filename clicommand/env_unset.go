@@ -65,7 +65,7 @@ func envUnsetAction(c *cli.Context) error {
 	client, err := jobapi.NewDefaultClient()
 	if err != nil {
 		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	var del []string
@@ -97,20 +97,20 @@ func envUnsetAction(c *cli.Context) error {
 			for sc.Scan() {
 				if err := parse(sc.Text()); err != nil {
 					fmt.Fprintf(c.App.ErrWriter, "Couldn't parse input line %d: %v\n", line, err)
-					os.Exit(1)
+					exit(1)
 				}
 				line++
 			}
 			if err := sc.Err(); err != nil {
 				fmt.Fprintf(c.App.ErrWriter, "Couldn't scan the input buffer: %v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
 			continue
 		}
 		// Parse args directly
 		if err := parse(arg); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Couldn't parse the command-line argument %q: %v\n", arg, err)
-			os.Exit(1)
+			exit(1)
 		}
 	}
 
@@ -140,7 +140,7 @@ func envUnsetAction(c *cli.Context) error {
 		}
 		if err := enc.Encode(unset); err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "Error marshalling JSON: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 	default:
@@ -1,15 +1,23 @@
 package clicommand
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/chaos"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
+	"github.com/buildkite/agent/v3/usage"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/oleiade/reflections"
 	"github.com/urfave/cli"
@@ -17,6 +25,11 @@ import (
 
 const (
 	DefaultEndpoint = "https://agent.buildkite.com/v3"
+
+	// RequestTimeoutExitCode is the exit status of a command that fails
+	// because its --request-timeout expired. It's the same status that
+	// timeout(1) uses.
+	RequestTimeoutExitCode = 124
 )
 
 var AgentAccessTokenFlag = cli.StringFlag{
@@ -33,6 +46,13 @@ var AgentRegisterTokenFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_TOKEN",
 }
 
+var AgentSecondaryTokenFlag = cli.StringFlag{
+	Name:   "secondary-token",
+	Value:  "",
+	Usage:  "Another agent token to register with if Buildkite rejects --token, such as while rotating tokens. Agents whose token is revoked while they're running register again with it",
+	EnvVar: "BUILDKITE_AGENT_SECONDARY_TOKEN",
+}
+
 var EndpointFlag = cli.StringFlag{
 	Name:   "endpoint",
 	Value:  DefaultEndpoint,
@@ -46,6 +66,12 @@ var NoHTTP2Flag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_NO_HTTP2",
 }
 
+var RequestTimeoutFlag = cli.StringFlag{
+	Name:   "request-timeout",
+	Usage:  "Give up if the command, including any retries, takes longer than this (e.g. 30s), and exit with status 124. By default there's no timeout",
+	EnvVar: "BUILDKITE_AGENT_REQUEST_TIMEOUT",
+}
+
 var DebugFlag = cli.BoolFlag{
 	Name:   "debug",
 	Usage:  "Enable debug mode. Synonym for ′--log-level debug′. Takes precedence over ′--log-level′",
@@ -65,12 +91,25 @@ var ProfileFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_PROFILE",
 }
 
+var RetryVerboseFlag = cli.BoolFlag{
+	Name:   "retry-verbose",
+	Usage:  "Log every failed attempt of a retried operation, with its cause, attempt number and the delay before the next attempt",
+	EnvVar: "BUILDKITE_AGENT_RETRY_VERBOSE",
+}
+
 var DebugHTTPFlag = cli.BoolFlag{
 	Name:   "debug-http",
 	Usage:  "Enable HTTP debug mode, which dumps all request and response bodies to the log",
 	EnvVar: "BUILDKITE_AGENT_DEBUG_HTTP",
 }
 
+var DebugHTTPDumpFlag = cli.StringFlag{
+	Name:   "debug-http-dump",
+	Value:  "",
+	Usage:  "Write all request and response bodies, with credentials redacted, to files in this directory rather than the log",
+	EnvVar: "BUILDKITE_AGENT_DEBUG_HTTP_DUMP",
+}
+
 var NoColorFlag = cli.BoolFlag{
 	Name:   "no-color",
 	Usage:  "Don't show colors in logging",
@@ -80,10 +119,99 @@ var NoColorFlag = cli.BoolFlag{
 var ExperimentsFlag = cli.StringSliceFlag{
 	Name:   "experiment",
 	Value:  &cli.StringSlice{},
-	Usage:  "Enable experimental features within the buildkite-agent",
+	Usage:  "Enable experimental features within the buildkite-agent. Add =<percent>%, such as streaming-logs=25%, to the agent's to only enable it for that percentage of builds",
 	EnvVar: "BUILDKITE_AGENT_EXPERIMENT",
 }
 
+var MetricsDatadogFlag = cli.BoolFlag{
+	Name:   "metrics-datadog",
+	Usage:  "Send metrics to DogStatsD for Datadog",
+	EnvVar: "BUILDKITE_METRICS_DATADOG",
+}
+
+var MetricsDatadogHostFlag = cli.StringFlag{
+	Name:   "metrics-datadog-host",
+	Usage:  "The dogstatsd instance to send metrics to using udp",
+	EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
+	Value:  "127.0.0.1:8125",
+}
+
+var MetricsDatadogDistributionsFlag = cli.BoolFlag{
+	Name:   "metrics-datadog-distributions",
+	Usage:  "Use Datadog Distributions for Timing metrics",
+	EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
+}
+
+var UsagePathFlag = cli.StringFlag{
+	Name:   "usage-path",
+	Value:  "",
+	Usage:  "A file to record the data transferred by jobs in, for ′buildkite-agent usage report′. By default nothing is recorded",
+	EnvVar: "BUILDKITE_USAGE_PATH",
+}
+
+var ArtifactPostProcessorsFlag = cli.StringFlag{
+	Name:   "artifact-post-processors",
+	Value:  "",
+	Usage:  "Rules for processing artifacts before they're uploaded, such as \"*.log=gzip;dist/**/*=checksum,sign,sbom\". Artifacts matching each pattern are gzipped, or have their SHA-256 checksum, signature or SPDX bill of materials uploaded alongside them",
+	EnvVar: "BUILDKITE_ARTIFACT_POST_PROCESSORS",
+}
+
+var ArtifactURLRewritesFlag = cli.StringFlag{
+	Name:   "artifact-url-rewrites",
+	Value:  "",
+	Usage:  "Semicolon separated rules for rewriting the URLs and upload destinations of artifacts before they're downloaded, such as \"^https://artifacts\\.internal/=>https://cdn.example.com/\". Each is a regular expression and its replacement",
+	EnvVar: "BUILDKITE_ARTIFACT_URL_REWRITES",
+}
+
+var ArtifactUploadDefaultDestinationFlag = cli.StringFlag{
+	Name:   "artifact-upload-default-destination",
+	Value:  "",
+	Usage:  "Where artifacts uploaded without a destination go instead of Buildkite's artifact storage, such as \"s3://my-artifacts/buildkite\". They're still registered with Buildkite, under the job's ID",
+	EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DEFAULT_DESTINATION",
+}
+
+var ArtifactSigningKeyFlag = cli.StringFlag{
+	Name:   "artifact-signing-key",
+	Value:  "",
+	Usage:  "Path to a PEM encoded Ed25519 private key that the sign artifact post-processor signs artifacts with",
+	EnvVar: "BUILDKITE_ARTIFACT_SIGNING_KEY",
+}
+
+var EncryptionKeyFileFlag = cli.StringFlag{
+	Name:   "encryption-key-file",
+	Value:  "",
+	Usage:  "Path to a 256 bit AES key, as 32 bytes or their base64, or kms: and the base64 of a key encrypted with AWS KMS, to encrypt artifacts with before they're uploaded, and decrypt them with after they're downloaded. Downloading an artifact that wasn't encrypted with a key fails",
+	EnvVar: "BUILDKITE_ARTIFACT_ENCRYPTION_KEY_FILE",
+}
+
+var ArtifactNameTemplateFlag = cli.StringFlag{
+	Name:   "name-template",
+	Value:  "",
+	Usage:  "A Go text/template to name artifacts with, from their .Path, .Dir, .Name and .Ext, and the agent's .Os and .Arch, such as \"{{.Path}}-{{.Os}}-{{.Arch}}\"",
+	EnvVar: "BUILDKITE_ARTIFACT_NAME_TEMPLATE",
+}
+
+var AllowFailuresFlag = cli.StringFlag{
+	Name:   "allow-failures",
+	Value:  "",
+	Usage:  "How many artifacts can fail to transfer without the command failing, as a count such as 5, or a percentage of the artifacts such as 10%. Failures are still logged",
+	EnvVar: "BUILDKITE_ARTIFACT_ALLOW_FAILURES",
+}
+
+var ArtifactPeersFlag = cli.StringSliceFlag{
+	Name:   "peers",
+	Value:  &cli.StringSlice{},
+	Usage:  "Other agents serving their shared cache with artifact serve, as host:port, to fetch artifacts from before the object store. Needs the artifact-peers experiment",
+	EnvVar: "BUILDKITE_ARTIFACT_PEERS",
+}
+
+var ArtifactPeerTokenFlag = cli.StringFlag{
+	Name:   "peer-token",
+	Value:  "",
+	Usage:  "A secret shared by agents that fetch artifacts from each other with the artifact-peers experiment. It's sent to peers over plain HTTP, so it only keeps out hosts that can't see the traffic between them",
+	EnvVar: "BUILDKITE_ARTIFACT_PEER_TOKEN",
+}
+
 var RedactedVars = cli.StringSliceFlag{
 	Name:   "redacted-vars",
 	Usage:  "Pattern of environment variable names containing sensitive values",
@@ -132,12 +260,12 @@ func CreateLogger(cfg any) logger.Logger {
 			printer.Colors = true
 		}
 
-		l = logger.NewConsoleLogger(printer, os.Exit)
+		l = logger.NewConsoleLogger(printer, exit)
 	case "json":
-		l = logger.NewConsoleLogger(logger.NewJSONPrinter(os.Stdout), os.Exit)
+		l = logger.NewConsoleLogger(logger.NewJSONPrinter(os.Stdout), exit)
 	default:
 		fmt.Printf("Unknown log-format of %q, try text or json\n", logFormat)
-		os.Exit(1)
+		exit(1)
 	}
 
 	l.SetLevel(logger.NOTICE)
@@ -171,17 +299,57 @@ func HandleGlobalFlags(l logger.Logger, cfg any) func() {
 	if err == nil {
 		experimentNamesSlice, ok := experimentNames.([]string)
 		if ok {
-			for _, name := range experimentNamesSlice {
-				known := experiments.Enable(name)
+			for _, experiment := range experimentNamesSlice {
+				name, percent, err := experiments.Parse(experiment)
+				if err != nil {
+					l.Warn("%s", err)
+					continue
+				}
+				known := experiments.EnableRollout(name, percent)
 				if !known {
 					l.Warn("Unknown experiment enabled: %q", name)
 					continue
 				}
+				if percent < 100 {
+					l.Debug("Enabled experiment %q for %d%% of builds", name, percent)
+					continue
+				}
 				l.Debug("Enabled experiment %q", name)
 			}
 		}
 	}
 
+	// Log retries if asked to
+	if retryVerbose, err := reflections.GetField(cfg, "RetryVerbose"); err == nil && retryVerbose == true {
+		retrylog.Enable(l)
+	}
+
+	// Make it obvious that chaos is being injected, as it's easy to leave on
+	if v := os.Getenv(chaos.EnvVar); v != "" {
+		if _, err := chaos.Parse(v); err != nil {
+			l.Error("%s, so every request will fail", err)
+		} else {
+			l.Warn("Injecting failures and latency into requests, as %s is set to %q", chaos.EnvVar, v)
+		}
+	}
+
+	// Say what artifact storage requests are tagged with, or why they aren't
+	if os.Getenv(storagetags.TagsEnvVar) != "" || os.Getenv(storagetags.HeadersEnvVar) != "" {
+		if tags, err := storagetags.Check(); err != nil {
+			l.Error("%s, so artifact storage requests won't be tagged", err)
+		} else {
+			l.Debug("Tagging artifact storage requests with User-Agent %q and headers %v", tags.UserAgent, tags.Headers)
+		}
+	}
+
+	if os.Getenv(storageproxy.SOCKS5ProxyEnvVar) != "" || os.Getenv(storageproxy.SSHTunnelEnvVar) != "" {
+		if proxy, err := storageproxy.Check(); err != nil {
+			l.Error("%s, so artifact storage requests will fail", err)
+		} else {
+			l.Debug("Sending artifact storage requests through %s", proxy)
+		}
+	}
+
 	// Handle profiling flag
 	return HandleProfileFlag(l, cfg)
 }
@@ -225,6 +393,45 @@ func UnsetConfigFromEnvironment(c *cli.Context) error {
 	return nil
 }
 
+// ErrRequestTimeout is what a command fails with when it's still running
+// once its --request-timeout expires
+var ErrRequestTimeout = errors.New("command didn't finish within the request timeout")
+
+// requestTimeout is the context of the running command's --request-timeout,
+// if it has one
+var requestTimeout context.Context
+
+// withRequestTimeout applies the --request-timeout flag to ctx, which is
+// cancelled when the timeout expires. If the command then fails, it exits
+// with RequestTimeoutExitCode.
+func withRequestTimeout(ctx context.Context, l logger.Logger, cfg any) (context.Context, context.CancelFunc) {
+	t, err := reflections.GetField(cfg, "RequestTimeout")
+	if err != nil || t == "" {
+		return context.WithCancel(ctx)
+	}
+
+	timeout, err := time.ParseDuration(t.(string))
+	if err != nil {
+		l.Fatal("Failed to parse request timeout: %v", err)
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	requestTimeout = ctx
+	return ctx, cancel
+}
+
+// requestTimeoutErr returns ErrRequestTimeout if the running command's
+// --request-timeout has expired
+func requestTimeoutErr() error {
+	if requestTimeout != nil && errors.Is(requestTimeout.Err(), context.DeadlineExceeded) {
+		return ErrRequestTimeout
+	}
+	return nil
+}
+
 func loadAPIClientConfig(cfg any, tokenField string) api.Config {
 	conf := api.Config{
 		UserAgent: version.UserAgent(),
@@ -236,6 +443,11 @@ func loadAPIClientConfig(cfg any, tokenField string) api.Config {
 		conf.DebugHTTP = true
 	}
 
+	debugHTTPDump, err := reflections.GetField(cfg, "DebugHTTPDump")
+	if debugHTTPDump != "" && err == nil {
+		conf.DebugHTTPDump = debugHTTPDump.(string)
+	}
+
 	endpoint, err := reflections.GetField(cfg, "Endpoint")
 	if endpoint != "" && err == nil {
 		conf.Endpoint = endpoint.(string)
@@ -253,3 +465,50 @@ func loadAPIClientConfig(cfg any, tokenField string) api.Config {
 
 	return conf
 }
+
+func loadMetricsCollectorConfig(cfg any) metrics.CollectorConfig {
+	conf := metrics.CollectorConfig{}
+
+	datadog, err := reflections.GetField(cfg, "MetricsDatadog")
+	if err == nil {
+		conf.Datadog = datadog.(bool)
+	}
+
+	datadogHost, err := reflections.GetField(cfg, "MetricsDatadogHost")
+	if err == nil {
+		conf.DatadogHost = datadogHost.(string)
+	}
+
+	datadogDistributions, err := reflections.GetField(cfg, "MetricsDatadogDistributions")
+	if err == nil {
+		conf.DatadogDistributions = datadogDistributions.(bool)
+	}
+
+	return conf
+}
+
+// jobMetricsTags returns the same tags that the agent uses for job metrics,
+// read from the environment of the job that's running the command
+func jobMetricsTags() metrics.Tags {
+	return metrics.Tags{
+		"pipeline": os.Getenv("BUILDKITE_PIPELINE_SLUG"),
+		"org":      os.Getenv("BUILDKITE_ORGANIZATION_SLUG"),
+		"branch":   os.Getenv("BUILDKITE_BRANCH"),
+		"source":   os.Getenv("BUILDKITE_SOURCE"),
+		"queue":    os.Getenv("BUILDKITE_AGENT_META_DATA_QUEUE"),
+	}
+}
+
+// jobUsageRecorder returns a recorder for the data transferred by the job
+// that's running the command, or nil if usage isn't being recorded
+func jobUsageRecorder(path string) *usage.Recorder {
+	if path == "" {
+		return nil
+	}
+	return usage.NewRecorder(path, usage.Record{
+		Organization: os.Getenv("BUILDKITE_ORGANIZATION_SLUG"),
+		Pipeline:     os.Getenv("BUILDKITE_PIPELINE_SLUG"),
+		Queue:        os.Getenv("BUILDKITE_AGENT_META_DATA_QUEUE"),
+		JobID:        os.Getenv("BUILDKITE_JOB_ID"),
+	})
+}
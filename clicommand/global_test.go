@@ -0,0 +1,39 @@
+package clicommand
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRequestTimeout(t *testing.T) {
+	l := logger.NewBuffer()
+
+	ctx, cancel := withRequestTimeout(context.Background(), l, MetaDataSetConfig{})
+	_, hasDeadline := ctx.Deadline()
+	assert.False(t, hasDeadline, "context has a deadline without --request-timeout")
+	cancel()
+
+	ctx, cancel = withRequestTimeout(context.Background(), l, MetaDataSetConfig{RequestTimeout: "1h"})
+	deadline, hasDeadline := ctx.Deadline()
+	assert.True(t, hasDeadline, "context has no deadline with --request-timeout")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Minute)
+
+	// Cancelling before the timeout isn't a timeout
+	cancel()
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.NoError(t, requestTimeoutErr())
+	assert.Equal(t, 1, exitStatus(1))
+
+	// Failing after it is
+	ctx, cancel = withRequestTimeout(context.Background(), l, MetaDataSetConfig{RequestTimeout: "1ms"})
+	defer cancel()
+	<-ctx.Done()
+	assert.ErrorIs(t, requestTimeoutErr(), ErrRequestTimeout)
+	assert.Equal(t, RequestTimeoutExitCode, exitStatus(1))
+	assert.Equal(t, 0, exitStatus(0))
+}
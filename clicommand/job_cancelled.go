@@ -0,0 +1,119 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/urfave/cli"
+)
+
+const jobCancelledHelpDescription = `Usage:
+
+   buildkite-agent job cancelled [options...]
+
+Description:
+   Checks whether the job has been cancelled, exiting with 0 if it has and 1
+   if it hasn't. Scripts can use this to tell a cancellation apart from other
+   interrupts, or to checkpoint their work before the agent stops the job
+   once the cancel grace period is over.
+
+   With --wait, waits until the job is cancelled, or until --timeout if one
+   is given, before exiting. Any other error exits with 2.
+
+   Note that this subcommand is only available from within the job executor with the job-api experiment enabled.
+
+Examples:
+   Checkpointing when the job is cancelled:
+
+   $ (buildkite-agent job cancelled --wait && ./save-checkpoint.sh) &
+   $ ./long-running-job.sh
+`
+
+// Exit statuses of buildkite-agent job cancelled
+const (
+	jobCancelledExitCode    = 0
+	jobNotCancelledExitCode = 1
+	jobCancelledErrExitCode = 2
+)
+
+var JobCancelledCommand = cli.Command{
+	Name:        "cancelled",
+	Usage:       "Checks whether the job has been cancelled",
+	Description: jobCancelledHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait until the job is cancelled",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Value: "0",
+			Usage: "With --wait, how long to wait for the job to be cancelled, e.g. 30m. The default of 0 waits until the job finishes",
+		},
+	},
+	Action: jobCancelledAction,
+}
+
+// jobCancelledPollInterval is how long each request waits for cancellation
+// when waiting, which keeps requests short enough to not be cut off
+const jobCancelledPollInterval = time.Minute
+
+func jobCancelledAction(c *cli.Context) error {
+	timeout, err := time.ParseDuration(c.String("timeout"))
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "Couldn't parse --timeout: %v\n", err)
+		exit(jobCancelledErrExitCode)
+	}
+
+	client, err := jobapi.NewDefaultClient()
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
+		exit(jobCancelledErrExitCode)
+	}
+
+	cancelled, err := jobCancelled(context.Background(), client.Cancelled, c.Bool("wait"), timeout)
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "Couldn't check whether the job was cancelled: %v\n", err)
+		exit(jobCancelledErrExitCode)
+	}
+
+	if cancelled {
+		fmt.Fprintln(c.App.Writer, "The job has been cancelled")
+		exit(jobCancelledExitCode)
+	}
+	exit(jobNotCancelledExitCode)
+	return nil
+}
+
+// jobCancelled checks once whether the job is cancelled, or if wait is set,
+// keeps checking until it is or timeout (if positive) passes.
+func jobCancelled(ctx context.Context, check func(context.Context, time.Duration) (bool, error), wait bool, timeout time.Duration) (bool, error) {
+	if !wait {
+		return check(ctx, 0)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		interval := jobCancelledPollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return false, nil
+			}
+			if remaining < interval {
+				interval = remaining
+			}
+		}
+
+		cancelled, err := check(ctx, interval)
+		if err != nil || cancelled {
+			return cancelled, err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// Without waiting, checks once
+	var waits []time.Duration
+	check := func(_ context.Context, wait time.Duration) (bool, error) {
+		waits = append(waits, wait)
+		return false, nil
+	}
+	cancelled, err := jobCancelled(ctx, check, false, 0)
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+	assert.Equal(t, []time.Duration{0}, waits)
+
+	// Waiting keeps checking until cancelled
+	calls := 0
+	check = func(_ context.Context, wait time.Duration) (bool, error) {
+		calls++
+		assert.Equal(t, jobCancelledPollInterval, wait)
+		return calls == 3, nil
+	}
+	cancelled, err = jobCancelled(ctx, check, true, 0)
+	assert.NoError(t, err)
+	assert.True(t, cancelled)
+	assert.Equal(t, 3, calls)
+
+	// Waiting gives up at the timeout
+	check = func(_ context.Context, wait time.Duration) (bool, error) {
+		assert.LessOrEqual(t, wait, 20*time.Millisecond)
+		time.Sleep(wait)
+		return false, nil
+	}
+	cancelled, err = jobCancelled(ctx, check, true, 20*time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+
+	// Errors are returned
+	check = func(context.Context, time.Duration) (bool, error) {
+		return false, errors.New("socket closed")
+	}
+	_, err = jobCancelled(ctx, check, true, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/urfave/cli"
+)
+
+const jobPhasesHelpDescription = `Usage:
+
+   buildkite-agent job phases [options...]
+
+Description:
+   Shows how long each phase of the job has taken so far, such as its
+   environment hooks, checkout, plugins and command, to see where a slow job
+   spends its time. A phase that's still running shows how long it's taken so
+   far.
+
+   To summarise it in an annotation once the job's finished, set
+   BUILDKITE_PHASE_TIMINGS_ANNOTATION=true in the job's environment.
+
+   Note that this subcommand is only available from within the job executor with
+   the ′job-api′ experiment enabled.
+
+Examples:
+   From a post-command hook:
+
+   $ buildkite-agent job phases
+   PHASE         DURATION
+   environment   1.2s
+   plugin        14.8s
+   checkout      2m3.4s
+   command       9m12.1s (running)
+
+   Getting them as JSON:
+
+   $ buildkite-agent job phases --format=json-pretty
+`
+
+var JobPhasesCommand = cli.Command{
+	Name:        "phases",
+	Usage:       "Shows how long each phase of the job has taken",
+	Description: jobPhasesHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Usage:  "Output format: plain, json, or json-pretty",
+			EnvVar: "BUILDKITE_AGENT_JOB_PHASES_FORMAT",
+			Value:  "plain",
+		},
+	},
+	Action: jobPhasesAction,
+}
+
+func jobPhasesAction(c *cli.Context) error {
+	client, err := jobapi.NewDefaultClient()
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
+		exit(1)
+	}
+
+	phases, err := client.Phases(context.Background())
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "Couldn't fetch the job's phase timings: %v\n", err)
+		exit(1)
+	}
+
+	switch c.String("format") {
+	case "plain":
+		w := tabwriter.NewWriter(c.App.Writer, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "PHASE\tDURATION")
+		for _, phase := range phases {
+			duration := time.Duration(phase.DurationSeconds * float64(time.Second)).Round(100 * time.Millisecond).String()
+			if phase.FinishedAt == nil {
+				duration += " (running)"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", phase.Name, duration)
+		}
+		w.Flush()
+
+	case "json", "json-pretty":
+		enc := json.NewEncoder(c.App.Writer)
+		if c.String("format") == "json-pretty" {
+			enc.SetIndent("", "  ")
+		}
+		if err := enc.Encode(phases); err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "Error marshalling JSON: %v\n", err)
+			exit(1)
+		}
+
+	default:
+		fmt.Fprintf(c.App.ErrWriter, "Invalid output format %q\n", c.String("format"))
+		exit(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const lfsPullHelpDescription = `Usage:
+
+   buildkite-agent lfs pull [pattern...] [options...]
+
+Description:
+   Downloads the Git LFS files matching the patterns into the checkout, for
+   jobs that were checked out with --git-lfs-skip-smudge (or
+   BUILDKITE_GIT_LFS_SKIP_SMUDGE) and so only have pointers to them. With no
+   patterns, every LFS file is downloaded.
+
+   Patterns are the same as for git lfs pull --include, such as
+   "assets/*.png", and several can be given.
+
+Examples:
+   Downloading only the fixtures the tests need:
+
+   $ buildkite-agent lfs pull "test/fixtures/**" "assets/icons/*.png"
+`
+
+type LFSPullConfig struct {
+	Exclude []string `cli:"exclude" normalize:"list"`
+	Path    string   `cli:"path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LFSPullCommand = cli.Command{
+	Name:        "pull",
+	Usage:       "Downloads Git LFS files matching patterns into the checkout",
+	Description: lfsPullHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:   "exclude",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated patterns of LFS files not to download, even if they match",
+			EnvVar: "BUILDKITE_LFS_PULL_EXCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "path",
+			Value:  "",
+			Usage:  "The checkout to download the files into. Defaults to the current directory",
+			EnvVar: "BUILDKITE_LFS_PULL_PATH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := LFSPullConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		cmd := exec.Command("git", lfsPullArgs(c.Args(), cfg.Exclude)...)
+		cmd.Dir = cfg.Path
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		l.Info("Running git %s", strings.Join(cmd.Args[1:], " "))
+		if err := cmd.Run(); err != nil {
+			l.Fatal("Failed to download the LFS files: %s", err)
+		}
+	},
+}
+
+// lfsPullArgs are the arguments to git for pulling the LFS files that match
+// the include patterns, and not the exclude patterns
+func lfsPullArgs(include, exclude []string) []string {
+	args := []string{"lfs", "pull"}
+	if len(include) > 0 {
+		args = append(args, fmt.Sprintf("--include=%s", strings.Join(include, ",")))
+	}
+	if len(exclude) > 0 {
+		args = append(args, fmt.Sprintf("--exclude=%s", strings.Join(exclude, ",")))
+	}
+	return args
+}
@@ -0,0 +1,31 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLFSPullArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{
+			want: []string{"lfs", "pull"},
+		},
+		{
+			include: []string{"assets/*.png", "test/fixtures/**"},
+			exclude: []string{"assets/huge.png"},
+			want:    []string{"lfs", "pull", "--include=assets/*.png,test/fixtures/**", "--exclude=assets/huge.png"},
+		},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, lfsPullArgs(test.include, test.exclude)); diff != "" {
+			t.Errorf("lfsPullArgs(%q, %q) diff (-want +got):\n%s", test.include, test.exclude, diff)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/gofrs/flock"
+	"github.com/urfave/cli"
+)
+
+var MetaDataLocalCacheFlag = cli.BoolFlag{
+	Name:   "local-cache",
+	Usage:  "Keep the meta-data this job sets in a file for the job, and read it from there, so a value that was just set can be read back before the API has caught up",
+	EnvVar: "BUILDKITE_META_DATA_LOCAL_CACHE",
+}
+
+// metaDataCache is the meta-data a job has set, kept in a file for the job so
+// later commands in it can read their writes. It's in the job's scratch
+// directory if it has one, so it's removed along with it.
+type metaDataCache struct {
+	path string
+}
+
+// newMetaDataCache returns the cache for a job, or nil if caching is off, so
+// it isn't consulted
+func newMetaDataCache(enabled bool, jobID string) *metaDataCache {
+	if !enabled || jobID == "" {
+		return nil
+	}
+	dir := os.Getenv("BUILDKITE_SCRATCH_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &metaDataCache{path: filepath.Join(dir, fmt.Sprintf("buildkite-meta-data-%s.json", jobID))}
+}
+
+// get returns the value of a key the job has set. A nil cache has nothing in
+// it.
+func (c *metaDataCache) get(key string) (string, bool, error) {
+	if c == nil {
+		return "", false, nil
+	}
+
+	lock := flock.New(c.path + ".lock")
+	if err := lock.RLock(); err != nil {
+		return "", false, err
+	}
+	defer lock.Unlock()
+
+	values, err := c.read()
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := values[key]
+	return value, ok, nil
+}
+
+// set records meta-data the job has set. Setting it on a nil cache does
+// nothing.
+func (c *metaDataCache) set(items ...*api.MetaData) error {
+	if c == nil {
+		return nil
+	}
+
+	lock := flock.New(c.path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	values, err := c.read()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		values[item.Key] = item.Value
+	}
+
+	contents, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	// Replaced in one go, so it's never read half written
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *metaDataCache) read() (map[string]string, error) {
+	values := map[string]string{}
+	contents, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &values); err != nil {
+		return nil, fmt.Errorf("parsing the meta-data cache %s: %w", c.path, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,45 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetaDataCache(t *testing.T) {
+	t.Setenv("BUILDKITE_SCRATCH_DIR", t.TempDir())
+
+	assert.Nil(t, newMetaDataCache(false, "job-1"))
+
+	// A nil cache has nothing in it, and ignores what's set
+	var disabled *metaDataCache
+	require.NoError(t, disabled.set(&api.MetaData{Key: "foo", Value: "bar"}))
+	_, ok, err := disabled.get("foo")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	cache := newMetaDataCache(true, "job-1")
+	_, ok, err = cache.get("foo")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, cache.set(&api.MetaData{Key: "foo", Value: "bar"}))
+	require.NoError(t, cache.set(&api.MetaData{Key: "foo", Value: "baz"}, &api.MetaData{Key: "empty", Value: ""}))
+
+	// Another command in the same job reads what was set
+	value, ok, err := newMetaDataCache(true, "job-1").get("foo")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "baz", value)
+
+	_, ok, err = newMetaDataCache(true, "job-1").get("empty")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// But one in another job doesn't
+	_, ok, err = newMetaDataCache(true, "job-2").get("foo")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
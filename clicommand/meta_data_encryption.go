@@ -0,0 +1,95 @@
+package clicommand
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/urfave/cli"
+)
+
+var MetaDataEncryptionKeyFileFlag = cli.StringFlag{
+	Name:   "meta-data-encryption-key-file",
+	Value:  "",
+	Usage:  "Path to a 256 bit AES key, as 32 bytes or their base64, or kms: and the base64 of a key encrypted with AWS KMS, that jobs' meta-data set encrypts values with, and meta-data get and keys decrypt them with",
+	EnvVar: agent.MetaDataEncryptionKeyFileEnv,
+}
+
+// Encrypted values are set with this prefix, followed by the base64 of the
+// nonce and the sealed value
+const metaDataEncryptedPrefix = metaDataFilePrefix + "encrypted:"
+
+// metaDataCipher encrypts meta-data values with a key the agent holds, so they
+// can't be read in Buildkite by anyone without it. Each value is sealed with
+// its key as additional data, so values can't be swapped between keys.
+type metaDataCipher struct {
+	aead cipher.AEAD
+}
+
+// newMetaDataCipher loads the key to encrypt values with, which the agent
+// gives the job in its environment. Without a key, it returns nil, which sets
+// values as they are.
+func newMetaDataCipher() (*metaDataCipher, error) {
+	return loadMetaDataCipher(os.Getenv(agent.MetaDataEncryptionKeyFileEnv))
+}
+
+func loadMetaDataCipher(keyPath string) (*metaDataCipher, error) {
+	if keyPath == "" {
+		return nil, nil
+	}
+	aead, err := agent.LoadEncryptionKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &metaDataCipher{aead: aead}, nil
+}
+
+// encrypt returns copies of the items with their values encrypted. A nil
+// cipher returns them as they are.
+func (c *metaDataCipher) encrypt(items ...*api.MetaData) ([]*api.MetaData, error) {
+	if c == nil {
+		return items, nil
+	}
+
+	encrypted := make([]*api.MetaData, len(items))
+	for i, item := range items {
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		sealed := c.aead.Seal(nonce, nonce, []byte(item.Value), []byte(item.Key))
+		encrypted[i] = &api.MetaData{
+			Key:   item.Key,
+			Value: metaDataEncryptedPrefix + base64.StdEncoding.EncodeToString(sealed),
+		}
+	}
+	return encrypted, nil
+}
+
+// decrypt returns the value of a key, decrypting it if it was encrypted.
+// Values that weren't are returned as they are, even by a nil cipher.
+func (c *metaDataCipher) decrypt(key, value string) (string, error) {
+	if !strings.HasPrefix(value, metaDataEncryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("the value is encrypted, but the agent has no --meta-data-encryption-key-file to decrypt it with")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, metaDataEncryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("the encrypted value is corrupt")
+	}
+	nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("decrypting the value, which may have been encrypted with another key: %w", err)
+	}
+	return string(plain), nil
+}
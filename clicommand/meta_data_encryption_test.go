@@ -0,0 +1,79 @@
+package clicommand
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+func testMetaDataCipher(t *testing.T) *metaDataCipher {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "meta-data.key")
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key)), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	c, err := loadMetaDataCipher(keyPath)
+	if err != nil {
+		t.Fatalf("loadMetaDataCipher() error = %v", err)
+	}
+	return c
+}
+
+func TestMetaDataCipher(t *testing.T) {
+	t.Parallel()
+
+	c := testMetaDataCipher(t)
+	items, err := c.encrypt(&api.MetaData{Key: "db-password", Value: "hunter2"})
+	if err != nil {
+		t.Fatalf("c.encrypt() error = %v", err)
+	}
+	if got := items[0].Value; !strings.HasPrefix(got, metaDataEncryptedPrefix) || strings.Contains(got, "hunter2") {
+		t.Errorf("c.encrypt() value = %q, want it encrypted", got)
+	}
+
+	if got, err := c.decrypt("db-password", items[0].Value); err != nil || got != "hunter2" {
+		t.Errorf("c.decrypt() = %q, %v, want %q", got, err, "hunter2")
+	}
+
+	// A value moved to another key doesn't decrypt
+	if _, err := c.decrypt("other", items[0].Value); err == nil {
+		t.Error("c.decrypt() of another key's value error = nil, want an error")
+	}
+
+	// Nor does one encrypted with another key
+	if _, err := testMetaDataCipher(t).decrypt("db-password", items[0].Value); err == nil {
+		t.Error("c.decrypt() with another key error = nil, want an error")
+	}
+}
+
+func TestMetaDataCipherNil(t *testing.T) {
+	t.Parallel()
+
+	var c *metaDataCipher
+	items, err := c.encrypt(&api.MetaData{Key: "foo", Value: "bar"})
+	if err != nil || items[0].Value != "bar" {
+		t.Errorf("nil c.encrypt() = %q, %v, want the value as it was", items[0].Value, err)
+	}
+	if got, err := c.decrypt("foo", "bar"); err != nil || got != "bar" {
+		t.Errorf("nil c.decrypt() = %q, %v, want %q", got, err, "bar")
+	}
+
+	encrypted, err := testMetaDataCipher(t).encrypt(&api.MetaData{Key: "foo", Value: "bar"})
+	if err != nil {
+		t.Fatalf("c.encrypt() error = %v", err)
+	}
+	if _, err := c.decrypt("foo", encrypted[0].Value); err == nil {
+		t.Error("nil c.decrypt() of an encrypted value error = nil, want an error")
+	}
+}
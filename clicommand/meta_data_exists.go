@@ -2,8 +2,8 @@ package clicommand
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
@@ -21,27 +21,39 @@ Description:
    The command exits with a status of 0 if the key has been set, or it will
    exit with a status of 100 if the key doesn't exist.
 
+   With --wait, it waits for the key to be set, such as by a job running at
+   the same time, and exits with a status of 100 if it isn't set before
+   --timeout.
+
 Example:
 
-   $ buildkite-agent meta-data exists "foo"`
+   $ buildkite-agent meta-data exists "foo"
+
+   $ buildkite-agent meta-data exists "release-version" --wait --timeout 5m`
 
 type MetaDataExistsConfig struct {
-	Key   string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Job   string `cli:"job"`
-	Build string `cli:"build"`
+	Key        string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Job        string `cli:"job"`
+	Build      string `cli:"build"`
+	LocalCache bool   `cli:"local-cache"`
+	Wait       bool   `cli:"wait"`
+	Timeout    string `cli:"timeout"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var MetaDataExistsCommand = cli.Command{
@@ -61,12 +73,26 @@ var MetaDataExistsCommand = cli.Command{
 			Usage:  "Which build should the meta-data be retrieved from. --build will take precedence over --job",
 			EnvVar: "BUILDKITE_METADATA_BUILD_ID",
 		},
+		MetaDataLocalCacheFlag,
+		cli.BoolFlag{
+			Name:   "wait",
+			Usage:  "If the key doesn't exist, wait for it to be set, checking every 5 seconds",
+			EnvVar: "BUILDKITE_META_DATA_EXISTS_WAIT",
+		},
+		cli.StringFlag{
+			Name:   "timeout",
+			Value:  "",
+			Usage:  "How long --wait waits for the key to be set, such as 5m. Defaults to no limit",
+			EnvVar: "BUILDKITE_META_DATA_EXISTS_TIMEOUT",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -74,6 +100,7 @@ var MetaDataExistsCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -85,7 +112,7 @@ var MetaDataExistsCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -99,13 +126,24 @@ var MetaDataExistsCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		var timeout time.Duration
+		if cfg.Timeout != "" {
+			if !cfg.Wait {
+				l.Fatal("--timeout can only be used with --wait")
+			}
+			timeout, err = time.ParseDuration(cfg.Timeout)
+			if err != nil || timeout <= 0 {
+				l.Fatal("Invalid --timeout %q, expected a duration such as 5m", cfg.Timeout)
+			}
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
-		// Find the meta data value
-		var exists *api.MetaDataExists
-		var resp *api.Response
-
 		scope := "job"
 		id := cfg.Job
 
@@ -114,28 +152,97 @@ var MetaDataExistsCommand = cli.Command{
 			id = cfg.Build
 		}
 
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
-			exists, resp, err = client.ExistsMetaData(ctx, scope, id, cfg.Key)
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
-				r.Break()
+		cache := newMetaDataCache(cfg.LocalCache, cfg.Job)
+
+		// check finds whether the key exists
+		check := func(ctx context.Context) (bool, error) {
+			// Keys this job set exist, even if the API hasn't caught up
+			if scope == "job" {
+				_, ok, err := cache.get(cfg.Key)
+				if err != nil {
+					l.Warn("Failed to read the meta-data cache: %s", err)
+				} else if ok {
+					return true, nil
+				}
 			}
+
+			var exists *api.MetaDataExists
+			err := retryMetaData(ctx, l, "Checking meta-data exists", func(r *roko.Retrier) (*api.Response, error) {
+				var resp *api.Response
+				var err error
+				exists, resp, err = client.ExistsMetaData(ctx, scope, id, cfg.Key)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+					r.Break()
+				}
+				return resp, err
+			})
 			if err != nil {
-				l.Warn("%s (%s)", err, r)
-				return err
+				return false, err
 			}
-			return nil
-		})
+			return exists.Exists, nil
+		}
 
+		exists, err := check(ctx)
 		if err != nil {
 			l.Fatal("Failed to see if meta-data exists: %s", err)
 		}
 
+		if !exists && cfg.Wait {
+			l.Info("Waiting for meta-data %q to be set", cfg.Key)
+			var waited time.Duration
+			exists, waited, err = waitForMetaData(ctx, check, timeout, metaDataWaitInterval)
+			switch {
+			case err != nil:
+				l.Fatal("Failed to see if meta-data exists: %s", err)
+			case exists:
+				l.Info("Meta-data %q was set after waiting %s", cfg.Key, waited.Round(time.Second))
+			default:
+				l.Error("Meta-data %q wasn't set after waiting %s", cfg.Key, waited.Round(time.Second))
+			}
+		}
+
 		// If the meta data didn't exist, exit with an error.
-		if !exists.Exists {
-			os.Exit(100)
+		if !exists {
+			exit(100)
 		}
 	},
 }
+
+// How often meta-data exists --wait checks whether the key has been set
+const metaDataWaitInterval = 5 * time.Second
+
+// waitForMetaData checks whether a meta-data key exists every interval until
+// it does, or until timeout if it's not zero. It returns whether it was found,
+// and how long it waited.
+func waitForMetaData(ctx context.Context, check func(context.Context) (bool, error), timeout, interval time.Duration) (bool, time.Duration, error) {
+	start := time.Now()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	errNotSet := errors.New("meta-data not set")
+	err := roko.NewRetrier(
+		roko.TryForever(),
+		roko.WithStrategy(roko.Constant(interval)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		exists, err := check(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			r.Break()
+			return err
+		case !exists:
+			return errNotSet
+		}
+		return nil
+	})
+	waited := time.Since(start)
+
+	if errors.Is(err, context.DeadlineExceeded) && timeout > 0 {
+		return false, waited, nil
+	}
+	return err == nil, waited, err
+}
@@ -0,0 +1,55 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForMetaData(t *testing.T) {
+	t.Parallel()
+
+	checks := 0
+	exists, _, err := waitForMetaData(context.Background(), func(context.Context) (bool, error) {
+		checks++
+		return checks == 3, nil
+	}, 0, time.Millisecond)
+	if err != nil || !exists {
+		t.Errorf("waitForMetaData() = %t, %v, want true, nil", exists, err)
+	}
+	if checks != 3 {
+		t.Errorf("key was checked %d times, want 3", checks)
+	}
+}
+
+func TestWaitForMetaDataTimeout(t *testing.T) {
+	t.Parallel()
+
+	exists, waited, err := waitForMetaData(context.Background(), func(context.Context) (bool, error) {
+		return false, nil
+	}, 50*time.Millisecond, time.Millisecond)
+	if err != nil || exists {
+		t.Errorf("waitForMetaData() = %t, %v, want false, nil", exists, err)
+	}
+	if waited < 50*time.Millisecond {
+		t.Errorf("waitForMetaData() waited %s, want at least the timeout", waited)
+	}
+}
+
+func TestWaitForMetaDataError(t *testing.T) {
+	t.Parallel()
+
+	checkErr := errors.New("unauthorized")
+	checks := 0
+	_, _, err := waitForMetaData(context.Background(), func(context.Context) (bool, error) {
+		checks++
+		return false, checkErr
+	}, 0, time.Millisecond)
+	if !errors.Is(err, checkErr) {
+		t.Errorf("waitForMetaData() error = %v, want %v", err, checkErr)
+	}
+	if checks != 1 {
+		t.Errorf("key was checked %d times, want once", checks)
+	}
+}
@@ -0,0 +1,127 @@
+package clicommand
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// Values set from files are stored as they are if they're text and small
+// enough, and otherwise with one of these prefixes, so meta-data get can turn
+// them back into the file's contents
+const (
+	metaDataFilePrefix   = "buildkite-meta-data:"
+	metaDataBase64Prefix = metaDataFilePrefix + "base64:"
+	metaDataChunksPrefix = metaDataFilePrefix + "chunks:"
+
+	// Values longer than this are split into chunks set under their own keys,
+	// which keeps them well under the API's limit on the size of a value
+	metaDataChunkSize = 64 * 1024
+)
+
+// metaDataManifest is set under the key of a value that was split into
+// chunks, and says how to put it back together
+type metaDataManifest struct {
+	Chunks int    `json:"chunks"`
+	Base64 bool   `json:"base64,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+// metaDataChunkKey is the key the nth chunk of a value is set under
+func metaDataChunkKey(key string, n int) string {
+	return fmt.Sprintf("%s.chunk.%d", key, n)
+}
+
+// encodeMetaDataFile returns the meta-data to set for the contents of a file.
+// Binary contents are base64 encoded, and large contents are split into
+// chunks, with a manifest under the key that's set last.
+func encodeMetaDataFile(key string, contents []byte) ([]*api.MetaData, error) {
+	value := string(contents)
+	binary := !utf8.Valid(contents) || strings.ContainsRune(value, 0) || strings.HasPrefix(value, metaDataFilePrefix)
+	if binary {
+		value = base64.StdEncoding.EncodeToString(contents)
+	}
+
+	if len(value) <= metaDataChunkSize {
+		if binary {
+			value = metaDataBase64Prefix + value
+		}
+		return []*api.MetaData{{Key: key, Value: value}}, nil
+	}
+
+	sum := sha256.Sum256(contents)
+	manifest := metaDataManifest{Base64: binary, SHA256: hex.EncodeToString(sum[:])}
+
+	var items []*api.MetaData
+	for len(value) > 0 {
+		n := metaDataChunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		// Text is split between runes, so each chunk is valid UTF-8
+		for !binary && n < len(value) && !utf8.RuneStart(value[n]) {
+			n--
+		}
+		items = append(items, &api.MetaData{Key: metaDataChunkKey(key, manifest.Chunks), Value: value[:n]})
+		value = value[n:]
+		manifest.Chunks++
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, &api.MetaData{Key: key, Value: metaDataChunksPrefix + string(encoded)}), nil
+}
+
+// decodeMetaDataValue returns the contents of the file a value was set from,
+// fetching its chunks with getChunk if it was split up. Values that weren't
+// set from files are returned as they are.
+func decodeMetaDataValue(key, value string, getChunk func(key string) (string, error)) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, metaDataBase64Prefix):
+		contents, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, metaDataBase64Prefix))
+		if err != nil {
+			return nil, fmt.Errorf("decoding %q: %w", key, err)
+		}
+		return contents, nil
+
+	case strings.HasPrefix(value, metaDataChunksPrefix):
+		var manifest metaDataManifest
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(value, metaDataChunksPrefix)), &manifest); err != nil {
+			return nil, fmt.Errorf("parsing the manifest of %q: %w", key, err)
+		}
+
+		var joined strings.Builder
+		for n := 0; n < manifest.Chunks; n++ {
+			chunk, err := getChunk(metaDataChunkKey(key, n))
+			if err != nil {
+				return nil, fmt.Errorf("getting chunk %d of %q: %w", n, key, err)
+			}
+			joined.WriteString(chunk)
+		}
+
+		contents := []byte(joined.String())
+		if manifest.Base64 {
+			var err error
+			if contents, err = base64.StdEncoding.DecodeString(joined.String()); err != nil {
+				return nil, fmt.Errorf("decoding %q: %w", key, err)
+			}
+		}
+
+		sum := sha256.Sum256(contents)
+		if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+			return nil, fmt.Errorf("the chunks of %q don't match its checksum, it may have been set again while it was being read", key)
+		}
+		return contents, nil
+
+	default:
+		return []byte(value), nil
+	}
+}
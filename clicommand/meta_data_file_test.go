@@ -0,0 +1,87 @@
+package clicommand
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMetaDataFileRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		contents   []byte
+		wantChunks int
+	}{
+		{name: "text", contents: []byte("hello world\n")},
+		{name: "binary", contents: []byte{0x1f, 0x8b, 0x00, 0xff}},
+		{name: "looks encoded", contents: []byte(metaDataBase64Prefix + "aGk=")},
+		{name: "large text", contents: []byte(strings.Repeat("llamas 🦙 ", 20000)), wantChunks: 4},
+		{name: "large binary", contents: bytes.Repeat([]byte{0xff, 0x00}, 100000), wantChunks: 5},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			items, err := encodeMetaDataFile("key", test.contents)
+			if err != nil {
+				t.Fatalf("encodeMetaDataFile() error = %v", err)
+			}
+			if got, want := len(items)-1, test.wantChunks; got != want {
+				t.Fatalf("encodeMetaDataFile() set %d chunks, want %d", got, want)
+			}
+
+			// The key itself is set last, once its chunks are
+			values := map[string]string{}
+			for _, item := range items {
+				if !utf8.ValidString(item.Value) {
+					t.Errorf("%s isn't valid UTF-8", item.Key)
+				}
+				values[item.Key] = item.Value
+			}
+			if last := items[len(items)-1]; last.Key != "key" {
+				t.Errorf("last key = %q, want %q", last.Key, "key")
+			}
+
+			got, err := decodeMetaDataValue("key", values["key"], func(key string) (string, error) {
+				value, ok := values[key]
+				if !ok {
+					return "", fmt.Errorf("no %s", key)
+				}
+				return value, nil
+			})
+			if err != nil {
+				t.Fatalf("decodeMetaDataValue() error = %v", err)
+			}
+			if !bytes.Equal(got, test.contents) {
+				t.Errorf("decodeMetaDataValue() = %d bytes, want the %d bytes that were encoded", len(got), len(test.contents))
+			}
+		})
+	}
+}
+
+func TestDecodeMetaDataValueChecksChunks(t *testing.T) {
+	t.Parallel()
+
+	items, err := encodeMetaDataFile("key", []byte(strings.Repeat("a", 2*metaDataChunkSize)))
+	if err != nil {
+		t.Fatalf("encodeMetaDataFile() error = %v", err)
+	}
+
+	// A chunk from a newer value
+	_, err = decodeMetaDataValue("key", items[len(items)-1].Value, func(key string) (string, error) {
+		return strings.Repeat("b", metaDataChunkSize), nil
+	})
+	if err == nil {
+		t.Errorf("decodeMetaDataValue() error = nil, want a checksum error")
+	}
+
+	if got, _ := decodeMetaDataValue("key", "plain", nil); string(got) != "plain" {
+		t.Errorf("decodeMetaDataValue(plain) = %q, want %q", got, "plain")
+	}
+}
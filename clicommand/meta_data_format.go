@@ -0,0 +1,66 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// metaDataFormatFuncs are the functions available to --format templates, on
+// top of the text/template builtins.
+var metaDataFormatFuncs = template.FuncMap{
+	// json parses a string as JSON, so fields of a JSON value can be used
+	// with e.g. {{(json .Value).version}}
+	"json": func(s string) (any, error) {
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("parsing value as JSON: %w", err)
+		}
+		return v, nil
+	},
+
+	// toJSON encodes a value as JSON, for printing nested objects and arrays
+	"toJSON": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	},
+}
+
+// metaDataFormatData is what --format templates are executed with
+type metaDataFormatData struct {
+	Key   string
+	Value string
+}
+
+// metaDataFormatter writes meta-data using an optional --format template.
+type metaDataFormatter struct {
+	tmpl *template.Template
+}
+
+func newMetaDataFormatter(format string) (*metaDataFormatter, error) {
+	if format == "" {
+		return &metaDataFormatter{}, nil
+	}
+
+	tmpl, err := template.New("format").Funcs(metaDataFormatFuncs).Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template: %w", err)
+	}
+
+	return &metaDataFormatter{tmpl: tmpl}, nil
+}
+
+// Write executes the template with data, or writes plain if there's no
+// template.
+func (f *metaDataFormatter) Write(w io.Writer, data metaDataFormatData, plain string) error {
+	if f.tmpl == nil {
+		_, err := io.WriteString(w, plain)
+		return err
+	}
+
+	return f.tmpl.Execute(w, data)
+}
@@ -0,0 +1,55 @@
+package clicommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaDataFormatter(t *testing.T) {
+	t.Parallel()
+
+	data := metaDataFormatData{
+		Key:   "release",
+		Value: `{"version":"1.2.3","targets":["linux","darwin"]}`,
+	}
+
+	for _, tc := range []struct {
+		name    string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{name: "no format", format: "", want: data.Value},
+		{name: "key and value", format: "{{.Key}}={{.Value}}", want: "release=" + data.Value},
+		{name: "json field", format: "{{(json .Value).version}}", want: "1.2.3"},
+		{name: "nested json", format: "{{toJSON (json .Value).targets}}", want: `["linux","darwin"]`},
+		{name: "missing json field", format: "{{(json .Value).nope}}", wantErr: true},
+		{name: "invalid json", format: "{{(json .Key).version}}", wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := newMetaDataFormatter(tc.format)
+			assert.NoError(t, err)
+
+			var out strings.Builder
+			err = f.Write(&out, data, data.Value)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, out.String())
+		})
+	}
+}
+
+func TestMetaDataFormatterInvalidTemplate(t *testing.T) {
+	t.Parallel()
+
+	_, err := newMetaDataFormatter("{{.Value")
+	assert.Error(t, err)
+}
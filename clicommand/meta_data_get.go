@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
@@ -22,26 +21,51 @@ Description:
 
 Example:
 
-   $ buildkite-agent meta-data get "foo"`
+   $ buildkite-agent meta-data get "foo"
+
+   If the key might not have been set, a default can be printed instead of
+   failing, or the command can exit with a status of 100, like meta-data exists:
+
+   $ buildkite-agent meta-data get "foo" --default "bar"
+   $ buildkite-agent meta-data get "foo" --check-exists || echo "foo isn't set"
+
+   If the value is JSON, the --format flag can extract fields from it:
+
+   $ buildkite-agent meta-data get "release" --format '{{(json .Value).version}}'
+
+   Values set with meta-data set --file are turned back into the file's
+   contents, which --output writes to a file rather than printing:
+
+   $ buildkite-agent meta-data get "coverage" --output ./coverage.tar.gz
+
+   Values that were encrypted when they were set are decrypted with the key
+   the agent was started with --meta-data-encryption-key-file.`
 
 type MetaDataGetConfig struct {
-	Key     string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Default string `cli:"default"`
-	Job     string `cli:"job"`
-	Build   string `cli:"build"`
+	Key         string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Default     string `cli:"default"`
+	CheckExists bool   `cli:"check-exists"`
+	Format      string `cli:"format"`
+	Output      string `cli:"output" normalize:"filepath"`
+	Job         string `cli:"job"`
+	Build       string `cli:"build"`
+	LocalCache  bool   `cli:"local-cache"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var MetaDataGetCommand = cli.Command{
@@ -54,6 +78,20 @@ var MetaDataGetCommand = cli.Command{
 			Value: "",
 			Usage: "If the meta-data value doesn't exist return this instead",
 		},
+		cli.BoolFlag{
+			Name:  "check-exists",
+			Usage: "If the meta-data value doesn't exist, exit with a status of 100 rather than failing. --default takes precedence",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "A Go template to format the output with, e.g. '{{(json .Value).version}}'. {{.Key}} and {{.Value}} are available, and the json function parses a JSON string",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Value: "",
+			Usage: "Write the value to a file, rather than printing it",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -66,12 +104,15 @@ var MetaDataGetCommand = cli.Command{
 			Usage:  "Which build should the meta-data be retrieved from. --build will take precedence over --job",
 			EnvVar: "BUILDKITE_METADATA_BUILD_ID",
 		},
+		MetaDataLocalCacheFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -79,6 +120,7 @@ var MetaDataGetCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -90,7 +132,7 @@ var MetaDataGetCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -104,6 +146,18 @@ var MetaDataGetCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		formatter, err := newMetaDataFormatter(cfg.Format)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		if cfg.Output != "" && cfg.Format != "" {
+			l.Fatal("Only one of --format or --output can be given")
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -119,22 +173,43 @@ var MetaDataGetCommand = cli.Command{
 			id = cfg.Build
 		}
 
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
-			metaData, resp, err = client.GetMetaData(ctx, scope, id, cfg.Key)
-			// Don't bother retrying if the response was one of these statuses
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
-				r.Break()
-				return err
+		// Values this job set are read back from its cache, which is only
+		// for this job's build
+		var cache *metaDataCache
+		if scope == "job" {
+			cache = newMetaDataCache(cfg.LocalCache, cfg.Job)
+		}
+
+		// Encrypted values are decrypted once they're read
+		encryption, err := newMetaDataCipher()
+		if err != nil {
+			l.Fatal("Failed to load the meta-data encryption key: %s", err)
+		}
+
+		fetch := func(key string) (metaData *api.MetaData, resp *api.Response, err error) {
+			if value, ok, err := cache.get(key); err != nil {
+				l.Warn("Failed to read the meta-data cache: %s", err)
+			} else if ok {
+				l.Debug("Read meta-data `%s` from the local cache", key)
+				value, err := encryption.decrypt(key, value)
+				return &api.MetaData{Key: key, Value: value}, nil, err
 			}
-			if err != nil {
-				l.Warn("%s (%s)", err, r)
-				return err
+
+			err = retryMetaData(ctx, l, "Fetching meta-data", func(r *roko.Retrier) (*api.Response, error) {
+				metaData, resp, err = client.GetMetaData(ctx, scope, id, key)
+				// Don't bother retrying if the response was one of these statuses
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+					r.Break()
+				}
+				return resp, err
+			})
+			if err == nil {
+				metaData.Value, err = encryption.decrypt(key, metaData.Value)
 			}
-			return nil
-		})
+			return metaData, resp, err
+		}
+
+		metaData, resp, err = fetch(cfg.Key)
 
 		// Deal with the error if we got one
 		if err != nil {
@@ -144,17 +219,56 @@ var MetaDataGetCommand = cli.Command{
 			//
 			// We also use `IsSet` instead of `cfg.Default != ""`
 			// to allow people to use a default of a blank string.
-			if resp.StatusCode == 404 && c.IsSet("default") {
+			//
+			// The request can fail without a response, such as when
+			// the API can't be reached.
+			missing := resp != nil && resp.StatusCode == 404
+			switch {
+			case missing && c.IsSet("default"):
 				l.Warn("No meta-data value exists with key `%s`, returning the supplied default \"%s\"", cfg.Key, cfg.Default)
 
-				fmt.Print(cfg.Default)
+				if cfg.Output != "" {
+					if err := os.WriteFile(cfg.Output, []byte(cfg.Default), 0o644); err != nil {
+						l.Fatal("Failed to write meta-data: %s", err)
+					}
+					return
+				}
+				data := metaDataFormatData{Key: cfg.Key, Value: cfg.Default}
+				if err := formatter.Write(os.Stdout, data, cfg.Default); err != nil {
+					l.Fatal("Failed to format meta-data: %s", err)
+				}
 				return
-			} else {
+			case missing && cfg.CheckExists:
+				l.Info("No meta-data value exists with key `%s`", cfg.Key)
+				exit(100)
+			default:
 				l.Fatal("Failed to get meta-data: %s", err)
 			}
 		}
 
+		// Put back together values that were set from files
+		contents, err := decodeMetaDataValue(cfg.Key, metaData.Value, func(key string) (string, error) {
+			chunk, _, err := fetch(key)
+			if err != nil {
+				return "", err
+			}
+			return chunk.Value, nil
+		})
+		if err != nil {
+			l.Fatal("Failed to get meta-data: %s", err)
+		}
+
+		if cfg.Output != "" {
+			if err := os.WriteFile(cfg.Output, contents, 0o644); err != nil {
+				l.Fatal("Failed to write meta-data: %s", err)
+			}
+			return
+		}
+
 		// Output the value to STDOUT
-		fmt.Print(metaData.Value)
+		data := metaDataFormatData{Key: cfg.Key, Value: string(contents)}
+		if err := formatter.Write(os.Stdout, data, string(contents)); err != nil {
+			l.Fatal("Failed to format meta-data: %s", err)
+		}
 	},
 }
@@ -2,9 +2,9 @@ package clicommand
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
@@ -21,26 +21,39 @@ Description:
    Lists all meta-data keys that have been previously set, delimited by a newline
    and terminated with a trailing newline.
 
+   Related keys can be grouped into namespaces by naming them with a common
+   prefix, such as deploy/region and deploy/version. --prefix lists only the
+   keys in a namespace, and --values fetches their values too, printing them
+   as a JSON object, or with --format.
+
 Example:
 
-   $ buildkite-agent meta-data keys`
+   $ buildkite-agent meta-data keys
+
+   $ buildkite-agent meta-data keys --prefix deploy/ --values`
 
 type MetaDataKeysConfig struct {
-	Job   string `cli:"job"`
-	Build string `cli:"build"`
+	Job    string `cli:"job"`
+	Build  string `cli:"build"`
+	Format string `cli:"format"`
+	Prefix string `cli:"prefix"`
+	Values bool   `cli:"values"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var MetaDataKeysCommand = cli.Command{
@@ -48,6 +61,20 @@ var MetaDataKeysCommand = cli.Command{
 	Usage:       "Lists all meta-data keys that have been previously set",
 	Description: metaDataKeysHelpDescription,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "A Go template to format each key with, e.g. '{{printf \"%q\" .Key}}'. The key is available as {{.Key}}, and with --values, its value as {{.Value}}",
+		},
+		cli.StringFlag{
+			Name:  "prefix",
+			Value: "",
+			Usage: "Only list the keys that start with this, such as deploy/",
+		},
+		cli.BoolFlag{
+			Name:  "values",
+			Usage: "Fetch the value of each key too, and print them as a JSON object of keys to values, unless --format is given",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -66,6 +93,8 @@ var MetaDataKeysCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -73,6 +102,7 @@ var MetaDataKeysCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -84,7 +114,7 @@ var MetaDataKeysCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -98,6 +128,15 @@ var MetaDataKeysCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		formatter, err := newMetaDataFormatter(cfg.Format)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -113,27 +152,82 @@ var MetaDataKeysCommand = cli.Command{
 			id = cfg.Build
 		}
 
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		err = retryMetaData(ctx, l, "Fetching meta-data keys", func(r *roko.Retrier) (*api.Response, error) {
 			keys, resp, err = client.MetaDataKeys(ctx, scope, id)
 			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
 				r.Break()
 			}
-			if err != nil {
-				l.Warn("%s (%s)", err, r)
-				return err
-			}
-			return nil
+			return resp, err
 		})
 
 		if err != nil {
 			l.Fatal("Failed to find meta-data keys: %s", err)
 		}
 
+		if cfg.Prefix != "" || cfg.Values {
+			keys = metaDataKeysWithPrefix(keys, cfg.Prefix)
+		}
+
+		if !cfg.Values {
+			for _, key := range keys {
+				if err := formatter.Write(os.Stdout, metaDataFormatData{Key: key}, key); err != nil {
+					l.Fatal("Failed to format meta-data key: %s", err)
+				}
+				fmt.Println()
+			}
+			return
+		}
+
+		// Encrypted values are decrypted once they're read
+		encryption, err := newMetaDataCipher()
+		if err != nil {
+			l.Fatal("Failed to load the meta-data encryption key: %s", err)
+		}
+
+		fetch := func(key string) (string, error) {
+			var metaData *api.MetaData
+			err := retryMetaData(ctx, l, "Fetching meta-data", func(r *roko.Retrier) (*api.Response, error) {
+				var resp *api.Response
+				var err error
+				metaData, resp, err = client.GetMetaData(ctx, scope, id, key)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+					r.Break()
+				}
+				return resp, err
+			})
+			if err != nil {
+				return "", err
+			}
+			return encryption.decrypt(key, metaData.Value)
+		}
+
+		values := make(map[string]string, len(keys))
+		for _, key := range keys {
+			value, err := fetch(key)
+			if err != nil {
+				l.Fatal("Failed to get meta-data `%s`: %s", key, err)
+			}
+			// Put back together values that were set from files
+			contents, err := decodeMetaDataValue(key, value, fetch)
+			if err != nil {
+				l.Fatal("Failed to get meta-data `%s`: %s", key, err)
+			}
+			values[key] = string(contents)
+		}
+
+		if cfg.Format == "" {
+			out, err := json.MarshalIndent(values, "", "  ")
+			if err != nil {
+				l.Fatal("Failed to encode meta-data: %s", err)
+			}
+			fmt.Println(string(out))
+			return
+		}
 		for _, key := range keys {
-			fmt.Printf("%s\n", key)
+			if err := formatter.Write(os.Stdout, metaDataFormatData{Key: key, Value: values[key]}, key); err != nil {
+				l.Fatal("Failed to format meta-data: %s", err)
+			}
+			fmt.Println()
 		}
 	},
 }
@@ -0,0 +1,35 @@
+package clicommand
+
+import (
+	"sort"
+	"strings"
+)
+
+// Meta-data keys can be grouped into namespaces by separating their parts
+// with slashes, such as deploy/region and deploy/version, so that related
+// values can be listed and fetched together with meta-data keys --prefix,
+// without knowing each of their names
+const metaDataKeySeparator = "/"
+
+// metaDataKeysWithPrefix returns the keys that start with prefix, sorted. The
+// chunks of values that were set from files are left out, as they're read
+// with the key they were split from.
+func metaDataKeysWithPrefix(keys []string, prefix string) []string {
+	all := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		all[key] = true
+	}
+
+	matched := []string{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.LastIndex(key, ".chunk."); i > 0 && all[key[:i]] {
+			continue
+		}
+		matched = append(matched, key)
+	}
+	sort.Strings(matched)
+	return matched
+}
@@ -0,0 +1,36 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetaDataKeysWithPrefix(t *testing.T) {
+	t.Parallel()
+
+	keys := []string{
+		"deploy/version",
+		"release",
+		"deploy/region",
+		"deploy/notes",
+		"deploy/notes.chunk.0",
+		"deploy/notes.chunk.1",
+		"deploy/unrelated.chunk.0",
+		"deployment",
+	}
+
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "deploy/", want: []string{"deploy/notes", "deploy/region", "deploy/unrelated.chunk.0", "deploy/version"}},
+		{prefix: "deploy", want: []string{"deploy/notes", "deploy/region", "deploy/unrelated.chunk.0", "deploy/version", "deployment"}},
+		{prefix: "missing/", want: []string{}},
+	} {
+		got := metaDataKeysWithPrefix(keys, test.prefix)
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("metaDataKeysWithPrefix(keys, %q) diff (-got +want):\n%s", test.prefix, diff)
+		}
+	}
+}
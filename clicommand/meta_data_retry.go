@@ -0,0 +1,100 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/roko"
+)
+
+// How many times the meta-data commands try a request before giving up
+const metaDataRetryAttempts = 10
+
+// The longest a Retry-After header can make a meta-data command wait before
+// trying again, so a bad header can't hang a job
+const metaDataMaxRetryAfter = 2 * time.Minute
+
+// metaDataRateLimitError is returned when the API rate limited every attempt
+// a meta-data command had left
+type metaDataRateLimitError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *metaDataRateLimitError) Error() string {
+	return fmt.Sprintf("the Buildkite API is rate limiting meta-data requests, and still was after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *metaDataRateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// retryMetaData makes a meta-data request until it succeeds, the request
+// breaks out of the retrier, or it runs out of attempts. Attempts back off
+// exponentially with jitter, so that jobs don't add to the load on the API
+// while it's struggling, and when the API says how long to wait before
+// trying again with Retry-After, it's waited for instead.
+func retryMetaData(ctx context.Context, l logger.Logger, what string, request func(*roko.Retrier) (*api.Response, error)) error {
+	rateLimited := false
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(metaDataRetryAttempts),
+		roko.WithStrategy(roko.ExponentialSubsecond(time.Second)),
+		roko.WithJitter(),
+	).DoWithContext(ctx, retrylog.Wrap(what, func(r *roko.Retrier) error {
+		resp, err := request(r)
+		if err == nil {
+			return nil
+		}
+
+		rateLimited = resp != nil && resp.StatusCode == http.StatusTooManyRequests
+		if resp != nil && resp.Response != nil {
+			if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				r.SetNextInterval(wait)
+			}
+		}
+
+		// Requests that broke out of the retrier failed for good, and are
+		// reported by the command
+		if !r.ShouldGiveUp() {
+			l.Warn("%s (%s)", err, r)
+		}
+		return err
+	}))
+	if err != nil && rateLimited {
+		return &metaDataRateLimitError{Attempts: metaDataRetryAttempts, Err: err}
+	}
+	return err
+}
+
+// parseRetryAfter returns how long a Retry-After header says to wait, which
+// is either a number of seconds or a date, capped at metaDataMaxRetryAfter
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		wait = at.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	switch {
+	case wait < 0:
+		wait = 0
+	case wait > metaDataMaxRetryAfter:
+		wait = metaDataMaxRetryAfter
+	}
+	return wait, true
+}
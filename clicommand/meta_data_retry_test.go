@@ -0,0 +1,81 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{header: "", ok: false},
+		{header: "soon", ok: false},
+		{header: "7", want: 7 * time.Second, ok: true},
+		{header: "-3", want: 0, ok: true},
+		{header: "86400", want: metaDataMaxRetryAfter, ok: true},
+		{header: "Thu, 01 Jun 2023 12:00:30 GMT", want: 30 * time.Second, ok: true},
+		{header: "Thu, 01 Jun 2023 11:00:00 GMT", want: 0, ok: true},
+	} {
+		got, ok := parseRetryAfter(tc.header, now)
+		assert.Equal(t, tc.ok, ok, "parseRetryAfter(%q) ok", tc.header)
+		assert.Equal(t, tc.want, got, "parseRetryAfter(%q)", tc.header)
+	}
+}
+
+// rateLimitedResponse is a 429 that says to try again straight away, so tests
+// don't wait
+func rateLimitedResponse() *api.Response {
+	return &api.Response{Response: &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"0"}},
+	}}
+}
+
+func TestRetryMetaDataRateLimited(t *testing.T) {
+	t.Parallel()
+
+	t.Run("recovers", func(t *testing.T) {
+		t.Parallel()
+
+		attempts := 0
+		err := retryMetaData(context.Background(), logger.Discard, "Setting meta-data", func(*roko.Retrier) (*api.Response, error) {
+			attempts++
+			if attempts < 3 {
+				return rateLimitedResponse(), errors.New("429 Too Many Requests")
+			}
+			return &api.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		t.Parallel()
+
+		attempts := 0
+		err := retryMetaData(context.Background(), logger.Discard, "Setting meta-data", func(*roko.Retrier) (*api.Response, error) {
+			attempts++
+			return rateLimitedResponse(), errors.New("429 Too Many Requests")
+		})
+		var rateLimitErr *metaDataRateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			t.Fatalf("retryMetaData() error = %v, want a *metaDataRateLimitError", err)
+		}
+		assert.Equal(t, metaDataRetryAttempts, attempts)
+	})
+}
@@ -2,13 +2,18 @@ package clicommand
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"time"
+	"sort"
+	"strings"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
@@ -16,6 +21,9 @@ import (
 const metaDataSetHelpDescription = `Usage:
 
    buildkite-agent meta-data set <key> [value] [options...]
+   buildkite-agent meta-data set <key> --file <path> [options...]
+   buildkite-agent meta-data set --from-file <path> [options...]
+   buildkite-agent meta-data set --from-json <path> [options...]
 
 Description:
 
@@ -24,29 +32,59 @@ Description:
    You can supply the value as an argument to the command, or pipe in a file or
    script output.
 
+   Many keys can be set at once by reading them from a dotenv-style file of
+   KEY=value lines with --from-file, or from a JSON object with --from-json.
+   Values in the JSON object that aren't strings are set as JSON. The keys are
+   set in a single request where the API supports it, and one at a time where
+   it doesn't.
+
+   With --file, the value is the contents of a file, which can be binary or
+   larger than a single value can be. Binary contents are base64 encoded, and
+   large contents are split into chunks set under keys such as "key.chunk.0",
+   with a manifest under the key itself. meta-data get turns them back into
+   the file's contents.
+
 Example:
 
    $ buildkite-agent meta-data set "foo" "bar"
    $ buildkite-agent meta-data set "foo" < ./tmp/meta-data-value
-   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"`
+   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"
+   $ buildkite-agent meta-data set --from-json ./tmp/release.json
+   $ buildkite-agent meta-data set "coverage" --file ./coverage.tar.gz
+
+   A value that was just set can take a moment to be readable. With
+   --local-cache, or BUILDKITE_META_DATA_LOCAL_CACHE=true in the job's
+   environment, the values a job sets are also kept in a file for the job, and
+   meta-data get and exists in the same job read them from there first.
+
+   Values that shouldn't be readable in Buildkite are encrypted when the agent
+   is started with --meta-data-encryption-key-file. Jobs on agents with the
+   same key can then read them with meta-data get.`
 
 type MetaDataSetConfig struct {
-	Key   string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Value string `cli:"arg:1" label:"meta-data value"`
-	Job   string `cli:"job" validate:"required"`
+	Key        string `cli:"arg:0" label:"meta-data key"`
+	Value      string `cli:"arg:1" label:"meta-data value"`
+	Job        string `cli:"job" validate:"required"`
+	FromFile   string `cli:"from-file" normalize:"filepath"`
+	FromJSON   string `cli:"from-json" normalize:"filepath"`
+	File       string `cli:"file" normalize:"filepath"`
+	LocalCache bool   `cli:"local-cache"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 var MetaDataSetCommand = cli.Command{
@@ -60,12 +98,30 @@ var MetaDataSetCommand = cli.Command{
 			Usage:  "Which job's build should the meta-data be set on",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:  "from-file",
+			Value: "",
+			Usage: "Set every key in a dotenv-style file of KEY=value lines, instead of a single key",
+		},
+		cli.StringFlag{
+			Name:  "from-json",
+			Value: "",
+			Usage: "Set every key in a file containing a JSON object, instead of a single key",
+		},
+		cli.StringFlag{
+			Name:  "file",
+			Value: "",
+			Usage: "Set the key to the contents of a file, which can be binary or larger than a single value",
+		},
+		MetaDataLocalCacheFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -73,6 +129,7 @@ var MetaDataSetCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -84,7 +141,7 @@ var MetaDataSetCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Printf("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -98,6 +155,98 @@ var MetaDataSetCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+		// Values are encrypted before they're set, if there's a key
+		encryption, err := newMetaDataCipher()
+		if err != nil {
+			l.Fatal("Failed to load the meta-data encryption key: %s", err)
+		}
+
+		// Once they're set, keep the values for this job to read back
+		cache := newMetaDataCache(cfg.LocalCache, cfg.Job)
+		cacheSet := func(items ...*api.MetaData) {
+			if err := cache.set(items...); err != nil {
+				l.Warn("Failed to cache meta-data: %s", err)
+			}
+		}
+
+		// If the API couldn't be reached, save the meta-data for the job
+		// runner to try again before the job finishes, otherwise give up
+		setFailed := func(err error, items ...*api.MetaData) {
+			deferred, deferErr := agent.DeferWrite(os.Getenv(agent.PendingWritesDirEnv), err, agent.PendingWrite{JobID: cfg.Job, MetaData: items})
+			if deferErr != nil {
+				l.Warn("Failed to save meta-data to try again later: %s", deferErr)
+			}
+			if !deferred {
+				l.Fatal("Failed to set meta-data: %s", err)
+			}
+			l.Warn("Failed to set meta-data, it will be tried again before the job finishes: %s", err)
+		}
+
+		if cfg.FromFile != "" || cfg.FromJSON != "" {
+			if cfg.Key != "" || (cfg.FromFile != "" && cfg.FromJSON != "") {
+				l.Fatal("Only one of a meta-data key, --from-file or --from-json can be given")
+			}
+
+			items, err := readMetaDataBatch(cfg.FromFile, cfg.FromJSON)
+			if err != nil {
+				l.Fatal("Failed to read meta-data: %s", err)
+			}
+			if len(items) == 0 {
+				l.Warn("No meta-data keys to set")
+				return
+			}
+			if items, err = encryption.encrypt(items...); err != nil {
+				l.Fatal("Failed to encrypt meta-data: %s", err)
+			}
+
+			if err := setMetaDataBatch(ctx, l, client, cfg.Job, items); err != nil {
+				setFailed(err, items...)
+			}
+			cacheSet(items...)
+			return
+		}
+
+		if cfg.Key == "" {
+			l.Fatal("A meta-data key, --from-file or --from-json is required")
+		}
+
+		if cfg.File != "" {
+			if len(c.Args()) > 1 {
+				l.Fatal("Only one of a meta-data value or --file can be given")
+			}
+
+			contents, err := os.ReadFile(cfg.File)
+			if err != nil {
+				l.Fatal("Failed to read meta-data: %s", err)
+			}
+			items, err := encodeMetaDataFile(cfg.Key, contents)
+			if err != nil {
+				l.Fatal("Failed to encode meta-data: %s", err)
+			}
+			if items, err = encryption.encrypt(items...); err != nil {
+				l.Fatal("Failed to encrypt meta-data: %s", err)
+			}
+
+			if len(items) == 1 {
+				err = setMetaData(ctx, l, client, cfg.Job, items[0])
+			} else {
+				l.Info("Setting %s in %d chunks", cfg.Key, len(items)-1)
+				err = setMetaDataBatch(ctx, l, client, cfg.Job, items)
+			}
+			if err != nil {
+				setFailed(err, items...)
+			}
+			cacheSet(items...)
+			return
+		}
+
 		// Read the value from STDIN if argument omitted entirely
 		if len(c.Args()) < 2 {
 			l.Info("Reading meta-data value from STDIN")
@@ -109,33 +258,115 @@ var MetaDataSetCommand = cli.Command{
 			cfg.Value = string(input)
 		}
 
-		// Create the API client
-		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
-
 		// Create the meta data to set
-		metaData := &api.MetaData{
+		items, err := encryption.encrypt(&api.MetaData{
 			Key:   cfg.Key,
 			Value: cfg.Value,
+		})
+		if err != nil {
+			l.Fatal("Failed to encrypt meta-data: %s", err)
 		}
+		metaData := items[0]
 
 		// Set the meta data
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
-			resp, err := client.SetMetaData(ctx, cfg.Job, metaData)
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+		if err := setMetaData(ctx, l, client, cfg.Job, metaData); err != nil {
+			setFailed(err, metaData)
+		}
+		cacheSet(metaData)
+	},
+}
+
+// metaDataSetter is the part of the API client that sets meta-data
+type metaDataSetter interface {
+	SetMetaData(ctx context.Context, jobId string, metaData *api.MetaData) (*api.Response, error)
+	SetMetaDataBatch(ctx context.Context, jobId string, batch *api.MetaDataBatch) (*api.Response, error)
+}
+
+func setMetaData(ctx context.Context, l logger.Logger, client metaDataSetter, jobID string, metaData *api.MetaData) error {
+	return retryMetaData(ctx, l, "Setting meta-data", func(r *roko.Retrier) (*api.Response, error) {
+		resp, err := client.SetMetaData(ctx, jobID, metaData)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			r.Break()
+		}
+		return resp, err
+	})
+}
+
+// setMetaDataBatch sets many meta-data keys in a single request, falling back
+// to setting them one at a time if the API can't set them in a batch
+func setMetaDataBatch(ctx context.Context, l logger.Logger, client metaDataSetter, jobID string, items []*api.MetaData) error {
+	unsupported := false
+	err := retryMetaData(ctx, l, "Setting meta-data", func(r *roko.Retrier) (*api.Response, error) {
+		resp, err := client.SetMetaDataBatch(ctx, jobID, &api.MetaDataBatch{Items: items})
+		if resp != nil {
+			switch resp.StatusCode {
+			case 404, 405, 501:
+				unsupported = true
+				r.Break()
+			case 401:
 				r.Break()
 			}
-			if err != nil {
-				l.Warn("%s (%s)", err, r)
-				return err
-			}
-			return nil
-		})
+		}
+		return resp, err
+	})
+	if !unsupported {
+		if err == nil {
+			l.Info("Set %d meta-data keys", len(items))
+		}
+		return err
+	}
 
+	l.Info("Setting meta-data in a batch isn't supported, setting %d keys one at a time", len(items))
+	for _, metaData := range items {
+		if err := setMetaData(ctx, l, client, jobID, metaData); err != nil {
+			return fmt.Errorf("setting %q: %w", metaData.Key, err)
+		}
+	}
+	return nil
+}
+
+// readMetaDataBatch reads the meta-data to set from a dotenv-style file or a
+// JSON object, sorted by key
+func readMetaDataBatch(fromFile, fromJSON string) ([]*api.MetaData, error) {
+	values := map[string]string{}
+
+	switch {
+	case fromFile != "":
+		f := cliconfig.File{Path: fromFile}
+		if err := f.Load(); err != nil {
+			return nil, err
+		}
+		values = f.Config
+
+	case fromJSON != "":
+		contents, err := os.ReadFile(fromJSON)
 		if err != nil {
-			l.Fatal("Failed to set meta-data: %s", err)
+			return nil, err
 		}
-	},
+
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(contents, &object); err != nil {
+			return nil, fmt.Errorf("parsing %s as a JSON object: %w", fromJSON, err)
+		}
+
+		for key, raw := range object {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				// Not a string, so it's set as it's written
+				value = string(raw)
+			}
+			values[key] = value
+		}
+	}
+
+	items := make([]*api.MetaData, 0, len(values))
+	for key, value := range values {
+		if strings.TrimSpace(key) == "" {
+			return nil, errors.New("meta-data keys can't be blank")
+		}
+		items = append(items, &api.MetaData{Key: key, Value: value})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+
+	return items, nil
 }
@@ -0,0 +1,95 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetaDataSetter records the requests made to set meta-data
+type fakeMetaDataSetter struct {
+	batchUnsupported bool
+	batches          int
+	sets             []string
+}
+
+func (f *fakeMetaDataSetter) SetMetaData(_ context.Context, _ string, md *api.MetaData) (*api.Response, error) {
+	f.sets = append(f.sets, md.Key)
+	return &api.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+}
+
+func (f *fakeMetaDataSetter) SetMetaDataBatch(_ context.Context, _ string, batch *api.MetaDataBatch) (*api.Response, error) {
+	f.batches++
+	if f.batchUnsupported {
+		return &api.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}, errors.New("not found")
+	}
+	for _, md := range batch.Items {
+		f.sets = append(f.sets, md.Key)
+	}
+	return &api.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+}
+
+func TestSetMetaDataBatch(t *testing.T) {
+	t.Parallel()
+
+	items := []*api.MetaData{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}
+
+	for _, tc := range []struct {
+		name        string
+		unsupported bool
+	}{
+		{name: "batched"},
+		{name: "one at a time", unsupported: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := &fakeMetaDataSetter{batchUnsupported: tc.unsupported}
+			err := setMetaDataBatch(context.Background(), logger.Discard, client, "my-job", items)
+			require.NoError(t, err)
+
+			assert.Equal(t, 1, client.batches, "batches")
+			assert.Equal(t, []string{"a", "b"}, client.sets)
+		})
+	}
+}
+
+func TestReadMetaDataBatch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	envPath := filepath.Join(dir, "meta-data.env")
+	require.NoError(t, os.WriteFile(envPath, []byte("# release\nversion=1.2.3\nexport channel=\"beta\"\n"), 0o600))
+
+	items, err := readMetaDataBatch(envPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, []*api.MetaData{
+		{Key: "channel", Value: "beta"},
+		{Key: "version", Value: "1.2.3"},
+	}, items)
+
+	jsonPath := filepath.Join(dir, "meta-data.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"version":"1.2.3","targets":["linux","darwin"],"build":42}`), 0o600))
+
+	items, err = readMetaDataBatch("", jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, []*api.MetaData{
+		{Key: "build", Value: "42"},
+		{Key: "targets", Value: `["linux","darwin"]`},
+		{Key: "version", Value: "1.2.3"},
+	}, items)
+
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`["not", "an", "object"]`), 0o600))
+	_, err = readMetaDataBatch("", jsonPath)
+	assert.Error(t, err)
+}
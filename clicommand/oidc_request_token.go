@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/retrylog"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
@@ -21,17 +21,20 @@ type OIDCTokenConfig struct {
 	Claims []string `cli:"claim"    normalize:"list"`
 
 	// Global flags
-	Debug       bool     `cli:"debug"`
-	LogLevel    string   `cli:"log-level"`
-	NoColor     bool     `cli:"no-color"`
-	Experiments []string `cli:"experiment" normalize:"list"`
-	Profile     string   `cli:"profile"`
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
 
 	// API config
 	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint"           validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
 }
 
 const (
@@ -85,6 +88,8 @@ var OIDCRequestTokenCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -92,6 +97,7 @@ var OIDCRequestTokenCommand = cli.Command{
 		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
+		RetryVerboseFlag,
 	},
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
@@ -103,7 +109,7 @@ var OIDCRequestTokenCommand = cli.Command{
 		warnings, err := loader.Load()
 		if err != nil {
 			fmt.Fprintf(c.App.ErrWriter, "%s\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		l := CreateLogger(&cfg)
@@ -117,6 +123,10 @@ var OIDCRequestTokenCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
 		// Note: if --lifetime is omitted, cfg.Lifetime = 0
 		if cfg.Lifetime < 0 {
 			l.Fatal("Lifetime %d must be a non-negative integer.", cfg.Lifetime)
@@ -131,7 +141,7 @@ var OIDCRequestTokenCommand = cli.Command{
 		if err := roko.NewRetrier(
 			roko.WithMaxAttempts(maxAttempts),
 			roko.WithStrategy(roko.Exponential(backoffSeconds*time.Second, 0)),
-		).DoWithContext(ctx, func(r *roko.Retrier) error {
+		).DoWithContext(ctx, retrylog.Wrap("Requesting OIDC token", func(r *roko.Retrier) error {
 			req := &api.OIDCTokenRequest{
 				Job:      cfg.Job,
 				Audience: cfg.Audience,
@@ -155,7 +165,7 @@ var OIDCRequestTokenCommand = cli.Command{
 				return err
 			}
 			return nil
-		}); err != nil {
+		})); err != nil {
 			if len(cfg.Audience) > 0 {
 				l.Error("Could not obtain OIDC token for audience %s", cfg.Audience)
 			} else {
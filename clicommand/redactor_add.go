@@ -0,0 +1,95 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/urfave/cli"
+)
+
+const redactorAddHelpDescription = `Usage:
+
+   buildkite-agent redactor add [value...]
+
+Description:
+   Adds values to redact from the job log, such as secrets fetched by a
+   script while the job is running. Values are redacted from the output of
+   the rest of the job, including the rest of the hook or command that adds
+   them.
+
+   Values given as arguments can be seen by other processes on the host, so
+   prefer passing secrets on standard input. With no arguments, or an
+   argument of "-", the whole of standard input is read as a single value,
+   less any trailing newline.
+
+   Values must be at least 6 bytes long, as redacting shorter values would
+   hide too much of the log.
+
+   Note that this subcommand is only available from within the job executor with the job-api experiment enabled.
+
+Examples:
+   Redacting a secret fetched from a secret store:
+
+   $ vault kv get -field=token secret/deploy | tee /tmp/deploy-token | buildkite-agent redactor add
+`
+
+var RedactorAddCommand = cli.Command{
+	Name:        "add",
+	Usage:       "Redacts values from the rest of the job log",
+	Description: redactorAddHelpDescription,
+	Action:      redactorAddAction,
+}
+
+func redactorAddAction(c *cli.Context) error {
+	values, err := redactorAddValues(c.Args(), os.Stdin)
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "Couldn't read the values to redact: %v\n", err)
+		exit(1)
+	}
+
+	client, err := jobapi.NewDefaultClient()
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, envClientErrMessage, err)
+		exit(1)
+	}
+
+	added, err := client.RedactionCreate(context.Background(), values)
+	if err != nil {
+		fmt.Fprintf(c.App.ErrWriter, "Couldn't add values to the redactor: %v\n", err)
+		exit(1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "Added %d value(s) to redact\n", added)
+	return nil
+}
+
+// redactorAddValues returns the values given as arguments, reading stdin for
+// "-" or when there are no arguments.
+func redactorAddValues(args []string, stdin io.Reader) ([]string, error) {
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg != "-" {
+			values = append(values, arg)
+			continue
+		}
+
+		input, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading standard input: %w", err)
+		}
+		value := strings.TrimRight(string(input), "\r\n")
+		if value == "" {
+			return nil, fmt.Errorf("standard input was empty")
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,27 @@
+package clicommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorAddValues(t *testing.T) {
+	t.Parallel()
+
+	values, err := redactorAddValues([]string{"hunter2hunter2"}, strings.NewReader("unused"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hunter2hunter2"}, values)
+
+	values, err = redactorAddValues(nil, strings.NewReader("-----BEGIN KEY-----\nabc\n-----END KEY-----\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-----BEGIN KEY-----\nabc\n-----END KEY-----"}, values)
+
+	values, err = redactorAddValues([]string{"first-secret", "-"}, strings.NewReader("second-secret\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first-secret", "second-secret"}, values)
+
+	_, err = redactorAddValues(nil, strings.NewReader("\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/retrylog"
+	"github.com/buildkite/roko"
+	"github.com/urfave/cli"
+)
+
+const retryRequestHelpDescription = `Usage:
+
+   buildkite-agent retry request --reason <reason> [options...]
+
+Description:
+
+   Records that the job should be retried, and why, as a retry hint in the
+   build's meta-data under "buildkite:retry-hint:<job id>". Use it from
+   scripts that detect failures a retry will fix, such as known flaky
+   infrastructure errors, so that the reason for the retry is kept with the
+   build.
+
+   The command fails when the job has already been retried --limit times,
+   so scripts can tell whether retrying is worthwhile. Pair it with an
+   automatic retry rule for an exit status to have the retry happen, e.g.
+   retry: { automatic: [{ exit_status: 75, limit: 2 }] }
+
+Example:
+
+   $ buildkite-agent retry request --reason "infra flake" --limit 2 && exit 75`
+
+// retryHintKeyPrefix is prefixed to the job ID to make the meta-data key a
+// retry hint is stored under
+const retryHintKeyPrefix = "buildkite:retry-hint:"
+
+type RetryRequestConfig struct {
+	Reason     string `cli:"reason" validate:"required"`
+	Limit      int    `cli:"limit"`
+	RetryCount int    `cli:"retry-count"`
+	Job        string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	DebugHTTPDump    string `cli:"debug-http-dump" normalize:"filepath"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+	RequestTimeout   string `cli:"request-timeout"`
+}
+
+// retryHint is what's recorded in the build's meta-data
+type retryHint struct {
+	Job          string    `json:"job"`
+	Reason       string    `json:"reason"`
+	Limit        int       `json:"limit,omitempty"`
+	RetryCount   int       `json:"retry_count"`
+	LimitReached bool      `json:"limit_reached"`
+	RequestedAt  time.Time `json:"requested_at"`
+}
+
+func newRetryHint(cfg RetryRequestConfig, now time.Time) retryHint {
+	return retryHint{
+		Job:          cfg.Job,
+		Reason:       cfg.Reason,
+		Limit:        cfg.Limit,
+		RetryCount:   cfg.RetryCount,
+		LimitReached: cfg.Limit > 0 && cfg.RetryCount >= cfg.Limit,
+		RequestedAt:  now.UTC(),
+	}
+}
+
+var RetryRequestCommand = cli.Command{
+	Name:        "request",
+	Usage:       "Record that the job should be retried, and why",
+	Description: retryRequestHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "reason",
+			Value: "",
+			Usage: "Why the job should be retried, e.g. \"infra flake\"",
+		},
+		cli.IntFlag{
+			Name:  "limit",
+			Value: 0,
+			Usage: "How many times the job can be retried for this reason. The default of 0 means no limit",
+		},
+		cli.IntFlag{
+			Name:   "retry-count",
+			Value:  0,
+			Usage:  "How many times the job has already been retried",
+			EnvVar: "BUILDKITE_RETRY_COUNT",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should be retried",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DebugHTTPDumpFlag,
+		RequestTimeoutFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := RetryRequestConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Give up if the command takes longer than --request-timeout
+		ctx, cancel := withRequestTimeout(ctx, l, cfg)
+		defer cancel()
+
+		hint := newRetryHint(cfg, time.Now())
+		value, err := json.Marshal(hint)
+		if err != nil {
+			l.Fatal("Failed to encode retry hint: %s", err)
+		}
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+		metaData := &api.MetaData{
+			Key:   retryHintKeyPrefix + cfg.Job,
+			Value: string(value),
+		}
+
+		err = roko.NewRetrier(
+			roko.WithMaxAttempts(10),
+			roko.WithStrategy(roko.Constant(5*time.Second)),
+		).DoWithContext(ctx, retrylog.Wrap("Recording retry hint", func(r *roko.Retrier) error {
+			resp, err := client.SetMetaData(ctx, cfg.Job, metaData)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				r.Break()
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, r)
+				return err
+			}
+			return nil
+		}))
+		if err != nil {
+			l.Fatal("Failed to record retry hint: %s", err)
+		}
+
+		if hint.LimitReached {
+			l.Error("The job has already been retried %d times, which is the limit of %d for %q", cfg.RetryCount, cfg.Limit, cfg.Reason)
+			exit(1)
+		}
+
+		l.Info("Recorded retry hint for %q", cfg.Reason)
+	},
+}
@@ -0,0 +1,38 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRetryHint(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 9, 2, 10, 0, 0, 0, time.UTC)
+	cfg := RetryRequestConfig{Job: "job-1", Reason: "infra flake", Limit: 2, RetryCount: 1}
+
+	hint := newRetryHint(cfg, now)
+	assert.False(t, hint.LimitReached)
+
+	b, err := json.Marshal(hint)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"job": "job-1",
+		"reason": "infra flake",
+		"limit": 2,
+		"retry_count": 1,
+		"limit_reached": false,
+		"requested_at": "2023-09-02T10:00:00Z"
+	}`, string(b))
+
+	cfg.RetryCount = 2
+	assert.True(t, newRetryHint(cfg, now).LimitReached)
+
+	// No limit
+	cfg.Limit = 0
+	cfg.RetryCount = 10
+	assert.False(t, newRetryHint(cfg, now).LimitReached)
+}
@@ -0,0 +1,259 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+const selftestHelpDescription = `Usage:
+
+   buildkite-agent selftest [options...]
+
+Description:
+
+   Checks that this build of the agent works on this host, without needing a
+   Buildkite organization or network access. It starts a fake Agent API and
+   object store in the same process, then sets and reads meta-data, and
+   uploads and downloads artifacts against them using the same code as the
+   meta-data and artifact commands.
+
+   The result of each check is printed, and the command exits with a status
+   of 1 if any of them failed. Run it with --debug to see the requests made.
+
+Example:
+
+   $ buildkite-agent selftest`
+
+type SelftestConfig struct {
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+}
+
+var SelftestCommand = cli.Command{
+	Name:        "selftest",
+	Usage:       "Check the agent works on this host against a fake Agent API",
+	Description: selftestHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := SelftestConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if !runSelftest(ctx, l, os.Stdout) {
+			exit(1)
+		}
+	},
+}
+
+// selftestCheck is one of the things buildkite-agent selftest checks works
+type selftestCheck struct {
+	name string
+	run  func(context.Context, *selftestEnv) error
+}
+
+// selftestEnv is what the checks run against
+type selftestEnv struct {
+	logger logger.Logger
+	client *api.Client
+	dir    string
+}
+
+var selftestChecks = []selftestCheck{
+	{name: "meta-data set", run: selftestMetaDataSet},
+	{name: "meta-data get", run: selftestMetaDataGet},
+	{name: "artifact upload", run: selftestArtifactUpload},
+	{name: "artifact download", run: selftestArtifactDownload},
+}
+
+// selftestArtifacts are the files uploaded and downloaded again
+var selftestArtifacts = map[string]string{
+	"llamas.txt":        "llamas\n",
+	"alpacas/herd.json": `{"alpacas": 3}`,
+	"empty.txt":         "",
+}
+
+// runSelftest runs the checks in order against a fake Agent API, prints how
+// each went to w, and returns whether they all passed. Once a check fails,
+// the ones after it are skipped, as they rely on it.
+func runSelftest(ctx context.Context, l logger.Logger, w io.Writer) bool {
+	server := newSelftestServer()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "buildkite-agent-selftest")
+	if err != nil {
+		fmt.Fprintf(w, "Couldn't create a directory for the selftest: %s\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	env := &selftestEnv{
+		logger: l,
+		client: api.NewClient(l, api.Config{Endpoint: server.URL, Token: selftestToken}),
+		dir:    dir,
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	passed := true
+	for _, check := range selftestChecks {
+		if !passed {
+			fmt.Fprintf(tw, "SKIP\t%s\t\n", check.name)
+			continue
+		}
+
+		start := time.Now()
+		if err := check.run(ctx, env); err != nil {
+			passed = false
+			fmt.Fprintf(tw, "FAIL\t%s\t%s\n", check.name, err)
+			continue
+		}
+		fmt.Fprintf(tw, "PASS\t%s\t%s\n", check.name, time.Since(start).Round(time.Millisecond))
+	}
+
+	return passed
+}
+
+func selftestMetaDataSet(ctx context.Context, env *selftestEnv) error {
+	if err := setMetaData(ctx, env.logger, env.client, selftestJobID, &api.MetaData{Key: "llamas", Value: "rock"}); err != nil {
+		return err
+	}
+
+	items := []*api.MetaData{{Key: "alpacas", Value: "3"}, {Key: "release", Value: "1.2.3"}}
+	return setMetaDataBatch(ctx, env.logger, env.client, selftestJobID, items)
+}
+
+func selftestMetaDataGet(ctx context.Context, env *selftestEnv) error {
+	md, _, err := env.client.GetMetaData(ctx, "build", selftestBuildID, "llamas")
+	if err != nil {
+		return err
+	}
+	if md.Value != "rock" {
+		return fmt.Errorf("got %q for llamas, want %q", md.Value, "rock")
+	}
+
+	exists, _, err := env.client.ExistsMetaData(ctx, "job", selftestJobID, "missing")
+	if err != nil {
+		return err
+	}
+	if exists.Exists {
+		return fmt.Errorf("a key that was never set exists")
+	}
+
+	keys, _, err := env.client.MetaDataKeys(ctx, "build", selftestBuildID)
+	if err != nil {
+		return err
+	}
+	if want := []string{"alpacas", "llamas", "release"}; !reflect.DeepEqual(keys, want) {
+		return fmt.Errorf("got keys %q, want %q", keys, want)
+	}
+	return nil
+}
+
+func selftestArtifactUpload(ctx context.Context, env *selftestEnv) error {
+	uploadDir := filepath.Join(env.dir, "upload")
+	for path, contents := range selftestArtifacts {
+		path = filepath.Join(uploadDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o666); err != nil {
+			return err
+		}
+	}
+
+	uploader := agent.NewArtifactUploader(env.logger, env.client, agent.ArtifactUploaderConfig{
+		JobID: selftestJobID,
+		Paths: filepath.ToSlash(filepath.Join(uploadDir, "**", "*")),
+	})
+	return uploader.Upload(ctx)
+}
+
+func selftestArtifactDownload(ctx context.Context, env *selftestEnv) error {
+	downloadDir := filepath.Join(env.dir, "download")
+	if err := os.Mkdir(downloadDir, 0o777); err != nil {
+		return err
+	}
+
+	downloader := agent.NewArtifactDownloader(env.logger, env.client, agent.ArtifactDownloaderConfig{
+		BuildID:     selftestBuildID,
+		Query:       "*",
+		Destination: downloadDir,
+	})
+	if err := downloader.Download(ctx); err != nil {
+		return err
+	}
+
+	// Artifacts are uploaded with absolute paths, so they're found by the
+	// end of their path, which is relative to the root
+	downloaded := map[string]string{}
+	for _, result := range downloader.Results() {
+		if result.Error != "" {
+			return fmt.Errorf("downloading %s: %s", result.Path, result.Error)
+		}
+		if _, path, ok := strings.Cut(result.Path, "/upload/"); ok {
+			downloaded[path] = result.Destination
+		}
+	}
+
+	for path, want := range selftestArtifacts {
+		destination, ok := downloaded[path]
+		if !ok {
+			return fmt.Errorf("%s wasn't downloaded", path)
+		}
+		got, err := os.ReadFile(destination)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, []byte(want)) {
+			return fmt.Errorf("downloaded %s as %q, want %q", path, got, want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	selftestJobID   = "selftest-job"
+	selftestBuildID = "selftest-build"
+	selftestToken   = "selftest-token"
+)
+
+// selftestServer is an in-process stand-in for the Agent API and the bucket
+// artifacts are uploaded to, which serves a single job in a single build
+type selftestServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	metaData  map[string]string
+	artifacts []*api.Artifact
+	states    map[string]string
+	objects   map[string][]byte
+}
+
+func newSelftestServer() *selftestServer {
+	s := &selftestServer{
+		metaData: map[string]string{},
+		states:   map[string]string{},
+		objects:  map[string][]byte{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *selftestServer) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	// The object store is public, like a presigned bucket, but the Agent API
+	// needs the access token
+	if strings.HasPrefix(req.URL.Path, "/objects/") || req.URL.Path == "/objects" {
+		s.serveObject(rw, req)
+		return
+	}
+	if req.Header.Get("Authorization") != "Token "+selftestToken {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobPath := "/jobs/" + selftestJobID
+	buildPath := "/builds/" + selftestBuildID
+
+	switch route := req.Method + " " + req.URL.Path; route {
+	case "POST " + jobPath + "/data/set":
+		var md api.MetaData
+		if !decodeSelftestRequest(rw, req, &md) {
+			return
+		}
+		s.metaData[md.Key] = md.Value
+
+	case "POST " + jobPath + "/data/batch_set":
+		var batch api.MetaDataBatch
+		if !decodeSelftestRequest(rw, req, &batch) {
+			return
+		}
+		for _, md := range batch.Items {
+			s.metaData[md.Key] = md.Value
+		}
+
+	case "POST " + jobPath + "/data/get", "POST " + buildPath + "/data/get":
+		var md api.MetaData
+		if !decodeSelftestRequest(rw, req, &md) {
+			return
+		}
+		value, ok := s.metaData[md.Key]
+		if !ok {
+			http.Error(rw, `{"message":"No key found"}`, http.StatusNotFound)
+			return
+		}
+		writeSelftestResponse(rw, api.MetaData{Key: md.Key, Value: value})
+
+	case "POST " + jobPath + "/data/exists", "POST " + buildPath + "/data/exists":
+		var md api.MetaData
+		if !decodeSelftestRequest(rw, req, &md) {
+			return
+		}
+		_, ok := s.metaData[md.Key]
+		writeSelftestResponse(rw, api.MetaDataExists{Exists: ok})
+
+	case "POST " + jobPath + "/data/keys", "POST " + buildPath + "/data/keys":
+		keys := make([]string, 0, len(s.metaData))
+		for key := range s.metaData {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeSelftestResponse(rw, keys)
+
+	case "POST " + jobPath + "/artifacts":
+		var batch api.ArtifactBatch
+		if !decodeSelftestRequest(rw, req, &batch) {
+			return
+		}
+		resp := api.ArtifactBatchCreateResponse{
+			ID:                 batch.ID,
+			UploadInstructions: &api.ArtifactUploadInstructions{Data: map[string]string{"key": "${artifact:path}"}},
+		}
+		resp.UploadInstructions.Action.URL = s.URL
+		resp.UploadInstructions.Action.Method = "POST"
+		resp.UploadInstructions.Action.Path = "/objects"
+		resp.UploadInstructions.Action.FileInput = "file"
+		for _, artifact := range batch.Artifacts {
+			artifact.ID = fmt.Sprintf("selftest-artifact-%d", len(s.artifacts)+1)
+			s.states[artifact.ID] = "new"
+			artifact.URL = s.URL + "/objects/" + artifact.Path
+			s.artifacts = append(s.artifacts, artifact)
+			resp.ArtifactIDs = append(resp.ArtifactIDs, artifact.ID)
+		}
+		writeSelftestResponse(rw, resp)
+
+	case "PUT " + jobPath + "/artifacts":
+		var update api.ArtifactBatchUpdateRequest
+		if !decodeSelftestRequest(rw, req, &update) {
+			return
+		}
+		for _, artifact := range update.Artifacts {
+			if _, ok := s.states[artifact.ID]; ok {
+				s.states[artifact.ID] = artifact.State
+			}
+		}
+
+	case "GET " + buildPath + "/artifacts/search":
+		// Only finished artifacts are found, whatever the query
+		found := []*api.Artifact{}
+		for _, artifact := range s.artifacts {
+			if s.states[artifact.ID] == "finished" {
+				found = append(found, artifact)
+			}
+		}
+		writeSelftestResponse(rw, found)
+
+	default:
+		http.Error(rw, fmt.Sprintf(`{"message":"%s isn't served by the selftest API"}`, route), http.StatusNotFound)
+	}
+}
+
+// serveObject accepts form uploads like a bucket does, and serves the objects
+// uploaded
+func (s *selftestServer) serveObject(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		key := req.FormValue("key")
+		file, _, err := req.FormFile("file")
+		if err != nil || key == "" {
+			http.Error(rw, "Uploads need a key and a file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		body, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.mu.Lock()
+		s.objects[key] = body
+		s.mu.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+
+	case http.MethodGet:
+		s.mu.Lock()
+		body, ok := s.objects[strings.TrimPrefix(req.URL.Path, "/objects/")]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		rw.Write(body)
+
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func decodeSelftestRequest(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		http.Error(rw, fmt.Sprintf(`{"message":%q}`, err.Error()), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeSelftestResponse(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,23 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestRunSelftest(t *testing.T) {
+	var out bytes.Buffer
+	if !runSelftest(context.Background(), logger.Discard, &out) {
+		t.Fatalf("runSelftest() = false, output:\n%s", out.String())
+	}
+
+	for _, check := range selftestChecks {
+		if !strings.Contains(out.String(), "PASS  "+check.name) {
+			t.Errorf("output doesn't show %q passed:\n%s", check.name, out.String())
+		}
+	}
+}
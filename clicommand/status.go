@@ -0,0 +1,173 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const statusHelpDescription = `Usage:
+
+   buildkite-agent status [options...]
+
+Description:
+
+   Shows the health of this host, and what each agent using the build path is
+   doing. This is the same information that agents send to Buildkite with
+   their heartbeats: free disk space in the build path, load average, and the
+   running job and its phase.
+
+   Agents update their status each time they heartbeat, so it can be up to a
+   heartbeat interval out of date.
+
+Example:
+
+   $ buildkite-agent status --json`
+
+type StatusConfig struct {
+	BuildPath string `cli:"build-path" normalize:"filepath" validate:"required"`
+	JSON      bool   `cli:"json"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+}
+
+// statusOutput is what buildkite-agent status --json prints
+type statusOutput struct {
+	Host   api.AgentHealth     `json:"host"`
+	Agents []agent.AgentStatus `json:"agents"`
+}
+
+var StatusCommand = cli.Command{
+	Name:        "status",
+	Usage:       "Show the health of this host and the agents running on it",
+	Description: statusHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "The build path used by the agents to show the status of",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as JSON",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := StatusConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		agents, err := agent.ReadAgentStatuses(cfg.BuildPath)
+		if err != nil {
+			l.Fatal("Failed to read agent statuses: %s", err)
+		}
+
+		out := statusOutput{
+			Host:   agent.HostHealth(cfg.BuildPath),
+			Agents: agents,
+		}
+
+		if cfg.JSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(out); err != nil {
+				l.Fatal("Failed to encode status: %s", err)
+			}
+			return
+		}
+
+		printStatus(os.Stdout, out, time.Now())
+	},
+}
+
+func printStatus(w io.Writer, out statusOutput, now time.Time) {
+	fmt.Fprintln(w, "Host:")
+	printHealth(w, out.Host)
+
+	if len(out.Agents) == 0 {
+		fmt.Fprintln(w, "\nNo agents have reported their status")
+		return
+	}
+
+	for _, a := range out.Agents {
+		fmt.Fprintf(w, "\nAgent %s (pid %d, updated %s ago):\n", a.Name, a.PID, now.Sub(a.UpdatedAt).Round(time.Second))
+		if a.Health.JobID == "" {
+			fmt.Fprintln(w, "  Idle")
+			continue
+		}
+		fmt.Fprintf(w, "  Running job %s\n", a.Health.JobID)
+		if a.Health.JobPhase != "" {
+			fmt.Fprintf(w, "  Phase: %s\n", a.Health.JobPhase)
+		}
+		if a.Health.ArtifactTransfer {
+			fmt.Fprintln(w, "  Transferring artifacts")
+		}
+	}
+}
+
+func printHealth(w io.Writer, h api.AgentHealth) {
+	if h.DiskTotalBytes > 0 {
+		fmt.Fprintf(w, "  Disk: %s free of %s\n", humanBytes(h.DiskFreeBytes), humanBytes(h.DiskTotalBytes))
+	}
+	if len(h.LoadAverage) > 0 {
+		loads := make([]string, 0, len(h.LoadAverage))
+		for _, l := range h.LoadAverage {
+			loads = append(loads, fmt.Sprintf("%.2f", l))
+		}
+		fmt.Fprintf(w, "  Load average: %s\n", strings.Join(loads, " "))
+	}
+}
+
+// humanBytes formats a number of bytes using binary prefixes, e.g. 1.5 GiB
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
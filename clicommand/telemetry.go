@@ -0,0 +1,102 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/telemetry"
+	"github.com/urfave/cli"
+)
+
+// recorder records the command that's running, if telemetry is enabled
+var recorder *telemetry.Recorder
+
+// WithTelemetry wraps the actions of commands and their subcommands so that
+// each run is recorded, if the user has opted in to telemetry. A run is
+// recorded with its exit status when its action returns, with or without an
+// error, or when it exits through exit, which the logger's Fatal does too.
+// Runs that panic or are killed aren't recorded.
+func WithTelemetry(commands []cli.Command) []cli.Command {
+	return withTelemetry("", commands)
+}
+
+func withTelemetry(prefix string, commands []cli.Command) []cli.Command {
+	wrapped := make([]cli.Command, 0, len(commands))
+	for _, cmd := range commands {
+		name := strings.TrimSpace(prefix + " " + cmd.Name)
+
+		cmd.Subcommands = withTelemetry(name, cmd.Subcommands)
+
+		switch action := cmd.Action.(type) {
+		case func(*cli.Context):
+			cmd.Action = func(c *cli.Context) {
+				startTelemetry(c, name)
+				action(c)
+				finishTelemetry(0)
+			}
+
+		case func(*cli.Context) error:
+			cmd.Action = func(c *cli.Context) error {
+				startTelemetry(c, name)
+				err := action(c)
+				if err == nil {
+					finishTelemetry(0)
+					return nil
+				}
+
+				// urfave/cli exits with 1 when an action fails, unless the
+				// error has a status of its own
+				status := exitStatus(1)
+				finishTelemetry(status)
+				if status == RequestTimeoutExitCode {
+					return cli.NewExitError(fmt.Errorf("%w: %v", ErrRequestTimeout, err), status)
+				}
+				return err
+			}
+		}
+
+		wrapped = append(wrapped, cmd)
+	}
+	return wrapped
+}
+
+// startTelemetry starts recording a run of the named command, with the flags
+// that have been set, but not their values.
+func startTelemetry(c *cli.Context, name string) {
+	var flags []string
+	for _, f := range c.FlagNames() {
+		if c.IsSet(f) {
+			flags = append(flags, f)
+		}
+	}
+
+	recorder = telemetry.Start(telemetry.ConfigFromEnv(), name, flags)
+}
+
+// finishTelemetry records the running command as having exited with status.
+func finishTelemetry(status int) {
+	if err := recorder.Finish(status); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record telemetry: %v\n", err)
+	}
+}
+
+// exitStatus returns the status a command that's exiting with status should
+// exit with instead. Failures once the command's --request-timeout has
+// expired are RequestTimeoutExitCode, as they're probably due to it.
+func exitStatus(status int) int {
+	if status != 0 && requestTimeoutErr() != nil {
+		return RequestTimeoutExitCode
+	}
+	return status
+}
+
+// exit records the running command's exit status and then exits. Commands
+// should exit with this rather than os.Exit, so that failures are recorded.
+func exit(status int) {
+	if status = exitStatus(status); status == RequestTimeoutExitCode {
+		fmt.Fprintln(os.Stderr, ErrRequestTimeout)
+	}
+	finishTelemetry(status)
+	os.Exit(status)
+}
@@ -0,0 +1,146 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/usage"
+	"github.com/urfave/cli"
+)
+
+const usageReportHelpDescription = `Usage:
+
+   buildkite-agent usage report [options...]
+
+Description:
+
+   Shows how much data each pipeline has transferred as artifacts on this
+   host, by queue. This is read from the records that artifact uploads and
+   downloads append to --usage-path, so it only covers jobs run by agents
+   started with the same --usage-path.
+
+Example:
+
+   $ buildkite-agent usage report --usage-path /var/lib/buildkite-agent/usage.jsonl --since 24h --json`
+
+type UsageReportConfig struct {
+	UsagePath string `cli:"usage-path" normalize:"filepath" validate:"required"`
+	Since     string `cli:"since"`
+	JSON      bool   `cli:"json"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+}
+
+// usageReportOutput is what buildkite-agent usage report --json prints
+type usageReportOutput struct {
+	Since     time.Time       `json:"since"`
+	Pipelines []usage.Summary `json:"pipelines"`
+}
+
+var UsageReportCommand = cli.Command{
+	Name:        "report",
+	Usage:       "Show the data transferred by each pipeline on this host",
+	Description: usageReportHelpDescription,
+	Flags: []cli.Flag{
+		UsagePathFlag,
+		cli.StringFlag{
+			Name:  "since",
+			Value: "24h",
+			Usage: "How far back to report on, as a duration such as 24h",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the report as JSON",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := UsageReportConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		since, err := time.ParseDuration(cfg.Since)
+		if err != nil || since <= 0 {
+			l.Fatal("Invalid --since %q, expected a duration such as 24h", cfg.Since)
+		}
+
+		out := usageReportOutput{Since: time.Now().Add(-since).UTC()}
+
+		records, err := usage.Read(cfg.UsagePath, out.Since)
+		if err != nil {
+			l.Fatal("Failed to read usage records: %s", err)
+		}
+		out.Pipelines = usage.Summarize(records)
+
+		if cfg.JSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(out); err != nil {
+				l.Fatal("Failed to encode usage report: %s", err)
+			}
+			return
+		}
+
+		printUsageReport(os.Stdout, out)
+	},
+}
+
+func printUsageReport(w io.Writer, out usageReportOutput) {
+	if len(out.Pipelines) == 0 {
+		fmt.Fprintf(w, "No data has been transferred since %s\n", out.Since.Format(time.RFC3339))
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PIPELINE\tQUEUE\tUPLOADED\tDOWNLOADED")
+	for _, s := range out.Pipelines {
+		pipeline := s.Pipeline
+		if s.Organization != "" {
+			pipeline = s.Organization + "/" + pipeline
+		}
+		queue := s.Queue
+		if queue == "" {
+			queue = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s (%d files)\t%s (%d files)\n",
+			pipeline, queue,
+			humanBytes(uint64(s.UploadedBytes)), s.UploadedFiles,
+			humanBytes(uint64(s.DownloadedBytes)), s.DownloadedFiles)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,35 @@
+package clicommand
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/usage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintUsageReport(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	printUsageReport(&buf, usageReportOutput{
+		Pipelines: []usage.Summary{
+			{Organization: "acme", Pipeline: "web", Queue: "default", UploadedBytes: 3 << 20, UploadedFiles: 2, DownloadedBytes: 512, DownloadedFiles: 1},
+			{Pipeline: "api", DownloadedBytes: 2048, DownloadedFiles: 4},
+		},
+	})
+
+	assert.Equal(t, `PIPELINE  QUEUE    UPLOADED           DOWNLOADED
+acme/web  default  3.0 MiB (2 files)  512 B (1 files)
+api       -        0 B (0 files)      2.0 KiB (4 files)
+`, buf.String())
+}
+
+func TestPrintUsageReportEmpty(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	printUsageReport(&buf, usageReportOutput{Since: time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, "No data has been transferred since 2023-04-01T00:00:00Z\n", buf.String())
+}
@@ -0,0 +1,349 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const waitForHelpDescription = `Usage:
+
+   buildkite-agent wait-for [options...]
+
+Description:
+
+   Waits until a URL responds successfully, or a TCP port accepts
+   connections, e.g. for a service started in the background by an earlier
+   command. The wait is shown as a collapsed group in the job log, which is
+   expanded with a summary of what went wrong if the wait times out.
+
+   Checks start at --interval apart, backing off by --backoff after each
+   failed check up to --max-interval. If both --url and --port are given,
+   both have to succeed.
+
+Example:
+
+   $ buildkite-agent wait-for --url http://localhost:8080/health --timeout 2m --interval 2s
+   $ buildkite-agent wait-for --port localhost:5432`
+
+type WaitForConfig struct {
+	URL          string `cli:"url"`
+	Port         string `cli:"port"`
+	ExpectStatus int    `cli:"expect-status"`
+	Timeout      string `cli:"timeout"`
+	Interval     string `cli:"interval"`
+	MaxInterval  string `cli:"max-interval"`
+	Backoff      string `cli:"backoff"`
+	Name         string `cli:"name"`
+
+	// Global flags
+	Debug        bool     `cli:"debug"`
+	LogLevel     string   `cli:"log-level"`
+	NoColor      bool     `cli:"no-color"`
+	Experiments  []string `cli:"experiment" normalize:"list"`
+	Profile      string   `cli:"profile"`
+	RetryVerbose bool     `cli:"retry-verbose"`
+}
+
+var WaitForCommand = cli.Command{
+	Name:        "wait-for",
+	Usage:       "Wait for a URL or TCP port to become available",
+	Description: waitForHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Value: "",
+			Usage: "An HTTP(S) URL to wait for a successful response from",
+		},
+		cli.StringFlag{
+			Name:  "port",
+			Value: "",
+			Usage: "A host:port to wait for a TCP connection to",
+		},
+		cli.IntFlag{
+			Name:  "expect-status",
+			Value: 0,
+			Usage: "The HTTP status the URL should respond with. The default of 0 accepts any 2xx status",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Value: "1m",
+			Usage: "How long to wait before giving up",
+		},
+		cli.StringFlag{
+			Name:  "interval",
+			Value: "1s",
+			Usage: "How long to wait between the first checks",
+		},
+		cli.StringFlag{
+			Name:  "max-interval",
+			Value: "10s",
+			Usage: "The longest to wait between checks when backing off",
+		},
+		cli.StringFlag{
+			Name:  "backoff",
+			Value: "1.5",
+			Usage: "How much to multiply the interval by after each failed check. 1 disables backing off",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Value: "",
+			Usage: "What to call the service in the job log. Defaults to the URL or port",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RetryVerboseFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := WaitForConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		w, err := newWaiter(cfg)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if !w.wait(context.Background(), os.Stdout) {
+			exit(1)
+		}
+	},
+}
+
+// waitCheck is something to wait for
+type waitCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// waitResult is the outcome of waiting for a check
+type waitResult struct {
+	name     string
+	attempts int
+	elapsed  time.Duration
+	err      error
+}
+
+type waiter struct {
+	checks      []waitCheck
+	name        string
+	timeout     time.Duration
+	interval    time.Duration
+	maxInterval time.Duration
+	backoff     float64
+	sleep       func(ctx context.Context, d time.Duration)
+}
+
+func newWaiter(cfg WaitForConfig) (*waiter, error) {
+	if cfg.URL == "" && cfg.Port == "" {
+		return nil, errors.New("one of --url or --port is required")
+	}
+
+	w := &waiter{name: cfg.Name, sleep: sleepContext}
+
+	durations := []struct {
+		flag  string
+		value string
+		into  *time.Duration
+	}{
+		{"timeout", cfg.Timeout, &w.timeout},
+		{"interval", cfg.Interval, &w.interval},
+		{"max-interval", cfg.MaxInterval, &w.maxInterval},
+	}
+	for _, d := range durations {
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", d.flag, err)
+		}
+		if parsed <= 0 {
+			return nil, fmt.Errorf("--%s must be positive", d.flag)
+		}
+		*d.into = parsed
+	}
+	if w.interval > w.maxInterval {
+		return nil, fmt.Errorf("--interval (%s) can't be longer than --max-interval (%s)", w.interval, w.maxInterval)
+	}
+
+	backoff, err := strconv.ParseFloat(cfg.Backoff, 64)
+	if err != nil || backoff < 1 {
+		return nil, fmt.Errorf("--backoff must be a number of at least 1, not %q", cfg.Backoff)
+	}
+	w.backoff = backoff
+
+	if cfg.URL != "" {
+		w.checks = append(w.checks, waitCheck{name: cfg.URL, check: httpCheck(cfg.URL, cfg.ExpectStatus, w.timeout)})
+	}
+	if cfg.Port != "" {
+		if _, _, err := net.SplitHostPort(cfg.Port); err != nil {
+			return nil, fmt.Errorf("--port must be host:port: %w", err)
+		}
+		w.checks = append(w.checks, waitCheck{name: cfg.Port, check: tcpCheck(cfg.Port)})
+	}
+
+	if w.name == "" {
+		names := make([]string, 0, len(w.checks))
+		for _, c := range w.checks {
+			names = append(names, c.name)
+		}
+		w.name = strings.Join(names, " and ")
+	}
+
+	return w, nil
+}
+
+// wait runs each check until it succeeds or the timeout passes, printing its
+// progress as a job log group to out. It reports whether every check
+// succeeded.
+func (w *waiter) wait(ctx context.Context, out io.Writer) bool {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	fmt.Fprintf(out, "~~~ :hourglass: Waiting for %s\n", w.name)
+
+	start := time.Now()
+	var results []waitResult
+	ok := true
+	for _, c := range w.checks {
+		result := w.waitFor(ctx, out, c)
+		results = append(results, result)
+		if result.err != nil {
+			ok = false
+			break
+		}
+	}
+
+	if ok {
+		fmt.Fprintf(out, "%s is available after %s\n", w.name, time.Since(start).Round(time.Millisecond))
+		return true
+	}
+
+	// Expand the group so the failure is visible
+	fmt.Fprintln(out, "^^^ +++")
+	fmt.Fprintf(out, "Gave up waiting for %s after %s\n", w.name, w.timeout)
+	for _, r := range results {
+		status := "available"
+		if r.err != nil {
+			status = "unavailable: " + r.err.Error()
+		}
+		fmt.Fprintf(out, "  %s: %s (%d checks over %s)\n", r.name, status, r.attempts, r.elapsed.Round(time.Millisecond))
+	}
+	return false
+}
+
+func (w *waiter) waitFor(ctx context.Context, out io.Writer, c waitCheck) waitResult {
+	start := time.Now()
+	interval := w.interval
+	result := waitResult{name: c.name}
+
+	for {
+		result.attempts++
+		err := c.check(ctx)
+		result.elapsed = time.Since(start)
+		if err == nil {
+			result.err = nil
+			return result
+		}
+
+		if ctx.Err() != nil && result.err != nil {
+			// The check was cut short by the timeout, so keep the error
+			// from the last check, which says why it wasn't available
+			return result
+		}
+		result.err = err
+		if ctx.Err() != nil {
+			return result
+		}
+
+		fmt.Fprintf(out, "%s isn't available yet: %v. Checking again in %s\n", c.name, err, interval)
+		w.sleep(ctx, interval)
+		if ctx.Err() != nil {
+			return result
+		}
+
+		interval = time.Duration(float64(interval) * w.backoff)
+		if interval > w.maxInterval {
+			interval = w.maxInterval
+		}
+	}
+}
+
+// httpCheck checks that url responds with expectStatus, or a 2xx status if
+// it's zero. A request that takes longer than timeout is abandoned, so a
+// server that never responds can't hold up the check.
+func httpCheck(url string, expectStatus int, timeout time.Duration) func(context.Context) error {
+	client := &http.Client{Timeout: timeout}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+
+		switch {
+		case expectStatus != 0 && resp.StatusCode != expectStatus:
+			return fmt.Errorf("responded with %s, expected %d", resp.Status, expectStatus)
+		case expectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299):
+			return fmt.Errorf("responded with %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+func tcpCheck(address string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
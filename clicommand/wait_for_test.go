@@ -0,0 +1,133 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testWaitForConfig() WaitForConfig {
+	return WaitForConfig{
+		Timeout:     "2s",
+		Interval:    "1ms",
+		MaxInterval: "5ms",
+		Backoff:     "2",
+	}
+}
+
+func TestWaitForURL(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Become healthy on the third request
+		if atomic.AddInt32(&requests, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := testWaitForConfig()
+	cfg.URL = server.URL
+	w, err := newWaiter(cfg)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	assert.True(t, w.wait(context.Background(), out))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.True(t, strings.HasPrefix(out.String(), "~~~ :hourglass: Waiting for "+server.URL+"\n"), out.String())
+	assert.Contains(t, out.String(), "503 Service Unavailable")
+	assert.NotContains(t, out.String(), "^^^ +++")
+}
+
+func TestWaitForPortTimesOut(t *testing.T) {
+	t.Parallel()
+
+	// Find a port that nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := testWaitForConfig()
+	cfg.Port = addr
+	cfg.Name = "postgres"
+	cfg.Timeout = "50ms"
+	w, err := newWaiter(cfg)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	assert.False(t, w.wait(context.Background(), out))
+	assert.Contains(t, out.String(), "^^^ +++\nGave up waiting for postgres after 50ms\n")
+	assert.Contains(t, out.String(), addr+": unavailable: ")
+	assert.Contains(t, out.String(), "connection refused")
+}
+
+func TestWaitForURLGivesUpOnHungServer(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Never respond
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := testWaitForConfig()
+	cfg.URL = server.URL
+	cfg.Timeout = "100ms"
+	w, err := newWaiter(cfg)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.False(t, w.wait(context.Background(), &bytes.Buffer{}))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWaitForBacksOff(t *testing.T) {
+	t.Parallel()
+
+	cfg := testWaitForConfig()
+	cfg.Port = "localhost:1"
+	w, err := newWaiter(cfg)
+	assert.NoError(t, err)
+
+	var sleeps []time.Duration
+	w.checks[0].check = func(context.Context) error {
+		if len(sleeps) == 4 {
+			return nil
+		}
+		return net.ErrClosed
+	}
+	w.sleep = func(_ context.Context, d time.Duration) { sleeps = append(sleeps, d) }
+
+	assert.True(t, w.wait(context.Background(), &bytes.Buffer{}))
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond}, sleeps)
+}
+
+func TestNewWaiterErrors(t *testing.T) {
+	t.Parallel()
+
+	for name, modify := range map[string]func(*WaitForConfig){
+		"nothing to wait for": func(c *WaitForConfig) {},
+		"bad port":            func(c *WaitForConfig) { c.Port = "8080" },
+		"bad timeout":         func(c *WaitForConfig) { c.URL = "http://localhost"; c.Timeout = "soon" },
+		"bad backoff":         func(c *WaitForConfig) { c.URL = "http://localhost"; c.Backoff = "0.5" },
+		"zero interval":       func(c *WaitForConfig) { c.URL = "http://localhost"; c.Interval = "0s" },
+		"interval over max":   func(c *WaitForConfig) { c.URL = "http://localhost"; c.Interval = "1m"; c.MaxInterval = "10s" },
+	} {
+		cfg := testWaitForConfig()
+		modify(&cfg)
+		_, err := newWaiter(cfg)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,199 @@
+// Package destination parses the URLs of the object stores that artifacts are
+// uploaded to and downloaded from, such as s3://bucket/path.
+//
+// It is intended for internal use by buildkite-agent only.
+package destination
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Scheme is the kind of object store a destination is in
+type Scheme string
+
+const (
+	S3          Scheme = "s3"
+	GS          Scheme = "gs"
+	Artifactory Scheme = "rt"
+	AzureBlob   Scheme = "az"
+)
+
+// Schemes are the schemes that Parse understands
+var Schemes = []Scheme{S3, GS, Artifactory, AzureBlob}
+
+// ErrUnknownScheme is wrapped by the error Parse returns for a destination
+// with a scheme it doesn't understand, which may be handled some other way,
+// such as by a storage helper
+var ErrUnknownScheme = errors.New("unknown scheme")
+
+// Destination is where in an object store artifacts are kept
+type Destination struct {
+	Scheme Scheme
+
+	// The S3 or Google Cloud Storage bucket, Artifactory repository, or Azure
+	// Blob Storage container
+	Bucket string
+
+	// The path in the bucket, without leading or trailing slashes. It's empty
+	// for the root of the bucket.
+	Path string
+}
+
+// String returns the destination as a URL, such as s3://bucket/path
+func (d Destination) String() string {
+	if d.Path == "" {
+		return fmt.Sprintf("%s://%s", d.Scheme, d.Bucket)
+	}
+	return fmt.Sprintf("%s://%s/%s", d.Scheme, d.Bucket, d.Path)
+}
+
+// ParseError is returned by Parse for a destination that isn't valid
+type ParseError struct {
+	Destination string
+	Err         error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid destination %q: %s", e.Destination, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse parses and validates a destination such as s3://bucket/path
+func Parse(s string) (Destination, error) {
+	fail := func(format string, v ...any) (Destination, error) {
+		return Destination{}, &ParseError{Destination: s, Err: fmt.Errorf(format, v...)}
+	}
+
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		return fail("expected a URL such as s3://bucket/path")
+	}
+
+	d := Destination{Scheme: Scheme(strings.ToLower(scheme))}
+	if !d.Scheme.known() {
+		return Destination{}, &ParseError{Destination: s, Err: fmt.Errorf("%w %q, expected one of %s", ErrUnknownScheme, scheme, schemeList())}
+	}
+
+	d.Bucket, d.Path, _ = strings.Cut(rest, "/")
+	d.Path = strings.Trim(d.Path, "/")
+
+	if d.Bucket == "" {
+		return fail("it has no %s", d.Scheme.bucketNoun())
+	}
+	if err := d.Scheme.validateBucket(d.Bucket); err != nil {
+		return fail("%s %q %v", d.Scheme.bucketNoun(), d.Bucket, err)
+	}
+	for _, r := range d.Path {
+		if unicode.IsControl(r) {
+			return fail("its path contains the control character %q", r)
+		}
+	}
+	for _, part := range strings.Split(d.Path, "/") {
+		if part == "." || part == ".." {
+			return fail("its path contains %q", part)
+		}
+	}
+
+	return d, nil
+}
+
+// HasScheme returns whether s is a destination with one of the schemes
+func HasScheme(s string, schemes ...Scheme) bool {
+	scheme, _, ok := strings.Cut(s, "://")
+	if !ok {
+		return false
+	}
+	for _, want := range schemes {
+		if Scheme(strings.ToLower(scheme)) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scheme) known() bool {
+	for _, known := range Schemes {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scheme) bucketNoun() string {
+	switch s {
+	case Artifactory:
+		return "repository"
+	case AzureBlob:
+		return "container"
+	default:
+		return "bucket"
+	}
+}
+
+// validateBucket checks a bucket name against the rules of the object store,
+// loosened where compatible servers, or buckets made under older rules, allow
+// more
+func (s Scheme) validateBucket(name string) error {
+	switch s {
+	case S3:
+		// Buckets made in us-east-1 before 2018 can have capitals and
+		// underscores, and be up to 255 characters
+		return checkName(name, 255, func(r rune) bool {
+			return isLower(r) || isUpper(r) || isDigit(r) || r == '.' || r == '-' || r == '_'
+		})
+	case GS:
+		return checkName(name, 222, func(r rune) bool {
+			return isLower(r) || isDigit(r) || r == '.' || r == '-' || r == '_'
+		})
+	case AzureBlob:
+		if len(name) < 3 || len(name) > 63 {
+			return fmt.Errorf("must be 3 to 63 characters long")
+		}
+		if strings.Contains(name, "--") {
+			return fmt.Errorf("can't contain consecutive hyphens")
+		}
+		return checkName(name, 63, func(r rune) bool {
+			return isLower(r) || isDigit(r) || r == '-'
+		})
+	default:
+		return checkName(name, 255, func(r rune) bool {
+			return !unicode.IsSpace(r) && !unicode.IsControl(r)
+		})
+	}
+}
+
+func checkName(name string, max int, valid func(rune) bool) error {
+	if len(name) > max {
+		return fmt.Errorf("is longer than %d characters", max)
+	}
+	for _, r := range name {
+		if !valid(r) {
+			return fmt.Errorf("can't contain %q", r)
+		}
+	}
+	first, last := rune(name[0]), rune(name[len(name)-1])
+	if !isAlnum(first) || !isAlnum(last) {
+		return fmt.Errorf("must start and end with a letter or number")
+	}
+	return nil
+}
+
+func isLower(r rune) bool { return r >= 'a' && r <= 'z' }
+func isUpper(r rune) bool { return r >= 'A' && r <= 'Z' }
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+func isAlnum(r rune) bool { return isLower(r) || isUpper(r) || isDigit(r) }
+
+func schemeList() string {
+	names := make([]string, len(Schemes))
+	for i, s := range Schemes {
+		names[i] = string(s) + "://"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,90 @@
+package destination
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		in   string
+		want Destination
+	}{
+		{in: "s3://my-bucket-name/foo/bar", want: Destination{Scheme: S3, Bucket: "my-bucket-name", Path: "foo/bar"}},
+		{in: "s3://custom-s3-domain/folder/ends-with-a-slash/", want: Destination{Scheme: S3, Bucket: "custom-s3-domain", Path: "folder/ends-with-a-slash"}},
+		{in: "s3://Legacy_Bucket", want: Destination{Scheme: S3, Bucket: "Legacy_Bucket"}},
+		{in: "gs://my-bucket-name", want: Destination{Scheme: GS, Bucket: "my-bucket-name"}},
+		{in: "GS://my.bucket/pkg/", want: Destination{Scheme: GS, Bucket: "my.bucket", Path: "pkg"}},
+		{in: "rt://my-repo/foo/bar", want: Destination{Scheme: Artifactory, Bucket: "my-repo", Path: "foo/bar"}},
+		{in: "az://my-container/foo", want: Destination{Scheme: AzureBlob, Bucket: "my-container", Path: "foo"}},
+	} {
+		got, err := Parse(test.in)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("Parse(%q) diff (-got +want):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, in := range []string{
+		"my-bucket/foo",
+		"s3://",
+		"s3:///foo",
+		"s3://-bucket/foo",
+		"s3://my bucket/foo",
+		"gs://MyBucket",
+		"az://ab",
+		"az://my--container",
+		"az://My-Container",
+		"rt://my-repo/foo/../bar",
+		"s3://my-bucket/foo\nbar",
+	} {
+		_, err := Parse(in)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Parse(%q) error = %v, want a *ParseError", in, err)
+		}
+	}
+
+	if _, err := Parse("oci://registry/foo"); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf(`Parse("oci://registry/foo") error = %v, want ErrUnknownScheme`, err)
+	}
+}
+
+func TestDestinationString(t *testing.T) {
+	t.Parallel()
+
+	for _, in := range []string{"s3://bucket", "gs://bucket/pkg/1", "az://container/a"} {
+		d, err := Parse(in)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", in, err)
+		}
+		if got := d.String(); got != in {
+			t.Errorf("Parse(%q).String() = %q", in, got)
+		}
+	}
+}
+
+func TestHasScheme(t *testing.T) {
+	t.Parallel()
+
+	if !HasScheme("S3://bucket", S3, GS) {
+		t.Errorf(`HasScheme("S3://bucket", S3, GS) = false, want true`)
+	}
+	if HasScheme("rt://repo", S3, GS) {
+		t.Errorf(`HasScheme("rt://repo", S3, GS) = true, want false`)
+	}
+	if HasScheme("s3-bucket/path", Schemes...) {
+		t.Errorf(`HasScheme("s3-bucket/path", Schemes...) = true, want false`)
+	}
+}
@@ -0,0 +1,449 @@
+// Package dockerproxy provides a proxy for the Docker Engine API that only
+// passes on requests a policy allows, so jobs can be given access to Docker
+// without being able to take over the host with it.
+package dockerproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Policy is what jobs are allowed to do with Docker. Everything the Docker
+// API allows is allowed, apart from:
+//
+//   - Privileged containers and execs, added capabilities, devices, device
+//     cgroup rules and device requests, security options, cgroup parents,
+//     volumes from other containers, and sharing the host's network, UTS or
+//     cgroup namespaces, unless AllowPrivileged is set
+//   - Sharing the host's PID, IPC or user namespaces
+//   - Bind mounting host paths other than AllowedMounts and their contents
+//   - Managing plugins, which run with root privileges
+//   - Initialising, joining or changing a swarm
+//
+// Services get the same checks as containers: their bind mounts must be in
+// AllowedMounts, and they can't add capabilities, change their security
+// profiles or use the host's network unless AllowPrivileged is set. The Proxy
+// also only allows execs in containers that were created through it.
+//
+// The proxy only helps if jobs can't reach the Docker daemon some other way,
+// such as through /var/run/docker.sock or a DOCKER_HOST listening on TCP.
+// The user jobs run as mustn't be able to connect to the daemon's socket.
+//
+// Bind mount sources are passed on to Docker as the paths they resolved to
+// when they were checked, so a symlink that's changed afterwards can't point
+// the mount somewhere else. Docker still resolves the path again when the
+// container starts, so anything that can write to an allowed mount can swap
+// a directory in it for a symlink in between. AllowedMounts should only
+// contain paths that jobs are trusted with everything the host user running
+// Docker can reach through them. Volume devices aren't rewritten, as they're
+// resolved whenever the volume is mounted.
+type Policy struct {
+	AllowPrivileged bool
+	AllowedMounts   []string
+}
+
+// PolicyError is returned when a request isn't allowed
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+func denied(format string, args ...any) error {
+	return &PolicyError{Reason: fmt.Sprintf(format, args...)}
+}
+
+var (
+	// Docker API paths can start with the API version, e.g. /v1.41/info
+	versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+	containerExecPath = regexp.MustCompile(`^/containers/([^/]+)/exec$`)
+	serviceUpdatePath = regexp.MustCompile(`^/services/[^/]+/update$`)
+)
+
+// apiPath returns the request path without the API version
+func apiPath(path string) string {
+	return versionPrefix.ReplaceAllString(path, "")
+}
+
+// hasBody reports whether checking a request needs its body
+func hasBody(method, path string) bool {
+	if method != "POST" {
+		return false
+	}
+	path = apiPath(path)
+	return path == "/containers/create" || path == "/volumes/create" || containerExecPath.MatchString(path) ||
+		path == "/services/create" || serviceUpdatePath.MatchString(path)
+}
+
+// execContainer returns the container that a request to create an exec is
+// for, if it is one
+func execContainer(method, path string) (string, bool) {
+	if method != "POST" {
+		return "", false
+	}
+	m := containerExecPath.FindStringSubmatch(apiPath(path))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// Check returns a PolicyError if the request isn't allowed. The body is only
+// needed for the requests that hasBody reports. It returns the body to pass on
+// to Docker, which can differ from the one it was given.
+func (p Policy) Check(method, path string, body []byte) ([]byte, error) {
+	path = apiPath(path)
+
+	switch {
+	case path == "/plugins" || strings.HasPrefix(path, "/plugins/"):
+		return nil, denied("managing Docker plugins isn't allowed")
+
+	case method != "POST":
+		return body, nil
+
+	case path == "/swarm" || strings.HasPrefix(path, "/swarm/"):
+		return nil, denied("managing the swarm isn't allowed")
+
+	case path == "/services/create" || serviceUpdatePath.MatchString(path):
+		return body, p.checkService(body)
+
+	case path == "/containers/create":
+		return p.checkContainerCreate(body)
+
+	case path == "/volumes/create":
+		return body, p.checkVolumeCreate(body)
+
+	case containerExecPath.MatchString(path):
+		var exec struct {
+			Privileged bool
+		}
+		if err := json.Unmarshal(body, &exec); err != nil {
+			return nil, denied("couldn't parse the exec: %v", err)
+		}
+		if exec.Privileged && !p.AllowPrivileged {
+			return nil, denied("privileged execs aren't allowed")
+		}
+	}
+
+	return body, nil
+}
+
+// containerCreate is the part of a container create request that's checked
+type containerCreate struct {
+	HostConfig struct {
+		Privileged        bool
+		CapAdd            []string
+		Devices           []json.RawMessage
+		DeviceCgroupRules []string
+		DeviceRequests    []json.RawMessage
+		SecurityOpt       []string
+		CgroupParent      string
+		VolumesFrom       []string
+		NetworkMode       string
+		UTSMode           string
+		CgroupnsMode      string
+		PidMode           string
+		IpcMode           string
+		UsernsMode        string
+		Binds             []string
+		Mounts            []struct {
+			Type          string
+			Source        string
+			VolumeOptions struct {
+				DriverConfig struct {
+					Options map[string]string
+				}
+			}
+		}
+	}
+}
+
+func (p Policy) checkContainerCreate(body []byte) ([]byte, error) {
+	var c containerCreate
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, denied("couldn't parse the container: %v", err)
+	}
+	hc := c.HostConfig
+
+	if !p.AllowPrivileged {
+		switch {
+		case hc.Privileged:
+			return nil, denied("privileged containers aren't allowed")
+		case len(hc.CapAdd) > 0:
+			return nil, denied("adding capabilities (%s) isn't allowed", strings.Join(hc.CapAdd, ", "))
+		case len(hc.Devices) > 0:
+			return nil, denied("adding devices isn't allowed")
+		case len(hc.DeviceCgroupRules) > 0:
+			return nil, denied("adding device cgroup rules isn't allowed")
+		case len(hc.DeviceRequests) > 0:
+			return nil, denied("requesting devices isn't allowed")
+		case len(hc.SecurityOpt) > 0:
+			return nil, denied("setting security options (%s) isn't allowed", strings.Join(hc.SecurityOpt, ", "))
+		case hc.CgroupParent != "":
+			return nil, denied("setting the cgroup parent isn't allowed")
+		case len(hc.VolumesFrom) > 0:
+			return nil, denied("mounting volumes from other containers isn't allowed")
+		}
+
+		for name, mode := range map[string]string{"network": hc.NetworkMode, "UTS": hc.UTSMode, "cgroup": hc.CgroupnsMode} {
+			if mode == "host" {
+				return nil, denied("sharing the host's %s namespace isn't allowed", name)
+			}
+		}
+	}
+
+	for name, mode := range map[string]string{"PID": hc.PidMode, "IPC": hc.IpcMode, "user": hc.UsernsMode} {
+		if mode == "host" {
+			return nil, denied("sharing the host's %s namespace isn't allowed", name)
+		}
+	}
+
+	rewrite := false
+	binds := make([]string, len(hc.Binds))
+	for i, bind := range hc.Binds {
+		// Binds are source:destination[:options], and sources that aren't
+		// absolute paths are named volumes
+		source, rest, _ := strings.Cut(bind, ":")
+		resolved, err := p.checkMount(source)
+		if err != nil {
+			return nil, err
+		}
+		binds[i] = bind
+		if resolved != source {
+			binds[i], rewrite = resolved+":"+rest, true
+		}
+	}
+
+	sources := make([]string, len(hc.Mounts))
+	for i, m := range hc.Mounts {
+		if m.Type == "bind" {
+			resolved, err := p.checkMount(m.Source)
+			if err != nil {
+				return nil, err
+			}
+			if resolved != m.Source {
+				sources[i], rewrite = resolved, true
+			}
+		}
+		if _, err := p.checkVolumeDevice(m.VolumeOptions.DriverConfig.Options); err != nil {
+			return nil, err
+		}
+	}
+
+	if !rewrite {
+		return body, nil
+	}
+	return rewriteBindSources(body, binds, sources)
+}
+
+// rewriteBindSources replaces the Binds in a container create request, and
+// the sources of its Mounts that aren't empty in sources
+func rewriteBindSources(body []byte, binds, sources []string) ([]byte, error) {
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, denied("couldn't parse the container: %v", err)
+	}
+	hostConfigKey, err := fieldKey(c, "HostConfig")
+	if err != nil {
+		return nil, err
+	}
+	var hc map[string]json.RawMessage
+	if err := json.Unmarshal(c[hostConfigKey], &hc); err != nil {
+		return nil, denied("couldn't parse the container: %v", err)
+	}
+
+	if len(binds) > 0 {
+		key, err := fieldKey(hc, "Binds")
+		if err != nil {
+			return nil, err
+		}
+		if hc[key], err = json.Marshal(binds); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sources) > 0 {
+		key, err := fieldKey(hc, "Mounts")
+		if err != nil {
+			return nil, err
+		}
+		var mounts []map[string]json.RawMessage
+		if err := json.Unmarshal(hc[key], &mounts); err != nil {
+			return nil, denied("couldn't parse the container's mounts: %v", err)
+		}
+		for i, source := range sources {
+			if source == "" {
+				continue
+			}
+			sourceKey, err := fieldKey(mounts[i], "Source")
+			if err != nil {
+				return nil, err
+			}
+			if mounts[i][sourceKey], err = json.Marshal(source); err != nil {
+				return nil, err
+			}
+		}
+		if hc[key], err = json.Marshal(mounts); err != nil {
+			return nil, err
+		}
+	}
+
+	if c[hostConfigKey], err = json.Marshal(hc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(c)
+}
+
+// fieldKey returns the key in m that Docker would decode as the field name.
+// Go's JSON decoder matches keys case-insensitively, so more than one key
+// could set the field, and the request is denied rather than guessing which.
+func fieldKey(m map[string]json.RawMessage, name string) (string, error) {
+	key := ""
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			if key != "" {
+				return "", denied("%s is set more than once", name)
+			}
+			key = k
+		}
+	}
+	if key == "" {
+		key = name
+	}
+	return key, nil
+}
+
+// serviceSpec is the part of a service create or update request that's
+// checked
+type serviceSpec struct {
+	TaskTemplate struct {
+		ContainerSpec struct {
+			Mounts []struct {
+				Type          string
+				Source        string
+				VolumeOptions struct {
+					DriverConfig struct {
+						Options map[string]string
+					}
+				}
+			}
+			Privileges struct {
+				SELinuxContext *json.RawMessage
+				Seccomp        *struct{ Mode string }
+				AppArmor       *struct{ Mode string }
+			}
+			CapabilityAdd []string
+		}
+		Networks []struct{ Target string }
+	}
+	Networks []struct{ Target string }
+}
+
+// checkService checks a service spec the same way as a container. Bind
+// sources aren't rewritten, as the service's tasks may run on other nodes,
+// where the paths resolve to something else.
+func (p Policy) checkService(body []byte) error {
+	var s serviceSpec
+	if err := json.Unmarshal(body, &s); err != nil {
+		return denied("couldn't parse the service: %v", err)
+	}
+	cs := s.TaskTemplate.ContainerSpec
+
+	if !p.AllowPrivileged {
+		switch {
+		case len(cs.CapabilityAdd) > 0:
+			return denied("adding capabilities (%s) isn't allowed", strings.Join(cs.CapabilityAdd, ", "))
+		case cs.Privileges.SELinuxContext != nil && string(*cs.Privileges.SELinuxContext) != "null":
+			return denied("setting the SELinux context isn't allowed")
+		case cs.Privileges.Seccomp != nil && !isDefaultMode(cs.Privileges.Seccomp.Mode):
+			return denied("changing the seccomp profile isn't allowed")
+		case cs.Privileges.AppArmor != nil && !isDefaultMode(cs.Privileges.AppArmor.Mode):
+			return denied("changing the AppArmor profile isn't allowed")
+		}
+
+		for _, n := range append(s.TaskTemplate.Networks, s.Networks...) {
+			if n.Target == "host" {
+				return denied("sharing the host's network namespace isn't allowed")
+			}
+		}
+	}
+
+	for _, m := range cs.Mounts {
+		if m.Type == "bind" {
+			if _, err := p.checkMount(m.Source); err != nil {
+				return err
+			}
+		}
+		if _, err := p.checkVolumeDevice(m.VolumeOptions.DriverConfig.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDefaultMode reports whether a seccomp or AppArmor mode is the default
+// profile, which is what's used when the mode is left empty
+func isDefaultMode(mode string) bool {
+	return mode == "" || mode == "default"
+}
+
+func (p Policy) checkVolumeCreate(body []byte) error {
+	var v struct {
+		DriverOpts map[string]string
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return denied("couldn't parse the volume: %v", err)
+	}
+	_, err := p.checkVolumeDevice(v.DriverOpts)
+	return err
+}
+
+// checkVolumeDevice checks the device of a local volume, which can be used to
+// bind mount a host path, e.g. docker volume create -o o=bind -o device=/
+func (p Policy) checkVolumeDevice(opts map[string]string) (string, error) {
+	if device := opts["device"]; device != "" {
+		return p.checkMount(device)
+	}
+	return "", nil
+}
+
+// checkMount checks a host path to be mounted into a container is within
+// one of the allowed mounts, and returns the path it resolved to. Sources
+// that aren't absolute paths are returned as they are.
+func (p Policy) checkMount(source string) (string, error) {
+	if !filepath.IsAbs(source) {
+		return source, nil
+	}
+
+	path := resolvePath(source)
+	for _, allowed := range p.AllowedMounts {
+		allowed = resolvePath(allowed)
+		if path == allowed || strings.HasPrefix(path, strings.TrimSuffix(allowed, string(filepath.Separator))+string(filepath.Separator)) {
+			return path, nil
+		}
+	}
+	return "", denied("mounting %s isn't allowed", source)
+}
+
+// resolvePath cleans the path, and resolves any symlinks in it, so they can't
+// be used to mount something outside of an allowed path
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+
+	// Docker creates bind mount sources that don't exist, so resolve as
+	// much of the path as does exist
+	dir := filepath.Dir(path)
+	if dir == path {
+		return path
+	}
+	return filepath.Join(resolvePath(dir), filepath.Base(path))
+}
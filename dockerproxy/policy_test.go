@@ -0,0 +1,127 @@
+package dockerproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "builds")
+	require.NoError(t, os.Mkdir(allowed, 0o755))
+	require.NoError(t, os.Symlink("/", filepath.Join(allowed, "escape")))
+
+	policy := Policy{AllowedMounts: []string{allowed}}
+
+	for _, test := range []struct {
+		name, method, path, body string
+		wantDenied               bool
+	}{
+		{name: "info", method: "GET", path: "/v1.41/info"},
+		{name: "build", method: "POST", path: "/v1.41/build?t=app"},
+		{name: "plain container", method: "POST", path: "/v1.41/containers/create", body: `{"Image":"alpine","HostConfig":{}}`},
+		{name: "privileged container", method: "POST", path: "/v1.41/containers/create", body: `{"HostConfig":{"Privileged":true}}`, wantDenied: true},
+		{name: "added capabilities", method: "POST", path: "/containers/create", body: `{"HostConfig":{"CapAdd":["SYS_ADMIN"]}}`, wantDenied: true},
+		{name: "devices", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Devices":[{"PathOnHost":"/dev/sda"}]}}`, wantDenied: true},
+		{name: "host pid", method: "POST", path: "/containers/create", body: `{"HostConfig":{"PidMode":"host"}}`, wantDenied: true},
+		{name: "host network", method: "POST", path: "/containers/create", body: `{"HostConfig":{"NetworkMode":"host"}}`, wantDenied: true},
+		{name: "host uts", method: "POST", path: "/containers/create", body: `{"HostConfig":{"UTSMode":"host"}}`, wantDenied: true},
+		{name: "host cgroup namespace", method: "POST", path: "/containers/create", body: `{"HostConfig":{"CgroupnsMode":"host"}}`, wantDenied: true},
+		{name: "bridge network", method: "POST", path: "/containers/create", body: `{"HostConfig":{"NetworkMode":"bridge"}}`},
+		{name: "security options", method: "POST", path: "/containers/create", body: `{"HostConfig":{"SecurityOpt":["apparmor=unconfined"]}}`, wantDenied: true},
+		{name: "device cgroup rules", method: "POST", path: "/containers/create", body: `{"HostConfig":{"DeviceCgroupRules":["b 8:* rmw"]}}`, wantDenied: true},
+		{name: "device requests", method: "POST", path: "/containers/create", body: `{"HostConfig":{"DeviceRequests":[{"Driver":"nvidia","Count":-1}]}}`, wantDenied: true},
+		{name: "cgroup parent", method: "POST", path: "/containers/create", body: `{"HostConfig":{"CgroupParent":"/"}}`, wantDenied: true},
+		{name: "volumes from", method: "POST", path: "/containers/create", body: `{"HostConfig":{"VolumesFrom":["other"]}}`, wantDenied: true},
+		{name: "ambiguous host config", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["` + allowed + `/../builds/checkout:/workdir"]},"hostconfig":{}}`, wantDenied: true},
+		{name: "allowed bind", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["` + allowed + `/checkout:/workdir:ro"]}}`},
+		{name: "named volume", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["cache:/cache"]}}`},
+		{name: "disallowed bind", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["/:/host"]}}`, wantDenied: true},
+		{name: "bind with dot dot", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["` + allowed + `/../../etc:/etc"]}}`, wantDenied: true},
+		{name: "bind through symlink", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Binds":["` + allowed + `/escape/etc:/etc"]}}`, wantDenied: true},
+		{name: "disallowed bind mount", method: "POST", path: "/containers/create", body: `{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/var/run/docker.sock","Target":"/var/run/docker.sock"}]}}`, wantDenied: true},
+		{name: "bind volume", method: "POST", path: "/volumes/create", body: `{"Name":"root","DriverOpts":{"type":"none","o":"bind","device":"/"}}`, wantDenied: true},
+		{name: "privileged exec", method: "POST", path: "/containers/abc123/exec", body: `{"Cmd":["sh"],"Privileged":true}`, wantDenied: true},
+		{name: "exec", method: "POST", path: "/containers/abc123/exec", body: `{"Cmd":["sh"]}`},
+		{name: "plugins", method: "POST", path: "/v1.41/plugins/pull", wantDenied: true},
+		{name: "swarm init", method: "POST", path: "/v1.41/swarm/init", body: `{"ListenAddr":"0.0.0.0:2377"}`, wantDenied: true},
+		{name: "swarm join", method: "POST", path: "/swarm/join", wantDenied: true},
+		{name: "swarm inspect", method: "GET", path: "/swarm"},
+		{name: "plain service", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Image":"alpine"}}}`},
+		{name: "service with disallowed bind", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Mounts":[{"Type":"bind","Source":"/","Target":"/host"}]}}}`, wantDenied: true},
+		{name: "service with allowed bind", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Mounts":[{"Type":"bind","Source":"` + allowed + `/checkout","Target":"/src"}]}}}`},
+		{name: "service with added capabilities", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"CapabilityAdd":["CAP_SYS_ADMIN"]}}}`, wantDenied: true},
+		{name: "service without seccomp", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Privileges":{"Seccomp":{"Mode":"unconfined"}}}}}`, wantDenied: true},
+		{name: "service without apparmor", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Privileges":{"AppArmor":{"Mode":"disabled"}}}}}`, wantDenied: true},
+		{name: "service with default profiles", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"ContainerSpec":{"Privileges":{"Seccomp":{"Mode":"default"},"AppArmor":{"Mode":"default"}}}}}`},
+		{name: "service on host network", method: "POST", path: "/services/create", body: `{"TaskTemplate":{"Networks":[{"Target":"host"}]}}`, wantDenied: true},
+		{name: "service update with bind volume", method: "POST", path: "/v1.41/services/abc123/update", body: `{"TaskTemplate":{"ContainerSpec":{"Mounts":[{"Type":"volume","Source":"root","VolumeOptions":{"DriverConfig":{"Options":{"o":"bind","device":"/"}}}}]}}}`, wantDenied: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := policy.Check(test.method, test.path, []byte(test.body))
+			if !test.wantDenied {
+				assert.NoError(t, err)
+				return
+			}
+			var policyErr *PolicyError
+			assert.True(t, errors.As(err, &policyErr), "expected a PolicyError, got %v", err)
+		})
+	}
+}
+
+func TestPolicyAllowPrivileged(t *testing.T) {
+	policy := Policy{AllowPrivileged: true}
+
+	_, err := policy.Check("POST", "/containers/create", []byte(`{"HostConfig":{"Privileged":true,"CapAdd":["NET_ADMIN"],"NetworkMode":"host"}}`))
+	assert.NoError(t, err)
+	_, err = policy.Check("POST", "/containers/create", []byte(`{"HostConfig":{"Binds":["/:/host"]}}`))
+	assert.Error(t, err)
+}
+
+func TestPolicyRewritesBindSources(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	allowed := filepath.Join(dir, "builds")
+	require.NoError(t, os.MkdirAll(filepath.Join(allowed, "checkout"), 0o755))
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(filepath.Join(allowed, "checkout"), link))
+
+	policy := Policy{AllowedMounts: []string{allowed}}
+
+	body, err := policy.Check("POST", "/containers/create", []byte(`{"Image":"alpine","HostConfig":{"Memory":4294967296,`+
+		`"Binds":["`+link+`:/workdir:ro","cache:/cache"],`+
+		`"Mounts":[{"Type":"bind","Source":"`+link+`","Target":"/src"}]}}`))
+	require.NoError(t, err)
+
+	var c struct {
+		Image      string
+		HostConfig struct {
+			Memory int64
+			Binds  []string
+			Mounts []struct{ Type, Source, Target string }
+		}
+	}
+	require.NoError(t, json.Unmarshal(body, &c))
+
+	// The symlink is replaced by where it pointed when it was checked, and
+	// everything else is left alone
+	checkout := filepath.Join(allowed, "checkout")
+	assert.Equal(t, "alpine", c.Image)
+	assert.Equal(t, int64(4294967296), c.HostConfig.Memory)
+	assert.Equal(t, []string{checkout + ":/workdir:ro", "cache:/cache"}, c.HostConfig.Binds)
+	require.Len(t, c.HostConfig.Mounts, 1)
+	assert.Equal(t, checkout, c.HostConfig.Mounts[0].Source)
+	assert.Equal(t, "/src", c.HostConfig.Mounts[0].Target)
+
+	// Requests that don't need rewriting are passed on as they are
+	unchanged := []byte(`{"HostConfig":{"Binds":["` + checkout + `:/workdir"]}}`)
+	body, err = policy.Check("POST", "/containers/create", unchanged)
+	require.NoError(t, err)
+	assert.Equal(t, unchanged, body)
+}
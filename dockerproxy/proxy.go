@@ -0,0 +1,216 @@
+package dockerproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// maxBodySize is the largest request body that's checked. Container and
+// volume definitions are much smaller than this.
+const maxBodySize = 4 << 20
+
+// Proxy passes Docker API requests that its policy allows on to the Docker
+// daemon listening on the Upstream socket. It keeps track of the containers
+// created through it, and only allows execs in those.
+type Proxy struct {
+	Upstream string
+	Policy   Policy
+
+	logger logger.Logger
+	proxy  *httputil.ReverseProxy
+
+	// containers are the IDs of the containers created through the proxy, by
+	// their ID and by the name they were given
+	mu         sync.Mutex
+	containers map[string]string
+}
+
+// New returns a proxy to the Docker daemon listening on the upstream socket
+func New(l logger.Logger, upstream string, policy Policy) *Proxy {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", upstream)
+		},
+	}
+
+	p := &Proxy{
+		Upstream:   upstream,
+		Policy:     policy,
+		logger:     l,
+		containers: make(map[string]string),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "docker"
+		},
+		Transport:      transport,
+		ModifyResponse: p.recordContainer,
+
+		// Stream logs and attached output as they arrive
+		FlushInterval: -1,
+	}
+	return p
+}
+
+// recordContainer remembers the container that a successful create request
+// made, so execs in it are allowed
+func (p *Proxy) recordContainer(resp *http.Response) error {
+	r := resp.Request
+	if r.Method != "POST" || apiPath(r.URL.Path) != "/containers/create" || resp.StatusCode/100 != 2 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var created struct{ Id string }
+	if err := json.Unmarshal(body, &created); err != nil || created.Id == "" {
+		p.logger.Warn("Couldn't find the ID of a container created through the Docker proxy, so execs in it won't be allowed")
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.containers[created.Id] = created.Id
+	if name := strings.TrimPrefix(r.URL.Query().Get("name"), "/"); name != "" {
+		p.containers[name] = created.Id
+	}
+	return nil
+}
+
+// ownContainer returns the ID of the container created through the proxy
+// that ref refers to, either by its name, its ID, or a unique prefix of its
+// ID. Docker looks up names before ID prefixes, so requests are passed on
+// with the full ID, which can't refer to another container.
+func (p *Proxy) ownContainer(ref string) (string, bool) {
+	ref = strings.TrimPrefix(ref, "/")
+	if ref == "" {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, ok := p.containers[ref]; ok {
+		return id, true
+	}
+
+	found := ""
+	for _, id := range p.containers {
+		if strings.HasPrefix(id, ref) && id != found {
+			if found != "" {
+				return "", false
+			}
+			found = id
+		}
+	}
+	return found, found != ""
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if hasBody(r.Method, r.URL.Path) {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("reading request: %v", err))
+			return
+		}
+		if len(body) > maxBodySize {
+			writeError(w, http.StatusRequestEntityTooLarge, "request is too large to check")
+			return
+		}
+	}
+
+	body, err := p.Policy.Check(r.Method, r.URL.Path, body)
+	if ref, ok := execContainer(r.Method, r.URL.Path); ok && err == nil {
+		id, owned := p.ownContainer(ref)
+		if !owned {
+			err = denied("exec in container %s isn't allowed, as it wasn't created through the proxy", ref)
+		} else {
+			r.URL.Path = versionPrefix.FindString(r.URL.Path) + "/containers/" + id + "/exec"
+			r.URL.RawPath = ""
+		}
+	}
+	if err != nil {
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			p.logger.Warn("Denied Docker request %s %s: %s", r.Method, r.URL.Path, policyErr.Reason)
+			writeError(w, http.StatusForbidden, "buildkite-agent docker proxy: "+policyErr.Reason)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Pass on the body the policy checked, which may have been rewritten
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// writeError responds with an error the way the Docker API does, so the
+// Docker CLI shows the message
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{message})
+}
+
+// ListenAndServe listens on the socket, replacing any left behind by a
+// previous agent, and serves the proxy until the context is done
+func (p *Proxy) ListenAndServe(ctx context.Context, socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing old socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("listening on socket: %w", err)
+	}
+
+	// Leave the socket where it is when the proxy stops, as an agent that's
+	// taken over from this one may be listening on it by then
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	srv := &http.Server{Handler: p}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// DockerHost is the DOCKER_HOST for a socket
+func DockerHost(socketPath string) string {
+	return (&url.URL{Scheme: "unix", Path: socketPath}).String()
+}
@@ -0,0 +1,92 @@
+package dockerproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	// Socket paths can't be very long, so don't use t.TempDir
+	dir, err := os.MkdirTemp("", "dockerproxy")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	upstream := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", upstream)
+	require.NoError(t, err)
+
+	var received []string
+	daemon := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Method+" "+r.URL.Path+" "+string(body))
+		_, _ = io.WriteString(w, `{"Id":"abc123"}`)
+	})}
+	go func() { _ = daemon.Serve(ln) }()
+	t.Cleanup(func() { daemon.Close() })
+
+	proxy := httptest.NewServer(New(logger.Discard, upstream, Policy{}))
+	t.Cleanup(proxy.Close)
+
+	create := `{"Image":"alpine","HostConfig":{}}`
+	resp, err := http.Post(proxy.URL+"/v1.41/containers/create", "application/json", strings.NewReader(create))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(proxy.URL+"/v1.41/containers/create", "application/json", strings.NewReader(`{"HostConfig":{"Privileged":true}}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	var denial struct{ Message string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&denial))
+	assert.Equal(t, "buildkite-agent docker proxy: privileged containers aren't allowed", denial.Message)
+
+	// Only the allowed request made it to the daemon, with its body intact
+	assert.Equal(t, []string{"POST /v1.41/containers/create " + create}, received)
+	received = nil
+
+	// Execs are only allowed in containers created through the proxy, and
+	// are passed on with the container's full ID
+	resp, err = http.Post(proxy.URL+"/v1.41/containers/abc/exec", "application/json", strings.NewReader(`{"Cmd":["sh"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(proxy.URL+"/v1.41/containers/def456/exec", "application/json", strings.NewReader(`{"Cmd":["sh"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	assert.Equal(t, []string{`POST /v1.41/containers/abc123/exec {"Cmd":["sh"]}`}, received)
+}
+
+func TestProxyExecByName(t *testing.T) {
+	p := New(logger.Discard, "", Policy{})
+
+	req := httptest.NewRequest("POST", "/v1.41/containers/create?name=app", nil)
+	resp := &http.Response{StatusCode: http.StatusCreated, Request: req, Body: io.NopCloser(strings.NewReader(`{"Id":"abc123"}`))}
+	require.NoError(t, p.recordContainer(resp))
+
+	id, ok := p.ownContainer("/app")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", id)
+
+	_, ok = p.ownContainer("other")
+	assert.False(t, ok)
+}
+
+func TestDockerHost(t *testing.T) {
+	assert.Equal(t, "unix:///var/lib/buildkite-agent/docker.sock", DockerHost("/var/lib/buildkite-agent/docker.sock"))
+}
@@ -4,6 +4,14 @@
 // It is intended for internal use by buildkite-agent only.
 package experiments
 
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 const (
 	JobAPI                     = "job-api"
 	KubernetesExec             = "kubernetes-exec"
@@ -14,6 +22,11 @@ const (
 	DescendingSpawnPrioity     = "descending-spawn-priority"
 	InbuiltStatusPage          = "inbuilt-status-page"
 	CancelCheckout             = "cancel-checkout"
+	InProcessArtifactUpload    = "inprocess-artifact-upload"
+	ContainerSteps             = "container-steps"
+	StreamingLogs              = "streaming-logs"
+	JobEvents                  = "job-events"
+	ArtifactPeers              = "artifact-peers"
 )
 
 var (
@@ -27,11 +40,50 @@ var (
 		DescendingSpawnPrioity:     {},
 		InbuiltStatusPage:          {},
 		CancelCheckout:             {},
+		InProcessArtifactUpload:    {},
+		ContainerSteps:             {},
+		StreamingLogs:              {},
+		JobEvents:                  {},
+		ArtifactPeers:              {},
 	}
 
 	experiments = make(map[string]bool, len(Available))
+
+	// The percentage of builds that experiments being rolled out are
+	// enabled for
+	rollouts = make(map[string]int)
 )
 
+// Parse parses an experiment as it's given to --experiment, which is its
+// name, optionally followed by = and the percentage of builds to enable it
+// for, such as "streaming-logs=25%". Without a percentage, it's enabled for
+// every build.
+func Parse(experiment string) (key string, percent int, err error) {
+	key, pct, ok := strings.Cut(experiment, "=")
+	key = strings.TrimSpace(key)
+	if !ok {
+		return key, 100, nil
+	}
+
+	percent, err = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(pct), "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return "", 0, fmt.Errorf("invalid rollout percentage for experiment %q, expected a percentage from 0 to 100 like %s=25%%", key, key)
+	}
+	return key, percent, nil
+}
+
+// EnableRollout enables a particular experiment for a percentage of builds.
+// Which builds is decided by their ID, so every job in a build agrees, and
+// a build that has it at one percentage still has it at a higher one.
+func EnableRollout(key string, percent int) (known bool) {
+	if percent >= 100 {
+		return Enable(key)
+	}
+	rollouts[key] = percent
+	_, known = Available[key]
+	return known
+}
+
 // Enable a particular experiment in the agent.
 func Enable(key string) (known bool) {
 	experiments[key] = true
@@ -42,6 +94,7 @@ func Enable(key string) (known bool) {
 // Disable a particular experiment in the agent.
 func Disable(key string) {
 	delete(experiments, key)
+	delete(rollouts, key)
 }
 
 // IsEnabled reports whether the named experiment is enabled.
@@ -49,6 +102,38 @@ func IsEnabled(key string) bool {
 	return experiments[key] // map[T]bool returns false for missing keys
 }
 
+// Rollouts returns the experiments being rolled out to a percentage of
+// builds, and the percentage of builds for each.
+func Rollouts() map[string]int {
+	r := make(map[string]int, len(rollouts))
+	for key, percent := range rollouts {
+		r[key] = percent
+	}
+	return r
+}
+
+// EnabledFor returns the keys of the experiments enabled for a build, which
+// are those enabled for every build and those rolled out to it.
+func EnabledFor(buildID string) []string {
+	keys := Enabled()
+	for key, percent := range rollouts {
+		if !experiments[key] && rolloutBucket(key, buildID) < percent {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rolloutBucket deterministically places a build in one of 100 buckets for
+// an experiment. The experiment is part of the hash so that each one is
+// rolled out to different builds.
+func rolloutBucket(key, buildID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key + "/" + buildID))
+	return int(h.Sum32() % 100)
+}
+
 // Enabled returns the keys of all the enabled experiments.
 func Enabled() []string {
 	var keys []string
@@ -0,0 +1,56 @@
+package experiments
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		experiment string
+		key        string
+		percent    int
+		wantErr    bool
+	}{
+		{experiment: "git-mirrors", key: "git-mirrors", percent: 100},
+		{experiment: "streaming-logs=25%", key: "streaming-logs", percent: 25},
+		{experiment: "streaming-logs = 0", key: "streaming-logs", percent: 0},
+		{experiment: "streaming-logs=101%", wantErr: true},
+		{experiment: "streaming-logs=lots", wantErr: true},
+	} {
+		key, percent, err := Parse(tc.experiment)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Parse(%q) error = %v, want error %t", tc.experiment, err, tc.wantErr)
+			continue
+		}
+		if key != tc.key || percent != tc.percent {
+			t.Errorf("Parse(%q) = (%q, %d), want (%q, %d)", tc.experiment, key, percent, tc.key, tc.percent)
+		}
+	}
+}
+
+func TestEnabledForRollout(t *testing.T) {
+	EnableRollout(StreamingLogs, 30)
+	defer Disable(StreamingLogs)
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		buildID := fmt.Sprintf("build-%d", i)
+		got := EnabledFor(buildID)
+
+		// Every job in a build agrees
+		if again := EnabledFor(buildID); len(again) != len(got) {
+			t.Fatalf("EnabledFor(%q) = %q, then %q", buildID, got, again)
+		}
+		if len(got) == 1 && got[0] == StreamingLogs {
+			enabled++
+		}
+	}
+
+	if enabled < 250 || enabled > 350 {
+		t.Errorf("%s was enabled for %d of 1000 builds, want about 300", StreamingLogs, enabled)
+	}
+	if IsEnabled(StreamingLogs) {
+		t.Errorf("IsEnabled(%q) = true, want false for an experiment being rolled out", StreamingLogs)
+	}
+}
@@ -9,11 +9,19 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"time"
 )
 
-const envURL = "http://job/api/current-job/v0/env"
+const (
+	envURL          = "http://job/api/current-job/v0/env"
+	redactionsURL   = "http://job/api/current-job/v0/redactions"
+	cancellationURL = "http://job/api/current-job/v0/cancellation"
+	phasesURL       = "http://job/api/current-job/v0/phases"
+	artifactsURL    = "http://job/api/current-job/v0/artifacts"
+)
 
 // Client connects to the Job API.
 type Client struct {
@@ -155,3 +163,52 @@ func (c *Client) EnvDelete(ctx context.Context, del []string) (deleted []string,
 	resp.Normalize()
 	return resp.Deleted, nil
 }
+
+// RedactionCreate adds values to be redacted from the job log.
+func (c *Client) RedactionCreate(ctx context.Context, values []string) (added int, err error) {
+	req := RedactionCreateRequest{
+		Values: values,
+	}
+	var resp RedactionCreateResponse
+	if err := c.do(ctx, "POST", redactionsURL, &req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Added, nil
+}
+
+// Cancelled reports whether the job has been cancelled. If wait is positive,
+// it waits up to that long for the job to be cancelled.
+func (c *Client) Cancelled(ctx context.Context, wait time.Duration) (bool, error) {
+	u := cancellationURL
+	if wait > 0 {
+		u += "?wait=" + url.QueryEscape(wait.String())
+	}
+
+	var resp CancellationGetResponse
+	if err := c.do(ctx, "GET", u, nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Cancelled, nil
+}
+
+// Phases returns when each phase of the job that has started so far started,
+// and how long it took.
+func (c *Client) Phases(ctx context.Context) ([]PhaseTiming, error) {
+	var resp PhasesGetResponse
+	if err := c.do(ctx, "GET", phasesURL, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Phases, nil
+}
+
+// ArtifactsCreate uploads the files matching paths, which can be globs, as
+// artifacts of the job. They go to destination, or where the job's artifacts
+// go if it's empty.
+func (c *Client) ArtifactsCreate(ctx context.Context, paths []string, destination string) error {
+	req := ArtifactsCreateRequest{
+		Paths:       paths,
+		Destination: destination,
+	}
+	var resp ArtifactsCreateResponse
+	return c.do(ctx, "POST", artifactsURL, &req, &resp)
+}
@@ -1,6 +1,9 @@
 package jobapi
 
-import "sort"
+import (
+	"sort"
+	"time"
+)
 
 // Error response is the response body for any errors that occur
 type ErrorResponse struct {
@@ -41,3 +44,43 @@ type EnvDeleteResponse struct {
 func (e EnvDeleteResponse) Normalize() {
 	sort.Strings(e.Deleted)
 }
+
+// RedactionCreateRequest is the request body for the POST /redactions endpoint
+type RedactionCreateRequest struct {
+	Values []string `json:"values"`
+}
+
+// RedactionCreateResponse is the response body for the POST /redactions endpoint
+type RedactionCreateResponse struct {
+	Added int `json:"added"`
+}
+
+// CancellationGetResponse is the response body for the GET /cancellation endpoint
+type CancellationGetResponse struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+// PhaseTiming is when a phase of the job started and finished, and how long it
+// took, or has taken so far if it's still running
+type PhaseTiming struct {
+	Name            string     `json:"name"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+}
+
+// PhasesGetResponse is the response body for the GET /phases endpoint
+type PhasesGetResponse struct {
+	Phases []PhaseTiming `json:"phases"`
+}
+
+// ArtifactsCreateRequest is the request body for the POST /artifacts endpoint
+type ArtifactsCreateRequest struct {
+	Paths       []string `json:"paths"`
+	Destination string   `json:"destination,omitempty"`
+}
+
+// ArtifactsCreateResponse is the response body for the POST /artifacts endpoint
+type ArtifactsCreateResponse struct {
+	Paths []string `json:"paths"`
+}
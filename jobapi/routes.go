@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/redaction"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"golang.org/x/exp/maps"
@@ -25,6 +28,10 @@ func (s *Server) router() chi.Router {
 		r.Get("/env", s.getEnv)
 		r.Patch("/env", s.patchEnv)
 		r.Delete("/env", s.deleteEnv)
+		r.Post("/redactions", s.createRedactions)
+		r.Get("/cancellation", s.getCancellation)
+		r.Get("/phases", s.getPhases)
+		r.Post("/artifacts", s.createArtifacts)
 	})
 
 	return r
@@ -138,6 +145,132 @@ func (s *Server) deleteEnv(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *Server) createRedactions(w http.ResponseWriter, r *http.Request) {
+	if s.AddRedactions == nil {
+		writeError(w, "redactions can't be added to this job's log", http.StatusNotImplemented)
+		return
+	}
+
+	var req RedactionCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	// Short values would redact too much of the log to be useful
+	short := 0
+	for _, v := range req.Values {
+		if len(v) < redaction.RedactLengthMin {
+			short++
+		}
+	}
+	if short > 0 {
+		writeError(
+			w,
+			fmt.Sprintf("%d of the values are shorter than the minimum of %d bytes, and can't be redacted", short, redaction.RedactLengthMin),
+			http.StatusUnprocessableEntity,
+		)
+		return
+	}
+
+	s.AddRedactions(req.Values)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RedactionCreateResponse{Added: len(req.Values)})
+}
+
+// getCancellation reports whether the job has been cancelled. With a wait
+// query parameter, e.g. ?wait=30s, it waits up to that long for the job to be
+// cancelled before responding.
+func (s *Server) getCancellation(w http.ResponseWriter, r *http.Request) {
+	if s.Cancelled == nil {
+		writeError(w, "cancellation isn't available for this job", http.StatusNotImplemented)
+		return
+	}
+
+	var wait time.Duration
+	if q := r.URL.Query().Get("wait"); q != "" {
+		var err error
+		wait, err = time.ParseDuration(q)
+		if err != nil || wait < 0 {
+			writeError(w, fmt.Sprintf("wait must be a positive duration, e.g. 30s, not %q", q), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cancelled := false
+	select {
+	case <-s.Cancelled:
+		cancelled = true
+	default:
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			defer t.Stop()
+
+			select {
+			case <-s.Cancelled:
+				cancelled = true
+			case <-t.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CancellationGetResponse{Cancelled: cancelled})
+}
+
+// getPhases reports when each phase of the job that has started so far
+// started, and how long it took
+func (s *Server) getPhases(w http.ResponseWriter, _ *http.Request) {
+	if s.PhaseTimings == nil {
+		writeError(w, "phase timings aren't available for this job", http.StatusNotImplemented)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PhasesGetResponse{Phases: s.PhaseTimings()})
+}
+
+// createArtifacts uploads files as artifacts of the job, with the agent's
+// credentials and storage backends
+func (s *Server) createArtifacts(w http.ResponseWriter, r *http.Request) {
+	if s.UploadArtifacts == nil {
+		writeError(w, "artifacts can't be uploaded from this job", http.StatusNotImplemented)
+		return
+	}
+
+	var req ArtifactsCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Paths) == 0 {
+		writeError(w, "no paths were given to upload", http.StatusUnprocessableEntity)
+		return
+	}
+	for _, path := range req.Paths {
+		if path == "" || strings.Contains(path, agent.ArtifactPathDelimiter) {
+			writeError(w, fmt.Sprintf("%q isn't a path that can be uploaded", path), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if err := s.UploadArtifacts(r.Context(), req.Paths, req.Destination); err != nil {
+		writeError(w, fmt.Errorf("uploading artifacts: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ArtifactsCreateResponse{Paths: req.Paths})
+}
+
 func checkProtected(candidates []string) []string {
 	protected := make([]string, 0, len(candidates))
 	for _, c := range candidates {
@@ -25,6 +25,24 @@ type Server struct {
 	SocketPath string
 	Logger     shell.Logger
 
+	// AddRedactions, if set, is called with values that should be redacted
+	// from the job log from now on. Without it, the redactions endpoint
+	// isn't available.
+	AddRedactions func(values []string)
+
+	// Cancelled, if set, is closed when the job is cancelled. Without it,
+	// the cancellation endpoint isn't available.
+	Cancelled <-chan struct{}
+
+	// PhaseTimings, if set, returns the phases of the job that have started
+	// so far, in order. Without it, the phases endpoint isn't available.
+	PhaseTimings func() []PhaseTiming
+
+	// UploadArtifacts, if set, uploads the files matching paths as artifacts
+	// of the job, to destination, or where the job's artifacts go if it's
+	// empty. Without it, the artifacts endpoint isn't available.
+	UploadArtifacts func(ctx context.Context, paths []string, destination string) error
+
 	environ *env.Environment
 	token   string
 	httpSvr *http.Server
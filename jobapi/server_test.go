@@ -395,3 +395,263 @@ func testAPI[Req, Resp any](t *testing.T, env *env.Environment, req *http.Reques
 		}
 	}
 }
+
+func TestCreateRedactions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		apiTestCase[jobapi.RedactionCreateRequest, jobapi.RedactionCreateResponse]
+		addRedactions bool
+		wantRedacted  []string
+	}{
+		{
+			apiTestCase: apiTestCase[jobapi.RedactionCreateRequest, jobapi.RedactionCreateResponse]{
+				name:                 "happy case",
+				requestBody:          &jobapi.RedactionCreateRequest{Values: []string{"hunter2hunter2", "correct horse"}},
+				expectedStatus:       http.StatusOK,
+				expectedResponseBody: &jobapi.RedactionCreateResponse{Added: 2},
+			},
+			addRedactions: true,
+			wantRedacted:  []string{"hunter2hunter2", "correct horse"},
+		},
+		{
+			apiTestCase: apiTestCase[jobapi.RedactionCreateRequest, jobapi.RedactionCreateResponse]{
+				name:           "short values returns a 422",
+				requestBody:    &jobapi.RedactionCreateRequest{Values: []string{"hunter2hunter2", "pw"}},
+				expectedStatus: http.StatusUnprocessableEntity,
+				expectedError: &jobapi.ErrorResponse{
+					Error: "1 of the values are shorter than the minimum of 6 bytes, and can't be redacted",
+				},
+			},
+			addRedactions: true,
+		},
+		{
+			apiTestCase: apiTestCase[jobapi.RedactionCreateRequest, jobapi.RedactionCreateResponse]{
+				name:           "without a redactor returns a 501",
+				requestBody:    &jobapi.RedactionCreateRequest{Values: []string{"hunter2hunter2"}},
+				expectedStatus: http.StatusNotImplemented,
+				expectedError: &jobapi.ErrorResponse{
+					Error: "redactions can't be added to this job's log",
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			environ := testEnviron()
+			srv, token, err := testServer(t, environ)
+			if err != nil {
+				t.Fatalf("creating server: %v", err)
+			}
+
+			var redacted []string
+			if c.addRedactions {
+				srv.AddRedactions = func(values []string) {
+					redacted = append(redacted, values...)
+				}
+			}
+
+			err = srv.Start()
+			if err != nil {
+				t.Fatalf("starting server: %v", err)
+			}
+
+			client := testSocketClient(srv.SocketPath)
+
+			defer func() {
+				err := srv.Stop()
+				if err != nil {
+					t.Fatalf("stopping server: %v", err)
+				}
+			}()
+
+			buf := bytes.NewBuffer(nil)
+			err = json.NewEncoder(buf).Encode(c.requestBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "http://bootstrap/api/current-job/v0/redactions", buf)
+			if err != nil {
+				t.Fatalf("creating request: %v", err)
+			}
+
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+			testAPI(t, environ, req, client, c.apiTestCase)
+
+			if diff := cmp.Diff(c.wantRedacted, redacted); diff != "" {
+				t.Errorf("redacted values diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetCancellation(t *testing.T) {
+	t.Parallel()
+
+	srv, token, err := testServer(t, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	cancelled := make(chan struct{})
+	srv.Cancelled = cancelled
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer func() {
+		if err := srv.Stop(); err != nil {
+			t.Fatalf("stopping server: %v", err)
+		}
+	}()
+
+	client := testSocketClient(srv.SocketPath)
+
+	get := func(query string) jobapi.CancellationGetResponse {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, "http://bootstrap/api/current-job/v0/cancellation"+query, nil)
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do(req) error = %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d (got %d)", http.StatusOK, resp.StatusCode)
+		}
+
+		var got jobapi.CancellationGetResponse
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return got
+	}
+
+	if got := get(""); got.Cancelled {
+		t.Errorf("before cancellation, got cancelled = true")
+	}
+	if got := get("?wait=10ms"); got.Cancelled {
+		t.Errorf("waiting before cancellation, got cancelled = true")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancelled)
+	}()
+
+	if got := get("?wait=10s"); !got.Cancelled {
+		t.Errorf("waiting for cancellation, got cancelled = false")
+	}
+	if got := get(""); !got.Cancelled {
+		t.Errorf("after cancellation, got cancelled = false")
+	}
+}
+
+func TestGetPhases(t *testing.T) {
+	t.Parallel()
+
+	srv, token, err := testServer(t, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	started := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+	want := []jobapi.PhaseTiming{
+		{Name: "checkout", StartedAt: started, FinishedAt: &finished, DurationSeconds: 90},
+		{Name: "command", StartedAt: finished, DurationSeconds: 3.5},
+	}
+	srv.PhaseTimings = func() []jobapi.PhaseTiming { return want }
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer func() {
+		if err := srv.Stop(); err != nil {
+			t.Fatalf("stopping server: %v", err)
+		}
+	}()
+
+	client, err := jobapi.NewClient(srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient() error = %v", err)
+	}
+	got, err := client.Phases(context.Background())
+	if err != nil {
+		t.Fatalf("client.Phases() error = %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("client.Phases() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCreateArtifacts(t *testing.T) {
+	t.Parallel()
+
+	srv, token, err := testServer(t, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+
+	var gotPaths []string
+	var gotDestination string
+	srv.UploadArtifacts = func(_ context.Context, paths []string, destination string) error {
+		gotPaths, gotDestination = paths, destination
+		if destination == "s3://broken" {
+			return errors.New("bucket is broken")
+		}
+		return nil
+	}
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer func() {
+		if err := srv.Stop(); err != nil {
+			t.Fatalf("stopping server: %v", err)
+		}
+	}()
+
+	client, err := jobapi.NewClient(srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient() error = %v", err)
+	}
+	ctx := context.Background()
+
+	paths := []string{"target/*.jar", "reports/junit.xml"}
+	if err := client.ArtifactsCreate(ctx, paths, "s3://my-bucket/jars"); err != nil {
+		t.Fatalf("client.ArtifactsCreate() error = %v", err)
+	}
+	if diff := cmp.Diff(paths, gotPaths); diff != "" {
+		t.Errorf("uploaded paths diff (-want +got):\n%s", diff)
+	}
+	if gotDestination != "s3://my-bucket/jars" {
+		t.Errorf("uploaded destination = %q, want %q", gotDestination, "s3://my-bucket/jars")
+	}
+
+	for _, tc := range []struct {
+		name        string
+		paths       []string
+		destination string
+	}{
+		{name: "no paths"},
+		{name: "delimiter in path", paths: []string{"a.txt;b.txt"}},
+		{name: "upload fails", paths: []string{"a.txt"}, destination: "s3://broken"},
+	} {
+		if err := client.ArtifactsCreate(ctx, tc.paths, tc.destination); err == nil {
+			t.Errorf("%s: client.ArtifactsCreate() error = nil, want an error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package jobcontext resolves the build and job a tool is running in, and how
+// to reach the Agent API from it, from the environment the agent gives each
+// job. It's for tools that run in jobs, such as plugins and helper binaries,
+// so they check the environment the same way the agent's own commands do,
+// rather than each reading BUILDKITE_JOB_ID and friends themselves.
+package jobcontext
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/version"
+)
+
+// DefaultEndpoint is the Agent API endpoint used when the job's environment
+// doesn't have one
+const DefaultEndpoint = "https://agent.buildkite.com/v3"
+
+// The environment variables the agent sets for each job that Resolve reads
+const (
+	JobIDEnv        = "BUILDKITE_JOB_ID"
+	BuildIDEnv      = "BUILDKITE_BUILD_ID"
+	EndpointEnv     = "BUILDKITE_AGENT_ENDPOINT"
+	AccessTokenEnv  = "BUILDKITE_AGENT_ACCESS_TOKEN"
+	JobAPISocketEnv = "BUILDKITE_AGENT_JOB_API_SOCKET"
+	JobAPITokenEnv  = "BUILDKITE_AGENT_JOB_API_TOKEN"
+)
+
+var (
+	// ErrNotInJob is returned by Resolve when the environment isn't a
+	// Buildkite job's at all
+	ErrNotInJob = errors.New("not running in a Buildkite job")
+
+	// ErrMissing is wrapped by the VarError Resolve returns for a variable
+	// that must be set, but isn't
+	ErrMissing = errors.New("empty or undefined")
+
+	// ErrInvalid is wrapped by the VarError Resolve returns for a variable
+	// that's set to something that can't be right
+	ErrInvalid = errors.New("invalid")
+)
+
+// VarError is returned by Resolve for an environment variable that's missing
+// or invalid
+type VarError struct {
+	Name string
+	Err  error
+}
+
+func (e *VarError) Error() string {
+	return fmt.Sprintf("%s %s", e.Name, e.Err)
+}
+
+func (e *VarError) Unwrap() error {
+	return e.Err
+}
+
+// Context is the build and job a tool is running in
+type Context struct {
+	JobID   string
+	BuildID string
+
+	// The Agent API endpoint, and the job's token for it
+	Endpoint    string
+	AccessToken string
+
+	// The socket and token of the Job API, if it's enabled
+	JobAPISocket string
+	JobAPIToken  string
+}
+
+// FromEnvironment resolves the context from the process's environment
+func FromEnvironment() (*Context, error) {
+	return Resolve(os.LookupEnv)
+}
+
+// Resolve resolves the context from an environment, looking variables up with
+// lookup, such as os.LookupEnv. It returns ErrNotInJob if the environment
+// isn't a job's, and a *VarError if a variable the agent sets for every job
+// is missing or invalid.
+func Resolve(lookup func(string) (string, bool)) (*Context, error) {
+	get := func(name string) string {
+		v, _ := lookup(name)
+		return strings.TrimSpace(v)
+	}
+
+	if v, _ := lookup("BUILDKITE"); v != "true" && get(JobIDEnv) == "" {
+		return nil, ErrNotInJob
+	}
+
+	c := &Context{
+		JobID:        get(JobIDEnv),
+		BuildID:      get(BuildIDEnv),
+		Endpoint:     get(EndpointEnv),
+		AccessToken:  get(AccessTokenEnv),
+		JobAPISocket: get(JobAPISocketEnv),
+		JobAPIToken:  get(JobAPITokenEnv),
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = DefaultEndpoint
+	}
+
+	for _, required := range []struct{ name, value string }{
+		{JobIDEnv, c.JobID},
+		{BuildIDEnv, c.BuildID},
+		{AccessTokenEnv, c.AccessToken},
+	} {
+		if required.value == "" {
+			return nil, &VarError{Name: required.name, Err: ErrMissing}
+		}
+	}
+	for _, id := range []struct{ name, value string }{
+		{JobIDEnv, c.JobID},
+		{BuildIDEnv, c.BuildID},
+	} {
+		if strings.ContainsAny(id.value, "/?#% ") {
+			return nil, &VarError{Name: id.name, Err: fmt.Errorf("%w ID %q", ErrInvalid, id.value)}
+		}
+	}
+
+	if err := checkEndpoint(c.Endpoint); err != nil {
+		return nil, &VarError{Name: EndpointEnv, Err: err}
+	}
+
+	// The Job API needs both, or it's not usable
+	if (c.JobAPISocket == "") != (c.JobAPIToken == "") {
+		name := JobAPITokenEnv
+		if c.JobAPISocket == "" {
+			name = JobAPISocketEnv
+		}
+		return nil, &VarError{Name: name, Err: ErrMissing}
+	}
+
+	return c, nil
+}
+
+func checkEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w endpoint %q: %v", ErrInvalid, endpoint, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return fmt.Errorf("%w endpoint %q, expected an http:// or https:// URL", ErrInvalid, endpoint)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%w endpoint %q, it has no host", ErrInvalid, endpoint)
+	}
+	return nil
+}
+
+// HasJobAPI reports whether the job has the Job API
+func (c *Context) HasJobAPI() bool {
+	return c.JobAPISocket != ""
+}
+
+// APIConfig returns the configuration of an Agent API client that acts as
+// the job
+func (c *Context) APIConfig() api.Config {
+	return api.Config{
+		Endpoint:  c.Endpoint,
+		Token:     c.AccessToken,
+		UserAgent: version.UserAgent(),
+	}
+}
@@ -0,0 +1,90 @@
+package jobcontext
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func job(extra map[string]string) map[string]string {
+	env := map[string]string{
+		"BUILDKITE":                    "true",
+		"BUILDKITE_JOB_ID":             "0189b3a4-job",
+		"BUILDKITE_BUILD_ID":           "0189b3a4-build",
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	return env
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	got, err := Resolve(lookupIn(job(map[string]string{
+		"BUILDKITE_AGENT_JOB_API_SOCKET": "/tmp/job-api.sock",
+		"BUILDKITE_AGENT_JOB_API_TOKEN":  "alpacas",
+	})))
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := &Context{
+		JobID:        "0189b3a4-job",
+		BuildID:      "0189b3a4-build",
+		Endpoint:     DefaultEndpoint,
+		AccessToken:  "llamas",
+		JobAPISocket: "/tmp/job-api.sock",
+		JobAPIToken:  "alpacas",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Resolve() diff (-got +want):\n%s", diff)
+	}
+	if !got.HasJobAPI() {
+		t.Errorf("HasJobAPI() = false, want true")
+	}
+	if conf := got.APIConfig(); conf.Endpoint != DefaultEndpoint || conf.Token != "llamas" {
+		t.Errorf("APIConfig() = %+v, want the endpoint and access token", conf)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := Resolve(lookupIn(map[string]string{"HOME": "/root"})); !errors.Is(err, ErrNotInJob) {
+		t.Errorf("Resolve() outside a job error = %v, want ErrNotInJob", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		env     map[string]string
+		wantVar string
+		wantErr error
+	}{
+		{"no job", job(map[string]string{"BUILDKITE_JOB_ID": ""}), JobIDEnv, ErrMissing},
+		{"no build", job(map[string]string{"BUILDKITE_BUILD_ID": " "}), BuildIDEnv, ErrMissing},
+		{"no token", job(map[string]string{"BUILDKITE_AGENT_ACCESS_TOKEN": ""}), AccessTokenEnv, ErrMissing},
+		{"bad job", job(map[string]string{"BUILDKITE_JOB_ID": "../jobs"}), JobIDEnv, ErrInvalid},
+		{"bad endpoint", job(map[string]string{"BUILDKITE_AGENT_ENDPOINT": "ftp://example.com"}), EndpointEnv, ErrInvalid},
+		{"endpoint without host", job(map[string]string{"BUILDKITE_AGENT_ENDPOINT": "https:///v3"}), EndpointEnv, ErrInvalid},
+		{"half a job API", job(map[string]string{"BUILDKITE_AGENT_JOB_API_SOCKET": "/tmp/job-api.sock"}), JobAPITokenEnv, ErrMissing},
+	} {
+		_, err := Resolve(lookupIn(test.env))
+		var varErr *VarError
+		if !errors.As(err, &varErr) {
+			t.Errorf("%s: Resolve() error = %v, want a *VarError", test.name, err)
+			continue
+		}
+		if varErr.Name != test.wantVar || !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: Resolve() error = %v, want %v for %s", test.name, err, test.wantErr, test.wantVar)
+		}
+	}
+}
@@ -62,7 +62,7 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "buildkite-agent"
 	app.Version = version.Version()
-	app.Commands = []cli.Command{
+	app.Commands = clicommand.WithTelemetry([]cli.Command{
 		clicommand.AcknowledgementsCommand,
 		clicommand.AgentStartCommand,
 		clicommand.AnnotateCommand,
@@ -79,8 +79,19 @@ func main() {
 			Subcommands: []cli.Command{
 				clicommand.ArtifactUploadCommand,
 				clicommand.ArtifactDownloadCommand,
+				clicommand.ArtifactPrefetchCommand,
+				clicommand.ArtifactServeCommand,
 				clicommand.ArtifactSearchCommand,
 				clicommand.ArtifactShasumCommand,
+				clicommand.ArtifactDiffCommand,
+			},
+		},
+		{
+			Name:  "concurrency",
+			Usage: "Limit how many jobs in a build run a command at once",
+			Subcommands: []cli.Command{
+				clicommand.ConcurrencyGateCommand,
+				clicommand.ConcurrencyReleaseCommand,
 			},
 		},
 		{
@@ -93,6 +104,21 @@ func main() {
 				clicommand.EnvUnsetCommand,
 			},
 		},
+		{
+			Name:  "job",
+			Usage: "Interact with the currently running job",
+			Subcommands: []cli.Command{
+				clicommand.JobCancelledCommand,
+				clicommand.JobPhasesCommand,
+			},
+		},
+		{
+			Name:  "lfs",
+			Usage: "Download Git LFS files into the checkout",
+			Subcommands: []cli.Command{
+				clicommand.LFSPullCommand,
+			},
+		},
 		{
 			Name:  "meta-data",
 			Usage: "Get/set data from Buildkite jobs",
@@ -117,6 +143,22 @@ func main() {
 				clicommand.PipelineUploadCommand,
 			},
 		},
+		{
+			Name:  "redactor",
+			Usage: "Redact sensitive values from the job log",
+			Subcommands: []cli.Command{
+				clicommand.RedactorAddCommand,
+			},
+		},
+		{
+			Name:  "retry",
+			Usage: "Request retries of the current job",
+			Subcommands: []cli.Command{
+				clicommand.RetryRequestCommand,
+			},
+		},
+		clicommand.SelftestCommand,
+		clicommand.StatusCommand,
 		{
 			Name:  "step",
 			Usage: "Get or update an attribute of a build step",
@@ -125,8 +167,16 @@ func main() {
 				clicommand.StepUpdateCommand,
 			},
 		},
+		{
+			Name:  "usage",
+			Usage: "Report on the data transferred by jobs on this host",
+			Subcommands: []cli.Command{
+				clicommand.UsageReportCommand,
+			},
+		},
+		clicommand.WaitForCommand,
 		clicommand.BootstrapCommand,
-	}
+	})
 
 	app.ErrWriter = os.Stderr
 
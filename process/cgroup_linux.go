@@ -0,0 +1,57 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// startInCgroup has the process start in its cgroup, so it's limited from
+// the moment it starts, rather than once it's been moved there. It returns a
+// function to close the cgroup with once the process has started.
+func (p *Process) startInCgroup() (func(), error) {
+	if !canStartInCgroup() {
+		return func() {}, nil
+	}
+
+	dir, err := os.Open(p.cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("opening the process's cgroup: %w", err)
+	}
+	if p.command.SysProcAttr == nil {
+		p.command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	p.command.SysProcAttr.UseCgroupFD = true
+	p.command.SysProcAttr.CgroupFD = int(dir.Fd())
+	return func() { _ = dir.Close() }, nil
+}
+
+// addToCgroup moves the process into its cgroup after it's started, on
+// kernels that can't start it there
+func (p *Process) addToCgroup() error {
+	if p.cgroup == "" || canStartInCgroup() {
+		return nil
+	}
+	pid := strconv.Itoa(p.command.Process.Pid)
+	return os.WriteFile(filepath.Join(p.cgroup, "cgroup.procs"), []byte(pid), 0o644)
+}
+
+// canStartInCgroup reports whether the kernel can start processes in a
+// cgroup, which needs clone3 from Linux 5.7
+func canStartInCgroup() bool {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return false
+	}
+	var major, minor int
+	release := strings.TrimRight(string(uname.Release[:]), "\x00")
+	if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 5 || major == 5 && minor >= 7
+}
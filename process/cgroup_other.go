@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import "errors"
+
+func (p *Process) startInCgroup() (func(), error) {
+	return nil, errors.New("starting processes in a cgroup is only supported on Linux")
+}
+
+func (p *Process) addToCgroup() error {
+	return nil
+}
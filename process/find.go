@@ -0,0 +1,19 @@
+package process
+
+import "errors"
+
+// ErrFindNotSupported is returned when processes can't be found on this
+// platform
+var ErrFindNotSupported = errors.New("finding processes isn't supported on this platform")
+
+// Info describes a running process
+type Info struct {
+	PID int
+
+	// Executable is the first argument the process was started with
+	Executable string
+
+	// Command is the whole command line, which can include secrets passed as
+	// arguments, so it shouldn't be logged
+	Command string
+}
@@ -0,0 +1,22 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Lookup returns what's known about a running process
+func Lookup(pid int) (Info, error) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return Info{}, err
+	}
+	executable, _, _ := bytes.Cut(cmdline, []byte{0})
+	return Info{
+		PID:        pid,
+		Executable: string(executable),
+		Command:    strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '}))),
+	}, nil
+}
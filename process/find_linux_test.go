@@ -0,0 +1,26 @@
+package process
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// The command line is visible once the process has finished execing
+	want := Info{PID: cmd.Process.Pid, Executable: "sleep", Command: "sleep 30"}
+	require.Eventually(t, func() bool {
+		info, err := Lookup(cmd.Process.Pid)
+		return err == nil && assert.ObjectsAreEqual(want, info)
+	}, 5*time.Second, 10*time.Millisecond)
+}
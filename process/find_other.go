@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+// Lookup returns what's known about a running process. It's only supported
+// on Linux.
+func Lookup(pid int) (Info, error) {
+	return Info{}, ErrFindNotSupported
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package process
+
+// Orphans returns the processes left running in the process's job object
+// once it's finished. Job objects are only on Windows.
+func (p *Process) Orphans() ([]int, error) {
+	return nil, ErrFindNotSupported
+}
+
+// KillOrphans kills the processes left running in the process's job object.
+// Job objects are only on Windows.
+func (p *Process) KillOrphans() error {
+	return ErrFindNotSupported
+}
@@ -0,0 +1,60 @@
+package process
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// JobObjectBasicProcessIdList, which x/sys/windows doesn't define
+const jobObjectBasicProcessIDList = 3
+
+// Orphans returns the processes left running in the process's job object,
+// which are those it started that haven't exited, once it's finished
+func (p *Process) Orphans() ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.winJobHandle == 0 || p.winJobClosed {
+		return nil, nil
+	}
+
+	// The list is cut short if there are more processes than fit, which
+	// doesn't matter, as they're all killed together
+	var list struct {
+		assigned uint32
+		listed   uint32
+		pids     [1024]uintptr
+	}
+	err := windows.QueryInformationJobObject(windows.Handle(p.winJobHandle), jobObjectBasicProcessIDList,
+		uintptr(unsafe.Pointer(&list)), uint32(unsafe.Sizeof(list)), nil)
+	if err != nil && !errors.Is(err, windows.ERROR_MORE_DATA) {
+		return nil, err
+	}
+
+	pids := make([]int, 0, list.listed)
+	for _, pid := range list.pids[:list.listed] {
+		pids = append(pids, int(pid))
+	}
+	return pids, nil
+}
+
+// KillOrphans kills the processes left running in the process's job object,
+// by closing it
+func (p *Process) KillOrphans() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closeJobObject()
+}
+
+// closeJobObject closes the process's job object, which kills everything in
+// it. p.mu must be held.
+func (p *Process) closeJobObject() error {
+	if p.winJobHandle == 0 || p.winJobClosed {
+		return nil
+	}
+	p.winJobClosed = true
+	return windows.CloseHandle(windows.Handle(p.winJobHandle))
+}
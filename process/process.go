@@ -66,6 +66,31 @@ func ParseSignal(sig string) (Signal, error) {
 	return s, nil
 }
 
+// SignalTarget is which processes are signalled when a process is
+// interrupted or terminated
+type SignalTarget string
+
+const (
+	// SignalProcessGroup signals the process group the process leads
+	SignalProcessGroup SignalTarget = "process-group"
+
+	// SignalSession signals every process in the session the process leads,
+	// which includes children that have moved to their own process groups.
+	// It falls back to the process group on platforms without sessions.
+	SignalSession SignalTarget = "session"
+)
+
+func ParseSignalTarget(target string) (SignalTarget, error) {
+	switch t := SignalTarget(strings.ToLower(target)); t {
+	case "":
+		return SignalProcessGroup, nil
+	case SignalProcessGroup, SignalSession:
+		return t, nil
+	default:
+		return "", fmt.Errorf("Unknown signal target %q, expected %q or %q", target, SignalProcessGroup, SignalSession)
+	}
+}
+
 // Configuration for a Process
 type Config struct {
 	PTY             bool
@@ -78,6 +103,7 @@ type Config struct {
 	Stderr          io.Writer
 	Dir             string
 	InterruptSignal Signal
+	SignalTarget    SignalTarget
 }
 
 // Process is an operating system level process
@@ -92,6 +118,12 @@ type Process struct {
 	started, done chan struct{}
 
 	winJobHandle uintptr
+	winJobClosed bool
+
+	// The cgroup v2 the process starts in, if any
+	cgroup string
+
+	usage ResourceUsage
 }
 
 // New returns a new instance of Process
@@ -102,6 +134,12 @@ func New(l logger.Logger, c Config) *Process {
 	}
 }
 
+// StartInCgroup has the process start in the cgroup v2 at path, which is
+// only supported on Linux. It must be called before Run.
+func (p *Process) StartInCgroup(path string) {
+	p.cgroup = path
+}
+
 // Pid is the pid of the running process
 func (p *Process) Pid() int {
 	return p.pid
@@ -132,6 +170,14 @@ func (p *Process) Run(ctx context.Context) error {
 		p.setupProcessGroup()
 	}
 
+	if p.cgroup != "" {
+		closeCgroup, err := p.startInCgroup()
+		if err != nil {
+			return err
+		}
+		defer closeCgroup()
+	}
+
 	// Configure working dir and fail if it doesn't exist, otherwise
 	// we get confusing errors about fork/exec failing because the file
 	// doesn't exist
@@ -175,6 +221,9 @@ func (p *Process) Run(ctx context.Context) error {
 		defer func() { _ = pty.Close() }()
 
 		p.pid = p.command.Process.Pid
+		if err := p.addToCgroup(); err != nil {
+			p.logger.Error("[Process] Failed to move the process into its cgroup: %v", err)
+		}
 
 		// Signal waiting consumers in Started() by closing the started channel
 		close(p.started)
@@ -216,6 +265,9 @@ func (p *Process) Run(ctx context.Context) error {
 			p.logger.Error("[Process] postStart failed: %v", err)
 		}
 		p.pid = p.command.Process.Pid
+		if err := p.addToCgroup(); err != nil {
+			p.logger.Error("[Process] Failed to move the process into its cgroup: %v", err)
+		}
 
 		// Signal waiting consumers in Started() by closing the started channel
 		close(p.started)
@@ -244,6 +296,7 @@ func (p *Process) Run(ctx context.Context) error {
 	// command runs, has no problems copying stdin, stdout, and stderr, and
 	// exits with a zero exit status.
 	p.waitResult = p.command.Wait()
+	p.usage = resourceUsage(p.command.ProcessState)
 
 	// Signal waiting consumers in Done() by closing the done channel
 	close(p.done)
@@ -131,6 +131,30 @@ func TestProcessRunsAndSignalsStartedAndStopped(t *testing.T) {
 	assertProcessDoesntExist(t, p)
 }
 
+func TestProcessUsage(t *testing.T) {
+	p := process.New(logger.Discard, process.Config{
+		Path: os.Args[0],
+		Env:  []string{"TEST_MAIN=tester"},
+	})
+
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("p.Run() = %v", err)
+	}
+
+	// Elsewhere, CPU time is sampled too coarsely for a short process
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	usage := p.Usage()
+	if usage.CPUTime() <= 0 {
+		t.Errorf("usage.CPUTime() = %v, want > 0", usage.CPUTime())
+	}
+	if usage.MaxRSS <= 0 {
+		t.Errorf("usage.MaxRSS = %d, want > 0", usage.MaxRSS)
+	}
+}
+
 func TestProcessTerminatesWhenContextDoes(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,64 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// sessionProcesses returns the processes in session sid that aren't in the
+// process group of the same ID, which is signalled separately
+func sessionProcesses(sid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			// The process has probably exited
+			continue
+		}
+
+		pgrp, session, err := parseProcStat(stat)
+		if err != nil {
+			return nil, fmt.Errorf("parsing /proc/%d/stat: %w", pid, err)
+		}
+		if session == sid && pgrp != sid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// parseProcStat returns the process group and session IDs from the contents
+// of /proc/<pid>/stat, which starts "pid (comm) state ppid pgrp session"
+func parseProcStat(stat []byte) (pgrp, session int, err error) {
+	// The command name can contain spaces and parentheses, so skip to the
+	// last closing parenthesis
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, 0, fmt.Errorf("no command name in %q", stat)
+	}
+
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("too few fields in %q", stat)
+	}
+
+	if pgrp, err = strconv.Atoi(string(fields[2])); err != nil {
+		return 0, 0, err
+	}
+	if session, err = strconv.Atoi(string(fields[3])); err != nil {
+		return 0, 0, err
+	}
+	return pgrp, session, nil
+}
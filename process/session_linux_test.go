@@ -0,0 +1,29 @@
+package process
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcStat(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		stat          string
+		pgrp, session int
+	}{
+		{"simple", "1234 (bash) S 1 1234 1200 34816 1234 4194560 1317", 1234, 1200},
+		{"command with spaces and parens", "99 (my (weird) cmd) R 98 97 96 0 -1", 97, 96},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pgrp, session, err := parseProcStat([]byte(test.stat))
+			require.NoError(t, err)
+			assert.Equal(t, test.pgrp, pgrp)
+			assert.Equal(t, test.session, session)
+		})
+	}
+
+	_, _, err := parseProcStat([]byte("12 (short) S 1"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package process
+
+// sessionProcesses finds nothing beyond the process group on platforms
+// without /proc, so the session target falls back to the process group
+func sessionProcesses(sid int) ([]int, error) {
+	return nil, nil
+}
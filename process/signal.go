@@ -12,11 +12,23 @@ import (
 
 func (p *Process) setupProcessGroup() {
 	// See https://github.com/kr/pty/issues/35 for context
-	if !p.conf.PTY {
+	if p.conf.PTY {
+		// Processes started in a PTY already lead their own session
+		return
+	}
+
+	if p.conf.SignalTarget == SignalSession {
+		// A session leader also leads a process group of the same ID, so
+		// signalling the process group still works
 		p.command.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
-			Pgid:    0,
+			Setsid: true,
 		}
+		return
+	}
+
+	p.command.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Pgid:    0,
 	}
 }
 
@@ -27,7 +39,9 @@ func (p *Process) postStart() error {
 
 func (p *Process) terminateProcessGroup() error {
 	p.logger.Debug("[Process] Sending signal SIGKILL to PGID: %d", p.pid)
-	return syscall.Kill(-p.pid, syscall.SIGKILL)
+	err := syscall.Kill(-p.pid, syscall.SIGKILL)
+	p.signalSession(syscall.SIGKILL)
+	return err
 }
 
 func (p *Process) interruptProcessGroup() error {
@@ -39,7 +53,31 @@ func (p *Process) interruptProcessGroup() error {
 	}
 
 	p.logger.Debug("[Process] Sending signal %s to PGID: %d", intSignal, p.pid)
-	return syscall.Kill(-p.pid, syscall.Signal(intSignal))
+	err := syscall.Kill(-p.pid, syscall.Signal(intSignal))
+	p.signalSession(syscall.Signal(intSignal))
+	return err
+}
+
+// signalSession sends sig to the processes in the session led by the
+// process that aren't in its process group, if the signal target is the
+// session
+func (p *Process) signalSession(sig syscall.Signal) {
+	if p.conf.SignalTarget != SignalSession {
+		return
+	}
+
+	pids, err := sessionProcesses(p.pid)
+	if err != nil {
+		p.logger.Warn("[Process] Couldn't find the processes in session %d, only the process group was signalled: %v", p.pid, err)
+		return
+	}
+
+	for _, pid := range pids {
+		p.logger.Debug("[Process] Sending signal %s to PID %d in session %d", SignalString(sig), pid, p.pid)
+		if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+			p.logger.Warn("[Process] Failed to signal PID %d: %v", pid, err)
+		}
+	}
 }
 
 func GetPgid(pid int) (int, error) {
@@ -44,3 +44,18 @@ func TestSignalStringWindows(t *testing.T) {
 		assert.Equal(t, row.s, process.SignalString(syscall.Signal(row.n)))
 	}
 }
+
+func TestParseSignalTarget(t *testing.T) {
+	for input, want := range map[string]process.SignalTarget{
+		"":              process.SignalProcessGroup,
+		"process-group": process.SignalProcessGroup,
+		"Session":       process.SignalSession,
+	} {
+		got, err := process.ParseSignalTarget(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	_, err := process.ParseSignalTarget("tree")
+	assert.Error(t, err)
+}
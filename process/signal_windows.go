@@ -72,7 +72,7 @@ func (p *Process) postStart() error {
 
 func (p *Process) terminateProcessGroup() error {
 	p.logger.Debug("[Process] Terminating process tree by destroying job")
-	return windows.CloseHandle(windows.Handle(p.winJobHandle))
+	return p.closeJobObject()
 }
 
 func (p *Process) interruptProcessGroup() error {
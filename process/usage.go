@@ -0,0 +1,44 @@
+package process
+
+import (
+	"os"
+	"time"
+)
+
+// ResourceUsage is what a process, and the descendants it waited for, used
+// while it ran. What the platform can't measure is left as zero.
+type ResourceUsage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// The largest resident set size, in bytes
+	MaxRSS int64
+
+	// Bytes read from and written to storage, rather than from caches
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// CPUTime is the total time spent on a CPU
+func (u ResourceUsage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
+}
+
+// Usage returns the resources the process used. It's only known once the
+// process has finished.
+func (p *Process) Usage() ResourceUsage {
+	return p.usage
+}
+
+func resourceUsage(state *os.ProcessState) ResourceUsage {
+	if state == nil {
+		return ResourceUsage{}
+	}
+
+	u := ResourceUsage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+	}
+	addSysUsage(&u, state.SysUsage())
+	return u
+}
@@ -0,0 +1,13 @@
+package process
+
+import "syscall"
+
+// addSysUsage adds the largest resident set, which is in bytes. IO is
+// counted in operations rather than blocks, so it isn't known in bytes.
+func addSysUsage(u *ResourceUsage, sysUsage any) {
+	ru, ok := sysUsage.(*syscall.Rusage)
+	if !ok {
+		return
+	}
+	u.MaxRSS = int64(ru.Maxrss)
+}
@@ -0,0 +1,15 @@
+package process
+
+import "syscall"
+
+// addSysUsage adds what's in the rusage, where the largest resident set is
+// in kilobytes and IO is counted in 512 byte blocks
+func addSysUsage(u *ResourceUsage, sysUsage any) {
+	ru, ok := sysUsage.(*syscall.Rusage)
+	if !ok {
+		return
+	}
+	u.MaxRSS = int64(ru.Maxrss) * 1024
+	u.BytesRead = int64(ru.Inblock) * 512
+	u.BytesWritten = int64(ru.Oublock) * 512
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package process
+
+// addSysUsage adds nothing beyond CPU time on other platforms
+func addSysUsage(u *ResourceUsage, sysUsage any) {}
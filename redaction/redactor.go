@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"io"
 	"path"
+	"sync"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 )
@@ -19,6 +20,10 @@ import (
 const RedactLengthMin = 6
 
 type Redactor struct {
+	// Guards everything below, since the values to redact can be changed
+	// (e.g. through the job API) while output is being written
+	mu sync.Mutex
+
 	replacement []byte
 
 	// Current offset from the start of the next input segment
@@ -58,6 +63,9 @@ func NewRedactor(output io.Writer, replacement string, needles []string) *Redact
 // We re-use the same Redactor between different hooks and the command
 // We need to reset and update the list of needles between each phase
 func (redactor *Redactor) Reset(needles []string) {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+
 	minNeedleLen := 0
 	maxNeedleLen := 0
 	for _, needle := range needles {
@@ -118,6 +126,9 @@ func (redactor *Redactor) Reset(needles []string) {
 }
 
 func (redactor *Redactor) Write(input []byte) (int, error) {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+
 	// This is the no needles case, for example, Reset([]string{})
 	if redactor.minlen == 0 && redactor.maxlen == 0 {
 		return redactor.output.Write(input)
@@ -273,6 +284,9 @@ func (redactor *Redactor) Write(input []byte) (int, error) {
 // Flush should be called after the final Write. This will Write() anything
 // retained in case of a partial match and reset the output buffer.
 func (redactor *Redactor) Flush() error {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+
 	_, err := redactor.output.Write(redactor.outbuf)
 	redactor.outbuf = redactor.outbuf[:0]
 	return err
@@ -0,0 +1,92 @@
+// Package retrylog logs the attempts made by retriers, when the agent has been
+// asked to with --retry-verbose.
+//
+// It is intended for internal use by buildkite-agent only.
+package retrylog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+)
+
+var (
+	mu sync.RWMutex
+	l  logger.Logger
+)
+
+// Enable logs every failed attempt made by a wrapped retrier callback to the
+// given logger.
+func Enable(logger logger.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	l = logger
+}
+
+// Disable stops logging attempts.
+func Disable() {
+	Enable(nil)
+}
+
+// Wrap returns a roko callback that calls fn, and if it fails, logs what was
+// being attempted, the cause of the failure, the attempt number and the delay
+// before the next attempt. It does nothing extra unless Enable has been
+// called.
+func Wrap(what string, fn func(*roko.Retrier) error) func(*roko.Retrier) error {
+	return func(r *roko.Retrier) error {
+		err := fn(r)
+		if err == nil {
+			return nil
+		}
+
+		mu.RLock()
+		logger := l
+		mu.RUnlock()
+
+		if logger != nil {
+			logger.Warn("%s failed (%s): %v %s", what, Cause(err), err, describe(r))
+		}
+		return err
+	}
+}
+
+// describe returns the attempt number and what happens next. roko works out
+// whether it will give up after the callback returns, so breaking out is the
+// only case that can be detected here.
+func describe(r *roko.Retrier) string {
+	if r.ShouldGiveUp() {
+		return fmt.Sprintf("Attempt %d, not retrying", r.AttemptCount()+1)
+	}
+	return r.String()
+}
+
+// Cause returns a short description of what kind of error err is.
+func Cause(err error) string {
+	var errResp *api.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return fmt.Sprintf("HTTP %d", errResp.Response.StatusCode)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network error"
+	}
+
+	return "error"
+}
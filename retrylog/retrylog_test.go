@@ -0,0 +1,76 @@
+package retrylog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapLogsFailedAttempts(t *testing.T) {
+	l := logger.NewBuffer()
+	Enable(l)
+	defer Disable()
+
+	attempts := 0
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(time.Second)),
+		roko.WithSleepFunc(func(time.Duration) {}),
+	).DoWithContext(context.Background(), Wrap("Doing a thing", func(r *roko.Retrier) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("llamas")
+		}
+		return nil
+	}))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"[warn] Doing a thing failed (error): llamas Attempt 1/3 Retrying in 1s",
+		"[warn] Doing a thing failed (error): llamas Attempt 2/3 Retrying in 1s",
+	}, l.Messages)
+}
+
+func TestWrapDoesNothingUnlessEnabled(t *testing.T) {
+	l := logger.NewBuffer()
+	Enable(l)
+	Disable()
+
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(1),
+		roko.WithStrategy(roko.Constant(time.Second)),
+	).DoWithContext(context.Background(), Wrap("Doing a thing", func(r *roko.Retrier) error {
+		return errors.New("llamas")
+	}))
+	assert.Error(t, err)
+	assert.Empty(t, l.Messages)
+}
+
+func TestCause(t *testing.T) {
+	t.Parallel()
+
+	errResp := &api.ErrorResponse{Response: &http.Response{
+		StatusCode: 502,
+		Request:    &http.Request{Method: "GET"},
+	}}
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{err: fmt.Errorf("wrapped: %w", errResp), want: "HTTP 502"},
+		{err: context.DeadlineExceeded, want: "timeout"},
+		{err: context.Canceled, want: "canceled"},
+		{err: errors.New("llamas"), want: "error"},
+	} {
+		assert.Equal(t, tc.want, Cause(tc.err), "Cause(%v)", tc.err)
+	}
+}
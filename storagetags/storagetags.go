@@ -0,0 +1,230 @@
+// Package storagetags tags the requests the agent makes to artifact storage,
+// such as S3, Google Cloud Storage and Artifactory, so that their access logs
+// and cost tools can attribute artifact traffic to a pipeline, queue or team.
+// It does nothing unless BUILDKITE_ARTIFACT_REQUEST_TAGS or
+// BUILDKITE_ARTIFACT_REQUEST_HEADERS is set.
+//
+// BUILDKITE_ARTIFACT_REQUEST_TAGS is a comma separated list of tags, which are
+// added to the User-Agent of each request, as storage access logs record it.
+// A tag is either name=value, or one of these names on its own, which takes
+// its value from the job:
+//
+//   - pipeline: the pipeline's slug
+//   - queue: the agent's queue
+//   - organization: the organization's slug
+//   - step: the step's key
+//
+// so "pipeline,queue,team=payments" adds "pipeline/my-app queue/default
+// team/payments" to the User-Agent.
+//
+// BUILDKITE_ARTIFACT_REQUEST_HEADERS is a comma separated list of Name=value
+// headers to add to each request, such as "X-Team=payments". Headers that
+// storage services expect to be signed, such as x-amz-*, can't be added.
+//
+// It is intended for internal use by buildkite-agent only.
+package storagetags
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/version"
+)
+
+// The environment variables requests are tagged with
+const (
+	TagsEnvVar    = "BUILDKITE_ARTIFACT_REQUEST_TAGS"
+	HeadersEnvVar = "BUILDKITE_ARTIFACT_REQUEST_HEADERS"
+)
+
+// The tags that take their value from the job, and where it comes from
+var jobTags = map[string]string{
+	"pipeline":     "BUILDKITE_PIPELINE_SLUG",
+	"queue":        "BUILDKITE_AGENT_META_DATA_QUEUE",
+	"organization": "BUILDKITE_ORGANIZATION_SLUG",
+	"step":         "BUILDKITE_STEP_KEY",
+}
+
+// Headers with these prefixes are signed by the storage services that read
+// them, so adding them after a request has been signed would break it
+var signedHeaderPrefixes = []string{"x-amz-", "x-goog-", "x-ms-"}
+
+// Config is how requests are tagged
+type Config struct {
+	// Added to the User-Agent of each request, such as "team/payments"
+	UserAgent string
+
+	// Added to each request
+	Headers http.Header
+}
+
+// Parse parses the tags and headers to add to requests, looking up the
+// values of job tags with getenv
+func Parse(tags, headers string, getenv func(string) string) (Config, error) {
+	var conf Config
+
+	var products []string
+	for _, tag := range splitList(tags) {
+		name, value, ok := strings.Cut(tag, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			envVar, known := jobTags[name]
+			if !known {
+				return Config{}, fmt.Errorf("invalid %s tag %q, expected name=value or one of %s", TagsEnvVar, tag, strings.Join(jobTagNames(), ", "))
+			}
+			value = getenv(envVar)
+			if value == "" {
+				// Outside of a job, there's nothing to tag it with
+				continue
+			}
+		}
+		if name == "" {
+			return Config{}, fmt.Errorf("invalid %s tag %q, it has no name", TagsEnvVar, tag)
+		}
+		products = append(products, userAgentToken(name)+"/"+userAgentToken(value))
+	}
+	conf.UserAgent = strings.Join(products, " ")
+
+	for _, header := range splitList(headers) {
+		name, value, ok := strings.Cut(header, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return Config{}, fmt.Errorf("invalid %s header %q, expected Name=value", HeadersEnvVar, header)
+		}
+		for _, prefix := range signedHeaderPrefixes {
+			if strings.HasPrefix(strings.ToLower(name), prefix) {
+				return Config{}, fmt.Errorf("invalid %s header %q, %s headers have to be signed, so can't be added", HeadersEnvVar, header, prefix+"*")
+			}
+		}
+		if conf.Headers == nil {
+			conf.Headers = http.Header{}
+		}
+		conf.Headers.Add(name, strings.TrimSpace(value))
+	}
+
+	return conf, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func jobTagNames() []string {
+	names := make([]string, 0, len(jobTags))
+	for name := range jobTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// userAgentToken replaces the characters that can't be in a User-Agent
+// product, such as spaces and slashes, with dashes
+func userAgentToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '_' || r == '-' || r == '+':
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(s))
+}
+
+var (
+	fromEnvOnce sync.Once
+	fromEnv     *Config
+)
+
+// load reads the environment once, and returns nil if requests aren't tagged,
+// including when the environment can't be parsed, which Check reports
+func load() *Config {
+	fromEnvOnce.Do(func() {
+		tags, headers := os.Getenv(TagsEnvVar), os.Getenv(HeadersEnvVar)
+		if tags == "" && headers == "" {
+			return
+		}
+		conf, err := Parse(tags, headers, os.Getenv)
+		if err != nil || (conf.UserAgent == "" && len(conf.Headers) == 0) {
+			return
+		}
+		fromEnv = &conf
+	})
+	return fromEnv
+}
+
+// Check returns what requests are tagged with, and an error if the
+// environment can't be parsed, in which case they aren't tagged
+func Check() (Config, error) {
+	return Parse(os.Getenv(TagsEnvVar), os.Getenv(HeadersEnvVar), os.Getenv)
+}
+
+// Transport tags the requests of the transport it wraps
+type Transport struct {
+	Delegate http.RoundTripper
+
+	conf Config
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.conf.UserAgent != "" {
+		userAgent := req.Header.Get("User-Agent")
+		if userAgent == "" {
+			userAgent = version.UserAgent()
+		}
+
+		// A client can be wrapped more than once on its way to a request
+		if !strings.HasSuffix(userAgent, t.conf.UserAgent) {
+			req.Header.Set("User-Agent", userAgent+" "+t.conf.UserAgent)
+		}
+	}
+	for name, values := range t.conf.Headers {
+		req.Header[name] = values
+	}
+	return t.Delegate.RoundTrip(req)
+}
+
+// Wrap returns rt with its requests tagged, if requests are tagged, and
+// otherwise returns rt as it is
+func Wrap(rt http.RoundTripper) http.RoundTripper {
+	conf := load()
+	if conf == nil {
+		return rt
+	}
+	return wrap(*conf, rt)
+}
+
+func wrap(conf Config, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{Delegate: rt, conf: conf}
+}
+
+// Client returns a copy of client with its requests tagged, if requests are
+// tagged, and otherwise returns client as it is. A nil client is treated as
+// http.DefaultClient.
+func Client(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rt := Wrap(client.Transport)
+	if rt == client.Transport {
+		return client
+	}
+	wrapped := *client
+	wrapped.Transport = rt
+	return &wrapped
+}
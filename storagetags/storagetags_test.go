@@ -0,0 +1,81 @@
+package storagetags
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"BUILDKITE_PIPELINE_SLUG":         "my-app",
+		"BUILDKITE_AGENT_META_DATA_QUEUE": "default",
+	}
+	got, err := Parse("pipeline, queue, step, team=payments, cost center=12/34", "X-Team=payments,X-Cost-Center=1234", func(name string) string {
+		return env[name]
+	})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := Config{
+		// There's no step key, so it's left out
+		UserAgent: "pipeline/my-app queue/default team/payments cost-center/12-34",
+		Headers:   http.Header{"X-Team": {"payments"}, "X-Cost-Center": {"1234"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Parse() diff (-want +got):\n%s", diff)
+	}
+
+	for _, tc := range []struct{ tags, headers string }{
+		{tags: "llamas"},
+		{tags: "=payments"},
+		{headers: "X-Team"},
+		{headers: "x-amz-acl=public-read"},
+		{headers: "X-Goog-Meta-Team=payments"},
+	} {
+		if _, err := Parse(tc.tags, tc.headers, func(string) string { return "" }); err == nil {
+			t.Errorf("Parse(%q, %q) error = nil, want an error", tc.tags, tc.headers)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	var userAgent, team string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		userAgent, team = req.Header.Get("User-Agent"), req.Header.Get("X-Team")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	conf := Config{UserAgent: "team/payments", Headers: http.Header{"X-Team": {"payments"}}}
+
+	// Wrapping a client twice tags its requests once
+	client := &http.Client{Transport: wrap(conf, wrap(conf, nil))}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest() error = %v", err)
+	}
+	req.Header.Set("User-Agent", "aws-sdk-go/1.44.0")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error = %v", err)
+	}
+	res.Body.Close()
+
+	if want := "aws-sdk-go/1.44.0 team/payments"; userAgent != want {
+		t.Errorf("User-Agent = %q, want %q", userAgent, want)
+	}
+	if team != "payments" {
+		t.Errorf("X-Team = %q, want %q", team, "payments")
+	}
+	if got := req.Header.Get("User-Agent"); got != "aws-sdk-go/1.44.0" {
+		t.Errorf("the original request's User-Agent = %q, want it unchanged", got)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package system
+
+// DiskUsage isn't supported on this platform.
+func DiskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
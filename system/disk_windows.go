@@ -0,0 +1,16 @@
+package system
+
+import "golang.org/x/sys/windows"
+
+// DiskUsage returns the bytes available to the current user and the total
+// size of the volume that path is on.
+func DiskUsage(path string) (free, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
@@ -1,4 +1,5 @@
-// Package system provides a way to log OS-specific platform information.
+// Package system provides a way to log OS-specific platform information, and
+// to measure the health of the host.
 //
 // It is intended for internal use by buildkite-agent only.
 package system
@@ -0,0 +1,6 @@
+package system
+
+import "errors"
+
+// ErrNotSupported is returned when a metric isn't available on this platform
+var ErrNotSupported = errors.New("not supported on this platform")
@@ -0,0 +1,34 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// LoadAverage returns the 1, 5 and 15 minute load averages.
+func LoadAverage() ([]float64, error) {
+	// vm.loadavg is a struct loadavg { fixpt_t ldavg[3]; long fscale; }
+	b, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 24 {
+		return nil, fmt.Errorf("unexpected vm.loadavg size %d", len(b))
+	}
+
+	scale := float64(binary.LittleEndian.Uint64(b[16:24]))
+	if scale == 0 {
+		return nil, fmt.Errorf("vm.loadavg has no scale")
+	}
+
+	loads := make([]float64, 3)
+	for i := range loads {
+		loads[i] = float64(binary.LittleEndian.Uint32(b[i*4:])) / scale
+	}
+	return loads, nil
+}
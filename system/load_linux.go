@@ -0,0 +1,36 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadAverage returns the 1, 5 and 15 minute load averages.
+func LoadAverage() ([]float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	return parseLoadAvg(string(b))
+}
+
+// parseLoadAvg parses the contents of /proc/loadavg, e.g.
+// "0.20 0.18 0.12 1/80 11206"
+func parseLoadAvg(s string) ([]float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected /proc/loadavg contents %q", s)
+	}
+
+	loads := make([]float64, 3)
+	for i := range loads {
+		l, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing load average %q: %w", fields[i], err)
+		}
+		loads[i] = l
+	}
+	return loads, nil
+}
@@ -0,0 +1,18 @@
+package system
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLoadAvg(t *testing.T) {
+	t.Parallel()
+
+	loads, err := parseLoadAvg("0.20 0.18 0.12 1/80 11206\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.20, 0.18, 0.12}, loads)
+
+	_, err = parseLoadAvg("")
+	assert.Error(t, err)
+}
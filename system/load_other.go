@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package system
+
+// LoadAverage isn't supported on this platform.
+func LoadAverage() ([]float64, error) {
+	return nil, ErrNotSupported
+}
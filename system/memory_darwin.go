@@ -0,0 +1,8 @@
+package system
+
+import "golang.org/x/sys/unix"
+
+// TotalMemory returns the total physical memory of the host in bytes.
+func TotalMemory() (uint64, error) {
+	return unix.SysctlUint64("hw.memsize")
+}
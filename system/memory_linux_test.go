@@ -0,0 +1,19 @@
+package system
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemTotal(t *testing.T) {
+	t.Parallel()
+
+	total, err := parseMemTotal(strings.NewReader("MemTotal:       16315460 kB\nMemFree:         1189148 kB\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(16315460*1024), total)
+
+	_, err = parseMemTotal(strings.NewReader("MemFree: 1 kB\n"))
+	assert.Error(t, err)
+}
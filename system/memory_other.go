@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package system
+
+// TotalMemory isn't supported on this platform.
+func TotalMemory() (uint64, error) {
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,19 @@
+package system
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountTmpfs mounts a tmpfs of at most size bytes at path, which only its
+// owner can use. Mounting needs root, or CAP_SYS_ADMIN.
+func MountTmpfs(path string, size uint64) error {
+	return unix.Mount("tmpfs", path, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, fmt.Sprintf("size=%d,mode=0700", size))
+}
+
+// UnmountTmpfs unmounts the tmpfs at path. Processes still using it keep it
+// until they exit.
+func UnmountTmpfs(path string) error {
+	return unix.Unmount(path, unix.MNT_DETACH)
+}
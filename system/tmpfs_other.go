@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+// MountTmpfs isn't supported on this platform.
+func MountTmpfs(path string, size uint64) error {
+	return ErrNotSupported
+}
+
+// UnmountTmpfs isn't supported on this platform.
+func UnmountTmpfs(path string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,168 @@
+// Package telemetry records which buildkite-agent commands and flags are used,
+// for operators who opt in to it.
+//
+// Nothing is recorded or sent unless BUILDKITE_AGENT_TELEMETRY_FILE or
+// BUILDKITE_AGENT_TELEMETRY_ENDPOINT is set. Events only contain the names of
+// commands and flags, never their values, and nothing that identifies the
+// organization, pipeline, job or host.
+//
+// It is intended for internal use by buildkite-agent only.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/version"
+)
+
+const (
+	// FileEnv is the environment variable naming a file that events are
+	// appended to, one JSON object per line
+	FileEnv = "BUILDKITE_AGENT_TELEMETRY_FILE"
+
+	// EndpointEnv is the environment variable naming a URL that events are
+	// POSTed to as JSON
+	EndpointEnv = "BUILDKITE_AGENT_TELEMETRY_ENDPOINT"
+
+	// How long to spend sending an event before giving up on it
+	sendTimeout = 2 * time.Second
+)
+
+// Config says where events are recorded.
+type Config struct {
+	File     string
+	Endpoint string
+}
+
+// ConfigFromEnv loads the telemetry config from the environment.
+func ConfigFromEnv() Config {
+	return Config{
+		File:     os.Getenv(FileEnv),
+		Endpoint: os.Getenv(EndpointEnv),
+	}
+}
+
+// Enabled reports whether events should be recorded at all.
+func (c Config) Enabled() bool {
+	return c.File != "" || c.Endpoint != ""
+}
+
+// Event is a single run of a command.
+type Event struct {
+	Command    string    `json:"command"`
+	Flags      []string  `json:"flags"`
+	Version    string    `json:"version"`
+	OS         string    `json:"os"`
+	Arch       string    `json:"arch"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitStatus int       `json:"exit_status"`
+}
+
+// Recorder records the run of a command from when it's started until it's
+// finished.
+type Recorder struct {
+	conf   Config
+	client *http.Client
+	event  Event
+	once   sync.Once
+}
+
+// Start begins recording a run of command with the named flags set. It
+// returns nil if telemetry isn't enabled. A nil *Recorder can be used, and
+// does nothing.
+func Start(conf Config, command string, flags []string) *Recorder {
+	if !conf.Enabled() {
+		return nil
+	}
+
+	flags = append([]string{}, flags...)
+	sort.Strings(flags)
+
+	return &Recorder{
+		conf:   conf,
+		client: &http.Client{Timeout: sendTimeout},
+		event: Event{
+			Command:   command,
+			Flags:     flags,
+			Version:   version.Version(),
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			StartedAt: time.Now().UTC(),
+		},
+	}
+}
+
+// Finish records the command as having exited with the given status. Only
+// the first call has any effect, so it's safe to call it on every path out of
+// a command. Telemetry must never get in the way of the command, so failing
+// to record the event is returned as an error for logging, not acted on.
+func (r *Recorder) Finish(exitStatus int) error {
+	if r == nil {
+		return nil
+	}
+
+	var err error
+	r.once.Do(func() {
+		r.event.DurationMS = time.Since(r.event.StartedAt).Milliseconds()
+		r.event.ExitStatus = exitStatus
+		err = r.write()
+	})
+	return err
+}
+
+func (r *Recorder) write() error {
+	b, err := json.Marshal(r.event)
+	if err != nil {
+		return err
+	}
+
+	if r.conf.File != "" {
+		f, err := os.OpenFile(r.conf.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening telemetry file: %w", err)
+		}
+		// A single write of a whole line, so that lines from agents
+		// sharing the file don't interleave
+		_, err = f.Write(append(b, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("writing telemetry file: %w", err)
+		}
+	}
+
+	if r.conf.Endpoint != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.conf.Endpoint, bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("creating telemetry request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", version.UserAgent())
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("sending telemetry: %w", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("sending telemetry: %s", resp.Status)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartDisabled(t *testing.T) {
+	t.Parallel()
+
+	r := Start(Config{}, "meta-data get", []string{"job"})
+	assert.Nil(t, r)
+	assert.NoError(t, r.Finish(0))
+}
+
+func TestFinishWritesFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "telemetry.jsonl")
+	conf := Config{File: path}
+
+	assert.NoError(t, Start(conf, "meta-data get", []string{"job", "default"}).Finish(0))
+
+	r := Start(conf, "artifact upload", nil)
+	assert.NoError(t, r.Finish(1))
+	assert.NoError(t, r.Finish(2), "second Finish")
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	assert.NoError(t, scanner.Err())
+
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "meta-data get", events[0].Command)
+		assert.Equal(t, []string{"default", "job"}, events[0].Flags)
+		assert.Equal(t, 0, events[0].ExitStatus)
+
+		assert.Equal(t, "artifact upload", events[1].Command)
+		assert.Equal(t, 1, events[1].ExitStatus)
+	}
+}
+
+func TestFinishPostsToEndpoint(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var e Event
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- e
+	}))
+	defer server.Close()
+
+	err := Start(Config{Endpoint: server.URL}, "annotate", []string{"style"}).Finish(0)
+	assert.NoError(t, err)
+
+	e := <-events
+	assert.Equal(t, "annotate", e.Command)
+	assert.Equal(t, []string{"style"}, e.Flags)
+}
@@ -0,0 +1,93 @@
+// Package testutil provides in-memory stand-ins for the object stores that
+// artifacts are uploaded to and downloaded from, so transfers can be tested
+// without cloud credentials or network access.
+package testutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is an object stored in a fake bucket
+type Object struct {
+	Data        []byte
+	ContentType string
+	Modified    time.Time
+}
+
+// etag is the MD5 of the data, which S3 and GCS use for objects that weren't
+// uploaded in parts
+func (o *Object) etag() string {
+	sum := md5.Sum(o.Data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// serve writes the object to the response, honouring Range requests
+func (o *Object) serve(rw http.ResponseWriter, req *http.Request) {
+	if o.ContentType != "" {
+		rw.Header().Set("Content-Type", o.ContentType)
+	}
+	rw.Header().Set("ETag", o.etag())
+	http.ServeContent(rw, req, "", o.Modified, bytes.NewReader(o.Data))
+}
+
+// buckets holds the objects in each bucket a fake server has
+type buckets struct {
+	mu      sync.Mutex
+	objects map[string]map[string]*Object
+}
+
+func newBuckets(names []string) *buckets {
+	b := &buckets{objects: map[string]map[string]*Object{}}
+	for _, name := range names {
+		b.objects[name] = map[string]*Object{}
+	}
+	return b
+}
+
+func (b *buckets) exists(bucket string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.objects[bucket]
+	return ok
+}
+
+func (b *buckets) put(bucket, key string, obj *Object) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	objects, ok := b.objects[bucket]
+	if !ok {
+		return false
+	}
+	if obj.Modified.IsZero() {
+		obj.Modified = time.Now()
+	}
+	objects[key] = obj
+	return true
+}
+
+func (b *buckets) get(bucket, key string) (*Object, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	obj, ok := b.objects[bucket][key]
+	return obj, ok
+}
+
+func (b *buckets) keys(bucket, prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := []string{}
+	for key := range b.objects[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,323 @@
+package testutil
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GCSServer is an in-memory server for the parts of the Google Cloud Storage
+// JSON API that artifact uploads and downloads use: media, multipart and
+// resumable uploads, and downloads with alt=media. It also issues the OAuth2
+// tokens for the service account in Env, which are accepted without being
+// checked.
+type GCSServer struct {
+	*httptest.Server
+
+	buckets *buckets
+
+	mu          sync.Mutex
+	uploads     map[string]*gcsResumableUpload
+	nextID      int
+	credentials []byte
+}
+
+type gcsResumableUpload struct {
+	bucket   string
+	metadata gcsObject
+	data     []byte
+}
+
+// gcsObject is the object resource of the JSON API
+type gcsObject struct {
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	Size        string `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	MD5Hash     string `json:"md5Hash"`
+	SelfLink    string `json:"selfLink"`
+}
+
+// NewGCSServer starts a server with empty buckets of the given names. Other
+// buckets don't exist.
+func NewGCSServer(buckets ...string) *GCSServer {
+	s := &GCSServer{
+		buckets: newBuckets(buckets),
+		uploads: map[string]*gcsResumableUpload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Env returns the environment variables that point the agent's Google Cloud
+// Storage client at the server, with service account credentials that get
+// their tokens from it
+func (s *GCSServer) Env() (map[string]string, error) {
+	credentials, err := s.credentialsJSON()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"BUILDKITE_GCS_ENDPOINT":                    s.URL,
+		"BUILDKITE_GS_APPLICATION_CREDENTIALS_JSON": string(credentials),
+	}, nil
+}
+
+// credentialsJSON returns a service account key file whose token URI is the
+// server, with a newly generated private key
+func (s *GCSServer) credentialsJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.credentials != nil {
+		return s.credentials, nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating service account key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	s.credentials, err = json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "testutil",
+		"private_key_id": "testutil",
+		"private_key":    string(keyPEM),
+		"client_email":   "testutil@testutil.iam.gserviceaccount.com",
+		"token_uri":      s.URL + "/token",
+	})
+	return s.credentials, err
+}
+
+// PutObject stores an object in a bucket, and returns false if the bucket
+// doesn't exist
+func (s *GCSServer) PutObject(bucket, name string, data []byte) bool {
+	return s.buckets.put(bucket, name, &Object{Data: data})
+}
+
+// Object returns an object in a bucket
+func (s *GCSServer) Object(bucket, name string) (*Object, bool) {
+	return s.buckets.get(bucket, name)
+}
+
+// Names returns the names of the objects in a bucket, in order
+func (s *GCSServer) Names(bucket string) []string {
+	return s.buckets.keys(bucket, "")
+}
+
+func (s *GCSServer) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		writeGCSJSON(rw, http.StatusOK, map[string]interface{}{
+			"access_token": "testutil-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		return
+	}
+
+	const (
+		objectsPrefix = "/storage/v1/b/"
+		uploadPrefix  = "/upload/storage/v1/b/"
+	)
+
+	switch {
+	case strings.HasPrefix(req.URL.Path, uploadPrefix):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, uploadPrefix), "/o")
+		s.upload(rw, req, bucket)
+
+	case strings.HasPrefix(req.URL.Path, objectsPrefix):
+		bucket, name, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, objectsPrefix), "/o/")
+		if !ok || req.Method != http.MethodGet {
+			writeGCSError(rw, http.StatusNotFound, "Not Found")
+			return
+		}
+		obj, ok := s.buckets.get(bucket, name)
+		if !ok {
+			writeGCSError(rw, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		if req.URL.Query().Get("alt") == "media" {
+			obj.serve(rw, req)
+			return
+		}
+		writeGCSJSON(rw, http.StatusOK, s.objectResource(bucket, name, obj))
+
+	default:
+		writeGCSError(rw, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *GCSServer) upload(rw http.ResponseWriter, req *http.Request, bucket string) {
+	if !s.buckets.exists(bucket) {
+		writeGCSError(rw, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+
+	query := req.URL.Query()
+
+	switch {
+	case req.Method == http.MethodPost && query.Get("uploadType") == "media":
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeGCSError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.finishUpload(rw, bucket, gcsObject{Name: query.Get("name"), ContentType: req.Header.Get("Content-Type")}, data)
+
+	case req.Method == http.MethodPost && query.Get("uploadType") == "multipart":
+		metadata, data, err := readGCSMultipart(req)
+		if err != nil {
+			writeGCSError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.finishUpload(rw, bucket, metadata, data)
+
+	case req.Method == http.MethodPost && query.Get("uploadType") == "resumable":
+		var metadata gcsObject
+		if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+			writeGCSError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		if metadata.Name == "" {
+			metadata.Name = query.Get("name")
+		}
+
+		s.mu.Lock()
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &gcsResumableUpload{bucket: bucket, metadata: metadata}
+		s.mu.Unlock()
+
+		rw.Header().Set("Location", fmt.Sprintf("%s%s?uploadType=resumable&upload_id=%s", s.URL, req.URL.Path, id))
+		rw.WriteHeader(http.StatusOK)
+
+	case req.Method == http.MethodPut && query.Get("upload_id") != "":
+		s.resumeUpload(rw, req, query.Get("upload_id"))
+
+	default:
+		writeGCSError(rw, http.StatusBadRequest, "Unsupported upload")
+	}
+}
+
+// resumeUpload appends a chunk to a resumable upload, which is finished once
+// the chunk's Content-Range gives the total size
+func (s *GCSServer) resumeUpload(rw http.ResponseWriter, req *http.Request, id string) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeGCSError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	upload, ok := s.uploads[id]
+	if ok {
+		upload.data = append(upload.data, data...)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeGCSError(rw, http.StatusNotFound, "No such upload")
+		return
+	}
+
+	// Content-Range is "bytes first-last/total", where the total is * until
+	// the last chunk
+	total := req.Header.Get("Content-Range")
+	if i := strings.LastIndex(total, "/"); i >= 0 {
+		total = total[i+1:]
+	}
+	if size, err := strconv.Atoi(total); err != nil || size > len(upload.data) {
+		if len(upload.data) > 0 {
+			rw.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+		rw.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	s.finishUpload(rw, upload.bucket, upload.metadata, upload.data)
+}
+
+func (s *GCSServer) finishUpload(rw http.ResponseWriter, bucket string, metadata gcsObject, data []byte) {
+	if metadata.Name == "" {
+		writeGCSError(rw, http.StatusBadRequest, "Required object name")
+		return
+	}
+	obj := &Object{Data: data, ContentType: metadata.ContentType}
+	s.buckets.put(bucket, metadata.Name, obj)
+	writeGCSJSON(rw, http.StatusOK, s.objectResource(bucket, metadata.Name, obj))
+}
+
+func (s *GCSServer) objectResource(bucket, name string, obj *Object) gcsObject {
+	sum := md5.Sum(obj.Data)
+	return gcsObject{
+		Kind:        "storage#object",
+		Name:        name,
+		Bucket:      bucket,
+		Size:        strconv.Itoa(len(obj.Data)),
+		ContentType: obj.ContentType,
+		MD5Hash:     base64.StdEncoding.EncodeToString(sum[:]),
+		SelfLink:    s.URL + "/storage/v1/b/" + bucket + "/o/" + name,
+	}
+}
+
+// readGCSMultipart reads a multipart/related upload, which is the object's
+// metadata as JSON followed by its data
+func readGCSMultipart(req *http.Request) (gcsObject, []byte, error) {
+	var metadata gcsObject
+
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return metadata, nil, err
+	}
+	mr := multipart.NewReader(req.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return metadata, nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return metadata, nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		return metadata, nil, fmt.Errorf("reading media: %w", err)
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		return metadata, nil, fmt.Errorf("reading media: %w", err)
+	}
+	if metadata.ContentType == "" {
+		metadata.ContentType = part.Header.Get("Content-Type")
+	}
+	return metadata, data, nil
+}
+
+func writeGCSJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeGCSError(rw http.ResponseWriter, status int, message string) {
+	writeGCSJSON(rw, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
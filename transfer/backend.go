@@ -0,0 +1,43 @@
+// Package transfer provides the pieces shared by artifact uploads and
+// downloads.
+//
+// Uploaders and downloaders each used to carry their own copy of the HTTP
+// request, error and checksum handling. A Backend wraps a storage service
+// behind a handful of operations, so that supporting a new service only
+// means implementing this interface.
+//
+// It is intended for internal use by buildkite-agent only.
+package transfer
+
+import (
+	"context"
+	"io"
+)
+
+// FileInfo describes an object stored in a Backend.
+type FileInfo struct {
+	// Size of the object in bytes, or -1 if unknown
+	Size int64
+
+	// The Content-Type the object is stored with, if known
+	ContentType string
+}
+
+// Backend is a place that artifacts can be transferred to or from. The format
+// of the path argument depends on the backend, for example HTTPBackend
+// expects a full URL.
+type Backend interface {
+	// Open returns a reader for the entire object at path. The caller must
+	// close it.
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+
+	// Stat returns information about the object at path without reading it.
+	Stat(ctx context.Context, path string) (FileInfo, error)
+
+	// ReadRange returns a reader for length bytes of the object at path,
+	// starting at offset. The caller must close it.
+	ReadRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+
+	// Write stores size bytes read from r at path.
+	Write(ctx context.Context, path string, r io.Reader, size int64) error
+}
@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// ChecksumAlgorithms are the checksum algorithms that artifacts can be
+// verified with, keyed by the name used to configure them.
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// DefaultChecksumPreference is the order in which checksums are tried when
+// verifying a file, strongest first. SHA-1 is only used for artifacts that
+// were uploaded without a SHA-256 checksum.
+var DefaultChecksumPreference = []string{"sha256", "sha1"}
+
+// ChecksumMismatchError is returned by VerifyFile when a file doesn't match
+// its expected checksum.
+type ChecksumMismatchError struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum of %s is %s, expected %s", e.Algorithm, e.Path, e.Actual, e.Expected)
+}
+
+// ChecksumFile returns the hex encoded checksum of the file at path, using
+// the given hash.
+func ChecksumFile(h hash.Hash, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// VerifyFile checks the file at path against the first algorithm in
+// preference that has a checksum in expected. It returns the algorithm that
+// was used, or an empty string if none of them had an expected checksum.
+func VerifyFile(path string, expected map[string]string, preference []string) (string, error) {
+	for _, algorithm := range preference {
+		want := expected[algorithm]
+		if want == "" {
+			continue
+		}
+
+		newHash, ok := ChecksumAlgorithms[algorithm]
+		if !ok {
+			return "", fmt.Errorf("unknown checksum algorithm %q", algorithm)
+		}
+
+		got, err := ChecksumFile(newHash(), path)
+		if err != nil {
+			return "", err
+		}
+
+		if got != want {
+			return algorithm, &ChecksumMismatchError{
+				Path:      path,
+				Algorithm: algorithm,
+				Expected:  want,
+				Actual:    got,
+			}
+		}
+
+		return algorithm, nil
+	}
+
+	return "", nil
+}
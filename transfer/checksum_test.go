@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "llamas.txt")
+	if err := os.WriteFile(path, []byte("llamas\n"), 0o666); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+	}
+
+	const (
+		wrongSHA1   = "2f25bc4b2e9ab4d3f3b3c5c8e8d3dc29f6d76d6c"
+		wrongSHA256 = "2d7a2b1e1d6e5c3c1f0a0e7de2a3d0e2a29a6ad8a7c8a1a1c3f0f5e6e3a1d2b4"
+	)
+	realSHA256, err := ChecksumFile(ChecksumAlgorithms["sha256"](), path)
+	if err != nil {
+		t.Fatalf("ChecksumFile() error = %v", err)
+	}
+	realSHA1, err := ChecksumFile(ChecksumAlgorithms["sha1"](), path)
+	if err != nil {
+		t.Fatalf("ChecksumFile() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		expected      map[string]string
+		preference    []string
+		wantAlgorithm string
+		wantMismatch  bool
+	}{
+		{
+			name:          "prefers sha256",
+			expected:      map[string]string{"sha1": wrongSHA1, "sha256": realSHA256},
+			preference:    DefaultChecksumPreference,
+			wantAlgorithm: "sha256",
+		},
+		{
+			name:          "falls back to sha1",
+			expected:      map[string]string{"sha1": realSHA1},
+			preference:    DefaultChecksumPreference,
+			wantAlgorithm: "sha1",
+		},
+		{
+			name:          "mismatch",
+			expected:      map[string]string{"sha256": wrongSHA256},
+			preference:    DefaultChecksumPreference,
+			wantAlgorithm: "sha256",
+			wantMismatch:  true,
+		},
+		{
+			name:       "no preferred checksums",
+			expected:   map[string]string{"sha256": wrongSHA256},
+			preference: []string{"sha1"},
+		},
+		{
+			name:       "verification disabled",
+			expected:   map[string]string{"sha256": wrongSHA256},
+			preference: []string{},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			algorithm, err := VerifyFile(path, tc.expected, tc.preference)
+			if algorithm != tc.wantAlgorithm {
+				t.Errorf("VerifyFile() algorithm = %q, want %q", algorithm, tc.wantAlgorithm)
+			}
+
+			var mismatch *ChecksumMismatchError
+			if got := errors.As(err, &mismatch); got != tc.wantMismatch {
+				t.Errorf("VerifyFile() error = %v, want mismatch = %t", err, tc.wantMismatch)
+			}
+		})
+	}
+}
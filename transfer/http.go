@@ -0,0 +1,162 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/buildkite/agent/v3/chaos"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/storageproxy"
+	"github.com/buildkite/agent/v3/storagetags"
+)
+
+// HTTPBackend is a Backend for objects that can be fetched and stored with
+// plain HTTP requests, where each path is a URL. Presigned S3 URLs, the Google
+// Cloud Storage JSON API and Artifactory are all reached this way.
+type HTTPBackend struct {
+	// The HTTP client to use, http.DefaultClient if nil
+	Client *http.Client
+
+	// Headers to add to every request, such as Authorization
+	Header http.Header
+
+	// Used to check each response. If nil, any 2xx or 3xx response is
+	// considered successful, and anything else returns a *StatusError
+	CheckResponse func(*http.Response) error
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// The logger to dump failed responses to
+	Logger logger.Logger
+}
+
+// ErrRangeIgnored is returned by ReadRange when the server sends the whole
+// object rather than the range that was asked for.
+var ErrRangeIgnored = errors.New("range not supported by server")
+
+// StatusError is returned when a request gets an unsuccessful response.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+func (b *HTTPBackend) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	res, err := b.do(ctx, http.MethodGet, url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (b *HTTPBackend) Stat(ctx context.Context, url string) (FileInfo, error) {
+	res, err := b.do(ctx, http.MethodHead, url, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	res.Body.Close()
+
+	return FileInfo{
+		Size:        res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+	}, nil
+}
+
+func (b *HTTPBackend) ReadRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	res, err := b.do(ctx, http.MethodGet, url, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// A server that ignores the Range header sends the whole object, which
+	// we can't hand back as if it were the range
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("range request for %s returned %s, not 206 Partial Content: %w", url, res.Status, ErrRangeIgnored)
+	}
+
+	return res.Body, nil
+}
+
+func (b *HTTPBackend) Write(ctx context.Context, url string, r io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	res, err := b.do(ctx, http.MethodPut, url, r, header)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// do sends a request and checks the response, returning it only if it was
+// successful. The caller is responsible for closing the response body.
+func (b *HTTPBackend) do(ctx context.Context, method, url string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range b.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	// net/http ignores a Content-Length header, so it has to be set on the
+	// request itself for the body to be streamed rather than chunked
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		req.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
+	}
+
+	client := storagetags.Client(chaos.Client(chaos.Artifacts, storageproxy.Client(b.Client)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while requesting %s %s (%T: %v)", method, url, err, err)
+	}
+
+	if err := b.checkResponse(res); err != nil {
+		if b.DebugHTTP && b.Logger != nil {
+			responseDump, dumpErr := httputil.DumpResponse(res, true)
+			if dumpErr != nil {
+				b.Logger.Debug("\nERR: %s\n%s", dumpErr, string(responseDump))
+			} else {
+				b.Logger.Debug("\n%s", string(responseDump))
+			}
+		}
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (b *HTTPBackend) checkResponse(res *http.Response) error {
+	if b.CheckResponse != nil {
+		return b.CheckResponse(res)
+	}
+	if res.StatusCode/100 != 2 && res.StatusCode/100 != 3 {
+		return &StatusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	content := "llamas are the best"
+	var (
+		mu      sync.Mutex
+		written string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer llamas" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/object":
+			if req.Method == http.MethodPut {
+				b, _ := io.ReadAll(req.Body)
+				mu.Lock()
+				written = string(b)
+				mu.Unlock()
+				return
+			}
+			http.ServeContent(rw, req, "object.txt", time.Time{}, strings.NewReader(content))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	b := &HTTPBackend{
+		Header: http.Header{"Authorization": []string{"Bearer llamas"}},
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		r, err := b.Open(ctx, server.URL+"/object")
+		if err != nil {
+			t.Fatalf("b.Open() error = %v", err)
+		}
+		defer r.Close()
+
+		got, _ := io.ReadAll(r)
+		if string(got) != content {
+			t.Errorf("b.Open() read %q, want %q", got, content)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := b.Stat(ctx, server.URL+"/object")
+		if err != nil {
+			t.Fatalf("b.Stat() error = %v", err)
+		}
+		if info.Size != int64(len(content)) {
+			t.Errorf("b.Stat() Size = %d, want %d", info.Size, len(content))
+		}
+	})
+
+	t.Run("ReadRange", func(t *testing.T) {
+		r, err := b.ReadRange(ctx, server.URL+"/object", 3, 3)
+		if err != nil {
+			t.Fatalf("b.ReadRange() error = %v", err)
+		}
+		defer r.Close()
+
+		got, _ := io.ReadAll(r)
+		if string(got) != "mas" {
+			t.Errorf("b.ReadRange() read %q, want %q", got, "mas")
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		if err := b.Write(ctx, server.URL+"/object", strings.NewReader("alpacas"), 7); err != nil {
+			t.Fatalf("b.Write() error = %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if written != "alpacas" {
+			t.Errorf("server received %q, want %q", written, "alpacas")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := b.Open(ctx, server.URL+"/missing")
+
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("b.Open() error = %v, want a *StatusError", err)
+		}
+		if statusErr.StatusCode != http.StatusNotFound {
+			t.Errorf("StatusError.StatusCode = %d, want %d", statusErr.StatusCode, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottledReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3000)
+
+	// The first second's worth is allowed straight away, then the rest
+	// takes at least another second
+	start := time.Now()
+	got, err := io.ReadAll(NewThrottledReader(context.Background(), bytes.NewReader(data), 1500))
+	if err != nil {
+		t.Fatalf("io.ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("io.ReadAll() read %d bytes, want %d", len(got), len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("reading 3000 bytes at 1500 bytes per second took %v, want at least 1s", elapsed)
+	}
+}
+
+func TestThrottledReaderUnlimited(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if got := NewThrottledReader(context.Background(), r, 0); got != r {
+		t.Errorf("NewThrottledReader(ctx, r, 0) = %v, want r unchanged", got)
+	}
+}
@@ -0,0 +1,214 @@
+// Package usage keeps local records of the data jobs transfer, so it can be
+// attributed to the pipelines and queues that transferred it.
+//
+// It is intended for internal use by buildkite-agent only.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of transfer that are recorded
+const (
+	ArtifactUpload   = "artifact_upload"
+	ArtifactDownload = "artifact_download"
+)
+
+// Record is the data one command transferred of one kind. Records are stored
+// one per line, as JSON.
+type Record struct {
+	Time         time.Time `json:"time"`
+	Organization string    `json:"organization,omitempty"`
+	Pipeline     string    `json:"pipeline"`
+	Queue        string    `json:"queue"`
+	JobID        string    `json:"job_id,omitempty"`
+	Kind         string    `json:"kind"`
+	Bytes        int64     `json:"bytes"`
+	Files        int64     `json:"files"`
+}
+
+// Recorder totals the data transferred by a command, then appends the totals
+// to the records file when it's flushed. A nil Recorder records nothing.
+type Recorder struct {
+	path     string
+	template Record
+
+	mu     sync.Mutex
+	totals map[string]*Record
+}
+
+// NewRecorder returns a Recorder that appends to the records file at path,
+// with records that are attributed like template
+func NewRecorder(path string, template Record) *Recorder {
+	return &Recorder{
+		path:     path,
+		template: template,
+		totals:   make(map[string]*Record),
+	}
+}
+
+// Add records that a file of the given size was transferred
+func (r *Recorder) Add(kind string, bytes int64) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total, ok := r.totals[kind]
+	if !ok {
+		rec := r.template
+		rec.Kind = kind
+		total = &rec
+		r.totals[kind] = total
+	}
+	total.Bytes += bytes
+	total.Files++
+}
+
+// Flush appends the totals so far to the records file
+func (r *Recorder) Flush() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.totals) == 0 {
+		return nil
+	}
+
+	kinds := make([]string, 0, len(r.totals))
+	for kind := range r.totals {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	now := time.Now().UTC()
+	var buf []byte
+	for _, kind := range kinds {
+		rec := *r.totals[kind]
+		rec.Time = now
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o777); err != nil {
+		return err
+	}
+
+	// Records are appended with a single write, so that several agents on
+	// the same host can share the file without their records interleaving
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	r.totals = make(map[string]*Record)
+	return nil
+}
+
+// Read returns the records in the file at path from since onwards. Lines that
+// can't be parsed, such as one cut short by a full disk, are skipped.
+func Read(path string, since time.Time) ([]Record, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.Time.Before(since) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// Summary is the data a pipeline transferred on a queue
+type Summary struct {
+	Organization    string `json:"organization,omitempty"`
+	Pipeline        string `json:"pipeline"`
+	Queue           string `json:"queue"`
+	UploadedBytes   int64  `json:"uploaded_bytes"`
+	UploadedFiles   int64  `json:"uploaded_files"`
+	DownloadedBytes int64  `json:"downloaded_bytes"`
+	DownloadedFiles int64  `json:"downloaded_files"`
+}
+
+// Summarize totals records by organization, pipeline and queue, with the
+// pipelines that transferred the most first
+func Summarize(records []Record) []Summary {
+	type key struct{ org, pipeline, queue string }
+
+	byKey := make(map[key]*Summary)
+	for _, rec := range records {
+		k := key{rec.Organization, rec.Pipeline, rec.Queue}
+		s, ok := byKey[k]
+		if !ok {
+			s = &Summary{Organization: rec.Organization, Pipeline: rec.Pipeline, Queue: rec.Queue}
+			byKey[k] = s
+		}
+		switch rec.Kind {
+		case ArtifactUpload:
+			s.UploadedBytes += rec.Bytes
+			s.UploadedFiles += rec.Files
+		case ArtifactDownload:
+			s.DownloadedBytes += rec.Bytes
+			s.DownloadedFiles += rec.Files
+		}
+	}
+
+	summaries := make([]Summary, 0, len(byKey))
+	for _, s := range byKey {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if ta, tb := a.UploadedBytes+a.DownloadedBytes, b.UploadedBytes+b.DownloadedBytes; ta != tb {
+			return ta > tb
+		}
+		if a.Organization != b.Organization {
+			return a.Organization < b.Organization
+		}
+		if a.Pipeline != b.Pipeline {
+			return a.Pipeline < b.Pipeline
+		}
+		return a.Queue < b.Queue
+	})
+	return summaries
+}
@@ -0,0 +1,66 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderFlushAndRead(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "usage", "records.jsonl")
+
+	web := NewRecorder(path, Record{Pipeline: "web", Queue: "default"})
+	web.Add(ArtifactUpload, 100)
+	web.Add(ArtifactUpload, 50)
+	web.Add(ArtifactDownload, 10)
+	require.NoError(t, web.Flush())
+
+	// Flushing again doesn't record anything twice
+	require.NoError(t, web.Flush())
+
+	api := NewRecorder(path, Record{Pipeline: "api", Queue: "large"})
+	api.Add(ArtifactDownload, 1000)
+	require.NoError(t, api.Flush())
+
+	// Partial lines are skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":"20`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	records, err := Read(path, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, []Summary{
+		{Pipeline: "api", Queue: "large", DownloadedBytes: 1000, DownloadedFiles: 1},
+		{Pipeline: "web", Queue: "default", UploadedBytes: 150, UploadedFiles: 2, DownloadedBytes: 10, DownloadedFiles: 1},
+	}, Summarize(records))
+
+	records, err = Read(path, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestNilRecorder(t *testing.T) {
+	t.Parallel()
+
+	var r *Recorder
+	r.Add(ArtifactUpload, 100)
+	assert.NoError(t, r.Flush())
+}
+
+func TestReadMissingFile(t *testing.T) {
+	t.Parallel()
+
+	records, err := Read(filepath.Join(t.TempDir(), "missing.jsonl"), time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}